@@ -0,0 +1,124 @@
+package main
+
+import (
+	"admin-service/internal/auth"
+	"admin-service/internal/db"
+	"admin-service/internal/middleware"
+	"admin-service/internal/users"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newLockoutRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	t.Setenv("ADMIN_LOCKOUT_THRESHOLD", "3")
+	t.Setenv("AUTH_LOCKOUT_THRESHOLD", "3")
+	setupTwoFactorTestDB(t)
+	r := newTwoFactorRouter()
+	api := r.Group("/admin")
+	api.Use(middleware.JWTAuth(), middleware.RequireAdmin())
+	api.GET("/lockouts", auth.LockoutsHandler)
+	api.DELETE("/admins/:id/lockout", auth.UnlockAdminHandler)
+	api.DELETE("/users/:id/lockout", users.Unlock)
+	return r
+}
+
+func TestAdminLoginLockout(t *testing.T) {
+	r := newLockoutRouter(t)
+	root, err := auth.CreateAdminUser("root", "root-password", "super_admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops, err := auth.CreateAdminUser("ops", "ops-password", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, body := doJSON(t, r, http.MethodPost, "/admin/login", "", map[string]string{"username": "root", "password": "root-password"})
+	rootToken, _ := body["token"].(string)
+
+	wrong := map[string]string{"username": "ops", "password": "guess"}
+	for i := 0; i < 3; i++ {
+		if code, _ := doJSON(t, r, http.MethodPost, "/admin/login", "", wrong); code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: %d", i+1, code)
+		}
+	}
+
+	// Locked: even the right password is refused, whatever the client IP.
+	req := httptest.NewRequest(http.MethodPost, "/admin/login", strings.NewReader(`{"username":"ops","password":"ops-password"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = "203.0.113.9:4000"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("locked login: %d %q %s", w.Code, w.Header().Get("Retry-After"), w.Body)
+	}
+
+	code, body := doJSON(t, r, http.MethodGet, "/admin/lockouts", rootToken, nil)
+	admins, _ := body["admins"].([]interface{})
+	if code != http.StatusOK || len(admins) != 1 || admins[0].(map[string]interface{})["locked"] != true {
+		t.Fatalf("lockouts: %d %v", code, body)
+	}
+
+	_, body = doJSON(t, r, http.MethodPost, "/admin/login", "", map[string]string{"username": "ops", "password": "ops-password"})
+	opsToken, _ := body["token"].(string)
+	if opsToken != "" {
+		t.Fatal("locked admin got a token")
+	}
+	if code, _ := doJSON(t, r, http.MethodDelete, "/admin/admins/"+ops.ID+"/lockout", rootToken, nil); code != http.StatusOK {
+		t.Fatalf("unlock: %d", code)
+	}
+	code, body = doJSON(t, r, http.MethodPost, "/admin/login", "", map[string]string{"username": "ops", "password": "ops-password"})
+	if code != http.StatusOK || body["token"] == nil {
+		t.Fatalf("login after unlock: %d %v", code, body)
+	}
+
+	// Only super admins unlock admins.
+	if code, _ := doJSON(t, r, http.MethodDelete, "/admin/admins/"+root.ID+"/lockout", body["token"].(string), nil); code != http.StatusForbidden {
+		t.Fatalf("unlock by non-super admin: %d", code)
+	}
+
+	var audited int
+	if err := db.DB.QueryRow(`SELECT COUNT(*) FROM audit_logs WHERE action IN ('admin.lockout', 'admin.unlock')`).Scan(&audited); err != nil {
+		t.Fatal(err)
+	}
+	if audited != 2 {
+		t.Fatalf("expected lockout and unlock in the audit log, got %d", audited)
+	}
+}
+
+func TestUnlockUser(t *testing.T) {
+	r := newLockoutRouter(t)
+	if _, err := db.DB.Exec(`INSERT INTO users (id, username) VALUES ('u1', 'alice')`); err != nil {
+		t.Fatal(err)
+	}
+	// The auth service records user failures; fake three of them, typed
+	// with another case than the stored username.
+	for i := 0; i < 3; i++ {
+		if _, err := auth.UserLockout.Fail("Alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token, _ := auth.GenerateToken(&auth.AdminUser{ID: "a1", Username: "admin", Role: "admin"}, time.Hour)
+	if wait, _ := auth.UserLockout.Check("alice"); wait <= 0 {
+		t.Fatal("alice should be locked")
+	}
+	if code, _ := doJSON(t, r, http.MethodDelete, "/admin/users/missing/lockout", token, nil); code != http.StatusNotFound {
+		t.Fatalf("unknown user: %d", code)
+	}
+	code, body := doJSON(t, r, http.MethodDelete, "/admin/users/u1/lockout", token, nil)
+	if code != http.StatusOK || body["had_failures"] != true {
+		t.Fatalf("unlock: %d %v", code, body)
+	}
+	if wait, _ := auth.UserLockout.Check("alice"); wait != 0 {
+		t.Fatalf("alice still waits %v", wait)
+	}
+	var action string
+	if err := db.DB.QueryRow(`SELECT action FROM audit_logs WHERE target_resource = 'users/u1'`).Scan(&action); err != nil || action != "user.unlock" {
+		t.Fatalf("unlock not audited: %q %v", action, err)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"os"
+	"time"
 
 	auditHandler "admin-service/internal/audit"
 	"admin-service/internal/auth"
@@ -34,6 +35,29 @@ func main() {
 	}
 	defer db.Close()
 
+	if err := auth.InitSigningKeys(""); err != nil {
+		log.Fatal(err)
+	}
+	if err := auth.InitTwoFactor(""); err != nil {
+		log.Fatal(err)
+	}
+	if err := auth.InitLockout(); err != nil {
+		log.Fatal(err)
+	}
+	if err := auth.InitPasswords(); err != nil {
+		log.Fatal(err)
+	}
+	if err := auth.InitSessions(); err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		for now := range time.Tick(time.Hour) {
+			if _, err := auth.RotateKeysIfDue(now); err != nil {
+				log.Printf("rotate admin JWT key: %v", err)
+			}
+		}
+	}()
+
 	if err := auth.EnsureSuperAdmin("admin", "admin"); err != nil {
 		log.Printf("EnsureSuperAdmin: %v", err)
 	}
@@ -59,18 +83,34 @@ func main() {
 	})
 
 	r.POST("/admin/login", auth.LoginHandler)
+	r.POST("/admin/login/2fa", auth.LoginMFAHandler)
+	r.POST("/admin/login/2fa/enroll", auth.LoginEnrollHandler)
+	r.POST("/admin/login/2fa/confirm", auth.LoginConfirmHandler)
 
 	api := r.Group("/admin")
 	api.Use(middleware.JWTAuth(), middleware.RequireAdmin())
 	{
 		api.GET("/me", auth.MeHandler)
 		api.POST("/admins", middleware.Audit("admin.create", "admins"), auth.CreateAdminHandler)
+		api.DELETE("/admins/:id/2fa", auth.ResetAdminMFAHandler)
+		api.DELETE("/admins/:id/lockout", auth.UnlockAdminHandler)
+		api.GET("/lockouts", auth.LockoutsHandler)
+
+		api.GET("/2fa", auth.MFAStatusHandler)
+		api.POST("/2fa/enroll", auth.MFAEnrollHandler)
+		api.POST("/2fa/confirm", auth.MFAConfirmHandler)
+		api.POST("/2fa/disable", auth.MFADisableHandler)
+		api.GET("/2fa/requirements", auth.GetMFARequirementsHandler)
+		api.PUT("/2fa/requirements", auth.PutMFARequirementsHandler)
 
 		api.GET("/users", middleware.Audit("users.list", "users"), users.List)
 		api.POST("/users", middleware.Audit("user.create", "users"), users.Create)
 		api.PUT("/users/:id", middleware.Audit("user.update", "users"), users.Update)
 		api.DELETE("/users/:id", middleware.Audit("user.delete", "users"), users.Delete)
 		api.POST("/users/:id/reset-password", middleware.Audit("user.reset_password", "users"), users.ResetPassword)
+		api.DELETE("/users/:id/2fa", users.ResetTwoFactor)
+		api.DELETE("/users/:id/lockout", users.Unlock)
+		api.DELETE("/users/:id/sessions", users.RevokeSessions)
 
 		api.GET("/departments", middleware.Audit("departments.list", "departments"), departments.List)
 		api.POST("/departments", middleware.Audit("department.create", "departments"), departments.Create)
@@ -108,6 +148,7 @@ func main() {
 	r.GET("/public/channels", channels.ListPublic)
 	r.GET("/public/users", users.List)
 	r.GET("/health", system.Health)
+	r.GET("/.well-known/jwks.json", auth.JWKSHandler)
 
 	port := os.Getenv("PORT")
 	if port == "" {
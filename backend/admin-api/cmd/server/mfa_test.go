@@ -0,0 +1,245 @@
+package main
+
+import (
+	"admin-service/internal/auth"
+	"admin-service/internal/db"
+	"admin-service/internal/middleware"
+	"admin-service/internal/users"
+	"bytes"
+	"encoding/base32"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lan-chat/mfa"
+
+	"github.com/gin-gonic/gin"
+)
+
+func setupTwoFactorTestDB(t *testing.T) {
+	t.Helper()
+	setupRouterTestDB(t)
+	_, err := db.DB.Exec(`
+	CREATE TABLE admin_users (
+		id TEXT PRIMARY KEY, username TEXT UNIQUE NOT NULL, password_hash TEXT NOT NULL,
+		role TEXT NOT NULL, created_at INTEGER NOT NULL, updated_at INTEGER NOT NULL
+	);
+	CREATE TABLE users (
+		id TEXT PRIMARY KEY, username TEXT UNIQUE NOT NULL, full_name TEXT, password_hash TEXT,
+		role_id TEXT, department_id TEXT, created_at INTEGER, updated_at INTEGER
+	);
+	CREATE TABLE audit_logs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT, timestamp INTEGER NOT NULL, actor_id TEXT NOT NULL,
+		actor_username TEXT, action TEXT NOT NULL, target_resource TEXT NOT NULL, details TEXT, ip_address TEXT
+	);`)
+	if err != nil {
+		t.Fatalf("create tables: %v", err)
+	}
+	if err := auth.InitTwoFactor(filepath.Join(t.TempDir(), "admin-totp.key")); err != nil {
+		t.Fatalf("init two-factor: %v", err)
+	}
+	// Keep the backoff between failed attempts out of the way of tests
+	// that submit wrong codes on purpose.
+	t.Setenv("ADMIN_LOCKOUT_BASE_DELAY", "1ns")
+	if err := auth.InitLockout(); err != nil {
+		t.Fatalf("init lockout: %v", err)
+	}
+	if err := auth.InitPasswords(); err != nil {
+		t.Fatalf("init passwords: %v", err)
+	}
+	if err := auth.InitSessions(); err != nil {
+		t.Fatalf("init sessions: %v", err)
+	}
+}
+
+func newTwoFactorRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/admin/login", auth.LoginHandler)
+	r.POST("/admin/login/2fa", auth.LoginMFAHandler)
+	r.POST("/admin/login/2fa/enroll", auth.LoginEnrollHandler)
+	r.POST("/admin/login/2fa/confirm", auth.LoginConfirmHandler)
+	api := r.Group("/admin")
+	api.Use(middleware.JWTAuth(), middleware.RequireAdmin())
+	api.GET("/2fa", auth.MFAStatusHandler)
+	api.PUT("/2fa/requirements", auth.PutMFARequirementsHandler)
+	api.DELETE("/admins/:id/2fa", auth.ResetAdminMFAHandler)
+	api.DELETE("/users/:id/2fa", users.ResetTwoFactor)
+	return r
+}
+
+func doJSON(t *testing.T, r *gin.Engine, method, path, token string, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		_ = json.NewEncoder(&buf).Encode(body)
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	out := map[string]interface{}{}
+	_ = json.Unmarshal(w.Body.Bytes(), &out)
+	return w.Code, out
+}
+
+func currentCode(t *testing.T, secret string, offset int64) string {
+	t.Helper()
+	raw, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatalf("decode secret: %v", err)
+	}
+	return mfa.Code(raw, mfa.Step(time.Now())+offset)
+}
+
+func TestAdminTwoFactorLogin(t *testing.T) {
+	setupTwoFactorTestDB(t)
+	r := newTwoFactorRouter()
+
+	root, err := auth.CreateAdminUser("root", "root-password", "super_admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.CreateAdminUser("ops", "ops-password", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	login := map[string]string{"username": "ops", "password": "ops-password"}
+
+	// Without a requirement the password alone is enough.
+	code, body := doJSON(t, r, http.MethodPost, "/admin/login", "", login)
+	if code != http.StatusOK || body["token"] == nil {
+		t.Fatalf("plain login: %d %v", code, body)
+	}
+
+	_, rootBody := doJSON(t, r, http.MethodPost, "/admin/login", "", map[string]string{"username": "root", "password": "root-password"})
+	rootToken, _ := rootBody["token"].(string)
+	code, body = doJSON(t, r, http.MethodPut, "/admin/2fa/requirements", rootToken, map[string][]string{"admin_role": {"admin"}})
+	if code != http.StatusOK {
+		t.Fatalf("set requirements: %d %v", code, body)
+	}
+
+	// Policy now requires ops to enroll before getting a token.
+	code, body = doJSON(t, r, http.MethodPost, "/admin/login", "", login)
+	if code != http.StatusOK || body["mfa_required"] != true || body["purpose"] != mfa.PurposeEnroll || body["token"] != nil {
+		t.Fatalf("login under policy: %d %v", code, body)
+	}
+	challenge := body["challenge"]
+	code, body = doJSON(t, r, http.MethodPost, "/admin/login/2fa/enroll", "", map[string]interface{}{"challenge": challenge})
+	if code != http.StatusOK || body["otpauth_uri"] == nil {
+		t.Fatalf("enroll: %d %v", code, body)
+	}
+	secret := body["secret"].(string)
+	first := currentCode(t, secret, -1)
+	code, body = doJSON(t, r, http.MethodPost, "/admin/login/2fa/confirm", "", map[string]interface{}{
+		"challenge": challenge, "code": first,
+	})
+	if code != http.StatusOK || body["token"] == nil {
+		t.Fatalf("confirm: %d %v", code, body)
+	}
+	recovery := body["recovery_codes"].([]interface{})
+	if len(recovery) != mfa.RecoveryCodeCount {
+		t.Fatalf("recovery codes: %v", recovery)
+	}
+
+	// Next login asks for a code; wrong and replayed codes are refused.
+	_, body = doJSON(t, r, http.MethodPost, "/admin/login", "", login)
+	if body["purpose"] != mfa.PurposeVerify {
+		t.Fatalf("second login: %v", body)
+	}
+	challenge = body["challenge"]
+	if code, _ := doJSON(t, r, http.MethodPost, "/admin/login/2fa", "", map[string]interface{}{"challenge": challenge, "code": "000000"}); code != http.StatusUnauthorized {
+		t.Fatalf("wrong code: %d", code)
+	}
+	if code, _ := doJSON(t, r, http.MethodPost, "/admin/login/2fa", "", map[string]interface{}{"challenge": challenge, "code": first}); code != http.StatusUnauthorized {
+		t.Fatalf("replayed code: %d", code)
+	}
+	code, body = doJSON(t, r, http.MethodPost, "/admin/login/2fa", "", map[string]interface{}{"challenge": challenge, "code": currentCode(t, secret, 0)})
+	if code != http.StatusOK || body["token"] == nil {
+		t.Fatalf("valid code: %d %v", code, body)
+	}
+	if code, _ := doJSON(t, r, http.MethodPost, "/admin/login/2fa", "", map[string]interface{}{"challenge": challenge, "code": currentCode(t, secret, 1)}); code != http.StatusUnauthorized {
+		t.Fatalf("a completed challenge must not be reused: %d", code)
+	}
+
+	// A recovery code works once.
+	_, body = doJSON(t, r, http.MethodPost, "/admin/login", "", login)
+	code, body = doJSON(t, r, http.MethodPost, "/admin/login/2fa", "", map[string]interface{}{"challenge": body["challenge"], "recovery_code": recovery[0]})
+	if code != http.StatusOK {
+		t.Fatalf("recovery code: %d %v", code, body)
+	}
+	opsToken := body["token"].(string)
+	_, body = doJSON(t, r, http.MethodPost, "/admin/login", "", login)
+	if code, _ := doJSON(t, r, http.MethodPost, "/admin/login/2fa", "", map[string]interface{}{"challenge": body["challenge"], "recovery_code": recovery[0]}); code != http.StatusUnauthorized {
+		t.Fatalf("spent recovery code: %d", code)
+	}
+
+	code, body = doJSON(t, r, http.MethodGet, "/admin/2fa", opsToken, nil)
+	if code != http.StatusOK || body["enabled"] != true || body["required"] != true || body["recovery_codes_left"] != float64(mfa.RecoveryCodeCount-1) {
+		t.Fatalf("status: %d %v", code, body)
+	}
+
+	// Only a super admin can reset another admin's second factor.
+	var id string
+	if err := db.DB.QueryRow(`SELECT id FROM admin_users WHERE username = 'ops'`).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := doJSON(t, r, http.MethodDelete, "/admin/admins/"+root.ID+"/2fa", opsToken, nil); code != http.StatusForbidden {
+		t.Fatalf("admin reset by non-super admin: %d", code)
+	}
+	if code, body := doJSON(t, r, http.MethodDelete, "/admin/admins/"+id+"/2fa", rootToken, nil); code != http.StatusOK {
+		t.Fatalf("reset: %d %v", code, body)
+	}
+	_, body = doJSON(t, r, http.MethodPost, "/admin/login", "", login)
+	if body["purpose"] != mfa.PurposeEnroll {
+		t.Fatalf("after reset the role policy asks to enroll again: %v", body)
+	}
+
+	var audited int
+	if err := db.DB.QueryRow(`SELECT COUNT(*) FROM audit_logs WHERE action IN
+		('2fa.requirements.update', 'admin.2fa.enroll', 'admin.2fa.enable', 'admin.2fa.verify_failed',
+		 'admin.2fa.recovery_code_used', 'admin.2fa.reset', 'admin.login.2fa_challenge')`).Scan(&audited); err != nil {
+		t.Fatal(err)
+	}
+	if audited < 7 {
+		t.Fatalf("expected every 2FA step in the audit log, got %d entries", audited)
+	}
+}
+
+func TestResetUserTwoFactor(t *testing.T) {
+	setupTwoFactorTestDB(t)
+	r := newTwoFactorRouter()
+	if _, err := db.DB.Exec(`INSERT INTO users (id, username) VALUES ('u1', 'alice')`); err != nil {
+		t.Fatal(err)
+	}
+	// Users enroll with the auth service; fake that with its own key.
+	box, _ := mfa.NewBox(make([]byte, 32))
+	store, err := mfa.NewStore(db.DB, mfa.RealmUser, box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Enroll("u1", "alice", "LAN Chat"); err != nil {
+		t.Fatal(err)
+	}
+
+	token, _ := auth.GenerateToken(&auth.AdminUser{ID: "a1", Username: "admin", Role: "admin"}, time.Hour)
+	if code, _ := doJSON(t, r, http.MethodDelete, "/admin/users/missing/2fa", token, nil); code != http.StatusNotFound {
+		t.Fatalf("unknown user: %d", code)
+	}
+	code, body := doJSON(t, r, http.MethodDelete, "/admin/users/u1/2fa", token, nil)
+	if code != http.StatusOK || body["had_2fa"] != true {
+		t.Fatalf("reset: %d %v", code, body)
+	}
+	if st, _ := store.Status("u1"); st.Enabled || st.Pending {
+		t.Fatalf("second factor still present: %+v", st)
+	}
+	var action string
+	if err := db.DB.QueryRow(`SELECT action FROM audit_logs WHERE target_resource = 'users/u1'`).Scan(&action); err != nil || action != "user.2fa.reset" {
+		t.Fatalf("reset not audited: %q %v", action, err)
+	}
+}
@@ -29,6 +29,9 @@ func setupRouterTestDB(t *testing.T) {
 		t.Fatalf("open sqlite: %v", err)
 	}
 	db.DB = conn
+	if err := auth.InitSigningKeys(filepath.Join(t.TempDir(), "admin-jwt-keys.json")); err != nil {
+		t.Fatalf("init signing keys: %v", err)
+	}
 	t.Cleanup(func() {
 		_ = conn.Close()
 	})
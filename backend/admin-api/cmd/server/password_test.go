@@ -0,0 +1,168 @@
+package main
+
+import (
+	"admin-service/internal/auth"
+	"admin-service/internal/db"
+	"admin-service/internal/middleware"
+	"admin-service/internal/users"
+	"net/http"
+	"testing"
+	"time"
+
+	"lan-chat/password"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newUsersRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	api := r.Group("/admin")
+	api.Use(middleware.JWTAuth(), middleware.RequireAdmin())
+	api.POST("/users", users.Create)
+	api.DELETE("/users/:id", users.Delete)
+	api.POST("/users/:id/reset-password", users.ResetPassword)
+	api.DELETE("/users/:id/sessions", users.RevokeSessions)
+	return r
+}
+
+func TestCreateUserPasswordPolicy(t *testing.T) {
+	setupTwoFactorTestDB(t)
+	r := newUsersRouter()
+	token, _ := auth.GenerateToken(&auth.AdminUser{ID: "a1", Username: "admin", Role: "admin"}, time.Hour)
+
+	code, body := doJSON(t, r, http.MethodPost, "/admin/users", token, map[string]string{"username": "alice", "password": "123456789"})
+	if problems, _ := body["problems"].([]interface{}); code != http.StatusBadRequest || len(problems) != 2 {
+		t.Fatalf("weak password: %d %v", code, body)
+	}
+
+	code, body = doJSON(t, r, http.MethodPost, "/admin/users", token, map[string]interface{}{
+		"username": "alice", "password": "Kettle-Orbit-17", "must_change_password": true,
+	})
+	if code != http.StatusCreated {
+		t.Fatalf("create: %d %v", code, body)
+	}
+	if reason, err := auth.UserPasswords.ChangeRequired(body["id"].(string)); err != nil || reason != password.ReasonReset {
+		t.Fatalf("must_change_password not recorded: %q %v", reason, err)
+	}
+
+	// Without a password the user gets a one-time one.
+	code, body = doJSON(t, r, http.MethodPost, "/admin/users", token, map[string]string{"username": "bob"})
+	temporary, _ := body["temporary_password"].(string)
+	if code != http.StatusCreated || temporary == "" || body["must_change"] != true {
+		t.Fatalf("create without password: %d %v", code, body)
+	}
+	if reason, _ := auth.UserPasswords.ChangeRequired(body["id"].(string)); reason != password.ReasonReset {
+		t.Fatalf("one-time password must be changed, got %q", reason)
+	}
+}
+
+func TestResetPasswordIssuesOneTimePassword(t *testing.T) {
+	setupTwoFactorTestDB(t)
+	r := newUsersRouter()
+	token, _ := auth.GenerateToken(&auth.AdminUser{ID: "a1", Username: "admin", Role: "admin"}, time.Hour)
+	code, body := doJSON(t, r, http.MethodPost, "/admin/users", token, map[string]string{"username": "alice", "password": "Kettle-Orbit-17"})
+	if code != http.StatusCreated {
+		t.Fatalf("create: %d %v", code, body)
+	}
+	id := body["id"].(string)
+	if reason, _ := auth.UserPasswords.ChangeRequired(id); reason != "" {
+		t.Fatalf("new user must not change the password: %q", reason)
+	}
+	for i := 0; i < 5; i++ {
+		_, _ = auth.UserLockout.Fail("alice")
+	}
+	insertTestSession(t, "s-alice", id)
+
+	if code, _ := doJSON(t, r, http.MethodPost, "/admin/users/missing/reset-password", token, nil); code != http.StatusNotFound {
+		t.Fatalf("unknown user: %d", code)
+	}
+	code, body = doJSON(t, r, http.MethodPost, "/admin/users/"+id+"/reset-password", token, nil)
+	temporary, _ := body["temporary_password"].(string)
+	if code != http.StatusOK || body["must_change"] != true || len(temporary) < 16 {
+		t.Fatalf("reset: %d %v", code, body)
+	}
+	var hash string
+	if err := db.DB.QueryRow(`SELECT password_hash FROM users WHERE id = ?`, id).Scan(&hash); err != nil {
+		t.Fatal(err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(temporary)) != nil {
+		t.Fatal("stored hash does not match the temporary password")
+	}
+	if reason, _ := auth.UserPasswords.ChangeRequired(id); reason != password.ReasonReset {
+		t.Fatalf("reset must force a change at next login, got %q", reason)
+	}
+	if wait, _ := auth.UserLockout.Check("alice"); wait != 0 {
+		t.Fatalf("reset should lift the lockout, still waits %v", wait)
+	}
+	if body["sessions_revoked"] != float64(1) || sessionRevokeReason(t, "s-alice") != auth.RevokeAdminPassword {
+		t.Fatalf("reset must sign the user out: %v, reason %q", body, sessionRevokeReason(t, "s-alice"))
+	}
+
+	// A second reset hands out a different password.
+	_, again := doJSON(t, r, http.MethodPost, "/admin/users/"+id+"/reset-password", token, nil)
+	if again["temporary_password"] == temporary {
+		t.Fatal("temporary passwords repeat")
+	}
+
+	// Revoking sessions is part of the same transaction: if it fails, the
+	// password and its history stay as they were.
+	var before string
+	if err := db.DB.QueryRow(`SELECT password_hash FROM users WHERE id = ?`, id).Scan(&before); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.DB.Exec(`DROP TABLE auth_sessions`); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := doJSON(t, r, http.MethodPost, "/admin/users/"+id+"/reset-password", token, nil); code != http.StatusInternalServerError {
+		t.Fatalf("reset without a session table: %d", code)
+	}
+	var after string
+	if err := db.DB.QueryRow(`SELECT password_hash FROM users WHERE id = ?`, id).Scan(&after); err != nil || after != before {
+		t.Fatalf("failed reset changed the password (%v)", err)
+	}
+	if err := auth.InitSessions(); err != nil {
+		t.Fatal(err)
+	}
+
+	var details string
+	if err := db.DB.QueryRow(`SELECT details FROM audit_logs WHERE action = 'user.reset_password' AND target_resource = ?`, "users/"+id).Scan(&details); err != nil {
+		t.Fatal(err)
+	}
+	if details != `{"must_change":true,"sessions_revoked":1}` {
+		t.Fatalf("audit details %q", details)
+	}
+
+	if code, _ := doJSON(t, r, http.MethodDelete, "/admin/users/"+id, token, nil); code != http.StatusOK {
+		t.Fatalf("delete: %d", code)
+	}
+	if reason, _ := auth.UserPasswords.ChangeRequired(id); reason != "" {
+		t.Fatalf("state left behind after delete: %q", reason)
+	}
+}
+
+func TestResetPasswordRefusesDirectoryUsers(t *testing.T) {
+	setupTwoFactorTestDB(t)
+	r := newUsersRouter()
+	token, _ := auth.GenerateToken(&auth.AdminUser{ID: "a1", Username: "admin", Role: "admin"}, time.Hour)
+	if _, err := db.DB.Exec(`INSERT INTO users (id, username, password_hash, created_at, updated_at) VALUES ('u-ldap', 'carol', '!', 1, 1)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.DB.Exec(`INSERT INTO user_identities (user_id, provider, external_id, synced_at) VALUES ('u-ldap', 'ldap', 'uid=carol', 1)`); err != nil {
+		t.Fatal(err)
+	}
+	insertTestSession(t, "s-carol", "u-ldap")
+
+	code, body := doJSON(t, r, http.MethodPost, "/admin/users/u-ldap/reset-password", token, nil)
+	if code != http.StatusConflict || body["temporary_password"] != nil {
+		t.Fatalf("reset of a directory user: %d %v", code, body)
+	}
+	var hash string
+	if err := db.DB.QueryRow(`SELECT password_hash FROM users WHERE id = 'u-ldap'`).Scan(&hash); err != nil || hash != "!" {
+		t.Fatalf("refused reset changed the password: %q %v", hash, err)
+	}
+	if reason := sessionRevokeReason(t, "s-carol"); reason != "" {
+		t.Fatalf("refused reset revoked sessions: %q", reason)
+	}
+}
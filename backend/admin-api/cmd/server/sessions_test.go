@@ -0,0 +1,70 @@
+package main
+
+import (
+	"admin-service/internal/auth"
+	"admin-service/internal/db"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// insertTestSession stands in for a login at the auth service.
+func insertTestSession(t *testing.T, id, userID string) {
+	t.Helper()
+	now := time.Now().Unix()
+	if _, err := db.DB.Exec(`INSERT INTO auth_sessions (id, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		id, userID, now, now+3600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sessionRevokeReason(t *testing.T, id string) string {
+	t.Helper()
+	var reason *string
+	if err := db.DB.QueryRow(`SELECT revoke_reason FROM auth_sessions WHERE id = ?`, id).Scan(&reason); err != nil {
+		t.Fatal(err)
+	}
+	if reason == nil {
+		return ""
+	}
+	return *reason
+}
+
+func TestRevokeUserSessions(t *testing.T) {
+	setupTwoFactorTestDB(t)
+	r := newUsersRouter()
+	if _, err := db.DB.Exec(`INSERT INTO users (id, username) VALUES ('u1', 'alice'), ('u2', 'bob')`); err != nil {
+		t.Fatal(err)
+	}
+	insertTestSession(t, "s-laptop", "u1")
+	insertTestSession(t, "s-phone", "u1")
+	insertTestSession(t, "s-bob", "u2")
+	token, _ := auth.GenerateToken(&auth.AdminUser{ID: "a1", Username: "admin", Role: "admin"}, time.Hour)
+
+	if code, _ := doJSON(t, r, http.MethodDelete, "/admin/users/missing/sessions", token, nil); code != http.StatusNotFound {
+		t.Fatalf("unknown user: %d", code)
+	}
+	code, body := doJSON(t, r, http.MethodDelete, "/admin/users/u1/sessions", token, nil)
+	if code != http.StatusOK || body["revoked"] != float64(2) {
+		t.Fatalf("revoke: %d %v", code, body)
+	}
+	for _, id := range []string{"s-laptop", "s-phone"} {
+		if reason := sessionRevokeReason(t, id); reason != auth.RevokeAdmin {
+			t.Fatalf("%s: revoke reason %q", id, reason)
+		}
+	}
+	if reason := sessionRevokeReason(t, "s-bob"); reason != "" {
+		t.Fatalf("another user's session was revoked: %q", reason)
+	}
+	if _, body := doJSON(t, r, http.MethodDelete, "/admin/users/u1/sessions", token, nil); body["revoked"] != float64(0) {
+		t.Fatalf("revoking again should find no active sessions: %v", body)
+	}
+
+	var details string
+	if err := db.DB.QueryRow(`SELECT details FROM audit_logs WHERE action = 'user.sessions.revoke' AND target_resource = 'users/u1' ORDER BY id LIMIT 1`).Scan(&details); err != nil {
+		t.Fatal(err)
+	}
+	if details != `{"revoked":2}` {
+		t.Fatalf("audit details %q", details)
+	}
+}
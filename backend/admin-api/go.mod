@@ -9,6 +9,10 @@ require (
 	github.com/gorilla/websocket v1.5.1
 	github.com/mattn/go-sqlite3 v1.14.22
 	golang.org/x/crypto v0.18.0
+	lan-chat/jwks v0.0.0
+	lan-chat/lockout v0.0.0
+	lan-chat/mfa v0.0.0
+	lan-chat/password v0.0.0
 )
 
 require (
@@ -36,3 +40,11 @@ require (
 	google.golang.org/protobuf v1.30.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace lan-chat/jwks => ../pkg/jwks
+
+replace lan-chat/lockout => ../pkg/lockout
+
+replace lan-chat/mfa => ../pkg/mfa
+
+replace lan-chat/password => ../pkg/password
@@ -2,18 +2,18 @@ package auth
 
 import (
 	"net/http"
-	"os"
 	"time"
 
+	"admin-service/internal/audit"
+
+	"lan-chat/jwks"
+
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 )
 
 const ClaimsKey = "claims"
 
-const JWTSecretEnv = "ADMIN_JWT_SECRET"
-const defaultSecret = "change-me-in-production-local-only"
-
 type Claims struct {
 	UserID   string `json:"user_id"`
 	Username string `json:"username"`
@@ -21,14 +21,6 @@ type Claims struct {
 	jwt.RegisteredClaims
 }
 
-func getSecret() []byte {
-	s := os.Getenv(JWTSecretEnv)
-	if s == "" {
-		s = defaultSecret
-	}
-	return []byte(s)
-}
-
 func GenerateToken(user *AdminUser, expiresIn time.Duration) (string, error) {
 	exp := time.Now().Add(expiresIn)
 	claims := Claims{
@@ -39,16 +31,20 @@ func GenerateToken(user *AdminUser, expiresIn time.Duration) (string, error) {
 			ExpiresAt: jwt.NewNumericDate(exp),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Subject:   user.ID,
+			Issuer:    Issuer,
 		},
 	}
-	t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return t.SignedString(getSecret())
+	kid, key := signingKeys.Signer()
+	t := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	t.Header["kid"] = kid
+	return t.SignedString(key)
 }
 
 func ParseToken(tokenString string) (*Claims, error) {
 	t, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(t *jwt.Token) (interface{}, error) {
-		return getSecret(), nil
-	})
+		kid, _ := t.Header["kid"].(string)
+		return signingKeys.PublicKey(kid)
+	}, jwt.WithValidMethods([]string{jwks.Algorithm}), jwt.WithIssuer(Issuer))
 	if err != nil {
 		return nil, err
 	}
@@ -64,21 +60,28 @@ func LoginHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
 		return
 	}
+	attempt, ok := beginAttempt(c, req.Username)
+	if !ok {
+		return
+	}
+	defer releaseAttempt(attempt)
 	user, err := Login(req.Username, req.Password)
 	if err != nil {
+		_ = audit.Log("", req.Username, "admin.login_failed", "admins", "", c.ClientIP())
+		loginFailed(c, attempt, nil, "password")
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
 		return
 	}
-	token, err := GenerateToken(user, 24*time.Hour)
+	purpose, err := secondFactor(user)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "token generation failed"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "login failed"})
+		return
+	}
+	if purpose != "" {
+		writeChallenge(c, user, purpose)
 		return
 	}
-	c.JSON(http.StatusOK, LoginResponse{
-		Token:     token,
-		User:      *user,
-		ExpiresAt: time.Now().Add(24 * time.Hour).Unix(),
-	})
+	writeLogin(c, user, "")
 }
 
 func MeHandler(c *gin.Context) {
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"lan-chat/jwks"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Admin tokens are signed by this service's own Ed25519 keys, persisted at
+// ADMIN_JWT_KEYS_PATH and rotated every ADMIN_JWT_ROTATE_EVERY. Retired keys
+// keep verifying for TokenTTL so no issued token is cut short.
+const (
+	KeysPathEnv     = "ADMIN_JWT_KEYS_PATH"
+	RotateEveryEnv  = "ADMIN_JWT_ROTATE_EVERY"
+	defaultKeysPath = "data/admin-jwt-keys.json"
+
+	// TokenTTL is the lifetime of admin tokens.
+	TokenTTL = 24 * time.Hour
+	// Issuer is the "iss" of admin tokens, distinct from user access tokens.
+	Issuer = "lan-chat-admin"
+)
+
+var signingKeys *jwks.Keyring
+
+// InitSigningKeys loads or creates the keyring at path, or at
+// ADMIN_JWT_KEYS_PATH when path is empty.
+func InitSigningKeys(path string) error {
+	if path == "" {
+		path = os.Getenv(KeysPathEnv)
+	}
+	if path == "" {
+		path = defaultKeysPath
+	}
+	rotateEvery := 30 * 24 * time.Hour
+	if v := os.Getenv(RotateEveryEnv); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			rotateEvery = d
+		}
+	}
+	keys, err := jwks.OpenKeyring(path, rotateEvery, TokenTTL)
+	if err != nil {
+		return err
+	}
+	signingKeys = keys
+	return nil
+}
+
+// RotateKeysIfDue rotates the signing key once it is older than the
+// rotation interval.
+func RotateKeysIfDue(now time.Time) (bool, error) {
+	return signingKeys.RotateIfDue(now)
+}
+
+// JWKSHandler publishes the public keys that verify admin tokens.
+func JWKSHandler(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, signingKeys.Set())
+}
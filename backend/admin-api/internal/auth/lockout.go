@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"admin-service/internal/audit"
+	"admin-service/internal/db"
+
+	"lan-chat/lockout"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// AdminLockout counts failed admin logins, with the ADMIN_LOCKOUT_*
+	// policy.
+	AdminLockout *lockout.Guard
+	// UserLockout is the auth service's realm, opened with its AUTH_LOCKOUT_*
+	// policy so lists show the same lock times; the admin API only lists
+	// and unlocks it.
+	UserLockout *lockout.Guard
+)
+
+// InitLockout opens the failed-login table for both realms.
+func InitLockout() error {
+	admins, err := lockout.New(db.DB, lockout.RealmAdmin, lockout.PolicyFromEnv("ADMIN"))
+	if err != nil {
+		return err
+	}
+	users, err := lockout.New(db.DB, lockout.RealmUser, lockout.PolicyFromEnv("AUTH"))
+	if err != nil {
+		return err
+	}
+	AdminLockout, UserLockout = admins, users
+	return nil
+}
+
+// beginAttempt reserves a login attempt for username, or writes 429 and
+// reports false while username must wait. Callers defer releaseAttempt.
+func beginAttempt(c *gin.Context, username string) (*lockout.Attempt, bool) {
+	attempt, wait, err := AdminLockout.Begin(username)
+	if err != nil {
+		log.Printf("lockout check %q: %v", username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "login failed"})
+		return nil, false
+	}
+	if attempt == nil {
+		secs := int64((wait + time.Second - 1) / time.Second)
+		c.Header("Retry-After", strconv.FormatInt(secs, 10))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many failed attempts, try again later", "retry_after": secs})
+		return nil, false
+	}
+	return attempt, true
+}
+
+// releaseAttempt refunds an attempt that did not fail.
+func releaseAttempt(attempt *lockout.Attempt) {
+	if err := attempt.Release(); err != nil {
+		log.Printf("lockout release %q: %v", attempt.Username(), err)
+	}
+}
+
+// loginFailed counts a wrong password or code against the attempt and
+// audits the failure that locks the account. user is nil for unknown
+// usernames.
+func loginFailed(c *gin.Context, attempt *lockout.Attempt, user *AdminUser, step string) {
+	res := attempt.Fail()
+	username := attempt.Username()
+	if !res.Locked {
+		return
+	}
+	actorID, target := "", "admins"
+	if user != nil {
+		actorID, target = user.ID, "admins/"+user.ID
+	}
+	_ = audit.LogJSON(actorID, username, "admin.lockout", target, gin.H{
+		"failures": res.Failures, "step": step, "locked_seconds": int64(res.Wait / time.Second),
+	}, c.ClientIP())
+}
+
+// loginSucceeded clears username's failures once a login is complete.
+func loginSucceeded(username string) {
+	if err := AdminLockout.Succeed(username); err != nil {
+		log.Printf("lockout reset %q: %v", username, err)
+	}
+}
+
+type LockoutsResponse struct {
+	Users  []lockout.Entry `json:"users"`
+	Admins []lockout.Entry `json:"admins"`
+}
+
+// LockoutsHandler lists user and admin accounts with recent failed logins.
+func LockoutsHandler(c *gin.Context) {
+	users, err := UserLockout.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	admins, err := AdminLockout.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, LockoutsResponse{Users: users, Admins: admins})
+}
+
+// UnlockAdminHandler clears another admin's failed logins. Only super
+// admins may do this.
+func UnlockAdminHandler(c *gin.Context) {
+	claims := claimsFrom(c)
+	if claims.Role != "super_admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "super admin access required"})
+		return
+	}
+	id := c.Param("id")
+	user, err := GetAdminByID(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	cleared, err := AdminLockout.Unlock(user.Username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	_ = audit.LogJSON(claims.UserID, claims.Username, "admin.unlock", "admins/"+id, gin.H{"had_failures": cleared}, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"ok": true, "had_failures": cleared})
+}
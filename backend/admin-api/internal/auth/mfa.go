@@ -0,0 +1,432 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"admin-service/internal/audit"
+	"admin-service/internal/db"
+
+	"lan-chat/lockout"
+	"lan-chat/mfa"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Admin TOTP secrets are sealed with a key at ADMIN_TOTP_KEY_PATH, kept
+// with the signing keys rather than in the shared database.
+const (
+	TOTPKeyPathEnv     = "ADMIN_TOTP_KEY_PATH"
+	defaultTOTPKeyPath = "data/admin-totp.key"
+
+	// TOTPIssuer is the account name authenticator apps show for admins.
+	TOTPIssuer = "LAN Chat Admin"
+)
+
+var (
+	// AdminTwoFactor holds second factors of admin accounts.
+	AdminTwoFactor *mfa.Store
+	// UserTwoFactor is the auth service's realm; the admin API only reads
+	// its status and resets it, and cannot open the secrets.
+	UserTwoFactor *mfa.Store
+
+	loginChallenges = mfa.NewChallenges(5*time.Minute, 5)
+)
+
+// InitTwoFactor opens the TOTP key at keyPath, or at ADMIN_TOTP_KEY_PATH
+// when keyPath is empty, and the 2FA tables.
+func InitTwoFactor(keyPath string) error {
+	if keyPath == "" {
+		keyPath = os.Getenv(TOTPKeyPathEnv)
+	}
+	if keyPath == "" {
+		keyPath = defaultTOTPKeyPath
+	}
+	box, err := mfa.OpenKeyFile(keyPath)
+	if err != nil {
+		return err
+	}
+	admins, err := mfa.NewStore(db.DB, mfa.RealmAdmin, box)
+	if err != nil {
+		return err
+	}
+	users, err := mfa.NewStore(db.DB, mfa.RealmUser, nil)
+	if err != nil {
+		return err
+	}
+	AdminTwoFactor, UserTwoFactor = admins, users
+	return nil
+}
+
+type MFAChallengeResponse struct {
+	MFARequired bool     `json:"mfa_required"`
+	Challenge   string   `json:"challenge"`
+	Purpose     string   `json:"purpose"`
+	Methods     []string `json:"methods"`
+	ExpiresIn   int64    `json:"expires_in"`
+}
+
+type MFACodeRequest struct {
+	Challenge    string `json:"challenge"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type MFAStatusResponse struct {
+	mfa.Status
+	Required bool `json:"required"`
+}
+
+type MFARequirements struct {
+	Role       []string `json:"role"`
+	Department []string `json:"department"`
+	AdminRole  []string `json:"admin_role"`
+}
+
+func claimsFrom(c *gin.Context) *Claims {
+	val, _ := c.Get(ClaimsKey)
+	claims, _ := val.(*Claims)
+	return claims
+}
+
+// secondFactor returns what an admin with the right password must do
+// next: nothing (""), enter a code, or enroll because their role requires
+// 2FA.
+func secondFactor(user *AdminUser) (string, error) {
+	st, err := AdminTwoFactor.Status(user.ID)
+	if err != nil {
+		return "", err
+	}
+	if st.Enabled {
+		return mfa.PurposeVerify, nil
+	}
+	required, err := AdminTwoFactor.Required(mfa.Requirement{Scope: mfa.ScopeAdminRole, ID: user.Role})
+	if err != nil || !required {
+		return "", err
+	}
+	return mfa.PurposeEnroll, nil
+}
+
+func writeChallenge(c *gin.Context, user *AdminUser, purpose string) {
+	token, err := loginChallenges.Issue(user.ID, purpose)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "challenge failed"})
+		return
+	}
+	_ = audit.LogJSON(user.ID, user.Username, "admin.login.2fa_challenge", "admins/"+user.ID,
+		gin.H{"purpose": purpose}, c.ClientIP())
+	methods := []string{"totp", "recovery_code"}
+	if purpose == mfa.PurposeEnroll {
+		methods = []string{"totp"}
+	}
+	c.JSON(http.StatusOK, MFAChallengeResponse{
+		MFARequired: true,
+		Challenge:   token,
+		Purpose:     purpose,
+		Methods:     methods,
+		ExpiresIn:   int64(loginChallenges.TTL() / time.Second),
+	})
+}
+
+func writeLogin(c *gin.Context, user *AdminUser, method string) {
+	token, err := GenerateToken(user, TokenTTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "token generation failed"})
+		return
+	}
+	loginSucceeded(user.Username)
+	_ = audit.LogJSON(user.ID, user.Username, "admin.login", "admins/"+user.ID, gin.H{"second_factor": method}, c.ClientIP())
+	c.JSON(http.StatusOK, LoginResponse{
+		Token:     token,
+		User:      *user,
+		ExpiresAt: time.Now().Add(TokenTTL).Unix(),
+	})
+}
+
+// pendingChallenge binds the request and returns its challenge's admin and
+// the reserved attempt. Callers defer releaseAttempt.
+func pendingChallenge(c *gin.Context, purpose string) (MFACodeRequest, *AdminUser, *lockout.Attempt, bool) {
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Challenge == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return req, nil, nil, false
+	}
+	ch, ok := loginChallenges.Get(req.Challenge)
+	if !ok || ch.Purpose != purpose {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired challenge"})
+		return req, nil, nil, false
+	}
+	user, err := GetAdminByID(ch.Subject)
+	if err != nil {
+		loginChallenges.Complete(req.Challenge)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+		return req, nil, nil, false
+	}
+	attempt, ok := beginAttempt(c, user.Username)
+	if !ok {
+		return req, nil, nil, false
+	}
+	return req, user, attempt, true
+}
+
+func failChallenge(c *gin.Context, req MFACodeRequest, user *AdminUser, attempt *lockout.Attempt) {
+	left := loginChallenges.Fail(req.Challenge)
+	_ = audit.LogJSON(user.ID, user.Username, "admin.2fa.verify_failed", "admins/"+user.ID,
+		gin.H{"attempts_left": left}, c.ClientIP())
+	loginFailed(c, attempt, user, "2fa")
+	if left == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "too many invalid codes, log in again"})
+		return
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+}
+
+// LoginMFAHandler completes an admin login with a TOTP or recovery code.
+func LoginMFAHandler(c *gin.Context) {
+	req, user, attempt, ok := pendingChallenge(c, mfa.PurposeVerify)
+	if !ok {
+		return
+	}
+	defer releaseAttempt(attempt)
+	method := "totp"
+	var err error
+	if req.RecoveryCode != "" {
+		method = "recovery_code"
+		var left int
+		if left, err = AdminTwoFactor.UseRecoveryCode(user.ID, req.RecoveryCode); err == nil {
+			_ = audit.LogJSON(user.ID, user.Username, "admin.2fa.recovery_code_used", "admins/"+user.ID,
+				gin.H{"recovery_codes_left": left}, c.ClientIP())
+		}
+	} else {
+		err = AdminTwoFactor.Verify(user.ID, req.Code)
+	}
+	switch {
+	case errors.Is(err, mfa.ErrInvalidCode):
+		failChallenge(c, req, user, attempt)
+		return
+	case errors.Is(err, mfa.ErrNotEnrolled):
+		loginChallenges.Complete(req.Challenge)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "two-factor authentication was reset, log in again"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "verification failed"})
+		return
+	}
+	loginChallenges.Complete(req.Challenge)
+	writeLogin(c, user, method)
+}
+
+// LoginEnrollHandler starts the enrollment an admin role requires.
+func LoginEnrollHandler(c *gin.Context) {
+	_, user, attempt, ok := pendingChallenge(c, mfa.PurposeEnroll)
+	if !ok {
+		return
+	}
+	defer releaseAttempt(attempt)
+	enroll(c, user)
+}
+
+// LoginConfirmHandler confirms that enrollment and signs the admin in; the
+// response carries the recovery codes once.
+func LoginConfirmHandler(c *gin.Context) {
+	req, user, attempt, ok := pendingChallenge(c, mfa.PurposeEnroll)
+	if !ok {
+		return
+	}
+	defer releaseAttempt(attempt)
+	codes, err := AdminTwoFactor.Confirm(user.ID, req.Code)
+	switch {
+	case errors.Is(err, mfa.ErrInvalidCode):
+		failChallenge(c, req, user, attempt)
+		return
+	case errors.Is(err, mfa.ErrNotEnrolled):
+		c.JSON(http.StatusConflict, gin.H{"error": "start enrollment first"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "confirmation failed"})
+		return
+	}
+	loginChallenges.Complete(req.Challenge)
+	_ = audit.LogJSON(user.ID, user.Username, "admin.2fa.enable", "admins/"+user.ID, gin.H{"during_login": true}, c.ClientIP())
+	token, err := GenerateToken(user, TokenTTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "token generation failed"})
+		return
+	}
+	loginSucceeded(user.Username)
+	_ = audit.LogJSON(user.ID, user.Username, "admin.login", "admins/"+user.ID, gin.H{"second_factor": "totp"}, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{
+		"token":          token,
+		"user":           user,
+		"expires_at":     time.Now().Add(TokenTTL).Unix(),
+		"recovery_codes": codes,
+	})
+}
+
+func enroll(c *gin.Context, user *AdminUser) {
+	enrollment, err := AdminTwoFactor.Enroll(user.ID, user.Username, TOTPIssuer)
+	if errors.Is(err, mfa.ErrAlreadyEnrolled) {
+		c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication already enabled"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "enrollment failed"})
+		return
+	}
+	_ = audit.Log(user.ID, user.Username, "admin.2fa.enroll", "admins/"+user.ID, "", c.ClientIP())
+	c.JSON(http.StatusOK, enrollment)
+}
+
+// MFAStatusHandler reports the signed-in admin's 2FA state.
+func MFAStatusHandler(c *gin.Context) {
+	claims := claimsFrom(c)
+	st, err := AdminTwoFactor.Status(claims.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	required, err := AdminTwoFactor.Required(mfa.Requirement{Scope: mfa.ScopeAdminRole, ID: claims.Role})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, MFAStatusResponse{Status: st, Required: required})
+}
+
+// MFAEnrollHandler starts enrollment for the signed-in admin.
+func MFAEnrollHandler(c *gin.Context) {
+	user, err := GetAdminByID(claimsFrom(c).UserID)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	enroll(c, user)
+}
+
+// MFAConfirmHandler enables 2FA for the signed-in admin.
+func MFAConfirmHandler(c *gin.Context) {
+	claims := claimsFrom(c)
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	codes, err := AdminTwoFactor.Confirm(claims.UserID, req.Code)
+	if !writeMFAError(c, claims, err) {
+		return
+	}
+	_ = audit.Log(claims.UserID, claims.Username, "admin.2fa.enable", "admins/"+claims.UserID, "", c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// MFADisableHandler turns 2FA off after a final code, unless the admin's
+// role requires it.
+func MFADisableHandler(c *gin.Context) {
+	claims := claimsFrom(c)
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Code == "" && req.RecoveryCode == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	required, err := AdminTwoFactor.Required(mfa.Requirement{Scope: mfa.ScopeAdminRole, ID: claims.Role})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if required {
+		c.JSON(http.StatusForbidden, gin.H{"error": "two-factor authentication is required for your role"})
+		return
+	}
+	if req.RecoveryCode != "" {
+		_, err = AdminTwoFactor.UseRecoveryCode(claims.UserID, req.RecoveryCode)
+	} else {
+		err = AdminTwoFactor.Verify(claims.UserID, req.Code)
+	}
+	if !writeMFAError(c, claims, err) {
+		return
+	}
+	if _, err := AdminTwoFactor.Reset(claims.UserID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	_ = audit.Log(claims.UserID, claims.Username, "admin.2fa.disable", "admins/"+claims.UserID, "", c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func writeMFAError(c *gin.Context, claims *Claims, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, mfa.ErrInvalidCode):
+		_ = audit.Log(claims.UserID, claims.Username, "admin.2fa.verify_failed", "admins/"+claims.UserID, "", c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+	case errors.Is(err, mfa.ErrNotEnrolled):
+		c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication is not enabled"})
+	case errors.Is(err, mfa.ErrAlreadyEnrolled):
+		c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication already enabled"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+	return false
+}
+
+// GetMFARequirementsHandler lists the roles, departments and admin roles
+// that must use 2FA.
+func GetMFARequirementsHandler(c *gin.Context) {
+	reqs, err := AdminTwoFactor.Requirements()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, MFARequirements{
+		Role:       reqs[mfa.ScopeRole],
+		Department: reqs[mfa.ScopeDepartment],
+		AdminRole:  reqs[mfa.ScopeAdminRole],
+	})
+}
+
+// PutMFARequirementsHandler replaces the 2FA requirements. Users and admins
+// in a listed scope without 2FA must enroll at their next login.
+func PutMFARequirementsHandler(c *gin.Context) {
+	claims := claimsFrom(c)
+	var req MFARequirements
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	for scope, ids := range map[string][]string{
+		mfa.ScopeRole:       req.Role,
+		mfa.ScopeDepartment: req.Department,
+		mfa.ScopeAdminRole:  req.AdminRole,
+	} {
+		if err := AdminTwoFactor.SetRequirements(scope, ids, claims.UserID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	_ = audit.LogJSON(claims.UserID, claims.Username, "2fa.requirements.update", "2fa/requirements", req, c.ClientIP())
+	GetMFARequirementsHandler(c)
+}
+
+// ResetAdminMFAHandler removes another admin's second factor so they can
+// enroll again. Only super admins may do this.
+func ResetAdminMFAHandler(c *gin.Context) {
+	claims := claimsFrom(c)
+	if claims.Role != "super_admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "super admin access required"})
+		return
+	}
+	id := c.Param("id")
+	if _, err := GetAdminByID(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if _, err := AdminTwoFactor.Reset(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	_ = audit.Log(claims.UserID, claims.Username, "admin.2fa.reset", "admins/"+id, "", c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
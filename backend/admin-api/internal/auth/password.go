@@ -0,0 +1,26 @@
+package auth
+
+import (
+	"admin-service/internal/db"
+
+	"lan-chat/password"
+)
+
+// UserPasswords is the chat users' password policy and history. It reads
+// the auth service's AUTH_PASSWORD_* settings so passwords set here and
+// there follow the same rules.
+var UserPasswords *password.Store
+
+// InitPasswords opens the password history tables.
+func InitPasswords() error {
+	policy, err := password.PolicyFromEnv("AUTH")
+	if err != nil {
+		return err
+	}
+	store, err := password.NewStore(db.DB, policy)
+	if err != nil {
+		return err
+	}
+	UserPasswords = store
+	return nil
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"database/sql"
+	"time"
+
+	"admin-service/internal/db"
+)
+
+// sessionSchema is the auth service's session table. Both services share
+// the database in deployment; creating it here lets the admin API revoke
+// sessions when it starts first.
+const sessionSchema = `
+	CREATE TABLE IF NOT EXISTS auth_sessions (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		expires_at BIGINT NOT NULL,
+		revoked_at BIGINT,
+		revoke_reason TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_auth_sessions_user ON auth_sessions(user_id);
+`
+
+// identitySchema is the auth service's link from users provisioned by a
+// directory to it; users without a row are local.
+const identitySchema = `
+	CREATE TABLE IF NOT EXISTS user_identities (
+		user_id TEXT PRIMARY KEY,
+		provider TEXT NOT NULL,
+		external_id TEXT NOT NULL,
+		synced_at BIGINT NOT NULL
+	);
+`
+
+// Revoke reasons recorded in auth_sessions; RevokeAdmin matches the auth
+// service's own admin revoke.
+const (
+	RevokeAdmin         = "admin_revoke_all"
+	RevokeAdminPassword = "admin_password_reset"
+)
+
+// InitSessions creates the session and directory identity tables if the
+// auth service has not.
+func InitSessions() error {
+	if _, err := db.DB.Exec(sessionSchema); err != nil {
+		return err
+	}
+	_, err := db.DB.Exec(identitySchema)
+	return err
+}
+
+// IdentityProvider returns the directory that manages userID's password,
+// or "" for a local user.
+func IdentityProvider(userID string) (string, error) {
+	var provider string
+	err := db.DB.QueryRow(`SELECT provider FROM user_identities WHERE user_id = ?`, userID).Scan(&provider)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return provider, err
+}
+
+// execer is satisfied by *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// RevokeUserSessions signs a chat user out everywhere: refresh tokens of
+// the sessions are refused and their access tokens stop working at
+// messaging and the auth service. It returns how many sessions were active.
+func RevokeUserSessions(ex execer, userID, reason string) (int64, error) {
+	res, err := ex.Exec(`UPDATE auth_sessions SET revoked_at = ?, revoke_reason = ? WHERE user_id = ? AND revoked_at IS NULL`,
+		time.Now().Unix(), reason, userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -4,9 +4,13 @@ import (
 	"admin-service/internal/audit"
 	"admin-service/internal/auth"
 	"admin-service/internal/db"
+	"database/sql"
+	"errors"
 	"net/http"
 	"time"
 
+	"lan-chat/password"
+
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 )
@@ -22,11 +26,15 @@ type User struct {
 }
 
 type CreateUserRequest struct {
-	Username     string `json:"username" binding:"required"`
-	FullName     string `json:"full_name"`
-	Password     string `json:"password" binding:"required"`
+	Username string `json:"username" binding:"required"`
+	FullName string `json:"full_name"`
+	// Password may be left out for a generated one-time password, which the
+	// response carries and the user must change at first login.
+	Password     string `json:"password"`
 	RoleID       string `json:"role_id"`
 	DepartmentID string `json:"department_id"`
+	// MustChangePassword makes the user replace the password at first login.
+	MustChangePassword bool `json:"must_change_password"`
 }
 
 type UpdateUserRequest struct {
@@ -65,6 +73,20 @@ func Create(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
 		return
 	}
+	var temporary string
+	if req.Password == "" {
+		var err error
+		if temporary, err = auth.UserPasswords.Policy().Generate(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "password generation failed"})
+			return
+		}
+		req.Password, req.MustChangePassword = temporary, true
+	}
+	var weak *password.Error
+	if err := auth.UserPasswords.Policy().Validate(req.Password, req.Username); errors.As(err, &weak) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": weak.Error(), "problems": weak.Problems})
+		return
+	}
 	hash, err := auth.HashPassword(req.Password)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "hash failed"})
@@ -80,9 +102,17 @@ func Create(c *gin.Context) {
 		c.JSON(http.StatusConflict, gin.H{"error": "user exists or db error"})
 		return
 	}
+	if err := auth.UserPasswords.Record(id, hash, req.MustChangePassword); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 	claims := getClaims(c)
 	_ = audit.Log(claims.UserID, claims.Username, "user.create", "users/"+id, req.Username, c.ClientIP())
-	c.JSON(http.StatusCreated, gin.H{"id": id, "username": req.Username})
+	resp := gin.H{"id": id, "username": req.Username, "must_change": req.MustChangePassword}
+	if temporary != "" {
+		resp["temporary_password"] = temporary
+	}
+	c.JSON(http.StatusCreated, resp)
 }
 
 func Update(c *gin.Context) {
@@ -132,25 +162,147 @@ func Update(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"ok": true})
 }
 
+// ResetPassword replaces a user's password with a random one-time password,
+// returned once, which the user must change at the next login, and signs
+// the user out everywhere. It also lifts any lockout so the user can use it
+// straight away. Directory users are refused with 409.
 func ResetPassword(c *gin.Context) {
 	id := c.Param("id")
-	defaultPassword := "123456789"
-	hash, err := auth.HashPassword(defaultPassword)
+	var username string
+	err := db.DB.QueryRow(`SELECT username FROM users WHERE id = ?`, id).Scan(&username)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// A directory user signs in against the directory: a local password
+	// would never be asked for, and must not become a way around it.
+	if provider, err := auth.IdentityProvider(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	} else if provider != "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "password is managed by the directory, reset it there", "provider": provider})
+		return
+	}
+	temporary, err := auth.UserPasswords.Policy().Generate()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "password generation failed"})
+		return
+	}
+	hash, err := auth.HashPassword(temporary)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "hash failed"})
 		return
 	}
 
+	// The new hash, its history entry and the end of the user's sessions
+	// land together: whoever had the old password keeps no way in.
 	now := time.Now().Unix()
-	_, err = db.DB.Exec(`UPDATE users SET password_hash = ?, updated_at = ? WHERE id = ?`, hash, now, id)
+	tx, err := db.DB.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE users SET password_hash = ?, updated_at = ? WHERE id = ?`, hash, now, id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := auth.UserPasswords.RecordTx(tx, id, hash, true); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	revoked, err := auth.RevokeUserSessions(tx, id, auth.RevokeAdminPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := auth.UserLockout.Unlock(username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims := getClaims(c)
+	_ = audit.LogJSON(claims.UserID, claims.Username, "user.reset_password", "users/"+id, gin.H{"must_change": true, "sessions_revoked": revoked}, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"ok": true, "temporary_password": temporary, "must_change": true, "sessions_revoked": revoked})
+}
+
+// ResetTwoFactor removes a user's second factor and recovery codes, for
+// users who lost their authenticator. They enroll again at next login if
+// policy requires it.
+func ResetTwoFactor(c *gin.Context) {
+	id := c.Param("id")
+	var exists bool
+	if err := db.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)`, id).Scan(&exists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	removed, err := auth.UserTwoFactor.Reset(id)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	claims := getClaims(c)
+	_ = audit.LogJSON(claims.UserID, claims.Username, "user.2fa.reset", "users/"+id, gin.H{"had_2fa": removed}, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"ok": true, "had_2fa": removed})
+}
 
+// Unlock clears a user's failed logins so they can try again before the
+// lockout expires.
+func Unlock(c *gin.Context) {
+	id := c.Param("id")
+	var username string
+	err := db.DB.QueryRow(`SELECT username FROM users WHERE id = ?`, id).Scan(&username)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	cleared, err := auth.UserLockout.Unlock(username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 	claims := getClaims(c)
-	_ = audit.Log(claims.UserID, claims.Username, "user.reset_password", "users/"+id, "", c.ClientIP())
-	c.JSON(http.StatusOK, gin.H{"ok": true, "message": "Password reset to default (123456789)"})
+	_ = audit.LogJSON(claims.UserID, claims.Username, "user.unlock", "users/"+id, gin.H{"had_failures": cleared}, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"ok": true, "had_failures": cleared})
+}
+
+// RevokeSessions signs a user out of every device, e.g. after a lost
+// laptop. The user can log in again with their password.
+func RevokeSessions(c *gin.Context) {
+	id := c.Param("id")
+	var exists bool
+	if err := db.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)`, id).Scan(&exists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	revoked, err := auth.RevokeUserSessions(db.DB, id, auth.RevokeAdmin)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	claims := getClaims(c)
+	_ = audit.LogJSON(claims.UserID, claims.Username, "user.sessions.revoke", "users/"+id, gin.H{"revoked": revoked}, c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"ok": true, "revoked": revoked})
 }
 
 func Delete(c *gin.Context) {
@@ -165,6 +317,10 @@ func Delete(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
 		return
 	}
+	if err := auth.UserPasswords.Forget(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 	claims := getClaims(c)
 	_ = audit.Log(claims.UserID, claims.Username, "user.delete", "users/"+id, "", c.ClientIP())
 	c.JSON(http.StatusOK, gin.H{"ok": true})
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"lan-chat/client"
+	"lan-chat/protocol"
+)
+
+// maxSendRetries bounds how often send waits out a 429 without a
+// Retry-After hint for one message.
+const maxSendRetries = 5
+
+func (a *app) login(ctx context.Context, args []string) error {
+	fs := a.flags("login")
+	username := fs.String("u", os.Getenv("LANCHAT_USERNAME"), "username")
+	password := fs.String("p", "", "password (prefer -password-stdin or LANCHAT_PASSWORD)")
+	fromStdin := fs.Bool("password-stdin", false, "read the password from the first line of stdin")
+	otp := fs.String("otp", os.Getenv("LANCHAT_OTP"), "two-factor code or recovery code, for accounts with 2FA")
+	newPassword := fs.String("new-password", os.Getenv("LANCHAT_NEW_PASSWORD"), "new password, when the server requires a change (after a reset or expiry)")
+	if rest, err := parse(fs, args); err != nil {
+		return err
+	} else if len(rest) > 0 {
+		return usagef("unexpected argument %q", rest[0])
+	}
+	if *fromStdin {
+		line, err := bufio.NewReader(a.stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		*password = strings.TrimRight(line, "\r\n")
+	}
+	if *password == "" {
+		*password = os.Getenv("LANCHAT_PASSWORD")
+	}
+	if *username == "" || *password == "" {
+		return usagef("username and password are required (-u, and -p, -password-stdin or LANCHAT_PASSWORD)")
+	}
+
+	s, err := a.c.Login(ctx, *username, *password)
+	var changeErr *client.PasswordChangeRequiredError
+	if errors.As(err, &changeErr) {
+		if *newPassword == "" {
+			return usagef("the password must be changed (%s): pass -new-password or set LANCHAT_NEW_PASSWORD", changeErr.Reason)
+		}
+		s, err = a.c.LoginChangePassword(ctx, changeErr.Challenge, *newPassword)
+	}
+	var mfaErr *client.MFARequiredError
+	if errors.As(err, &mfaErr) && mfaErr.Purpose == "verify" {
+		if *otp == "" {
+			return usagef("this account uses two-factor authentication: pass -otp or set LANCHAT_OTP")
+		}
+		s, err = a.c.LoginMFA(ctx, mfaErr.Challenge, *otp)
+	}
+	if err != nil {
+		return err
+	}
+	saved := &savedSession{
+		Session:         *s,
+		Username:        *username,
+		AuthURL:         a.cfg.AuthURL,
+		MessagingURL:    a.cfg.MessagingURL,
+		PresenceURL:     a.cfg.PresenceURL,
+		FileTransferURL: a.cfg.FileTransferURL,
+	}
+	if err := saveSession(a.sessionPath, saved); err != nil {
+		return err
+	}
+	if a.json {
+		return a.printJSON(map[string]string{"user_id": s.UserID, "username": *username, "role": s.Role})
+	}
+	fmt.Fprintf(a.stdout, "logged in as %s (%s, role %s)\n", *username, s.UserID, s.Role)
+	return nil
+}
+
+// passwd reads the current and the new password from the first two lines
+// of stdin, so neither ends up in shell history.
+func (a *app) passwd(ctx context.Context, args []string) error {
+	if rest, err := parse(a.flags("passwd"), args); err != nil {
+		return err
+	} else if len(rest) > 0 {
+		return usagef("unexpected argument %q", rest[0])
+	}
+	r := bufio.NewReader(a.stdin)
+	var lines [2]string
+	for i := range lines {
+		line, err := r.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		lines[i] = strings.TrimRight(line, "\r\n")
+	}
+	if lines[0] == "" || lines[1] == "" {
+		return usagef("pass the current and the new password on stdin, one per line")
+	}
+	if err := a.authenticate(ctx); err != nil {
+		return err
+	}
+	if err := a.c.ChangePassword(ctx, lines[0], lines[1]); err != nil {
+		return err
+	}
+	if a.json {
+		return a.printJSON(map[string]bool{"ok": true})
+	}
+	fmt.Fprintln(a.stdout, "password changed; other sessions were signed out")
+	return nil
+}
+
+func (a *app) logout(ctx context.Context, args []string) error {
+	if _, err := parse(a.flags("logout"), args); err != nil {
+		return err
+	}
+	if a.saved.Token != "" {
+		a.c.SetSession(a.saved.Session)
+		if err := a.c.Logout(ctx); err != nil {
+			fmt.Fprintf(a.stderr, "lanchat: revoking session: %v\n", err)
+		}
+	}
+	if err := os.Remove(a.sessionPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (a *app) whoami(ctx context.Context, args []string) error {
+	if _, err := parse(a.flags("whoami"), args); err != nil {
+		return err
+	}
+	if a.saved.Token == "" {
+		return client.ErrNotLoggedIn
+	}
+	if a.json {
+		return a.printJSON(map[string]string{
+			"user_id":       a.saved.UserID,
+			"username":      a.saved.Username,
+			"role":          a.saved.Role,
+			"messaging_url": a.cfg.MessagingURL,
+		})
+	}
+	fmt.Fprintf(a.stdout, "%s (%s, role %s) on %s\n", a.saved.Username, a.saved.UserID, a.saved.Role, a.cfg.MessagingURL)
+	return nil
+}
+
+func (a *app) channels(ctx context.Context, args []string) error {
+	if _, err := parse(a.flags("channels"), args); err != nil {
+		return err
+	}
+	if err := a.authenticate(ctx); err != nil {
+		return err
+	}
+	channels, err := a.c.Channels(ctx)
+	if err != nil {
+		return err
+	}
+	if a.json {
+		return a.printJSON(channels)
+	}
+	tw := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tTYPE")
+	for _, ch := range channels {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", ch.ID, ch.Name, ch.Type)
+	}
+	return tw.Flush()
+}
+
+func (a *app) members(ctx context.Context, args []string) error {
+	rest, err := parse(a.flags("members"), args)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 1 {
+		return usagef("expected one channel")
+	}
+	if err := a.authenticate(ctx); err != nil {
+		return err
+	}
+	ch, err := a.resolveChannel(ctx, rest[0])
+	if err != nil {
+		return err
+	}
+	members, err := a.c.Members(ctx, ch.ID)
+	if err != nil {
+		return err
+	}
+	if a.json {
+		return a.printJSON(members)
+	}
+	tw := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSERNAME\tFULL NAME")
+	for _, m := range members {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", m.ID, m.Username, m.FullName)
+	}
+	return tw.Flush()
+}
+
+func (a *app) history(ctx context.Context, args []string) error {
+	fs := a.flags("history")
+	n := fs.Int("n", 20, "number of messages")
+	rest, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 1 {
+		return usagef("expected one channel")
+	}
+	if err := a.authenticate(ctx); err != nil {
+		return err
+	}
+	ch, err := a.resolveChannel(ctx, rest[0])
+	if err != nil {
+		return err
+	}
+	msgs, err := a.lastMessages(ctx, ch.ID, *n)
+	if err != nil {
+		return err
+	}
+	p := a.newPrinter([]client.Channel{ch})
+	for i := range msgs {
+		if err := p.print(ctx, &msgs[i], false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastMessages returns the newest n messages of a channel, oldest first, or
+// all of them when n is negative. The server pages from the oldest message,
+// so this walks the cursor to the end keeping only the last n.
+func (a *app) lastMessages(ctx context.Context, channelID string, n int) ([]protocol.Message, error) {
+	var last []protocol.Message
+	cursor := client.HistoryCursor{}
+	for {
+		page, err := a.c.HistoryAfter(ctx, channelID, cursor, client.HistoryPageSize)
+		if err != nil {
+			return nil, err
+		}
+		last = append(last, page...)
+		if n >= 0 && len(last) > n {
+			last = append(last[:0], last[len(last)-n:]...)
+		}
+		if len(page) < client.HistoryPageSize {
+			return last, nil
+		}
+		cursor = client.CursorAfter(page[len(page)-1])
+	}
+}
+
+func (a *app) tail(ctx context.Context, args []string) error {
+	fs := a.flags("tail")
+	n := fs.Int("n", 0, "print the last N messages of each channel first")
+	binary := fs.Bool("binary", false, "use the Protobuf wire format")
+	rest, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := a.authenticate(ctx); err != nil {
+		return err
+	}
+	all, err := a.c.Channels(ctx)
+	if err != nil {
+		return err
+	}
+	var watched []client.Channel
+	for _, ref := range rest {
+		ch, err := a.resolveChannel(ctx, ref)
+		if err != nil {
+			return err
+		}
+		watched = append(watched, ch)
+	}
+	filter := make(map[string]bool)
+	for _, ch := range watched {
+		filter[ch.ID] = true
+	}
+
+	// Connect before printing history so nothing sent in between is lost;
+	// live copies of history messages are skipped by ID.
+	cfg := a.cfg
+	cfg.Binary = *binary
+	rt := client.New(cfg)
+	rt.SetSession(a.c.Session())
+	if err := rt.Connect(ctx); err != nil {
+		return err
+	}
+	defer rt.Close()
+
+	p := a.newPrinter(all)
+	seen := make(map[string]bool)
+	if *n > 0 {
+		backlog := watched
+		if len(backlog) == 0 {
+			backlog = all
+		}
+		for _, ch := range backlog {
+			msgs, err := a.lastMessages(ctx, ch.ID, *n)
+			if err != nil {
+				return err
+			}
+			for i := range msgs {
+				seen[msgs[i].ID] = true
+				if err := p.print(ctx, &msgs[i], false); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for ev := range rt.Events() {
+		switch ev := ev.(type) {
+		case client.MessageEvent:
+			if (len(filter) > 0 && !filter[ev.Message.ChannelID]) || seen[ev.Message.ID] {
+				continue
+			}
+			if err := p.print(ctx, &ev.Message, ev.Resumed); err != nil {
+				return err
+			}
+		case client.ErrorEvent:
+			fmt.Fprintf(a.stderr, "lanchat: server error %s: %s\n", ev.Error.Code, ev.Error.Message)
+		case client.ConnectedEvent:
+			if ev.Reconnect {
+				fmt.Fprintln(a.stderr, "lanchat: reconnected")
+			}
+		case client.DisconnectedEvent:
+			if ev.RetryIn == 0 {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return ev.Err
+			}
+			fmt.Fprintf(a.stderr, "lanchat: connection lost (%v), retrying in %s\n", ev.Err, ev.RetryIn.Round(time.Millisecond))
+		}
+	}
+	return nil
+}
+
+func (a *app) send(ctx context.Context, args []string) error {
+	fs := a.flags("send")
+	lines := fs.Bool("lines", false, "send each line of stdin as its own message, as it arrives")
+	rest, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(rest) == 0 {
+		return usagef("expected a channel")
+	}
+	if *lines && len(rest) > 1 {
+		return usagef("-lines reads stdin and takes no text arguments")
+	}
+	if err := a.authenticate(ctx); err != nil {
+		return err
+	}
+	ch, err := a.resolveChannel(ctx, rest[0])
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(rest) > 1:
+		return a.sendText(ctx, ch.ID, strings.Join(rest[1:], " "))
+	case *lines:
+		sc := bufio.NewScanner(a.stdin)
+		sc.Buffer(make([]byte, 64*1024), 1024*1024)
+		for sc.Scan() {
+			if strings.TrimSpace(sc.Text()) == "" {
+				continue
+			}
+			if err := a.sendText(ctx, ch.ID, sc.Text()); err != nil {
+				return err
+			}
+		}
+		return sc.Err()
+	}
+	data, err := io.ReadAll(a.stdin)
+	if err != nil {
+		return err
+	}
+	text := strings.TrimRight(string(data), "\r\n")
+	if strings.TrimSpace(text) == "" {
+		return errors.New("nothing to send")
+	}
+	return a.sendText(ctx, ch.ID, text)
+}
+
+// sendText sends one message, waiting out rate limits so that piped input
+// is delivered rather than dropped.
+func (a *app) sendText(ctx context.Context, channelID, text string) error {
+	return a.sendMessage(ctx, protocol.SendMessageRequest{
+		ChannelID: channelID,
+		Type:      protocol.MessageTypeText,
+		Content:   []byte(text),
+	}, nil)
+}
+
+func (a *app) sendMessage(ctx context.Context, req protocol.SendMessageRequest, extra map[string]interface{}) error {
+	for attempt := 0; ; {
+		id, err := a.c.Send(ctx, req)
+		var apiErr *client.APIError
+		// The server's Retry-After is honoured for as long as it keeps
+		// giving one; only 429s without a hint count against the retries.
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusTooManyRequests &&
+			(apiErr.RetryAfter > 0 || attempt < maxSendRetries) {
+			wait := apiErr.RetryAfter
+			if wait <= 0 {
+				wait = time.Second
+				attempt++
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if a.json {
+			out := map[string]interface{}{"message_id": id, "channel_id": req.ChannelID}
+			for k, v := range extra {
+				out[k] = v
+			}
+			return a.printJSON(out)
+		}
+		return nil
+	}
+}
+
+func (a *app) dm(ctx context.Context, args []string) error {
+	rest, err := parse(a.flags("dm"), args)
+	if err != nil {
+		return err
+	}
+	if len(rest) == 0 {
+		return usagef("expected a user ID")
+	}
+	if err := a.authenticate(ctx); err != nil {
+		return err
+	}
+	channelID, err := a.c.OpenDM(ctx, rest[0])
+	if err != nil {
+		return err
+	}
+	if len(rest) > 1 {
+		return a.sendText(ctx, channelID, strings.Join(rest[1:], " "))
+	}
+	if a.json {
+		return a.printJSON(map[string]string{"channel_id": channelID})
+	}
+	fmt.Fprintln(a.stdout, channelID)
+	return nil
+}
+
+func (a *app) upload(ctx context.Context, args []string) error {
+	fs := a.flags("upload")
+	text := fs.String("m", "", "message text to send with the file")
+	rest, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 2 {
+		return usagef("expected a channel and a file")
+	}
+	if err := a.authenticate(ctx); err != nil {
+		return err
+	}
+	ch, err := a.resolveChannel(ctx, rest[0])
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(rest[1])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	up, err := a.c.Upload(ctx, filepath.Base(rest[1]), f)
+	if err != nil {
+		return err
+	}
+	msgType := protocol.MessageTypeFile
+	if mt, _, _ := mime.ParseMediaType(up.MimeType); strings.HasPrefix(mt, "image/") {
+		msgType = protocol.MessageTypeImage
+	}
+	req := protocol.SendMessageRequest{
+		ChannelID:  ch.ID,
+		Type:       msgType,
+		Content:    []byte(*text),
+		Attachment: up.Attachment(),
+	}
+	if err := a.sendMessage(ctx, req, map[string]interface{}{"file": up}); err != nil {
+		return err
+	}
+	if !a.json {
+		fmt.Fprintf(a.stdout, "shared %s (%d bytes) in #%s\nfile id: %s\nkey:     %s\n", up.Name, up.Size, channelLabel(ch), up.FileID, up.Key)
+	}
+	return nil
+}
+
+func (a *app) download(ctx context.Context, args []string) error {
+	fs := a.flags("download")
+	out := fs.String("o", "", "output path (default stdout)")
+	rest, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 2 {
+		return usagef("expected a file ID and a key")
+	}
+	if err := a.authenticate(ctx); err != nil {
+		return err
+	}
+	data, err := a.c.Download(ctx, rest[0], rest[1])
+	if err != nil {
+		return err
+	}
+	if *out == "" || *out == "-" {
+		_, err := a.stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(*out, data, 0644); err != nil {
+		return err
+	}
+	if a.json {
+		return a.printJSON(map[string]interface{}{"path": *out, "size": len(data)})
+	}
+	return nil
+}
+
+var statusNames = map[client.Status]string{
+	client.StatusOffline: "offline",
+	client.StatusOnline:  "online",
+	client.StatusBusy:    "busy",
+	client.StatusAway:    "away",
+}
+
+func (a *app) presence(ctx context.Context, args []string) error {
+	rest, err := parse(a.flags("presence"), args)
+	if err != nil {
+		return err
+	}
+	if len(rest) == 0 {
+		return usagef("expected at least one user ID")
+	}
+	type row struct {
+		UserID   string    `json:"user_id"`
+		Status   string    `json:"status"`
+		LastSeen time.Time `json:"last_seen"`
+	}
+	var rows []row
+	for _, id := range rest {
+		p, err := a.c.Presence(ctx, id)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, row{UserID: p.UserID, Status: statusNames[p.Status], LastSeen: p.LastSeen})
+	}
+	if a.json {
+		return a.printJSON(rows)
+	}
+	tw := tabwriter.NewWriter(a.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tSTATUS\tLAST SEEN")
+	for _, r := range rows {
+		lastSeen := "-"
+		if !r.LastSeen.IsZero() {
+			lastSeen = r.LastSeen.Local().Format(timeLayout)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.UserID, r.Status, lastSeen)
+	}
+	return tw.Flush()
+}
+
+func (a *app) status(ctx context.Context, args []string) error {
+	fs := a.flags("status")
+	keep := fs.Bool("keep", false, "keep sending heartbeats until interrupted")
+	interval := fs.Duration("interval", 30*time.Second, "heartbeat interval with -keep")
+	rest, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 1 {
+		return usagef("expected a status")
+	}
+	status, ok := client.Status(0), false
+	for s, name := range statusNames {
+		if name == strings.ToLower(rest[0]) {
+			status, ok = s, true
+		}
+	}
+	if !ok {
+		return usagef("unknown status %q", rest[0])
+	}
+	if err := a.authenticate(ctx); err != nil {
+		return err
+	}
+	if *keep {
+		a.c.KeepPresence(ctx, status, *interval)
+		return nil
+	}
+	return a.c.SetStatus(ctx, status)
+}
@@ -0,0 +1,18 @@
+module lan-chat/lanchat
+
+go 1.22
+
+require (
+	lan-chat/client v0.0.0
+	lan-chat/protocol v0.0.0
+)
+
+require (
+	github.com/gorilla/websocket v1.5.3 // indirect
+	google.golang.org/protobuf v1.34.2 // indirect
+)
+
+replace (
+	lan-chat/client => ../../pkg/client
+	lan-chat/protocol => ../../pkg/protocol
+)
@@ -0,0 +1,316 @@
+// Command lanchat is a command-line client for the LAN chat backend, for
+// headless machines and scripts:
+//
+//	lanchat -host 10.0.0.5 login -u alice
+//	lanchat channels
+//	lanchat tail general
+//	journalctl -f -u nginx | lanchat send -lines ops-alerts
+//	lanchat upload ops report.pdf
+//
+// Every command accepts -json for machine-readable output. Non-interactive
+// jobs can skip `login` by setting LANCHAT_USERNAME and LANCHAT_PASSWORD.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"lan-chat/client"
+)
+
+// Default ports, matching docker-compose.
+const (
+	authPort      = "8086"
+	messagingPort = "8081"
+	presencePort  = "8083"
+	filesPort     = "8082"
+)
+
+type command struct {
+	usage string
+	help  string
+	run   func(a *app, ctx context.Context, args []string) error
+}
+
+var commands = map[string]command{
+	"login":    {"login [-u user] [-p pass | -password-stdin] [-otp code] [-new-password pass]", "log in and save the session", (*app).login},
+	"logout":   {"logout", "revoke and forget the saved session", (*app).logout},
+	"passwd":   {"passwd < current-and-new", "change your password (current and new password on stdin, one per line)", (*app).passwd},
+	"whoami":   {"whoami", "show the logged-in user", (*app).whoami},
+	"channels": {"channels", "list channels you can read", (*app).channels},
+	"members":  {"members <channel>", "list channel members", (*app).members},
+	"history":  {"history [-n N] <channel>", "print recent messages", (*app).history},
+	"tail":     {"tail [-n N] [-binary] [channel...]", "stream messages live (all channels by default)", (*app).tail},
+	"send":     {"send [-lines] <channel> [text...]", "send text, or stdin when no text is given", (*app).send},
+	"dm":       {"dm <user-id> [text...]", "open a direct message channel, optionally sending text", (*app).dm},
+	"upload":   {"upload [-m text] <channel> <file>", "upload a file and share it in a channel", (*app).upload},
+	"download": {"download [-o path] <file-id> <key>", "download and decrypt a file", (*app).download},
+	"presence": {"presence <user-id>...", "show presence status", (*app).presence},
+	"status":   {"status [-keep] online|busy|away", "set your presence status", (*app).status},
+}
+
+// errBadFlags reports a flag error the flag package has already printed.
+var errBadFlags = errors.New("bad flags")
+
+// usageError makes run print usage and exit with status 2.
+type usageError struct{ msg string }
+
+func (e *usageError) Error() string { return e.msg }
+
+func usagef(format string, args ...interface{}) error {
+	return &usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+// app holds what every command needs: I/O, output mode and the client.
+type app struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	usage       string // of the running command
+	json        bool
+	sessionPath string
+	cfg         client.Config
+	saved       *savedSession
+	c           *client.Client
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run executes one lanchat invocation and returns its exit status.
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	a := &app{stdin: stdin, stdout: stdout, stderr: stderr}
+
+	global := flag.NewFlagSet("lanchat", flag.ContinueOnError)
+	global.SetOutput(stderr)
+	host := global.String("host", os.Getenv("LANCHAT_HOST"), "backend host; services are reached on their default ports")
+	authURL := global.String("auth-url", os.Getenv("LANCHAT_AUTH_URL"), "auth service URL")
+	messagingURL := global.String("messaging-url", os.Getenv("LANCHAT_MESSAGING_URL"), "messaging service URL")
+	presenceURL := global.String("presence-url", os.Getenv("LANCHAT_PRESENCE_URL"), "presence service URL")
+	filesURL := global.String("files-url", os.Getenv("LANCHAT_FILES_URL"), "filetransfer service URL")
+	global.StringVar(&a.sessionPath, "session", os.Getenv("LANCHAT_SESSION"), "session file (default in the user config dir)")
+	global.BoolVar(&a.json, "json", false, "print JSON instead of text")
+	global.Usage = func() { printUsage(stderr, global) }
+	if err := global.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if global.NArg() == 0 {
+		printUsage(stderr, global)
+		return 2
+	}
+	name, rest := global.Arg(0), global.Args()[1:]
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "lanchat: unknown command %q\n", name)
+		printUsage(stderr, global)
+		return 2
+	}
+
+	if a.sessionPath == "" {
+		a.sessionPath = defaultSessionPath()
+	}
+	saved, err := loadSession(a.sessionPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "lanchat: %v\n", err)
+		return 1
+	}
+	a.saved = saved
+	a.cfg = client.Config{
+		AuthURL:         serviceURL(*authURL, *host, saved.AuthURL, authPort),
+		MessagingURL:    serviceURL(*messagingURL, *host, saved.MessagingURL, messagingPort),
+		PresenceURL:     serviceURL(*presenceURL, *host, saved.PresenceURL, presencePort),
+		FileTransferURL: serviceURL(*filesURL, *host, saved.FileTransferURL, filesPort),
+		ClientName:      "lanchat-cli",
+		OnSessionChange: a.sessionChanged,
+	}
+	a.c = client.New(a.cfg)
+	a.usage = cmd.usage
+
+	if err := cmd.run(a, ctx, rest); err != nil {
+		var ue *usageError
+		switch {
+		case errors.Is(err, flag.ErrHelp):
+			return 0
+		case errors.Is(err, errBadFlags):
+			return 2
+		case errors.As(err, &ue):
+			fmt.Fprintf(stderr, "lanchat: %s\nusage: lanchat %s\n", ue.msg, cmd.usage)
+			return 2
+		case errors.Is(err, context.Canceled):
+			return 0
+		}
+		fmt.Fprintf(stderr, "lanchat: %s\n", describeError(err))
+		return 1
+	}
+	return 0
+}
+
+// serviceURL picks a service URL: an explicit URL wins, then -host, then
+// the URL saved at login, then localhost.
+func serviceURL(explicit, host, saved, port string) string {
+	switch {
+	case explicit != "":
+		return explicit
+	case host != "":
+		return "http://" + host + ":" + port
+	case saved != "":
+		return saved
+	}
+	return "http://localhost:" + port
+}
+
+func describeError(err error) string {
+	var apiErr *client.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusUnauthorized:
+			return "not authorized: session missing or expired, run `lanchat login`"
+		case http.StatusForbidden:
+			return "forbidden: " + apiErr.Message
+		case http.StatusTooManyRequests:
+			if apiErr.RetryAfter > 0 {
+				return fmt.Sprintf("too many failed attempts: try again in %s", apiErr.RetryAfter)
+			}
+		}
+		return fmt.Sprintf("server returned %d: %s", apiErr.StatusCode, apiErr.Message)
+	}
+	if errors.Is(err, client.ErrNotLoggedIn) {
+		return "not logged in: run `lanchat login` or set LANCHAT_USERNAME and LANCHAT_PASSWORD"
+	}
+	var changeErr *client.PasswordChangeRequiredError
+	if errors.As(err, &changeErr) {
+		return "the password must be changed first: run `lanchat login -new-password <password>`"
+	}
+	var mfaErr *client.MFARequiredError
+	if errors.As(err, &mfaErr) {
+		if mfaErr.Purpose == "enroll" {
+			return "two-factor authentication must be set up first: log in once with the desktop app"
+		}
+		return "this account uses two-factor authentication: run `lanchat login -otp <code>`"
+	}
+	return err.Error()
+}
+
+func printUsage(w io.Writer, global *flag.FlagSet) {
+	fmt.Fprintln(w, "usage: lanchat [flags] <command> [args]")
+	fmt.Fprintln(w, "\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-44s %s\n", commands[name].usage, commands[name].help)
+	}
+	fmt.Fprintln(w, "\nflags:")
+	global.SetOutput(w)
+	global.PrintDefaults()
+}
+
+// flags returns a FlagSet for a subcommand; -json is accepted after the
+// command name as well as before it.
+func (a *app) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("lanchat "+name, flag.ContinueOnError)
+	fs.SetOutput(a.stderr)
+	fs.BoolVar(&a.json, "json", a.json, "print JSON instead of text")
+	fs.Usage = func() {
+		fmt.Fprintf(a.stderr, "usage: lanchat %s\n", a.usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse parses args, allowing flags to follow positional arguments so that
+// `lanchat send ops -lines` works like `lanchat send -lines ops`. Text that
+// starts with a dash goes after `--`.
+func parse(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, err
+			}
+			return nil, errBadFlags
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		if args[0] == "--" {
+			return append(positional, args[1:]...), nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// sessionChanged saves tokens the SDK rotated, since the refresh token in
+// the session file stops working once it has been used. Sessions logged in
+// from the environment are not saved.
+func (a *app) sessionChanged(s client.Session) {
+	if a.saved.Token == "" {
+		return
+	}
+	a.saved.Session = s
+	if err := saveSession(a.sessionPath, a.saved); err != nil {
+		fmt.Fprintf(a.stderr, "lanchat: saving refreshed session: %v\n", err)
+	}
+}
+
+// authenticate installs the saved session, or logs in with
+// LANCHAT_USERNAME/LANCHAT_PASSWORD without saving anything.
+func (a *app) authenticate(ctx context.Context) error {
+	if a.saved.Token != "" {
+		a.c.SetSession(a.saved.Session)
+		return nil
+	}
+	user, pass := os.Getenv("LANCHAT_USERNAME"), os.Getenv("LANCHAT_PASSWORD")
+	if user == "" || pass == "" {
+		return client.ErrNotLoggedIn
+	}
+	_, err := a.c.Login(ctx, user, pass)
+	return err
+}
+
+// resolveChannel accepts a channel ID or name.
+func (a *app) resolveChannel(ctx context.Context, ref string) (client.Channel, error) {
+	ref = strings.TrimPrefix(ref, "#")
+	channels, err := a.c.Channels(ctx)
+	if err != nil {
+		return client.Channel{}, err
+	}
+	for _, ch := range channels {
+		if ch.ID == ref {
+			return ch, nil
+		}
+	}
+	var found []client.Channel
+	for _, ch := range channels {
+		if strings.EqualFold(ch.Name, ref) {
+			found = append(found, ch)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return client.Channel{}, fmt.Errorf("no channel %q", ref)
+	case 1:
+		return found[0], nil
+	}
+	return client.Channel{}, fmt.Errorf("channel name %q is ambiguous, use its ID", ref)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"lan-chat/client/fakeserver"
+	"lan-chat/protocol"
+)
+
+type cliEnv struct {
+	t       *testing.T
+	srv     *fakeserver.Server
+	session string
+}
+
+func newCLIEnv(t *testing.T) *cliEnv {
+	t.Helper()
+	for _, k := range []string{"LANCHAT_HOST", "LANCHAT_SESSION", "LANCHAT_USERNAME", "LANCHAT_PASSWORD", "LANCHAT_OTP", "LANCHAT_NEW_PASSWORD",
+		"LANCHAT_AUTH_URL", "LANCHAT_MESSAGING_URL", "LANCHAT_PRESENCE_URL", "LANCHAT_FILES_URL"} {
+		t.Setenv(k, "")
+	}
+	srv := fakeserver.New()
+	t.Cleanup(srv.Close)
+	srv.AddUser("alice", "secret")
+	srv.AddUser("bob", "secret")
+	srv.AddChannel("ops-1", "ops-alerts", "private", "u-alice", "u-bob")
+	return &cliEnv{t: t, srv: srv, session: filepath.Join(t.TempDir(), "session.json")}
+}
+
+// syncBuffer lets tests read output while run is still writing it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (e *cliEnv) args(args ...string) []string {
+	u := e.srv.URL
+	return append([]string{"-auth-url", u, "-messaging-url", u, "-presence-url", u, "-files-url", u, "-session", e.session}, args...)
+}
+
+func (e *cliEnv) run(stdin string, args ...string) (int, string, string) {
+	e.t.Helper()
+	var stdout, stderr syncBuffer
+	code := run(context.Background(), e.args(args...), strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func (e *cliEnv) mustRun(stdin string, args ...string) string {
+	e.t.Helper()
+	code, out, errOut := e.run(stdin, args...)
+	if code != 0 {
+		e.t.Fatalf("lanchat %v exited %d: %s", args, code, errOut)
+	}
+	return out
+}
+
+func TestLoginSessionAndChannels(t *testing.T) {
+	e := newCLIEnv(t)
+
+	if code, _, errOut := e.run("", "channels"); code != 1 || !strings.Contains(errOut, "not logged in") {
+		t.Fatalf("expected not-logged-in error, got %d %q", code, errOut)
+	}
+	if code, _, _ := e.run("wrong\n", "login", "-u", "alice", "-password-stdin"); code != 1 {
+		t.Fatalf("expected failed login to exit 1, got %d", code)
+	}
+	if code, _, _ := e.run("", "login", "-u", "alice"); code != 2 {
+		t.Fatalf("expected usage error without a password, got %d", code)
+	}
+
+	out := e.mustRun("secret\n", "login", "-u", "alice", "-password-stdin")
+	if !strings.Contains(out, "logged in as alice (u-alice") {
+		t.Fatalf("unexpected login output %q", out)
+	}
+	info, err := os.Stat(e.session)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("session file not private: %v %v", info, err)
+	}
+
+	// The saved session carries the service URLs; no URL flags needed.
+	var stdout, stderr bytes.Buffer
+	if code := run(context.Background(), []string{"-session", e.session, "whoami"}, nil, &stdout, &stderr); code != 0 {
+		t.Fatalf("whoami failed: %s", stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "alice (u-alice") || !strings.Contains(stdout.String(), e.srv.URL) {
+		t.Fatalf("unexpected whoami %q", stdout.String())
+	}
+
+	var channels []struct{ ID, Name, Type string }
+	if err := json.Unmarshal([]byte(e.mustRun("", "channels", "-json")), &channels); err != nil || len(channels) != 2 {
+		t.Fatalf("unexpected channels JSON: %+v %v", channels, err)
+	}
+	if out := e.mustRun("", "channels"); !strings.Contains(out, "ops-1") || !strings.Contains(out, "ops-alerts") {
+		t.Fatalf("unexpected channels table %q", out)
+	}
+
+	e.mustRun("", "logout")
+	if _, err := os.Stat(e.session); !os.IsNotExist(err) {
+		t.Fatalf("session file not removed: %v", err)
+	}
+}
+
+func TestLoginWithOTP(t *testing.T) {
+	e := newCLIEnv(t)
+	e.srv.RequireOTP("alice", "123456")
+
+	if code, _, errOut := e.run("secret\n", "login", "-u", "alice", "-password-stdin"); code != 2 || !strings.Contains(errOut, "-otp") {
+		t.Fatalf("expected a usage error asking for -otp, got %d %q", code, errOut)
+	}
+	if code, _, _ := e.run("secret\n", "login", "-u", "alice", "-password-stdin", "-otp", "000000"); code != 1 {
+		t.Fatalf("expected a wrong code to fail, got %d", code)
+	}
+	t.Setenv("LANCHAT_OTP", "123456")
+	if out := e.mustRun("secret\n", "login", "-u", "alice", "-password-stdin"); !strings.Contains(out, "logged in as alice") {
+		t.Fatalf("unexpected login output %q", out)
+	}
+	e.mustRun("", "channels")
+}
+
+func TestPasswordChange(t *testing.T) {
+	e := newCLIEnv(t)
+	e.srv.RequirePasswordChange("alice")
+
+	if code, _, errOut := e.run("secret\n", "login", "-u", "alice", "-password-stdin"); code != 2 || !strings.Contains(errOut, "-new-password") {
+		t.Fatalf("expected a usage error asking for -new-password, got %d %q", code, errOut)
+	}
+	if out := e.mustRun("secret\n", "login", "-u", "alice", "-password-stdin", "-new-password", "brand-new-1"); !strings.Contains(out, "logged in as alice") {
+		t.Fatalf("unexpected login output %q", out)
+	}
+
+	if code, _, errOut := e.run("wrong\nnewer-still-2\n", "passwd"); code != 1 || !strings.Contains(errOut, "Current password is incorrect") {
+		t.Fatalf("expected a wrong current password to fail, got %d %q", code, errOut)
+	}
+	if out := e.mustRun("brand-new-1\nnewer-still-2\n", "passwd"); !strings.Contains(out, "password changed") {
+		t.Fatalf("unexpected passwd output %q", out)
+	}
+	if got := e.srv.Password("alice"); got != "newer-still-2" {
+		t.Fatalf("password is %q", got)
+	}
+}
+
+func TestEnvCredentials(t *testing.T) {
+	e := newCLIEnv(t)
+	t.Setenv("LANCHAT_USERNAME", "bob")
+	t.Setenv("LANCHAT_PASSWORD", "secret")
+
+	e.mustRun("", "send", "general", "from", "cron")
+	msgs := e.srv.Messages("general")
+	if len(msgs) != 1 || msgs[0].SenderID != "u-bob" || string(msgs[0].Content) != "from cron" {
+		t.Fatalf("unexpected messages %+v", msgs)
+	}
+	if _, err := os.Stat(e.session); !os.IsNotExist(err) {
+		t.Fatal("env credentials must not write a session file")
+	}
+}
+
+func TestSendAndHistory(t *testing.T) {
+	e := newCLIEnv(t)
+	e.mustRun("secret\n", "login", "-u", "alice", "-password-stdin")
+
+	// By name, with flags after the channel, one message per stdin line.
+	e.mustRun("disk full on db1\n\nload high on web2\n", "send", "#ops-alerts", "-lines")
+	// Whole stdin as one message.
+	e.mustRun("line one\nline two\n", "send", "ops-1")
+	out := e.mustRun("", "send", "-json", "ops-1", "--", "-5", "degrees")
+
+	var resp struct {
+		MessageID string `json:"message_id"`
+		ChannelID string `json:"channel_id"`
+	}
+	if err := json.Unmarshal([]byte(out), &resp); err != nil || resp.MessageID == "" || resp.ChannelID != "ops-1" {
+		t.Fatalf("unexpected send JSON %q (%v)", out, err)
+	}
+	var texts []string
+	for _, m := range e.srv.Messages("ops-1") {
+		texts = append(texts, string(m.Content))
+	}
+	want := []string{"disk full on db1", "load high on web2", "line one\nline two", "-5 degrees"}
+	if strings.Join(texts, "|") != strings.Join(want, "|") {
+		t.Fatalf("got %q, want %q", texts, want)
+	}
+
+	out = e.mustRun("", "history", "-n", "2", "ops-alerts")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], "#ops-alerts alice: line one") || !strings.HasSuffix(lines[2], "alice: -5 degrees") {
+		t.Fatalf("unexpected history %q", out)
+	}
+
+	if code, _, errOut := e.run("", "send", "nope", "x"); code != 1 || !strings.Contains(errOut, `no channel "nope"`) {
+		t.Fatalf("expected unknown channel error, got %d %q", code, errOut)
+	}
+	if code, _, _ := e.run("", "send"); code != 2 {
+		t.Fatalf("expected usage error, got %d", code)
+	}
+	if code, _, _ := e.run("", "send", "-bogus", "ops-1", "x"); code != 2 {
+		t.Fatalf("expected bad flag to exit 2, got %d", code)
+	}
+}
+
+func TestSendLinesWaitsOutRateLimit(t *testing.T) {
+	e := newCLIEnv(t)
+	e.mustRun("secret\n", "login", "-u", "alice", "-password-stdin")
+	e.srv.LimitSends(3, time.Second)
+
+	var in strings.Builder
+	for i := 0; i < 8; i++ {
+		fmt.Fprintf(&in, "line %d\n", i)
+	}
+	start := time.Now()
+	e.mustRun(in.String(), "send", "ops-1", "-lines")
+	if msgs := e.srv.Messages("ops-1"); len(msgs) != 8 || string(msgs[7].Content) != "line 7" {
+		t.Fatalf("expected all 8 lines delivered in order, got %d", len(msgs))
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("expected send to wait for Retry-After, finished in %s", elapsed)
+	}
+}
+
+func TestHistoryShowsNewestMessages(t *testing.T) {
+	e := newCLIEnv(t)
+	e.mustRun("secret\n", "login", "-u", "alice", "-password-stdin")
+	base := time.Now().Add(-time.Hour).UnixMilli()
+	for i := 0; i < 250; i++ {
+		e.srv.Post(protocol.Message{ChannelID: "ops-1", SenderID: "u-bob", Timestamp: base + int64(i), Type: protocol.MessageTypeText, Content: []byte(fmt.Sprintf("msg %d", i))})
+	}
+
+	out := e.mustRun("", "history", "-n", "3", "ops-1")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 || !strings.HasSuffix(lines[0], "msg 247") || !strings.HasSuffix(lines[2], "msg 249") {
+		t.Fatalf("expected the newest 3 messages, got %q", out)
+	}
+	if out := e.mustRun("", "history", "-n", "-1", "ops-1"); strings.Count(out, "\n") != 250 {
+		t.Fatalf("expected all 250 messages with -n -1, got %d lines", strings.Count(out, "\n"))
+	}
+}
+
+func TestTail(t *testing.T) {
+	e := newCLIEnv(t)
+	e.mustRun("secret\n", "login", "-u", "alice", "-password-stdin")
+	e.srv.Post(protocol.Message{ChannelID: "ops-1", SenderID: "u-bob", Type: protocol.MessageTypeText, Content: []byte("earlier")})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var stdout, stderr syncBuffer
+	done := make(chan int)
+	go func() {
+		done <- run(ctx, e.args("tail", "-json", "-n", "5", "ops-alerts"), nil, &stdout, &stderr)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for e.srv.Connections("u-alice") == 0 || !strings.Contains(stdout.String(), "earlier") {
+		if time.Now().After(deadline) {
+			t.Fatalf("tail did not start: %q %q", stdout.String(), stderr.String())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	e.srv.Post(protocol.Message{ChannelID: "general", SenderID: "u-bob", Type: protocol.MessageTypeText, Content: []byte("elsewhere")})
+	e.srv.Post(protocol.Message{ChannelID: "ops-1", SenderID: "u-bob", Type: protocol.MessageTypeText, Content: []byte("live")})
+	for !strings.Contains(stdout.String(), "live") {
+		if time.Now().After(deadline) {
+			t.Fatalf("live message not printed: %q", stdout.String())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	if code := <-done; code != 0 {
+		t.Fatalf("tail exited %d: %s", code, stderr.String())
+	}
+
+	var views []messageView
+	for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+		var v messageView
+		if err := json.Unmarshal([]byte(line), &v); err != nil {
+			t.Fatalf("bad JSON line %q: %v", line, err)
+		}
+		views = append(views, v)
+	}
+	if len(views) != 2 || views[0].Text != "earlier" || views[1].Text != "live" ||
+		views[1].Sender != "bob" || views[1].Channel != "ops-alerts" || views[1].Type != "text" {
+		t.Fatalf("unexpected tail output %+v", views)
+	}
+}
+
+func TestUploadDownload(t *testing.T) {
+	e := newCLIEnv(t)
+	e.mustRun("secret\n", "login", "-u", "alice", "-password-stdin")
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "report.txt")
+	content := bytes.Repeat([]byte("uptime 99.9%\n"), 500)
+	if err := os.WriteFile(src, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var up struct {
+		MessageID string `json:"message_id"`
+		File      struct {
+			FileID string `json:"file_id"`
+			Key    string `json:"key"`
+		} `json:"file"`
+	}
+	out := e.mustRun("", "-json", "upload", "-m", "weekly report", "ops-alerts", src)
+	if err := json.Unmarshal([]byte(out), &up); err != nil || up.File.FileID == "" || up.File.Key == "" {
+		t.Fatalf("unexpected upload JSON %q (%v)", out, err)
+	}
+	msgs := e.srv.Messages("ops-1")
+	if len(msgs) != 1 || msgs[0].Type != protocol.MessageTypeFile || msgs[0].Attachment.Name != "report.txt" ||
+		string(msgs[0].Content) != "weekly report" {
+		t.Fatalf("unexpected file message %+v", msgs)
+	}
+
+	if got := e.mustRun("", "download", up.File.FileID, up.File.Key); got != string(content) {
+		t.Fatalf("stdout download mismatch (%d bytes)", len(got))
+	}
+	dst := filepath.Join(dir, "copy.txt")
+	e.mustRun("", "download", "-o", dst, up.File.FileID, up.File.Key)
+	if got, err := os.ReadFile(dst); err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("file download mismatch: %v", err)
+	}
+}
+
+func TestPresenceAndStatus(t *testing.T) {
+	e := newCLIEnv(t)
+	e.mustRun("secret\n", "login", "-u", "alice", "-password-stdin")
+
+	e.mustRun("", "status", "busy")
+	if out := e.mustRun("", "presence", "u-alice", "u-bob"); !strings.Contains(out, "u-alice  busy") || !strings.Contains(out, "u-bob    offline") {
+		t.Fatalf("unexpected presence table %q", out)
+	}
+	var rows []struct{ UserID, Status string }
+	if err := json.Unmarshal([]byte(e.mustRun("", "presence", "-json", "u-alice")), &rows); err != nil || rows[0].Status != "busy" {
+		t.Fatalf("unexpected presence JSON %+v (%v)", rows, err)
+	}
+	if code, _, _ := e.run("", "status", "sleeping"); code != 2 {
+		t.Fatalf("expected usage error for unknown status, got %d", code)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"lan-chat/client"
+	"lan-chat/protocol"
+)
+
+const timeLayout = "2006-01-02 15:04:05"
+
+var typeNames = map[protocol.MessageType]string{
+	protocol.MessageTypeText:   "text",
+	protocol.MessageTypeImage:  "image",
+	protocol.MessageTypeFile:   "file",
+	protocol.MessageTypeSystem: "system",
+	protocol.MessageTypeVoice:  "voice",
+}
+
+func (a *app) printJSON(v interface{}) error {
+	return json.NewEncoder(a.stdout).Encode(v)
+}
+
+// messageView is the -json form of a message: one object per line, with
+// text decoded and sender and channel names resolved where possible.
+type messageView struct {
+	ID         string               `json:"id"`
+	ChannelID  string               `json:"channel_id"`
+	Channel    string               `json:"channel,omitempty"`
+	SenderID   string               `json:"sender_id"`
+	Sender     string               `json:"sender,omitempty"`
+	Time       time.Time            `json:"time"`
+	Type       string               `json:"type"`
+	Text       string               `json:"text,omitempty"`
+	Attachment *protocol.Attachment `json:"attachment,omitempty"`
+	Resumed    bool                 `json:"resumed,omitempty"`
+}
+
+// printer renders messages, looking up usernames per channel on demand.
+type printer struct {
+	a        *app
+	channels map[string]client.Channel
+	users    map[string]string
+	loaded   map[string]bool
+}
+
+func (a *app) newPrinter(channels []client.Channel) *printer {
+	p := &printer{
+		a:        a,
+		channels: make(map[string]client.Channel),
+		users:    make(map[string]string),
+		loaded:   make(map[string]bool),
+	}
+	for _, ch := range channels {
+		p.channels[ch.ID] = ch
+	}
+	return p
+}
+
+// sender resolves a user ID to a username via the channel's member list,
+// fetched at most once per channel. Lookups are best effort.
+func (p *printer) sender(ctx context.Context, channelID, userID string) string {
+	if name, ok := p.users[userID]; ok {
+		return name
+	}
+	if !p.loaded[channelID] {
+		p.loaded[channelID] = true
+		if members, err := p.a.c.Members(ctx, channelID); err == nil {
+			for _, m := range members {
+				p.users[m.ID] = m.Username
+			}
+		}
+	}
+	return p.users[userID]
+}
+
+func channelLabel(ch client.Channel) string {
+	if ch.Name != "" {
+		return ch.Name
+	}
+	return ch.ID
+}
+
+func (p *printer) print(ctx context.Context, msg *protocol.Message, resumed bool) error {
+	v := messageView{
+		ID:         msg.ID,
+		ChannelID:  msg.ChannelID,
+		SenderID:   msg.SenderID,
+		Sender:     p.sender(ctx, msg.ChannelID, msg.SenderID),
+		Time:       time.UnixMilli(msg.Timestamp),
+		Type:       typeNames[msg.Type],
+		Attachment: msg.Attachment,
+		Resumed:    resumed,
+	}
+	if ch, ok := p.channels[msg.ChannelID]; ok {
+		v.Channel = channelLabel(ch)
+	}
+	if v.Type == "" {
+		v.Type = "unknown"
+	}
+	if msg.Type != protocol.MessageTypeUnknown {
+		v.Text = string(msg.Content)
+	}
+	if p.a.json {
+		return p.a.printJSON(v)
+	}
+
+	channel, sender := v.Channel, v.Sender
+	if channel == "" {
+		channel = v.ChannelID
+	}
+	if sender == "" {
+		sender = v.SenderID
+	}
+	var body strings.Builder
+	body.WriteString(v.Text)
+	if att := v.Attachment; att != nil {
+		if body.Len() > 0 {
+			body.WriteString(" ")
+		}
+		if att.Voice != nil {
+			fmt.Fprintf(&body, "[voice %.1fs id=%s]", float64(att.Voice.DurationMs)/1000, att.FileID)
+		} else {
+			fmt.Fprintf(&body, "[%s %s, %d bytes, id=%s]", v.Type, att.Name, att.Size, att.FileID)
+		}
+	}
+	suffix := ""
+	if resumed {
+		suffix = " (missed)"
+	}
+	_, err := fmt.Fprintf(p.a.stdout, "%s #%s %s: %s%s\n", v.Time.Local().Format(timeLayout), channel, sender, body.String(), suffix)
+	return err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"lan-chat/client"
+)
+
+// savedSession is what `lanchat login` writes: the token plus the service
+// URLs it was issued by, so later commands need no flags.
+type savedSession struct {
+	client.Session
+	Username        string `json:"username"`
+	AuthURL         string `json:"auth_url"`
+	MessagingURL    string `json:"messaging_url"`
+	PresenceURL     string `json:"presence_url"`
+	FileTransferURL string `json:"filetransfer_url"`
+}
+
+func defaultSessionPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "lanchat", "session.json")
+}
+
+// loadSession reads the session file; a missing file is an empty session.
+func loadSession(path string) (*savedSession, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &savedSession{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s savedSession
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("corrupt session file %s: %w", path, err)
+	}
+	return &s, nil
+}
+
+// saveSession writes the session readable by the owner only, since the
+// token grants full access to the account.
+func saveSession(path string, s *savedSession) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,396 @@
+// Package client is the Go SDK for the LAN chat backend. It wraps the auth,
+// messaging, presence and filetransfer services behind context-aware calls
+// and delivers real-time traffic from /ws as typed events, reconnecting and
+// resuming missed history automatically.
+//
+// Tests can point a Client at fakeserver.Server instead of the real
+// services.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config locates the backend services. Unset URLs default to the ports used
+// by docker-compose on localhost.
+type Config struct {
+	AuthURL         string // default http://localhost:8086
+	MessagingURL    string // default http://localhost:8081
+	PresenceURL     string // default http://localhost:8083
+	FileTransferURL string // default http://localhost:8082
+
+	HTTPClient *http.Client
+
+	// Binary negotiates the Protobuf wire format on /ws.
+	Binary bool
+	// ClientName is sent in the /ws hello, e.g. "deploy-bot/1.2".
+	ClientName string
+	// Capabilities are requested in the /ws hello.
+	Capabilities []string
+	// DeviceID binds /ws and History to one of the user's registered
+	// devices, so fan-out messages carry this device's ciphertext.
+	DeviceID string
+	// OnSessionChange is called after the access and refresh tokens were
+	// rotated, so callers that persist the session can save the new one:
+	// the previous refresh token no longer works.
+	OnSessionChange func(Session)
+
+	// ReconnectMin and ReconnectMax bound the exponential reconnect backoff.
+	ReconnectMin time.Duration // default 500ms
+	ReconnectMax time.Duration // default 30s
+	// EventBuffer is the capacity of the Events channel. Events are dropped
+	// rather than blocking the connection when it is full.
+	EventBuffer int // default 256
+	// ResumeSkew is how far before the newest message seen in a channel
+	// history is replayed after a reconnect, matching the server's
+	// allowed clock skew for signed messages. Replayed messages are
+	// deduplicated by ID.
+	ResumeSkew time.Duration // default 5m
+}
+
+// ErrNotLoggedIn is returned by calls that need a token before Login or
+// SetSession.
+var ErrNotLoggedIn = errors.New("client: not logged in")
+
+// APIError is a non-2xx response from one of the services.
+type APIError struct {
+	StatusCode int
+	Message    string
+	// RetryAfter is the server's Retry-After hint on 429 and 503 responses.
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("client: %d %s", e.StatusCode, e.Message)
+}
+
+// Session is the result of a successful login. Sessions with a refresh
+// token renew their short-lived access token shortly before ExpiresAt.
+type Session struct {
+	Token        string    `json:"token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at,omitempty"`
+	UserID       string    `json:"user_id"`
+	Role         string    `json:"role"`
+}
+
+// refreshMargin is how long before expiry an access token is renewed.
+const refreshMargin = 30 * time.Second
+
+// Client talks to the chat backend on behalf of one user. It is safe for
+// concurrent use.
+type Client struct {
+	cfg  Config
+	http *http.Client
+
+	mu      sync.RWMutex
+	session Session
+	// refreshMu serialises refreshes: a refresh token works once, and the
+	// auth service revokes the session when one is presented twice.
+	refreshMu sync.Mutex
+
+	rt *realtime
+}
+
+// New returns a Client for cfg.
+func New(cfg Config) *Client {
+	if cfg.AuthURL == "" {
+		cfg.AuthURL = "http://localhost:8086"
+	}
+	if cfg.MessagingURL == "" {
+		cfg.MessagingURL = "http://localhost:8081"
+	}
+	if cfg.PresenceURL == "" {
+		cfg.PresenceURL = "http://localhost:8083"
+	}
+	if cfg.FileTransferURL == "" {
+		cfg.FileTransferURL = "http://localhost:8082"
+	}
+	for _, u := range []*string{&cfg.AuthURL, &cfg.MessagingURL, &cfg.PresenceURL, &cfg.FileTransferURL} {
+		*u = strings.TrimRight(*u, "/")
+	}
+	if cfg.ReconnectMin <= 0 {
+		cfg.ReconnectMin = 500 * time.Millisecond
+	}
+	if cfg.ReconnectMax < cfg.ReconnectMin {
+		cfg.ReconnectMax = 30 * time.Second
+	}
+	if cfg.EventBuffer <= 0 {
+		cfg.EventBuffer = 256
+	}
+	if cfg.ResumeSkew <= 0 {
+		cfg.ResumeSkew = 5 * time.Minute
+	}
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	c := &Client{cfg: cfg, http: httpClient}
+	c.rt = newRealtime(c)
+	return c
+}
+
+// MFARequiredError is returned by Login when the password was right but the
+// account needs a second factor: pass Challenge and a code to LoginMFA.
+type MFARequiredError struct {
+	Challenge string
+	// Purpose is "verify", or "enroll" when policy requires two-factor
+	// authentication the account has not set up; enrolling needs the
+	// auth service's /login/2fa/enroll, which this client does not wrap.
+	Purpose   string
+	ExpiresIn time.Duration
+}
+
+func (e *MFARequiredError) Error() string {
+	if e.Purpose == "enroll" {
+		return "client: two-factor authentication must be set up before logging in"
+	}
+	return "client: two-factor code required"
+}
+
+// PasswordChangeRequiredError is returned by Login when the password was
+// right but must be replaced first, after an administrator reset it or
+// once it expired: pass Challenge and a new password to
+// LoginChangePassword.
+type PasswordChangeRequiredError struct {
+	Challenge string
+	// Reason is "reset" or "expired".
+	Reason    string
+	ExpiresIn time.Duration
+}
+
+func (e *PasswordChangeRequiredError) Error() string {
+	return "client: password must be changed before logging in"
+}
+
+// loginResponse is a session or, for accounts with 2FA or a password to
+// change, a challenge.
+type loginResponse struct {
+	Session
+	MFARequired            bool   `json:"mfa_required"`
+	PasswordChangeRequired bool   `json:"password_change_required"`
+	Challenge              string `json:"challenge"`
+	Purpose                string `json:"purpose"`
+	Reason                 string `json:"reason"`
+	ExpiresIn              int64  `json:"expires_in"`
+}
+
+// Login exchanges credentials for a token at the auth service. Accounts
+// with two-factor authentication get an *MFARequiredError instead, and
+// accounts that must change the password a *PasswordChangeRequiredError.
+func (c *Client) Login(ctx context.Context, username, password string) (*Session, error) {
+	body := map[string]string{"username": username, "password": password}
+	return c.login(ctx, "/login", body)
+}
+
+// LoginMFA completes a login with the challenge from MFARequiredError and
+// a 6-digit authenticator code or, if code is anything else, a recovery
+// code.
+func (c *Client) LoginMFA(ctx context.Context, challenge, code string) (*Session, error) {
+	body := map[string]string{"challenge": challenge}
+	if isOTP(code) {
+		body["code"] = code
+	} else {
+		body["recovery_code"] = code
+	}
+	return c.login(ctx, "/login/2fa", body)
+}
+
+// LoginChangePassword sets a new password with the challenge from
+// PasswordChangeRequiredError and completes the login, unless the account
+// also needs a second factor (*MFARequiredError).
+func (c *Client) LoginChangePassword(ctx context.Context, challenge, newPassword string) (*Session, error) {
+	body := map[string]string{"challenge": challenge, "new_password": newPassword}
+	return c.login(ctx, "/login/password", body)
+}
+
+// ChangePassword replaces the signed-in user's password. The auth service
+// ends the user's other sessions; this one stays valid.
+func (c *Client) ChangePassword(ctx context.Context, current, newPassword string) error {
+	body := map[string]string{"current_password": current, "new_password": newPassword}
+	return c.do(ctx, http.MethodPost, c.cfg.AuthURL+"/password", body, nil, true)
+}
+
+func isOTP(code string) bool {
+	if len(code) != 6 {
+		return false
+	}
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Client) login(ctx context.Context, path string, body interface{}) (*Session, error) {
+	var resp loginResponse
+	if err := c.do(ctx, http.MethodPost, c.cfg.AuthURL+path, body, &resp, false); err != nil {
+		return nil, err
+	}
+	if resp.PasswordChangeRequired {
+		return nil, &PasswordChangeRequiredError{
+			Challenge: resp.Challenge,
+			Reason:    resp.Reason,
+			ExpiresIn: time.Duration(resp.ExpiresIn) * time.Second,
+		}
+	}
+	if resp.MFARequired {
+		return nil, &MFARequiredError{
+			Challenge: resp.Challenge,
+			Purpose:   resp.Purpose,
+			ExpiresIn: time.Duration(resp.ExpiresIn) * time.Second,
+		}
+	}
+	s := resp.Session
+	c.SetSession(s)
+	return &s, nil
+}
+
+// SetSession installs a token obtained elsewhere, e.g. a bot token.
+func (c *Client) SetSession(s Session) {
+	c.mu.Lock()
+	c.session = s
+	c.mu.Unlock()
+}
+
+// Session returns the current session.
+func (c *Client) Session() Session {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.session
+}
+
+// Refresh exchanges the refresh token for new access and refresh tokens.
+// Calls that need a token do this on their own when it is about to expire.
+func (c *Client) Refresh(ctx context.Context) (*Session, error) {
+	return c.refresh(ctx, c.Session().RefreshToken)
+}
+
+func (c *Client) refresh(ctx context.Context, spent string) (*Session, error) {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	current := c.Session()
+	if current.RefreshToken != spent {
+		// Another call rotated the tokens while this one waited.
+		return &current, nil
+	}
+	if spent == "" {
+		return nil, ErrNotLoggedIn
+	}
+	var s Session
+	body := map[string]string{"refresh_token": spent}
+	if err := c.do(ctx, http.MethodPost, c.cfg.AuthURL+"/refresh", body, &s, false); err != nil {
+		return nil, err
+	}
+	c.SetSession(s)
+	if c.cfg.OnSessionChange != nil {
+		c.cfg.OnSessionChange(s)
+	}
+	return &s, nil
+}
+
+// Logout revokes the session at the auth service and forgets it locally.
+func (c *Client) Logout(ctx context.Context) error {
+	s := c.Session()
+	if s.Token == "" {
+		return ErrNotLoggedIn
+	}
+	body, err := json.Marshal(map[string]string{"refresh_token": s.RefreshToken})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.AuthURL+"/logout", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.Token)
+	if err := c.send(req, nil, false); err != nil {
+		return err
+	}
+	c.SetSession(Session{})
+	return nil
+}
+
+// token returns the access token, renewing it first when it expires within
+// refreshMargin.
+func (c *Client) token(ctx context.Context) (string, error) {
+	s := c.Session()
+	if s.Token == "" {
+		return "", ErrNotLoggedIn
+	}
+	if s.RefreshToken == "" || s.ExpiresAt.IsZero() || time.Until(s.ExpiresAt) > refreshMargin {
+		return s.Token, nil
+	}
+	renewed, err := c.refresh(ctx, s.RefreshToken)
+	if err != nil {
+		return "", err
+	}
+	return renewed.Token, nil
+}
+
+// do sends a JSON request and decodes a JSON response into out (if non-nil).
+func (c *Client) do(ctx context.Context, method, url string, in, out interface{}, auth bool) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.send(req, out, auth)
+}
+
+func (c *Client) send(req *http.Request, out interface{}, auth bool) error {
+	if auth {
+		token, err := c.token(req.Context())
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	apiErr := &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		apiErr.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return apiErr
+}
@@ -0,0 +1,523 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"lan-chat/client"
+	"lan-chat/client/fakeserver"
+	"lan-chat/protocol"
+)
+
+func newTestClient(t *testing.T, srv *fakeserver.Server, username string, binary bool) *client.Client {
+	t.Helper()
+	cfg := srv.Config()
+	cfg.Binary = binary
+	c := client.New(cfg)
+	if _, err := c.Login(context.Background(), username, "secret"); err != nil {
+		t.Fatalf("login %s: %v", username, err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// nextEvent waits for the first event matching want, skipping others.
+func nextEvent[T client.Event](t *testing.T, c *client.Client) T {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev, ok := <-c.Events():
+			if !ok {
+				t.Fatal("event stream closed")
+			}
+			if v, ok := ev.(T); ok {
+				return v
+			}
+		case <-timeout:
+			var zero T
+			t.Fatalf("timed out waiting for %T", zero)
+		}
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLoginAndREST(t *testing.T) {
+	srv := fakeserver.New()
+	defer srv.Close()
+	alice := srv.AddUser("alice", "secret")
+	bob := srv.AddUser("bob", "secret")
+	srv.AddChannel("priv-1", "private", "private", alice)
+	ctx := context.Background()
+
+	anon := client.New(srv.Config())
+	if _, err := anon.Channels(ctx); !errors.Is(err, client.ErrNotLoggedIn) {
+		t.Fatalf("expected ErrNotLoggedIn, got %v", err)
+	}
+	_, err := anon.Login(ctx, "alice", "wrong")
+	var apiErr *client.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 APIError, got %v", err)
+	}
+
+	c := newTestClient(t, srv, "alice", false)
+	if s := c.Session(); s.UserID != alice || s.Token == "" {
+		t.Fatalf("unexpected session %+v", s)
+	}
+	channels, err := c.Channels(ctx)
+	if err != nil || len(channels) != 2 {
+		t.Fatalf("expected general and priv-1, got %+v (%v)", channels, err)
+	}
+
+	dm, err := c.OpenDM(ctx, bob)
+	if err != nil || dm == "" {
+		t.Fatalf("open dm: %q %v", dm, err)
+	}
+	if _, err := c.SendText(ctx, dm, "hi bob"); err != nil {
+		t.Fatal(err)
+	}
+	members, err := c.Members(ctx, dm)
+	if err != nil || len(members) != 2 {
+		t.Fatalf("expected 2 dm members, got %+v (%v)", members, err)
+	}
+
+	b := newTestClient(t, srv, "bob", false)
+	history, err := b.History(ctx, dm)
+	if err != nil || len(history) != 1 || string(history[0].Content) != "hi bob" || history[0].SenderID != alice {
+		t.Fatalf("unexpected dm history %+v (%v)", history, err)
+	}
+	_, err = b.History(ctx, "priv-1")
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for non-member, got %v", err)
+	}
+}
+
+func TestLoginWithSecondFactor(t *testing.T) {
+	srv := fakeserver.New()
+	defer srv.Close()
+	alice := srv.AddUser("alice", "secret")
+	srv.RequireOTP("alice", "123456")
+	ctx := context.Background()
+	c := client.New(srv.Config())
+
+	_, err := c.Login(ctx, "alice", "secret")
+	var mfaErr *client.MFARequiredError
+	if !errors.As(err, &mfaErr) || mfaErr.Challenge == "" || mfaErr.Purpose != "verify" {
+		t.Fatalf("expected MFARequiredError, got %v", err)
+	}
+	if c.Session().Token != "" {
+		t.Fatal("no session before the second factor")
+	}
+	_, err = c.LoginMFA(ctx, mfaErr.Challenge, "654321")
+	var apiErr *client.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a wrong code, got %v", err)
+	}
+	s, err := c.LoginMFA(ctx, mfaErr.Challenge, "123456")
+	if err != nil || s.UserID != alice || c.Session().Token == "" {
+		t.Fatalf("login with code: %+v %v", s, err)
+	}
+	if _, err := c.Channels(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.LoginMFA(ctx, mfaErr.Challenge, "123456"); !errors.As(err, &apiErr) {
+		t.Fatalf("a used challenge must be refused, got %v", err)
+	}
+}
+
+func TestPasswordChange(t *testing.T) {
+	srv := fakeserver.New()
+	defer srv.Close()
+	alice := srv.AddUser("alice", "temporary")
+	srv.RequirePasswordChange("alice")
+	srv.RequireOTP("alice", "123456")
+	ctx := context.Background()
+	c := client.New(srv.Config())
+
+	_, err := c.Login(ctx, "alice", "temporary")
+	var changeErr *client.PasswordChangeRequiredError
+	if !errors.As(err, &changeErr) || changeErr.Challenge == "" || changeErr.Reason != "reset" {
+		t.Fatalf("expected PasswordChangeRequiredError, got %v", err)
+	}
+	var apiErr *client.APIError
+	if _, err := c.LoginChangePassword(ctx, changeErr.Challenge, "short"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a rejected password, got %v", err)
+	}
+	// The new password is set, and the second factor is still asked for.
+	_, err = c.LoginChangePassword(ctx, changeErr.Challenge, "chosen-by-alice")
+	var mfaErr *client.MFARequiredError
+	if !errors.As(err, &mfaErr) {
+		t.Fatalf("expected MFARequiredError after the change, got %v", err)
+	}
+	if s, err := c.LoginMFA(ctx, mfaErr.Challenge, "123456"); err != nil || s.UserID != alice {
+		t.Fatalf("login with code: %+v %v", s, err)
+	}
+
+	if err := c.ChangePassword(ctx, "wrong", "another-one-1"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for a wrong current password, got %v", err)
+	}
+	if err := c.ChangePassword(ctx, "chosen-by-alice", "another-one-1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.Password("alice"); got != "another-one-1" {
+		t.Fatalf("password is %q", got)
+	}
+}
+
+func TestRefreshAndLogout(t *testing.T) {
+	srv := fakeserver.New()
+	defer srv.Close()
+	srv.AddUser("alice", "secret")
+	srv.TokenTTL = 10 * time.Second // inside the refresh margin: every call renews
+	ctx := context.Background()
+
+	var saved []client.Session
+	cfg := srv.Config()
+	cfg.OnSessionChange = func(s client.Session) { saved = append(saved, s) }
+	c := client.New(cfg)
+	first, err := c.Login(ctx, "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.RefreshToken == "" || first.ExpiresAt.IsZero() {
+		t.Fatalf("expected refresh token and expiry, got %+v", first)
+	}
+	if _, err := c.Channels(ctx); err != nil {
+		t.Fatal(err)
+	}
+	renewed := c.Session()
+	if renewed.Token == first.Token || renewed.RefreshToken == first.RefreshToken {
+		t.Fatalf("expected tokens to be rotated before expiry")
+	}
+	if len(saved) != 1 || saved[0] != renewed {
+		t.Fatalf("expected OnSessionChange with the new session, got %+v", saved)
+	}
+
+	// Replaying the spent refresh token revokes the whole session.
+	thief := client.New(srv.Config())
+	thief.SetSession(*first)
+	_, err = thief.Refresh(ctx)
+	var apiErr *client.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected reused refresh token to be rejected, got %v", err)
+	}
+	if _, err := c.Channels(ctx); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected session to be revoked after reuse, got %v", err)
+	}
+
+	srv.TokenTTL = time.Hour
+	s, err := c.Login(ctx, "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Logout(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Channels(ctx); !errors.Is(err, client.ErrNotLoggedIn) {
+		t.Fatalf("expected ErrNotLoggedIn after logout, got %v", err)
+	}
+	other := client.New(srv.Config())
+	other.SetSession(*s)
+	if _, err := other.Channels(ctx); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected logged out token to be rejected, got %v", err)
+	}
+}
+
+func TestRealtime(t *testing.T) {
+	for _, binary := range []bool{false, true} {
+		name := "json"
+		if binary {
+			name = "proto"
+		}
+		t.Run(name, func(t *testing.T) {
+			srv := fakeserver.New()
+			defer srv.Close()
+			alice := srv.AddUser("alice", "secret")
+			srv.AddUser("bob", "secret")
+			ctx := context.Background()
+
+			a := newTestClient(t, srv, "alice", binary)
+			b := newTestClient(t, srv, "bob", binary)
+			if err := a.Publish(ctx, protocol.SendMessageRequest{ChannelID: "general", Content: []byte("x")}); !errors.Is(err, client.ErrNotConnected) {
+				t.Fatalf("expected ErrNotConnected before Connect, got %v", err)
+			}
+			for _, c := range []*client.Client{a, b} {
+				if err := c.Connect(ctx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := a.Connect(ctx); !errors.Is(err, client.ErrAlreadyConnected) {
+				t.Fatalf("expected ErrAlreadyConnected, got %v", err)
+			}
+
+			welcome := nextEvent[client.WelcomeEvent](t, b)
+			if welcome.Welcome.Version != protocol.ProtocolVersion {
+				t.Fatalf("unexpected welcome %+v", welcome.Welcome)
+			}
+			hasBinary := false
+			for _, cap := range welcome.Welcome.Enabled {
+				hasBinary = hasBinary || cap == protocol.CapabilityBinary
+			}
+			if hasBinary != binary {
+				t.Fatalf("binary enabled = %v, want %v", hasBinary, binary)
+			}
+			nextEvent[client.WelcomeEvent](t, a)
+
+			if err := a.Publish(ctx, protocol.SendMessageRequest{ChannelID: "general", Type: protocol.MessageTypeText, Content: []byte("hello")}); err != nil {
+				t.Fatal(err)
+			}
+			ev := nextEvent[client.MessageEvent](t, b)
+			if string(ev.Message.Content) != "hello" || ev.Message.SenderID != alice || ev.Resumed {
+				t.Fatalf("unexpected message event %+v", ev)
+			}
+
+			if err := a.Publish(ctx, protocol.SendMessageRequest{ChannelID: "missing", Content: []byte("x")}); err != nil {
+				t.Fatal(err)
+			}
+			if e := nextEvent[client.ErrorEvent](t, a); e.Error.ChannelID != "missing" {
+				t.Fatalf("unexpected error event %+v", e)
+			}
+		})
+	}
+}
+
+func TestReconnectResumesMissedMessages(t *testing.T) {
+	srv := fakeserver.New()
+	defer srv.Close()
+	alice := srv.AddUser("alice", "secret")
+	bob := srv.AddUser("bob", "secret")
+	ctx := context.Background()
+
+	c := newTestClient(t, srv, "alice", false)
+	if err := c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent[client.WelcomeEvent](t, c)
+	waitFor(t, func() bool { return srv.Connections(alice) == 1 })
+	live := srv.Post(protocol.Message{ChannelID: "general", SenderID: bob, Content: []byte("before")})
+	if ev := nextEvent[client.MessageEvent](t, c); ev.Message.ID != live.ID {
+		t.Fatalf("unexpected live message %+v", ev)
+	}
+
+	srv.DropConnections()
+	if ev := nextEvent[client.DisconnectedEvent](t, c); ev.RetryIn <= 0 {
+		t.Fatalf("expected a retry after a dropped connection, got %+v", ev)
+	}
+	missed := srv.Post(protocol.Message{ChannelID: "general", SenderID: bob, Content: []byte("while away")})
+
+	if ev := nextEvent[client.ConnectedEvent](t, c); !ev.Reconnect {
+		t.Fatal("expected a reconnect event")
+	}
+	ev := nextEvent[client.MessageEvent](t, c)
+	if ev.Message.ID != missed.ID || !ev.Resumed {
+		t.Fatalf("expected resumed %s, got %+v", missed.ID, ev)
+	}
+
+	// Messages already delivered are not replayed again. "after" may arrive
+	// live or from history depending on timing, but only once.
+	srv.DropConnections()
+	nextEvent[client.ConnectedEvent](t, c)
+	waitFor(t, func() bool { return srv.Connections(alice) == 1 })
+	after := srv.Post(protocol.Message{ChannelID: "general", SenderID: bob, Content: []byte("after")})
+	if ev := nextEvent[client.MessageEvent](t, c); ev.Message.ID != after.ID {
+		t.Fatalf("expected only %s, got %+v", after.ID, ev)
+	}
+}
+
+func TestResumePagesThroughLongGaps(t *testing.T) {
+	srv := fakeserver.New()
+	defer srv.Close()
+	alice := srv.AddUser("alice", "secret")
+	bob := srv.AddUser("bob", "secret")
+	ctx := context.Background()
+
+	c := newTestClient(t, srv, "alice", false)
+	if err := c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent[client.WelcomeEvent](t, c)
+	waitFor(t, func() bool { return srv.Connections(alice) == 1 })
+	srv.DropConnections()
+	nextEvent[client.DisconnectedEvent](t, c)
+
+	// More than one history page, several messages per millisecond.
+	base := time.Now().Add(time.Second).UnixMilli()
+	const gap = client.HistoryPageSize*2 + 10
+	for i := 0; i < gap; i++ {
+		srv.Post(protocol.Message{ID: fmt.Sprintf("gap-%03d", i), ChannelID: "general", SenderID: bob, Timestamp: base + int64(i/3)})
+	}
+
+	nextEvent[client.ConnectedEvent](t, c)
+	for i := 0; i < gap; i++ {
+		ev := nextEvent[client.MessageEvent](t, c)
+		if want := fmt.Sprintf("gap-%03d", i); ev.Message.ID != want || !ev.Resumed {
+			t.Fatalf("resumed message %d: expected %s, got %s", i, want, ev.Message.ID)
+		}
+	}
+
+	history, err := c.History(ctx, "general")
+	if err != nil || len(history) != client.HistoryPageSize || history[0].ID != "gap-000" {
+		t.Fatalf("expected the oldest page, got %d messages (%v)", len(history), err)
+	}
+	rest, err := c.HistoryAfter(ctx, "general", client.CursorAfter(history[len(history)-1]), 0)
+	if err != nil || len(rest) != client.HistoryPageSize || rest[0].ID != fmt.Sprintf("gap-%03d", client.HistoryPageSize) {
+		t.Fatalf("expected the next page, got %d messages (%v)", len(rest), err)
+	}
+}
+
+func TestResumeReplaysLateMessagesStampedEarlier(t *testing.T) {
+	srv := fakeserver.New()
+	defer srv.Close()
+	alice := srv.AddUser("alice", "secret")
+	bob := srv.AddUser("bob", "secret")
+	ctx := context.Background()
+
+	c := newTestClient(t, srv, "alice", false)
+	if err := c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent[client.WelcomeEvent](t, c)
+	waitFor(t, func() bool { return srv.Connections(alice) == 1 })
+	now := time.Now().Add(time.Second).UnixMilli()
+	live := srv.Post(protocol.Message{ID: "live", ChannelID: "general", SenderID: bob, Timestamp: now})
+	if ev := nextEvent[client.MessageEvent](t, c); ev.Message.ID != live.ID {
+		t.Fatalf("unexpected live message %+v", ev)
+	}
+
+	// A signed message keeps its sender's clock, so it can be stored after
+	// "live" with an earlier timestamp.
+	srv.DropConnections()
+	nextEvent[client.DisconnectedEvent](t, c)
+	srv.Post(protocol.Message{ID: "late", ChannelID: "general", SenderID: bob, Timestamp: now - time.Minute.Milliseconds()})
+	srv.Post(protocol.Message{ID: "stale", ChannelID: "general", SenderID: bob, Timestamp: now - time.Hour.Milliseconds()})
+
+	nextEvent[client.ConnectedEvent](t, c)
+	if ev := nextEvent[client.MessageEvent](t, c); ev.Message.ID != "late" || !ev.Resumed {
+		t.Fatalf("expected the late message to be resumed, got %+v", ev)
+	}
+	select {
+	case ev := <-c.Events():
+		if m, ok := ev.(client.MessageEvent); ok {
+			t.Fatalf("unexpected replay of %s", m.Message.ID)
+		}
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestCloseStopsEvents(t *testing.T) {
+	srv := fakeserver.New()
+	defer srv.Close()
+	srv.AddUser("alice", "secret")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := newTestClient(t, srv, "alice", false)
+	if err := c.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	ev := nextEvent[client.DisconnectedEvent](t, c)
+	if !errors.Is(ev.Err, context.Canceled) || ev.RetryIn != 0 {
+		t.Fatalf("expected final disconnect, got %+v", ev)
+	}
+	select {
+	case _, ok := <-c.Events():
+		if ok {
+			t.Fatal("expected events to be closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("events not closed")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUploadDownload(t *testing.T) {
+	srv := fakeserver.New()
+	defer srv.Close()
+	srv.AddUser("alice", "secret")
+	bob := srv.AddUser("bob", "secret")
+	srv.AddUser("carol", "secret")
+	ctx := context.Background()
+
+	a := newTestClient(t, srv, "alice", false)
+	content := bytes.Repeat([]byte("lan-chat "), 1000)
+	up, err := a.Upload(ctx, "notes.txt", bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.Size != int64(len(content)) || up.Name != "notes.txt" || up.Key == "" {
+		t.Fatalf("unexpected upload %+v", up)
+	}
+	if got, err := a.Download(ctx, up.FileID, up.Key); err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("uploader could not read unshared file (%d bytes, %v)", len(got), err)
+	}
+
+	dm, err := a.OpenDM(ctx, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Send(ctx, protocol.SendMessageRequest{ChannelID: dm, Type: protocol.MessageTypeFile, Attachment: up.Attachment()}); err != nil {
+		t.Fatal(err)
+	}
+
+	b := newTestClient(t, srv, "bob", false)
+	got, err := b.Download(ctx, up.FileID, up.Key)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("download mismatch (%d bytes, %v)", len(got), err)
+	}
+
+	var apiErr *client.APIError
+	_, err = newTestClient(t, srv, "carol", false).Download(ctx, up.FileID, up.Key)
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for non-member, got %v", err)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	srv := fakeserver.New()
+	defer srv.Close()
+	alice := srv.AddUser("alice", "secret")
+	ctx := context.Background()
+
+	c := client.New(srv.Config())
+	if err := c.SetStatus(ctx, client.StatusBusy); !errors.Is(err, client.ErrNotLoggedIn) {
+		t.Fatalf("expected ErrNotLoggedIn, got %v", err)
+	}
+	c = newTestClient(t, srv, "alice", false)
+	if err := c.SetStatus(ctx, client.StatusBusy); err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.Presence(ctx, alice)
+	if err != nil || p.Status != client.StatusBusy {
+		t.Fatalf("unexpected presence %+v (%v)", p, err)
+	}
+
+	keepCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		c.KeepPresence(keepCtx, client.StatusAway, 10*time.Millisecond)
+		close(done)
+	}()
+	waitFor(t, func() bool {
+		p, err := c.Presence(ctx, alice)
+		return err == nil && p.Status == client.StatusAway
+	})
+	cancel()
+	<-done
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"time"
+
+	"lan-chat/protocol"
+)
+
+// Event is delivered on Client.Events. The concrete types are
+// ConnectedEvent, WelcomeEvent, MessageEvent, NoticeEvent, ErrorEvent and
+// DisconnectedEvent.
+type Event interface {
+	event()
+}
+
+// ConnectedEvent is sent each time the /ws connection is established.
+type ConnectedEvent struct {
+	Reconnect bool // false for the first connection made by Connect
+}
+
+// WelcomeEvent carries the server's answer to the client hello.
+type WelcomeEvent struct {
+	Welcome protocol.Welcome
+}
+
+// MessageEvent is a chat message. Resumed is set for messages that arrived
+// while the client was disconnected and were fetched from history after
+// reconnecting.
+type MessageEvent struct {
+	Message protocol.Message
+	Resumed bool
+}
+
+// NoticeEvent is a server notification, sent only when the notices
+// capability was negotiated.
+type NoticeEvent struct {
+	Notice protocol.Notice
+}
+
+// ErrorEvent is a request the server rejected, e.g. because of rate limits.
+type ErrorEvent struct {
+	Error protocol.ErrorDetail
+}
+
+// DisconnectedEvent is sent when the connection drops. RetryIn is the delay
+// before the next attempt; it is zero when the client has stopped, either
+// because Close was called or the server rejected the handshake (Err is
+// then a *protocol.HandshakeError).
+type DisconnectedEvent struct {
+	Err     error
+	RetryIn time.Duration
+}
+
+func (ConnectedEvent) event()    {}
+func (WelcomeEvent) event()      {}
+func (MessageEvent) event()      {}
+func (NoticeEvent) event()       {}
+func (ErrorEvent) event()        {}
+func (DisconnectedEvent) event() {}
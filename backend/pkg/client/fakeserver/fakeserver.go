@@ -0,0 +1,933 @@
+// Package fakeserver is an in-memory stand-in for the chat backend, for
+// testing code built on lan-chat/client without running the services. One
+// Server answers the auth, messaging, presence and filetransfer APIs on a
+// single URL:
+//
+//	srv := fakeserver.New()
+//	defer srv.Close()
+//	srv.AddUser("alice", "secret")
+//	c := client.New(srv.Config())
+//
+// It implements the happy paths of each endpoint with channel membership
+// checks; rate limits, retention and signatures are not modelled.
+package fakeserver
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"lan-chat/client"
+	"lan-chat/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// Capabilities advertised in Welcome.
+var Capabilities = []string{
+	protocol.CapabilityAttachments,
+	protocol.CapabilityBinary,
+	protocol.CapabilityEphemeral,
+	protocol.CapabilityVoice,
+}
+
+type user struct {
+	id       string
+	username string
+	password string
+	otp      string // second factor code, "" without 2FA
+	// mustChange makes the next login set a new password first.
+	mustChange bool
+}
+
+type channel struct {
+	client.Channel
+	members map[string]bool
+}
+
+type storedFile struct {
+	upload     client.Upload
+	uploadedBy string
+	ciphertext []byte
+}
+
+type conn struct {
+	userID string
+	ws     *websocket.Conn
+	codec  protocol.Codec
+	send   chan []byte
+}
+
+// authToken is an access or refresh token of a login session.
+type authToken struct {
+	userID  string
+	session string
+	expires time.Time // zero never expires
+}
+
+// Server is an in-memory chat backend. All methods are safe for concurrent use.
+type Server struct {
+	// URL is the base URL of every service.
+	URL string
+	// TokenTTL is the lifetime of access tokens issued from now on; zero
+	// means they never expire. Set it before the first login.
+	TokenTTL time.Duration
+
+	srv      *httptest.Server
+	upgrader websocket.Upgrader
+
+	mu       sync.Mutex
+	seq      int
+	users    map[string]*user // by username
+	tokens   map[string]authToken
+	refresh  map[string]authToken
+	spent    map[string]string // used refresh token -> session
+	pending  map[string]string // 2FA challenge -> username
+	changes  map[string]string // password change challenge -> username
+	channels map[string]*channel
+	messages map[string][]protocol.Message
+	presence map[string]client.Presence
+	files    map[string]*storedFile
+	conns    map[*conn]bool
+
+	// Per-user /send limit set by LimitSends.
+	sendLimit  int
+	sendWindow time.Duration
+	sends      map[string][]time.Time
+}
+
+// New starts a Server with a public "general" channel.
+func New() *Server {
+	s := &Server{
+		upgrader: websocket.Upgrader{
+			CheckOrigin:  func(*http.Request) bool { return true },
+			Subprotocols: protocol.Subprotocols,
+		},
+		users:    make(map[string]*user),
+		tokens:   make(map[string]authToken),
+		refresh:  make(map[string]authToken),
+		spent:    make(map[string]string),
+		pending:  make(map[string]string),
+		changes:  make(map[string]string),
+		channels: make(map[string]*channel),
+		messages: make(map[string][]protocol.Message),
+		presence: make(map[string]client.Presence),
+		files:    make(map[string]*storedFile),
+		conns:    make(map[*conn]bool),
+	}
+	s.AddChannel("general", "general", "public")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", s.login)
+	mux.HandleFunc("/login/2fa", s.loginMFA)
+	mux.HandleFunc("/login/password", s.loginPassword)
+	mux.HandleFunc("/password", s.changePassword)
+	mux.HandleFunc("/refresh", s.refreshSession)
+	mux.HandleFunc("/logout", s.logout)
+	mux.HandleFunc("/channels", s.listChannels)
+	mux.HandleFunc("/channel-members", s.channelMembers)
+	mux.HandleFunc("/dm", s.openDM)
+	mux.HandleFunc("/history", s.history)
+	mux.HandleFunc("/send", s.sendHTTP)
+	mux.HandleFunc("/ws", s.handleWS)
+	mux.HandleFunc("/heartbeat", s.heartbeat)
+	mux.HandleFunc("/status", s.status)
+	mux.HandleFunc("/upload", s.upload)
+	mux.HandleFunc("/download", s.download)
+	s.srv = httptest.NewServer(mux)
+	s.URL = s.srv.URL
+	return s
+}
+
+// Config returns a client configuration pointing every service at s.
+func (s *Server) Config() client.Config {
+	return client.Config{
+		AuthURL:         s.URL,
+		MessagingURL:    s.URL,
+		PresenceURL:     s.URL,
+		FileTransferURL: s.URL,
+		ReconnectMin:    20 * time.Millisecond,
+		ReconnectMax:    200 * time.Millisecond,
+	}
+}
+
+// Close drops all connections and stops the server.
+func (s *Server) Close() {
+	s.DropConnections()
+	s.srv.Close()
+}
+
+// AddUser creates a user and returns its ID ("u-" + username).
+func (s *Server) AddUser(username, password string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := &user{id: "u-" + username, username: username, password: password}
+	s.users[username] = u
+	return u.id
+}
+
+// RequireOTP turns on two-factor login for username: after the password,
+// the user must present code (the fake has no clock, so it never changes).
+func (s *Server) RequireOTP(username, code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[username]; ok {
+		u.otp = code
+	}
+}
+
+// RequirePasswordChange makes username's next login set a new password
+// before it completes, as after an administrator's reset.
+func (s *Server) RequirePasswordChange(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[username]; ok {
+		u.mustChange = true
+	}
+}
+
+// Password returns username's current password.
+func (s *Server) Password(username string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[username]; ok {
+		return u.password
+	}
+	return ""
+}
+
+// AddChannel creates or replaces a channel. typ is "public", "private" or
+// "dm"; members are user IDs and are ignored for public channels.
+func (s *Server) AddChannel(id, name, typ string, members ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := &channel{Channel: client.Channel{ID: id, Name: name, Type: typ}, members: make(map[string]bool)}
+	for _, m := range members {
+		ch.members[m] = true
+	}
+	s.channels[id] = ch
+}
+
+// Post stores msg as if a user had sent it and delivers it to connected
+// members. ID and Timestamp are filled in when empty.
+func (s *Server) Post(msg protocol.Message) protocol.Message {
+	s.mu.Lock()
+	if msg.ID == "" {
+		s.seq++
+		msg.ID = fmt.Sprintf("m-%d", s.seq)
+	}
+	if msg.Timestamp == 0 {
+		msg.Timestamp = time.Now().UnixMilli()
+	}
+	s.messages[msg.ChannelID] = append(s.messages[msg.ChannelID], msg)
+	targets := s.recipientsLocked(msg.ChannelID)
+	s.mu.Unlock()
+
+	for _, c := range targets {
+		c.enqueue(&protocol.Envelope{Message: &msg})
+	}
+	return msg
+}
+
+// LimitSends rejects /send requests beyond n per window and user with 429
+// and a Retry-After hint, like the messaging flood guard.
+func (s *Server) LimitSends(n int, window time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sendLimit, s.sendWindow = n, window
+	s.sends = make(map[string][]time.Time)
+}
+
+// sendWaitLocked records a send by userID and returns how long it must wait
+// when over the limit.
+func (s *Server) sendWaitLocked(userID string) time.Duration {
+	if s.sendLimit <= 0 {
+		return 0
+	}
+	now := time.Now()
+	recent := s.sends[userID][:0]
+	for _, at := range s.sends[userID] {
+		if now.Sub(at) < s.sendWindow {
+			recent = append(recent, at)
+		}
+	}
+	s.sends[userID] = recent
+	if len(recent) >= s.sendLimit {
+		return s.sendWindow - now.Sub(recent[0])
+	}
+	s.sends[userID] = append(recent, now)
+	return 0
+}
+
+// Messages returns the stored messages of a channel, oldest first.
+func (s *Server) Messages(channelID string) []protocol.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]protocol.Message(nil), s.messages[channelID]...)
+}
+
+// Connections returns the number of open /ws connections of userID.
+func (s *Server) Connections(userID string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for c := range s.conns {
+		if c.userID == userID {
+			n++
+		}
+	}
+	return n
+}
+
+// DropConnections closes every /ws connection, as a restart or network
+// failure would.
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	conns := make([]*conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+	for _, c := range conns {
+		c.ws.Close()
+	}
+}
+
+func (c *conn) enqueue(env *protocol.Envelope) {
+	data, err := c.codec.EncodeFrame(env)
+	if err != nil {
+		return
+	}
+	select {
+	case c.send <- data:
+	default:
+	}
+}
+
+func (s *Server) recipientsLocked(channelID string) []*conn {
+	ch := s.channels[channelID]
+	var out []*conn
+	for c := range s.conns {
+		if ch != nil && (ch.Type == "public" || ch.members[c.userID]) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func (s *Server) authenticate(r *http.Request) (string, bool) {
+	token := r.URL.Query().Get("token")
+	if h := r.Header.Get("Authorization"); len(h) > 7 && h[:7] == "Bearer " {
+		token = h[7:]
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[token]
+	if !ok || (!t.expires.IsZero() && time.Now().After(t.expires)) {
+		return "", false
+	}
+	return t.userID, true
+}
+
+func (s *Server) canReadLocked(userID, channelID string) bool {
+	ch := s.channels[channelID]
+	return ch != nil && (ch.Type == "public" || ch.members[userID])
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&body) != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	u, ok := s.users[body.Username]
+	if !ok || u.password != body.Password {
+		s.mu.Unlock()
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if u.mustChange {
+		challenge := randomHex(16)
+		s.changes[challenge] = u.username
+		s.mu.Unlock()
+		writeJSON(w, map[string]interface{}{
+			"password_change_required": true, "challenge": challenge, "reason": "reset", "expires_in": 300,
+		})
+		return
+	}
+	s.afterPasswordLocked(w, u)
+}
+
+// afterPasswordLocked asks for the second factor or issues a session, and
+// unlocks s.mu.
+func (s *Server) afterPasswordLocked(w http.ResponseWriter, u *user) {
+	if u.otp != "" {
+		challenge := randomHex(16)
+		s.pending[challenge] = u.username
+		s.mu.Unlock()
+		writeJSON(w, map[string]interface{}{
+			"mfa_required": true, "challenge": challenge, "purpose": "verify",
+			"methods": []string{"totp"}, "expires_in": 300,
+		})
+		return
+	}
+	session := s.issueLocked(u.id, randomHex(8))
+	s.mu.Unlock()
+	writeJSON(w, session)
+}
+
+// loginPassword answers a password change challenge. The fake's only rule
+// is that the new password has 8 characters and differs from the old one.
+func (s *Server) loginPassword(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Challenge   string `json:"challenge"`
+		NewPassword string `json:"new_password"`
+	}
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&body) != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	u, ok := s.users[s.changes[body.Challenge]]
+	if !ok {
+		s.mu.Unlock()
+		http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+	if len(body.NewPassword) < 8 || body.NewPassword == u.password {
+		s.mu.Unlock()
+		http.Error(w, "Password rejected: too weak", http.StatusBadRequest)
+		return
+	}
+	delete(s.changes, body.Challenge)
+	u.password, u.mustChange = body.NewPassword, false
+	s.afterPasswordLocked(w, u)
+}
+
+func (s *Server) changePassword(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.authenticate(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var body struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&body) != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.id != userID {
+			continue
+		}
+		if u.password != body.CurrentPassword {
+			http.Error(w, "Current password is incorrect", http.StatusForbidden)
+			return
+		}
+		if len(body.NewPassword) < 8 || body.NewPassword == u.password {
+			http.Error(w, "Password rejected: too weak", http.StatusBadRequest)
+			return
+		}
+		u.password = body.NewPassword
+		writeJSON(w, map[string]interface{}{"ok": true, "revoked_sessions": 0})
+		return
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+func (s *Server) loginMFA(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&body) != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[s.pending[body.Challenge]]
+	if !ok {
+		http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+	if body.Code != u.otp {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	delete(s.pending, body.Challenge)
+	writeJSON(w, s.issueLocked(u.id, randomHex(8)))
+}
+
+// issueLocked hands out a new access and refresh token pair for session.
+func (s *Server) issueLocked(userID, session string) client.Session {
+	t := authToken{userID: userID, session: session}
+	if s.TokenTTL > 0 {
+		t.expires = time.Now().Add(s.TokenTTL)
+	}
+	access, refresh := "fake-"+randomHex(16), "fake-refresh-"+randomHex(16)
+	s.tokens[access] = t
+	s.refresh[refresh] = authToken{userID: userID, session: session}
+	return client.Session{Token: access, RefreshToken: refresh, ExpiresAt: t.expires, UserID: userID, Role: "member"}
+}
+
+// revokeLocked drops every token of session.
+func (s *Server) revokeLocked(session string) {
+	for k, t := range s.tokens {
+		if t.session == session {
+			delete(s.tokens, k)
+		}
+	}
+	for k, t := range s.refresh {
+		if t.session == session {
+			delete(s.refresh, k)
+		}
+	}
+}
+
+// refreshSession rotates a refresh token. Presenting a spent one revokes
+// its session, as the auth service does.
+func (s *Server) refreshSession(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&body) != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, reused := s.spent[body.RefreshToken]; reused {
+		s.revokeLocked(session)
+		http.Error(w, "Refresh token reused, session revoked", http.StatusUnauthorized)
+		return
+	}
+	t, ok := s.refresh[body.RefreshToken]
+	if !ok {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	delete(s.refresh, body.RefreshToken)
+	s.spent[body.RefreshToken] = t.session
+	writeJSON(w, s.issueLocked(t.userID, t.session))
+}
+
+func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	token := ""
+	if h := r.Header.Get("Authorization"); len(h) > 7 && h[:7] == "Bearer " {
+		token = h[7:]
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[token]
+	if !ok {
+		t, ok = s.refresh[body.RefreshToken]
+	}
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.revokeLocked(t.session)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listChannels(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.authenticate(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	out := make([]client.Channel, 0)
+	for id, ch := range s.channels {
+		if s.canReadLocked(userID, id) {
+			out = append(out, ch.Channel)
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	writeJSON(w, map[string]interface{}{"channels": out})
+}
+
+func (s *Server) channelMembers(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.authenticate(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	channelID := r.URL.Query().Get("channel_id")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.canReadLocked(userID, channelID) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	out := make([]client.Member, 0)
+	for _, u := range s.users {
+		if s.channels[channelID].Type == "public" || s.channels[channelID].members[u.id] {
+			out = append(out, client.Member{ID: u.id, Username: u.username, FullName: u.username})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	writeJSON(w, map[string]interface{}{"members": out})
+}
+
+func (s *Server) openDM(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.authenticate(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var body struct {
+		TargetUserID string `json:"target_user_id"`
+	}
+	if json.NewDecoder(r.Body).Decode(&body) != nil || body.TargetUserID == "" || body.TargetUserID == userID {
+		http.Error(w, "invalid target", http.StatusBadRequest)
+		return
+	}
+	pair := []string{userID, body.TargetUserID}
+	sort.Strings(pair)
+	id := "dm-" + pair[0] + "-" + pair[1]
+	s.mu.Lock()
+	_, exists := s.channels[id]
+	s.mu.Unlock()
+	if !exists {
+		s.AddChannel(id, "", "dm", pair...)
+	}
+	writeJSON(w, map[string]string{"channel_id": id})
+}
+
+func (s *Server) history(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.authenticate(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	channelID := r.URL.Query().Get("channel_id")
+	s.mu.Lock()
+	allowed := s.canReadLocked(userID, channelID)
+	s.mu.Unlock()
+	if !allowed {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	// Like the real server: oldest first by (timestamp, id), from the
+	// since/after_id cursor, at most 100 per page.
+	q := r.URL.Query()
+	var since int64
+	if v := q.Get("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+	afterID := q.Get("after_id")
+	limit := client.HistoryPageSize
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, limit)
+	}
+	msgs := s.Messages(channelID)
+	sort.SliceStable(msgs, func(i, j int) bool {
+		if msgs[i].Timestamp != msgs[j].Timestamp {
+			return msgs[i].Timestamp < msgs[j].Timestamp
+		}
+		return msgs[i].ID < msgs[j].ID
+	})
+	page := []protocol.Message{}
+	for _, m := range msgs {
+		if len(page) == limit {
+			break
+		}
+		if q.Has("since") && (m.Timestamp < since || m.Timestamp == since && m.ID <= afterID) {
+			continue
+		}
+		page = append(page, m)
+	}
+	writeJSON(w, page)
+}
+
+// accept stores a message sent by userID, reporting false when the channel
+// is unknown or not readable, or the attachment is someone else's file the
+// sender cannot read.
+func (s *Server) accept(userID string, req *protocol.SendMessageRequest) (protocol.Message, bool) {
+	s.mu.Lock()
+	allowed := s.canReadLocked(userID, req.ChannelID)
+	if allowed && req.Attachment != nil {
+		_, allowed = s.fileAccessLocked(userID, req.Attachment.FileID)
+	}
+	s.mu.Unlock()
+	if !allowed {
+		return protocol.Message{}, false
+	}
+	return s.Post(protocol.Message{
+		ChannelID:  req.ChannelID,
+		SenderID:   userID,
+		Type:       req.Type,
+		Content:    req.Content,
+		Nonce:      req.Nonce,
+		Signature:  req.Signature,
+		DeviceID:   req.DeviceID,
+		Attachment: req.Attachment,
+	}), true
+}
+
+func (s *Server) sendHTTP(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.authenticate(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req protocol.SendMessageRequest
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&req) != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	wait := s.sendWaitLocked(userID)
+	s.mu.Unlock()
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+		http.Error(w, "rate limited", http.StatusTooManyRequests)
+		return
+	}
+	msg, ok := s.accept(userID, &req)
+	if !ok {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	writeJSON(w, protocol.SendMessageResponse{MessageID: msg.ID, Success: true})
+}
+
+func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.authenticate(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &conn{userID: userID, ws: ws, codec: protocol.CodecFor(ws.Subprotocol()), send: make(chan []byte, 256)}
+	s.mu.Lock()
+	s.conns[c] = true
+	s.mu.Unlock()
+
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+			close(c.send)
+		}()
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			env, err := c.codec.DecodeFrame(data)
+			if err != nil {
+				continue
+			}
+			switch {
+			case env.Hello != nil:
+				welcome, err := protocol.Negotiate(env.Hello, 0, protocol.ProtocolVersion, Capabilities)
+				if err != nil {
+					detail := err.(*protocol.HandshakeError).Detail
+					c.enqueue(&protocol.Envelope{Error: &detail})
+					return
+				}
+				c.enqueue(&protocol.Envelope{Welcome: welcome})
+			case env.Send != nil:
+				if _, ok := s.accept(userID, env.Send); !ok {
+					c.enqueue(&protocol.Envelope{Error: &protocol.ErrorDetail{
+						Code: "forbidden", Message: "channel not found or not readable", ChannelID: env.Send.ChannelID,
+					}})
+				}
+			}
+		}
+	}()
+
+	frameType := websocket.TextMessage
+	if c.codec.Binary() {
+		frameType = websocket.BinaryMessage
+	}
+	for data := range c.send {
+		if ws.WriteMessage(frameType, data) != nil {
+			break
+		}
+	}
+	ws.Close()
+}
+
+func (s *Server) heartbeat(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		UserID string        `json:"user_id"`
+		Status client.Status `json:"status"`
+	}
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&body) != nil || body.UserID == "" {
+		http.Error(w, "Invalid body", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.presence[body.UserID] = client.Presence{UserID: body.UserID, Status: body.Status, LastSeen: time.Now()}
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		http.Error(w, "Missing user_id", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	p, ok := s.presence[userID]
+	s.mu.Unlock()
+	if !ok || time.Since(p.LastSeen) > time.Minute {
+		p.UserID, p.Status = userID, client.StatusOffline
+	}
+	writeJSON(w, p)
+}
+
+func (s *Server) upload(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.authenticate(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Invalid file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Read error", http.StatusInternalServerError)
+		return
+	}
+
+	// Same layout as the filetransfer service: IV followed by AES-GCM output.
+	key := make([]byte, 32)
+	iv := make([]byte, 12)
+	_, _ = rand.Read(key)
+	_, _ = rand.Read(iv)
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+	digest := sha256.Sum256(content)
+	mimeType := header.Header.Get("Content-Type")
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = http.DetectContentType(content)
+	}
+	f := &storedFile{
+		upload: client.Upload{
+			FileID:   randomUUID(),
+			Key:      hex.EncodeToString(key),
+			Name:     header.Filename,
+			Size:     int64(len(content)),
+			MimeType: mimeType,
+			SHA256:   hex.EncodeToString(digest[:]),
+		},
+		ciphertext: append(iv, gcm.Seal(nil, iv, content, nil)...),
+	}
+	f.uploadedBy = userID
+	s.mu.Lock()
+	s.files[f.upload.FileID] = f
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, f.upload)
+}
+
+// fileAccessLocked reports whether fileID was uploaded by userID or shared
+// in a channel userID can read. Files the server has not stored pass, as
+// the real service only knows the uploader of files it stored.
+func (s *Server) fileAccessLocked(userID, fileID string) (shared, allowed bool) {
+	if f, ok := s.files[fileID]; !ok || f.uploadedBy == userID {
+		return ok, true
+	}
+	for channelID, msgs := range s.messages {
+		for _, m := range msgs {
+			if m.Attachment != nil && m.Attachment.FileID == fileID {
+				shared = true
+				allowed = allowed || s.canReadLocked(userID, channelID)
+			}
+		}
+	}
+	return shared, allowed
+}
+
+// download serves a file to its uploader and to members of a channel it was
+// shared in, like the real filetransfer service does via messaging.
+func (s *Server) download(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.authenticate(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	fileID := r.URL.Query().Get("id")
+	s.mu.Lock()
+	f, exists := s.files[fileID]
+	shared, allowed := s.fileAccessLocked(userID, fileID)
+	s.mu.Unlock()
+	switch {
+	case !exists || !(shared || allowed):
+		http.Error(w, "File not found", http.StatusNotFound)
+	case !allowed:
+		http.Error(w, "forbidden", http.StatusForbidden)
+	default:
+		_, _ = w.Write(f.ciphertext)
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func randomUUID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
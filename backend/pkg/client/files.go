@@ -0,0 +1,107 @@
+package client
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+
+	"lan-chat/protocol"
+)
+
+// Upload is the filetransfer record of an uploaded file. Key decrypts the
+// stored ciphertext and must be shared with recipients out of band (e.g.
+// inside an end-to-end encrypted message).
+type Upload struct {
+	FileID   string `json:"file_id"`
+	Key      string `json:"key"` // hex AES-256 key
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	MimeType string `json:"mime_type"`
+	SHA256   string `json:"sha256"`
+}
+
+// Attachment returns the descriptor to send with a file message.
+func (u *Upload) Attachment() *protocol.Attachment {
+	return &protocol.Attachment{FileID: u.FileID, Name: u.Name, Size: u.Size, MimeType: u.MimeType, SHA256: u.SHA256}
+}
+
+var errShortCiphertext = errors.New("client: downloaded file is too short")
+
+// Upload streams r to the filetransfer service as name.
+func (c *Client) Upload(ctx context.Context, name string, r io.Reader) (*Upload, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		fw, err := mw.CreateFormFile("file", name)
+		if err == nil {
+			_, err = io.Copy(fw, r)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.FileTransferURL+"/upload", pr)
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	var out Upload
+	if err := c.send(req, &out, true); err != nil {
+		pr.Close()
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Download fetches a file and decrypts it with the hex key returned by
+// Upload. Access is granted by membership of a channel the file was shared in.
+func (c *Client) Download(ctx context.Context, fileID, key string) ([]byte, error) {
+	dek, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		c.cfg.FileTransferURL+"/download?id="+url.QueryEscape(fileID), nil)
+	if err != nil {
+		return nil, err
+	}
+	token, err := c.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(dek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errShortCiphertext
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
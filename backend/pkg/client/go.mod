@@ -0,0 +1,12 @@
+module lan-chat/client
+
+go 1.22
+
+require (
+	github.com/gorilla/websocket v1.5.3
+	lan-chat/protocol v0.0.0
+)
+
+require google.golang.org/protobuf v1.34.2 // indirect
+
+replace lan-chat/protocol => ../protocol
@@ -0,0 +1,128 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"lan-chat/protocol"
+)
+
+// Channel is a channel the user can read.
+type Channel struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"` // "public", "private" or "dm"
+}
+
+// Member is a channel member.
+type Member struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	FullName string `json:"full_name"`
+}
+
+// Channels lists the channels the user can access.
+func (c *Client) Channels(ctx context.Context) ([]Channel, error) {
+	var out struct {
+		Channels []Channel `json:"channels"`
+	}
+	if err := c.do(ctx, http.MethodGet, c.cfg.MessagingURL+"/channels", nil, &out, true); err != nil {
+		return nil, err
+	}
+	return out.Channels, nil
+}
+
+// Members lists the members of a channel.
+func (c *Client) Members(ctx context.Context, channelID string) ([]Member, error) {
+	var out struct {
+		Members []Member `json:"members"`
+	}
+	u := c.cfg.MessagingURL + "/channel-members?channel_id=" + url.QueryEscape(channelID)
+	if err := c.do(ctx, http.MethodGet, u, nil, &out, true); err != nil {
+		return nil, err
+	}
+	return out.Members, nil
+}
+
+// OpenDM returns the direct-message channel with targetUserID, creating it
+// if needed.
+func (c *Client) OpenDM(ctx context.Context, targetUserID string) (string, error) {
+	var out struct {
+		ChannelID string `json:"channel_id"`
+	}
+	body := map[string]string{"target_user_id": targetUserID}
+	if err := c.do(ctx, http.MethodPost, c.cfg.MessagingURL+"/dm", body, &out, true); err != nil {
+		return "", err
+	}
+	return out.ChannelID, nil
+}
+
+// HistoryPageSize is the most messages the server returns per history page.
+const HistoryPageSize = 100
+
+// HistoryCursor is a position in a channel's history. The zero value starts
+// at the oldest message. Since (Unix ms) alone includes messages sent in that
+// millisecond; AfterID also skips those up to and including that message ID.
+type HistoryCursor struct {
+	Since   int64
+	AfterID string
+}
+
+// CursorAfter returns the cursor that continues a walk after msg.
+func CursorAfter(msg protocol.Message) HistoryCursor {
+	return HistoryCursor{Since: msg.Timestamp, AfterID: msg.ID}
+}
+
+// History returns the oldest page of a channel's messages, oldest first.
+// Use HistoryAfter to walk further.
+func (c *Client) History(ctx context.Context, channelID string) ([]protocol.Message, error) {
+	return c.HistoryAfter(ctx, channelID, HistoryCursor{}, HistoryPageSize)
+}
+
+// HistoryAfter returns up to limit (at most HistoryPageSize) messages of a
+// channel from cursor on, oldest first. A page shorter than limit is the end
+// of the channel.
+func (c *Client) HistoryAfter(ctx context.Context, channelID string, cursor HistoryCursor, limit int) ([]protocol.Message, error) {
+	var out []protocol.Message
+	q := url.Values{"channel_id": {channelID}}
+	if cursor.Since != 0 || cursor.AfterID != "" {
+		q.Set("since", strconv.FormatInt(cursor.Since, 10))
+	}
+	if cursor.AfterID != "" {
+		q.Set("after_id", cursor.AfterID)
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	if c.cfg.DeviceID != "" {
+		q.Set("device_id", c.cfg.DeviceID)
+	}
+	if err := c.do(ctx, http.MethodGet, c.cfg.MessagingURL+"/history?"+q.Encode(), nil, &out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Send posts a message over HTTP and returns its ID. Use Publish to send
+// over the real-time connection instead.
+func (c *Client) Send(ctx context.Context, req protocol.SendMessageRequest) (string, error) {
+	var out protocol.SendMessageResponse
+	if err := c.do(ctx, http.MethodPost, c.cfg.MessagingURL+"/send", req, &out, true); err != nil {
+		return "", err
+	}
+	if !out.Success {
+		return "", &APIError{StatusCode: http.StatusOK, Message: out.Error}
+	}
+	return out.MessageID, nil
+}
+
+// SendText is a convenience wrapper around Send for plain-text messages.
+func (c *Client) SendText(ctx context.Context, channelID, text string) (string, error) {
+	return c.Send(ctx, protocol.SendMessageRequest{
+		ChannelID: channelID,
+		Type:      protocol.MessageTypeText,
+		Content:   []byte(text),
+	})
+}
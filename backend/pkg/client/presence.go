@@ -0,0 +1,64 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Status is a user's presence status, as stored by the presence service.
+type Status int
+
+const (
+	StatusOffline Status = iota
+	StatusOnline
+	StatusBusy
+	StatusAway
+)
+
+// Presence is a user's last reported status.
+type Presence struct {
+	UserID   string    `json:"user_id"`
+	Status   Status    `json:"status"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// SetStatus reports the logged-in user's status. The presence service marks
+// users offline after a minute without a heartbeat; see KeepPresence.
+func (c *Client) SetStatus(ctx context.Context, status Status) error {
+	userID := c.Session().UserID
+	if userID == "" {
+		return ErrNotLoggedIn
+	}
+	body := map[string]interface{}{"user_id": userID, "status": status}
+	return c.do(ctx, http.MethodPost, c.cfg.PresenceURL+"/heartbeat", body, nil, false)
+}
+
+// KeepPresence reports status every interval until ctx is done. Failed
+// heartbeats are retried on the next tick.
+func (c *Client) KeepPresence(ctx context.Context, status Status, interval time.Duration) {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		_ = c.SetStatus(ctx, status)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Presence returns the status of userID.
+func (c *Client) Presence(ctx context.Context, userID string) (*Presence, error) {
+	var p Presence
+	u := c.cfg.PresenceURL + "/status?user_id=" + url.QueryEscape(userID)
+	if err := c.do(ctx, http.MethodGet, u, nil, &p, false); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
@@ -0,0 +1,374 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"lan-chat/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// ErrNotConnected is returned by Publish while /ws is down.
+	ErrNotConnected = errors.New("client: not connected")
+	// ErrAlreadyConnected is returned by a second call to Connect.
+	ErrAlreadyConnected = errors.New("client: already connected")
+)
+
+// realtime owns the /ws connection and the reconnect loop.
+type realtime struct {
+	c      *Client
+	events chan Event
+
+	mu      sync.Mutex
+	started bool
+	conn    *websocket.Conn
+	codec   protocol.Codec
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	writeMu sync.Mutex
+
+	// Resume bookkeeping: the newest timestamp seen per channel and the IDs
+	// seen within ResumeSkew of it, plus when the first connection was made.
+	trackMu sync.Mutex
+	newest  map[string]int64
+	seen    map[string]map[string]int64 // channel -> message ID -> timestamp
+	since   int64
+}
+
+func newRealtime(c *Client) *realtime {
+	return &realtime{
+		c:      c,
+		events: make(chan Event, c.cfg.EventBuffer),
+		newest: make(map[string]int64),
+		seen:   make(map[string]map[string]int64),
+	}
+}
+
+// Events returns the channel on which real-time events are delivered. It is
+// closed when the connection stops for good.
+func (c *Client) Events() <-chan Event {
+	return c.rt.events
+}
+
+// Connect opens /ws and keeps it open, reconnecting with backoff and
+// replaying missed messages from history, until ctx is done or Close is
+// called. The first connection attempt is made synchronously so that
+// authentication errors are returned directly.
+func (c *Client) Connect(ctx context.Context) error {
+	rt := c.rt
+	rt.mu.Lock()
+	if rt.started {
+		rt.mu.Unlock()
+		return ErrAlreadyConnected
+	}
+	rt.mu.Unlock()
+
+	conn, codec, err := rt.dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	loopCtx, cancel := context.WithCancel(ctx)
+	rt.mu.Lock()
+	rt.started = true
+	rt.cancel = cancel
+	rt.done = make(chan struct{})
+	rt.mu.Unlock()
+
+	rt.trackMu.Lock()
+	rt.since = time.Now().UnixMilli()
+	rt.trackMu.Unlock()
+
+	go rt.run(loopCtx, conn, codec)
+	return nil
+}
+
+// Close stops the real-time connection and waits for it to shut down.
+func (c *Client) Close() error {
+	rt := c.rt
+	rt.mu.Lock()
+	cancel, done, conn := rt.cancel, rt.done, rt.conn
+	rt.mu.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	if conn != nil {
+		conn.Close()
+	}
+	<-done
+	return nil
+}
+
+// Publish sends a message over /ws. The server answers rejected messages
+// with an ErrorEvent rather than an error here.
+func (c *Client) Publish(ctx context.Context, req protocol.SendMessageRequest) error {
+	return c.rt.write(ctx, &protocol.Envelope{Send: &req})
+}
+
+func (rt *realtime) wsURL() string {
+	u := rt.c.cfg.MessagingURL
+	switch {
+	case strings.HasPrefix(u, "https://"):
+		u = "wss://" + strings.TrimPrefix(u, "https://")
+	case strings.HasPrefix(u, "http://"):
+		u = "ws://" + strings.TrimPrefix(u, "http://")
+	}
+	u += "/ws"
+	if id := rt.c.cfg.DeviceID; id != "" {
+		u += "?device_id=" + url.QueryEscape(id)
+	}
+	return u
+}
+
+func (rt *realtime) dial(ctx context.Context) (*websocket.Conn, protocol.Codec, error) {
+	token, err := rt.c.token(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 15 * time.Second,
+		Subprotocols:     []string{protocol.SubprotocolJSON},
+	}
+	if rt.c.cfg.Binary {
+		dialer.Subprotocols = protocol.Subprotocols
+	}
+	conn, resp, err := dialer.DialContext(ctx, rt.wsURL(), http.Header{"Authorization": {"Bearer " + token}})
+	if err != nil {
+		if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+			return nil, nil, &APIError{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+		}
+		return nil, nil, err
+	}
+	codec := protocol.CodecFor(conn.Subprotocol())
+
+	caps := append([]string{}, rt.c.cfg.Capabilities...)
+	if codec.Binary() {
+		caps = append(caps, protocol.CapabilityBinary)
+	}
+	hello := &protocol.Hello{
+		Version:      protocol.ProtocolVersion,
+		MinVersion:   protocol.ProtocolVersion,
+		Capabilities: caps,
+		Client:       rt.c.cfg.ClientName,
+	}
+	if err := writeFrame(conn, codec, &protocol.Envelope{Hello: hello}, time.Now().Add(10*time.Second)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, codec, nil
+}
+
+func writeFrame(conn *websocket.Conn, codec protocol.Codec, env *protocol.Envelope, deadline time.Time) error {
+	data, err := codec.EncodeFrame(env)
+	if err != nil {
+		return err
+	}
+	frameType := websocket.TextMessage
+	if codec.Binary() {
+		frameType = websocket.BinaryMessage
+	}
+	_ = conn.SetWriteDeadline(deadline)
+	return conn.WriteMessage(frameType, data)
+}
+
+func (rt *realtime) write(ctx context.Context, env *protocol.Envelope) error {
+	rt.mu.Lock()
+	conn, codec := rt.conn, rt.codec
+	rt.mu.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(10 * time.Second)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	rt.writeMu.Lock()
+	defer rt.writeMu.Unlock()
+	return writeFrame(conn, codec, env, deadline)
+}
+
+// emit delivers ev without blocking the connection; events are dropped when
+// the consumer falls behind by more than Config.EventBuffer.
+func (rt *realtime) emit(ev Event) {
+	select {
+	case rt.events <- ev:
+	default:
+	}
+}
+
+func (rt *realtime) run(ctx context.Context, conn *websocket.Conn, codec protocol.Codec) {
+	defer func() {
+		rt.mu.Lock()
+		rt.conn = nil
+		close(rt.done)
+		rt.mu.Unlock()
+		close(rt.events)
+	}()
+
+	reconnect := false
+	backoff := rt.c.cfg.ReconnectMin
+	for {
+		rt.mu.Lock()
+		rt.conn, rt.codec = conn, codec
+		rt.mu.Unlock()
+		rt.emit(ConnectedEvent{Reconnect: reconnect})
+		if reconnect {
+			rt.resume(ctx)
+		}
+		backoff = rt.c.cfg.ReconnectMin
+
+		// Unblock the read when ctx is cancelled rather than waiting for
+		// the server to send something.
+		stop := context.AfterFunc(ctx, func() { conn.Close() })
+		err := rt.readLoop(conn, codec)
+		stop()
+		rt.mu.Lock()
+		rt.conn = nil
+		rt.mu.Unlock()
+		conn.Close()
+
+		var hs *protocol.HandshakeError
+		if ctx.Err() != nil || errors.As(err, &hs) {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			rt.emit(DisconnectedEvent{Err: err})
+			return
+		}
+
+		for {
+			wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+			rt.emit(DisconnectedEvent{Err: err, RetryIn: wait})
+			select {
+			case <-ctx.Done():
+				rt.emit(DisconnectedEvent{Err: ctx.Err()})
+				return
+			case <-time.After(wait):
+			}
+			if backoff *= 2; backoff > rt.c.cfg.ReconnectMax {
+				backoff = rt.c.cfg.ReconnectMax
+			}
+			if conn, codec, err = rt.dial(ctx); err == nil {
+				break
+			}
+		}
+		reconnect = true
+	}
+}
+
+func (rt *realtime) readLoop(conn *websocket.Conn, codec protocol.Codec) error {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		env, err := codec.DecodeFrame(data)
+		if err != nil {
+			continue
+		}
+		switch {
+		case env.Message != nil:
+			if !env.Message.Ephemeral {
+				rt.track(env.Message)
+			}
+			rt.emit(MessageEvent{Message: *env.Message})
+		case env.Welcome != nil:
+			rt.emit(WelcomeEvent{Welcome: *env.Welcome})
+		case env.Notice != nil:
+			rt.emit(NoticeEvent{Notice: *env.Notice})
+		case env.Error != nil:
+			rt.emit(ErrorEvent{Error: *env.Error})
+			switch env.Error.Code {
+			case protocol.ErrorCodeIncompatibleVersion, protocol.ErrorCodeMissingCapability, protocol.ErrorCodeHelloRequired:
+				return &protocol.HandshakeError{Detail: *env.Error}
+			}
+		}
+	}
+}
+
+// track records msg for resume and reports whether it had not been seen.
+// IDs are kept for ResumeSkew below the newest timestamp, since messages
+// carry their sender's clock and may be stored out of timestamp order.
+func (rt *realtime) track(msg *protocol.Message) bool {
+	rt.trackMu.Lock()
+	defer rt.trackMu.Unlock()
+	seen := rt.seen[msg.ChannelID]
+	if seen == nil {
+		seen = make(map[string]int64)
+		rt.seen[msg.ChannelID] = seen
+	}
+	if _, ok := seen[msg.ID]; ok {
+		return false
+	}
+	seen[msg.ID] = msg.Timestamp
+	if newest, ok := rt.newest[msg.ChannelID]; ok && msg.Timestamp <= newest {
+		return true
+	}
+	rt.newest[msg.ChannelID] = msg.Timestamp
+	floor := msg.Timestamp - rt.c.cfg.ResumeSkew.Milliseconds()
+	for id, ts := range seen {
+		if ts < floor {
+			delete(seen, id)
+		}
+	}
+	return true
+}
+
+// resumeFloor is the timestamp history is replayed from: ResumeSkew before
+// the newest message seen in the channel, so late messages stamped earlier
+// are not skipped, or the first connection time when none was seen.
+func (rt *realtime) resumeFloor(channelID string) int64 {
+	rt.trackMu.Lock()
+	defer rt.trackMu.Unlock()
+	if newest, ok := rt.newest[channelID]; ok {
+		return newest - rt.c.cfg.ResumeSkew.Milliseconds()
+	}
+	return rt.since
+}
+
+// resume replays messages sent while the connection was down.
+func (rt *realtime) resume(ctx context.Context) {
+	channels, err := rt.c.Channels(ctx)
+	if err != nil {
+		return
+	}
+	for _, ch := range channels {
+		rt.resumeChannel(ctx, ch.ID)
+	}
+}
+
+// resumeChannel pages through a channel's history from resumeFloor,
+// emitting the messages whose IDs were not seen yet.
+func (rt *realtime) resumeChannel(ctx context.Context, channelID string) {
+	floor := rt.resumeFloor(channelID)
+	cursor := HistoryCursor{Since: floor}
+	for {
+		page, err := rt.c.HistoryAfter(ctx, channelID, cursor, HistoryPageSize)
+		if err != nil || len(page) == 0 {
+			return
+		}
+		for i := range page {
+			if page[i].Timestamp >= floor && rt.track(&page[i]) {
+				rt.emit(MessageEvent{Message: page[i], Resumed: true})
+			}
+		}
+		if len(page) < HistoryPageSize {
+			return
+		}
+		cursor = CursorAfter(page[len(page)-1])
+	}
+}
@@ -0,0 +1,168 @@
+package jwks
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Source fetches the current key set.
+type Source func(ctx context.Context) (*Set, error)
+
+// HTTPSource fetches the set from a JWKS URL, e.g.
+// http://auth:8086/.well-known/jwks.json.
+func HTTPSource(url string, client *http.Client) Source {
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	return func(ctx context.Context) (*Set, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("jwks: %s returned %d", url, resp.StatusCode)
+		}
+		var set Set
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+			return nil, fmt.Errorf("jwks: decoding %s: %w", url, err)
+		}
+		return &set, nil
+	}
+}
+
+// StaticSource always returns set; for tests and fixed deployments.
+func StaticSource(set Set) Source {
+	return func(context.Context) (*Set, error) { return &set, nil }
+}
+
+// Cache verifies against a cached copy of a Source. The set is refetched
+// once it is older than the refresh interval, and early (at most every
+// MinInterval) when a token names a key the cache has not seen, which is
+// how a rotation reaches verifiers. A key that disappears from the set,
+// or a source that cannot be reached, does not invalidate cached keys
+// until the grace period since they were last fetched has passed.
+type Cache struct {
+	source  Source
+	refresh time.Duration
+	grace   time.Duration
+
+	// MinInterval rate-limits fetches triggered by unknown key IDs.
+	MinInterval time.Duration
+
+	// mu guards the fields below but is never held across a fetch. keys
+	// is replaced, not modified, so a snapshot can be read without it.
+	mu        sync.Mutex
+	keys      map[string]cachedKey
+	fetchedAt time.Time  // last successful fetch
+	triedAt   time.Time  // last attempt
+	fetching  *fetchCall // in-flight fetch that lookups wait for
+	now       func() time.Time
+}
+
+type cachedKey struct {
+	key      ed25519.PublicKey
+	lastSeen time.Time
+}
+
+// fetchCall is one fetch shared by every lookup that needs it.
+type fetchCall struct {
+	done chan struct{}
+	err  error
+}
+
+// NewCache returns a Cache over source that refetches after refresh and
+// keeps keys for grace after they were last published.
+func NewCache(source Source, refresh, grace time.Duration) *Cache {
+	return &Cache{
+		source:      source,
+		refresh:     refresh,
+		grace:       grace,
+		MinInterval: 10 * time.Second,
+		keys:        make(map[string]cachedKey),
+		now:         time.Now,
+	}
+}
+
+// Key returns the public key for kid, fetching the set when it is stale
+// or does not know kid yet. Concurrent lookups share a single fetch;
+// lookups that need none are not held up by it.
+func (c *Cache) Key(ctx context.Context, kid string) (ed25519.PublicKey, error) {
+	c.mu.Lock()
+	now := c.now()
+	_, known := c.keys[kid]
+	stale := now.Sub(c.fetchedAt) >= c.refresh
+	call, leader := c.fetching, false
+	if (stale || !known) && call == nil && now.Sub(c.triedAt) >= c.MinInterval {
+		c.triedAt = now
+		call, leader = &fetchCall{done: make(chan struct{})}, true
+		c.fetching = call
+	}
+	if known && !stale {
+		call = nil
+	}
+	c.mu.Unlock()
+
+	var err error
+	if leader {
+		err = c.fetch(ctx, now, call)
+	} else if call != nil {
+		select {
+		case <-call.done:
+			err = call.err
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	c.mu.Lock()
+	keys := c.keys
+	c.mu.Unlock()
+	if err != nil && len(keys) == 0 {
+		return nil, err
+	}
+	entry, ok := keys[kid]
+	if !ok || now.Sub(entry.lastSeen) > c.grace {
+		return nil, ErrUnknownKey
+	}
+	return entry.key, nil
+}
+
+// fetch loads the set and swaps in a new key map, then releases the
+// lookups waiting on call.
+func (c *Cache) fetch(ctx context.Context, now time.Time, call *fetchCall) error {
+	set, err := c.source(ctx)
+	c.mu.Lock()
+	if err == nil {
+		keys := make(map[string]cachedKey, len(c.keys)+len(set.Keys))
+		for kid, entry := range c.keys {
+			if now.Sub(entry.lastSeen) <= c.grace {
+				keys[kid] = entry
+			}
+		}
+		for _, jwk := range set.Keys {
+			pub, err := jwk.PublicKey()
+			if err != nil || jwk.Kid == "" {
+				continue
+			}
+			keys[jwk.Kid] = cachedKey{key: pub, lastSeen: now}
+		}
+		c.keys = keys
+		c.fetchedAt = now
+	}
+	c.fetching = nil
+	call.err = err
+	c.mu.Unlock()
+	close(call.done)
+	return err
+}
@@ -0,0 +1,3 @@
+module lan-chat/jwks
+
+go 1.22
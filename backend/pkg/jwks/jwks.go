@@ -0,0 +1,73 @@
+// Package jwks holds the signing keys of the auth service and lets the
+// other services verify its access tokens from the published JSON Web Key
+// Set (RFC 7517) without holding anything that can mint tokens.
+//
+// Keys are Ed25519 ("EdDSA" in JWT headers). The issuer keeps a Keyring
+// that rotates on a schedule and still publishes retired keys for a grace
+// period; verifiers keep a Cache of the published set.
+package jwks
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// Algorithm is the JWT "alg" of every key in this package.
+const Algorithm = "EdDSA"
+
+// ErrUnknownKey is returned for a key ID that is not, or no longer, valid.
+var ErrUnknownKey = errors.New("jwks: unknown key id")
+
+// JWK is one public key of a Set.
+type JWK struct {
+	Kty string `json:"kty"` // "OKP"
+	Crv string `json:"crv"` // "Ed25519"
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	X   string `json:"x"` // base64url public key
+}
+
+// Set is a JSON Web Key Set as served at /.well-known/jwks.json.
+type Set struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicJWK describes an Ed25519 public key.
+func PublicJWK(kid string, pub ed25519.PublicKey) JWK {
+	return JWK{
+		Kty: "OKP",
+		Crv: "Ed25519",
+		Kid: kid,
+		Use: "sig",
+		Alg: Algorithm,
+		X:   base64.RawURLEncoding.EncodeToString(pub),
+	}
+}
+
+// PublicKey decodes an Ed25519 JWK.
+func (k JWK) PublicKey() (ed25519.PublicKey, error) {
+	if k.Kty != "OKP" || k.Crv != "Ed25519" {
+		return nil, fmt.Errorf("jwks: unsupported key %s/%s", k.Kty, k.Crv)
+	}
+	if k.Alg != "" && k.Alg != Algorithm {
+		return nil, fmt.Errorf("jwks: unsupported algorithm %s", k.Alg)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil || len(x) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("jwks: malformed key %q", k.Kid)
+	}
+	return ed25519.PublicKey(x), nil
+}
+
+// Thumbprint is the RFC 7638 thumbprint of an Ed25519 public key, used as
+// its key ID.
+func Thumbprint(pub ed25519.PublicKey) string {
+	// Members in lexicographic order, no whitespace, as RFC 7638 requires.
+	canonical := `{"crv":"Ed25519","kty":"OKP","x":"` + base64.RawURLEncoding.EncodeToString(pub) + `"}`
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
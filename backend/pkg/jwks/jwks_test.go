@@ -0,0 +1,215 @@
+package jwks
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestThumbprintVector(t *testing.T) {
+	// RFC 8037 appendix A.3.
+	x, _ := base64.RawURLEncoding.DecodeString("11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo")
+	if got := Thumbprint(ed25519.PublicKey(x)); got != "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k" {
+		t.Fatalf("thumbprint = %s", got)
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "jwt-keys.json")
+	ring, err := OpenKeyring(path, time.Hour, 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm()&0o077 != 0 {
+		t.Fatalf("keyring must be private to the owner: %v %v", info, err)
+	}
+	first, firstKey := ring.Signer()
+
+	reopened, err := OpenKeyring(path, time.Hour, 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid, key := reopened.Signer(); kid != first || !key.Equal(firstKey) {
+		t.Fatalf("signer changed across restarts")
+	}
+	if rotated, err := reopened.RotateIfDue(time.Now()); err != nil || rotated {
+		t.Fatalf("fresh key rotated: %v %v", rotated, err)
+	}
+
+	now := time.Now()
+	if rotated, err := reopened.RotateIfDue(now.Add(time.Hour)); err != nil || !rotated {
+		t.Fatalf("expected rotation after an hour: %v %v", rotated, err)
+	}
+	second, _ := reopened.Signer()
+	if second == first {
+		t.Fatalf("rotation kept the signing key")
+	}
+	set := reopened.Set()
+	if len(set.Keys) != 2 || set.Keys[0].Kid != second || set.Keys[1].Kid != first {
+		t.Fatalf("expected new and retired key published, got %+v", set.Keys)
+	}
+	pub, err := reopened.PublicKey(first)
+	if err != nil || !pub.Equal(firstKey.Public()) {
+		t.Fatalf("retired key must verify during grace: %v", err)
+	}
+	if set.Keys[1].Kid != Thumbprint(pub) {
+		t.Fatalf("kid is not the key thumbprint")
+	}
+
+	// Once the grace period is over the retired key is dropped.
+	if err := reopened.Rotate(now.Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.PublicKey(first); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected expired key to be unknown, got %v", err)
+	}
+	if _, err := OpenKeyring(filepath.Join(t.TempDir(), "k.json"), 0, time.Minute); err == nil {
+		t.Fatalf("expected zero rotation interval to be rejected")
+	}
+}
+
+func TestCacheFollowsRotation(t *testing.T) {
+	ring, err := OpenKeyring(filepath.Join(t.TempDir(), "jwt-keys.json"), time.Hour, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetches := 0
+	failing := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if failing {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(ring.Set())
+	}))
+	defer srv.Close()
+
+	clock := time.Now()
+	cache := NewCache(HTTPSource(srv.URL, nil), 5*time.Minute, 30*time.Minute)
+	cache.now = func() time.Time { return clock }
+	ctx := context.Background()
+
+	first, firstKey := ring.Signer()
+	if key, err := cache.Key(ctx, first); err != nil || !key.Equal(firstKey.Public()) {
+		t.Fatalf("lookup: %v", err)
+	}
+	if _, err := cache.Key(ctx, first); err != nil || fetches != 1 {
+		t.Fatalf("expected the cached set to be reused, %d fetches (%v)", fetches, err)
+	}
+
+	// Unknown key IDs refetch, but not more often than MinInterval.
+	clock = clock.Add(cache.MinInterval)
+	if _, err := cache.Key(ctx, "forged"); !errors.Is(err, ErrUnknownKey) || fetches != 2 {
+		t.Fatalf("expected one refetch for an unknown kid, %d fetches (%v)", fetches, err)
+	}
+	if _, err := cache.Key(ctx, "forged-again"); !errors.Is(err, ErrUnknownKey) || fetches != 2 {
+		t.Fatalf("expected unknown kids to be rate limited, %d fetches (%v)", fetches, err)
+	}
+
+	// A rotation is picked up on the first token signed by the new key.
+	clock = clock.Add(cache.MinInterval)
+	if err := ring.Rotate(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := ring.Signer()
+	if _, err := cache.Key(ctx, second); err != nil || fetches != 3 {
+		t.Fatalf("expected the new key after a refetch, %d fetches (%v)", fetches, err)
+	}
+
+	// An unreachable issuer does not break verification within the grace.
+	failing = true
+	clock = clock.Add(10 * time.Minute)
+	if _, err := cache.Key(ctx, second); err != nil {
+		t.Fatalf("expected cached key while the issuer is down: %v", err)
+	}
+	clock = clock.Add(30 * time.Minute)
+	if _, err := cache.Key(ctx, second); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected key to lapse after the grace period, got %v", err)
+	}
+}
+
+func TestCacheWithoutKeysReportsSourceError(t *testing.T) {
+	down := errors.New("down")
+	cache := NewCache(func(context.Context) (*Set, error) { return nil, down }, time.Minute, time.Minute)
+	if _, err := cache.Key(context.Background(), "kid"); !errors.Is(err, down) {
+		t.Fatalf("expected source error, got %v", err)
+	}
+	bad := StaticSource(Set{Keys: []JWK{{Kty: "RSA", Kid: "rsa"}, {Kty: "OKP", Crv: "Ed25519", Kid: "short", X: "AAAA"}}})
+	if _, err := NewCache(bad, time.Minute, time.Minute).Key(context.Background(), "rsa"); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected unsupported keys to be ignored, got %v", err)
+	}
+}
+
+func TestCacheLookupsShareOneFetch(t *testing.T) {
+	ring, err := OpenKeyring(filepath.Join(t.TempDir(), "jwt-keys.json"), time.Hour, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	cache := NewCache(func(ctx context.Context) (*Set, error) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		set := ring.Set()
+		return &set, nil
+	}, time.Hour, time.Hour)
+	cache.MinInterval = 0
+	ctx := context.Background()
+	first, _ := ring.Signer()
+	if _, err := cache.Key(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ring.Rotate(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	second, secondKey := ring.Signer()
+	results := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			key, err := cache.Key(ctx, second)
+			if err == nil && !key.Equal(secondKey.Public()) {
+				err = errors.New("wrong key")
+			}
+			results <- err
+		}()
+	}
+	for deadline := time.Now().Add(2 * time.Second); fetches.Load() < 2 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+	}
+
+	// A cached key is served while the fetch is in flight.
+	done := make(chan error, 1)
+	go func() {
+		_, err := cache.Key(ctx, first)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lookup of a cached key waited for the fetch")
+	}
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		if err := <-results; err != nil {
+			t.Fatalf("lookup of the rotated key: %v", err)
+		}
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("expected concurrent lookups to share one fetch, got %d fetches", n)
+	}
+}
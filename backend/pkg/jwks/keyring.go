@@ -0,0 +1,184 @@
+package jwks
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Keyring is the issuer's set of signing keys, persisted as one JSON file
+// readable by its owner only. The newest key signs; keys it replaced stay
+// published for Grace so tokens they signed keep verifying until expiry.
+type Keyring struct {
+	path        string
+	rotateEvery time.Duration
+	grace       time.Duration
+
+	mu   sync.RWMutex
+	keys []storedKey // oldest first, the last one signs
+}
+
+type storedKey struct {
+	ID        string `json:"kid"`
+	Seed      []byte `json:"seed"` // ed25519 private key seed
+	CreatedAt int64  `json:"created_at"`
+	RetiredAt int64  `json:"retired_at,omitempty"`
+}
+
+type keyringFile struct {
+	Version int         `json:"version"`
+	Keys    []storedKey `json:"keys"`
+}
+
+// OpenKeyring loads the keyring at path, creating it with a fresh key if it
+// does not exist. A new key is generated every rotateEvery; retired keys
+// are published for grace, which must outlast the longest token lifetime.
+func OpenKeyring(path string, rotateEvery, grace time.Duration) (*Keyring, error) {
+	if rotateEvery <= 0 || grace <= 0 {
+		return nil, errors.New("jwks: rotation interval and grace period must be positive")
+	}
+	k := &Keyring{path: path, rotateEvery: rotateEvery, grace: grace}
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+		return k, k.Rotate(time.Now())
+	case err != nil:
+		return nil, err
+	}
+	var f keyringFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("jwks: reading keyring %s: %w", path, err)
+	}
+	if f.Version != 1 || len(f.Keys) == 0 {
+		return nil, fmt.Errorf("jwks: unsupported keyring %s", path)
+	}
+	for _, key := range f.Keys {
+		if len(key.Seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("jwks: malformed key %q in %s", key.ID, path)
+		}
+	}
+	k.keys = f.Keys
+	return k, nil
+}
+
+// Signer returns the key ID and private key that sign new tokens.
+func (k *Keyring) Signer() (string, ed25519.PrivateKey) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	current := k.keys[len(k.keys)-1]
+	return current.ID, ed25519.NewKeyFromSeed(current.Seed)
+}
+
+// PublicKey returns the public key for kid while it is still published.
+func (k *Keyring) PublicKey(kid string) (ed25519.PublicKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	now := time.Now()
+	for _, key := range k.keys {
+		if key.ID == kid && k.publishedLocked(key, now) {
+			return ed25519.NewKeyFromSeed(key.Seed).Public().(ed25519.PublicKey), nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// Set returns the JWKS to publish: the signing key and retired keys still
+// within their grace period, newest first.
+func (k *Keyring) Set() Set {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	now := time.Now()
+	set := Set{Keys: make([]JWK, 0, len(k.keys))}
+	for i := len(k.keys) - 1; i >= 0; i-- {
+		if key := k.keys[i]; k.publishedLocked(key, now) {
+			set.Keys = append(set.Keys, PublicJWK(key.ID, ed25519.NewKeyFromSeed(key.Seed).Public().(ed25519.PublicKey)))
+		}
+	}
+	return set
+}
+
+func (k *Keyring) publishedLocked(key storedKey, now time.Time) bool {
+	return key.RetiredAt == 0 || now.Before(time.Unix(key.RetiredAt, 0).Add(k.grace))
+}
+
+// RotateIfDue rotates when the signing key is older than the rotation
+// interval and reports whether it did.
+func (k *Keyring) RotateIfDue(now time.Time) (bool, error) {
+	k.mu.RLock()
+	due := now.Sub(time.Unix(k.keys[len(k.keys)-1].CreatedAt, 0)) >= k.rotateEvery
+	k.mu.RUnlock()
+	if !due {
+		return false, nil
+	}
+	return true, k.Rotate(now)
+}
+
+// Rotate generates a new signing key, retires the current one and forgets
+// keys whose grace period has ended. The keyring file is replaced
+// atomically before the new key is used.
+func (k *Keyring) Rotate(now time.Time) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	keys := make([]storedKey, 0, len(k.keys)+1)
+	for _, key := range k.keys {
+		if key.RetiredAt == 0 {
+			key.RetiredAt = now.Unix()
+		}
+		if k.publishedLocked(key, now) {
+			keys = append(keys, key)
+		}
+	}
+	keys = append(keys, storedKey{ID: Thumbprint(pub), Seed: priv.Seed(), CreatedAt: now.Unix()})
+
+	data, err := json.MarshalIndent(keyringFile{Version: 1, Keys: keys}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(k.path, data, 0o600); err != nil {
+		return err
+	}
+	k.keys = keys
+	return nil
+}
+
+// writeFileAtomic replaces path so that a crash leaves the old or the new
+// content, never a mix.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
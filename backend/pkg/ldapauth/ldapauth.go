@@ -0,0 +1,375 @@
+// Package ldapauth checks passwords against an LDAP directory such as
+// Active Directory or OpenLDAP. It finds the account with a service bind,
+// verifies the password by binding as the account, and maps the groups the
+// account belongs to onto a chat role, so the directory stays the single
+// place where people and their permissions are managed.
+package ldapauth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+var (
+	// ErrInvalidCredentials covers unknown accounts and wrong passwords
+	// alike.
+	ErrInvalidCredentials = errors.New("ldapauth: invalid credentials")
+	// ErrNoRole means the password was right but the account is in no
+	// mapped group and there is no default role.
+	ErrNoRole = errors.New("ldapauth: account has no role")
+)
+
+// GroupRole grants Role to members of Group, a group DN or just its
+// common name.
+type GroupRole struct {
+	Group string
+	Role  string
+}
+
+// Config describes the directory and how its accounts map to users.
+type Config struct {
+	// URL is ldap://host:389 or ldaps://host:636.
+	URL string
+	// StartTLS upgrades an ldap:// connection before binding.
+	StartTLS bool
+	// CAFile verifies the server with these PEM certificates instead of
+	// the system pool.
+	CAFile string
+
+	// BindDN and BindPassword are the service account that searches for
+	// users; empty means an anonymous search.
+	BindDN       string
+	BindPassword string
+
+	// BaseDN is where users are searched, e.g. ou=people,dc=corp,dc=local.
+	BaseDN string
+	// UserAttr holds the login name: uid, or sAMAccountName on AD.
+	UserAttr string
+	// UserFilter narrows the search to people, e.g. (objectClass=person).
+	UserFilter string
+	// NameAttr holds the display name; cn is used when it is empty.
+	NameAttr string
+	// GroupAttr lists the groups of an account (memberOf).
+	GroupAttr string
+	// GroupBaseDN, when set, also finds groups that list the account in
+	// member or uniqueMember, for directories without memberOf.
+	GroupBaseDN string
+
+	// GroupRoles are tried in order; the first group the account is in
+	// decides the role.
+	GroupRoles []GroupRole
+	// DefaultRole is for accounts in no mapped group. Empty refuses them.
+	DefaultRole string
+	// DepartmentAttr, when set, is read as the account's department.
+	DepartmentAttr string
+
+	Timeout time.Duration
+}
+
+// DefaultConfig fits OpenLDAP with the usual inetOrgPerson schema.
+func DefaultConfig() Config {
+	return Config{
+		UserAttr:   "uid",
+		UserFilter: "(objectClass=person)",
+		NameAttr:   "displayName",
+		GroupAttr:  "memberOf",
+		Timeout:    10 * time.Second,
+	}
+}
+
+// ConfigFromEnv overrides DefaultConfig with <prefix>_LDAP_URL,
+// _LDAP_START_TLS, _LDAP_CA_FILE, _LDAP_BIND_DN, _LDAP_BIND_PASSWORD,
+// _LDAP_BASE_DN, _LDAP_USER_ATTR, _LDAP_USER_FILTER, _LDAP_NAME_ATTR,
+// _LDAP_GROUP_ATTR, _LDAP_GROUP_BASE_DN, _LDAP_GROUP_ROLES,
+// _LDAP_DEFAULT_ROLE, _LDAP_DEPARTMENT_ATTR and _LDAP_TIMEOUT.
+// _LDAP_GROUP_ROLES is a ;-separated list of group:role pairs. The
+// directory is off when <prefix>_LDAP_URL is empty.
+func ConfigFromEnv(prefix string) (Config, error) {
+	c := DefaultConfig()
+	for name, s := range map[string]*string{
+		"_LDAP_URL":             &c.URL,
+		"_LDAP_CA_FILE":         &c.CAFile,
+		"_LDAP_BIND_DN":         &c.BindDN,
+		"_LDAP_BASE_DN":         &c.BaseDN,
+		"_LDAP_USER_ATTR":       &c.UserAttr,
+		"_LDAP_USER_FILTER":     &c.UserFilter,
+		"_LDAP_NAME_ATTR":       &c.NameAttr,
+		"_LDAP_GROUP_ATTR":      &c.GroupAttr,
+		"_LDAP_GROUP_BASE_DN":   &c.GroupBaseDN,
+		"_LDAP_DEFAULT_ROLE":    &c.DefaultRole,
+		"_LDAP_DEPARTMENT_ATTR": &c.DepartmentAttr,
+	} {
+		if v := strings.TrimSpace(os.Getenv(prefix + name)); v != "" {
+			*s = v
+		}
+	}
+	// Passwords may start or end with spaces.
+	c.BindPassword = os.Getenv(prefix + "_LDAP_BIND_PASSWORD")
+	if v := strings.TrimSpace(os.Getenv(prefix + "_LDAP_START_TLS")); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return c, fmt.Errorf("%s_LDAP_START_TLS: invalid boolean %q", prefix, v)
+		}
+		c.StartTLS = b
+	}
+	if v := strings.TrimSpace(os.Getenv(prefix + "_LDAP_TIMEOUT")); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return c, fmt.Errorf("%s_LDAP_TIMEOUT: invalid duration %q", prefix, v)
+		}
+		c.Timeout = d
+	}
+	roles, err := ParseGroupRoles(os.Getenv(prefix + "_LDAP_GROUP_ROLES"))
+	if err != nil {
+		return c, fmt.Errorf("%s_LDAP_GROUP_ROLES: %w", prefix, err)
+	}
+	c.GroupRoles = roles
+	return c, nil
+}
+
+// ParseGroupRoles reads "group:role;group:role". A group DN contains no
+// colon, so the last one separates the role.
+func ParseGroupRoles(s string) ([]GroupRole, error) {
+	var roles []GroupRole
+	for _, pair := range strings.Split(s, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("%q is not group:role", pair)
+		}
+		group, role := strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+		if group == "" || role == "" {
+			return nil, fmt.Errorf("%q is not group:role", pair)
+		}
+		roles = append(roles, GroupRole{Group: group, Role: role})
+	}
+	return roles, nil
+}
+
+// Entry is an account whose password the directory accepted.
+type Entry struct {
+	DN       string
+	Username string
+	FullName string
+	// Department is empty unless Config.DepartmentAttr is set.
+	Department string
+	Groups     []string
+	Role       string
+}
+
+// Authenticator verifies passwords against one directory. Each call uses
+// its own connection, so it is safe for concurrent use.
+type Authenticator struct {
+	cfg Config
+	tls *tls.Config
+}
+
+// New checks cfg and loads its CA file.
+func New(cfg Config) (*Authenticator, error) {
+	if cfg.URL == "" || cfg.BaseDN == "" {
+		return nil, errors.New("ldapauth: URL and BaseDN are required")
+	}
+	if cfg.UserAttr == "" {
+		return nil, errors.New("ldapauth: UserAttr is required")
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultConfig().Timeout
+	}
+	a := &Authenticator{cfg: cfg}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("ldapauth: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ldapauth: no certificates in %s", cfg.CAFile)
+		}
+		a.tls = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	return a, nil
+}
+
+// Authenticate finds username in the directory and binds as it with
+// password. Errors other than ErrInvalidCredentials and ErrNoRole mean the
+// directory could not be asked.
+func (a *Authenticator) Authenticate(username, password string) (Entry, error) {
+	// An empty password would be an unauthenticated bind, which many
+	// servers accept for any DN.
+	if username == "" || password == "" {
+		return Entry{}, ErrInvalidCredentials
+	}
+	conn, err := a.dial()
+	if err != nil {
+		return Entry{}, err
+	}
+	defer conn.Close()
+
+	if a.cfg.BindDN != "" {
+		if err := conn.Bind(a.cfg.BindDN, a.cfg.BindPassword); err != nil {
+			return Entry{}, fmt.Errorf("ldapauth: service bind: %w", err)
+		}
+	}
+	entry, err := a.findUser(conn, username)
+	if err != nil {
+		return Entry{}, err
+	}
+	groups := entry.GetAttributeValues(a.cfg.GroupAttr)
+	if a.cfg.GroupBaseDN != "" {
+		more, err := a.searchGroups(conn, entry.DN)
+		if err != nil {
+			return Entry{}, err
+		}
+		groups = append(groups, more...)
+	}
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return Entry{}, ErrInvalidCredentials
+		}
+		return Entry{}, fmt.Errorf("ldapauth: user bind: %w", err)
+	}
+
+	e := Entry{
+		DN:       entry.DN,
+		Username: entry.GetAttributeValue(a.cfg.UserAttr),
+		Groups:   groups,
+	}
+	if e.Username == "" {
+		e.Username = username
+	}
+	if a.cfg.NameAttr != "" {
+		e.FullName = entry.GetAttributeValue(a.cfg.NameAttr)
+	}
+	if e.FullName == "" {
+		e.FullName = entry.GetAttributeValue("cn")
+	}
+	if a.cfg.DepartmentAttr != "" {
+		e.Department = entry.GetAttributeValue(a.cfg.DepartmentAttr)
+	}
+	e.Role = a.role(groups)
+	if e.Role == "" {
+		return e, ErrNoRole
+	}
+	return e, nil
+}
+
+func (a *Authenticator) dial() (*ldap.Conn, error) {
+	opts := []ldap.DialOpt{ldap.DialWithDialer(&net.Dialer{Timeout: a.cfg.Timeout})}
+	if a.tls != nil {
+		opts = append(opts, ldap.DialWithTLSConfig(a.tls))
+	}
+	conn, err := ldap.DialURL(a.cfg.URL, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("ldapauth: %w", err)
+	}
+	conn.SetTimeout(a.cfg.Timeout)
+	if a.cfg.StartTLS {
+		cfg := a.tls
+		if cfg == nil {
+			cfg = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		cfg = cfg.Clone()
+		if u, err := url.Parse(a.cfg.URL); err == nil {
+			cfg.ServerName = u.Hostname()
+		}
+		if err := conn.StartTLS(cfg); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldapauth: StartTLS: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// findUser returns the one account named username. Several matches are
+// refused rather than guessed between.
+func (a *Authenticator) findUser(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	filter := "(" + a.cfg.UserAttr + "=" + ldap.EscapeFilter(username) + ")"
+	if a.cfg.UserFilter != "" {
+		filter = "(&" + a.cfg.UserFilter + filter + ")"
+	}
+	attrs := []string{"cn", a.cfg.UserAttr}
+	for _, attr := range []string{a.cfg.NameAttr, a.cfg.GroupAttr, a.cfg.DepartmentAttr} {
+		if attr != "" {
+			attrs = append(attrs, attr)
+		}
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		a.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(a.cfg.Timeout/time.Second), false,
+		filter, attrs, nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("ldapauth: search %s: %w", filter, err)
+	}
+	if res == nil || len(res.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	return res.Entries[0], nil
+}
+
+func (a *Authenticator) searchGroups(conn *ldap.Conn, dn string) ([]string, error) {
+	escaped := ldap.EscapeFilter(dn)
+	res, err := conn.Search(ldap.NewSearchRequest(
+		a.cfg.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(a.cfg.Timeout/time.Second), false,
+		"(|(member="+escaped+")(uniqueMember="+escaped+"))", []string{"cn"}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("ldapauth: group search: %w", err)
+	}
+	groups := make([]string, 0, len(res.Entries))
+	for _, e := range res.Entries {
+		groups = append(groups, e.DN)
+	}
+	return groups, nil
+}
+
+// role returns the role of the first mapping that matches one of groups.
+func (a *Authenticator) role(groups []string) string {
+	for _, gr := range a.cfg.GroupRoles {
+		for _, g := range groups {
+			if sameGroup(gr.Group, g) {
+				return gr.Role
+			}
+		}
+	}
+	return a.cfg.DefaultRole
+}
+
+// sameGroup compares a configured group with a group DN from the
+// directory, ignoring case and spacing. A configured name without "=" only
+// has to match the group's common name.
+func sameGroup(want, dn string) bool {
+	got, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.EqualFold(want, dn)
+	}
+	if !strings.Contains(want, "=") {
+		if len(got.RDNs) == 0 {
+			return false
+		}
+		for _, attr := range got.RDNs[0].Attributes {
+			if strings.EqualFold(attr.Type, "cn") && strings.EqualFold(attr.Value, want) {
+				return true
+			}
+		}
+		return false
+	}
+	w, err := ldap.ParseDN(want)
+	if err != nil {
+		return false
+	}
+	return w.EqualFold(got)
+}
@@ -0,0 +1,207 @@
+package ldapauth
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"lan-chat/ldapauth/ldaptest"
+)
+
+const (
+	serviceDN = "cn=chat,ou=services,dc=corp,dc=local"
+	adminsDN  = "cn=chat-admins,ou=groups,dc=corp,dc=local"
+	staffDN   = "cn=staff,ou=groups,dc=corp,dc=local"
+	opsDN     = "cn=ops,ou=groups,dc=corp,dc=local"
+	carolDN   = "uid=carol,ou=people,dc=corp,dc=local"
+)
+
+func testDirectory(t *testing.T) *ldaptest.Server {
+	d := ldaptest.NewServer(t, serviceDN, "svc-secret")
+	person := []string{"top", "person", "inetOrgPerson"}
+	d.Add("uid=alice,ou=people,dc=corp,dc=local", "alice-pw", map[string][]string{
+		"objectClass": person, "uid": {"alice"}, "cn": {"alice"}, "displayName": {"Alice Liddell"},
+		"departmentNumber": {"Engineering"}, "memberOf": {staffDN, adminsDN},
+	})
+	d.Add("uid=bob,ou=people,dc=corp,dc=local", "bob-pw", map[string][]string{
+		"objectClass": person, "uid": {"bob"}, "cn": {"Bob Builder"}, "memberOf": {staffDN},
+	})
+	d.Add(carolDN, "carol-pw", map[string][]string{
+		"objectClass": person, "uid": {"carol"}, "cn": {"Carol"},
+	})
+	d.Add(opsDN, "", map[string][]string{
+		"objectClass": {"groupOfNames"}, "cn": {"ops"}, "member": {carolDN},
+	})
+	for _, ou := range []string{"people", "contractors"} {
+		d.Add("uid=dup,ou="+ou+",dc=corp,dc=local", "dup-pw", map[string][]string{
+			"objectClass": person, "uid": {"dup"}, "memberOf": {staffDN},
+		})
+	}
+	// Not a person, so the user filter skips it.
+	d.Add("uid=printer,ou=devices,dc=corp,dc=local", "printer-pw", map[string][]string{
+		"objectClass": {"device"}, "uid": {"printer"}, "memberOf": {staffDN},
+	})
+	return d
+}
+
+func testConfig(d *ldaptest.Server) Config {
+	c := DefaultConfig()
+	c.URL = d.URL()
+	c.BindDN = serviceDN
+	c.BindPassword = "svc-secret"
+	c.BaseDN = "dc=corp,dc=local"
+	c.DepartmentAttr = "departmentNumber"
+	c.GroupRoles = []GroupRole{
+		{Group: "CN=Chat-Admins, OU=Groups, DC=corp, DC=local", Role: "admin"},
+		{Group: "staff", Role: "member"},
+	}
+	return c
+}
+
+func TestAuthenticate(t *testing.T) {
+	d := testDirectory(t)
+	a, err := New(testConfig(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := a.Authenticate("alice", "alice-pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Entry{
+		DN: "uid=alice,ou=people,dc=corp,dc=local", Username: "alice", FullName: "Alice Liddell",
+		Department: "Engineering", Groups: []string{staffDN, adminsDN}, Role: "admin",
+	}
+	if !reflect.DeepEqual(e, want) {
+		t.Fatalf("alice = %+v, want %+v", e, want)
+	}
+	if binds := d.Binds(); !reflect.DeepEqual(binds, []string{serviceDN, want.DN}) {
+		t.Fatalf("binds = %q, want service then user", binds)
+	}
+
+	// The directory's spelling of the name wins; cn stands in for a
+	// missing display name.
+	e, err = a.Authenticate("BOB", "bob-pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Username != "bob" || e.FullName != "Bob Builder" || e.Role != "member" || e.Department != "" {
+		t.Fatalf("bob = %+v", e)
+	}
+
+	for _, tc := range []struct{ name, username, password string }{
+		{"wrong password", "alice", "bob-pw"},
+		{"unknown user", "mallory", "x"},
+		{"wildcard username", "*", "alice-pw"},
+		{"filter injection", "alice)(uid=*", "alice-pw"},
+		{"ambiguous username", "dup", "dup-pw"},
+		{"not a person", "printer", "printer-pw"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := a.Authenticate(tc.username, tc.password); !errors.Is(err, ErrInvalidCredentials) {
+				t.Fatalf("err = %v, want ErrInvalidCredentials", err)
+			}
+		})
+	}
+
+	before := len(d.Binds())
+	if _, err := a.Authenticate("alice", ""); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("empty password: err = %v, want ErrInvalidCredentials", err)
+	}
+	if len(d.Binds()) != before {
+		t.Fatal("an empty password reached the directory")
+	}
+}
+
+func TestAuthenticateRoles(t *testing.T) {
+	d := testDirectory(t)
+
+	cfg := testConfig(d)
+	a, _ := New(cfg)
+	if _, err := a.Authenticate("carol", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("carol wrong password: err = %v", err)
+	}
+	if e, err := a.Authenticate("carol", "carol-pw"); !errors.Is(err, ErrNoRole) || e.Username != "carol" {
+		t.Fatalf("carol without mapped group: %+v, %v; want ErrNoRole", e, err)
+	}
+
+	cfg.DefaultRole = "guest"
+	a, _ = New(cfg)
+	if e, err := a.Authenticate("carol", "carol-pw"); err != nil || e.Role != "guest" {
+		t.Fatalf("carol with default role: %+v, %v", e, err)
+	}
+
+	// Without memberOf, groups are found by their member attribute.
+	cfg.GroupBaseDN = "ou=groups,dc=corp,dc=local"
+	cfg.GroupRoles = append(cfg.GroupRoles, GroupRole{Group: opsDN, Role: "support"})
+	a, _ = New(cfg)
+	e, err := a.Authenticate("carol", "carol-pw")
+	if err != nil || e.Role != "support" || !reflect.DeepEqual(e.Groups, []string{opsDN}) {
+		t.Fatalf("carol via group search: %+v, %v", e, err)
+	}
+}
+
+func TestAuthenticateDirectoryErrors(t *testing.T) {
+	d := testDirectory(t)
+
+	cfg := testConfig(d)
+	cfg.BindPassword = "wrong"
+	a, _ := New(cfg)
+	if _, err := a.Authenticate("alice", "alice-pw"); err == nil || errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("bad service account: err = %v, want a directory error", err)
+	}
+
+	// Anonymous searches are refused by this directory.
+	cfg.BindDN = ""
+	a, _ = New(cfg)
+	if _, err := a.Authenticate("alice", "alice-pw"); err == nil || errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("anonymous search: err = %v, want a directory error", err)
+	}
+
+	cfg = testConfig(d)
+	cfg.URL = "ldap://127.0.0.1:1"
+	a, _ = New(cfg)
+	if _, err := a.Authenticate("alice", "alice-pw"); err == nil || errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("unreachable directory: err = %v, want a directory error", err)
+	}
+
+	if _, err := New(Config{URL: "ldap://x"}); err == nil {
+		t.Fatal("New accepted a config without BaseDN")
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("T_LDAP_URL", "ldaps://dc1.corp.local")
+	t.Setenv("T_LDAP_BASE_DN", "dc=corp,dc=local")
+	t.Setenv("T_LDAP_USER_ATTR", "sAMAccountName")
+	t.Setenv("T_LDAP_BIND_PASSWORD", " spaced ")
+	t.Setenv("T_LDAP_START_TLS", "true")
+	t.Setenv("T_LDAP_GROUP_ROLES", "cn=Chat Admins,ou=Groups,dc=corp,dc=local:admin; staff : member ;")
+	t.Setenv("T_LDAP_TIMEOUT", "3s")
+	c, err := ConfigFromEnv("T")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.URL != "ldaps://dc1.corp.local" || c.UserAttr != "sAMAccountName" || c.BindPassword != " spaced " ||
+		!c.StartTLS || c.Timeout.String() != "3s" || c.GroupAttr != "memberOf" {
+		t.Fatalf("config = %+v", c)
+	}
+	want := []GroupRole{{"cn=Chat Admins,ou=Groups,dc=corp,dc=local", "admin"}, {"staff", "member"}}
+	if !reflect.DeepEqual(c.GroupRoles, want) {
+		t.Fatalf("group roles = %+v, want %+v", c.GroupRoles, want)
+	}
+
+	for name, value := range map[string]string{
+		"T_LDAP_GROUP_ROLES": "admins",
+		"T_LDAP_START_TLS":   "maybe",
+		"T_LDAP_TIMEOUT":     "-1s",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := ConfigFromEnv("T"); err == nil {
+				t.Fatalf("%s=%q accepted", name, value)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+// Package ldaptest provides an in-process LDAP server for tests of code
+// that authenticates against a directory.
+package ldaptest
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Server is an in-process LDAP server that answers the simple binds and
+// searches ldapauth.Authenticator makes. Searches are only allowed to the
+// service account.
+type Server struct {
+	ln              net.Listener
+	serviceDN       string
+	servicePassword string
+
+	mu      sync.Mutex
+	entries []entry
+	binds   []string
+}
+
+type entry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// NewServer starts a Server on a loopback port that stops when the test
+// ends. serviceDN and servicePassword are the account allowed to search.
+func NewServer(t testing.TB, serviceDN, servicePassword string) *Server {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Server{ln: ln, serviceDN: serviceDN, servicePassword: servicePassword}
+	go d.serve()
+	t.Cleanup(func() { ln.Close() })
+	return d
+}
+
+// URL is the ldap:// URL to configure.
+func (d *Server) URL() string { return "ldap://" + d.ln.Addr().String() }
+
+// Add stores an entry. An empty password makes the entry unable to bind.
+func (d *Server) Add(dn, password string, attrs map[string][]string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries = append(d.entries, entry{dn: dn, password: password, attrs: attrs})
+}
+
+// Binds returns the DNs that binds were attempted with.
+func (d *Server) Binds() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.binds...)
+}
+
+func (d *Server) serve() {
+	for {
+		conn, err := d.ln.Accept()
+		if err != nil {
+			return
+		}
+		go d.handle(conn)
+	}
+}
+
+func (d *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	bound := ""
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := d.bind(dn, password)
+			if code == ldap.LDAPResultSuccess {
+				bound = dn
+			}
+			d.reply(conn, id, result(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			if bound == "" || !sameDN(bound, d.serviceDN) {
+				d.reply(conn, id, result(ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights))
+				continue
+			}
+			d.search(conn, id, op)
+		case ldap.ApplicationUnbindRequest:
+			return
+		default:
+			d.reply(conn, id, result(ldap.ApplicationExtendedResponse, ldap.LDAPResultUnwillingToPerform))
+		}
+	}
+}
+
+func (d *Server) bind(dn, password string) uint16 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.binds = append(d.binds, dn)
+	if password == "" {
+		return ldap.LDAPResultUnwillingToPerform
+	}
+	if sameDN(dn, d.serviceDN) && password == d.servicePassword {
+		return ldap.LDAPResultSuccess
+	}
+	for _, e := range d.entries {
+		if sameDN(dn, e.dn) && e.password != "" && password == e.password {
+			return ldap.LDAPResultSuccess
+		}
+	}
+	return ldap.LDAPResultInvalidCredentials
+}
+
+func (d *Server) search(conn net.Conn, id int64, op *ber.Packet) {
+	base, err := ldap.ParseDN(op.Children[0].Value.(string))
+	if err != nil {
+		d.reply(conn, id, result(ldap.ApplicationSearchResultDone, ldap.LDAPResultInvalidDNSyntax))
+		return
+	}
+	sizeLimit := int(op.Children[3].Value.(int64))
+	filter := op.Children[6]
+
+	d.mu.Lock()
+	var found []entry
+	for _, e := range d.entries {
+		dn, _ := ldap.ParseDN(e.dn)
+		if (base.EqualFold(dn) || base.AncestorOfFold(dn)) && matches(filter, e) {
+			found = append(found, e)
+		}
+	}
+	d.mu.Unlock()
+
+	code := uint16(ldap.LDAPResultSuccess)
+	if sizeLimit > 0 && len(found) > sizeLimit {
+		found, code = found[:sizeLimit], ldap.LDAPResultSizeLimitExceeded
+	}
+	for _, e := range found {
+		res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+		res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "Object Name"))
+		attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+		for name, values := range e.attrs {
+			attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+			attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+			set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+			for _, v := range values {
+				set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+			}
+			attr.AppendChild(set)
+			attrs.AppendChild(attr)
+		}
+		res.AppendChild(attrs)
+		d.reply(conn, id, res)
+	}
+	d.reply(conn, id, result(ldap.ApplicationSearchResultDone, code))
+}
+
+// matches evaluates the and, or, not, equality and presence filters
+// Authenticator sends. Values compare case-insensitively, DNs by meaning.
+func matches(f *ber.Packet, e entry) bool {
+	switch f.Tag {
+	case ldap.FilterAnd:
+		for _, c := range f.Children {
+			if !matches(c, e) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, c := range f.Children {
+			if matches(c, e) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !matches(f.Children[0], e)
+	case ldap.FilterEqualityMatch:
+		name, want := f.Children[0].Data.String(), f.Children[1].Data.String()
+		for _, v := range attrValues(e, name) {
+			if strings.EqualFold(v, want) || sameDN(v, want) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		return len(attrValues(e, f.Data.String())) > 0
+	}
+	return false
+}
+
+func attrValues(e entry, name string) []string {
+	for k, v := range e.attrs {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+func sameDN(a, b string) bool {
+	x, err1 := ldap.ParseDN(a)
+	y, err2 := ldap.ParseDN(b)
+	return err1 == nil && err2 == nil && len(x.RDNs) > 0 && x.EqualFold(y)
+}
+
+func result(tag ber.Tag, code uint16) *ber.Packet {
+	res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	res.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return res
+}
+
+func (d *Server) reply(conn net.Conn, id int64, op *ber.Packet) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+	packet.AppendChild(op)
+	conn.Write(packet.Bytes())
+}
@@ -0,0 +1,3 @@
+module lan-chat/lockout
+
+go 1.22
@@ -0,0 +1,356 @@
+// Package lockout counts failed logins per username, independent of the
+// client's IP and of the username's case, so a guesser spread over many
+// addresses or spellings still slows down.
+// After each failure the account must wait an exponentially growing delay
+// before the next attempt; past a threshold it is locked, again for
+// exponentially longer each time. A successful login or an administrator
+// clears the count. State lives in the shared database so every instance
+// of a service, and the admin API, see the same lockouts.
+package lockout
+
+import (
+	"database/sql"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema is shared by the auth service and the admin API.
+const Schema = `
+	CREATE TABLE IF NOT EXISTS login_failures (
+		realm TEXT NOT NULL,
+		username TEXT NOT NULL,
+		failures INTEGER NOT NULL,
+		first_failed_at BIGINT NOT NULL,
+		last_failed_at BIGINT NOT NULL,
+		PRIMARY KEY (realm, username)
+	);
+`
+
+// Realms keep user and admin usernames apart.
+const (
+	RealmUser  = "user"
+	RealmAdmin = "admin"
+)
+
+// Policy decides how long an account waits after n failures.
+type Policy struct {
+	// Threshold is the failure count at which the account is locked.
+	Threshold int
+	// BaseDelay is the wait after the first failure; it doubles with each
+	// further failure below Threshold.
+	BaseDelay time.Duration
+	// LockDuration is the first lockout; it doubles with each failure
+	// after the account was locked, up to MaxLock.
+	LockDuration time.Duration
+	MaxLock      time.Duration
+	// ResetAfter forgets failures this long after the last one.
+	ResetAfter time.Duration
+}
+
+// DefaultPolicy waits 1s, 2s, 4s, 8s after the first four failures and
+// locks for 15 minutes at the fifth, then 30, 60... up to a day.
+func DefaultPolicy() Policy {
+	return Policy{
+		Threshold:    5,
+		BaseDelay:    time.Second,
+		LockDuration: 15 * time.Minute,
+		MaxLock:      24 * time.Hour,
+		ResetAfter:   24 * time.Hour,
+	}
+}
+
+// PolicyFromEnv overrides DefaultPolicy with <prefix>_LOCKOUT_THRESHOLD,
+// _LOCKOUT_BASE_DELAY, _LOCKOUT_DURATION, _LOCKOUT_MAX and
+// _LOCKOUT_RESET_AFTER. A threshold of 0 or less turns lockout off.
+func PolicyFromEnv(prefix string) Policy {
+	p := DefaultPolicy()
+	if v := strings.TrimSpace(os.Getenv(prefix + "_LOCKOUT_THRESHOLD")); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			p.Threshold = n
+		}
+	}
+	for name, d := range map[string]*time.Duration{
+		"_LOCKOUT_BASE_DELAY":  &p.BaseDelay,
+		"_LOCKOUT_DURATION":    &p.LockDuration,
+		"_LOCKOUT_MAX":         &p.MaxLock,
+		"_LOCKOUT_RESET_AFTER": &p.ResetAfter,
+	} {
+		if v, err := time.ParseDuration(strings.TrimSpace(os.Getenv(prefix + name))); err == nil && v > 0 {
+			*d = v
+		}
+	}
+	return p
+}
+
+// Wait is how long after the last of n failures the next attempt is
+// allowed.
+func (p Policy) Wait(n int) time.Duration {
+	if n <= 0 || p.Threshold <= 0 {
+		return 0
+	}
+	if n < p.Threshold {
+		return min(shift(p.BaseDelay, n-1), p.LockDuration)
+	}
+	return min(shift(p.LockDuration, n-p.Threshold), p.MaxLock)
+}
+
+// Locked reports whether n failures lock the account rather than only
+// delay it.
+func (p Policy) Locked(n int) bool {
+	return p.Threshold > 0 && n >= p.Threshold
+}
+
+// shift doubles d n times, stopping long before it could overflow.
+func shift(d time.Duration, n int) time.Duration {
+	for ; n > 0 && d < 1<<61; n-- {
+		d *= 2
+	}
+	return d
+}
+
+// Guard tracks one realm's failures.
+type Guard struct {
+	db     *sql.DB
+	realm  string
+	policy Policy
+	now    func() time.Time
+}
+
+// New creates the schema if needed and returns a Guard for realm.
+func New(db *sql.DB, realm string, policy Policy) (*Guard, error) {
+	if _, err := db.Exec(Schema); err != nil {
+		return nil, err
+	}
+	return &Guard{db: db, realm: realm, policy: policy, now: time.Now}, nil
+}
+
+// Policy returns the guard's policy.
+func (g *Guard) Policy() Policy { return g.policy }
+
+// key folds the spellings of a username that log in to the same account.
+func key(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// Check returns how long username must wait before it may try to log in;
+// zero means now. Begin both checks and reserves the attempt, and is what
+// login handlers should use.
+func (g *Guard) Check(username string) (time.Duration, error) {
+	e, err := g.entry(username)
+	if err != nil || e == nil {
+		return 0, err
+	}
+	return e.Retry(g.now()), nil
+}
+
+// Result describes the state after a recorded failure.
+type Result struct {
+	Failures int
+	// Wait is the delay before the next attempt.
+	Wait time.Duration
+	// Locked is set when this failure reached the lockout threshold.
+	Locked bool
+}
+
+// Fail records a failed attempt for username.
+func (g *Guard) Fail(username string) (Result, error) {
+	username = key(username)
+	now := g.now().Unix()
+	stale := g.now().Add(-g.policy.ResetAfter).Unix()
+	_, err := g.db.Exec(`
+		INSERT INTO login_failures (realm, username, failures, first_failed_at, last_failed_at) VALUES (?, ?, 1, ?, ?)
+		ON CONFLICT (realm, username) DO UPDATE SET
+			failures = CASE WHEN login_failures.last_failed_at < ? THEN 1 ELSE login_failures.failures + 1 END,
+			first_failed_at = CASE WHEN login_failures.last_failed_at < ? THEN excluded.first_failed_at ELSE login_failures.first_failed_at END,
+			last_failed_at = excluded.last_failed_at`,
+		g.realm, username, now, now, stale, stale)
+	if err != nil {
+		return Result{}, err
+	}
+	var n int
+	if err := g.db.QueryRow(`SELECT failures FROM login_failures WHERE realm = ? AND username = ?`, g.realm, username).Scan(&n); err != nil {
+		return Result{}, err
+	}
+	return Result{Failures: n, Wait: g.policy.Wait(n), Locked: g.policy.Locked(n)}, nil
+}
+
+// Succeed clears username's failures after a complete login.
+func (g *Guard) Succeed(username string) error {
+	_, err := g.db.Exec(`DELETE FROM login_failures WHERE realm = ? AND username = ?`, g.realm, key(username))
+	return err
+}
+
+// Unlock clears username's failures and reports whether there were any.
+func (g *Guard) Unlock(username string) (bool, error) {
+	res, err := g.db.Exec(`DELETE FROM login_failures WHERE realm = ? AND username = ?`, g.realm, key(username))
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// Begin reserves a login attempt for username: the attempt counts as a
+// failure from the start, so concurrent attempts see its wait and are
+// refused instead of all passing the same check. It returns the wait and
+// no attempt when username must not try yet. The caller calls Fail on a
+// wrong password or code, and defers Release to refund the reservation
+// otherwise.
+func (g *Guard) Begin(username string) (*Attempt, time.Duration, error) {
+	username = key(username)
+	for {
+		a := &Attempt{g: g, username: username}
+		var failures int
+		var first, last int64
+		err := g.db.QueryRow(`SELECT failures, first_failed_at, last_failed_at FROM login_failures WHERE realm = ? AND username = ?`,
+			g.realm, username).Scan(&failures, &first, &last)
+		found := err == nil
+		if err != nil && err != sql.ErrNoRows {
+			return nil, 0, err
+		}
+		now := g.now()
+		a.at = now.Unix()
+		// A forgotten count starts over, and a refund forgets it again.
+		if found && now.Sub(time.Unix(last, 0)) <= g.policy.ResetAfter {
+			e := g.fill(Entry{Failures: failures}, first, last)
+			if wait := e.Retry(now); wait > 0 {
+				return nil, wait, nil
+			}
+			a.prev, a.prevFirst, a.prevLast = failures, first, last
+		}
+		a.n = a.prev + 1
+		start := a.at
+		if a.prev > 0 {
+			start = a.prevFirst
+		}
+		var res sql.Result
+		if found {
+			res, err = g.db.Exec(`UPDATE login_failures SET failures = ?, first_failed_at = ?, last_failed_at = ?
+				WHERE realm = ? AND username = ? AND failures = ? AND last_failed_at = ?`,
+				a.n, start, a.at, g.realm, username, failures, last)
+		} else {
+			res, err = g.db.Exec(`INSERT INTO login_failures (realm, username, failures, first_failed_at, last_failed_at) VALUES (?, ?, 1, ?, ?)
+				ON CONFLICT (realm, username) DO NOTHING`, g.realm, username, a.at, a.at)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, 0, err
+		}
+		if n == 1 {
+			return a, 0, nil
+		}
+		// Another attempt changed the row since it was read: look again.
+	}
+}
+
+// Attempt is a login attempt reserved by Begin.
+type Attempt struct {
+	g        *Guard
+	username string
+	// n and at are the count and time the reservation wrote; prev,
+	// prevFirst and prevLast the row it replaced, prev 0 for none.
+	n, prev             int
+	at                  int64
+	prevFirst, prevLast int64
+	settled             bool
+}
+
+// Username is the key the attempt is counted under.
+func (a *Attempt) Username() string { return a.username }
+
+// Fail keeps the reservation as a failure.
+func (a *Attempt) Fail() Result {
+	a.settled = true
+	return Result{Failures: a.n, Wait: a.g.policy.Wait(a.n), Locked: a.g.policy.Locked(a.n)}
+}
+
+// Release refunds the reservation unless Fail kept it. Once anything else
+// changed the row, such as Succeed clearing it or a later attempt, the
+// refund is skipped: the count errs on the high side, never the low.
+func (a *Attempt) Release() error {
+	if a.settled {
+		return nil
+	}
+	a.settled = true
+	var err error
+	if a.prev == 0 {
+		_, err = a.g.db.Exec(`DELETE FROM login_failures WHERE realm = ? AND username = ? AND failures = ? AND last_failed_at = ?`,
+			a.g.realm, a.username, a.n, a.at)
+	} else {
+		_, err = a.g.db.Exec(`UPDATE login_failures SET failures = ?, first_failed_at = ?, last_failed_at = ?
+			WHERE realm = ? AND username = ? AND failures = ? AND last_failed_at = ?`,
+			a.prev, a.prevFirst, a.prevLast, a.g.realm, a.username, a.n, a.at)
+	}
+	return err
+}
+
+// Entry is an account with recent failures.
+type Entry struct {
+	Username      string    `json:"username"`
+	Failures      int       `json:"failures"`
+	FirstFailedAt time.Time `json:"first_failed_at"`
+	LastFailedAt  time.Time `json:"last_failed_at"`
+	Locked        bool      `json:"locked"`
+	RetryAt       time.Time `json:"retry_at"`
+}
+
+// Retry is how long after now the account may try again.
+func (e *Entry) Retry(now time.Time) time.Duration {
+	if d := e.RetryAt.Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// List returns accounts with failures that are not yet forgotten, most
+// recent first.
+func (g *Guard) List() ([]Entry, error) {
+	rows, err := g.db.Query(`SELECT username, failures, first_failed_at, last_failed_at FROM login_failures
+		WHERE realm = ? AND last_failed_at >= ? ORDER BY last_failed_at DESC`,
+		g.realm, g.now().Add(-g.policy.ResetAfter).Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []Entry{}
+	for rows.Next() {
+		var e Entry
+		var first, last int64
+		if err := rows.Scan(&e.Username, &e.Failures, &first, &last); err != nil {
+			return nil, err
+		}
+		list = append(list, g.fill(e, first, last))
+	}
+	return list, rows.Err()
+}
+
+func (g *Guard) entry(username string) (*Entry, error) {
+	username = key(username)
+	e := Entry{Username: username}
+	var first, last int64
+	err := g.db.QueryRow(`SELECT failures, first_failed_at, last_failed_at FROM login_failures WHERE realm = ? AND username = ?`,
+		g.realm, username).Scan(&e.Failures, &first, &last)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if g.now().Sub(time.Unix(last, 0)) > g.policy.ResetAfter {
+		return nil, nil
+	}
+	e = g.fill(e, first, last)
+	return &e, nil
+}
+
+func (g *Guard) fill(e Entry, first, last int64) Entry {
+	e.FirstFailedAt, e.LastFailedAt = time.Unix(first, 0), time.Unix(last, 0)
+	e.RetryAt = e.LastFailedAt.Add(g.policy.Wait(e.Failures))
+	e.Locked = g.policy.Locked(e.Failures) && g.now().Before(e.RetryAt)
+	return e
+}
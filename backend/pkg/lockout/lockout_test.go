@@ -0,0 +1,52 @@
+package lockout
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPolicyWait(t *testing.T) {
+	p := DefaultPolicy()
+	cases := []struct {
+		failures int
+		wait     time.Duration
+		locked   bool
+	}{
+		{0, 0, false},
+		{1, time.Second, false},
+		{2, 2 * time.Second, false},
+		{4, 8 * time.Second, false},
+		{5, 15 * time.Minute, true},
+		{6, 30 * time.Minute, true},
+		{7, time.Hour, true},
+		{12, 24 * time.Hour, true},
+		{1000, 24 * time.Hour, true},
+	}
+	for _, c := range cases {
+		if got := p.Wait(c.failures); got != c.wait {
+			t.Errorf("Wait(%d) = %v, want %v", c.failures, got, c.wait)
+		}
+		if got := p.Locked(c.failures); got != c.locked {
+			t.Errorf("Locked(%d) = %v, want %v", c.failures, got, c.locked)
+		}
+	}
+
+	off := p
+	off.Threshold = 0
+	if off.Wait(100) != 0 || off.Locked(100) {
+		t.Fatal("a zero threshold turns lockout off")
+	}
+}
+
+func TestPolicyFromEnv(t *testing.T) {
+	t.Setenv("TEST_LOCKOUT_THRESHOLD", "3")
+	t.Setenv("TEST_LOCKOUT_DURATION", "1m")
+	t.Setenv("TEST_LOCKOUT_MAX", "bogus")
+	p := PolicyFromEnv("TEST")
+	if p.Threshold != 3 || p.LockDuration != time.Minute || p.MaxLock != DefaultPolicy().MaxLock {
+		t.Fatalf("unexpected policy %+v", p)
+	}
+	if p.Wait(3) != time.Minute || p.Wait(4) != 2*time.Minute {
+		t.Fatalf("lockout must start at the configured threshold: %v %v", p.Wait(3), p.Wait(4))
+	}
+}
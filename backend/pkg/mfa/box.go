@@ -0,0 +1,91 @@
+package mfa
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ErrSealed is returned when a sealed secret cannot be opened with the key.
+var ErrSealed = errors.New("mfa: cannot open sealed secret")
+
+// Box seals TOTP secrets at rest with AES-256-GCM under a key file only the
+// owning service can read, so the shared database alone does not reveal
+// them.
+type Box struct {
+	aead cipher.AEAD
+}
+
+// OpenKeyFile loads the 32-byte key at path, creating it (0600) if it does
+// not exist.
+func OpenKeyFile(path string) (*Box, error) {
+	key, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(key); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := f.Close(); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return NewBox(key)
+}
+
+// NewBox returns a Box over a 32-byte key.
+func NewBox(key []byte) (*Box, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("mfa: key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Box{aead: aead}, nil
+}
+
+// Seal encrypts plaintext bound to ad, e.g. the owner of the secret.
+func (b *Box) Seal(plaintext, ad []byte) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b.aead.Seal(nonce, nonce, plaintext, ad)), nil
+}
+
+// Open reverses Seal with the same ad.
+func (b *Box) Open(sealed string, ad []byte) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(raw) < b.aead.NonceSize() {
+		return nil, ErrSealed
+	}
+	n := b.aead.NonceSize()
+	plaintext, err := b.aead.Open(nil, raw[:n], raw[n:], ad)
+	if err != nil {
+		return nil, ErrSealed
+	}
+	return plaintext, nil
+}
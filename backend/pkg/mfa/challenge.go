@@ -0,0 +1,99 @@
+package mfa
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+// Challenge purposes: the password was right and the user must either
+// enter a code or, because policy requires a second factor they do not
+// have yet, enroll one.
+const (
+	PurposeVerify = "verify"
+	PurposeEnroll = "enroll"
+)
+
+// Challenge is the state between the password step and the second factor.
+type Challenge struct {
+	Subject  string
+	Purpose  string
+	Expires  time.Time
+	attempts int
+}
+
+// Challenges holds pending login challenges in memory. A challenge is
+// dropped when it expires, is completed, or after too many wrong codes.
+type Challenges struct {
+	ttl         time.Duration
+	maxAttempts int
+
+	mu sync.Mutex
+	m  map[string]*Challenge
+}
+
+// NewChallenges returns a store whose challenges last ttl and allow
+// maxAttempts wrong codes.
+func NewChallenges(ttl time.Duration, maxAttempts int) *Challenges {
+	return &Challenges{ttl: ttl, maxAttempts: maxAttempts, m: make(map[string]*Challenge)}
+}
+
+// TTL is how long new challenges are valid.
+func (c *Challenges) TTL() time.Duration { return c.ttl }
+
+// Issue starts a challenge for subject and returns its opaque token.
+func (c *Challenges) Issue(subject, purpose string) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, ch := range c.m {
+		if now.After(ch.Expires) {
+			delete(c.m, k)
+		}
+	}
+	c.m[token] = &Challenge{Subject: subject, Purpose: purpose, Expires: now.Add(c.ttl)}
+	return token, nil
+}
+
+// Get returns the pending challenge for token.
+func (c *Challenges) Get(token string) (Challenge, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.m[token]
+	if !ok || time.Now().After(ch.Expires) {
+		delete(c.m, token)
+		return Challenge{}, false
+	}
+	return *ch, true
+}
+
+// Fail records a wrong code and returns how many attempts are left; the
+// challenge is gone once none are.
+func (c *Challenges) Fail(token string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.m[token]
+	if !ok {
+		return 0
+	}
+	ch.attempts++
+	left := c.maxAttempts - ch.attempts
+	if left <= 0 {
+		delete(c.m, token)
+		return 0
+	}
+	return left
+}
+
+// Complete removes a challenge that succeeded.
+func (c *Challenges) Complete(token string) {
+	c.mu.Lock()
+	delete(c.m, token)
+	c.mu.Unlock()
+}
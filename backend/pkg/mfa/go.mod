@@ -0,0 +1,3 @@
+module lan-chat/mfa
+
+go 1.22
@@ -0,0 +1,160 @@
+package mfa
+
+import (
+	"bytes"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHOTPVectors(t *testing.T) {
+	// RFC 6238 appendix B, SHA1 with 8 digits.
+	secret := []byte("12345678901234567890")
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, v := range vectors {
+		if got := hotp(secret, uint64(Step(time.Unix(v.unix, 0))), 8); got != v.code {
+			t.Errorf("t=%d: code = %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+func TestMatchIsSingleUseAndBounded(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+
+	step, ok := Match(secret, Code(secret, current), now, 0)
+	if !ok || step != current {
+		t.Fatalf("current code: step %d ok %v", step, ok)
+	}
+	if _, ok := Match(secret, Code(secret, current), now, step); ok {
+		t.Fatal("a code must not be accepted twice")
+	}
+	if _, ok := Match(secret, Code(secret, current-1), now, step); ok {
+		t.Fatal("a code older than the last one used must be refused")
+	}
+	if _, ok := Match(secret, Code(secret, current+1), now, 0); !ok {
+		t.Fatal("a code one step ahead is within the allowed skew")
+	}
+	if _, ok := Match(secret, Code(secret, current-Skew-1), now, 0); ok {
+		t.Fatal("a code outside the skew window must be refused")
+	}
+	if _, ok := Match(secret, "12345", now, 0); ok {
+		t.Fatal("short codes must be refused")
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	u, err := url.Parse(ProvisioningURI("LAN Chat", "alice", secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/LAN Chat:alice" {
+		t.Fatalf("unexpected URI %s", u)
+	}
+	q := u.Query()
+	if q.Get("secret") != "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" || q.Get("issuer") != "LAN Chat" || q.Get("digits") != "6" {
+		t.Fatalf("unexpected parameters %v", q)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := NewRecoveryCodes(RecoveryCodeCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 14 || strings.Count(code, "-") != 2 {
+			t.Fatalf("malformed recovery code %q", code)
+		}
+		if seen[code] {
+			t.Fatalf("duplicate recovery code %q", code)
+		}
+		seen[code] = true
+	}
+	typed := " " + strings.ToUpper(strings.ReplaceAll(codes[0], "-", " ")) + " "
+	if HashRecoveryCode(typed) != HashRecoveryCode(codes[0]) {
+		t.Fatal("case, spaces and dashes must not matter")
+	}
+	if HashRecoveryCode(codes[0]) == HashRecoveryCode(codes[1]) {
+		t.Fatal("different codes must hash differently")
+	}
+}
+
+func TestBox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "totp.key")
+	box, err := OpenKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm()&0o077 != 0 {
+		t.Fatalf("key file must be private to the owner: %v %v", info, err)
+	}
+	sealed, err := box.Seal([]byte("secret"), []byte("user/1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := reopened.Open(sealed, []byte("user/1"))
+	if err != nil || !bytes.Equal(plain, []byte("secret")) {
+		t.Fatalf("open = %q, %v", plain, err)
+	}
+	if _, err := reopened.Open(sealed, []byte("user/2")); err != ErrSealed {
+		t.Fatalf("a secret sealed for another subject must not open: %v", err)
+	}
+	other, _ := NewBox(make([]byte, 32))
+	if _, err := other.Open(sealed, []byte("user/1")); err != ErrSealed {
+		t.Fatalf("a different key must not open the secret: %v", err)
+	}
+}
+
+func TestChallenges(t *testing.T) {
+	c := NewChallenges(time.Minute, 3)
+	token, err := c.Issue("7", PurposeVerify)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch, ok := c.Get(token); !ok || ch.Subject != "7" || ch.Purpose != PurposeVerify {
+		t.Fatalf("get = %+v, %v", ch, ok)
+	}
+	if left := c.Fail(token); left != 2 {
+		t.Fatalf("left = %d", left)
+	}
+	c.Fail(token)
+	if left := c.Fail(token); left != 0 {
+		t.Fatalf("left = %d", left)
+	}
+	if _, ok := c.Get(token); ok {
+		t.Fatal("challenge must be dropped after too many wrong codes")
+	}
+
+	token, _ = c.Issue("7", PurposeEnroll)
+	c.Complete(token)
+	if _, ok := c.Get(token); ok {
+		t.Fatal("completed challenge must be gone")
+	}
+
+	expired := NewChallenges(-time.Second, 3)
+	token, _ = expired.Issue("7", PurposeVerify)
+	if _, ok := expired.Get(token); ok {
+		t.Fatal("expired challenge must be refused")
+	}
+}
@@ -0,0 +1,372 @@
+package mfa
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Schema is shared by the auth service (realm "user") and the admin API
+// (realm "admin"), which also resets users and edits requirements.
+const Schema = `
+	CREATE TABLE IF NOT EXISTS mfa_totp (
+		realm TEXT NOT NULL,
+		subject_id TEXT NOT NULL,
+		secret TEXT NOT NULL, -- sealed with the owning service's TOTP key
+		confirmed_at BIGINT, -- NULL while enrollment is pending
+		last_step BIGINT NOT NULL DEFAULT 0, -- newest time step used, codes are single-use
+		created_at BIGINT NOT NULL,
+		PRIMARY KEY (realm, subject_id)
+	);
+	CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+		realm TEXT NOT NULL,
+		subject_id TEXT NOT NULL,
+		code_hash TEXT NOT NULL,
+		used_at BIGINT,
+		PRIMARY KEY (realm, subject_id, code_hash)
+	);
+	CREATE TABLE IF NOT EXISTS mfa_requirements (
+		scope TEXT NOT NULL,
+		scope_id TEXT NOT NULL,
+		created_by TEXT,
+		created_at BIGINT NOT NULL,
+		PRIMARY KEY (scope, scope_id)
+	);
+`
+
+// Realms keep user and admin accounts apart; their IDs come from
+// different tables.
+const (
+	RealmUser  = "user"
+	RealmAdmin = "admin"
+)
+
+// Requirement scopes: users by role or department, admins by admin role.
+const (
+	ScopeRole       = "role"
+	ScopeDepartment = "department"
+	ScopeAdminRole  = "admin_role"
+)
+
+var (
+	ErrNotEnrolled     = errors.New("mfa: no second factor enrolled")
+	ErrAlreadyEnrolled = errors.New("mfa: second factor already enrolled")
+	ErrInvalidCode     = errors.New("mfa: invalid code")
+	ErrNoBox           = errors.New("mfa: store cannot read secrets")
+)
+
+// Store reads and writes one realm's second factors.
+type Store struct {
+	db    *sql.DB
+	realm string
+	box   *Box // nil for stores that only reset and report status
+}
+
+// NewStore creates the schema if needed and returns a Store for realm.
+func NewStore(db *sql.DB, realm string, box *Box) (*Store, error) {
+	if _, err := db.Exec(Schema); err != nil {
+		return nil, err
+	}
+	return &Store{db: db, realm: realm, box: box}, nil
+}
+
+// Status describes a subject's second factor.
+type Status struct {
+	Enabled           bool  `json:"enabled"`
+	Pending           bool  `json:"pending"` // enrollment started, not confirmed
+	ConfirmedAt       int64 `json:"confirmed_at,omitempty"`
+	RecoveryCodesLeft int   `json:"recovery_codes_left"`
+}
+
+// Status reports whether subject has a confirmed second factor.
+func (s *Store) Status(subject string) (Status, error) {
+	var st Status
+	var confirmed sql.NullInt64
+	err := s.db.QueryRow(`SELECT confirmed_at FROM mfa_totp WHERE realm = ? AND subject_id = ?`, s.realm, subject).Scan(&confirmed)
+	if err == sql.ErrNoRows {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	st.Enabled, st.Pending, st.ConfirmedAt = confirmed.Valid, !confirmed.Valid, confirmed.Int64
+	err = s.db.QueryRow(`SELECT COUNT(*) FROM mfa_recovery_codes WHERE realm = ? AND subject_id = ? AND used_at IS NULL`,
+		s.realm, subject).Scan(&st.RecoveryCodesLeft)
+	return st, err
+}
+
+// Enrollment is what a user needs to add the account to an authenticator.
+type Enrollment struct {
+	Secret string `json:"secret"` // base32, for manual entry
+	URI    string `json:"otpauth_uri"`
+}
+
+// Enroll starts (or restarts) enrollment with a new secret. It is not used
+// for logins until Confirm proves the authenticator has it.
+func (s *Store) Enroll(subject, account, issuer string) (*Enrollment, error) {
+	if s.box == nil {
+		return nil, ErrNoBox
+	}
+	st, err := s.Status(subject)
+	if err != nil {
+		return nil, err
+	}
+	if st.Enabled {
+		return nil, ErrAlreadyEnrolled
+	}
+	secret, err := NewSecret()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := s.box.Seal(secret, s.ad(subject))
+	if err != nil {
+		return nil, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM mfa_totp WHERE realm = ? AND subject_id = ?`, s.realm, subject); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`INSERT INTO mfa_totp (realm, subject_id, secret, created_at) VALUES (?, ?, ?, ?)`,
+		s.realm, subject, sealed, time.Now().Unix()); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &Enrollment{Secret: EncodeSecret(secret), URI: ProvisioningURI(issuer, account, secret)}, nil
+}
+
+// Confirm enables a pending enrollment once code matches and returns fresh
+// recovery codes, shown to the user this once.
+func (s *Store) Confirm(subject, code string) ([]string, error) {
+	secret, confirmed, lastStep, err := s.secret(subject)
+	if err != nil {
+		return nil, err
+	}
+	if confirmed {
+		return nil, ErrAlreadyEnrolled
+	}
+	step, ok := Match(secret, code, time.Now(), lastStep)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`UPDATE mfa_totp SET confirmed_at = ?, last_step = ? WHERE realm = ? AND subject_id = ? AND confirmed_at IS NULL`,
+		time.Now().Unix(), step, s.realm, subject)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return nil, ErrAlreadyEnrolled
+	}
+	codes, err := replaceRecoveryCodes(tx, s.realm, subject)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// Verify checks a code from a confirmed authenticator. Each code works
+// once, and no code older than the last one used is accepted.
+func (s *Store) Verify(subject, code string) error {
+	secret, confirmed, lastStep, err := s.secret(subject)
+	if err != nil {
+		return err
+	}
+	if !confirmed {
+		return ErrNotEnrolled
+	}
+	step, ok := Match(secret, code, time.Now(), lastStep)
+	if !ok {
+		return ErrInvalidCode
+	}
+	res, err := s.db.Exec(`UPDATE mfa_totp SET last_step = ? WHERE realm = ? AND subject_id = ? AND last_step < ?`,
+		step, s.realm, subject, step)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return ErrInvalidCode // raced with a login using the same code
+	}
+	return nil
+}
+
+// UseRecoveryCode spends one recovery code and returns how many are left.
+func (s *Store) UseRecoveryCode(subject, code string) (int, error) {
+	st, err := s.Status(subject)
+	if err != nil {
+		return 0, err
+	}
+	if !st.Enabled {
+		return 0, ErrNotEnrolled
+	}
+	res, err := s.db.Exec(`UPDATE mfa_recovery_codes SET used_at = ? WHERE realm = ? AND subject_id = ? AND code_hash = ? AND used_at IS NULL`,
+		time.Now().Unix(), s.realm, subject, HashRecoveryCode(code))
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return 0, ErrInvalidCode
+	}
+	return st.RecoveryCodesLeft - 1, nil
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes of an enrolled
+// subject.
+func (s *Store) RegenerateRecoveryCodes(subject string) ([]string, error) {
+	st, err := s.Status(subject)
+	if err != nil {
+		return nil, err
+	}
+	if !st.Enabled {
+		return nil, ErrNotEnrolled
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	codes, err := replaceRecoveryCodes(tx, s.realm, subject)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// Reset removes subject's second factor and recovery codes, e.g. for a
+// user who lost their device. It reports whether there was anything.
+func (s *Store) Reset(subject string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`DELETE FROM mfa_totp WHERE realm = ? AND subject_id = ?`, s.realm, subject)
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE realm = ? AND subject_id = ?`, s.realm, subject); err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, tx.Commit()
+}
+
+// Requirement is one scope a subject belongs to, e.g. {ScopeRole, "finance"}.
+type Requirement struct {
+	Scope string
+	ID    string
+}
+
+// Required reports whether any of the given scopes requires a second factor.
+func (s *Store) Required(memberships ...Requirement) (bool, error) {
+	for _, m := range memberships {
+		if m.ID == "" {
+			continue
+		}
+		var exists bool
+		err := s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM mfa_requirements WHERE scope = ? AND scope_id = ?)`, m.Scope, m.ID).Scan(&exists)
+		if err != nil {
+			return false, err
+		}
+		if exists {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Requirements lists the IDs that require a second factor, by scope.
+func (s *Store) Requirements() (map[string][]string, error) {
+	out := map[string][]string{ScopeRole: {}, ScopeDepartment: {}, ScopeAdminRole: {}}
+	rows, err := s.db.Query(`SELECT scope, scope_id FROM mfa_requirements ORDER BY scope, scope_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var scope, id string
+		if err := rows.Scan(&scope, &id); err != nil {
+			return nil, err
+		}
+		out[scope] = append(out[scope], id)
+	}
+	return out, rows.Err()
+}
+
+// SetRequirements replaces the IDs of one scope.
+func (s *Store) SetRequirements(scope string, ids []string, by string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM mfa_requirements WHERE scope = ?`, scope); err != nil {
+		return err
+	}
+	ids = append([]string(nil), ids...)
+	sort.Strings(ids)
+	now := time.Now().Unix()
+	for i, id := range ids {
+		if id == "" || (i > 0 && ids[i-1] == id) {
+			continue
+		}
+		if _, err := tx.Exec(`INSERT INTO mfa_requirements (scope, scope_id, created_by, created_at) VALUES (?, ?, ?, ?)`,
+			scope, id, by, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Store) ad(subject string) []byte {
+	return []byte(s.realm + "/" + subject)
+}
+
+func (s *Store) secret(subject string) ([]byte, bool, int64, error) {
+	if s.box == nil {
+		return nil, false, 0, ErrNoBox
+	}
+	var sealed string
+	var confirmed sql.NullInt64
+	var lastStep int64
+	err := s.db.QueryRow(`SELECT secret, confirmed_at, last_step FROM mfa_totp WHERE realm = ? AND subject_id = ?`, s.realm, subject).
+		Scan(&sealed, &confirmed, &lastStep)
+	if err == sql.ErrNoRows {
+		return nil, false, 0, ErrNotEnrolled
+	}
+	if err != nil {
+		return nil, false, 0, err
+	}
+	secret, err := s.box.Open(sealed, s.ad(subject))
+	if err != nil {
+		return nil, false, 0, err
+	}
+	return secret, confirmed.Valid, lastStep, nil
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, realm, subject string) ([]string, error) {
+	if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE realm = ? AND subject_id = ?`, realm, subject); err != nil {
+		return nil, err
+	}
+	codes, err := NewRecoveryCodes(RecoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		if _, err := tx.Exec(`INSERT INTO mfa_recovery_codes (realm, subject_id, code_hash) VALUES (?, ?, ?)`,
+			realm, subject, HashRecoveryCode(code)); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
@@ -0,0 +1,134 @@
+// Package mfa implements the second login factor shared by the auth
+// service and the admin API: TOTP (RFC 6238) with otpauth:// provisioning
+// URIs, single-use recovery codes, short-lived login challenges, and a
+// Store over the shared mfa_* tables.
+package mfa
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters. They are the defaults of every authenticator app, so
+// the provisioning URI states them only for completeness.
+const (
+	Digits     = 6
+	Period     = 30 * time.Second
+	SecretSize = 20 // 160 bits, as RFC 4226 recommends for HMAC-SHA1
+
+	// Skew is how many periods before and after now a code is accepted.
+	Skew = 1
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret returns a random TOTP secret.
+func NewSecret() ([]byte, error) {
+	secret := make([]byte, SecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// EncodeSecret is the base32 form users type in when they cannot scan.
+func EncodeSecret(secret []byte) string {
+	return b32.EncodeToString(secret)
+}
+
+// ProvisioningURI is the otpauth:// URI to render as a QR code.
+func ProvisioningURI(issuer, account string, secret []byte) string {
+	q := url.Values{}
+	q.Set("secret", EncodeSecret(secret))
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(Digits))
+	q.Set("period", fmt.Sprint(int(Period/time.Second)))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// Step is the TOTP time step of t.
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code is the code for time step step.
+func Code(secret []byte, step int64) string {
+	return hotp(secret, uint64(step), Digits)
+}
+
+// hotp is RFC 4226 with HMAC-SHA1 and dynamic truncation.
+func hotp(secret []byte, counter uint64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// Match returns the time step code is valid for at now, within Skew steps,
+// and only if that step is later than lastStep: a code is good once.
+func Match(secret []byte, code string, now time.Time, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != Digits {
+		return 0, false
+	}
+	current := Step(now)
+	for step := current - Skew; step <= current+Skew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(Code(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// RecoveryCodeCount is how many recovery codes an enrollment hands out.
+const RecoveryCodeCount = 10
+
+// NewRecoveryCodes returns n random codes like "k3m9-x2qa-7fpd".
+func NewRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	for i := range codes {
+		raw := make([]byte, 8)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(b32.EncodeToString(raw))[:12]
+		codes[i] = s[0:4] + "-" + s[4:8] + "-" + s[8:12]
+	}
+	return codes, nil
+}
+
+// HashRecoveryCode is how recovery codes are stored. Case, spaces and
+// dashes do not matter when the code is typed back in.
+func HashRecoveryCode(code string) string {
+	normalized := strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(code)))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,3 @@
+module lan-chat/password
+
+go 1.22
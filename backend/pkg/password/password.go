@@ -0,0 +1,187 @@
+// Package password is the password policy shared by the auth service and
+// the admin API: minimum length and character classes, a deny-list of
+// common passwords, reuse history and a maximum age after which the
+// password must be changed at the next login.
+package password
+
+import (
+	"bufio"
+	"crypto/rand"
+	_ "embed"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// MaxLength is bcrypt's limit; the admin API hashes with bcrypt.
+const MaxLength = 72
+
+//go:embed common.txt
+var commonList string
+
+// Policy is what a new password must satisfy.
+type Policy struct {
+	MinLength int
+	// MinClasses is how many of lowercase, uppercase, digits and symbols
+	// must appear.
+	MinClasses int
+	// History is how many previous passwords may not be reused; 0 allows
+	// reuse.
+	History int
+	// MaxAge forces a change at the next login once a password is this
+	// old; 0 never expires passwords.
+	MaxAge time.Duration
+
+	deny map[string]bool
+}
+
+// DefaultPolicy asks for 8 characters from at least two classes, refuses
+// the built-in list of common passwords and the last 5 passwords, and
+// never expires passwords.
+func DefaultPolicy() Policy {
+	p := Policy{MinLength: 8, MinClasses: 2, History: 5, deny: map[string]bool{}}
+	p.addDenied(commonList)
+	return p
+}
+
+// PolicyFromEnv overrides DefaultPolicy with <prefix>_PASSWORD_MIN_LENGTH,
+// _PASSWORD_MIN_CLASSES, _PASSWORD_HISTORY and _PASSWORD_MAX_AGE.
+// <prefix>_PASSWORD_DENYLIST names a file of further passwords to refuse,
+// one per line.
+func PolicyFromEnv(prefix string) (Policy, error) {
+	p := DefaultPolicy()
+	for name, n := range map[string]*int{
+		"_PASSWORD_MIN_LENGTH":  &p.MinLength,
+		"_PASSWORD_MIN_CLASSES": &p.MinClasses,
+		"_PASSWORD_HISTORY":     &p.History,
+	} {
+		if v := strings.TrimSpace(os.Getenv(prefix + name)); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil || i < 0 {
+				return p, fmt.Errorf("%s%s: invalid value %q", prefix, name, v)
+			}
+			*n = i
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv(prefix + "_PASSWORD_MAX_AGE")); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return p, fmt.Errorf("%s_PASSWORD_MAX_AGE: invalid duration %q", prefix, v)
+		}
+		p.MaxAge = d
+	}
+	p.MinLength = min(max(p.MinLength, 1), MaxLength)
+	p.MinClasses = min(p.MinClasses, 4)
+	if path := strings.TrimSpace(os.Getenv(prefix + "_PASSWORD_DENYLIST")); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return p, err
+		}
+		p.addDenied(string(b))
+	}
+	return p, nil
+}
+
+func (p *Policy) addDenied(list string) {
+	sc := bufio.NewScanner(strings.NewReader(list))
+	for sc.Scan() {
+		line := strings.ToLower(strings.TrimSpace(sc.Text()))
+		if line != "" && !strings.HasPrefix(line, "#") {
+			p.deny[line] = true
+		}
+	}
+}
+
+// Error lists every rule a password breaks.
+type Error struct {
+	Problems []string `json:"problems"`
+}
+
+func (e *Error) Error() string {
+	return "password rejected: " + strings.Join(e.Problems, "; ")
+}
+
+// ErrReused is returned for a password among the last Policy.History.
+var ErrReused = errors.New("password was used recently")
+
+// Validate checks password against the policy, returning an *Error.
+func (p Policy) Validate(password, username string) error {
+	var problems []string
+	if n := len([]rune(password)); n < p.MinLength {
+		problems = append(problems, fmt.Sprintf("shorter than %d characters", p.MinLength))
+	}
+	if len(password) > MaxLength {
+		problems = append(problems, fmt.Sprintf("longer than %d bytes", MaxLength))
+	}
+	if classes(password) < p.MinClasses {
+		problems = append(problems, fmt.Sprintf("needs at least %d of lowercase, uppercase, digits and symbols", p.MinClasses))
+	}
+	if p.common(password) {
+		problems = append(problems, "too common")
+	}
+	if u := strings.ToLower(strings.TrimSpace(username)); len(u) >= 3 && strings.Contains(strings.ToLower(password), u) {
+		problems = append(problems, "contains the username")
+	}
+	if problems != nil {
+		return &Error{Problems: problems}
+	}
+	return nil
+}
+
+// common reports whether password, or its letters once leading and
+// trailing digits and symbols are dropped ("Password1!" -> "password"),
+// is denied.
+func (p Policy) common(password string) bool {
+	lower := strings.ToLower(password)
+	if p.deny[lower] {
+		return true
+	}
+	core := strings.TrimFunc(lower, func(r rune) bool { return !unicode.IsLetter(r) })
+	return core != "" && p.deny[core]
+}
+
+func classes(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// generateAlphabet leaves out characters that are easy to misread when an
+// administrator passes a temporary password on.
+const generateAlphabet = "abcdefghjkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789!@#%*-_"
+
+// Generate returns a random password that satisfies p, for one-time
+// passwords set by an administrator.
+func (p Policy) Generate() (string, error) {
+	n := max(16, p.MinLength)
+	limit := big.NewInt(int64(len(generateAlphabet)))
+	for {
+		b := make([]byte, n)
+		for i := range b {
+			j, err := rand.Int(rand.Reader, limit)
+			if err != nil {
+				return "", err
+			}
+			b[i] = generateAlphabet[j.Int64()]
+		}
+		if pw := string(b); classes(pw) == 4 && p.Validate(pw, "") == nil {
+			return pw, nil
+		}
+	}
+}
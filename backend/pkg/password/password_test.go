@@ -0,0 +1,90 @@
+package password
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	p := DefaultPolicy()
+	cases := []struct {
+		password string
+		problems []string
+	}{
+		{"correct horse battery", nil},
+		{"Tr0ub4dor", nil},
+		{"short1", []string{"shorter than 8 characters"}},
+		{"alllowercase", []string{"needs at least 2 of"}},
+		{"123456789", []string{"needs at least 2 of", "too common"}},
+		{"Password1!", []string{"too common"}},
+		{"qwerty2024", []string{"too common"}},
+		{"alice-is-great", []string{"contains the username"}},
+		{strings.Repeat("a1", 40), []string{"longer than 72 bytes"}},
+	}
+	for _, c := range cases {
+		err := p.Validate(c.password, "Alice")
+		if c.problems == nil {
+			if err != nil {
+				t.Errorf("%q: unexpected %v", c.password, err)
+			}
+			continue
+		}
+		var perr *Error
+		if !errors.As(err, &perr) || len(perr.Problems) != len(c.problems) {
+			t.Errorf("%q: got %v, want %v", c.password, err, c.problems)
+			continue
+		}
+		for i, want := range c.problems {
+			if !strings.HasPrefix(perr.Problems[i], want) {
+				t.Errorf("%q: problem %q, want %q", c.password, perr.Problems[i], want)
+			}
+		}
+	}
+}
+
+func TestPolicyFromEnv(t *testing.T) {
+	deny := filepath.Join(t.TempDir(), "deny.txt")
+	if err := os.WriteFile(deny, []byte("# local words\nBandung\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("X_PASSWORD_MIN_LENGTH", "12")
+	t.Setenv("X_PASSWORD_MIN_CLASSES", "3")
+	t.Setenv("X_PASSWORD_HISTORY", "0")
+	t.Setenv("X_PASSWORD_MAX_AGE", "2160h")
+	t.Setenv("X_PASSWORD_DENYLIST", deny)
+	p, err := PolicyFromEnv("X")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MinLength != 12 || p.MinClasses != 3 || p.History != 0 || p.MaxAge != 90*24*time.Hour {
+		t.Fatalf("policy: %+v", p)
+	}
+	if p.Validate("Bandung2024!", "") == nil || p.Validate("Password123!", "") == nil {
+		t.Fatal("configured and built-in deny-lists both apply")
+	}
+
+	t.Setenv("X_PASSWORD_HISTORY", "many")
+	if _, err := PolicyFromEnv("X"); err == nil {
+		t.Fatal("invalid history accepted")
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	p := DefaultPolicy()
+	p.MinLength = 20
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		pw, err := p.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pw) != 20 || classes(pw) != 4 || p.Validate(pw, "") != nil || seen[pw] {
+			t.Fatalf("generated %q", pw)
+		}
+		seen[pw] = true
+	}
+}
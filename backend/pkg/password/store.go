@@ -0,0 +1,155 @@
+package password
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Schema is shared by the auth service and the admin API. Hashes in
+// password_history use whichever format the service that set the password
+// writes; callers pass a matching verifier to Reused.
+const Schema = `
+	CREATE TABLE IF NOT EXISTS password_history (
+		user_id TEXT NOT NULL,
+		password_hash TEXT NOT NULL,
+		created_at BIGINT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_password_history_user ON password_history(user_id, created_at);
+	CREATE TABLE IF NOT EXISTS password_state (
+		user_id TEXT PRIMARY KEY,
+		changed_at BIGINT NOT NULL,
+		must_change INTEGER NOT NULL DEFAULT 0
+	);
+`
+
+// recentHistory is the creation time of the oldest of a user's last N
+// passwords (arguments: user ID, N). Passwords set within the same second
+// tie and are all kept, so there is no need for a row ID that only SQLite
+// has.
+const recentHistory = `(SELECT MIN(created_at) FROM (
+	SELECT created_at FROM password_history WHERE user_id = ? ORDER BY created_at DESC LIMIT ?) recent)`
+
+// Reasons a login must change the password before it completes.
+const (
+	ReasonReset   = "reset"
+	ReasonExpired = "expired"
+)
+
+// Store keeps users' password history and whether they must change it.
+type Store struct {
+	db     *sql.DB
+	policy Policy
+	now    func() time.Time
+}
+
+// NewStore creates the schema if needed.
+func NewStore(db *sql.DB, policy Policy) (*Store, error) {
+	if _, err := db.Exec(Schema); err != nil {
+		return nil, err
+	}
+	return &Store{db: db, policy: policy, now: time.Now}, nil
+}
+
+// Policy returns the store's policy.
+func (s *Store) Policy() Policy { return s.policy }
+
+// Check validates password for username and refuses one of the user's
+// last Policy.History passwords. match verifies a password against a
+// stored hash.
+func (s *Store) Check(userID, username, password string, match func(password, hash string) bool) error {
+	if err := s.policy.Validate(password, username); err != nil {
+		return err
+	}
+	if s.policy.History <= 0 {
+		return nil
+	}
+	rows, err := s.db.Query(`SELECT password_hash FROM password_history WHERE user_id = ?
+		AND created_at >= `+recentHistory, userID, userID, s.policy.History)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return err
+		}
+		if match(password, hash) {
+			return ErrReused
+		}
+	}
+	return rows.Err()
+}
+
+// Record notes that userID's password is now hash. mustChange makes the
+// next login change it, as after an administrator's reset.
+func (s *Store) Record(userID, hash string, mustChange bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := s.RecordTx(tx, userID, hash, mustChange); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecordTx is Record within the caller's transaction, so the new hash and
+// its history are stored together with whatever else the caller changes.
+func (s *Store) RecordTx(tx *sql.Tx, userID, hash string, mustChange bool) error {
+	now := s.now().Unix()
+	if s.policy.History > 0 && !mustChange {
+		// A one-time password is never chosen by the user, so it does not
+		// count towards the history.
+		if _, err := tx.Exec(`INSERT INTO password_history (user_id, password_hash, created_at) VALUES (?, ?, ?)`,
+			userID, hash, now); err != nil {
+			return err
+		}
+	}
+	prune, args := `DELETE FROM password_history WHERE user_id = ?`, []interface{}{userID}
+	if s.policy.History > 0 {
+		prune += ` AND created_at < ` + recentHistory
+		args = append(args, userID, s.policy.History)
+	}
+	if _, err := tx.Exec(prune, args...); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO password_state (user_id, changed_at, must_change) VALUES (?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET changed_at = excluded.changed_at, must_change = excluded.must_change`,
+		userID, now, mustChange); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ChangeRequired returns ReasonReset or ReasonExpired when userID must
+// change the password before a login completes, or "". Passwords set
+// before the store existed have no recorded age and never expire.
+func (s *Store) ChangeRequired(userID string) (string, error) {
+	var changed int64
+	var must bool
+	err := s.db.QueryRow(`SELECT changed_at, must_change FROM password_state WHERE user_id = ?`, userID).Scan(&changed, &must)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case must:
+		return ReasonReset, nil
+	case s.policy.MaxAge > 0 && s.now().Sub(time.Unix(changed, 0)) > s.policy.MaxAge:
+		return ReasonExpired, nil
+	}
+	return "", nil
+}
+
+// Forget drops a deleted user's history.
+func (s *Store) Forget(userID string) error {
+	if _, err := s.db.Exec(`DELETE FROM password_history WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`DELETE FROM password_state WHERE user_id = ?`, userID)
+	return err
+}
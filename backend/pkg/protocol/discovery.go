@@ -3,6 +3,10 @@ package protocol
 import (
 	"encoding/json"
 	"time"
+
+	"lan-chat/protocol/pb"
+
+	"google.golang.org/protobuf/proto"
 )
 
 // MessageType defines the type of message being exchanged.
@@ -18,7 +22,7 @@ const (
 )
 
 // DiscoveryPacket represents the payload sent over UDP for node discovery.
-// In a real implementation, this would be generated from Protobuf.
+// Its binary encoding is pb.DiscoveryPacket.
 type DiscoveryPacket struct {
 	ClusterID string `json:"cluster_id"`
 	NodeID    string `json:"node_id"`
@@ -35,14 +39,41 @@ type PeerInfo struct {
 	PublicKey []byte    `json:"public_key"`
 }
 
-// Encode converts the packet to bytes (JSON for simplicity without protoc).
+// Encode converts the packet to JSON bytes, understood by every node.
 func (p *DiscoveryPacket) Encode() ([]byte, error) {
 	return json.Marshal(p)
 }
 
-// Decode parses bytes into a DiscoveryPacket.
+// EncodeBinary converts the packet to its Protobuf encoding.
+func (p *DiscoveryPacket) EncodeBinary() ([]byte, error) {
+	return proto.Marshal(&pb.DiscoveryPacket{
+		ClusterId: p.ClusterID,
+		NodeId:    p.NodeID,
+		Address:   p.Address,
+		Priority:  p.Priority,
+		PublicKey: p.PublicKey,
+	})
+}
+
+// Decode parses bytes into a DiscoveryPacket. Both encodings are accepted so
+// nodes can be upgraded one at a time: JSON packets start with '{', which is
+// never a valid first byte of the Protobuf encoding.
 func DecodeDiscoveryPacket(data []byte) (*DiscoveryPacket, error) {
 	var p DiscoveryPacket
-	err := json.Unmarshal(data, &p)
-	return &p, err
+	if len(data) > 0 && data[0] == '{' {
+		err := json.Unmarshal(data, &p)
+		return &p, err
+	}
+	var in pb.DiscoveryPacket
+	if err := proto.Unmarshal(data, &in); err != nil {
+		return &p, err
+	}
+	p = DiscoveryPacket{
+		ClusterID: in.GetClusterId(),
+		NodeID:    in.GetNodeId(),
+		Address:   in.GetAddress(),
+		Priority:  in.GetPriority(),
+		PublicKey: in.GetPublicKey(),
+	}
+	return &p, nil
 }
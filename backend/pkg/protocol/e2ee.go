@@ -1,15 +1,108 @@
 package protocol
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 )
 
-// RatchetSession represents the state of a double ratchet session.
+// RatchetSession is the state of one X3DH + Double Ratchet session with a
+// remote device. It is plain data: MarshalBinary/UnmarshalBinary persist it
+// between runs. A session must not be used concurrently.
 type RatchetSession struct {
-	RootKey   []byte
-	ChainKey  []byte
-	NextKey   []byte
-	RatchetID string
+	Version   int    `json:"version"`
+	RatchetID string `json:"ratchet_id"` // caller's label, e.g. the recipient ID
+
+	// Identities as IdentityKey.Bytes(); AssociatedData is the initiator's
+	// followed by the responder's and is authenticated with every message.
+	LocalIdentity  []byte `json:"local_identity"`
+	RemoteIdentity []byte `json:"remote_identity"`
+	AssociatedData []byte `json:"associated_data"`
+
+	RootKey           []byte   `json:"root_key"`
+	SendingRatchet    *KeyPair `json:"sending_ratchet,omitempty"`
+	RemoteRatchetKey  []byte   `json:"remote_ratchet_key,omitempty"`
+	SendingChainKey   []byte   `json:"sending_chain_key,omitempty"`
+	ReceivingChainKey []byte   `json:"receiving_chain_key,omitempty"`
+	SendCount         uint32   `json:"send_count"`
+	ReceiveCount      uint32   `json:"receive_count"`
+	PreviousSendCount uint32   `json:"previous_send_count"`
+
+	SkippedKeys []SkippedMessageKey `json:"skipped_keys,omitempty"`
+
+	// BaseKey is the initiator's X3DH ephemeral key; it identifies the
+	// session in repeated prekey messages.
+	BaseKey []byte `json:"base_key"`
+	// PendingPreKey is set on the initiator until the first reply arrives;
+	// until then every message carries the X3DH parameters, so the session
+	// can be set up from whichever message the responder receives first.
+	PendingPreKey *PendingPreKey `json:"pending_prekey,omitempty"`
+}
+
+// SkippedMessageKey is the key of a message that has not arrived yet.
+type SkippedMessageKey struct {
+	RatchetKey []byte `json:"ratchet_key"`
+	N          uint32 `json:"n"`
+	MessageKey []byte `json:"message_key"`
+}
+
+// PendingPreKey records which of the responder's prekeys a session used.
+type PendingPreKey struct {
+	SignedPreKeyID  uint32 `json:"signed_prekey_id"`
+	OneTimePreKeyID uint32 `json:"one_time_prekey_id,omitempty"`
+}
+
+const ratchetSessionVersion = 1
+
+// MarshalBinary serialises the session.
+func (s *RatchetSession) MarshalBinary() ([]byte, error) {
+	return json.Marshal(s)
+}
+
+// UnmarshalBinary restores a session written by MarshalBinary.
+func (s *RatchetSession) UnmarshalBinary(data []byte) error {
+	var out RatchetSession
+	if err := json.Unmarshal(data, &out); err != nil {
+		return err
+	}
+	if out.Version != ratchetSessionVersion {
+		return fmt.Errorf("e2ee: unsupported session version %d", out.Version)
+	}
+	*s = out
+	return nil
+}
+
+// Established reports whether the session holds key material.
+func (s *RatchetSession) Established() bool {
+	return s.RootKey != nil
+}
+
+// clone returns a deep copy so a failed decryption leaves s untouched.
+func (s *RatchetSession) clone() *RatchetSession {
+	c := *s
+	cp := func(b []byte) []byte {
+		if b == nil {
+			return nil
+		}
+		return append([]byte(nil), b...)
+	}
+	c.RootKey = cp(s.RootKey)
+	c.RemoteRatchetKey = cp(s.RemoteRatchetKey)
+	c.SendingChainKey = cp(s.SendingChainKey)
+	c.ReceivingChainKey = cp(s.ReceivingChainKey)
+	if s.SendingRatchet != nil {
+		c.SendingRatchet = &KeyPair{Private: cp(s.SendingRatchet.Private), Public: cp(s.SendingRatchet.Public)}
+	}
+	c.SkippedKeys = append([]SkippedMessageKey(nil), s.SkippedKeys...)
+	if s.PendingPreKey != nil {
+		p := *s.PendingPreKey
+		c.PendingPreKey = &p
+	}
+	return &c
 }
 
 // SignalProtocolHandler defines the interface for E2EE operations.
@@ -19,30 +112,196 @@ type SignalProtocolHandler interface {
 	DecryptMessage(session *RatchetSession, ciphertext []byte) ([]byte, error)
 }
 
-// DummySignalHandler is a placeholder implementation.
-type DummySignalHandler struct{}
+var (
+	// ErrIdentityKeyChanged is returned when a prekey message for an
+	// existing session comes from a different identity than before.
+	ErrIdentityKeyChanged = errors.New("e2ee: remote identity key changed")
+	ErrNoPreKeyStore      = errors.New("e2ee: no prekey store to accept sessions")
+)
 
-func (h *DummySignalHandler) InitializeSession(recipientID string, identityKey []byte, signedPreKey []byte) (*RatchetSession, error) {
-	// In a real implementation, perform X3DH key exchange here.
-	return &RatchetSession{
-		RootKey:   []byte("root-key"),
-		ChainKey:  []byte("chain-key"),
-		RatchetID: "session-" + recipientID,
-	}, nil
+// DoubleRatchetHandler implements SignalProtocolHandler with X3DH session
+// setup and the Double Ratchet, using X25519, HKDF-SHA256 and AES-256-GCM.
+type DoubleRatchetHandler struct {
+	Identity *IdentityKeyPair
+	// PreKeys holds the private prekeys this device published; it is only
+	// needed to accept sessions other devices start.
+	PreKeys PreKeyStore
+	// Rand defaults to crypto/rand.
+	Rand io.Reader
 }
 
-func (h *DummySignalHandler) EncryptMessage(session *RatchetSession, plaintext []byte) ([]byte, error) {
-	// Simulate encryption (In reality: AES-GCM)
-	ciphertext := make([]byte, len(plaintext))
-	copy(ciphertext, plaintext)
-	// Append dummy logic to show something happened
-	return append(ciphertext, []byte("-encrypted")...), nil
+var _ SignalProtocolHandler = (*DoubleRatchetHandler)(nil)
+
+// NewDoubleRatchetHandler returns a handler for the given identity.
+func NewDoubleRatchetHandler(identity *IdentityKeyPair, prekeys PreKeyStore) *DoubleRatchetHandler {
+	return &DoubleRatchetHandler{Identity: identity, PreKeys: prekeys}
 }
 
-func (h *DummySignalHandler) DecryptMessage(session *RatchetSession, ciphertext []byte) ([]byte, error) {
-	if len(ciphertext) < 10 {
-		return nil, errors.New("ciphertext too short")
+func (h *DoubleRatchetHandler) rand() io.Reader {
+	if h.Rand != nil {
+		return h.Rand
+	}
+	return rand.Reader
+}
+
+// InitializeSession starts a session without a one-time prekey.
+// identityKey is IdentityKey.Bytes() and signedPreKey is
+// SignedPreKey.PublicBytes(); the signature is verified.
+func (h *DoubleRatchetHandler) InitializeSession(recipientID string, identityKey []byte, signedPreKey []byte) (*RatchetSession, error) {
+	if len(signedPreKey) != SignedPreKeySize {
+		return nil, ErrInvalidKey
+	}
+	return h.InitiateSession(recipientID, &PreKeyBundle{
+		IdentityKey:           identityKey,
+		SignedPreKeyID:        binary.BigEndian.Uint32(signedPreKey),
+		SignedPreKey:          signedPreKey[4 : 4+KeySize],
+		SignedPreKeySignature: signedPreKey[4+KeySize:],
+	})
+}
+
+// InitiateSession runs X3DH against a verified prekey bundle. Messages
+// encrypted with the session are prekey messages until the first reply.
+func (h *DoubleRatchetHandler) InitiateSession(recipientID string, bundle *PreKeyBundle) (*RatchetSession, error) {
+	remote, err := bundle.Verify()
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := GenerateKeyPair(h.rand())
+	if err != nil {
+		return nil, err
+	}
+	sk, err := x3dhInitiate(h.Identity, ephemeral, remote, bundle)
+	if err != nil {
+		return nil, err
+	}
+	local := h.Identity.Public().Bytes()
+	s := &RatchetSession{
+		Version:        ratchetSessionVersion,
+		RatchetID:      recipientID,
+		LocalIdentity:  local,
+		RemoteIdentity: remote.Bytes(),
+		AssociatedData: append(append([]byte(nil), local...), remote.Bytes()...),
+		BaseKey:        ephemeral.Public,
+		PendingPreKey:  &PendingPreKey{SignedPreKeyID: bundle.SignedPreKeyID, OneTimePreKeyID: bundle.OneTimePreKeyID},
+	}
+	if err := s.initInitiator(h.rand(), sk, bundle.SignedPreKey); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// EncryptMessage encrypts plaintext and advances the session.
+func (h *DoubleRatchetHandler) EncryptMessage(session *RatchetSession, plaintext []byte) ([]byte, error) {
+	if !session.Established() {
+		return nil, ErrSessionNotReady
+	}
+	local, err := ParseIdentityKey(session.LocalIdentity)
+	if err != nil {
+		return nil, err
+	}
+	out, err := session.encrypt(plaintext)
+	if err != nil || session.PendingPreKey == nil {
+		return out, err
+	}
+	return encodePreKeyMessage(&preKeyMessage{
+		identity:        local,
+		baseKey:         session.BaseKey,
+		signedPreKeyID:  session.PendingPreKey.SignedPreKeyID,
+		oneTimePreKeyID: session.PendingPreKey.OneTimePreKeyID,
+		inner:           out,
+	}), nil
+}
+
+// DecryptMessage decrypts ciphertext and advances the session; on error the
+// session is unchanged. A prekey message may be given a zero session (or
+// one from an earlier session with the same identity), which is then set
+// up from this device's prekeys. A prekey message from a different
+// identity than the session's fails with ErrIdentityKeyChanged.
+//
+// The one-time prekey a new session used is removed before DecryptMessage
+// returns. Callers that persist the session use DecryptStored, or
+// DecryptKeepingPreKey, so the prekey outlives a failed save.
+func (h *DoubleRatchetHandler) DecryptMessage(session *RatchetSession, ciphertext []byte) ([]byte, error) {
+	pt, used, err := h.DecryptKeepingPreKey(session, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if used != 0 {
+		if err := h.PreKeys.RemoveOneTimePreKey(used); err != nil {
+			return nil, err
+		}
+	}
+	return pt, nil
+}
+
+// DecryptKeepingPreKey is DecryptMessage without removing the one-time
+// prekey: it returns the ID of the prekey a new session used, or 0, for
+// the caller to remove with PreKeys.RemoveOneTimePreKey once the session
+// is saved. Removed earlier, a failed save would leave a message that can
+// never be decrypted again.
+func (h *DoubleRatchetHandler) DecryptKeepingPreKey(session *RatchetSession, ciphertext []byte) ([]byte, uint32, error) {
+	working := session.clone()
+	inner := ciphertext
+	var usedOneTimePreKey uint32
+	if IsPreKeyMessage(ciphertext) {
+		m, err := parsePreKeyMessage(ciphertext)
+		if err != nil {
+			return nil, 0, err
+		}
+		if session.Established() && !bytes.Equal(session.RemoteIdentity, m.identity.Bytes()) {
+			return nil, 0, ErrIdentityKeyChanged
+		}
+		if !session.Established() || !bytes.Equal(session.BaseKey, m.baseKey) {
+			if working, err = h.acceptSession(session.RatchetID, m); err != nil {
+				return nil, 0, err
+			}
+			usedOneTimePreKey = m.oneTimePreKeyID
+		}
+		inner = m.inner
+	}
+	if !working.Established() {
+		return nil, 0, ErrSessionNotReady
+	}
+	pt, err := working.decrypt(h.rand(), inner)
+	if err != nil {
+		return nil, 0, err
+	}
+	// A reply means the responder has the session; stop sending prekeys.
+	working.PendingPreKey = nil
+	*session = *working
+	return pt, usedOneTimePreKey, nil
+}
+
+// acceptSession runs the responder side of X3DH. The one-time prekey is
+// only removed by the caller once the message decrypts, so a forged prekey
+// message cannot burn it.
+func (h *DoubleRatchetHandler) acceptSession(ratchetID string, m *preKeyMessage) (*RatchetSession, error) {
+	if h.PreKeys == nil {
+		return nil, ErrNoPreKeyStore
+	}
+	spk, err := h.PreKeys.SignedPreKey(m.signedPreKeyID)
+	if err != nil {
+		return nil, err
+	}
+	var opk *OneTimePreKey
+	if m.oneTimePreKeyID != 0 {
+		if opk, err = h.PreKeys.OneTimePreKey(m.oneTimePreKeyID); err != nil {
+			return nil, err
+		}
+	}
+	sk, err := x3dhRespond(h.Identity, spk, opk, m.identity, m.baseKey)
+	if err != nil {
+		return nil, err
+	}
+	local := h.Identity.Public().Bytes()
+	s := &RatchetSession{
+		Version:        ratchetSessionVersion,
+		RatchetID:      ratchetID,
+		LocalIdentity:  local,
+		RemoteIdentity: m.identity.Bytes(),
+		AssociatedData: append(m.identity.Bytes(), local...),
+		BaseKey:        append([]byte(nil), m.baseKey...),
 	}
-	// Simulate decryption
-	return ciphertext[:len(ciphertext)-10], nil
+	s.initResponder(sk, &spk.KeyPair)
+	return s, nil
 }
@@ -0,0 +1,337 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+type e2eeDevice struct {
+	identity *IdentityKeyPair
+	spk      *SignedPreKey
+	opks     []*OneTimePreKey
+	store    *MemoryPreKeyStore
+	handler  *DoubleRatchetHandler
+}
+
+func newE2EEDevice(t *testing.T, rng *testRand) *e2eeDevice {
+	t.Helper()
+	id, err := GenerateIdentityKeyPair(rng)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spk, _ := GenerateSignedPreKey(rng, id, 7)
+	opks, _ := GenerateOneTimePreKeys(rng, 1, 3)
+	store := NewMemoryPreKeyStore([]*SignedPreKey{spk}, opks)
+	return &e2eeDevice{identity: id, spk: spk, opks: opks, store: store,
+		handler: &DoubleRatchetHandler{Identity: id, PreKeys: store, Rand: rng}}
+}
+
+func (d *e2eeDevice) bundle(withOneTime bool) *PreKeyBundle {
+	if withOneTime {
+		return NewPreKeyBundle(d.identity.Public(), d.spk, d.opks[0])
+	}
+	return NewPreKeyBundle(d.identity.Public(), d.spk, nil)
+}
+
+func encryptAll(t *testing.T, h *DoubleRatchetHandler, s *RatchetSession, prefix string, n int) [][]byte {
+	t.Helper()
+	out := make([][]byte, n)
+	for i := range out {
+		ct, err := h.EncryptMessage(s, []byte(fmt.Sprintf("%s %d", prefix, i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out[i] = ct
+	}
+	return out
+}
+
+func mustDecrypt(t *testing.T, h *DoubleRatchetHandler, s *RatchetSession, ct []byte, want string) {
+	t.Helper()
+	pt, err := h.DecryptMessage(s, ct)
+	if err != nil || string(pt) != want {
+		t.Fatalf("decrypt = %q, %v; want %q", pt, err, want)
+	}
+}
+
+func snapshot(t *testing.T, s *RatchetSession) []byte {
+	t.Helper()
+	data, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	for _, withOneTime := range []bool{true, false} {
+		rng := newTestRand(fmt.Sprintf("round-trip-%v", withOneTime))
+		alice, bob := newE2EEDevice(t, rng), newE2EEDevice(t, rng)
+
+		as, err := alice.handler.InitiateSession("bob", bob.bundle(withOneTime))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs := &RatchetSession{RatchetID: "alice"}
+		if _, err := bob.handler.EncryptMessage(bs, []byte("x")); !errors.Is(err, ErrSessionNotReady) {
+			t.Fatalf("expected ErrSessionNotReady, got %v", err)
+		}
+
+		// Several turns so both sides perform DH ratchet steps.
+		for turn := 0; turn < 4; turn++ {
+			for i, ct := range encryptAll(t, alice.handler, as, fmt.Sprintf("a%d", turn), 3) {
+				if (turn == 0) != IsPreKeyMessage(ct) {
+					t.Fatalf("turn %d: prekey message = %v", turn, IsPreKeyMessage(ct))
+				}
+				mustDecrypt(t, bob.handler, bs, ct, fmt.Sprintf("a%d %d", turn, i))
+			}
+			for i, ct := range encryptAll(t, bob.handler, bs, fmt.Sprintf("b%d", turn), 2) {
+				mustDecrypt(t, alice.handler, as, ct, fmt.Sprintf("b%d %d", turn, i))
+			}
+		}
+		if bs.RatchetID != "alice" || !bytes.Equal(bs.RemoteIdentity, alice.identity.Public().Bytes()) ||
+			!bytes.Equal(as.AssociatedData, bs.AssociatedData) {
+			t.Fatal("sessions disagree on identities")
+		}
+		if _, err := bob.store.OneTimePreKey(1); withOneTime != errors.Is(err, ErrUnknownPreKey) {
+			t.Fatalf("one-time prekey removed = %v, want %v", err != nil, withOneTime)
+		}
+	}
+}
+
+func TestInitializeSessionVerifiesSignedPreKey(t *testing.T) {
+	rng := newTestRand("initialize")
+	alice, bob := newE2EEDevice(t, rng), newE2EEDevice(t, rng)
+	identity := bob.identity.Public().Bytes()
+
+	as, err := alice.handler.InitializeSession("bob", identity, bob.spk.PublicBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, _ := alice.handler.EncryptMessage(as, []byte("hi"))
+	mustDecrypt(t, bob.handler, &RatchetSession{}, ct, "hi")
+
+	forged := bob.spk.PublicBytes()
+	forged[10] ^= 1
+	if _, err := alice.handler.InitializeSession("bob", identity, forged); !errors.Is(err, ErrInvalidPreKeyBundle) {
+		t.Fatalf("expected ErrInvalidPreKeyBundle, got %v", err)
+	}
+	mallory := newE2EEDevice(t, rng)
+	if _, err := alice.handler.InitializeSession("bob", identity, mallory.spk.PublicBytes()); !errors.Is(err, ErrInvalidPreKeyBundle) {
+		t.Fatalf("expected a prekey signed by another identity to be rejected, got %v", err)
+	}
+	if _, err := alice.handler.InitializeSession("bob", identity[:10], bob.spk.PublicBytes()); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("expected ErrInvalidKey, got %v", err)
+	}
+}
+
+func TestOutOfOrderWithinChain(t *testing.T) {
+	rng := newTestRand("out-of-order")
+	alice, bob := newE2EEDevice(t, rng), newE2EEDevice(t, rng)
+	as, _ := alice.handler.InitiateSession("bob", bob.bundle(true))
+	bs := &RatchetSession{}
+
+	cts := encryptAll(t, alice.handler, as, "m", 5)
+	for _, i := range []int{3, 0, 4, 1, 2} {
+		mustDecrypt(t, bob.handler, bs, cts[i], fmt.Sprintf("m %d", i))
+	}
+	if len(bs.SkippedKeys) != 0 {
+		t.Fatalf("expected all skipped keys used, %d left", len(bs.SkippedKeys))
+	}
+	// Replays fail and leave the session as it was.
+	before := snapshot(t, bs)
+	if _, err := bob.handler.DecryptMessage(bs, cts[2]); err == nil {
+		t.Fatal("expected replay to fail")
+	}
+	if !bytes.Equal(before, snapshot(t, bs)) {
+		t.Fatal("failed decryption changed the session")
+	}
+}
+
+func TestOutOfOrderAcrossRatchetSteps(t *testing.T) {
+	rng := newTestRand("across-steps")
+	alice, bob := newE2EEDevice(t, rng), newE2EEDevice(t, rng)
+	as, _ := alice.handler.InitiateSession("bob", bob.bundle(true))
+	bs := &RatchetSession{}
+
+	first := encryptAll(t, alice.handler, as, "a", 3)
+	// Bob sets the session up from the second prekey message.
+	mustDecrypt(t, bob.handler, bs, first[1], "a 1")
+	reply := encryptAll(t, bob.handler, bs, "b", 2)
+	mustDecrypt(t, alice.handler, as, reply[1], "b 1")
+	if as.PendingPreKey != nil {
+		t.Fatal("initiator still sends prekey messages after a reply")
+	}
+
+	second := encryptAll(t, alice.handler, as, "c", 2)
+	if IsPreKeyMessage(second[0]) {
+		t.Fatal("expected a plain ratchet message after the reply")
+	}
+	mustDecrypt(t, bob.handler, bs, second[1], "c 1")
+	// Delayed messages from the previous chains, including prekey messages
+	// for the already established session.
+	mustDecrypt(t, bob.handler, bs, first[2], "a 2")
+	mustDecrypt(t, bob.handler, bs, first[0], "a 0")
+	mustDecrypt(t, bob.handler, bs, second[0], "c 0")
+	mustDecrypt(t, alice.handler, as, reply[0], "b 0")
+}
+
+func TestRandomDelivery(t *testing.T) {
+	rng := newTestRand("random-delivery")
+	alice, bob := newE2EEDevice(t, rng), newE2EEDevice(t, rng)
+	as, _ := alice.handler.InitiateSession("bob", bob.bundle(true))
+	bs := &RatchetSession{}
+
+	type flight struct {
+		ct   []byte
+		want string
+	}
+	toBob := []flight{{encryptAll(t, alice.handler, as, "hello", 1)[0], "hello 0"}}
+	var toAlice []flight
+	order := rand.New(rand.NewSource(1))
+	deliver := func(h *DoubleRatchetHandler, s *RatchetSession, queue []flight) []flight {
+		i := order.Intn(len(queue))
+		mustDecrypt(t, h, s, queue[i].ct, queue[i].want)
+		return append(queue[:i], queue[i+1:]...)
+	}
+
+	for step := 0; step < 400; step++ {
+		switch order.Intn(4) {
+		case 0:
+			msg := fmt.Sprintf("a%d", step)
+			ct, err := alice.handler.EncryptMessage(as, []byte(msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			toBob = append(toBob, flight{ct, msg})
+		case 1:
+			if !bs.Established() || bs.SendingChainKey == nil {
+				continue
+			}
+			msg := fmt.Sprintf("b%d", step)
+			ct, err := bob.handler.EncryptMessage(bs, []byte(msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			toAlice = append(toAlice, flight{ct, msg})
+		case 2:
+			if len(toBob) > 0 {
+				toBob = deliver(bob.handler, bs, toBob)
+			}
+		case 3:
+			if len(toAlice) > 0 {
+				toAlice = deliver(alice.handler, as, toAlice)
+			}
+		}
+	}
+	for len(toBob) > 0 {
+		toBob = deliver(bob.handler, bs, toBob)
+	}
+	for len(toAlice) > 0 {
+		toAlice = deliver(alice.handler, as, toAlice)
+	}
+}
+
+func TestTamperedMessagesAreRejected(t *testing.T) {
+	rng := newTestRand("tamper")
+	alice, bob := newE2EEDevice(t, rng), newE2EEDevice(t, rng)
+	as, _ := alice.handler.InitiateSession("bob", bob.bundle(true))
+	bs := &RatchetSession{}
+	ct := encryptAll(t, alice.handler, as, "m", 1)[0]
+
+	for _, pos := range []int{len(ct) - 1, preKeyHeaderSize + 5, preKeyHeaderSize + ratchetHeaderSize - 1} {
+		bad := append([]byte(nil), ct...)
+		bad[pos] ^= 0x80
+		if _, err := bob.handler.DecryptMessage(bs, bad); err == nil {
+			t.Fatalf("tampered byte %d accepted", pos)
+		}
+		if bs.Established() {
+			t.Fatal("failed prekey message established a session")
+		}
+	}
+	// The forged attempts did not burn the one-time prekey.
+	mustDecrypt(t, bob.handler, bs, ct, "m 0")
+
+	if _, err := bob.handler.DecryptMessage(bs, ct[:10]); !errors.Is(err, ErrMalformedMessage) {
+		t.Fatalf("expected ErrMalformedMessage, got %v", err)
+	}
+	if _, err := bob.handler.DecryptMessage(&RatchetSession{}, []byte("hello-encrypted")); err == nil {
+		t.Fatal("expected garbage to be rejected")
+	}
+}
+
+func TestTooManySkippedMessages(t *testing.T) {
+	rng := newTestRand("skip")
+	alice, bob := newE2EEDevice(t, rng), newE2EEDevice(t, rng)
+	as, _ := alice.handler.InitiateSession("bob", bob.bundle(true))
+	bs := &RatchetSession{}
+	mustDecrypt(t, bob.handler, bs, encryptAll(t, alice.handler, as, "m", 1)[0], "m 0")
+
+	cts := encryptAll(t, alice.handler, as, "n", MaxSkip+2)
+	if _, err := bob.handler.DecryptMessage(bs, cts[MaxSkip+1]); !errors.Is(err, ErrTooManySkipped) {
+		t.Fatalf("expected ErrTooManySkipped, got %v", err)
+	}
+	mustDecrypt(t, bob.handler, bs, cts[MaxSkip], fmt.Sprintf("n %d", MaxSkip))
+	if len(bs.SkippedKeys) != MaxSkip {
+		t.Fatalf("expected %d skipped keys, got %d", MaxSkip, len(bs.SkippedKeys))
+	}
+}
+
+func TestSessionSerialisation(t *testing.T) {
+	rng := newTestRand("serialise")
+	alice, bob := newE2EEDevice(t, rng), newE2EEDevice(t, rng)
+	as, _ := alice.handler.InitiateSession("bob", bob.bundle(true))
+	bs := &RatchetSession{}
+	cts := encryptAll(t, alice.handler, as, "m", 3)
+	mustDecrypt(t, bob.handler, bs, cts[2], "m 2")
+
+	reload := func(s *RatchetSession) *RatchetSession {
+		var out RatchetSession
+		if err := out.UnmarshalBinary(snapshot(t, s)); err != nil {
+			t.Fatal(err)
+		}
+		return &out
+	}
+	as, bs = reload(as), reload(bs)
+	mustDecrypt(t, bob.handler, bs, cts[0], "m 0")
+	reply := encryptAll(t, bob.handler, bs, "r", 1)[0]
+	mustDecrypt(t, alice.handler, reload(as), reply, "r 0")
+
+	if err := new(RatchetSession).UnmarshalBinary([]byte(`{"version":99}`)); err == nil {
+		t.Fatal("expected unknown version to be rejected")
+	}
+}
+
+func TestIdentityChangeAndNewSessions(t *testing.T) {
+	rng := newTestRand("identity-change")
+	alice, bob := newE2EEDevice(t, rng), newE2EEDevice(t, rng)
+	as, _ := alice.handler.InitiateSession("bob", bob.bundle(false))
+	bs := &RatchetSession{}
+	mustDecrypt(t, bob.handler, bs, encryptAll(t, alice.handler, as, "m", 1)[0], "m 0")
+
+	// Alice restarts the session with the same identity: Bob replaces his.
+	as2, _ := alice.handler.InitiateSession("bob", bob.bundle(false))
+	mustDecrypt(t, bob.handler, bs, encryptAll(t, alice.handler, as2, "new", 1)[0], "new 0")
+
+	// A different identity claiming the same session is refused.
+	mallory := newE2EEDevice(t, rng)
+	ms, _ := mallory.handler.InitiateSession("bob", bob.bundle(false))
+	ct := encryptAll(t, mallory.handler, ms, "evil", 1)[0]
+	if _, err := bob.handler.DecryptMessage(bs, ct); !errors.Is(err, ErrIdentityKeyChanged) {
+		t.Fatalf("expected ErrIdentityKeyChanged, got %v", err)
+	}
+	if id, err := PreKeyMessageIdentity(ct); err != nil || !id.Equal(mallory.identity.Public()) {
+		t.Fatalf("PreKeyMessageIdentity = %v, %v", id, err)
+	}
+
+	// Reusing a consumed one-time prekey fails on the responder.
+	as3, _ := alice.handler.InitiateSession("bob", bob.bundle(true))
+	mustDecrypt(t, bob.handler, &RatchetSession{}, encryptAll(t, alice.handler, as3, "x", 1)[0], "x 0")
+	as4, _ := alice.handler.InitiateSession("bob", bob.bundle(true))
+	if _, err := bob.handler.DecryptMessage(&RatchetSession{}, encryptAll(t, alice.handler, as4, "y", 1)[0]); !errors.Is(err, ErrUnknownPreKey) {
+		t.Fatalf("expected ErrUnknownPreKey, got %v", err)
+	}
+}
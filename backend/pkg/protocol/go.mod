@@ -1,3 +1,5 @@
 module lan-chat/protocol
 
 go 1.22
+
+require google.golang.org/protobuf v1.34.2
@@ -0,0 +1,107 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ProtocolVersion is the /ws protocol version implemented by this package.
+// Clients that connect without a Hello are treated as version 0.
+const ProtocolVersion = 1
+
+// Capabilities advertised in Welcome. A client that negotiated a capability
+// may rely on the matching frames and fields.
+const (
+	CapabilityBinary      = "binary"      // lan-chat.v1+proto subprotocol
+	CapabilityAttachments = "attachments" // Message.Attachment descriptors
+	CapabilityVoice       = "voice"       // MessageTypeVoice with VoiceInfo
+	CapabilitySignatures  = "signatures"  // device-signed messages
+	CapabilityCommands    = "commands"    // slash commands
+	CapabilityEphemeral   = "ephemeral"   // unsaved replies to one user
+	CapabilityNotices     = "notices"     // Notice frames
+)
+
+// Error codes sent when a handshake is rejected.
+const (
+	ErrorCodeIncompatibleVersion = "incompatible_version"
+	ErrorCodeMissingCapability   = "missing_capability"
+	ErrorCodeHelloRequired       = "hello_required"
+)
+
+// Hello is the first frame a client sends on /ws.
+type Hello struct {
+	Version      int32    `json:"version"`
+	MinVersion   int32    `json:"min_version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Required     []string `json:"required,omitempty"`
+	Client       string   `json:"client,omitempty"`
+}
+
+// Welcome answers a Hello.
+type Welcome struct {
+	Version      int32    `json:"version"`
+	Capabilities []string `json:"capabilities"`
+	Enabled      []string `json:"enabled"`
+}
+
+// HandshakeError rejects a Hello; Detail is sent to the client before the
+// connection is closed.
+type HandshakeError struct {
+	Detail ErrorDetail
+}
+
+func (e *HandshakeError) Error() string { return e.Detail.Message }
+
+// Negotiate checks a client Hello against the server's supported version
+// range and capabilities and returns the Welcome to send back.
+func Negotiate(h *Hello, minVersion, maxVersion int32, supported []string) (*Welcome, error) {
+	clientMin := h.MinVersion
+	if clientMin == 0 || clientMin > h.Version {
+		clientMin = h.Version
+	}
+	if h.Version < minVersion || clientMin > maxVersion {
+		return nil, &HandshakeError{ErrorDetail{
+			Code: ErrorCodeIncompatibleVersion,
+			Message: fmt.Sprintf("client speaks protocol %d-%d, server supports %d-%d",
+				clientMin, h.Version, minVersion, maxVersion),
+		}}
+	}
+
+	have := make(map[string]bool, len(supported))
+	for _, c := range supported {
+		have[c] = true
+	}
+	var missing []string
+	for _, c := range h.Required {
+		if !have[c] {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, &HandshakeError{ErrorDetail{
+			Code:    ErrorCodeMissingCapability,
+			Message: "server does not support: " + strings.Join(missing, ", "),
+		}}
+	}
+
+	enabled := make([]string, 0, len(h.Capabilities))
+	seen := make(map[string]bool)
+	for _, c := range append(append([]string{}, h.Capabilities...), h.Required...) {
+		if have[c] && !seen[c] {
+			seen[c] = true
+			enabled = append(enabled, c)
+		}
+	}
+	sort.Strings(enabled)
+
+	version := h.Version
+	if version > maxVersion {
+		version = maxVersion
+	}
+	return &Welcome{
+		Version:      version,
+		Capabilities: append([]string{}, supported...),
+		Enabled:      enabled,
+	}, nil
+}
@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	supported := []string{CapabilityBinary, CapabilityVoice, CapabilityAttachments}
+	cases := []struct {
+		name        string
+		hello       Hello
+		min, max    int32
+		wantCode    string
+		wantVersion int32
+		wantEnabled []string
+	}{
+		{"intersection", Hello{Version: 1, Capabilities: []string{CapabilityVoice, "threads"}}, 0, 1, "", 1, []string{CapabilityVoice}},
+		{"required counts as enabled", Hello{Version: 1, Required: []string{CapabilityBinary}}, 0, 1, "", 1, []string{CapabilityBinary}},
+		{"newer client negotiates down", Hello{Version: 3, MinVersion: 1}, 0, 1, "", 1, []string{}},
+		{"client too old", Hello{Version: 1}, 2, 3, ErrorCodeIncompatibleVersion, 0, nil},
+		{"client too new", Hello{Version: 4, MinVersion: 3}, 1, 2, ErrorCodeIncompatibleVersion, 0, nil},
+		{"missing required", Hello{Version: 1, Required: []string{"receipts"}}, 0, 1, ErrorCodeMissingCapability, 0, nil},
+	}
+	for _, c := range cases {
+		h := c.hello
+		w, err := Negotiate(&h, c.min, c.max, supported)
+		if c.wantCode != "" {
+			var hs *HandshakeError
+			if !errors.As(err, &hs) || hs.Detail.Code != c.wantCode {
+				t.Fatalf("%s: expected %s, got %v", c.name, c.wantCode, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", c.name, err)
+		}
+		if w.Version != c.wantVersion || !reflect.DeepEqual(w.Enabled, c.wantEnabled) || !reflect.DeepEqual(w.Capabilities, supported) {
+			t.Fatalf("%s: unexpected welcome %+v", c.name, w)
+		}
+	}
+}
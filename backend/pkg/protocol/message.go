@@ -6,14 +6,50 @@ import (
 
 // Message represents a chat message.
 type Message struct {
-	ID        string      `json:"id"`
-	ChannelID string      `json:"channel_id"`
-	SenderID  string      `json:"sender_id"`
-	Timestamp int64       `json:"timestamp"`
-	Type      MessageType `json:"type"`
-	Content   []byte      `json:"content"` // Encrypted payload
-	Nonce     []byte      `json:"nonce"`
-	Signature []byte      `json:"signature"`
+	ID         string      `json:"id"`
+	ChannelID  string      `json:"channel_id"`
+	SenderID   string      `json:"sender_id"`
+	Timestamp  int64       `json:"timestamp"`
+	Type       MessageType `json:"type"`
+	Content    []byte      `json:"content"` // Encrypted payload
+	Nonce      []byte      `json:"nonce"`
+	Signature  []byte      `json:"signature"`
+	DeviceID   string      `json:"device_id,omitempty"` // Signing or fan-out sending device
+	Ephemeral  bool        `json:"ephemeral,omitempty"` // Delivered only to one user, never stored
+	Attachment *Attachment `json:"attachment,omitempty"`
+	// FanOut marks a message encrypted separately for each device. Content
+	// then holds only the copy for RecipientDeviceID, and is empty for a
+	// device the sender did not encrypt to.
+	FanOut            bool   `json:"fan_out,omitempty"`
+	RecipientDeviceID string `json:"recipient_device_id,omitempty"`
+}
+
+// DeviceCiphertext is one device's copy of a fan-out message, encrypted
+// with the pairwise session between the sending and receiving device.
+type DeviceCiphertext struct {
+	UserID   string `json:"user_id,omitempty"` // filled in by the server
+	DeviceID string `json:"device_id"`
+	Content  []byte `json:"content"`
+}
+
+// Attachment describes a file stored by the filetransfer service and shared
+// in a MessageTypeFile or MessageTypeImage message.
+type Attachment struct {
+	FileID   string `json:"file_id"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	MimeType string `json:"mime_type"`
+	SHA256   string `json:"sha256"` // Hex digest of the plaintext file
+	// Voice is set on MessageTypeVoice attachments so clients can render a
+	// player without downloading the audio.
+	Voice *VoiceInfo `json:"voice,omitempty"`
+}
+
+// VoiceInfo is client-supplied metadata for a voice note.
+type VoiceInfo struct {
+	DurationMs int64  `json:"duration_ms"`
+	Codec      string `json:"codec"`    // e.g. "opus", "aac", "mp3"
+	Waveform   []int  `json:"waveform"` // Downsampled amplitudes, 0-255
 }
 
 // SendMessageRequest is the payload for sending a message.
@@ -23,6 +59,17 @@ type SendMessageRequest struct {
 	Nonce     []byte      `json:"nonce"`
 	Signature []byte      `json:"signature"`
 	Type      MessageType `json:"type"`
+	// DeviceID and Timestamp (Unix ms) are required when Signature is set;
+	// the server keeps the signed timestamp so recipients can re-verify.
+	DeviceID  string `json:"device_id,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	// Attachment is required for file and image messages. Fields the client
+	// sets must match the filetransfer record; the server fills the rest.
+	Attachment *Attachment `json:"attachment,omitempty"`
+	// Recipients sends one ciphertext per device instead of Content, which
+	// must then be empty. DeviceID names the sending device; include the
+	// sender's other devices to keep them in sync.
+	Recipients []DeviceCiphertext `json:"recipients,omitempty"`
 }
 
 // SendMessageResponse is the acknowledgment.
@@ -30,6 +77,9 @@ type SendMessageResponse struct {
 	MessageID string `json:"message_id"`
 	Success   bool   `json:"success"`
 	Error     string `json:"error,omitempty"`
+	// Ephemeral is a slash-command reply meant only for the sender. It is
+	// not stored, and MessageID is empty when it is the only reply.
+	Ephemeral string `json:"ephemeral,omitempty"`
 }
 
 // EncodeMessage converts the message to bytes.
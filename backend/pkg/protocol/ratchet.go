@@ -0,0 +1,335 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Double Ratchet parameters.
+const (
+	// MaxSkip is the most message keys one chain may skip, so a forged
+	// counter cannot make the receiver derive keys without bound.
+	MaxSkip = 1000
+	// MaxSkippedKeys bounds the skipped keys kept per session; the oldest
+	// are dropped first.
+	MaxSkippedKeys = 2000
+)
+
+const (
+	ratchetInfo     = "LanChat Ratchet"
+	messageKeysInfo = "LanChat MessageKeys"
+
+	e2eeVersion        byte = 1
+	messageTypeRatchet byte = 1
+	messageTypePreKey  byte = 2
+	ratchetHeaderSize       = 2 + KeySize + 4 + 4
+	preKeyHeaderSize        = 2 + IdentityKeySize + KeySize + 4 + 4
+	gcmTagSize              = 16
+)
+
+var (
+	ErrMalformedMessage = errors.New("e2ee: malformed message")
+	ErrDecryptFailed    = errors.New("e2ee: message failed authentication")
+	ErrTooManySkipped   = errors.New("e2ee: too many skipped messages")
+	ErrSessionNotReady  = errors.New("e2ee: session cannot send before receiving")
+)
+
+// hkdf is HKDF-SHA256 (RFC 5869).
+func hkdf(salt, ikm, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	prk := extract.Sum(nil)
+
+	var out, block []byte
+	for i := byte(1); len(out) < length; i++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{i})
+		block = expand.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
+
+// kdfRK advances the root key with a DH output, returning the new root key
+// and a chain key.
+func kdfRK(rootKey, dhOut []byte) (newRoot, chainKey []byte) {
+	out := hkdf(rootKey, dhOut, []byte(ratchetInfo), 2*KeySize)
+	return out[:KeySize], out[KeySize:]
+}
+
+// kdfCK advances a chain key, returning the next chain key and the message
+// key for the current step.
+func kdfCK(chainKey []byte) (next, messageKey []byte) {
+	m := hmac.New(sha256.New, chainKey)
+	m.Write([]byte{0x01})
+	messageKey = m.Sum(nil)
+	m = hmac.New(sha256.New, chainKey)
+	m.Write([]byte{0x02})
+	return m.Sum(nil), messageKey
+}
+
+// messageCipher expands a message key into an AES-256-GCM cipher and
+// nonce. Each message key is used once, so a derived nonce is safe.
+func messageCipher(messageKey []byte) (cipher.AEAD, []byte, error) {
+	return expandCipher(messageKey, messageKeysInfo)
+}
+
+func expandCipher(messageKey []byte, info string) (cipher.AEAD, []byte, error) {
+	keys := hkdf(make([]byte, KeySize), messageKey, []byte(info), KeySize+12)
+	block, err := aes.NewCipher(keys[:KeySize])
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcm, keys[KeySize:], nil
+}
+
+// ratchetHeader is the cleartext header of a ratchet message.
+type ratchetHeader struct {
+	RatchetKey []byte // sender's current ratchet public key
+	Previous   uint32 // messages in the sender's previous sending chain
+	N          uint32 // index in the current sending chain
+}
+
+// ratchetMessage is version || type || ratchet key || PN || N || ciphertext.
+type ratchetMessage struct {
+	header     ratchetHeader
+	headerData []byte // authenticated with the ciphertext
+	ciphertext []byte
+}
+
+// preKeyMessage wraps the first ratchet messages of a session with what the
+// responder needs to run X3DH: version || type || identity || base key ||
+// signed prekey ID || one-time prekey ID (0 for none) || ratchet message.
+type preKeyMessage struct {
+	identity        IdentityKey
+	baseKey         []byte
+	signedPreKeyID  uint32
+	oneTimePreKeyID uint32
+	inner           []byte
+}
+
+func encodeRatchetHeader(h ratchetHeader) []byte {
+	out := append(make([]byte, 0, ratchetHeaderSize), e2eeVersion, messageTypeRatchet)
+	out = append(out, h.RatchetKey...)
+	out = binary.BigEndian.AppendUint32(out, h.Previous)
+	return binary.BigEndian.AppendUint32(out, h.N)
+}
+
+func parseRatchetMessage(data []byte) (*ratchetMessage, error) {
+	if len(data) < ratchetHeaderSize+gcmTagSize || data[0] != e2eeVersion || data[1] != messageTypeRatchet {
+		return nil, ErrMalformedMessage
+	}
+	return &ratchetMessage{
+		header: ratchetHeader{
+			RatchetKey: data[2 : 2+KeySize],
+			Previous:   binary.BigEndian.Uint32(data[2+KeySize:]),
+			N:          binary.BigEndian.Uint32(data[6+KeySize:]),
+		},
+		headerData: data[:ratchetHeaderSize],
+		ciphertext: data[ratchetHeaderSize:],
+	}, nil
+}
+
+func encodePreKeyMessage(m *preKeyMessage) []byte {
+	out := append(make([]byte, 0, preKeyHeaderSize+len(m.inner)), e2eeVersion, messageTypePreKey)
+	out = append(out, m.identity.Bytes()...)
+	out = append(out, m.baseKey...)
+	out = binary.BigEndian.AppendUint32(out, m.signedPreKeyID)
+	out = binary.BigEndian.AppendUint32(out, m.oneTimePreKeyID)
+	return append(out, m.inner...)
+}
+
+func parsePreKeyMessage(data []byte) (*preKeyMessage, error) {
+	if len(data) < preKeyHeaderSize || data[0] != e2eeVersion || data[1] != messageTypePreKey {
+		return nil, ErrMalformedMessage
+	}
+	identity, err := ParseIdentityKey(data[2 : 2+IdentityKeySize])
+	if err != nil {
+		return nil, ErrMalformedMessage
+	}
+	off := 2 + IdentityKeySize
+	return &preKeyMessage{
+		identity:        identity,
+		baseKey:         data[off : off+KeySize],
+		signedPreKeyID:  binary.BigEndian.Uint32(data[off+KeySize:]),
+		oneTimePreKeyID: binary.BigEndian.Uint32(data[off+KeySize+4:]),
+		inner:           data[preKeyHeaderSize:],
+	}, nil
+}
+
+// IsPreKeyMessage reports whether ciphertext starts a new session, i.e.
+// whether DecryptMessage may be given a zero RatchetSession for it.
+func IsPreKeyMessage(ciphertext []byte) bool {
+	return len(ciphertext) >= 2 && ciphertext[0] == e2eeVersion && ciphertext[1] == messageTypePreKey
+}
+
+// PreKeyMessageIdentity returns the sender identity carried by a prekey
+// message, so callers can check it before accepting the session.
+func PreKeyMessageIdentity(ciphertext []byte) (IdentityKey, error) {
+	m, err := parsePreKeyMessage(ciphertext)
+	if err != nil {
+		return IdentityKey{}, err
+	}
+	return m.identity, nil
+}
+
+// initInitiator sets up the sending side after X3DH: the responder's signed
+// prekey doubles as its first ratchet key.
+func (s *RatchetSession) initInitiator(rand io.Reader, sk, remoteRatchetKey []byte) error {
+	ratchet, err := GenerateKeyPair(rand)
+	if err != nil {
+		return err
+	}
+	shared, err := dh(ratchet.Private, remoteRatchetKey)
+	if err != nil {
+		return err
+	}
+	s.SendingRatchet = ratchet
+	s.RemoteRatchetKey = append([]byte(nil), remoteRatchetKey...)
+	s.RootKey, s.SendingChainKey = kdfRK(sk, shared)
+	return nil
+}
+
+// initResponder sets up the receiving side after X3DH; the first sending
+// chain is created when the initiator's first ratchet key arrives.
+func (s *RatchetSession) initResponder(sk []byte, signedPreKey *KeyPair) {
+	kp := *signedPreKey
+	s.SendingRatchet = &kp
+	s.RootKey = append([]byte(nil), sk...)
+}
+
+// encrypt produces a ratchet message and advances the sending chain.
+func (s *RatchetSession) encrypt(plaintext []byte) ([]byte, error) {
+	if s.SendingChainKey == nil {
+		return nil, ErrSessionNotReady
+	}
+	next, mk := kdfCK(s.SendingChainKey)
+	header := encodeRatchetHeader(ratchetHeader{
+		RatchetKey: s.SendingRatchet.Public,
+		Previous:   s.PreviousSendCount,
+		N:          s.SendCount,
+	})
+	gcm, nonce, err := messageCipher(mk)
+	if err != nil {
+		return nil, err
+	}
+	out := gcm.Seal(header, nonce, plaintext, append(append([]byte(nil), s.AssociatedData...), header...))
+	s.SendingChainKey = next
+	s.SendCount++
+	return out, nil
+}
+
+// decrypt opens a ratchet message, performing a DH ratchet step when the
+// sender's ratchet key changed. It mutates s even on failure, so callers
+// work on a copy and keep it only on success.
+func (s *RatchetSession) decrypt(rand io.Reader, data []byte) ([]byte, error) {
+	m, err := parseRatchetMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	if pt, ok, err := s.trySkipped(m); ok {
+		return pt, err
+	}
+	if !bytes.Equal(m.header.RatchetKey, s.RemoteRatchetKey) {
+		if err := s.skipKeys(m.header.Previous); err != nil {
+			return nil, err
+		}
+		if err := s.dhRatchet(rand, m.header.RatchetKey); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.skipKeys(m.header.N); err != nil {
+		return nil, err
+	}
+	next, mk := kdfCK(s.ReceivingChainKey)
+	s.ReceivingChainKey = next
+	s.ReceiveCount++
+	return s.open(mk, m)
+}
+
+func (s *RatchetSession) open(messageKey []byte, m *ratchetMessage) ([]byte, error) {
+	gcm, nonce, err := messageCipher(messageKey)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := gcm.Open(nil, nonce, m.ciphertext, append(append([]byte(nil), s.AssociatedData...), m.headerData...))
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	return pt, nil
+}
+
+// trySkipped decrypts m with a stored skipped key, if there is one.
+func (s *RatchetSession) trySkipped(m *ratchetMessage) ([]byte, bool, error) {
+	for i, k := range s.SkippedKeys {
+		if k.N == m.header.N && bytes.Equal(k.RatchetKey, m.header.RatchetKey) {
+			pt, err := s.open(k.MessageKey, m)
+			if err == nil {
+				s.SkippedKeys = append(s.SkippedKeys[:i:i], s.SkippedKeys[i+1:]...)
+			}
+			return pt, true, err
+		}
+	}
+	return nil, false, nil
+}
+
+// skipKeys stores the message keys of the receiving chain up to index
+// until, for messages that have not arrived yet.
+func (s *RatchetSession) skipKeys(until uint32) error {
+	if s.ReceivingChainKey == nil {
+		return nil
+	}
+	if until > s.ReceiveCount+MaxSkip {
+		return ErrTooManySkipped
+	}
+	for s.ReceiveCount < until {
+		next, mk := kdfCK(s.ReceivingChainKey)
+		s.SkippedKeys = append(s.SkippedKeys, SkippedMessageKey{
+			RatchetKey: append([]byte(nil), s.RemoteRatchetKey...),
+			N:          s.ReceiveCount,
+			MessageKey: mk,
+		})
+		s.ReceivingChainKey = next
+		s.ReceiveCount++
+	}
+	if extra := len(s.SkippedKeys) - MaxSkippedKeys; extra > 0 {
+		s.SkippedKeys = append([]SkippedMessageKey(nil), s.SkippedKeys[extra:]...)
+	}
+	return nil
+}
+
+// dhRatchet moves to the sender's new ratchet key: a receiving chain from
+// it and our current key, then a fresh key of ours and a sending chain.
+func (s *RatchetSession) dhRatchet(rand io.Reader, remoteKey []byte) error {
+	shared, err := dh(s.SendingRatchet.Private, remoteKey)
+	if err != nil {
+		return err
+	}
+	s.PreviousSendCount = s.SendCount
+	s.SendCount, s.ReceiveCount = 0, 0
+	s.RemoteRatchetKey = append([]byte(nil), remoteKey...)
+	s.RootKey, s.ReceivingChainKey = kdfRK(s.RootKey, shared)
+
+	ratchet, err := GenerateKeyPair(rand)
+	if err != nil {
+		return err
+	}
+	if shared, err = dh(ratchet.Private, remoteKey); err != nil {
+		return err
+	}
+	s.SendingRatchet = ratchet
+	s.RootKey, s.SendingChainKey = kdfRK(s.RootKey, shared)
+	return nil
+}
@@ -0,0 +1,151 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// testRand is a deterministic byte stream: SHA-256(seed || counter) blocks.
+type testRand struct {
+	seed    []byte
+	counter uint32
+	buf     []byte
+}
+
+func newTestRand(seed string) *testRand { return &testRand{seed: []byte(seed)} }
+
+func (r *testRand) Read(p []byte) (int, error) {
+	for len(r.buf) < len(p) {
+		block := sha256.Sum256(binary.BigEndian.AppendUint32(append([]byte(nil), r.seed...), r.counter))
+		r.counter++
+		r.buf = append(r.buf, block[:]...)
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestHKDFVector(t *testing.T) {
+	// RFC 5869, test case 1.
+	okm := hkdf(unhex(t, "000102030405060708090a0b0c"), bytes.Repeat([]byte{0x0b}, 22),
+		unhex(t, "f0f1f2f3f4f5f6f7f8f9"), 42)
+	want := "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865"
+	if hex.EncodeToString(okm) != want {
+		t.Fatalf("hkdf = %x", okm)
+	}
+}
+
+func TestX25519Vector(t *testing.T) {
+	// RFC 7748, section 6.1.
+	alice := unhex(t, "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a")
+	bobPub := unhex(t, "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f")
+	kp, err := GenerateKeyPair(bytes.NewReader(alice))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(kp.Public) != "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a" {
+		t.Fatalf("public key = %x", kp.Public)
+	}
+	shared, err := dh(kp.Private, bobPub)
+	if err != nil || hex.EncodeToString(shared) != "4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742" {
+		t.Fatalf("shared secret = %x (%v)", shared, err)
+	}
+	if _, err := dh(kp.Private, make([]byte, KeySize)); err != ErrInvalidKey {
+		t.Fatalf("expected low-order point to be rejected, got %v", err)
+	}
+}
+
+// The expected values below were computed with an independent reference
+// implementation of X25519, HKDF and HMAC.
+func TestRatchetKDFVectors(t *testing.T) {
+	rk, ck := kdfRK(bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32))
+	if hex.EncodeToString(rk) != "722d774ab78c568bca0fb2fab1b71c889e37d83e595da5339d4fe74126d82793" ||
+		hex.EncodeToString(ck) != "9d4aa72aa40f165f64de081a839a77be0bb1a8702e4846d35d275eca4317edc8" {
+		t.Fatalf("kdfRK = %x %x", rk, ck)
+	}
+	next, mk := kdfCK(bytes.Repeat([]byte{3}, 32))
+	if hex.EncodeToString(next) != "cfbf8f5595e5f186a92161efb3ebb946d3aa706c2df70eed5152741bdb1e7bde" ||
+		hex.EncodeToString(mk) != "aa6fa3f949be2b2cc7de5a18e7f65fee5fb78488f588d53196a63e66ad67ad12" {
+		t.Fatalf("kdfCK = %x %x", next, mk)
+	}
+	keys := hkdf(make([]byte, 32), bytes.Repeat([]byte{4}, 32), []byte(messageKeysInfo), 44)
+	if hex.EncodeToString(keys) != "5892e9978fb8d58834df9a4f938f4a151cb720f9136a09125062d51ec3cb2f26"+"607bfc106f9890074b029e75" {
+		t.Fatalf("message keys = %x", keys)
+	}
+}
+
+func TestX3DHSessionVector(t *testing.T) {
+	rng := newTestRand("lanchat-e2ee-vector")
+	aliceID, _ := GenerateIdentityKeyPair(rng)
+	bobID, _ := GenerateIdentityKeyPair(rng)
+	spk, _ := GenerateSignedPreKey(rng, bobID, 1)
+	opks, _ := GenerateOneTimePreKeys(rng, 100, 1)
+
+	for name, got := range map[string][]byte{
+		"c38eceb1591f5411267c61f52fff2d2ac99a2fb1eb0b787ccdc117e2c279915e": aliceID.DH.Public,
+		"a51cac81dc78b10fdc652c359d5863245c6e225f6cc724415bae8497bfa1f44e": bobID.DH.Public,
+		"af24a5dc988c4a9dee74a327dee699d9627d79ca6d7a35246b31fd3ee461d02a": spk.KeyPair.Public,
+		"ffe63807e8fc41db89e2a79e06456021b5719995879cf2d1507a732d58e1833e": opks[0].KeyPair.Public,
+	} {
+		if hex.EncodeToString(got) != name {
+			t.Fatalf("key = %x, want %s", got, name)
+		}
+	}
+
+	bundle := NewPreKeyBundle(bobID.Public(), spk, opks[0])
+	alice := &DoubleRatchetHandler{Identity: aliceID, Rand: rng}
+	session, err := alice.InitiateSession("bob", bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(session.BaseKey) != "ece59513978fb8c3a0912d9bfd7812d5cf9a9172137fb77929d6f3182f3b2032" ||
+		hex.EncodeToString(session.SendingRatchet.Public) != "34aeba3ee3bd73664cf8649b0de9a4943192788a6b432ffab3efab7b7a093c5c" ||
+		hex.EncodeToString(session.RootKey) != "cc3d447f5fe0fb5e91c5c98fade73e3935edb508389f84457eda4741f4bf61d5" ||
+		hex.EncodeToString(session.SendingChainKey) != "f5905ffec20668079492bd4ef6d241acb6f8266c7c6282bd499795065cf2e03f" {
+		t.Fatalf("unexpected initiator state %+v", session)
+	}
+
+	ct, err := alice.EncryptMessage(session, []byte("hello bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := parsePreKeyMessage(ct)
+	if err != nil || !m.identity.Equal(aliceID.Public()) || m.signedPreKeyID != 1 || m.oneTimePreKeyID != 100 {
+		t.Fatalf("unexpected prekey message %+v (%v)", m, err)
+	}
+	inner, err := parseRatchetMessage(m.inner)
+	if err != nil || inner.header.N != 0 || inner.header.Previous != 0 {
+		t.Fatalf("unexpected ratchet header %+v (%v)", inner, err)
+	}
+
+	// Open the first message with the reference message key and AD.
+	mk := unhex(t, "b8227647476ed785c1f98d8bdda8085f24127db25600fdd1898164cb22f57113")
+	gcm, nonce, _ := messageCipher(mk)
+	if hex.EncodeToString(nonce) != "a60906afda1af0d3ccd124c5" {
+		t.Fatalf("nonce = %x", nonce)
+	}
+	ad := append(append(aliceID.Public().Bytes(), bobID.Public().Bytes()...), inner.headerData...)
+	pt, err := gcm.Open(nil, nonce, inner.ciphertext, ad)
+	if err != nil || string(pt) != "hello bob" {
+		t.Fatalf("reference decryption failed: %q %v", pt, err)
+	}
+
+	// And the responder derives the same secret from its private keys.
+	bob := NewDoubleRatchetHandler(bobID, NewMemoryPreKeyStore([]*SignedPreKey{spk}, opks))
+	var bobSession RatchetSession
+	if pt, err := bob.DecryptMessage(&bobSession, ct); err != nil || string(pt) != "hello bob" {
+		t.Fatalf("bob decrypt: %q %v", pt, err)
+	}
+}
@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Safety numbers let two users check, by comparing digits in person or
+// over another channel, that the server handed them each other's real
+// identity keys. A user's fingerprint covers the identity keys of all of
+// their devices, so adding, replacing or removing a device changes it.
+//
+// The derivation follows Signal's numeric fingerprint: the keys (sorted and
+// concatenated) and the stable user ID are hashed with SHA-512,
+// FingerprintIterations times, and the first 30 bytes are read as six
+// 40-bit big-endian numbers, each reduced mod 100000 to five digits.
+
+const (
+	FingerprintIterations = 5200
+	fingerprintVersion    = 0
+	fingerprintDigits     = 30
+)
+
+// Fingerprint returns the 30-digit fingerprint of a user's identity keys.
+func Fingerprint(userID string, keys ...IdentityKey) string {
+	encoded := make([][]byte, len(keys))
+	for i, k := range keys {
+		encoded[i] = k.Bytes()
+	}
+	slices.SortFunc(encoded, bytes.Compare)
+	material := bytes.Join(encoded, nil)
+
+	h := sha512.New()
+	h.Write(binary.BigEndian.AppendUint16(nil, fingerprintVersion))
+	h.Write(material)
+	h.Write([]byte(userID))
+	hash := h.Sum(nil)
+	for i := 0; i < FingerprintIterations; i++ {
+		h.Reset()
+		h.Write(hash)
+		h.Write(material)
+		hash = h.Sum(hash[:0])
+	}
+
+	var b strings.Builder
+	for i := 0; i < fingerprintDigits/5; i++ {
+		chunk := hash[i*5 : i*5+5]
+		n := uint64(chunk[0])<<32 | uint64(binary.BigEndian.Uint32(chunk[1:]))
+		fmt.Fprintf(&b, "%05d", n%100000)
+	}
+	return b.String()
+}
+
+// SafetyNumber returns the 60-digit number two users compare. Both sides
+// compute the same value: the two fingerprints in ascending order.
+func SafetyNumber(localID string, localKeys []IdentityKey, remoteID string, remoteKeys []IdentityKey) string {
+	local, remote := Fingerprint(localID, localKeys...), Fingerprint(remoteID, remoteKeys...)
+	if remote < local {
+		local, remote = remote, local
+	}
+	return local + remote
+}
+
+// FormatSafetyNumber splits a safety number into groups of five digits.
+func FormatSafetyNumber(number string) string {
+	var groups []string
+	for len(number) > 5 {
+		groups = append(groups, number[:5])
+		number = number[5:]
+	}
+	return strings.Join(append(groups, number), " ")
+}
@@ -0,0 +1,50 @@
+package protocol
+
+import "testing"
+
+// The expected digits were computed with an independent reference
+// implementation of the derivation.
+func TestSafetyNumberVector(t *testing.T) {
+	rng := newTestRand("safety-number-vector")
+	a1, _ := GenerateIdentityKeyPair(rng)
+	a2, _ := GenerateIdentityKeyPair(rng)
+	b, _ := GenerateIdentityKeyPair(rng)
+
+	if got := Fingerprint("u-alice", a1.Public(), a2.Public()); got != "119710758516510707402029836819" {
+		t.Fatalf("alice fingerprint = %s", got)
+	}
+	if got := Fingerprint("u-bob", b.Public()); got != "346118101864252735791513976276" {
+		t.Fatalf("bob fingerprint = %s", got)
+	}
+
+	alice := SafetyNumber("u-alice", []IdentityKey{a2.Public(), a1.Public()}, "u-bob", []IdentityKey{b.Public()})
+	bob := SafetyNumber("u-bob", []IdentityKey{b.Public()}, "u-alice", []IdentityKey{a1.Public(), a2.Public()})
+	if alice != bob || alice != "119710758516510707402029836819346118101864252735791513976276" {
+		t.Fatalf("safety numbers differ: %s vs %s", alice, bob)
+	}
+	if got := FormatSafetyNumber(alice); got != "11971 07585 16510 70740 20298 36819 34611 81018 64252 73579 15139 76276" {
+		t.Fatalf("formatted = %q", got)
+	}
+}
+
+func TestSafetyNumberChangesWithKeys(t *testing.T) {
+	rng := newTestRand("safety-number-change")
+	a, _ := GenerateIdentityKeyPair(rng)
+	b, _ := GenerateIdentityKeyPair(rng)
+	replaced, _ := GenerateIdentityKeyPair(rng)
+	extra, _ := GenerateIdentityKeyPair(rng)
+
+	base := SafetyNumber("u-alice", []IdentityKey{a.Public()}, "u-bob", []IdentityKey{b.Public()})
+	for name, n := range map[string]string{
+		"replaced key": SafetyNumber("u-alice", []IdentityKey{a.Public()}, "u-bob", []IdentityKey{replaced.Public()}),
+		"added device": SafetyNumber("u-alice", []IdentityKey{a.Public()}, "u-bob", []IdentityKey{b.Public(), extra.Public()}),
+		"other user":   SafetyNumber("u-alice", []IdentityKey{a.Public()}, "u-carol", []IdentityKey{b.Public()}),
+	} {
+		if n == base {
+			t.Fatalf("%s: safety number did not change", name)
+		}
+		if len(n) != 60 {
+			t.Fatalf("%s: unexpected length %d", name, len(n))
+		}
+	}
+}
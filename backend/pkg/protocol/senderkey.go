@@ -0,0 +1,386 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Sender keys encrypt a channel message once for every member. Each device
+// keeps its own chain per channel and hands it to the other members in a
+// SenderKeyDistribution over their pairwise Double Ratchet sessions; a
+// sender key message is then
+//
+//	version || type || key ID || iteration || AES-GCM ciphertext || signature
+//
+// where the Ed25519 signature covers everything before it, so members
+// holding the chain key still cannot forge messages from the sender. Chains
+// only move forward: a member given a key cannot read what was sent before.
+// Keys are replaced whenever the channel's membership changes, so removed
+// members cannot read later messages and new members cannot read earlier
+// ones.
+
+const (
+	senderKeyInfo = "LanChat SenderKey"
+
+	messageTypeSenderKey             byte = 3
+	messageTypeSenderKeyDistribution byte = 4
+	senderKeyHeaderSize                   = 2 + 4 + 4
+	senderKeyDistributionSize             = 2 + 4 + 4 + KeySize + ed25519.PublicKeySize + 2
+
+	// MaxSenderKeyStates is how many keys are kept per sender, so messages
+	// sent just before a rotation still decrypt.
+	MaxSenderKeyStates = 5
+)
+
+var (
+	// ErrUnknownSenderKey means no distribution from the sender (or for
+	// this key) was processed; the sender has to distribute it again.
+	ErrUnknownSenderKey = errors.New("e2ee: unknown sender key")
+	ErrDuplicateMessage = errors.New("e2ee: message already decrypted")
+	ErrWrongChannel     = errors.New("e2ee: sender key belongs to another channel")
+)
+
+// SenderKeyDistribution carries a sender's chain to another member. It is
+// secret: send it only inside pairwise sessions.
+type SenderKeyDistribution struct {
+	ChannelID  string
+	KeyID      uint32
+	Iteration  uint32
+	ChainKey   []byte
+	SigningKey ed25519.PublicKey
+}
+
+// MarshalBinary encodes d as version || type || key ID || iteration ||
+// chain key || signing key || channel ID length || channel ID.
+func (d *SenderKeyDistribution) MarshalBinary() ([]byte, error) {
+	if len(d.ChainKey) != KeySize || len(d.SigningKey) != ed25519.PublicKeySize || len(d.ChannelID) > 0xffff {
+		return nil, ErrInvalidKey
+	}
+	out := append(make([]byte, 0, senderKeyDistributionSize+len(d.ChannelID)), e2eeVersion, messageTypeSenderKeyDistribution)
+	out = binary.BigEndian.AppendUint32(out, d.KeyID)
+	out = binary.BigEndian.AppendUint32(out, d.Iteration)
+	out = append(out, d.ChainKey...)
+	out = append(out, d.SigningKey...)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(d.ChannelID)))
+	return append(out, d.ChannelID...), nil
+}
+
+// UnmarshalBinary decodes a distribution written by MarshalBinary.
+func (d *SenderKeyDistribution) UnmarshalBinary(data []byte) error {
+	if !IsSenderKeyDistribution(data) || len(data) < senderKeyDistributionSize {
+		return ErrMalformedMessage
+	}
+	n := int(binary.BigEndian.Uint16(data[senderKeyDistributionSize-2:]))
+	if len(data) != senderKeyDistributionSize+n {
+		return ErrMalformedMessage
+	}
+	p := data[2:]
+	*d = SenderKeyDistribution{
+		KeyID:      binary.BigEndian.Uint32(p),
+		Iteration:  binary.BigEndian.Uint32(p[4:]),
+		ChainKey:   append([]byte(nil), p[8:8+KeySize]...),
+		SigningKey: append(ed25519.PublicKey(nil), p[8+KeySize:8+KeySize+ed25519.PublicKeySize]...),
+		ChannelID:  string(data[senderKeyDistributionSize:]),
+	}
+	return nil
+}
+
+// IsSenderKeyDistribution reports whether a decrypted pairwise message is a
+// SenderKeyDistribution rather than application data.
+func IsSenderKeyDistribution(plaintext []byte) bool {
+	return len(plaintext) >= 2 && plaintext[0] == e2eeVersion && plaintext[1] == messageTypeSenderKeyDistribution
+}
+
+// IsSenderKeyMessage reports whether ciphertext is a sender key message.
+func IsSenderKeyMessage(ciphertext []byte) bool {
+	return len(ciphertext) >= 2 && ciphertext[0] == e2eeVersion && ciphertext[1] == messageTypeSenderKey
+}
+
+// SenderKeyState is one sender chain. SigningPrivate is only set for the
+// local device's own key.
+type SenderKeyState struct {
+	KeyID          uint32             `json:"key_id"`
+	Iteration      uint32             `json:"iteration"` // index of the next message key
+	ChainKey       []byte             `json:"chain_key"`
+	SigningKey     []byte             `json:"signing_key"`
+	SigningPrivate []byte             `json:"signing_private,omitempty"`
+	Skipped        []SkippedSenderKey `json:"skipped,omitempty"`
+}
+
+// SkippedSenderKey is the key of a sender key message that has not arrived
+// yet.
+type SkippedSenderKey struct {
+	Iteration  uint32 `json:"iteration"`
+	MessageKey []byte `json:"message_key"`
+}
+
+func (s *SenderKeyState) clone() *SenderKeyState {
+	c := *s
+	c.ChainKey = append([]byte(nil), s.ChainKey...)
+	c.Skipped = append([]SkippedSenderKey(nil), s.Skipped...)
+	return &c
+}
+
+// GroupSender is the chains received from one device of a member, newest
+// first.
+type GroupSender struct {
+	Member string            `json:"member"`
+	Device string            `json:"device,omitempty"`
+	States []*SenderKeyState `json:"states"`
+}
+
+// GroupSession is a device's sender key state for one channel. Like
+// RatchetSession it is plain data persisted with MarshalBinary, and must not
+// be used concurrently.
+type GroupSession struct {
+	Version   int    `json:"version"`
+	ChannelID string `json:"channel_id"`
+	// Own is this device's sending chain; nil until UpdateMembers runs.
+	Own *SenderKeyState `json:"own,omitempty"`
+	// Members (sorted) is the membership Own was created for.
+	Members []string       `json:"members"`
+	Senders []*GroupSender `json:"senders,omitempty"`
+}
+
+const groupSessionVersion = 1
+
+// NewGroupSession returns an empty session for channelID.
+func NewGroupSession(channelID string) *GroupSession {
+	return &GroupSession{Version: groupSessionVersion, ChannelID: channelID}
+}
+
+// MarshalBinary serialises the session.
+func (g *GroupSession) MarshalBinary() ([]byte, error) {
+	return json.Marshal(g)
+}
+
+// UnmarshalBinary restores a session written by MarshalBinary.
+func (g *GroupSession) UnmarshalBinary(data []byte) error {
+	var out GroupSession
+	if err := json.Unmarshal(data, &out); err != nil {
+		return err
+	}
+	if out.Version != groupSessionVersion {
+		return fmt.Errorf("e2ee: unsupported group session version %d", out.Version)
+	}
+	*g = out
+	return nil
+}
+
+// UpdateMembers records the channel's current members (user IDs) and, when
+// they differ from the membership the own key was created for, replaces
+// the own key and forgets keys received from removed members. It returns
+// the distribution to send to every member's devices over pairwise
+// sessions, or nil when nothing changed.
+func (g *GroupSession) UpdateMembers(rand io.Reader, members []string) (*SenderKeyDistribution, error) {
+	sorted := slices.Clone(members)
+	slices.Sort(sorted)
+	sorted = slices.Compact(sorted)
+	if g.Own != nil && slices.Equal(sorted, g.Members) {
+		return nil, nil
+	}
+	dist, err := g.Rotate(rand)
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]bool, len(sorted))
+	for _, m := range sorted {
+		current[m] = true
+	}
+	kept := g.Senders[:0]
+	for _, s := range g.Senders {
+		if current[s.Member] {
+			kept = append(kept, s)
+		}
+	}
+	g.Senders = kept
+	g.Members = sorted
+	return dist, nil
+}
+
+// Rotate replaces the own key, e.g. when it may have leaked, and returns
+// its distribution.
+func (g *GroupSession) Rotate(rand io.Reader) (*SenderKeyDistribution, error) {
+	var buf [4 + KeySize]byte
+	if _, err := io.ReadFull(rand, buf[:]); err != nil {
+		return nil, err
+	}
+	pub, priv, err := ed25519.GenerateKey(rand)
+	if err != nil {
+		return nil, err
+	}
+	keyID := binary.BigEndian.Uint32(buf[:4])
+	if g.Own != nil && keyID == g.Own.KeyID {
+		keyID++
+	}
+	g.Own = &SenderKeyState{
+		KeyID:          keyID,
+		ChainKey:       append([]byte(nil), buf[4:]...),
+		SigningKey:     pub,
+		SigningPrivate: priv,
+	}
+	return g.Distribution(), nil
+}
+
+// Distribution returns the own key at its current iteration, for members
+// who lost it. It is nil before the first UpdateMembers.
+func (g *GroupSession) Distribution() *SenderKeyDistribution {
+	if g.Own == nil {
+		return nil
+	}
+	return &SenderKeyDistribution{
+		ChannelID:  g.ChannelID,
+		KeyID:      g.Own.KeyID,
+		Iteration:  g.Own.Iteration,
+		ChainKey:   append([]byte(nil), g.Own.ChainKey...),
+		SigningKey: append(ed25519.PublicKey(nil), g.Own.SigningKey...),
+	}
+}
+
+// ProcessDistribution stores a key received from device of member. A key
+// that is already known is ignored, so a replayed distribution cannot move
+// a chain back.
+func (g *GroupSession) ProcessDistribution(member, device string, d *SenderKeyDistribution) error {
+	if d.ChannelID != g.ChannelID {
+		return ErrWrongChannel
+	}
+	if len(d.ChainKey) != KeySize || len(d.SigningKey) != ed25519.PublicKeySize {
+		return ErrInvalidKey
+	}
+	sender := g.sender(member, device)
+	if sender == nil {
+		sender = &GroupSender{Member: member, Device: device}
+		g.Senders = append(g.Senders, sender)
+	}
+	for _, s := range sender.States {
+		if s.KeyID == d.KeyID {
+			return nil
+		}
+	}
+	state := &SenderKeyState{
+		KeyID:      d.KeyID,
+		Iteration:  d.Iteration,
+		ChainKey:   append([]byte(nil), d.ChainKey...),
+		SigningKey: append([]byte(nil), d.SigningKey...),
+	}
+	sender.States = append([]*SenderKeyState{state}, sender.States...)
+	if len(sender.States) > MaxSenderKeyStates {
+		sender.States = sender.States[:MaxSenderKeyStates]
+	}
+	return nil
+}
+
+func (g *GroupSession) sender(member, device string) *GroupSender {
+	for _, s := range g.Senders {
+		if s.Member == member && s.Device == device {
+			return s
+		}
+	}
+	return nil
+}
+
+// Encrypt encrypts plaintext with the own key and advances it.
+func (g *GroupSession) Encrypt(plaintext []byte) ([]byte, error) {
+	if g.Own == nil {
+		return nil, ErrSessionNotReady
+	}
+	next, mk := kdfCK(g.Own.ChainKey)
+	header := append(make([]byte, 0, senderKeyHeaderSize), e2eeVersion, messageTypeSenderKey)
+	header = binary.BigEndian.AppendUint32(header, g.Own.KeyID)
+	header = binary.BigEndian.AppendUint32(header, g.Own.Iteration)
+	gcm, nonce, err := expandCipher(mk, senderKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	out := gcm.Seal(header, nonce, plaintext, g.associatedData(header))
+	out = append(out, ed25519.Sign(ed25519.PrivateKey(g.Own.SigningPrivate), out)...)
+	g.Own.ChainKey = next
+	g.Own.Iteration++
+	return out, nil
+}
+
+// Decrypt opens a message from device of member. Messages may arrive out
+// of order; each decrypts once. On error the session is unchanged.
+func (g *GroupSession) Decrypt(member, device string, ciphertext []byte) ([]byte, error) {
+	if !IsSenderKeyMessage(ciphertext) || len(ciphertext) < senderKeyHeaderSize+gcmTagSize+ed25519.SignatureSize {
+		return nil, ErrMalformedMessage
+	}
+	keyID := binary.BigEndian.Uint32(ciphertext[2:])
+	iteration := binary.BigEndian.Uint32(ciphertext[6:])
+	sender := g.sender(member, device)
+	if sender == nil {
+		return nil, ErrUnknownSenderKey
+	}
+	idx := -1
+	for i, s := range sender.States {
+		if s.KeyID == keyID {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return nil, ErrUnknownSenderKey
+	}
+	signed := ciphertext[:len(ciphertext)-ed25519.SignatureSize]
+	if !ed25519.Verify(sender.States[idx].SigningKey, signed, ciphertext[len(signed):]) {
+		return nil, ErrDecryptFailed
+	}
+
+	state := sender.States[idx].clone()
+	mk, err := state.messageKey(iteration)
+	if err != nil {
+		return nil, err
+	}
+	gcm, nonce, err := expandCipher(mk, senderKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	header := signed[:senderKeyHeaderSize]
+	pt, err := gcm.Open(nil, nonce, signed[senderKeyHeaderSize:], g.associatedData(header))
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	sender.States[idx] = state
+	return pt, nil
+}
+
+// associatedData binds messages to the channel.
+func (g *GroupSession) associatedData(header []byte) []byte {
+	return append([]byte(g.ChannelID), header...)
+}
+
+// messageKey returns the key for iteration, taking it from the skipped
+// keys or advancing the chain and keeping the keys passed over.
+func (s *SenderKeyState) messageKey(iteration uint32) ([]byte, error) {
+	if iteration < s.Iteration {
+		for i, k := range s.Skipped {
+			if k.Iteration == iteration {
+				s.Skipped = append(s.Skipped[:i:i], s.Skipped[i+1:]...)
+				return k.MessageKey, nil
+			}
+		}
+		return nil, ErrDuplicateMessage
+	}
+	if iteration-s.Iteration > MaxSkip {
+		return nil, ErrTooManySkipped
+	}
+	for s.Iteration < iteration {
+		next, mk := kdfCK(s.ChainKey)
+		s.Skipped = append(s.Skipped, SkippedSenderKey{Iteration: s.Iteration, MessageKey: mk})
+		s.ChainKey = next
+		s.Iteration++
+	}
+	if extra := len(s.Skipped) - MaxSkippedKeys; extra > 0 {
+		s.Skipped = append([]SkippedSenderKey(nil), s.Skipped[extra:]...)
+	}
+	next, mk := kdfCK(s.ChainKey)
+	s.ChainKey = next
+	s.Iteration++
+	return mk, nil
+}
@@ -0,0 +1,283 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// testGroup is one device per member with pairwise sessions between them.
+type testGroup struct {
+	t        *testing.T
+	rng      *testRand
+	sessions map[string]*GroupSession
+	pairs    map[[2]string]*RatchetSession // (from, to)
+	handlers map[string]*DoubleRatchetHandler
+}
+
+func newTestGroup(t *testing.T, members ...string) *testGroup {
+	t.Helper()
+	g := &testGroup{
+		t:        t,
+		rng:      newTestRand("sender-keys"),
+		sessions: map[string]*GroupSession{},
+		pairs:    map[[2]string]*RatchetSession{},
+		handlers: map[string]*DoubleRatchetHandler{},
+	}
+	for _, m := range members {
+		g.join(m)
+	}
+	return g
+}
+
+// join creates m's device and pairwise sessions with every existing device.
+func (g *testGroup) join(m string) {
+	g.t.Helper()
+	id, _ := GenerateIdentityKeyPair(g.rng)
+	spk, _ := GenerateSignedPreKey(g.rng, id, 1)
+	opks, _ := GenerateOneTimePreKeys(g.rng, 1, 10)
+	g.handlers[m] = &DoubleRatchetHandler{Identity: id, PreKeys: NewMemoryPreKeyStore([]*SignedPreKey{spk}, opks), Rand: g.rng}
+	g.sessions[m] = NewGroupSession("priv-1")
+	for other, h := range g.handlers {
+		if other == m {
+			continue
+		}
+		spk, _ := GenerateSignedPreKey(g.rng, h.Identity, 2)
+		h.PreKeys.(*MemoryPreKeyStore).SignedPreKeys[2] = spk
+		s, err := g.handlers[m].InitiateSession(other, NewPreKeyBundle(h.Identity.Public(), spk, nil))
+		if err != nil {
+			g.t.Fatal(err)
+		}
+		g.pairs[[2]string{m, other}] = s
+		g.pairs[[2]string{other, m}] = &RatchetSession{RatchetID: m}
+		// The responder can send once the first message arrives.
+		ct, _ := g.handlers[m].EncryptMessage(s, []byte("hello"))
+		if _, err := h.DecryptMessage(g.pairs[[2]string{other, m}], ct); err != nil {
+			g.t.Fatal(err)
+		}
+	}
+}
+
+// update applies a membership change on every member's device and delivers
+// the resulting distributions over the pairwise sessions.
+func (g *testGroup) update(members ...string) {
+	g.t.Helper()
+	for _, from := range members {
+		dist, err := g.sessions[from].UpdateMembers(g.rng, members)
+		if err != nil {
+			g.t.Fatal(err)
+		}
+		if dist != nil {
+			g.distribute(from, dist, members)
+		}
+	}
+}
+
+func (g *testGroup) distribute(from string, dist *SenderKeyDistribution, members []string) {
+	g.t.Helper()
+	data, err := dist.MarshalBinary()
+	if err != nil {
+		g.t.Fatal(err)
+	}
+	for _, to := range members {
+		if to == from {
+			continue
+		}
+		ct, err := g.handlers[from].EncryptMessage(g.pairs[[2]string{from, to}], data)
+		if err != nil {
+			g.t.Fatal(err)
+		}
+		pt, err := g.handlers[to].DecryptMessage(g.pairs[[2]string{to, from}], ct)
+		if err != nil {
+			g.t.Fatal(err)
+		}
+		if !IsSenderKeyDistribution(pt) {
+			g.t.Fatalf("expected a distribution, got %x", pt)
+		}
+		var got SenderKeyDistribution
+		if err := got.UnmarshalBinary(pt); err != nil {
+			g.t.Fatal(err)
+		}
+		if err := g.sessions[to].ProcessDistribution(from, "", &got); err != nil {
+			g.t.Fatal(err)
+		}
+	}
+}
+
+func (g *testGroup) send(from, text string) []byte {
+	g.t.Helper()
+	ct, err := g.sessions[from].Encrypt([]byte(text))
+	if err != nil {
+		g.t.Fatal(err)
+	}
+	if !IsSenderKeyMessage(ct) {
+		g.t.Fatalf("not a sender key message: %x", ct)
+	}
+	return ct
+}
+
+func (g *testGroup) expect(to, from string, ct []byte, text string) {
+	g.t.Helper()
+	pt, err := g.sessions[to].Decrypt(from, "", ct)
+	if err != nil || string(pt) != text {
+		g.t.Fatalf("%s decrypting from %s: %q %v", to, from, pt, err)
+	}
+}
+
+func TestSenderKeyRoundTrip(t *testing.T) {
+	g := newTestGroup(t, "alice", "bob", "carol")
+	g.update("alice", "bob", "carol")
+
+	for i, from := range []string{"alice", "bob", "carol", "alice"} {
+		text := from + " says hi " + string(rune('0'+i))
+		ct := g.send(from, text)
+		for _, to := range []string{"alice", "bob", "carol"} {
+			if to != from {
+				g.expect(to, from, ct, text)
+			}
+		}
+	}
+
+	// Unchanged membership keeps the key.
+	if dist, err := g.sessions["alice"].UpdateMembers(g.rng, []string{"carol", "bob", "alice", "bob"}); dist != nil || err != nil {
+		t.Fatalf("expected no rotation for the same members, got %v %v", dist, err)
+	}
+}
+
+func TestSenderKeyOutOfOrderAndReplay(t *testing.T) {
+	g := newTestGroup(t, "alice", "bob")
+	g.update("alice", "bob")
+
+	var cts [][]byte
+	for i := 0; i < 50; i++ {
+		cts = append(cts, g.send("alice", string(rune('a'+i%26))))
+	}
+	order := rand.New(rand.NewSource(7)).Perm(len(cts))
+	for _, i := range order {
+		g.expect("bob", "alice", cts[i], string(rune('a'+i%26)))
+	}
+	if _, err := g.sessions["bob"].Decrypt("alice", "", cts[3]); !errors.Is(err, ErrDuplicateMessage) {
+		t.Fatalf("expected replay to fail, got %v", err)
+	}
+
+	// Skipping beyond MaxSkip is rejected without changing the chain.
+	for i := 0; i <= MaxSkip; i++ {
+		g.send("alice", "x")
+	}
+	far := g.send("alice", "far")
+	if _, err := g.sessions["bob"].Decrypt("alice", "", far); !errors.Is(err, ErrTooManySkipped) {
+		t.Fatalf("expected too many skipped, got %v", err)
+	}
+}
+
+func TestSenderKeyRejectsTamperingAndForgery(t *testing.T) {
+	g := newTestGroup(t, "alice", "bob", "carol")
+	g.update("alice", "bob", "carol")
+	ct := g.send("alice", "pay carol 5")
+
+	for _, i := range []int{3, senderKeyHeaderSize + 1, len(ct) - 1} {
+		bad := bytes.Clone(ct)
+		bad[i] ^= 1
+		if _, err := g.sessions["bob"].Decrypt("alice", "", bad); err == nil {
+			t.Fatalf("tampered byte %d accepted", i)
+		}
+	}
+
+	// Carol holds alice's chain key but not her signing key: re-encrypting
+	// with the chain and re-signing with her own key must not pass as alice.
+	stolen := g.sessions["carol"].sender("alice", "").States[0].clone()
+	forger := &GroupSession{ChannelID: "priv-1", Own: stolen}
+	forger.Own.SigningPrivate = g.sessions["carol"].Own.SigningPrivate
+	forged, err := forger.Encrypt([]byte("pay carol 500"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.sessions["bob"].Decrypt("alice", "", forged); !errors.Is(err, ErrDecryptFailed) {
+		t.Fatalf("expected forged message to fail, got %v", err)
+	}
+	g.expect("bob", "alice", ct, "pay carol 5")
+
+	// A message for another channel does not decrypt here.
+	other := NewGroupSession("priv-2")
+	other.Own = g.sessions["alice"].Own.clone()
+	other.Own.SigningPrivate = g.sessions["alice"].Own.SigningPrivate
+	cross, _ := other.Encrypt([]byte("wrong room"))
+	if _, err := g.sessions["bob"].Decrypt("alice", "", cross); err == nil {
+		t.Fatalf("message bound to another channel accepted")
+	}
+	if err := g.sessions["bob"].ProcessDistribution("alice", "", other.Distribution()); !errors.Is(err, ErrWrongChannel) {
+		t.Fatalf("expected distribution for another channel to be rejected, got %v", err)
+	}
+}
+
+func TestSenderKeyRotatesOnMembershipChange(t *testing.T) {
+	g := newTestGroup(t, "alice", "bob", "carol")
+	g.update("alice", "bob", "carol")
+	before := g.send("alice", "before")
+	oldKey := g.sessions["alice"].Own.KeyID
+
+	// Carol is removed: everyone rotates and she gets no new keys.
+	g.update("alice", "bob")
+	if g.sessions["alice"].Own.KeyID == oldKey {
+		t.Fatalf("expected a new key after removal")
+	}
+	if g.sessions["bob"].sender("carol", "") != nil {
+		t.Fatalf("expected keys from the removed member to be dropped")
+	}
+	after := g.send("alice", "after")
+	g.expect("bob", "alice", after, "after")
+	if _, err := g.sessions["carol"].Decrypt("alice", "", after); !errors.Is(err, ErrUnknownSenderKey) {
+		t.Fatalf("removed member decrypted a new message: %v", err)
+	}
+	// Messages sent before the rotation still decrypt for remaining members.
+	g.expect("bob", "alice", before, "before")
+
+	// Dave joins: he can read from now on, but not what was sent before.
+	g.join("dave")
+	g.update("alice", "bob", "dave")
+	welcome := g.send("bob", "welcome dave")
+	g.expect("dave", "bob", welcome, "welcome dave")
+	g.expect("alice", "bob", welcome, "welcome dave")
+	if _, err := g.sessions["dave"].Decrypt("alice", "", after); !errors.Is(err, ErrUnknownSenderKey) {
+		t.Fatalf("new member decrypted an earlier message: %v", err)
+	}
+}
+
+func TestGroupSessionSerialisation(t *testing.T) {
+	g := newTestGroup(t, "alice", "bob")
+	g.update("alice", "bob")
+	g.expect("bob", "alice", g.send("alice", "one"), "one")
+	skipped := g.send("alice", "two")
+
+	data, err := g.sessions["bob"].MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored GroupSession
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	g.sessions["bob"] = &restored
+	g.expect("bob", "alice", g.send("alice", "three"), "three")
+	g.expect("bob", "alice", skipped, "two")
+
+	data, _ = g.sessions["alice"].MarshalBinary()
+	var alice GroupSession
+	if err := alice.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	ct, err := alice.Encrypt([]byte("four"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.expect("bob", "alice", ct, "four")
+
+	var d SenderKeyDistribution
+	if err := d.UnmarshalBinary([]byte{e2eeVersion, messageTypeSenderKeyDistribution, 0}); !errors.Is(err, ErrMalformedMessage) {
+		t.Fatalf("expected malformed distribution error, got %v", err)
+	}
+	if _, err := NewGroupSession("priv-1").Encrypt([]byte("x")); !errors.Is(err, ErrSessionNotReady) {
+		t.Fatalf("expected encrypt before UpdateMembers to fail, got %v", err)
+	}
+}
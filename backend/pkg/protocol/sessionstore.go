@@ -0,0 +1,427 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// SessionStore persists ratchet sessions by the caller's ID for the remote
+// device. Every ratchet step must be stored before its result is used:
+// a ciphertext sent from state that was never saved makes the next run
+// reuse its message key, and a plaintext shown from state that was never
+// saved desyncs the receiving chain. UpdateSession makes that one step.
+type SessionStore interface {
+	// LoadSession returns the session stored under id, or
+	// ErrSessionNotFound.
+	LoadSession(id string) (*RatchetSession, error)
+	// UpdateSession calls fn with the stored session (a zero session with
+	// RatchetID id if there is none) and, if fn succeeds, replaces the
+	// stored state with the result in one atomic write. If fn fails or the
+	// write fails, the stored session is unchanged.
+	UpdateSession(id string, fn func(*RatchetSession) error) error
+	DeleteSession(id string) error
+}
+
+var (
+	ErrSessionNotFound = errors.New("e2ee: session not found")
+	ErrStorageKey      = errors.New("e2ee: wrong storage key")
+	ErrSessionCorrupt  = errors.New("e2ee: stored session failed authentication")
+)
+
+var (
+	_ SessionStore = (*MemorySessionStore)(nil)
+	_ SessionStore = (*FileSessionStore)(nil)
+)
+
+// EncryptStored encrypts with the session stored under id and returns the
+// ciphertext only once the advanced session has been saved.
+func (h *DoubleRatchetHandler) EncryptStored(store SessionStore, id string, plaintext []byte) ([]byte, error) {
+	var out []byte
+	err := store.UpdateSession(id, func(s *RatchetSession) error {
+		var err error
+		out, err = h.EncryptMessage(s, plaintext)
+		return err
+	})
+	return out, err
+}
+
+// DecryptStored decrypts with the session stored under id, accepting a new
+// session from a prekey message if there is none. The plaintext is only
+// returned once the advanced session has been saved; if saving fails the
+// same ciphertext can be decrypted again later. The one-time prekey a new
+// session used is removed only after the save, so a failed save does not
+// burn it. If that removal alone fails, the plaintext is returned with the
+// error: the session is saved and the message will not decrypt again.
+func (h *DoubleRatchetHandler) DecryptStored(store SessionStore, id string, ciphertext []byte) ([]byte, error) {
+	var out []byte
+	var used uint32
+	err := store.UpdateSession(id, func(s *RatchetSession) error {
+		var err error
+		out, used, err = h.DecryptKeepingPreKey(s, ciphertext)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if used != 0 {
+		if err := h.PreKeys.RemoveOneTimePreKey(used); err != nil {
+			return out, fmt.Errorf("e2ee: removing used one-time prekey %d: %w", used, err)
+		}
+	}
+	return out, nil
+}
+
+// MemorySessionStore is a SessionStore that keeps serialised sessions in
+// memory, for tests and throwaway clients.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string][]byte
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string][]byte)}
+}
+
+func (m *MemorySessionStore) LoadSession(id string) (*RatchetSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.load(id)
+}
+
+func (m *MemorySessionStore) load(id string) (*RatchetSession, error) {
+	data, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	var s RatchetSession
+	if err := s.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (m *MemorySessionStore) UpdateSession(id string, fn func(*RatchetSession) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, err := m.load(id)
+	if errors.Is(err, ErrSessionNotFound) {
+		s, err = &RatchetSession{RatchetID: id}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := fn(s); err != nil {
+		return err
+	}
+	data, err := s.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	m.sessions[id] = data
+	return nil
+}
+
+func (m *MemorySessionStore) DeleteSession(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+// KeySource supplies the key a FileSessionStore encrypts sessions with. The
+// salt is chosen when the store is created and kept next to the sessions.
+type KeySource interface {
+	StorageKey(salt []byte) ([]byte, error)
+}
+
+// PassphraseIterations is the default PBKDF2-HMAC-SHA256 cost for
+// Passphrase.
+const PassphraseIterations = 600000
+
+// Passphrase derives the storage key from a passphrase the user types.
+type Passphrase struct {
+	Secret     string
+	Iterations int // default PassphraseIterations; must match on every open
+}
+
+func (p Passphrase) StorageKey(salt []byte) ([]byte, error) {
+	if p.Secret == "" {
+		return nil, errors.New("e2ee: empty passphrase")
+	}
+	n := p.Iterations
+	if n <= 0 {
+		n = PassphraseIterations
+	}
+	return pbkdf2SHA256([]byte(p.Secret), salt, n, 32), nil
+}
+
+// KeyringFile stands in for an OS keyring: a random 32-byte secret in a
+// file only the user can read, created on first use. The storage key is
+// derived from it and the store's salt.
+type KeyringFile string
+
+func (k KeyringFile) StorageKey(salt []byte) ([]byte, error) {
+	path := string(k)
+	secret, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(path, secret, 0o600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if len(secret) != 32 {
+		return nil, fmt.Errorf("e2ee: keyring file %s holds %d bytes, want 32", path, len(secret))
+	}
+	return hkdf(salt, secret, []byte("LanChat SessionStore"), 32), nil
+}
+
+// pbkdf2SHA256 is PBKDF2 (RFC 8018) with HMAC-SHA256.
+func pbkdf2SHA256(password, salt []byte, iterations, length int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var out []byte
+	for block := uint32(1); len(out) < length; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:length]
+}
+
+// FileSessionStore keeps one file per session in a directory, each sealed
+// with AES-256-GCM under the storage key and bound to its session ID.
+// Files are replaced by writing a temporary file, syncing it and renaming
+// it over the old one, so a crash leaves either the old or the new state.
+// It is safe for concurrent use within one process.
+//
+// Layout: store.json holds the salt and a key check value; each session is
+// <hex SHA-256 of the ID>.session containing nonce(12) || ciphertext.
+type FileSessionStore struct {
+	dir  string
+	aead cipher.AEAD
+	mu   sync.Mutex
+}
+
+type fileStoreMeta struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Check   []byte `json:"check"` // sealed storeCheckText
+}
+
+const (
+	fileStoreVersion  = 1
+	fileStoreMetaName = "store.json"
+	storeCheckText    = "LanChat session store"
+)
+
+// OpenFileSessionStore opens the store in dir, creating it if needed. A key
+// that does not match the one the store was created with fails with
+// ErrStorageKey.
+func OpenFileSessionStore(dir string, keys KeySource) (*FileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	metaPath := filepath.Join(dir, fileStoreMetaName)
+	var meta fileStoreMeta
+	data, err := os.ReadFile(metaPath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		meta = fileStoreMeta{Version: fileStoreVersion, Salt: make([]byte, 16)}
+		if _, err := rand.Read(meta.Salt); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("e2ee: reading %s: %w", metaPath, err)
+		}
+		if meta.Version != fileStoreVersion {
+			return nil, fmt.Errorf("e2ee: unsupported session store version %d", meta.Version)
+		}
+	}
+
+	key, err := keys.StorageKey(meta.Salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileSessionStore{dir: dir, aead: aead}
+
+	if meta.Check == nil {
+		if meta.Check, err = s.seal([]byte(storeCheckText), fileStoreMetaName); err != nil {
+			return nil, err
+		}
+		data, _ := json.Marshal(meta)
+		if err := writeFileAtomic(metaPath, data, 0o600); err != nil {
+			return nil, err
+		}
+	} else if check, err := s.open(meta.Check, fileStoreMetaName); err != nil || string(check) != storeCheckText {
+		return nil, ErrStorageKey
+	}
+	return s, nil
+}
+
+func (s *FileSessionStore) path(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".session")
+}
+
+func (s *FileSessionStore) seal(plaintext []byte, id string) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(plaintext)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, plaintext, []byte(id)), nil
+}
+
+func (s *FileSessionStore) open(data []byte, id string) ([]byte, error) {
+	n := s.aead.NonceSize()
+	if len(data) < n {
+		return nil, ErrSessionCorrupt
+	}
+	out, err := s.aead.Open(nil, data[:n], data[n:], []byte(id))
+	if err != nil {
+		return nil, ErrSessionCorrupt
+	}
+	return out, nil
+}
+
+func (s *FileSessionStore) LoadSession(id string) (*RatchetSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(id)
+}
+
+func (s *FileSessionStore) load(id string) (*RatchetSession, error) {
+	data, err := os.ReadFile(s.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := s.open(data, id)
+	if err != nil {
+		return nil, err
+	}
+	var out RatchetSession
+	if err := out.UnmarshalBinary(plaintext); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (s *FileSessionStore) UpdateSession(id string, fn func(*RatchetSession) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, err := s.load(id)
+	if errors.Is(err, ErrSessionNotFound) {
+		session, err = &RatchetSession{RatchetID: id}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := fn(session); err != nil {
+		return err
+	}
+	plaintext, err := session.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	sealed, err := s.seal(plaintext, id)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(id), sealed, 0o600)
+}
+
+func (s *FileSessionStore) DeleteSession(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.path(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// writeFileAtomic replaces path with data: the data is written and synced
+// to a temporary file in the same directory, which is then renamed over
+// path and the directory synced.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes a rename or removal in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPBKDF2Vectors(t *testing.T) {
+	// RFC 7914 section 11 and the widely used PBKDF2-HMAC-SHA256 vectors.
+	for _, tc := range []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+	} {
+		got := pbkdf2SHA256([]byte(tc.password), []byte(tc.salt), tc.iterations, len(tc.want)/2)
+		if hex.EncodeToString(got) != tc.want {
+			t.Fatalf("pbkdf2(%q, %d) = %x", tc.password, tc.iterations, got)
+		}
+	}
+}
+
+// testPassphrase keeps the tests fast; real stores use PassphraseIterations.
+var testPassphrase = Passphrase{Secret: "correct horse", Iterations: 1000}
+
+func TestFileSessionStorePersistsAcrossRestarts(t *testing.T) {
+	rng := newTestRand("session-store")
+	alice, bob := newE2EEDevice(t, rng), newE2EEDevice(t, rng)
+	aliceDir, bobDir := t.TempDir(), t.TempDir()
+	bobKeyring := KeyringFile(filepath.Join(t.TempDir(), "keyring"))
+	aliceStore, err := OpenFileSessionStore(aliceDir, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobStore, err := OpenFileSessionStore(bobDir, bobKeyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(string(bobKeyring)); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm()&0o077 != 0 {
+		t.Fatalf("keyring file must be private to the user, got %v", info.Mode())
+	}
+
+	err = aliceStore.UpdateSession("bob/d-1", func(s *RatchetSession) error {
+		started, err := alice.handler.InitiateSession("bob/d-1", bob.bundle(true))
+		if err != nil {
+			return err
+		}
+		*s = *started
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange := func(from *DoubleRatchetHandler, fromStore SessionStore, fromID string, to *DoubleRatchetHandler, toStore SessionStore, toID, text string) {
+		t.Helper()
+		ct, err := from.EncryptStored(fromStore, fromID, []byte(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pt, err := to.DecryptStored(toStore, toID, ct)
+		if err != nil || string(pt) != text {
+			t.Fatalf("decrypt %q: %q %v", text, pt, err)
+		}
+	}
+	exchange(alice.handler, aliceStore, "bob/d-1", bob.handler, bobStore, "alice/d-1", "hello bob")
+	exchange(bob.handler, bobStore, "alice/d-1", alice.handler, aliceStore, "bob/d-1", "hello alice")
+
+	// Nothing secret is readable on disk.
+	session, _ := aliceStore.LoadSession("bob/d-1")
+	files, _ := filepath.Glob(filepath.Join(aliceDir, "*.session"))
+	if len(files) != 1 {
+		t.Fatalf("expected one session file, got %v", files)
+	}
+	raw, _ := os.ReadFile(files[0])
+	if bytes.Contains(raw, session.RootKey) || bytes.Contains(raw, []byte("root_key")) {
+		t.Fatalf("session stored in the clear")
+	}
+
+	// Both sides restart and carry on where they left off.
+	if _, err := OpenFileSessionStore(aliceDir, Passphrase{Secret: "wrong", Iterations: 1000}); !errors.Is(err, ErrStorageKey) {
+		t.Fatalf("expected wrong passphrase to be rejected, got %v", err)
+	}
+	if _, err := OpenFileSessionStore(bobDir, KeyringFile(filepath.Join(t.TempDir(), "other"))); !errors.Is(err, ErrStorageKey) {
+		t.Fatalf("expected another keyring to be rejected, got %v", err)
+	}
+	if aliceStore, err = OpenFileSessionStore(aliceDir, testPassphrase); err != nil {
+		t.Fatal(err)
+	}
+	if bobStore, err = OpenFileSessionStore(bobDir, bobKeyring); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		exchange(alice.handler, aliceStore, "bob/d-1", bob.handler, bobStore, "alice/d-1", "after restart")
+		exchange(bob.handler, bobStore, "alice/d-1", alice.handler, aliceStore, "bob/d-1", "and back")
+	}
+
+	if err := aliceStore.DeleteSession("bob/d-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := aliceStore.LoadSession("bob/d-1"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected deleted session to be gone, got %v", err)
+	}
+}
+
+func TestFileSessionStoreFailedStepsLeaveStateIntact(t *testing.T) {
+	rng := newTestRand("session-store-failures")
+	alice, bob := newE2EEDevice(t, rng), newE2EEDevice(t, rng)
+	dir := t.TempDir()
+	store, err := OpenFileSessionStore(dir, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobSession, _ := bob.handler.InitiateSession("alice", alice.bundle(false))
+	ct, _ := bob.handler.EncryptMessage(bobSession, []byte("first"))
+	if pt, err := alice.handler.DecryptStored(store, "bob", ct); err != nil || string(pt) != "first" {
+		t.Fatalf("accept session: %q %v", pt, err)
+	}
+	path := store.path("bob")
+	before, _ := os.ReadFile(path)
+
+	// A message that fails to decrypt does not touch the stored session.
+	next, _ := bob.handler.EncryptMessage(bobSession, []byte("second"))
+	bad := bytes.Clone(next)
+	bad[len(bad)-1] ^= 1
+	if _, err := alice.handler.DecryptStored(store, "bob", bad); err == nil {
+		t.Fatalf("tampered message accepted")
+	}
+	if err := store.UpdateSession("bob", func(s *RatchetSession) error {
+		s.RootKey = nil
+		return errors.New("step failed")
+	}); err == nil {
+		t.Fatalf("expected the step error")
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+		t.Fatalf("failed steps rewrote the session")
+	}
+
+	// A crash mid-write leaves a temporary file behind and the old state.
+	if err := os.WriteFile(filepath.Join(dir, "."+filepath.Base(path)+".tmp-123"), []byte("partial"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenFileSessionStore(dir, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pt, err := alice.handler.DecryptStored(reopened, "bob", next); err != nil || string(pt) != "second" {
+		t.Fatalf("decrypt after crash: %q %v", pt, err)
+	}
+
+	// Sealed files are bound to their ID and cannot be edited or swapped.
+	if err := reopened.UpdateSession("carol", func(s *RatchetSession) error {
+		*s = *bobSession
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	carol, _ := os.ReadFile(reopened.path("carol"))
+	if err := os.WriteFile(path, carol, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.LoadSession("bob"); !errors.Is(err, ErrSessionCorrupt) {
+		t.Fatalf("expected a swapped file to be rejected, got %v", err)
+	}
+	carol[len(carol)-1] ^= 1
+	_ = os.WriteFile(reopened.path("carol"), carol, 0o600)
+	if _, err := reopened.LoadSession("carol"); !errors.Is(err, ErrSessionCorrupt) {
+		t.Fatalf("expected an edited file to be rejected, got %v", err)
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	rng := newTestRand("memory-session-store")
+	alice, bob := newE2EEDevice(t, rng), newE2EEDevice(t, rng)
+	aliceStore, bobStore := NewMemorySessionStore(), NewMemorySessionStore()
+	_ = aliceStore.UpdateSession("bob", func(s *RatchetSession) error {
+		started, err := alice.handler.InitiateSession("bob", bob.bundle(true))
+		if err != nil {
+			return err
+		}
+		*s = *started
+		return nil
+	})
+	for _, text := range []string{"one", "two"} {
+		ct, err := alice.handler.EncryptStored(aliceStore, "bob", []byte(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pt, err := bob.handler.DecryptStored(bobStore, "alice", ct); err != nil || string(pt) != text {
+			t.Fatalf("decrypt %q: %q %v", text, pt, err)
+		}
+	}
+	if s, err := bobStore.LoadSession("alice"); err != nil || s.ReceiveCount != 2 {
+		t.Fatalf("unexpected stored session %+v %v", s, err)
+	}
+	if _, err := bobStore.LoadSession("nobody"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+// failingStore runs each step but fails to write it.
+type failingStore struct{ SessionStore }
+
+func (f failingStore) UpdateSession(id string, fn func(*RatchetSession) error) error {
+	return f.SessionStore.UpdateSession(id, func(s *RatchetSession) error {
+		if err := fn(s); err != nil {
+			return err
+		}
+		return errors.New("disk full")
+	})
+}
+
+func TestDecryptStoredKeepsPreKeyUntilSaved(t *testing.T) {
+	rng := newTestRand("session-store-prekey")
+	alice, bob := newE2EEDevice(t, rng), newE2EEDevice(t, rng)
+	store := NewMemorySessionStore()
+	session, err := alice.handler.InitiateSession("bob", bob.bundle(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, _ := alice.handler.EncryptMessage(session, []byte("hello"))
+	opk := bob.opks[0].ID
+
+	if _, err := bob.handler.DecryptStored(failingStore{store}, "alice", ct); err == nil {
+		t.Fatal("expected the failed save to be reported")
+	}
+	if _, err := bob.store.OneTimePreKey(opk); err != nil {
+		t.Fatalf("one-time prekey removed although the session was not saved: %v", err)
+	}
+	if pt, err := bob.handler.DecryptStored(store, "alice", ct); err != nil || string(pt) != "hello" {
+		t.Fatalf("retry after the failed save: %q %v", pt, err)
+	}
+	if _, err := bob.store.OneTimePreKey(opk); !errors.Is(err, ErrUnknownPreKey) {
+		t.Fatalf("one-time prekey kept after the session was saved: %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+)
+
+// signingContext prefixes every signed payload so message signatures cannot
+// be confused with signatures made by the same key for other purposes.
+const signingContext = "lan-chat/message/v1"
+
+// SigningPayload is the canonical byte encoding covered by a message
+// signature: the context string followed by the length-prefixed channel ID,
+// content and nonce, then the timestamp, all big-endian.
+func SigningPayload(channelID string, content, nonce []byte, timestamp int64) []byte {
+	buf := make([]byte, 0, len(signingContext)+len(channelID)+len(content)+len(nonce)+4*4+8)
+	for _, field := range [][]byte{[]byte(signingContext), []byte(channelID), content, nonce} {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(field)))
+		buf = append(buf, field...)
+	}
+	return binary.BigEndian.AppendUint64(buf, uint64(timestamp))
+}
+
+// SignMessage signs a send request with a device's Ed25519 key, filling in
+// DeviceID, Timestamp and Signature. The request's ChannelID and Timestamp
+// must already be final; for a DM that is the dm_ channel ID from OpenDM, not
+// the other user's ID.
+func SignMessage(req *SendMessageRequest, deviceID string, key ed25519.PrivateKey) {
+	req.DeviceID = deviceID
+	req.Signature = ed25519.Sign(key, SigningPayload(req.ChannelID, req.Content, req.Nonce, req.Timestamp))
+}
+
+// VerifyMessageSignature checks sig over the canonical payload.
+func VerifyMessageSignature(pub ed25519.PublicKey, channelID string, content, nonce []byte, timestamp int64, sig []byte) bool {
+	if len(pub) != ed25519.PublicKeySize || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(pub, SigningPayload(channelID, content, nonce, timestamp), sig)
+}
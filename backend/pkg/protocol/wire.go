@@ -0,0 +1,368 @@
+package protocol
+
+//go:generate protoc --proto_path=proto --go_out=. --go_opt=module=lan-chat/protocol lanchat/v1/lanchat.proto
+
+import (
+	"encoding/json"
+	"errors"
+
+	"lan-chat/protocol/pb"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// WebSocket subprotocols offered on /ws. Clients that request none get JSON.
+const (
+	SubprotocolJSON     = "lan-chat.v1+json"
+	SubprotocolProtobuf = "lan-chat.v1+proto"
+)
+
+// Subprotocols lists the supported subprotocols in server preference order.
+var Subprotocols = []string{SubprotocolProtobuf, SubprotocolJSON}
+
+var errEmptyEnvelope = errors.New("protocol: envelope has no payload")
+
+// ErrorDetail reports a rejected client request.
+type ErrorDetail struct {
+	Code         string `json:"code"`
+	Message      string `json:"message"`
+	ChannelID    string `json:"channel_id,omitempty"`
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"`
+}
+
+// Envelope is a single /ws frame. Exactly one field is set.
+type Envelope struct {
+	Message *Message
+	Send    *SendMessageRequest
+	Error   *ErrorDetail
+	Hello   *Hello
+	Welcome *Welcome
+	Notice  *Notice
+}
+
+// Notice kinds sent to clients with CapabilityNotices.
+const (
+	// NoticePreKeysLow tells a device owner that few one-time prekeys are
+	// left; Data holds "remaining" and "threshold".
+	NoticePreKeysLow = "prekeys_low"
+	// NoticeChannelMembersChanged is sent to the members of ChannelID,
+	// including removed ones, when its membership changes; Data holds
+	// comma-separated user IDs under "added" and "removed". Members replace
+	// their sender keys for the channel.
+	NoticeChannelMembersChanged = "channel_members_changed"
+	// NoticeDeviceAdded tells a user's devices that DeviceID published its
+	// first identity key, so one of them can send it the history.
+	NoticeDeviceAdded = "device_added"
+	// NoticeDeviceTransfer tells DeviceID that another device of the same
+	// user left it an encrypted transfer; Data holds "transfer_id",
+	// "from_device_id" and "size".
+	NoticeDeviceTransfer = "device_transfer"
+)
+
+// Notice is a server notification that is not a chat message.
+type Notice struct {
+	Kind      string            `json:"kind"`
+	UserID    string            `json:"user_id,omitempty"`
+	DeviceID  string            `json:"device_id,omitempty"`
+	ChannelID string            `json:"channel_id,omitempty"`
+	Data      map[string]string `json:"data,omitempty"`
+	Timestamp int64             `json:"timestamp"`
+}
+
+// Codec encodes /ws frames for one negotiated subprotocol.
+type Codec interface {
+	// Subprotocol is the WebSocket subprotocol name.
+	Subprotocol() string
+	// Binary reports whether frames are sent as binary WebSocket messages.
+	Binary() bool
+	EncodeFrame(env *Envelope) ([]byte, error)
+	DecodeFrame(data []byte) (*Envelope, error)
+}
+
+// CodecFor returns the codec for a negotiated subprotocol, defaulting to
+// JSON for clients that did not ask for one.
+func CodecFor(subprotocol string) Codec {
+	if subprotocol == SubprotocolProtobuf {
+		return ProtobufCodec{}
+	}
+	return JSONCodec{}
+}
+
+// JSONCodec is the original wire format: messages and send requests are
+// bare JSON objects and errors are {"error": {...}}.
+type JSONCodec struct{}
+
+func (JSONCodec) Subprotocol() string { return SubprotocolJSON }
+func (JSONCodec) Binary() bool        { return false }
+
+func (JSONCodec) EncodeFrame(env *Envelope) ([]byte, error) {
+	switch {
+	case env.Message != nil:
+		return json.Marshal(env.Message)
+	case env.Send != nil:
+		return json.Marshal(env.Send)
+	case env.Error != nil:
+		return json.Marshal(struct {
+			Error *ErrorDetail `json:"error"`
+		}{env.Error})
+	case env.Hello != nil:
+		return json.Marshal(struct {
+			Hello *Hello `json:"hello"`
+		}{env.Hello})
+	case env.Welcome != nil:
+		return json.Marshal(struct {
+			Welcome *Welcome `json:"welcome"`
+		}{env.Welcome})
+	case env.Notice != nil:
+		return json.Marshal(struct {
+			Notice *Notice `json:"notice"`
+		}{env.Notice})
+	}
+	return nil, errEmptyEnvelope
+}
+
+func (JSONCodec) DecodeFrame(data []byte) (*Envelope, error) {
+	var probe struct {
+		Error    *ErrorDetail `json:"error"`
+		Hello    *Hello       `json:"hello"`
+		Welcome  *Welcome     `json:"welcome"`
+		Notice   *Notice      `json:"notice"`
+		ID       string       `json:"id"`
+		SenderID string       `json:"sender_id"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, err
+	}
+	switch {
+	case probe.Error != nil:
+		return &Envelope{Error: probe.Error}, nil
+	case probe.Hello != nil:
+		return &Envelope{Hello: probe.Hello}, nil
+	case probe.Welcome != nil:
+		return &Envelope{Welcome: probe.Welcome}, nil
+	case probe.Notice != nil:
+		return &Envelope{Notice: probe.Notice}, nil
+	case probe.ID != "" && probe.SenderID != "":
+		var m Message
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+		return &Envelope{Message: &m}, nil
+	}
+	var req SendMessageRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+	return &Envelope{Send: &req}, nil
+}
+
+// ProtobufCodec encodes frames as pb.Envelope, avoiding the base64 overhead
+// JSON adds to encrypted content.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) Subprotocol() string { return SubprotocolProtobuf }
+func (ProtobufCodec) Binary() bool        { return true }
+
+func (ProtobufCodec) EncodeFrame(env *Envelope) ([]byte, error) {
+	out := &pb.Envelope{}
+	switch {
+	case env.Message != nil:
+		out.Payload = &pb.Envelope_Message{Message: env.Message.ToProto()}
+	case env.Send != nil:
+		out.Payload = &pb.Envelope_Send{Send: env.Send.ToProto()}
+	case env.Error != nil:
+		out.Payload = &pb.Envelope_Error{Error: env.Error.ToProto()}
+	case env.Hello != nil:
+		out.Payload = &pb.Envelope_Hello{Hello: env.Hello.ToProto()}
+	case env.Welcome != nil:
+		out.Payload = &pb.Envelope_Welcome{Welcome: env.Welcome.ToProto()}
+	case env.Notice != nil:
+		out.Payload = &pb.Envelope_Notice{Notice: env.Notice.ToProto()}
+	default:
+		return nil, errEmptyEnvelope
+	}
+	return proto.Marshal(out)
+}
+
+func (ProtobufCodec) DecodeFrame(data []byte) (*Envelope, error) {
+	var in pb.Envelope
+	if err := proto.Unmarshal(data, &in); err != nil {
+		return nil, err
+	}
+	switch p := in.Payload.(type) {
+	case *pb.Envelope_Message:
+		return &Envelope{Message: MessageFromProto(p.Message)}, nil
+	case *pb.Envelope_Send:
+		return &Envelope{Send: SendMessageRequestFromProto(p.Send)}, nil
+	case *pb.Envelope_Error:
+		return &Envelope{Error: ErrorDetailFromProto(p.Error)}, nil
+	case *pb.Envelope_Hello:
+		return &Envelope{Hello: HelloFromProto(p.Hello)}, nil
+	case *pb.Envelope_Welcome:
+		return &Envelope{Welcome: WelcomeFromProto(p.Welcome)}, nil
+	case *pb.Envelope_Notice:
+		return &Envelope{Notice: NoticeFromProto(p.Notice)}, nil
+	}
+	return nil, errEmptyEnvelope
+}
+
+// ToProto converts m to its wire representation.
+func (m *Message) ToProto() *pb.Message {
+	return &pb.Message{
+		Id:         m.ID,
+		ChannelId:  m.ChannelID,
+		SenderId:   m.SenderID,
+		Timestamp:  m.Timestamp,
+		Type:       pb.MessageType(m.Type),
+		Content:    m.Content,
+		Nonce:      m.Nonce,
+		Signature:  m.Signature,
+		DeviceId:   m.DeviceID,
+		Ephemeral:  m.Ephemeral,
+		Attachment: m.Attachment.ToProto(),
+
+		FanOut:            m.FanOut,
+		RecipientDeviceId: m.RecipientDeviceID,
+	}
+}
+
+// MessageFromProto converts a wire message back to a Message.
+func MessageFromProto(p *pb.Message) *Message {
+	return &Message{
+		ID:         p.GetId(),
+		ChannelID:  p.GetChannelId(),
+		SenderID:   p.GetSenderId(),
+		Timestamp:  p.GetTimestamp(),
+		Type:       MessageType(p.GetType()),
+		Content:    p.GetContent(),
+		Nonce:      p.GetNonce(),
+		Signature:  p.GetSignature(),
+		DeviceID:   p.GetDeviceId(),
+		Ephemeral:  p.GetEphemeral(),
+		Attachment: AttachmentFromProto(p.GetAttachment()),
+
+		FanOut:            p.GetFanOut(),
+		RecipientDeviceID: p.GetRecipientDeviceId(),
+	}
+}
+
+// ToProto converts r to its wire representation.
+func (r *SendMessageRequest) ToProto() *pb.SendMessageRequest {
+	out := &pb.SendMessageRequest{
+		ChannelId:  r.ChannelID,
+		Content:    r.Content,
+		Nonce:      r.Nonce,
+		Signature:  r.Signature,
+		Type:       pb.MessageType(r.Type),
+		DeviceId:   r.DeviceID,
+		Timestamp:  r.Timestamp,
+		Attachment: r.Attachment.ToProto(),
+	}
+	for _, c := range r.Recipients {
+		out.Recipients = append(out.Recipients, &pb.DeviceCiphertext{UserId: c.UserID, DeviceId: c.DeviceID, Content: c.Content})
+	}
+	return out
+}
+
+// SendMessageRequestFromProto converts a wire request back to a SendMessageRequest.
+func SendMessageRequestFromProto(p *pb.SendMessageRequest) *SendMessageRequest {
+	out := &SendMessageRequest{
+		ChannelID:  p.GetChannelId(),
+		Content:    p.GetContent(),
+		Nonce:      p.GetNonce(),
+		Signature:  p.GetSignature(),
+		Type:       MessageType(p.GetType()),
+		DeviceID:   p.GetDeviceId(),
+		Timestamp:  p.GetTimestamp(),
+		Attachment: AttachmentFromProto(p.GetAttachment()),
+	}
+	for _, c := range p.GetRecipients() {
+		out.Recipients = append(out.Recipients, DeviceCiphertext{UserID: c.GetUserId(), DeviceID: c.GetDeviceId(), Content: c.GetContent()})
+	}
+	return out
+}
+
+// ToProto converts a to its wire representation; nil stays nil.
+func (a *Attachment) ToProto() *pb.Attachment {
+	if a == nil {
+		return nil
+	}
+	out := &pb.Attachment{
+		FileId:   a.FileID,
+		Name:     a.Name,
+		Size:     a.Size,
+		MimeType: a.MimeType,
+		Sha256:   a.SHA256,
+	}
+	if a.Voice != nil {
+		out.Voice = &pb.VoiceInfo{DurationMs: a.Voice.DurationMs, Codec: a.Voice.Codec}
+		for _, s := range a.Voice.Waveform {
+			if s < 0 {
+				s = 0
+			}
+			out.Voice.Waveform = append(out.Voice.Waveform, uint32(s))
+		}
+	}
+	return out
+}
+
+// AttachmentFromProto converts a wire attachment; nil stays nil.
+func AttachmentFromProto(p *pb.Attachment) *Attachment {
+	if p == nil {
+		return nil
+	}
+	out := &Attachment{
+		FileID:   p.GetFileId(),
+		Name:     p.GetName(),
+		Size:     p.GetSize(),
+		MimeType: p.GetMimeType(),
+		SHA256:   p.GetSha256(),
+	}
+	if v := p.GetVoice(); v != nil {
+		out.Voice = &VoiceInfo{DurationMs: v.GetDurationMs(), Codec: v.GetCodec(), Waveform: make([]int, len(v.GetWaveform()))}
+		for i, s := range v.GetWaveform() {
+			out.Voice.Waveform[i] = int(s)
+		}
+	}
+	return out
+}
+
+// ToProto converts d to its wire representation.
+func (d *ErrorDetail) ToProto() *pb.ErrorDetail {
+	return &pb.ErrorDetail{Code: d.Code, Message: d.Message, ChannelId: d.ChannelID, RetryAfterMs: d.RetryAfterMs}
+}
+
+// ErrorDetailFromProto converts a wire error back to an ErrorDetail.
+func ErrorDetailFromProto(p *pb.ErrorDetail) *ErrorDetail {
+	return &ErrorDetail{Code: p.GetCode(), Message: p.GetMessage(), ChannelID: p.GetChannelId(), RetryAfterMs: p.GetRetryAfterMs()}
+}
+
+// ToProto converts h to its wire representation.
+func (h *Hello) ToProto() *pb.Hello {
+	return &pb.Hello{Version: h.Version, MinVersion: h.MinVersion, Capabilities: h.Capabilities, Required: h.Required, Client: h.Client}
+}
+
+// HelloFromProto converts a wire hello back to a Hello.
+func HelloFromProto(p *pb.Hello) *Hello {
+	return &Hello{Version: p.GetVersion(), MinVersion: p.GetMinVersion(), Capabilities: p.GetCapabilities(), Required: p.GetRequired(), Client: p.GetClient()}
+}
+
+// ToProto converts w to its wire representation.
+func (w *Welcome) ToProto() *pb.Welcome {
+	return &pb.Welcome{Version: w.Version, Capabilities: w.Capabilities, Enabled: w.Enabled}
+}
+
+// WelcomeFromProto converts a wire welcome back to a Welcome.
+func WelcomeFromProto(p *pb.Welcome) *Welcome {
+	return &Welcome{Version: p.GetVersion(), Capabilities: p.GetCapabilities(), Enabled: p.GetEnabled()}
+}
+
+// ToProto converts n to its wire representation.
+func (n *Notice) ToProto() *pb.Notice {
+	return &pb.Notice{Kind: n.Kind, UserId: n.UserID, DeviceId: n.DeviceID, ChannelId: n.ChannelID, Data: n.Data, Timestamp: n.Timestamp}
+}
+
+// NoticeFromProto converts a wire notice back to a Notice.
+func NoticeFromProto(p *pb.Notice) *Notice {
+	return &Notice{Kind: p.GetKind(), UserID: p.GetUserId(), DeviceID: p.GetDeviceId(), ChannelID: p.GetChannelId(), Data: p.GetData(), Timestamp: p.GetTimestamp()}
+}
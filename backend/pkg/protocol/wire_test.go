@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func testMessage() *Message {
+	return &Message{
+		ID:        "m-1",
+		ChannelID: "general",
+		SenderID:  "u-alice",
+		Timestamp: 1700000000000,
+		Type:      MessageTypeVoice,
+		Content:   bytes.Repeat([]byte{0xA5}, 1024),
+		Nonce:     []byte("nonce"),
+		Signature: []byte("sig"),
+		DeviceID:  "d-1",
+		Attachment: &Attachment{
+			FileID: "f-1", Name: "note.ogg", Size: 48000, MimeType: "audio/ogg", SHA256: "ab12",
+			Voice: &VoiceInfo{DurationMs: 4200, Codec: "opus", Waveform: []int{0, 80, 255}},
+		},
+	}
+}
+
+func TestCodecsRoundTripFrames(t *testing.T) {
+	frames := []*Envelope{
+		{Message: testMessage()},
+		{Send: &SendMessageRequest{ChannelID: "general", Content: []byte("hi"), Type: MessageTypeText, DeviceID: "d-1", Timestamp: 42}},
+		{Send: &SendMessageRequest{ChannelID: "priv-1", Type: MessageTypeText, DeviceID: "d-1", Recipients: []DeviceCiphertext{
+			{DeviceID: "d-2", Content: []byte("for d-2")}, {UserID: "u-bob", DeviceID: "d-3", Content: []byte("for d-3")},
+		}}},
+		{Message: &Message{ID: "m-2", ChannelID: "priv-1", SenderID: "u-alice", Type: MessageTypeText, Content: []byte("for d-3"), DeviceID: "d-1", FanOut: true, RecipientDeviceID: "d-3"}},
+		{Error: &ErrorDetail{Code: "rate_limited", Message: "slow down", ChannelID: "general", RetryAfterMs: 1500}},
+		{Hello: &Hello{Version: 1, MinVersion: 1, Capabilities: []string{CapabilityVoice}, Required: []string{CapabilityBinary}, Client: "desktop/2.0"}},
+		{Welcome: &Welcome{Version: 1, Capabilities: []string{CapabilityBinary, CapabilityVoice}, Enabled: []string{CapabilityVoice}}},
+		{Notice: &Notice{Kind: NoticePreKeysLow, UserID: "u-1", DeviceID: "d-1", Data: map[string]string{"remaining": "3"}, Timestamp: 1700000000000}},
+	}
+	for _, codec := range []Codec{JSONCodec{}, ProtobufCodec{}} {
+		for _, env := range frames {
+			data, err := codec.EncodeFrame(env)
+			if err != nil {
+				t.Fatalf("%s encode: %v", codec.Subprotocol(), err)
+			}
+			got, err := codec.DecodeFrame(data)
+			if err != nil {
+				t.Fatalf("%s decode: %v", codec.Subprotocol(), err)
+			}
+			if !reflect.DeepEqual(got, env) {
+				t.Fatalf("%s round trip mismatch:\n got %+v\nwant %+v", codec.Subprotocol(), got, env)
+			}
+		}
+		if _, err := codec.EncodeFrame(&Envelope{}); err == nil {
+			t.Fatalf("%s: expected error for empty envelope", codec.Subprotocol())
+		}
+	}
+}
+
+func TestJSONCodecKeepsLegacyFrames(t *testing.T) {
+	msg := testMessage()
+	legacy, _ := json.Marshal(msg)
+	data, err := JSONCodec{}.EncodeFrame(&Envelope{Message: msg})
+	if err != nil || !bytes.Equal(data, legacy) {
+		t.Fatalf("JSON frames must stay bare messages: %s", data)
+	}
+	env, err := JSONCodec{}.DecodeFrame([]byte(`{"channel_id":"general","content":"aGk=","type":1}`))
+	if err != nil || env.Send == nil || string(env.Send.Content) != "hi" {
+		t.Fatalf("expected legacy send request, got %+v (%v)", env, err)
+	}
+
+	bin, _ := ProtobufCodec{}.EncodeFrame(&Envelope{Message: msg})
+	if len(bin) >= len(legacy)*3/4 {
+		t.Fatalf("binary frame (%d bytes) should avoid base64 overhead of JSON (%d bytes)", len(bin), len(legacy))
+	}
+	if CodecFor("").Subprotocol() != SubprotocolJSON || !CodecFor(SubprotocolProtobuf).Binary() {
+		t.Fatalf("unexpected codec selection")
+	}
+}
+
+func TestDecodeDiscoveryPacketAcceptsBothEncodings(t *testing.T) {
+	p := &DiscoveryPacket{ClusterID: "c", NodeID: "n-1", Address: "10.0.0.2:8080", Priority: 3, PublicKey: []byte("key")}
+	jsonData, _ := p.Encode()
+	binData, err := p.EncodeBinary()
+	if err != nil {
+		t.Fatalf("encode binary: %v", err)
+	}
+	for _, data := range [][]byte{jsonData, binData} {
+		got, err := DecodeDiscoveryPacket(data)
+		if err != nil || !reflect.DeepEqual(got, p) {
+			t.Fatalf("decode %q: got %+v (%v)", data, got, err)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Key sizes of the X3DH key material.
+const (
+	KeySize          = 32                                  // X25519 public and private keys
+	IdentityKeySize  = KeySize + ed25519.PublicKeySize     // IdentityKey.Bytes()
+	SignedPreKeySize = 4 + KeySize + ed25519.SignatureSize // SignedPreKey.PublicBytes()
+)
+
+var (
+	ErrInvalidKey          = errors.New("e2ee: invalid key")
+	ErrInvalidPreKeyBundle = errors.New("e2ee: signed prekey signature does not verify")
+	ErrUnknownPreKey       = errors.New("e2ee: unknown prekey")
+)
+
+// KeyPair is an X25519 key pair.
+type KeyPair struct {
+	Private []byte `json:"private"`
+	Public  []byte `json:"public"`
+}
+
+// GenerateKeyPair creates an X25519 key pair from 32 bytes of rand. Unlike
+// ecdh.GenerateKey it is deterministic for a given reader, which the test
+// vectors rely on.
+func GenerateKeyPair(rand io.Reader) (*KeyPair, error) {
+	seed := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand, seed); err != nil {
+		return nil, err
+	}
+	priv, err := ecdh.X25519().NewPrivateKey(seed)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{Private: priv.Bytes(), Public: priv.PublicKey().Bytes()}, nil
+}
+
+// dh computes X25519(private, public), rejecting low-order public keys.
+func dh(private, public []byte) ([]byte, error) {
+	priv, err := ecdh.X25519().NewPrivateKey(private)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	pub, err := ecdh.X25519().NewPublicKey(public)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	return secret, nil
+}
+
+// IdentityKey is the public long-term identity of a device: an X25519 key
+// used in X3DH and an Ed25519 key that signs its prekeys.
+type IdentityKey struct {
+	DH      []byte `json:"dh"`
+	Signing []byte `json:"signing"`
+}
+
+// Bytes returns DH || Signing, the form published in bundles and used for
+// associated data and fingerprints.
+func (k IdentityKey) Bytes() []byte {
+	return append(append(make([]byte, 0, IdentityKeySize), k.DH...), k.Signing...)
+}
+
+// Equal reports whether k and other are the same identity.
+func (k IdentityKey) Equal(other IdentityKey) bool {
+	return bytes.Equal(k.DH, other.DH) && bytes.Equal(k.Signing, other.Signing)
+}
+
+// ParseIdentityKey decodes IdentityKey.Bytes.
+func ParseIdentityKey(b []byte) (IdentityKey, error) {
+	if len(b) != IdentityKeySize {
+		return IdentityKey{}, ErrInvalidKey
+	}
+	k := IdentityKey{
+		DH:      append([]byte(nil), b[:KeySize]...),
+		Signing: append([]byte(nil), b[KeySize:]...),
+	}
+	if _, err := ecdh.X25519().NewPublicKey(k.DH); err != nil {
+		return IdentityKey{}, ErrInvalidKey
+	}
+	return k, nil
+}
+
+// IdentityKeyPair is a device's private long-term identity.
+type IdentityKeyPair struct {
+	DH      KeyPair            `json:"dh"`
+	Signing ed25519.PrivateKey `json:"signing"`
+}
+
+// GenerateIdentityKeyPair creates a new identity from rand.
+func GenerateIdentityKeyPair(rand io.Reader) (*IdentityKeyPair, error) {
+	kp, err := GenerateKeyPair(rand)
+	if err != nil {
+		return nil, err
+	}
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := io.ReadFull(rand, seed); err != nil {
+		return nil, err
+	}
+	return &IdentityKeyPair{DH: *kp, Signing: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// Public returns the public identity.
+func (ik *IdentityKeyPair) Public() IdentityKey {
+	return IdentityKey{
+		DH:      append([]byte(nil), ik.DH.Public...),
+		Signing: append([]byte(nil), ik.Signing.Public().(ed25519.PublicKey)...),
+	}
+}
+
+// SignedPreKey is a medium-term X25519 key signed by the identity key.
+type SignedPreKey struct {
+	ID        uint32  `json:"id"`
+	KeyPair   KeyPair `json:"key_pair"`
+	Signature []byte  `json:"signature"`
+}
+
+// GenerateSignedPreKey creates a signed prekey with the given ID.
+func GenerateSignedPreKey(rand io.Reader, identity *IdentityKeyPair, id uint32) (*SignedPreKey, error) {
+	kp, err := GenerateKeyPair(rand)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedPreKey{ID: id, KeyPair: *kp, Signature: ed25519.Sign(identity.Signing, kp.Public)}, nil
+}
+
+// PublicBytes returns ID || public key || signature, the form
+// InitializeSession accepts.
+func (spk *SignedPreKey) PublicBytes() []byte {
+	out := binary.BigEndian.AppendUint32(make([]byte, 0, SignedPreKeySize), spk.ID)
+	return append(append(out, spk.KeyPair.Public...), spk.Signature...)
+}
+
+// OneTimePreKey is an X25519 key used for at most one session.
+type OneTimePreKey struct {
+	ID      uint32  `json:"id"`
+	KeyPair KeyPair `json:"key_pair"`
+}
+
+// GenerateOneTimePreKeys creates n one-time prekeys numbered from startID.
+// ID 0 is reserved to mean "no one-time prekey".
+func GenerateOneTimePreKeys(rand io.Reader, startID uint32, n int) ([]*OneTimePreKey, error) {
+	if startID == 0 {
+		return nil, fmt.Errorf("%w: one-time prekey IDs start at 1", ErrInvalidKey)
+	}
+	keys := make([]*OneTimePreKey, 0, n)
+	for i := 0; i < n; i++ {
+		kp, err := GenerateKeyPair(rand)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &OneTimePreKey{ID: startID + uint32(i), KeyPair: *kp})
+	}
+	return keys, nil
+}
+
+// PreKeyBundle is what an initiator fetches to start a session with a
+// device. OneTimePreKey is optional; its ID is 0 when absent.
+type PreKeyBundle struct {
+	IdentityKey           []byte `json:"identity_key"`
+	SignedPreKeyID        uint32 `json:"signed_prekey_id"`
+	SignedPreKey          []byte `json:"signed_prekey"`
+	SignedPreKeySignature []byte `json:"signed_prekey_signature"`
+	OneTimePreKeyID       uint32 `json:"one_time_prekey_id,omitempty"`
+	OneTimePreKey         []byte `json:"one_time_prekey,omitempty"`
+}
+
+// NewPreKeyBundle builds the bundle a device publishes; opk may be nil.
+func NewPreKeyBundle(identity IdentityKey, spk *SignedPreKey, opk *OneTimePreKey) *PreKeyBundle {
+	b := &PreKeyBundle{
+		IdentityKey:           identity.Bytes(),
+		SignedPreKeyID:        spk.ID,
+		SignedPreKey:          append([]byte(nil), spk.KeyPair.Public...),
+		SignedPreKeySignature: append([]byte(nil), spk.Signature...),
+	}
+	if opk != nil {
+		b.OneTimePreKeyID = opk.ID
+		b.OneTimePreKey = append([]byte(nil), opk.KeyPair.Public...)
+	}
+	return b
+}
+
+// Verify checks the bundle's keys and the signed prekey signature.
+func (b *PreKeyBundle) Verify() (IdentityKey, error) {
+	ik, err := ParseIdentityKey(b.IdentityKey)
+	if err != nil {
+		return IdentityKey{}, err
+	}
+	if _, err := ecdh.X25519().NewPublicKey(b.SignedPreKey); err != nil {
+		return IdentityKey{}, ErrInvalidKey
+	}
+	if !ed25519.Verify(ik.Signing, b.SignedPreKey, b.SignedPreKeySignature) {
+		return IdentityKey{}, ErrInvalidPreKeyBundle
+	}
+	if b.OneTimePreKey != nil {
+		if _, err := ecdh.X25519().NewPublicKey(b.OneTimePreKey); err != nil {
+			return IdentityKey{}, ErrInvalidKey
+		}
+	}
+	return ik, nil
+}
+
+// PreKeyStore holds a device's private prekeys for accepting sessions.
+type PreKeyStore interface {
+	SignedPreKey(id uint32) (*SignedPreKey, error)
+	OneTimePreKey(id uint32) (*OneTimePreKey, error)
+	// RemoveOneTimePreKey deletes a one-time prekey once a session using it
+	// is established, so that it is never used for a second one.
+	RemoveOneTimePreKey(id uint32) error
+}
+
+// MemoryPreKeyStore is an in-memory PreKeyStore. It is not safe for
+// concurrent use.
+type MemoryPreKeyStore struct {
+	SignedPreKeys  map[uint32]*SignedPreKey
+	OneTimePreKeys map[uint32]*OneTimePreKey
+}
+
+// NewMemoryPreKeyStore returns a store holding the given keys.
+func NewMemoryPreKeyStore(spks []*SignedPreKey, opks []*OneTimePreKey) *MemoryPreKeyStore {
+	s := &MemoryPreKeyStore{
+		SignedPreKeys:  make(map[uint32]*SignedPreKey),
+		OneTimePreKeys: make(map[uint32]*OneTimePreKey),
+	}
+	for _, k := range spks {
+		s.SignedPreKeys[k.ID] = k
+	}
+	for _, k := range opks {
+		s.OneTimePreKeys[k.ID] = k
+	}
+	return s
+}
+
+func (s *MemoryPreKeyStore) SignedPreKey(id uint32) (*SignedPreKey, error) {
+	if k, ok := s.SignedPreKeys[id]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("%w: signed prekey %d", ErrUnknownPreKey, id)
+}
+
+func (s *MemoryPreKeyStore) OneTimePreKey(id uint32) (*OneTimePreKey, error) {
+	if k, ok := s.OneTimePreKeys[id]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("%w: one-time prekey %d", ErrUnknownPreKey, id)
+}
+
+func (s *MemoryPreKeyStore) RemoveOneTimePreKey(id uint32) error {
+	delete(s.OneTimePreKeys, id)
+	return nil
+}
+
+// x3dhInfo is the HKDF info string for the X3DH shared secret.
+const x3dhInfo = "LanChat X3DH"
+
+// x3dhSecret derives SK from the DH outputs, prefixed with 32 0xFF bytes
+// as the X3DH specification requires for X25519.
+func x3dhSecret(dhs ...[]byte) []byte {
+	ikm := bytes.Repeat([]byte{0xFF}, KeySize)
+	for _, d := range dhs {
+		ikm = append(ikm, d...)
+	}
+	return hkdf(make([]byte, KeySize), ikm, []byte(x3dhInfo), KeySize)
+}
+
+// x3dhInitiate computes SK for the initiator:
+//
+//	DH1 = DH(IKa, SPKb)  DH2 = DH(EKa, IKb)  DH3 = DH(EKa, SPKb)  DH4 = DH(EKa, OPKb)
+func x3dhInitiate(identity *IdentityKeyPair, ephemeral *KeyPair, remote IdentityKey, b *PreKeyBundle) ([]byte, error) {
+	dh1, err := dh(identity.DH.Private, b.SignedPreKey)
+	if err != nil {
+		return nil, err
+	}
+	dh2, err := dh(ephemeral.Private, remote.DH)
+	if err != nil {
+		return nil, err
+	}
+	dh3, err := dh(ephemeral.Private, b.SignedPreKey)
+	if err != nil {
+		return nil, err
+	}
+	dhs := [][]byte{dh1, dh2, dh3}
+	if b.OneTimePreKey != nil {
+		dh4, err := dh(ephemeral.Private, b.OneTimePreKey)
+		if err != nil {
+			return nil, err
+		}
+		dhs = append(dhs, dh4)
+	}
+	return x3dhSecret(dhs...), nil
+}
+
+// x3dhRespond computes the same SK on the responder side.
+func x3dhRespond(identity *IdentityKeyPair, spk *SignedPreKey, opk *OneTimePreKey, remote IdentityKey, baseKey []byte) ([]byte, error) {
+	dh1, err := dh(spk.KeyPair.Private, remote.DH)
+	if err != nil {
+		return nil, err
+	}
+	dh2, err := dh(identity.DH.Private, baseKey)
+	if err != nil {
+		return nil, err
+	}
+	dh3, err := dh(spk.KeyPair.Private, baseKey)
+	if err != nil {
+		return nil, err
+	}
+	dhs := [][]byte{dh1, dh2, dh3}
+	if opk != nil {
+		dh4, err := dh(opk.KeyPair.Private, baseKey)
+		if err != nil {
+			return nil, err
+		}
+		dhs = append(dhs, dh4)
+	}
+	return x3dhSecret(dhs...), nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// auditEvent matches the body accepted by the audit service's POST /log.
+type auditEvent struct {
+	ActorID        string `json:"actor_id"`
+	Action         string `json:"action"`
+	TargetResource string `json:"target_resource"`
+	Details        string `json:"details"`
+}
+
+// auditClient forwards security events to the audit service. A nil client
+// or empty URL disables forwarding.
+type auditClient struct {
+	url    string
+	client *http.Client
+}
+
+func newAuditClient(url string) *auditClient {
+	return &auditClient{url: url, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func auditClientFromEnv() *auditClient {
+	url := os.Getenv("AUTH_AUDIT_URL")
+	if url == "" {
+		url = "http://localhost:8084/log"
+	}
+	return newAuditClient(url)
+}
+
+// Log records an event with details marshalled as JSON. Delivery happens in
+// the background so an unreachable audit service does not hold up logins;
+// failures are logged.
+func (a *auditClient) Log(actorID, action, target string, details interface{}) {
+	if a == nil || a.url == "" {
+		return
+	}
+	d, _ := json.Marshal(details)
+	body, err := json.Marshal(auditEvent{ActorID: actorID, Action: action, TargetResource: target, Details: string(d)})
+	if err != nil {
+		return
+	}
+	go func() {
+		if err := a.post(body); err != nil {
+			log.Printf("audit %s on %s not recorded: %v", action, target, err)
+		}
+	}()
+}
+
+func (a *auditClient) post(body []byte) error {
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("audit service returned %d", resp.StatusCode)
+	}
+	return nil
+}
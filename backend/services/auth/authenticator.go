@@ -0,0 +1,242 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Authenticator checks a username and password against one source of
+// accounts. The local users table is always first; directories configured
+// through the environment follow.
+type Authenticator interface {
+	// Name is recorded with the accounts the authenticator provisions, so
+	// later logins go back to it.
+	Name() string
+	// Authenticate returns errBadCredentials for unknown usernames and
+	// wrong passwords, errNoAccess for accounts that may not sign in, and
+	// any other error when the source could not be asked.
+	Authenticate(username, password string) (Identity, error)
+}
+
+// Identity is an account an Authenticator vouched for.
+type Identity struct {
+	// Username is the source's spelling of the login name.
+	Username string
+	FullName string
+	// Role is a role name; empty keeps the user's role.
+	Role string
+	// Department is a department name; empty keeps the user's department.
+	Department string
+	// ExternalID is the source's own name for the account, e.g. its DN.
+	ExternalID string
+}
+
+var (
+	errBadCredentials = errors.New("invalid credentials")
+	errNoAccess       = errors.New("account may not sign in")
+)
+
+const providerLocal = "local"
+
+// identitySchema links users provisioned from a directory to it. Users
+// without a row are local.
+const identitySchema = `
+	CREATE TABLE IF NOT EXISTS user_identities (
+		user_id TEXT PRIMARY KEY,
+		provider TEXT NOT NULL,
+		external_id TEXT NOT NULL,
+		synced_at BIGINT NOT NULL
+	);
+`
+
+// localAuthenticator verifies the password hash in the users table.
+type localAuthenticator struct {
+	db *sql.DB
+}
+
+func (localAuthenticator) Name() string { return providerLocal }
+
+func (a localAuthenticator) Authenticate(username, password string) (Identity, error) {
+	var hash sql.NullString
+	err := a.db.QueryRow(`SELECT password_hash FROM users WHERE username = ?`, username).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return Identity{}, errBadCredentials
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+	match, err := VerifyPassword(password, hash.String)
+	if err != nil || !match {
+		return Identity{}, errBadCredentials
+	}
+	return Identity{Username: username}, nil
+}
+
+// accountSource returns the ID of username's user and the authenticator
+// it belongs to, or empty strings when there is no such user.
+func (s *AuthService) accountSource(username string) (userID, provider string, err error) {
+	err = s.db.QueryRow(`
+		SELECT u.id, COALESCE(i.provider, ?)
+		FROM users u
+		LEFT JOIN user_identities i ON i.user_id = u.id
+		WHERE u.username = ?`, providerLocal, username).Scan(&userID, &provider)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+	return userID, provider, err
+}
+
+// identityProvider returns the directory userID was provisioned from, or
+// "" for a local user.
+func (s *AuthService) identityProvider(userID string) (string, error) {
+	var provider string
+	err := s.db.QueryRow(`SELECT provider FROM user_identities WHERE user_id = ?`, userID).Scan(&provider)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return provider, err
+}
+
+// verifyCredentials checks a login against the authenticator the user
+// belongs to. Usernames nobody has seen yet are offered to every
+// authenticator in turn, and the first that accepts them provisions the
+// user. On failure the returned User carries the ID of a known account.
+func (s *AuthService) verifyCredentials(username, password string) (User, string, error) {
+	userID, source, err := s.accountSource(username)
+	if err != nil {
+		return User{}, "", err
+	}
+	failure := errBadCredentials
+	for _, a := range s.authenticators {
+		if userID != "" && a.Name() != source {
+			continue
+		}
+		identity, err := a.Authenticate(username, password)
+		switch {
+		case err == nil:
+			if a.Name() == providerLocal {
+				user, err := s.userByName(username)
+				return user, providerLocal, err
+			}
+			user, err := s.provision(a.Name(), identity)
+			return user, a.Name(), err
+		case errors.Is(err, errBadCredentials):
+		default:
+			failure = fmt.Errorf("%s: %w", a.Name(), err)
+		}
+	}
+	return User{ID: userID, Username: username}, source, failure
+}
+
+func (s *AuthService) userByName(username string) (User, error) {
+	var user User
+	// Join with roles to get role name from role_id, fallback to role_id itself if roles table is empty
+	err := s.db.QueryRow(`
+		SELECT u.id, u.username, COALESCE(u.password_hash, ''), COALESCE(r.name, u.role_id, 'user') as role
+		FROM users u
+		LEFT JOIN roles r ON u.role_id = r.id
+		WHERE u.username = ?`, username).
+		Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role)
+	return user, err
+}
+
+// provision creates the user for an account provider vouched for on its
+// first login, and brings the name, role and department up to date on
+// later ones. A local user of the same name is never taken over.
+func (s *AuthService) provision(provider string, id Identity) (User, error) {
+	if !usernamePattern.MatchString(id.Username) {
+		return User{}, fmt.Errorf("%w: %s username %q is not valid here", errNoAccess, provider, id.Username)
+	}
+	if id.FullName == "" {
+		id.FullName = id.Username
+	}
+	departmentID := ""
+	if id.Department != "" {
+		var err error
+		if departmentID, err = s.departmentID(id.Department); err != nil {
+			log.Printf("department %q of %s not synced: %v", id.Department, id.Username, err)
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	var userID, source, oldRole string
+	err = tx.QueryRow(`
+		SELECT u.id, COALESCE(i.provider, ?), COALESCE(u.role_id, '')
+		FROM users u
+		LEFT JOIN user_identities i ON i.user_id = u.id
+		WHERE u.username = ?`, providerLocal, id.Username).Scan(&userID, &source, &oldRole)
+	created := err == sql.ErrNoRows
+	if err != nil && !created {
+		return User{}, err
+	}
+	if !created && source != provider {
+		return User{}, fmt.Errorf("%w: %q is a %s account", errBadCredentials, id.Username, source)
+	}
+
+	roleID := oldRole
+	if id.Role != "" {
+		if err := tx.QueryRow(`SELECT COALESCE((SELECT id FROM roles WHERE name = ?), ?)`, id.Role, id.Role).Scan(&roleID); err != nil {
+			return User{}, err
+		}
+	}
+	now := time.Now().Unix()
+	if created {
+		userID = uuid.New().String()
+		// No password hash: the directory checks the password.
+		_, err = tx.Exec(`INSERT INTO users (id, username, full_name, password_hash, role_id, department_id, created_at, updated_at) VALUES (?, ?, ?, '', ?, NULLIF(?, ''), ?, ?)`,
+			userID, id.Username, id.FullName, roleID, departmentID, now, now)
+	} else {
+		_, err = tx.Exec(`UPDATE users SET full_name = ?, role_id = ?, department_id = COALESCE(NULLIF(?, ''), department_id), updated_at = ? WHERE id = ?`,
+			id.FullName, roleID, departmentID, now, userID)
+	}
+	if err != nil {
+		return User{}, err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO user_identities (user_id, provider, external_id, synced_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET external_id = excluded.external_id, synced_at = excluded.synced_at`,
+		userID, provider, id.ExternalID, now)
+	if err != nil {
+		return User{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return User{}, err
+	}
+
+	switch {
+	case created:
+		s.audit.Log(userID, "user.provisioned", "user:"+userID, map[string]interface{}{
+			"username": id.Username, "provider": provider, "external_id": id.ExternalID,
+			"role": id.Role, "department": id.Department,
+		})
+	case roleID != oldRole:
+		s.audit.Log(userID, "user.role.sync", "user:"+userID, map[string]interface{}{
+			"username": id.Username, "provider": provider, "from": oldRole, "to": roleID,
+		})
+	}
+	return s.lookupUser(userID)
+}
+
+// departmentID returns the ID of the department called name, creating it
+// when the directory names one the admin API does not know yet.
+func (s *AuthService) departmentID(name string) (string, error) {
+	now := time.Now().Unix()
+	_, err := s.db.Exec(`INSERT INTO departments (id, name, created_at, updated_at) VALUES (?, ?, ?, ?) ON CONFLICT(name) DO NOTHING`,
+		uuid.New().String(), name, now, now)
+	if err != nil {
+		return "", err
+	}
+	var id string
+	err = s.db.QueryRow(`SELECT id FROM departments WHERE name = ?`, name).Scan(&id)
+	return id, err
+}
@@ -7,6 +7,26 @@ require (
 	golang.org/x/crypto v0.21.0
 	github.com/google/uuid v1.6.0
 	github.com/mattn/go-sqlite3 v1.14.22
+	lan-chat/jwks v0.0.0
+	lan-chat/ldapauth v0.0.0
+	lan-chat/lockout v0.0.0
+	lan-chat/mfa v0.0.0
+	lan-chat/password v0.0.0
 )
 
-require golang.org/x/sys v0.18.0 // indirect
+require (
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
+	github.com/go-asn1-ber/asn1-ber v1.5.5 // indirect
+	github.com/go-ldap/ldap/v3 v3.4.8 // indirect
+	golang.org/x/sys v0.18.0 // indirect
+)
+
+replace lan-chat/jwks => ../../pkg/jwks
+
+replace lan-chat/ldapauth => ../../pkg/ldapauth
+
+replace lan-chat/lockout => ../../pkg/lockout
+
+replace lan-chat/mfa => ../../pkg/mfa
+
+replace lan-chat/password => ../../pkg/password
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"lan-chat/ldapauth"
+)
+
+const providerLDAP = "ldap"
+
+// ldapAuthenticator signs users in against the corporate directory.
+type ldapAuthenticator struct {
+	dir *ldapauth.Authenticator
+}
+
+func (ldapAuthenticator) Name() string { return providerLDAP }
+
+func (a ldapAuthenticator) Authenticate(username, password string) (Identity, error) {
+	entry, err := a.dir.Authenticate(username, password)
+	switch {
+	case errors.Is(err, ldapauth.ErrInvalidCredentials):
+		return Identity{}, errBadCredentials
+	case errors.Is(err, ldapauth.ErrNoRole):
+		return Identity{}, errNoAccess
+	case err != nil:
+		return Identity{}, err
+	}
+	return Identity{
+		Username:   entry.Username,
+		FullName:   entry.FullName,
+		Role:       entry.Role,
+		Department: entry.Department,
+		ExternalID: entry.DN,
+	}, nil
+}
+
+// authenticatorsFromEnv returns the local authenticator, followed by the
+// LDAP directory when AUTH_LDAP_URL is set.
+func (s *AuthService) authenticatorsFromEnv() ([]Authenticator, error) {
+	auths := []Authenticator{localAuthenticator{db: s.db}}
+	cfg, err := ldapauth.ConfigFromEnv("AUTH")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.URL == "" {
+		return auths, nil
+	}
+	dir, err := ldapauth.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("LDAP authentication enabled against %s (%s)", cfg.URL, cfg.BaseDN)
+	return append(auths, ldapAuthenticator{dir: dir}), nil
+}
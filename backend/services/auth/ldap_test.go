@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+
+	"lan-chat/ldapauth"
+	"lan-chat/ldapauth/ldaptest"
+)
+
+const (
+	ldapServiceDN = "cn=chat,ou=services,dc=corp,dc=local"
+	ldapAliceDN   = "uid=alice,ou=people,dc=corp,dc=local"
+	ldapBobDN     = "uid=bob,ou=people,dc=corp,dc=local"
+)
+
+// newLDAPTestService starts a directory with alice (an admin in
+// Engineering), bob (staff) and carol (in no mapped group) and returns an
+// AuthService that authenticates against it.
+func newLDAPTestService(t *testing.T) (*AuthService, *ldaptest.Server) {
+	t.Helper()
+	d := ldaptest.NewServer(t, ldapServiceDN, "svc-secret")
+	person := []string{"top", "person", "inetOrgPerson"}
+	d.Add(ldapAliceDN, "alice-pw", map[string][]string{
+		"objectClass": person, "uid": {"alice"}, "displayName": {"Alice Liddell"},
+		"departmentNumber": {"Engineering"}, "memberOf": {"cn=chat-admins,ou=groups,dc=corp,dc=local"},
+	})
+	d.Add(ldapBobDN, "bob-pw", map[string][]string{
+		"objectClass": person, "uid": {"bob"}, "memberOf": {"cn=staff,ou=groups,dc=corp,dc=local"},
+	})
+	d.Add("uid=carol,ou=people,dc=corp,dc=local", "carol-pw", map[string][]string{
+		"objectClass": person, "uid": {"carol"},
+	})
+
+	s := newTestService(t)
+	cfg := ldapauth.DefaultConfig()
+	cfg.URL = d.URL()
+	cfg.BindDN = ldapServiceDN
+	cfg.BindPassword = "svc-secret"
+	cfg.BaseDN = "dc=corp,dc=local"
+	cfg.DepartmentAttr = "departmentNumber"
+	roles, err := ldapauth.ParseGroupRoles("chat-admins:admin;staff:user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.GroupRoles = roles
+	dir, err := ldapauth.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.authenticators = append(s.authenticators, ldapAuthenticator{dir: dir})
+	// Departments belong to the admin API's schema.
+	if _, err := s.db.Exec(`CREATE TABLE departments (id TEXT PRIMARY KEY, name TEXT UNIQUE NOT NULL, created_at INTEGER NOT NULL, updated_at INTEGER NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	return s, d
+}
+
+func TestLDAPLoginProvisionsUser(t *testing.T) {
+	t.Parallel()
+	s, _ := newLDAPTestService(t)
+
+	pair := login(t, s, "alice", "alice-pw")
+	if pair.Role != "admin" || !accepted(s, pair.Token) {
+		t.Fatalf("alice = %+v, want an admin session", pair)
+	}
+	var fullName, hash, department, provider, externalID string
+	err := s.db.QueryRow(`
+		SELECT u.full_name, u.password_hash, d.name, i.provider, i.external_id
+		FROM users u
+		JOIN departments d ON d.id = u.department_id
+		JOIN user_identities i ON i.user_id = u.id
+		WHERE u.id = ?`, pair.UserID).Scan(&fullName, &hash, &department, &provider, &externalID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fullName != "Alice Liddell" || hash != "" || department != "Engineering" || provider != providerLDAP || externalID != ldapAliceDN {
+		t.Fatalf("provisioned alice = %q %q %q %q %q", fullName, hash, department, provider, externalID)
+	}
+
+	// Later logins find the same user.
+	if again := login(t, s, "alice", "alice-pw"); again.UserID != pair.UserID {
+		t.Fatalf("second login user = %s, want %s", again.UserID, pair.UserID)
+	}
+	if rec := call(t, s.LoginHandler, "", LoginRequest{Username: "alice", Password: "bob-pw"}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong directory password: status = %d, want 401", rec.Code)
+	}
+	if rec := call(t, s.LoginHandler, "", LoginRequest{Username: "carol", Password: "carol-pw"}); rec.Code != http.StatusForbidden {
+		t.Fatalf("directory user without a role: status = %d, want 403", rec.Code)
+	}
+	var carol int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM users WHERE username = 'carol'`).Scan(&carol); err != nil || carol != 0 {
+		t.Fatalf("carol provisioned without a role: %d, %v", carol, err)
+	}
+
+	if rec := call(t, s.RegisterHandler, "", RegisterRequest{Username: "mallory", Password: "Mallory-Pass-42"}); rec.Code != http.StatusForbidden {
+		t.Fatalf("register with a directory: status = %d, want 403", rec.Code)
+	}
+}
+
+func TestLDAPDoesNotTakeOverLocalUser(t *testing.T) {
+	t.Parallel()
+	s, d := newLDAPTestService(t)
+	bobID := createTestUser(t, s, "bob", "Local-Bob-42", "user")
+
+	if rec := call(t, s.LoginHandler, "", LoginRequest{Username: "bob", Password: "bob-pw"}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("directory password of a local user: status = %d, want 401", rec.Code)
+	}
+	for _, dn := range d.Binds() {
+		if dn == ldapBobDN {
+			t.Fatal("the directory was asked about a local user")
+		}
+	}
+
+	pair := login(t, s, "bob", "Local-Bob-42")
+	if pair.UserID != bobID {
+		t.Fatalf("local login user = %s, want %s", pair.UserID, bobID)
+	}
+	var provider string
+	if err := s.db.QueryRow(`SELECT provider FROM user_identities WHERE user_id = ?`, bobID).Scan(&provider); err != sql.ErrNoRows {
+		t.Fatalf("local bob linked to %q (%v)", provider, err)
+	}
+
+	// Even if the user appears between lookup and provisioning, the
+	// directory account does not replace the local one.
+	if _, err := s.provision(providerLDAP, Identity{Username: "bob", ExternalID: ldapBobDN}); err == nil {
+		t.Fatal("provisioning took over the local bob")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"lan-chat/lockout"
+)
+
+// beginAttempt reserves a login attempt for username, or writes 429 and
+// reports false when username must still wait. The wait applies however
+// many IPs the attempts come from, unlike authLimiter. Callers defer
+// releaseAttempt.
+func (s *AuthService) beginAttempt(w http.ResponseWriter, username string) (*lockout.Attempt, bool) {
+	attempt, wait, err := s.lockout.Begin(username)
+	if err != nil {
+		log.Printf("lockout check %q: %v", username, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if attempt == nil {
+		w.Header().Set("Retry-After", strconv.FormatInt(int64((wait+time.Second-1)/time.Second), 10))
+		http.Error(w, "Too many failed attempts, try again later", http.StatusTooManyRequests)
+		return nil, false
+	}
+	return attempt, true
+}
+
+// releaseAttempt refunds an attempt that did not fail.
+func releaseAttempt(attempt *lockout.Attempt) {
+	if err := attempt.Release(); err != nil {
+		log.Printf("lockout release %q: %v", attempt.Username(), err)
+	}
+}
+
+// loginFailed counts a wrong password or second factor against the
+// attempt's username and audits the attempt that locks the account.
+// userID is empty for usernames that do not exist, which are counted all
+// the same so probing them costs as much as guessing a real one.
+func (s *AuthService) loginFailed(r *http.Request, attempt *lockout.Attempt, userID, step string) {
+	res := attempt.Fail()
+	username := attempt.Username()
+	if !res.Locked {
+		return
+	}
+	target := "user:" + userID
+	if userID == "" {
+		target = "username:" + username
+	}
+	s.audit.Log(userID, "user.lockout", target, map[string]interface{}{
+		"username": username, "failures": res.Failures, "step": step,
+		"locked_seconds": int64(res.Wait / time.Second), "ip": clientIP(r),
+	})
+}
+
+// loginSucceeded clears username's failures once a login is complete.
+func (s *AuthService) loginSucceeded(username string) {
+	if err := s.lockout.Succeed(username); err != nil {
+		log.Printf("lockout reset %q: %v", username, err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"lan-chat/mfa"
+)
+
+func TestSecondFactorFailuresCountTowardLockout(t *testing.T) {
+	t.Parallel()
+	s := newTestService(t)
+	policy := testLockoutPolicy()
+	policy.Threshold = 3
+	setLockoutPolicy(t, s, policy)
+	aliceID := createTestUser(t, s, "alice", "Correct-Horse-42", "user")
+	secret, _ := enableTOTP(t, s, aliceID)
+	// A code from well outside the accepted window is always wrong.
+	wrong := mfa.Code(secret, mfa.Step(time.Now())-5)
+
+	if rec := call(t, s.LoginHandler, "", LoginRequest{Username: "alice", Password: "wrong"}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: status = %d, want 401", rec.Code)
+	}
+	challenge := loginChallenge(t, s, "alice", "Correct-Horse-42", mfa.PurposeVerify)
+	for i := 0; i < 2; i++ {
+		if rec := call(t, s.LoginMFAHandler, "", MFACodeRequest{Challenge: challenge, Code: wrong}); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d: status = %d, want 401", i+1, rec.Code)
+		}
+	}
+
+	// The password and the two codes make three failures: the account is
+	// locked, even for the right code on a challenge it already holds.
+	rec := call(t, s.LoginMFAHandler, "", MFACodeRequest{Challenge: challenge, Code: mfa.Code(secret, mfa.Step(time.Now())+1)})
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("right code while locked: status = %d, Retry-After %q, want 429 with a wait", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := call(t, s.LoginHandler, "", LoginRequest{Username: "alice", Password: "Correct-Horse-42"}); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("right password while locked: status = %d, want 429", rec.Code)
+	}
+
+	if ok, err := s.lockout.Unlock("alice"); err != nil || !ok {
+		t.Fatalf("unlock = %v, %v", ok, err)
+	}
+	loginChallenge(t, s, "alice", "Correct-Horse-42", mfa.PurposeVerify)
+}
+
+func TestCompletedLoginClearsFailures(t *testing.T) {
+	t.Parallel()
+	s := newTestService(t)
+	policy := testLockoutPolicy()
+	policy.Threshold = 3
+	setLockoutPolicy(t, s, policy)
+	aliceID := createTestUser(t, s, "alice", "Correct-Horse-42", "user")
+	secret, _ := enableTOTP(t, s, aliceID)
+
+	challenge := loginChallenge(t, s, "alice", "Correct-Horse-42", mfa.PurposeVerify)
+	for i := 0; i < 2; i++ {
+		call(t, s.LoginMFAHandler, "", MFACodeRequest{Challenge: challenge, Code: mfa.Code(secret, mfa.Step(time.Now())-5)})
+	}
+	var pair TokenPair
+	decode(t, call(t, s.LoginMFAHandler, "", MFACodeRequest{Challenge: challenge, Code: mfa.Code(secret, mfa.Step(time.Now())+1)}), &pair)
+
+	// Two failures before the login no longer count: two more do not lock.
+	for i := 0; i < 2; i++ {
+		if rec := call(t, s.LoginHandler, "", LoginRequest{Username: "alice", Password: "wrong"}); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong password %d: status = %d, want 401", i+1, rec.Code)
+		}
+	}
+	loginChallenge(t, s, "alice", "Correct-Horse-42", mfa.PurposeVerify)
+}
+
+func TestLockoutIgnoresUsernameCase(t *testing.T) {
+	t.Parallel()
+	s := newTestService(t)
+	policy := testLockoutPolicy()
+	policy.Threshold = 3
+	setLockoutPolicy(t, s, policy)
+	createTestUser(t, s, "alice", "Correct-Horse-42", "user")
+
+	for _, name := range []string{"Alice", "ALICE", " alice"} {
+		if rec := call(t, s.LoginHandler, "", LoginRequest{Username: name, Password: "wrong"}); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong password as %q: status = %d, want 401", name, rec.Code)
+		}
+	}
+	if rec := call(t, s.LoginHandler, "", LoginRequest{Username: "alice", Password: "Correct-Horse-42"}); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("right password after failures under other spellings: status = %d, want 429", rec.Code)
+	}
+	if ok, err := s.lockout.Unlock("ALICE"); err != nil || !ok {
+		t.Fatalf("unlock under another spelling = %v, %v", ok, err)
+	}
+	login(t, s, "alice", "Correct-Horse-42")
+}
+
+func TestConcurrentAttemptsWaitForEachOther(t *testing.T) {
+	t.Parallel()
+	s := newTestService(t)
+	policy := testLockoutPolicy()
+	policy.BaseDelay = time.Minute
+	setLockoutPolicy(t, s, policy)
+
+	// Attempts that all pass a check before any of them fails would each
+	// get a guess; a reservation lets only one through.
+	first, wait, err := s.lockout.Begin("alice")
+	if err != nil || first == nil {
+		t.Fatalf("first attempt: wait %v, err %v", wait, err)
+	}
+	for i := 0; i < 2; i++ {
+		if attempt, wait, err := s.lockout.Begin("Alice"); err != nil || attempt != nil || wait <= 0 {
+			t.Fatalf("attempt while the first is open: %v, wait %v, err %v", attempt, wait, err)
+		}
+	}
+
+	// Releasing the attempt refunds it; failing it keeps the wait.
+	if err := first.Release(); err != nil {
+		t.Fatal(err)
+	}
+	attempt, wait, err := s.lockout.Begin("alice")
+	if err != nil || attempt == nil {
+		t.Fatalf("attempt after a release: wait %v, err %v", wait, err)
+	}
+	if res := attempt.Fail(); res.Failures != 1 {
+		t.Fatalf("failures after one wrong attempt = %d, want 1", res.Failures)
+	}
+	if err := attempt.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, wait, _ := s.lockout.Begin("alice"); wait <= 0 {
+		t.Fatal("a failed attempt was refunded")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -18,6 +19,11 @@ import (
 
 	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
+
+	"lan-chat/jwks"
+	"lan-chat/lockout"
+	"lan-chat/mfa"
+	"lan-chat/password"
 )
 
 // User represents a user account.
@@ -30,8 +36,17 @@ type User struct {
 
 // AuthService handles authentication and user management.
 type AuthService struct {
-	db *sql.DB
-	mu sync.RWMutex
+	db        *sql.DB
+	mu        sync.RWMutex
+	mfa       *mfa.Store
+	lockout   *lockout.Guard
+	passwords *password.Store
+	audit     *auditClient
+	// authenticators check passwords; the local one comes first.
+	authenticators []Authenticator
+	// keys signs access tokens. Other services only ever see the public
+	// halves, served at /.well-known/jwks.json.
+	keys *jwks.Keyring
 }
 
 const requestIDHeader = "X-Request-ID"
@@ -147,7 +162,7 @@ func withRequestTrace(name string, maxBodyBytes int64, next http.HandlerFunc) ht
 	}
 }
 
-func NewAuthService(dbPath string) (*AuthService, error) {
+func NewAuthService(dbPath string, keys *jwks.Keyring, totpKeys *mfa.Box) (*AuthService, error) {
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		return nil, err
@@ -157,9 +172,37 @@ func NewAuthService(dbPath string) (*AuthService, error) {
 		return nil, err
 	}
 
-	return &AuthService{
-		db: db,
-	}, nil
+	store, err := mfa.NewStore(db, mfa.RealmUser, totpKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	guard, err := lockout.New(db, lockout.RealmUser, lockout.PolicyFromEnv("AUTH"))
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := password.PolicyFromEnv("AUTH")
+	if err != nil {
+		return nil, err
+	}
+	passwords, err := password.NewStore(db, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &AuthService{
+		db:        db,
+		keys:      keys,
+		mfa:       store,
+		lockout:   guard,
+		passwords: passwords,
+		audit:     auditClientFromEnv(),
+	}
+	if s.authenticators, err = s.authenticatorsFromEnv(); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
 func initDB(db *sql.DB) error {
@@ -184,7 +227,13 @@ func initDB(db *sql.DB) error {
 		FOREIGN KEY (role_id) REFERENCES roles(id)
 	);
 	`
-	_, err := db.Exec(query)
+	if _, err := db.Exec(query); err != nil {
+		return err
+	}
+	if _, err := db.Exec(identitySchema); err != nil {
+		return err
+	}
+	_, err := db.Exec(sessionSchema)
 	return err
 }
 
@@ -209,6 +258,13 @@ func (s *AuthService) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A local account would shadow the directory account of the same
+	// name, so accounts come from the directory alone once there is one.
+	if len(s.authenticators) > 1 {
+		http.Error(w, "Registration is disabled, sign in with your directory account", http.StatusForbidden)
+		return
+	}
+
 	var req RegisterRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
@@ -221,8 +277,7 @@ func (s *AuthService) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid username format", http.StatusBadRequest)
 		return
 	}
-	if len(req.Password) < 8 || len(req.Password) > 72 {
-		http.Error(w, "Password length must be 8-72", http.StatusBadRequest)
+	if !writePasswordError(w, s.passwords.Policy().Validate(req.Password, req.Username)) {
 		return
 	}
 	if len(req.FullName) > 80 {
@@ -249,6 +304,9 @@ func (s *AuthService) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "User already exists or DB error", http.StatusConflict)
 		return
 	}
+	if err := s.passwords.Record(userID, hash, false); err != nil {
+		log.Printf("record password of %s: %v", userID, err)
+	}
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{"id": userID})
@@ -275,38 +333,84 @@ func (s *AuthService) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid credentials format", http.StatusBadRequest)
 		return
 	}
+	attempt, ok := s.beginAttempt(w, req.Username)
+	if !ok {
+		return
+	}
+	defer releaseAttempt(attempt)
 
-	var user User
-	// Join with roles to get role name from role_id, fallback to role_id itself if roles table is empty
-	err := s.db.QueryRow(`
-		SELECT u.id, u.username, u.password_hash, COALESCE(r.name, u.role_id, 'user') as role 
-		FROM users u 
-		LEFT JOIN roles r ON u.role_id = r.id 
-		WHERE u.username = ?`, req.Username).
-		Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role)
-
-	if err != nil {
+	user, source, err := s.verifyCredentials(req.Username, req.Password)
+	switch {
+	case errors.Is(err, errBadCredentials):
+		if user.ID != "" {
+			s.audit.Log(user.ID, "user.login_failed", "user:"+user.ID, map[string]interface{}{
+				"username": user.Username, "ip": clientIP(r),
+			})
+		}
+		s.loginFailed(r, attempt, user.ID, "password")
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
+	case errors.Is(err, errNoAccess):
+		log.Printf("login %q refused: %v", req.Username, err)
+		s.audit.Log(user.ID, "user.login_denied", "username:"+req.Username, map[string]interface{}{
+			"username": req.Username, "provider": source, "ip": clientIP(r),
+		})
+		http.Error(w, "Account is not allowed to sign in", http.StatusForbidden)
+		return
+	case err != nil:
+		log.Printf("login %q: %v", req.Username, err)
+		http.Error(w, "Authentication service unavailable, try again later", http.StatusServiceUnavailable)
+		return
 	}
 
-	match, err := VerifyPassword(req.Password, user.PasswordHash)
-	if err != nil || !match {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	// Directory passwords are changed in the directory.
+	if source != providerLocal {
+		s.afterPassword(w, r, user)
+		return
+	}
+	reason, err := s.passwords.ChangeRequired(user.ID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if reason != "" {
+		s.audit.Log(user.ID, "user.login.password_change_required", "user:"+user.ID, map[string]interface{}{
+			"username": user.Username, "reason": reason, "ip": clientIP(r),
+		})
+		s.writePasswordChallenge(w, user.ID, reason)
 		return
 	}
+	s.afterPassword(w, r, user)
+}
 
-	token, err := GenerateToken(user.Username, user.Role)
+// afterPassword continues a login whose password is settled: it asks for
+// the second factor when there is one, or signs the user in.
+func (s *AuthService) afterPassword(w http.ResponseWriter, r *http.Request, user User) {
+	purpose, err := s.secondFactor(user.ID)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
+	if purpose != "" {
+		s.audit.Log(user.ID, "user.login.2fa_challenge", "user:"+user.ID, map[string]interface{}{
+			"username": user.Username, "purpose": purpose, "ip": clientIP(r),
+		})
+		s.writeChallenge(w, user.ID, purpose)
+		return
+	}
 
-	json.NewEncoder(w).Encode(map[string]string{
-		"token":   token,
-		"user_id": user.ID,
-		"role":    user.Role,
+	pair, err := s.startSession(user)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	s.loginSucceeded(user.Username)
+	s.audit.Log(user.ID, "user.login", "user:"+user.ID, map[string]interface{}{
+		"username": user.Username, "ip": clientIP(r),
 	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pair)
 }
 
 func (s *AuthService) ensureDefaultUser(username, password, role string) error {
@@ -331,6 +435,10 @@ func (s *AuthService) ensureDefaultUser(username, password, role string) error {
 	if err != nil {
 		return err
 	}
+	// The default password is public; make its first login replace it.
+	if err := s.passwords.Record(userID, hash, true); err != nil {
+		return err
+	}
 
 	log.Printf("Default user %s created", username)
 	return nil
@@ -348,7 +456,27 @@ func main() {
 		log.Fatalf("Failed to create database directory: %v", err)
 	}
 
-	svc, err := NewAuthService(dbPath)
+	keysPath := os.Getenv("AUTH_JWT_KEYS_PATH")
+	if keysPath == "" {
+		keysPath = filepath.Join(dir, "jwt-keys.json")
+	}
+	keys, err := openSigningKeys(keysPath)
+	if err != nil {
+		log.Fatalf("Failed to load JWT signing keys: %v", err)
+	}
+
+	// TOTP secrets are sealed with a key kept beside the signing keys, so
+	// the shared database alone does not reveal them.
+	totpKeyPath := os.Getenv("AUTH_TOTP_KEY_PATH")
+	if totpKeyPath == "" {
+		totpKeyPath = filepath.Join(filepath.Dir(keysPath), "totp.key")
+	}
+	totpKeys, err := mfa.OpenKeyFile(totpKeyPath)
+	if err != nil {
+		log.Fatalf("Failed to load TOTP key: %v", err)
+	}
+
+	svc, err := NewAuthService(dbPath, keys, totpKeys)
 	if err != nil {
 		log.Fatalf("Failed to initialize auth service: %v", err)
 	}
@@ -357,9 +485,37 @@ func main() {
 		log.Printf("Failed to ensure default user: %v", err)
 	}
 
+	go func() {
+		for now := range time.Tick(time.Hour) {
+			if err := svc.purgeExpiredSessions(now); err != nil {
+				log.Printf("Failed to purge expired sessions: %v", err)
+			}
+			if rotated, err := keys.RotateIfDue(now); err != nil {
+				log.Printf("Failed to rotate JWT signing key: %v", err)
+			} else if rotated {
+				kid, _ := keys.Signer()
+				log.Printf("Rotated JWT signing key, now signing with %s", kid)
+			}
+		}
+	}()
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/register", withRequestTrace("register", defaultAuthBodyLimit, svc.RegisterHandler))
 	mux.HandleFunc("/login", withRequestTrace("login", defaultAuthBodyLimit, svc.LoginHandler))
+	mux.HandleFunc("/login/2fa", withRequestTrace("login_2fa", defaultAuthBodyLimit, svc.LoginMFAHandler))
+	mux.HandleFunc("/login/2fa/enroll", withRequestTrace("login_2fa_enroll", defaultAuthBodyLimit, svc.LoginEnrollHandler))
+	mux.HandleFunc("/login/2fa/confirm", withRequestTrace("login_2fa_confirm", defaultAuthBodyLimit, svc.LoginConfirmHandler))
+	mux.HandleFunc("/login/password", withRequestTrace("login_password", defaultAuthBodyLimit, svc.LoginPasswordHandler))
+	mux.HandleFunc("/password", withRequestTrace("change_password", defaultAuthBodyLimit, svc.ChangePasswordHandler))
+	mux.HandleFunc("/2fa", withRequestTrace("2fa_status", defaultAuthBodyLimit, svc.MFAHandler))
+	mux.HandleFunc("/2fa/enroll", withRequestTrace("2fa_enroll", defaultAuthBodyLimit, svc.MFAEnrollHandler))
+	mux.HandleFunc("/2fa/confirm", withRequestTrace("2fa_confirm", defaultAuthBodyLimit, svc.MFAConfirmHandler))
+	mux.HandleFunc("/2fa/disable", withRequestTrace("2fa_disable", defaultAuthBodyLimit, svc.MFADisableHandler))
+	mux.HandleFunc("/2fa/recovery-codes", withRequestTrace("2fa_recovery_codes", defaultAuthBodyLimit, svc.MFARecoveryCodesHandler))
+	mux.HandleFunc("/refresh", withRequestTrace("refresh", defaultAuthBodyLimit, svc.RefreshHandler))
+	mux.HandleFunc("/logout", withRequestTrace("logout", defaultAuthBodyLimit, svc.LogoutHandler))
+	mux.HandleFunc("/sessions/revoke-all", withRequestTrace("revoke_all_sessions", defaultAuthBodyLimit, svc.RevokeAllSessionsHandler))
+	mux.HandleFunc("/.well-known/jwks.json", withRequestTrace("jwks", 0, svc.JWKSHandler))
 	mux.HandleFunc("/health", withRequestTrace("health", 0, func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintln(w, "Auth Service is running")
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lan-chat/lockout"
+	"lan-chat/mfa"
+
+	"github.com/google/uuid"
+)
+
+// newTestService opens an AuthService over a fresh database with its own
+// signing and TOTP keys. Failed logins wait a nanosecond instead of a
+// second, and nothing is sent to the audit service.
+func newTestService(t *testing.T) *AuthService {
+	t.Helper()
+	dir := t.TempDir()
+	keys, err := openSigningKeys(filepath.Join(dir, "jwt-keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	box, err := mfa.OpenKeyFile(filepath.Join(dir, "totp.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewAuthService(filepath.Join(dir, "auth.db"), keys, box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.audit = nil
+	t.Cleanup(func() { s.db.Close() })
+	setLockoutPolicy(t, s, testLockoutPolicy())
+	return s
+}
+
+func testLockoutPolicy() lockout.Policy {
+	p := lockout.DefaultPolicy()
+	p.BaseDelay = time.Nanosecond
+	return p
+}
+
+// setLockoutPolicy replaces the lockout policy NewAuthService read from
+// the environment.
+func setLockoutPolicy(t *testing.T, s *AuthService, p lockout.Policy) {
+	t.Helper()
+	guard, err := lockout.New(s.db, lockout.RealmUser, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.lockout = guard
+}
+
+// createTestUser adds a local user and returns its ID.
+func createTestUser(t *testing.T, s *AuthService, username, pw, role string) string {
+	t.Helper()
+	hash, err := HashPassword(pw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := uuid.New().String()
+	now := time.Now().Unix()
+	if _, err := s.db.Exec(`INSERT INTO users (id, username, full_name, password_hash, role_id, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		userID, username, username, hash, role, now, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.passwords.Record(userID, hash, false); err != nil {
+		t.Fatal(err)
+	}
+	return userID
+}
+
+// call sends body as JSON to h, with bearer as the access token when it is
+// not empty.
+func call(t *testing.T, h http.HandlerFunc, bearer string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
+
+// decode unmarshals a 200 response into v.
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s), want 200", rec.Code, rec.Body.String())
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decode %s: %v", rec.Body.String(), err)
+	}
+}
+
+// login signs username in with a password alone and returns the tokens.
+func login(t *testing.T, s *AuthService, username, pw string) TokenPair {
+	t.Helper()
+	var pair TokenPair
+	decode(t, call(t, s.LoginHandler, "", LoginRequest{Username: username, Password: pw}), &pair)
+	if pair.Token == "" || pair.RefreshToken == "" {
+		t.Fatalf("login %s returned no tokens: %+v", username, pair)
+	}
+	return pair
+}
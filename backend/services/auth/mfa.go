@@ -0,0 +1,436 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"lan-chat/lockout"
+	"lan-chat/mfa"
+)
+
+// totpIssuer is the account name authenticator apps show.
+var totpIssuer = envString("AUTH_TOTP_ISSUER", "LAN Chat")
+
+// Login challenges live for five minutes and allow five wrong codes.
+var loginChallenges = mfa.NewChallenges(5*time.Minute, 5)
+
+func envString(name, fallback string) string {
+	if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// MFAChallenge is the login response for a correct password when a second
+// factor is still needed. Purpose "verify" wants a code (or recovery code)
+// at /login/2fa; "enroll" means policy requires 2FA the user does not have
+// yet, set up via /login/2fa/enroll and /login/2fa/confirm.
+type MFAChallenge struct {
+	MFARequired bool     `json:"mfa_required"`
+	Challenge   string   `json:"challenge"`
+	Purpose     string   `json:"purpose"`
+	Methods     []string `json:"methods"`
+	ExpiresIn   int64    `json:"expires_in"`
+}
+
+// MFACodeRequest carries a challenge and/or a second factor.
+type MFACodeRequest struct {
+	Challenge    string `json:"challenge,omitempty"`
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+// EnabledResponse is returned when enrollment is confirmed: the recovery
+// codes, shown this once, and for login enrollment the session tokens.
+type EnabledResponse struct {
+	*TokenPair
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// mfaRequired reports whether policy requires a second factor for the
+// user's role or department.
+func (s *AuthService) mfaRequired(userID string) (bool, error) {
+	var roleID, departmentID sql.NullString
+	err := s.db.QueryRow(`SELECT role_id, department_id FROM users WHERE id = ?`, userID).Scan(&roleID, &departmentID)
+	if err != nil {
+		return false, err
+	}
+	return s.mfa.Required(
+		mfa.Requirement{Scope: mfa.ScopeRole, ID: roleID.String},
+		mfa.Requirement{Scope: mfa.ScopeDepartment, ID: departmentID.String},
+	)
+}
+
+// secondFactor decides what a user who got the password right must do
+// next: nothing (""), enter a code, or enroll.
+func (s *AuthService) secondFactor(userID string) (string, error) {
+	st, err := s.mfa.Status(userID)
+	if err != nil {
+		return "", err
+	}
+	if st.Enabled {
+		return mfa.PurposeVerify, nil
+	}
+	required, err := s.mfaRequired(userID)
+	if err != nil || !required {
+		return "", err
+	}
+	return mfa.PurposeEnroll, nil
+}
+
+func (s *AuthService) writeChallenge(w http.ResponseWriter, userID, purpose string) {
+	token, err := loginChallenges.Issue(userID, purpose)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	methods := []string{"totp", "recovery_code"}
+	if purpose == mfa.PurposeEnroll {
+		methods = []string{"totp"}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MFAChallenge{
+		MFARequired: true,
+		Challenge:   token,
+		Purpose:     purpose,
+		Methods:     methods,
+		ExpiresIn:   int64(loginChallenges.TTL() / time.Second),
+	})
+}
+
+// lookupUser loads the user a challenge or session belongs to.
+func (s *AuthService) lookupUser(userID string) (User, error) {
+	var user User
+	err := s.db.QueryRow(`
+		SELECT u.id, u.username, COALESCE(r.name, u.role_id, 'user')
+		FROM users u
+		LEFT JOIN roles r ON u.role_id = r.id
+		WHERE u.id = ?`, userID).Scan(&user.ID, &user.Username, &user.Role)
+	return user, err
+}
+
+// challengeFor decodes the request and returns its pending challenge, or
+// writes the error.
+func challengeFor(w http.ResponseWriter, r *http.Request, purpose string) (MFACodeRequest, mfa.Challenge, bool) {
+	var req MFACodeRequest
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return req, mfa.Challenge{}, false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Challenge == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return req, mfa.Challenge{}, false
+	}
+	ch, ok := loginChallenges.Get(req.Challenge)
+	if !ok || ch.Purpose != purpose {
+		http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return req, mfa.Challenge{}, false
+	}
+	return req, ch, true
+}
+
+// challengeUser loads the user a challenge was issued to and reserves the
+// attempt, or writes the error when the user is gone or locked out by
+// failed codes. Callers defer releaseAttempt.
+func (s *AuthService) challengeUser(w http.ResponseWriter, ch mfa.Challenge) (User, *lockout.Attempt, bool) {
+	user, err := s.lookupUser(ch.Subject)
+	if err != nil {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return user, nil, false
+	}
+	attempt, ok := s.beginAttempt(w, user.Username)
+	return user, attempt, ok
+}
+
+// failChallenge counts a wrong code against the challenge and against
+// the account's lockout.
+func (s *AuthService) failChallenge(w http.ResponseWriter, r *http.Request, req MFACodeRequest, ch mfa.Challenge, user User, attempt *lockout.Attempt) {
+	left := loginChallenges.Fail(req.Challenge)
+	s.loginFailed(r, attempt, user.ID, "2fa")
+	s.audit.Log(ch.Subject, "user.2fa.verify_failed", "user:"+ch.Subject, map[string]interface{}{
+		"purpose": ch.Purpose, "attempts_left": left, "ip": clientIP(r),
+	})
+	if left == 0 {
+		http.Error(w, "Too many invalid codes, log in again", http.StatusUnauthorized)
+		return
+	}
+	http.Error(w, "Invalid code", http.StatusUnauthorized)
+}
+
+// LoginMFAHandler completes a login with a TOTP code or a recovery code.
+func (s *AuthService) LoginMFAHandler(w http.ResponseWriter, r *http.Request) {
+	req, ch, ok := challengeFor(w, r, mfa.PurposeVerify)
+	if !ok {
+		return
+	}
+	user, attempt, ok := s.challengeUser(w, ch)
+	if !ok {
+		return
+	}
+	defer releaseAttempt(attempt)
+	method := "totp"
+	var err error
+	if req.RecoveryCode != "" {
+		method = "recovery_code"
+		var left int
+		left, err = s.mfa.UseRecoveryCode(ch.Subject, req.RecoveryCode)
+		if err == nil {
+			s.audit.Log(ch.Subject, "user.2fa.recovery_code_used", "user:"+ch.Subject, map[string]interface{}{
+				"recovery_codes_left": left, "ip": clientIP(r),
+			})
+		}
+	} else {
+		err = s.mfa.Verify(ch.Subject, req.Code)
+	}
+	switch {
+	case errors.Is(err, mfa.ErrInvalidCode):
+		s.failChallenge(w, r, req, ch, user, attempt)
+		return
+	case errors.Is(err, mfa.ErrNotEnrolled):
+		// Reset by an administrator since the password step.
+		loginChallenges.Complete(req.Challenge)
+		http.Error(w, "Two-factor authentication was reset, log in again", http.StatusUnauthorized)
+		return
+	case err != nil:
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	loginChallenges.Complete(req.Challenge)
+
+	pair, err := s.startSession(user)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	s.loginSucceeded(user.Username)
+	s.audit.Log(user.ID, "user.login", "user:"+user.ID, map[string]interface{}{
+		"username": user.Username, "second_factor": method, "ip": clientIP(r),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pair)
+}
+
+// LoginEnrollHandler starts the enrollment policy demands during login.
+func (s *AuthService) LoginEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	_, ch, ok := challengeFor(w, r, mfa.PurposeEnroll)
+	if !ok {
+		return
+	}
+	s.enroll(w, r, ch.Subject)
+}
+
+// LoginConfirmHandler confirms a login enrollment and signs the user in.
+func (s *AuthService) LoginConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	req, ch, ok := challengeFor(w, r, mfa.PurposeEnroll)
+	if !ok {
+		return
+	}
+	user, attempt, ok := s.challengeUser(w, ch)
+	if !ok {
+		return
+	}
+	defer releaseAttempt(attempt)
+	codes, err := s.mfa.Confirm(ch.Subject, req.Code)
+	switch {
+	case errors.Is(err, mfa.ErrInvalidCode):
+		s.failChallenge(w, r, req, ch, user, attempt)
+		return
+	case errors.Is(err, mfa.ErrNotEnrolled):
+		http.Error(w, "Start enrollment first", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	loginChallenges.Complete(req.Challenge)
+	s.audit.Log(ch.Subject, "user.2fa.enable", "user:"+ch.Subject, map[string]interface{}{
+		"during_login": true, "ip": clientIP(r),
+	})
+
+	pair, err := s.startSession(user)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	s.loginSucceeded(user.Username)
+	s.audit.Log(user.ID, "user.login", "user:"+user.ID, map[string]interface{}{
+		"username": user.Username, "second_factor": "totp", "ip": clientIP(r),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EnabledResponse{TokenPair: pair, RecoveryCodes: codes})
+}
+
+func (s *AuthService) enroll(w http.ResponseWriter, r *http.Request, userID string) {
+	user, err := s.lookupUser(userID)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	enrollment, err := s.mfa.Enroll(user.ID, user.Username, totpIssuer)
+	if errors.Is(err, mfa.ErrAlreadyEnrolled) {
+		http.Error(w, "Two-factor authentication already enabled", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	s.audit.Log(user.ID, "user.2fa.enroll", "user:"+user.ID, map[string]interface{}{"ip": clientIP(r)})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(enrollment)
+}
+
+// MFAStatusResponse is returned by GET /2fa.
+type MFAStatusResponse struct {
+	mfa.Status
+	Required bool `json:"required"`
+}
+
+// MFAHandler serves GET /2fa: whether the caller has 2FA and must have it.
+func (s *AuthService) MFAHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, err := s.authenticate(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	st, err := s.mfa.Status(claims.Subject)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	required, err := s.mfaRequired(claims.Subject)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MFAStatusResponse{Status: st, Required: required})
+}
+
+// MFAEnrollHandler starts enrollment for the signed-in user and returns the
+// secret and otpauth:// URI to show as a QR code.
+func (s *AuthService) MFAEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, err := s.authenticate(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.enroll(w, r, claims.Subject)
+}
+
+// MFAConfirmHandler enables 2FA once the first code checks out and returns
+// the recovery codes.
+func (s *AuthService) MFAConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	claims, req, ok := s.codeRequest(w, r)
+	if !ok {
+		return
+	}
+	codes, err := s.mfa.Confirm(claims.Subject, req.Code)
+	if !s.writeMFAError(w, r, claims.Subject, err) {
+		return
+	}
+	s.audit.Log(claims.Subject, "user.2fa.enable", "user:"+claims.Subject, map[string]interface{}{"ip": clientIP(r)})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EnabledResponse{RecoveryCodes: codes})
+}
+
+// MFADisableHandler turns 2FA off after a final code, unless policy
+// requires it for the user.
+func (s *AuthService) MFADisableHandler(w http.ResponseWriter, r *http.Request) {
+	claims, req, ok := s.codeRequest(w, r)
+	if !ok {
+		return
+	}
+	if required, err := s.mfaRequired(claims.Subject); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	} else if required {
+		http.Error(w, "Two-factor authentication is required for your account", http.StatusForbidden)
+		return
+	}
+	if !s.writeMFAError(w, r, claims.Subject, s.verifyAny(claims.Subject, req)) {
+		return
+	}
+	if _, err := s.mfa.Reset(claims.Subject); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	s.audit.Log(claims.Subject, "user.2fa.disable", "user:"+claims.Subject, map[string]interface{}{"ip": clientIP(r)})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MFARecoveryCodesHandler replaces the caller's recovery codes after a code
+// check.
+func (s *AuthService) MFARecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	claims, req, ok := s.codeRequest(w, r)
+	if !ok {
+		return
+	}
+	if !s.writeMFAError(w, r, claims.Subject, s.verifyAny(claims.Subject, req)) {
+		return
+	}
+	codes, err := s.mfa.RegenerateRecoveryCodes(claims.Subject)
+	if !s.writeMFAError(w, r, claims.Subject, err) {
+		return
+	}
+	s.audit.Log(claims.Subject, "user.2fa.recovery_codes_regenerate", "user:"+claims.Subject, map[string]interface{}{"ip": clientIP(r)})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EnabledResponse{RecoveryCodes: codes})
+}
+
+func (s *AuthService) codeRequest(w http.ResponseWriter, r *http.Request) (*Claims, MFACodeRequest, bool) {
+	var req MFACodeRequest
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, req, false
+	}
+	claims, err := s.authenticate(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, req, false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Code == "" && req.RecoveryCode == "") {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return nil, req, false
+	}
+	return claims, req, true
+}
+
+func (s *AuthService) verifyAny(userID string, req MFACodeRequest) error {
+	if req.RecoveryCode != "" {
+		_, err := s.mfa.UseRecoveryCode(userID, req.RecoveryCode)
+		return err
+	}
+	return s.mfa.Verify(userID, req.Code)
+}
+
+// writeMFAError reports err, if any, and whether the handler may go on.
+func (s *AuthService) writeMFAError(w http.ResponseWriter, r *http.Request, userID string, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, mfa.ErrInvalidCode):
+		s.audit.Log(userID, "user.2fa.verify_failed", "user:"+userID, map[string]interface{}{"ip": clientIP(r)})
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+	case errors.Is(err, mfa.ErrNotEnrolled):
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+	case errors.Is(err, mfa.ErrAlreadyEnrolled):
+		http.Error(w, "Two-factor authentication already enabled", http.StatusConflict)
+	default:
+		http.Error(w, "Server error", http.StatusInternalServerError)
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/base32"
+	"net/http"
+	"testing"
+	"time"
+
+	"lan-chat/mfa"
+)
+
+// totpSecret decodes the base32 secret an enrollment hands out.
+func totpSecret(t *testing.T, e mfa.Enrollment) []byte {
+	t.Helper()
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(e.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+// enableTOTP enrolls userID with the code of the current time step and
+// returns the secret and recovery codes. The next code a login accepts is
+// that of the following step.
+func enableTOTP(t *testing.T, s *AuthService, userID string) ([]byte, []string) {
+	t.Helper()
+	e, err := s.mfa.Enroll(userID, userID, totpIssuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := totpSecret(t, *e)
+	codes, err := s.mfa.Confirm(userID, mfa.Code(secret, mfa.Step(time.Now())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret, codes
+}
+
+// loginChallenge signs in with a password and expects a second-factor
+// challenge for purpose.
+func loginChallenge(t *testing.T, s *AuthService, username, pw, purpose string) string {
+	t.Helper()
+	var ch MFAChallenge
+	decode(t, call(t, s.LoginHandler, "", LoginRequest{Username: username, Password: pw}), &ch)
+	if !ch.MFARequired || ch.Challenge == "" || ch.Purpose != purpose {
+		t.Fatalf("login = %+v, want a %s challenge", ch, purpose)
+	}
+	return ch.Challenge
+}
+
+func TestLoginWithSecondFactor(t *testing.T) {
+	t.Parallel()
+	s := newTestService(t)
+	aliceID := createTestUser(t, s, "alice", "Correct-Horse-42", "user")
+	secret, recovery := enableTOTP(t, s, aliceID)
+
+	challenge := loginChallenge(t, s, "alice", "Correct-Horse-42", mfa.PurposeVerify)
+	next := mfa.Code(secret, mfa.Step(time.Now())+1)
+
+	// The challenge is not a token, and enrollment endpoints refuse it.
+	if accepted(s, challenge) {
+		t.Fatal("challenge accepted as an access token")
+	}
+	if rec := call(t, s.LoginConfirmHandler, "", MFACodeRequest{Challenge: challenge, Code: next}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("verify challenge at /login/2fa/confirm: status = %d, want 401", rec.Code)
+	}
+
+	var pair TokenPair
+	decode(t, call(t, s.LoginMFAHandler, "", MFACodeRequest{Challenge: challenge, Code: next}), &pair)
+	if pair.UserID != aliceID || !accepted(s, pair.Token) {
+		t.Fatalf("2fa login = %+v, want a session for alice", pair)
+	}
+	if rec := call(t, s.LoginMFAHandler, "", MFACodeRequest{Challenge: challenge, Code: next}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("completed challenge reused: status = %d, want 401", rec.Code)
+	}
+
+	// A recovery code stands in for the authenticator, once.
+	challenge = loginChallenge(t, s, "alice", "Correct-Horse-42", mfa.PurposeVerify)
+	decode(t, call(t, s.LoginMFAHandler, "", MFACodeRequest{Challenge: challenge, RecoveryCode: recovery[0]}), &pair)
+	if !accepted(s, pair.Token) {
+		t.Fatal("recovery code login returned a rejected token")
+	}
+	challenge = loginChallenge(t, s, "alice", "Correct-Horse-42", mfa.PurposeVerify)
+	if rec := call(t, s.LoginMFAHandler, "", MFACodeRequest{Challenge: challenge, RecoveryCode: recovery[0]}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("spent recovery code: status = %d, want 401", rec.Code)
+	}
+}
+
+func TestLoginEnrollsWhenPolicyRequires(t *testing.T) {
+	t.Parallel()
+	s := newTestService(t)
+	rootID := createTestUser(t, s, "root", "Admin-Password-42", "admin")
+	createTestUser(t, s, "alice", "Correct-Horse-42", "user")
+	if err := s.mfa.SetRequirements(mfa.ScopeRole, []string{"admin"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Users outside the policy sign in with the password alone.
+	login(t, s, "alice", "Correct-Horse-42")
+
+	challenge := loginChallenge(t, s, "root", "Admin-Password-42", mfa.PurposeEnroll)
+	if rec := call(t, s.LoginMFAHandler, "", MFACodeRequest{Challenge: challenge, Code: "000000"}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("enroll challenge at /login/2fa: status = %d, want 401", rec.Code)
+	}
+	var e mfa.Enrollment
+	decode(t, call(t, s.LoginEnrollHandler, "", MFACodeRequest{Challenge: challenge}), &e)
+	secret := totpSecret(t, e)
+
+	var enabled EnabledResponse
+	decode(t, call(t, s.LoginConfirmHandler, "", MFACodeRequest{Challenge: challenge, Code: mfa.Code(secret, mfa.Step(time.Now()))}), &enabled)
+	if enabled.TokenPair == nil || enabled.UserID != rootID || !accepted(s, enabled.Token) {
+		t.Fatalf("confirm = %+v, want a session for root", enabled)
+	}
+	if len(enabled.RecoveryCodes) != mfa.RecoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(enabled.RecoveryCodes), mfa.RecoveryCodeCount)
+	}
+
+	// From now on root has a second factor to enter.
+	loginChallenge(t, s, "root", "Admin-Password-42", mfa.PurposeVerify)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"lan-chat/password"
+)
+
+// purposePasswordChange marks login challenges that wait for a new
+// password, after an admin reset or once the password expired.
+const purposePasswordChange = "password_change"
+
+// PasswordChallenge is the login response when the password must change
+// before the login completes.
+type PasswordChallenge struct {
+	PasswordChangeRequired bool   `json:"password_change_required"`
+	Challenge              string `json:"challenge"`
+	Reason                 string `json:"reason"`
+	ExpiresIn              int64  `json:"expires_in"`
+}
+
+// LoginPasswordRequest answers a PasswordChallenge.
+type LoginPasswordRequest struct {
+	Challenge   string `json:"challenge"`
+	NewPassword string `json:"new_password"`
+}
+
+// ChangePasswordRequest is the body of /password.
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+func matchPassword(pw, hash string) bool {
+	ok, err := VerifyPassword(pw, hash)
+	return err == nil && ok
+}
+
+// checkNewPassword writes 400 and reports false when pw breaks the policy
+// or was used recently.
+func (s *AuthService) checkNewPassword(w http.ResponseWriter, user User, pw string) bool {
+	return writePasswordError(w, s.passwords.Check(user.ID, user.Username, pw, matchPassword))
+}
+
+// writePasswordError reports true for a nil err and otherwise writes why
+// the password was refused.
+func writePasswordError(w http.ResponseWriter, err error) bool {
+	var perr *password.Error
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &perr):
+		http.Error(w, "Password rejected: "+strings.Join(perr.Problems, "; "), http.StatusBadRequest)
+	case errors.Is(err, password.ErrReused):
+		http.Error(w, "Password was used recently, choose another", http.StatusBadRequest)
+	default:
+		http.Error(w, "Server error", http.StatusInternalServerError)
+	}
+	return false
+}
+
+// setPassword stores pw as the user's password and records it in the
+// history.
+func (s *AuthService) setPassword(userID, pw string) error {
+	hash, err := HashPassword(pw)
+	if err != nil {
+		return err
+	}
+	// The hash, its history and its age land together: a failure between
+	// them would leave a new password that still counts as expired, or one
+	// the history check does not know.
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE users SET password_hash = ?, updated_at = ? WHERE id = ?`, hash, time.Now().Unix(), userID); err != nil {
+		return err
+	}
+	if err := s.passwords.RecordTx(tx, userID, hash, false); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *AuthService) writePasswordChallenge(w http.ResponseWriter, userID, reason string) {
+	token, err := loginChallenges.Issue(userID, purposePasswordChange)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PasswordChallenge{
+		PasswordChangeRequired: true,
+		Challenge:              token,
+		Reason:                 reason,
+		ExpiresIn:              int64(loginChallenges.TTL() / time.Second),
+	})
+}
+
+// LoginPasswordHandler sets the new password a login was asked for and
+// carries on with the second factor, if any, or signs the user in.
+func (s *AuthService) LoginPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req LoginPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Challenge == "" || req.NewPassword == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	ch, ok := loginChallenges.Get(req.Challenge)
+	if !ok || ch.Purpose != purposePasswordChange {
+		http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+	user, attempt, ok := s.challengeUser(w, ch)
+	if !ok {
+		return
+	}
+	defer releaseAttempt(attempt)
+	if !s.checkNewPassword(w, user, req.NewPassword) {
+		return
+	}
+	if err := s.setPassword(user.ID, req.NewPassword); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	loginChallenges.Complete(req.Challenge)
+	s.audit.Log(user.ID, "user.password.change", "user:"+user.ID, map[string]interface{}{
+		"during_login": true, "ip": clientIP(r),
+	})
+	s.afterPassword(w, r, user)
+}
+
+// ChangePasswordHandler lets a signed-in user change their password. It
+// needs the current password and ends the user's other sessions.
+func (s *AuthService) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, err := s.authenticate(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.CurrentPassword == "" || req.NewPassword == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	var user User
+	err = s.db.QueryRow(`SELECT id, username, password_hash FROM users WHERE id = ?`, claims.Subject).
+		Scan(&user.ID, &user.Username, &user.PasswordHash)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if provider, err := s.identityProvider(user.ID); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	} else if provider != "" {
+		http.Error(w, "Password is managed by the directory, change it there", http.StatusConflict)
+		return
+	}
+	attempt, ok := s.beginAttempt(w, user.Username)
+	if !ok {
+		return
+	}
+	defer releaseAttempt(attempt)
+	if !matchPassword(req.CurrentPassword, user.PasswordHash) {
+		s.loginFailed(r, attempt, user.ID, "change_password")
+		http.Error(w, "Current password is incorrect", http.StatusForbidden)
+		return
+	}
+	if req.NewPassword == req.CurrentPassword {
+		http.Error(w, "New password must differ from the current one", http.StatusBadRequest)
+		return
+	}
+	if !s.checkNewPassword(w, user, req.NewPassword) {
+		return
+	}
+	if err := s.setPassword(user.ID, req.NewPassword); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	res, err := s.db.Exec(`UPDATE auth_sessions SET revoked_at = ?, revoke_reason = ? WHERE user_id = ? AND id != ? AND revoked_at IS NULL`,
+		time.Now().Unix(), revokePasswordChange, user.ID, claims.SessionID)
+	if err != nil {
+		log.Printf("revoke sessions after password change of %s: %v", user.ID, err)
+	}
+	var revoked int64
+	if res != nil {
+		revoked, _ = res.RowsAffected()
+	}
+	s.audit.Log(user.ID, "user.password.change", "user:"+user.ID, map[string]interface{}{
+		"revoked_sessions": revoked, "ip": clientIP(r),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "revoked_sessions": revoked})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"lan-chat/mfa"
+	"lan-chat/password"
+)
+
+// passwordChallenge signs in with a password and expects to be asked for a
+// new one first.
+func passwordChallenge(t *testing.T, s *AuthService, username, pw, reason string) string {
+	t.Helper()
+	var ch PasswordChallenge
+	decode(t, call(t, s.LoginHandler, "", LoginRequest{Username: username, Password: pw}), &ch)
+	if !ch.PasswordChangeRequired || ch.Challenge == "" || ch.Reason != reason {
+		t.Fatalf("login = %+v, want a %s password challenge", ch, reason)
+	}
+	return ch.Challenge
+}
+
+func TestLoginForcesChangeOfDefaultPassword(t *testing.T) {
+	t.Parallel()
+	s := newTestService(t)
+	if err := s.ensureDefaultUser("admin", "Default-Pass-1", "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	challenge := passwordChallenge(t, s, "admin", "Default-Pass-1", password.ReasonReset)
+	if accepted(s, challenge) {
+		t.Fatal("password challenge accepted as an access token")
+	}
+	if rec := call(t, s.LoginMFAHandler, "", MFACodeRequest{Challenge: challenge, Code: "000000"}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("password challenge at /login/2fa: status = %d, want 401", rec.Code)
+	}
+	if rec := call(t, s.LoginPasswordHandler, "", LoginPasswordRequest{Challenge: challenge, NewPassword: "short"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("weak new password: status = %d, want 400", rec.Code)
+	}
+
+	var pair TokenPair
+	decode(t, call(t, s.LoginPasswordHandler, "", LoginPasswordRequest{Challenge: challenge, NewPassword: "Fresh-Root-Pass-7"}), &pair)
+	if !accepted(s, pair.Token) {
+		t.Fatal("login after the password change returned a rejected token")
+	}
+	if rec := call(t, s.LoginPasswordHandler, "", LoginPasswordRequest{Challenge: challenge, NewPassword: "Another-Pass-8"}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("completed challenge reused: status = %d, want 401", rec.Code)
+	}
+
+	if rec := call(t, s.LoginHandler, "", LoginRequest{Username: "admin", Password: "Default-Pass-1"}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("default password after the change: status = %d, want 401", rec.Code)
+	}
+	login(t, s, "admin", "Fresh-Root-Pass-7")
+}
+
+func TestLoginForcesChangeOfExpiredPassword(t *testing.T) {
+	t.Parallel()
+	s := newTestService(t)
+	policy := password.DefaultPolicy()
+	policy.MaxAge = 30 * 24 * time.Hour
+	passwords, err := password.NewStore(s.db, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.passwords = passwords
+	aliceID := createTestUser(t, s, "alice", "Correct-Horse-42", "user")
+	secret, _ := enableTOTP(t, s, aliceID)
+	if _, err := s.db.Exec(`UPDATE password_state SET changed_at = ? WHERE user_id = ?`,
+		time.Now().Add(-31*24*time.Hour).Unix(), aliceID); err != nil {
+		t.Fatal(err)
+	}
+
+	challenge := passwordChallenge(t, s, "alice", "Correct-Horse-42", password.ReasonExpired)
+	if rec := call(t, s.LoginPasswordHandler, "", LoginPasswordRequest{Challenge: challenge, NewPassword: "Correct-Horse-42"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expired password again: status = %d, want 400", rec.Code)
+	}
+
+	// The new password settles the first step; the second factor follows.
+	var ch MFAChallenge
+	decode(t, call(t, s.LoginPasswordHandler, "", LoginPasswordRequest{Challenge: challenge, NewPassword: "Fresh-Horse-43"}), &ch)
+	if !ch.MFARequired || ch.Purpose != mfa.PurposeVerify {
+		t.Fatalf("after the password change = %+v, want a 2fa challenge", ch)
+	}
+	var pair TokenPair
+	decode(t, call(t, s.LoginMFAHandler, "", MFACodeRequest{Challenge: ch.Challenge, Code: mfa.Code(secret, mfa.Step(time.Now())+1)}), &pair)
+	if !accepted(s, pair.Token) {
+		t.Fatal("2fa after the password change returned a rejected token")
+	}
+
+	loginChallenge(t, s, "alice", "Fresh-Horse-43", mfa.PurposeVerify)
+}
+
+func TestFailedPasswordChangeKeepsOldPassword(t *testing.T) {
+	t.Parallel()
+	s := newTestService(t)
+	aliceID := createTestUser(t, s, "alice", "Correct-Horse-42", "user")
+	if _, err := s.db.Exec(`DROP TABLE password_state`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.setPassword(aliceID, "Fresh-Horse-43"); err == nil {
+		t.Fatal("expected the failed history write to be reported")
+	}
+	var hash string
+	if err := s.db.QueryRow(`SELECT password_hash FROM users WHERE id = ?`, aliceID).Scan(&hash); err != nil {
+		t.Fatal(err)
+	}
+	if !matchPassword("Correct-Horse-42", hash) {
+		t.Fatal("failed change replaced the password")
+	}
+}
+
+func TestPasswordHistoryKeepsLastPasswords(t *testing.T) {
+	t.Parallel()
+	s := newTestService(t)
+	policy := password.DefaultPolicy()
+	policy.History = 2
+	passwords, err := password.NewStore(s.db, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceID := createTestUser(t, s, "alice", "Correct-Horse-42", "user")
+	if _, err := s.db.Exec(`DELETE FROM password_history WHERE user_id = ?`, aliceID); err != nil {
+		t.Fatal(err)
+	}
+	old := []string{"Old-Horse-Pass-1", "Old-Horse-Pass-2", "Old-Horse-Pass-3"}
+	for i, pw := range old {
+		hash, err := HashPassword(pw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.db.Exec(`INSERT INTO password_history (user_id, password_hash, created_at) VALUES (?, ?, ?)`,
+			aliceID, hash, time.Now().Add(time.Duration(i-3)*time.Hour).Unix()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash, err := HashPassword("Fresh-Horse-43")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := passwords.Record(aliceID, hash, false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		password string
+		want     error
+	}{
+		{"Fresh-Horse-43", password.ErrReused},
+		{"Old-Horse-Pass-3", password.ErrReused},
+		{"Old-Horse-Pass-2", nil},
+		{"Old-Horse-Pass-1", nil},
+	} {
+		if err := passwords.Check(aliceID, "alice", tc.password, matchPassword); err != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.password, err, tc.want)
+		}
+	}
+	var n int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM password_history WHERE user_id = ?`, aliceID).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected the history to be pruned to 2 entries, got %d", n)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// sessionSchema stores login sessions and their refresh tokens. Messaging
+// reads auth_sessions from the shared database to reject access tokens of
+// revoked sessions, so the column set must stay in sync with its copy.
+const sessionSchema = `
+	CREATE TABLE IF NOT EXISTS auth_sessions (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		expires_at BIGINT NOT NULL, -- refresh deadline, slides forward on every refresh
+		revoked_at BIGINT,
+		revoke_reason TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_auth_sessions_user ON auth_sessions(user_id);
+	CREATE TABLE IF NOT EXISTS refresh_tokens (
+		token_hash TEXT PRIMARY KEY,
+		session_id TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		expires_at BIGINT NOT NULL,
+		used_at BIGINT
+	);
+	CREATE INDEX IF NOT EXISTS idx_refresh_tokens_session ON refresh_tokens(session_id);
+`
+
+// Session revocation reasons.
+const (
+	revokeLogout       = "logout"
+	revokeTokenReuse   = "refresh_token_reuse"
+	revokeAdmin        = "admin_revoke_all"
+	revokeUserRevoke   = "user_revoke_all"
+	revokeUserNotFound = "user_not_found"
+	// Other sessions end when the user changes the password.
+	revokePasswordChange = "password_change"
+)
+
+var (
+	accessTokenTTL  = envDuration("AUTH_ACCESS_TOKEN_TTL", 15*time.Minute)
+	refreshTokenTTL = envDuration("AUTH_REFRESH_TOKEN_TTL", 30*24*time.Hour)
+
+	errInvalidRefreshToken = errors.New("invalid refresh token")
+	errRefreshTokenReused  = errors.New("refresh token reused")
+	errSessionRevoked      = errors.New("session revoked")
+)
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("ignoring invalid %s=%q", name, v)
+	}
+	return fallback
+}
+
+// TokenPair is what /login and /refresh return.
+type TokenPair struct {
+	Token        string    `json:"token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresIn    int64     `json:"expires_in"` // access token lifetime in seconds
+	ExpiresAt    time.Time `json:"expires_at"`
+	UserID       string    `json:"user_id"`
+	Role         string    `json:"role"`
+}
+
+// RefreshRequest is the payload of /refresh and, optionally, /logout.
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func newRefreshToken() (string, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:]), nil
+}
+
+// hashRefreshToken is how refresh tokens are stored: a database leak must
+// not hand out working tokens.
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueRefreshToken stores a fresh refresh token for sessionID and slides
+// the session's refresh deadline forward.
+func issueRefreshToken(tx *sql.Tx, sessionID string, now time.Time) (string, error) {
+	token, err := newRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	expires := now.Add(refreshTokenTTL).Unix()
+	if _, err := tx.Exec(`INSERT INTO refresh_tokens (token_hash, session_id, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		hashRefreshToken(token), sessionID, now.Unix(), expires); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`UPDATE auth_sessions SET expires_at = ? WHERE id = ?`, expires, sessionID); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// startSession opens a new login session for user and returns its tokens.
+func (s *AuthService) startSession(user User) (*TokenPair, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	sessionID := uuid.New().String()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT INTO auth_sessions (id, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		sessionID, user.ID, now.Unix(), now.Add(refreshTokenTTL).Unix()); err != nil {
+		return nil, err
+	}
+	refresh, err := issueRefreshToken(tx, sessionID, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.tokenPair(user, sessionID, refresh)
+}
+
+func (s *AuthService) tokenPair(user User, sessionID, refresh string) (*TokenPair, error) {
+	token, expires, err := s.GenerateToken(user.ID, user.Username, user.Role, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		Token:        token,
+		RefreshToken: refresh,
+		ExpiresIn:    int64(time.Until(expires).Round(time.Second) / time.Second),
+		ExpiresAt:    expires.UTC(),
+		UserID:       user.ID,
+		Role:         user.Role,
+	}, nil
+}
+
+// rotateRefreshToken spends a refresh token and hands out its successor.
+// A token that was already spent means it leaked: the whole session is
+// revoked so neither the thief nor the owner can keep using it.
+func (s *AuthService) rotateRefreshToken(token string) (*TokenPair, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	hash := hashRefreshToken(token)
+	var sessionID string
+	var expiresAt int64
+	var usedAt sql.NullInt64
+	err = tx.QueryRow(`SELECT session_id, expires_at, used_at FROM refresh_tokens WHERE token_hash = ?`, hash).
+		Scan(&sessionID, &expiresAt, &usedAt)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if usedAt.Valid {
+		if err := revokeSession(tx, sessionID, revokeTokenReuse, now); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		log.Printf("refresh token reuse detected, session %s revoked", sessionID)
+		return nil, errRefreshTokenReused
+	}
+	if expiresAt < now.Unix() {
+		return nil, errInvalidRefreshToken
+	}
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET used_at = ? WHERE token_hash = ?`, now.Unix(), hash); err != nil {
+		return nil, err
+	}
+
+	var user User
+	var revokedAt sql.NullInt64
+	err = tx.QueryRow(`
+		SELECT s.revoked_at, u.id, u.username, COALESCE(r.name, u.role_id, 'user')
+		FROM auth_sessions s
+		JOIN users u ON u.id = s.user_id
+		LEFT JOIN roles r ON u.role_id = r.id
+		WHERE s.id = ?`, sessionID).
+		Scan(&revokedAt, &user.ID, &user.Username, &user.Role)
+	if err == sql.ErrNoRows {
+		// The session or its user is gone; nothing may refresh it again.
+		if err := revokeSession(tx, sessionID, revokeUserNotFound, now); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, errSessionRevoked
+	}
+	if err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid {
+		return nil, errSessionRevoked
+	}
+
+	refresh, err := issueRefreshToken(tx, sessionID, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.tokenPair(user, sessionID, refresh)
+}
+
+func revokeSession(tx *sql.Tx, sessionID, reason string, now time.Time) error {
+	_, err := tx.Exec(`UPDATE auth_sessions SET revoked_at = ?, revoke_reason = ? WHERE id = ? AND revoked_at IS NULL`,
+		now.Unix(), reason, sessionID)
+	return err
+}
+
+// sessionActive reports whether sessionID may still be used.
+func (s *AuthService) sessionActive(sessionID string) bool {
+	var expiresAt int64
+	var revokedAt sql.NullInt64
+	err := s.db.QueryRow(`SELECT expires_at, revoked_at FROM auth_sessions WHERE id = ?`, sessionID).Scan(&expiresAt, &revokedAt)
+	return err == nil && !revokedAt.Valid && expiresAt >= time.Now().Unix()
+}
+
+// authenticate accepts a bearer access token whose session is still active.
+func (s *AuthService) authenticate(r *http.Request) (*Claims, error) {
+	raw := r.Header.Get("Authorization")
+	if len(raw) < 7 || !strings.EqualFold(raw[:7], "Bearer ") {
+		return nil, errSessionRevoked
+	}
+	claims, err := s.ValidateToken(raw[7:])
+	if err != nil {
+		return nil, err
+	}
+	if claims.SessionID == "" || !s.sessionActive(claims.SessionID) {
+		return nil, errSessionRevoked
+	}
+	return claims, nil
+}
+
+// RefreshHandler exchanges a refresh token for a new access token and a new
+// refresh token. Each refresh token works once.
+func (s *AuthService) RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	pair, err := s.rotateRefreshToken(req.RefreshToken)
+	switch {
+	case errors.Is(err, errRefreshTokenReused):
+		http.Error(w, "Refresh token reused, session revoked", http.StatusUnauthorized)
+		return
+	case errors.Is(err, errInvalidRefreshToken), errors.Is(err, errSessionRevoked):
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	case err != nil:
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pair)
+}
+
+// LogoutHandler revokes the session of the bearer access token or, when the
+// access token already expired, of the refresh token in the body.
+func (s *AuthService) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var sessionID string
+	if claims, err := s.authenticate(r); err == nil {
+		sessionID = claims.SessionID
+	} else {
+		var req RefreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err == nil && req.RefreshToken != "" {
+			_ = s.db.QueryRow(`SELECT session_id FROM refresh_tokens WHERE token_hash = ?`, hashRefreshToken(req.RefreshToken)).Scan(&sessionID)
+		}
+	}
+	if sessionID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if _, err := s.db.Exec(`UPDATE auth_sessions SET revoked_at = ?, revoke_reason = ? WHERE id = ? AND revoked_at IS NULL`,
+		time.Now().Unix(), revokeLogout, sessionID); err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeAllRequest names the user whose sessions /sessions/revoke-all ends.
+type RevokeAllRequest struct {
+	UserID string `json:"user_id"`
+}
+
+// RevokeAllSessionsHandler signs a user out everywhere. Users may revoke
+// their own sessions; revoking someone else's requires an admin token.
+func (s *AuthService) RevokeAllSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, err := s.authenticate(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req RevokeAllRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	reason := revokeUserRevoke
+	if req.UserID == "" {
+		req.UserID = claims.Subject
+	} else if req.UserID != claims.Subject {
+		if claims.Role != "admin" && claims.Role != "super_admin" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		reason = revokeAdmin
+	}
+	res, err := s.db.Exec(`UPDATE auth_sessions SET revoked_at = ?, revoke_reason = ? WHERE user_id = ? AND revoked_at IS NULL`,
+		time.Now().Unix(), reason, req.UserID)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	revoked, _ := res.RowsAffected()
+	log.Printf("%s revoked %d sessions of user %s", claims.Username, revoked, req.UserID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"user_id": req.UserID, "revoked": revoked})
+}
+
+// purgeExpiredSessions drops refresh tokens past their deadline and
+// sessions no access token can still point at.
+func (s *AuthService) purgeExpiredSessions(now time.Time) error {
+	if _, err := s.db.Exec(`DELETE FROM refresh_tokens WHERE expires_at < ?`, now.Unix()); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`DELETE FROM auth_sessions WHERE expires_at < ?`, now.Add(-accessTokenTTL).Unix())
+	return err
+}
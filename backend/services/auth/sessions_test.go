@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// sessionOf returns the session an access token belongs to.
+func sessionOf(t *testing.T, s *AuthService, token string) string {
+	t.Helper()
+	claims, err := s.ValidateToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claims.SessionID
+}
+
+// accepted reports whether the service still accepts an access token.
+func accepted(s *AuthService, token string) bool {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	_, err := s.authenticate(req)
+	return err == nil
+}
+
+// revokeReason returns why a session was revoked, or "" while it is active.
+func revokeReason(t *testing.T, s *AuthService, sessionID string) string {
+	t.Helper()
+	var reason sql.NullString
+	if err := s.db.QueryRow(`SELECT revoke_reason FROM auth_sessions WHERE id = ?`, sessionID).Scan(&reason); err != nil {
+		t.Fatal(err)
+	}
+	return reason.String
+}
+
+func TestRefreshRotatesAndRevokesOnReuse(t *testing.T) {
+	t.Parallel()
+	s := newTestService(t)
+	createTestUser(t, s, "alice", "Correct-Horse-42", "user")
+	first := login(t, s, "alice", "Correct-Horse-42")
+	other := login(t, s, "alice", "Correct-Horse-42")
+
+	var second TokenPair
+	decode(t, call(t, s.RefreshHandler, "", RefreshRequest{RefreshToken: first.RefreshToken}), &second)
+	if second.RefreshToken == first.RefreshToken {
+		t.Fatal("refresh returned the spent refresh token")
+	}
+	if sessionOf(t, s, second.Token) != sessionOf(t, s, first.Token) {
+		t.Fatal("refresh moved the login to another session")
+	}
+	if !accepted(s, second.Token) {
+		t.Fatal("refreshed access token rejected")
+	}
+
+	// Spending the first token again means it leaked.
+	if rec := call(t, s.RefreshHandler, "", RefreshRequest{RefreshToken: first.RefreshToken}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("reused refresh token: status = %d, want 401", rec.Code)
+	}
+	if got := revokeReason(t, s, sessionOf(t, s, first.Token)); got != revokeTokenReuse {
+		t.Fatalf("revoke reason = %q, want %q", got, revokeTokenReuse)
+	}
+	if rec := call(t, s.RefreshHandler, "", RefreshRequest{RefreshToken: second.RefreshToken}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("successor of a reused token: status = %d, want 401", rec.Code)
+	}
+	if accepted(s, second.Token) {
+		t.Fatal("access token of the revoked session still accepted")
+	}
+
+	if !accepted(s, other.Token) || revokeReason(t, s, sessionOf(t, s, other.Token)) != "" {
+		t.Fatal("reuse revoked the user's other session")
+	}
+	if rec := call(t, s.RefreshHandler, "", RefreshRequest{RefreshToken: "not-a-token"}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("unknown refresh token: status = %d, want 401", rec.Code)
+	}
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+	t.Parallel()
+	s := newTestService(t)
+	createTestUser(t, s, "alice", "Correct-Horse-42", "user")
+	pair := login(t, s, "alice", "Correct-Horse-42")
+	expired := login(t, s, "alice", "Correct-Horse-42")
+
+	if rec := call(t, s.LogoutHandler, pair.Token, struct{}{}); rec.Code != http.StatusNoContent {
+		t.Fatalf("logout: status = %d, want 204", rec.Code)
+	}
+	if accepted(s, pair.Token) {
+		t.Fatal("access token accepted after logout")
+	}
+	if rec := call(t, s.RefreshHandler, "", RefreshRequest{RefreshToken: pair.RefreshToken}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("refresh after logout: status = %d, want 401", rec.Code)
+	}
+	if got := revokeReason(t, s, sessionOf(t, s, pair.Token)); got != revokeLogout {
+		t.Fatalf("revoke reason = %q, want %q", got, revokeLogout)
+	}
+
+	// A client whose access token expired logs out with the refresh token.
+	if rec := call(t, s.LogoutHandler, "", RefreshRequest{RefreshToken: expired.RefreshToken}); rec.Code != http.StatusNoContent {
+		t.Fatalf("logout by refresh token: status = %d, want 204", rec.Code)
+	}
+	if accepted(s, expired.Token) {
+		t.Fatal("session still active after logout by refresh token")
+	}
+
+	if rec := call(t, s.LogoutHandler, "", RefreshRequest{RefreshToken: "not-a-token"}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("logout without a session: status = %d, want 401", rec.Code)
+	}
+}
+
+func TestRevokeAllSessionsAuthorization(t *testing.T) {
+	t.Parallel()
+	s := newTestService(t)
+	aliceID := createTestUser(t, s, "alice", "Correct-Horse-42", "user")
+	bobID := createTestUser(t, s, "bob", "Battery-Staple-42", "user")
+	createTestUser(t, s, "root", "Admin-Password-42", "admin")
+	alice := []TokenPair{login(t, s, "alice", "Correct-Horse-42"), login(t, s, "alice", "Correct-Horse-42")}
+	bob := login(t, s, "bob", "Battery-Staple-42")
+	admin := login(t, s, "root", "Admin-Password-42")
+
+	if rec := call(t, s.RevokeAllSessionsHandler, "", RevokeAllRequest{UserID: bobID}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("without a token: status = %d, want 401", rec.Code)
+	}
+	if rec := call(t, s.RevokeAllSessionsHandler, alice[0].Token, RevokeAllRequest{UserID: bobID}); rec.Code != http.StatusForbidden {
+		t.Fatalf("user revoking another user: status = %d, want 403", rec.Code)
+	}
+	if !accepted(s, bob.Token) {
+		t.Fatal("refused revocation still ended bob's session")
+	}
+
+	var res struct {
+		UserID  string `json:"user_id"`
+		Revoked int64  `json:"revoked"`
+	}
+	decode(t, call(t, s.RevokeAllSessionsHandler, admin.Token, RevokeAllRequest{UserID: bobID}), &res)
+	if res.UserID != bobID || res.Revoked != 1 {
+		t.Fatalf("admin revoke = %+v, want bob's one session", res)
+	}
+	if accepted(s, bob.Token) || revokeReason(t, s, sessionOf(t, s, bob.Token)) != revokeAdmin {
+		t.Fatal("admin revocation did not end bob's session")
+	}
+	if !accepted(s, admin.Token) || !accepted(s, alice[0].Token) {
+		t.Fatal("admin revocation ended other users' sessions")
+	}
+
+	// Without a user_id the caller signs themselves out everywhere.
+	decode(t, call(t, s.RevokeAllSessionsHandler, alice[0].Token, struct{}{}), &res)
+	if res.UserID != aliceID || res.Revoked != 2 {
+		t.Fatalf("self revoke = %+v, want alice's two sessions", res)
+	}
+	for _, pair := range alice {
+		if accepted(s, pair.Token) || revokeReason(t, s, sessionOf(t, s, pair.Token)) != revokeUserRevoke {
+			t.Fatal("self revocation left a session active")
+		}
+	}
+}
@@ -1,42 +1,71 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"time"
 
+	"lan-chat/jwks"
+
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
-var jwtKey = []byte("my_secret_key") // In production, load from ENV/Secret Manager
+var (
+	jwtRotateEvery = envDuration("AUTH_JWT_ROTATE_EVERY", 30*24*time.Hour)
+	jwtKeyGrace    = envDuration("AUTH_JWT_KEY_GRACE", 24*time.Hour)
+)
 
 type Claims struct {
-	Username string `json:"username"`
-	Role     string `json:"role"`
+	Username  string `json:"username"`
+	Role      string `json:"role"`
+	SessionID string `json:"sid,omitempty"`
 	jwt.RegisteredClaims
 }
 
-// GenerateToken creates a new JWT token for a user.
-func GenerateToken(username, role string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
+// openSigningKeys loads or creates the keyring at path. Retired keys stay
+// published at least as long as the access tokens they signed.
+func openSigningKeys(path string) (*jwks.Keyring, error) {
+	grace := jwtKeyGrace
+	if grace < accessTokenTTL {
+		grace = accessTokenTTL
+	}
+	return jwks.OpenKeyring(path, jwtRotateEvery, grace)
+}
+
+// GenerateToken creates a short-lived access token for a user's session.
+// Longer access comes from refreshing the session, which can be revoked.
+func (s *AuthService) GenerateToken(userID, username, role, sessionID string) (string, time.Time, error) {
+	now := time.Now()
+	expirationTime := now.Add(accessTokenTTL)
 	claims := &Claims{
-		Username: username,
-		Role:     role,
+		Username:  username,
+		Role:      role,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Subject:   userID,
+			IssuedAt:  jwt.NewNumericDate(now),
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			Issuer:    "lan-chat-auth",
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtKey)
+	kid, key := s.keys.Signer()
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	return signed, expirationTime, err
 }
 
 // ValidateToken parses and validates a JWT token.
-func ValidateToken(tokenString string) (*Claims, error) {
+func (s *AuthService) ValidateToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
+		kid, _ := token.Header["kid"].(string)
+		return s.keys.PublicKey(kid)
+	}, jwt.WithValidMethods([]string{jwks.Algorithm}))
 
 	if err != nil {
 		return nil, err
@@ -48,3 +77,14 @@ func ValidateToken(tokenString string) (*Claims, error) {
 
 	return claims, nil
 }
+
+// JWKSHandler publishes the public keys that verify access tokens.
+func (s *AuthService) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(s.keys.Set())
+}
@@ -2,8 +2,8 @@ module lan-chat/discovery
 
 go 1.22
 
-require (
-    lan-chat/protocol v0.0.0
-)
+require lan-chat/protocol v0.0.0
+
+require google.golang.org/protobuf v1.34.2 // indirect
 
 replace lan-chat/protocol => ../../pkg/protocol
@@ -28,6 +28,10 @@ type DiscoveryService struct {
 	Peers     map[string]*protocol.PeerInfo
 	mu        sync.RWMutex
 	conn      *net.UDPConn
+
+	// Binary announces with the Protobuf encoding. Receivers accept both, so
+	// enable it only once every node runs a version that can decode it.
+	Binary bool
 }
 
 func NewDiscoveryService(nodeID, clusterID string, port int) *DiscoveryService {
@@ -89,7 +93,11 @@ func (s *DiscoveryService) broadcast(addr *net.UDPAddr) {
 		PublicKey: []byte("dummy-key"),
 	}
 
-	data, err := packet.Encode()
+	encode := packet.Encode
+	if s.Binary {
+		encode = packet.EncodeBinary
+	}
+	data, err := encode()
 	if err != nil {
 		log.Printf("Error encoding packet: %v", err)
 		return
@@ -180,6 +188,7 @@ func main() {
 	}
 
 	svc := NewDiscoveryService(nodeID, clusterID, port)
+	svc.Binary = os.Getenv("DISCOVERY_WIRE_FORMAT") == "proto"
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
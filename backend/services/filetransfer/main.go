@@ -4,6 +4,8 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -11,6 +13,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -24,10 +27,31 @@ const StorageDir = "./storage"
 const requestIDHeader = "X-Request-ID"
 const defaultUploadLimit = 20 << 20 // 20 MiB
 
+// serviceTokenHeader carries the secret shared with messaging, which reads
+// file records without acting for a user.
+const serviceTokenHeader = "X-Service-Token"
+
 var fileLimiter = newIPRateLimiter(45, time.Minute)
 
 type FileTransferService struct {
-	storagePath string
+	storagePath  string
+	authzURL     string // messaging /attachments/authorize; empty disables access checks
+	serviceToken string // lets messaging read file records; empty disables it
+	client       *http.Client
+}
+
+// FileRecord is the metadata kept next to each encrypted blob. Its JSON form
+// matches protocol.Attachment so messaging can validate descriptors.
+type FileRecord struct {
+	FileID    string `json:"file_id"`
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	MimeType  string `json:"mime_type"`
+	SHA256    string `json:"sha256"`
+	CreatedAt int64  `json:"created_at"`
+	// UploadedBy is the user ID messaging vouched for at upload time. It is
+	// empty when access checks are disabled.
+	UploadedBy string `json:"uploaded_by,omitempty"`
 }
 
 type statusRecorder struct {
@@ -138,7 +162,26 @@ func NewFileTransferService(path string) *FileTransferService {
 	if err := os.MkdirAll(path, 0700); err != nil {
 		log.Fatalf("Failed to create storage dir: %v", err)
 	}
-	return &FileTransferService{storagePath: path}
+	return &FileTransferService{
+		storagePath: path,
+		client:      &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (s *FileTransferService) metaPath(fileID string) string {
+	return filepath.Join(s.storagePath, fileID+".meta.json")
+}
+
+func (s *FileTransferService) loadRecord(fileID string) (*FileRecord, error) {
+	data, err := os.ReadFile(s.metaPath(fileID))
+	if err != nil {
+		return nil, err
+	}
+	var rec FileRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
 }
 
 // UploadHandler handles file uploads and encrypts them at rest.
@@ -147,6 +190,11 @@ func (s *FileTransferService) UploadHandler(w http.ResponseWriter, r *http.Reque
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	uploader, status := s.authorize(r, "action=upload")
+	if status != 0 {
+		http.Error(w, strings.ToLower(http.StatusText(status)), status)
+		return
+	}
 	if ct := r.Header.Get("Content-Type"); !strings.Contains(ct, "multipart/form-data") {
 		http.Error(w, "Content-Type must be multipart/form-data", http.StatusBadRequest)
 		return
@@ -214,6 +262,21 @@ func (s *FileTransferService) UploadHandler(w http.ResponseWriter, r *http.Reque
 	// Encrypt
 	ciphertext := aesGCM.Seal(nil, iv, content, nil)
 
+	digest := sha256.Sum256(content)
+	mimeType := header.Header.Get("Content-Type")
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = http.DetectContentType(content)
+	}
+	record := FileRecord{
+		FileID:     fileID,
+		Name:       header.Filename,
+		Size:       int64(len(content)),
+		MimeType:   mimeType,
+		SHA256:     hex.EncodeToString(digest[:]),
+		CreatedAt:  time.Now().Unix(),
+		UploadedBy: uploader,
+	}
+
 	// Write IV + Ciphertext
 	if _, err := out.Write(iv); err != nil {
 		http.Error(w, "Write error", http.StatusInternalServerError)
@@ -224,9 +287,119 @@ func (s *FileTransferService) UploadHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	meta, err := json.Marshal(record)
+	if err != nil {
+		http.Error(w, "Write error", http.StatusInternalServerError)
+		return
+	}
+	if err := os.WriteFile(s.metaPath(fileID), meta, 0600); err != nil {
+		http.Error(w, "Write error", http.StatusInternalServerError)
+		return
+	}
+
 	// Return File ID and Key (Key should be protected/wrapped in real app)
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	fmt.Fprintf(w, `{"file_id": "%s", "key": "%x"}`, fileID, key)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"file_id":   fileID,
+		"key":       hex.EncodeToString(key),
+		"name":      record.Name,
+		"size":      record.Size,
+		"mime_type": record.MimeType,
+		"sha256":    record.SHA256,
+	})
+}
+
+// MetaHandler returns the FileRecord of an uploaded file to messaging
+// (by service token) or to a user who may download the file.
+func (s *FileTransferService) MetaHandler(w http.ResponseWriter, r *http.Request) {
+	fileID := r.URL.Query().Get("id")
+	if _, err := uuid.Parse(fileID); err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+	rec, err := s.loadRecord(fileID)
+	if err != nil {
+		if s.isService(r) || s.authzURL == "" {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		// Unknown files look the same as files the caller may not see.
+		rec = &FileRecord{FileID: fileID}
+	}
+	if !s.isService(r) {
+		if status := s.authorizeFile(r, rec); status != 0 {
+			http.Error(w, strings.ToLower(http.StatusText(status)), status)
+			return
+		}
+		if rec.Name == "" {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rec)
+}
+
+// isService reports whether r carries the token shared with messaging.
+func (s *FileTransferService) isService(r *http.Request) bool {
+	got := r.Header.Get(serviceTokenHeader)
+	return s.serviceToken != "" && got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(s.serviceToken)) == 1
+}
+
+// authorizeFile lets the uploader of rec and members of a channel it was
+// shared in through. It returns the HTTP status to answer with when access
+// is denied, or 0.
+func (s *FileTransferService) authorizeFile(r *http.Request, rec *FileRecord) int {
+	q := "file_id=" + url.QueryEscape(rec.FileID)
+	if rec.UploadedBy != "" {
+		q += "&uploaded_by=" + url.QueryEscape(rec.UploadedBy)
+	}
+	_, status := s.authorize(r, q)
+	return status
+}
+
+// authorize asks the messaging service about the caller with query. It
+// returns the user ID messaging named, and the HTTP status to answer with
+// when access is denied or 0 when the request may proceed.
+func (s *FileTransferService) authorize(r *http.Request, query string) (string, int) {
+	if s.authzURL == "" {
+		return "", 0
+	}
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		// Links opened directly in a browser cannot set headers.
+		if tok := r.URL.Query().Get("token"); tok != "" {
+			auth = "Bearer " + tok
+		}
+	}
+	if auth == "" {
+		return "", http.StatusUnauthorized
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, s.authzURL+"?"+query, nil)
+	if err != nil {
+		return "", http.StatusInternalServerError
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set(requestIDHeader, r.Header.Get(requestIDHeader))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Printf("authorization (%s) failed: %v", query, err)
+		return "", http.StatusBadGateway
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var out struct {
+			UserID string `json:"user_id"`
+		}
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&out)
+		return out.UserID, 0
+	case http.StatusUnauthorized, http.StatusNotFound:
+		return "", resp.StatusCode
+	default:
+		return "", http.StatusForbidden
+	}
 }
 
 // DownloadHandler serves encrypted files.
@@ -240,6 +413,15 @@ func (s *FileTransferService) DownloadHandler(w http.ResponseWriter, r *http.Req
 		http.Error(w, "Invalid file ID", http.StatusBadRequest)
 		return
 	}
+	rec, err := s.loadRecord(fileID)
+	if err != nil {
+		// Files from before records were kept are authorised by sharing alone.
+		rec = &FileRecord{FileID: fileID}
+	}
+	if status := s.authorizeFile(r, rec); status != 0 {
+		http.Error(w, strings.ToLower(http.StatusText(status)), status)
+		return
+	}
 
 	// In a real app, strict path sanitization is needed
 	matches, _ := filepath.Glob(filepath.Join(s.storagePath, fileID+"*.enc"))
@@ -253,10 +435,23 @@ func (s *FileTransferService) DownloadHandler(w http.ResponseWriter, r *http.Req
 
 func main() {
 	svc := NewFileTransferService(StorageDir)
+	svc.authzURL = os.Getenv("FILETRANSFER_AUTHZ_URL")
+	svc.serviceToken = os.Getenv("FILETRANSFER_SERVICE_TOKEN")
+	if svc.authzURL == "" {
+		svc.authzURL = "http://localhost:8081/attachments/authorize"
+	}
+	if svc.authzURL == "off" {
+		log.Println("WARNING: upload and download authorization disabled (FILETRANSFER_AUTHZ_URL=off)")
+		svc.authzURL = ""
+	}
+	if svc.authzURL != "" && svc.serviceToken == "" {
+		log.Fatal("FILETRANSFER_SERVICE_TOKEN is required while authorization is on; messaging cannot read file records without it")
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/upload", withRequestTrace("upload", defaultUploadLimit+1024*1024, svc.UploadHandler))
 	mux.HandleFunc("/download", withRequestTrace("download", 0, svc.DownloadHandler))
+	mux.HandleFunc("/files/meta", withRequestTrace("files-meta", 0, svc.MetaHandler))
 	mux.HandleFunc("/health", withRequestTrace("health", 0, func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintln(w, "File Transfer Service is running")
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// uploadTestFile uploads content as bearer; bearer may be empty when
+// authorization is disabled.
+func uploadTestFile(t *testing.T, svc *FileTransferService, bearer, name string, content []byte) map[string]interface{} {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatalf("create form file: %v", err)
+	}
+	_, _ = fw.Write(content)
+	_ = mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	rec := httptest.NewRecorder()
+	svc.UploadHandler(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("upload failed: %d %s", rec.Code, rec.Body.String())
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatalf("decode upload response: %v", err)
+	}
+	return out
+}
+
+func TestUploadStoresFileRecord(t *testing.T) {
+	svc := NewFileTransferService(t.TempDir())
+	content := []byte("%PDF-1.4 quarterly numbers")
+	up := uploadTestFile(t, svc, "", "report.pdf", content)
+
+	fileID, _ := up["file_id"].(string)
+	metaReq := httptest.NewRequest(http.MethodGet, "/files/meta?id="+fileID, nil)
+	metaRec := httptest.NewRecorder()
+	svc.MetaHandler(metaRec, metaReq)
+	if metaRec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", metaRec.Code)
+	}
+	var rec FileRecord
+	if err := json.Unmarshal(metaRec.Body.Bytes(), &rec); err != nil {
+		t.Fatalf("decode record: %v", err)
+	}
+	digest := sha256.Sum256(content)
+	if rec.FileID != fileID || rec.Name != "report.pdf" || rec.Size != int64(len(content)) ||
+		rec.SHA256 != hex.EncodeToString(digest[:]) || rec.MimeType != "application/pdf" {
+		t.Fatalf("unexpected record %+v", rec)
+	}
+	if up["sha256"] != rec.SHA256 {
+		t.Fatalf("upload response and record disagree: %v vs %s", up["sha256"], rec.SHA256)
+	}
+
+	missing := httptest.NewRecorder()
+	svc.MetaHandler(missing, httptest.NewRequest(http.MethodGet, "/files/meta?id=7b0c2c7e-4a44-4c55-9d59-4f1f1b0e0a11", nil))
+	if missing.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown file, got %d", missing.Code)
+	}
+}
+
+// newTestAuthz stands in for messaging's /attachments/authorize: "member"
+// may read every shared file, "outsider" none, and "uploader" only what it
+// uploaded.
+func newTestAuthz(t *testing.T) *httptest.Server {
+	t.Helper()
+	users := map[string]string{
+		"Bearer member":   "u-member",
+		"Bearer outsider": "u-outsider",
+		"Bearer uploader": "u-uploader",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := users[r.Header.Get("Authorization")]
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		q := r.URL.Query()
+		allowed := q.Get("action") == "upload" || q.Get("uploaded_by") == userID || userID == "u-member"
+		if !allowed {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "user_id": userID})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDownloadRequiresChannelMembership(t *testing.T) {
+	svc := NewFileTransferService(t.TempDir())
+	svc.authzURL = newTestAuthz(t).URL
+	fileID := uploadTestFile(t, svc, "member", "notes.txt", []byte("hello"))["file_id"].(string)
+
+	cases := []struct {
+		name   string
+		header string
+		query  string
+		want   int
+	}{
+		{"anonymous", "", "", http.StatusUnauthorized},
+		{"outsider", "Bearer outsider", "", http.StatusForbidden},
+		{"member header", "Bearer member", "", http.StatusOK},
+		{"member query token", "", "&token=member", http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/download?id="+fileID+c.query, nil)
+		if c.header != "" {
+			req.Header.Set("Authorization", c.header)
+		}
+		rec := httptest.NewRecorder()
+		svc.DownloadHandler(rec, req)
+		if rec.Code != c.want {
+			t.Fatalf("%s: expected %d, got %d", c.name, c.want, rec.Code)
+		}
+	}
+}
+
+func TestUploaderCanReadUnsharedFile(t *testing.T) {
+	svc := NewFileTransferService(t.TempDir())
+	svc.authzURL = newTestAuthz(t).URL
+	svc.serviceToken = "svc-token"
+
+	anon := httptest.NewRequest(http.MethodPost, "/upload", nil)
+	anonRec := httptest.NewRecorder()
+	svc.UploadHandler(anonRec, anon)
+	if anonRec.Code != http.StatusUnauthorized {
+		t.Fatalf("anonymous upload: expected 401, got %d", anonRec.Code)
+	}
+
+	fileID := uploadTestFile(t, svc, "uploader", "draft.txt", []byte("draft"))["file_id"].(string)
+
+	get := func(handler http.HandlerFunc, path string, header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path+"?id="+fileID, nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	if rec := get(svc.DownloadHandler, "/download", "Authorization", "Bearer uploader"); rec.Code != http.StatusOK {
+		t.Fatalf("uploader download: expected 200, got %d", rec.Code)
+	}
+	if rec := get(svc.DownloadHandler, "/download", "Authorization", "Bearer outsider"); rec.Code != http.StatusForbidden {
+		t.Fatalf("outsider download: expected 403, got %d", rec.Code)
+	}
+
+	if rec := get(svc.MetaHandler, "/files/meta", "", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("anonymous meta: expected 401, got %d", rec.Code)
+	}
+	if rec := get(svc.MetaHandler, "/files/meta", "Authorization", "Bearer outsider"); rec.Code != http.StatusForbidden {
+		t.Fatalf("outsider meta: expected 403, got %d", rec.Code)
+	}
+	if rec := get(svc.MetaHandler, "/files/meta", serviceTokenHeader, "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong service token: expected 401, got %d", rec.Code)
+	}
+	for _, c := range []struct{ header, value string }{
+		{"Authorization", "Bearer uploader"},
+		{serviceTokenHeader, "svc-token"},
+	} {
+		rec := get(svc.MetaHandler, "/files/meta", c.header, c.value)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("meta as %s: expected 200, got %d", c.value, rec.Code)
+		}
+		var record FileRecord
+		if err := json.Unmarshal(rec.Body.Bytes(), &record); err != nil {
+			t.Fatalf("decode record: %v", err)
+		}
+		if record.UploadedBy != "u-uploader" {
+			t.Fatalf("expected uploader u-uploader, got %q", record.UploadedBy)
+		}
+	}
+}
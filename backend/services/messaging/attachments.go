@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"lan-chat/protocol"
+)
+
+const attachmentSchema = `
+	CREATE TABLE IF NOT EXISTS message_attachments (
+		message_id TEXT PRIMARY KEY,
+		file_id TEXT NOT NULL,
+		channel_id TEXT NOT NULL,
+		created_at BIGINT
+	);
+	CREATE INDEX IF NOT EXISTS idx_message_attachments_file ON message_attachments(file_id);
+`
+
+var (
+	errAttachmentRequired = errors.New("file, image and voice messages require an attachment")
+	errAttachmentUnknown  = errors.New("attachment does not reference a stored file")
+	errAttachmentMismatch = errors.New("attachment does not match the stored file")
+	errAttachmentDenied   = errors.New("attachment was uploaded by someone else and not shared with the sender")
+	errVoiceInvalid       = errors.New("invalid voice metadata")
+	errVoiceTooLong       = errors.New("voice message exceeds maximum duration")
+	errVoiceTooLarge      = errors.New("voice message exceeds maximum size")
+)
+
+// maxWaveformSamples bounds the waveform stored with every voice message.
+const maxWaveformSamples = 256
+
+// maxVoiceBytesPerSecond rejects metadata whose duration is implausibly short
+// for the file size (512 kbit/s is far above any voice codec setting).
+const maxVoiceBytesPerSecond = 64 << 10
+
+// voiceCodecs lists accepted codecs and the container MIME types they may
+// arrive in. The application/ and video/ entries are what filetransfer's
+// content sniffing reports for Ogg, WebM and M4A uploads without a type.
+var voiceCodecs = map[string][]string{
+	"opus": {"audio/ogg", "audio/opus", "audio/webm", "application/ogg", "video/webm"},
+	"aac":  {"audio/aac", "audio/mp4", "audio/x-m4a", "video/mp4"},
+	"mp3":  {"audio/mpeg"},
+}
+
+// VoiceLimits caps voice messages.
+type VoiceLimits struct {
+	MaxDuration time.Duration
+	MaxBytes    int64
+}
+
+func voiceLimitsFromEnv() VoiceLimits {
+	return VoiceLimits{
+		MaxDuration: envDuration("MESSAGING_VOICE_MAX_DURATION", 5*time.Minute),
+		MaxBytes:    int64(envInt("MESSAGING_VOICE_MAX_BYTES", 10<<20)),
+	}
+}
+
+// validateVoice checks client-supplied voice metadata against the stored file.
+func validateVoice(v *protocol.VoiceInfo, stored *protocol.Attachment, limits VoiceLimits) error {
+	if v == nil || v.DurationMs <= 0 || len(v.Waveform) == 0 || len(v.Waveform) > maxWaveformSamples {
+		return errVoiceInvalid
+	}
+	for _, sample := range v.Waveform {
+		if sample < 0 || sample > 255 {
+			return errVoiceInvalid
+		}
+	}
+	mimes, ok := voiceCodecs[strings.ToLower(v.Codec)]
+	if !ok {
+		return errVoiceInvalid
+	}
+	mime, _, _ := strings.Cut(stored.MimeType, ";")
+	matched := false
+	for _, m := range mimes {
+		matched = matched || strings.EqualFold(strings.TrimSpace(mime), m)
+	}
+	if !matched {
+		return errAttachmentMismatch
+	}
+	if time.Duration(v.DurationMs)*time.Millisecond > limits.MaxDuration {
+		return errVoiceTooLong
+	}
+	if stored.Size > limits.MaxBytes {
+		return errVoiceTooLarge
+	}
+	if float64(stored.Size)/(float64(v.DurationMs)/1000) > maxVoiceBytesPerSecond {
+		return errVoiceInvalid
+	}
+	v.Codec = strings.ToLower(v.Codec)
+	return nil
+}
+
+// serviceTokenHeader carries the secret messaging and filetransfer share
+// for calls that act on no particular user's behalf.
+const serviceTokenHeader = "X-Service-Token"
+
+// fileTransferClient looks up file records in the filetransfer service.
+type fileTransferClient struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func newFileTransferClient(baseURL, token string) *fileTransferClient {
+	return &fileTransferClient{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func fileTransferClientFromEnv() *fileTransferClient {
+	base := os.Getenv("MESSAGING_FILETRANSFER_URL")
+	if base == "" {
+		base = "http://localhost:8082"
+	}
+	return newFileTransferClient(base, os.Getenv("MESSAGING_FILETRANSFER_TOKEN"))
+}
+
+// storedFile is filetransfer's record of an upload: the attachment
+// descriptor plus the user who uploaded it.
+type storedFile struct {
+	protocol.Attachment
+	UploadedBy string `json:"uploaded_by"`
+}
+
+// Lookup returns the stored record for fileID.
+func (c *fileTransferClient) Lookup(fileID string) (*storedFile, error) {
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+"/files/meta?id="+url.QueryEscape(fileID), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set(serviceTokenHeader, c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("filetransfer unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusBadRequest:
+		return nil, errAttachmentUnknown
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("filetransfer returned %d", resp.StatusCode)
+	}
+	var f storedFile
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&f); err != nil {
+		return nil, err
+	}
+	if f.FileID != fileID {
+		return nil, errAttachmentUnknown
+	}
+	return &f, nil
+}
+
+func isAttachmentType(t protocol.MessageType) bool {
+	return t == protocol.MessageTypeFile || t == protocol.MessageTypeImage || t == protocol.MessageTypeVoice
+}
+
+// resolveAttachment validates a send request's attachment against the
+// filetransfer record and replaces it with the canonical descriptor. Older
+// clients that only send "FILE:<id>:<name>" content are upgraded here.
+// senderID must have uploaded the file or be able to download it already,
+// so that knowing a file ID is not enough to share it.
+func (r *MessageRouter) resolveAttachment(req *protocol.SendMessageRequest, senderID string) error {
+	if req.Attachment == nil && !isAttachmentType(req.Type) {
+		return nil
+	}
+	claimed := req.Attachment
+	if claimed == nil {
+		claimed = parseAttachmentRef(string(req.Content))
+	}
+	if claimed == nil || claimed.FileID == "" {
+		return errAttachmentRequired
+	}
+	if !isAttachmentType(req.Type) {
+		req.Type = protocol.MessageTypeFile
+	}
+
+	file, err := r.files.Lookup(claimed.FileID)
+	if err != nil {
+		return err
+	}
+	if file.UploadedBy != senderID {
+		switch err := r.canAccessFile(senderID, claimed.FileID); {
+		case errors.Is(err, errForbidden), errors.Is(err, errChannelMissing):
+			return errAttachmentDenied
+		case err != nil:
+			return err
+		}
+	}
+	stored := &file.Attachment
+	if (claimed.Size != 0 && claimed.Size != stored.Size) ||
+		(claimed.SHA256 != "" && !strings.EqualFold(claimed.SHA256, stored.SHA256)) ||
+		(claimed.MimeType != "" && claimed.MimeType != stored.MimeType) {
+		return errAttachmentMismatch
+	}
+	if req.Type == protocol.MessageTypeImage && !strings.HasPrefix(stored.MimeType, "image/") {
+		return errAttachmentMismatch
+	}
+	if req.Type == protocol.MessageTypeVoice {
+		if err := validateVoice(claimed.Voice, stored, r.voice); err != nil {
+			return err
+		}
+		stored.Voice = claimed.Voice
+	}
+	if claimed.Name != "" {
+		// The display name is the sender's choice; everything else is the
+		// server's record.
+		stored.Name = claimed.Name
+	}
+	req.Attachment = stored
+	return nil
+}
+
+// recordAttachment remembers which channel a file was shared in so that
+// downloads can be authorised by channel membership.
+func (r *MessageRouter) recordAttachment(msg *protocol.Message) error {
+	if msg.Attachment == nil {
+		return nil
+	}
+	_, err := r.db.Exec(r.bind(`
+		INSERT INTO message_attachments (message_id, file_id, channel_id, created_at)
+		VALUES (?, ?, ?, ?)`), msg.ID, msg.Attachment.FileID, msg.ChannelID, msg.Timestamp)
+	return err
+}
+
+// canAccessFile reports whether userID may read at least one channel in which
+// fileID was shared. It returns errChannelMissing for files never shared.
+func (r *MessageRouter) canAccessFile(userID, fileID string) error {
+	rows, err := r.db.Query(r.bind(`SELECT DISTINCT channel_id FROM message_attachments WHERE file_id = ?`), fileID)
+	if err != nil {
+		return err
+	}
+	var channels []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		channels = append(channels, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(channels) == 0 {
+		return errChannelMissing
+	}
+	for _, channelID := range channels {
+		if r.authorizeChannelAccess(userID, channelID) == nil {
+			return nil
+		}
+	}
+	return errForbidden
+}
+
+// AttachmentAuthorizeHandler is called by the filetransfer service before it
+// serves a file or its metadata. It answers 200 when the bearer uploaded the
+// file (uploaded_by, from filetransfer's record) or may read a channel it
+// was shared in. With action=upload it only checks the bearer, and names
+// the uploader to record.
+// GET /attachments/authorize?file_id={id}&uploaded_by={user_id}
+// GET /attachments/authorize?action=upload
+func (r *MessageRouter) AttachmentAuthorizeHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, err := r.authenticate(req)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ok := func() {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "user_id": userID})
+	}
+	if req.URL.Query().Get("action") == "upload" {
+		ok()
+		return
+	}
+	fileID := req.URL.Query().Get("file_id")
+	if fileID == "" {
+		http.Error(w, "missing file_id", http.StatusBadRequest)
+		return
+	}
+	if uploader := req.URL.Query().Get("uploaded_by"); uploader != "" && uploader == userID {
+		ok()
+		return
+	}
+	switch err := r.canAccessFile(userID, fileID); {
+	case err == nil:
+		ok()
+	case errors.Is(err, errForbidden):
+		http.Error(w, "forbidden", http.StatusForbidden)
+	case errors.Is(err, errChannelMissing):
+		http.Error(w, "not found", http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// attachmentErrorDetail maps resolveAttachment failures to an ErrorFrame.
+func attachmentErrorDetail(err error, channelID string) protocol.ErrorDetail {
+	return protocol.ErrorDetail{Code: "invalid_attachment", Message: err.Error(), ChannelID: channelID}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"lan-chat/protocol"
+)
+
+const (
+	testFileID  = "5f0b7c36-2a53-4a8e-9a57-3f0c1f3f9e21"
+	testVoiceID = "0e6d5f4a-93a2-4f61-8c1b-6a0b9d1c2e33"
+)
+
+// Both test files were uploaded by alice.
+var testFileRecords = map[string]storedFile{
+	testFileID: {Attachment: protocol.Attachment{FileID: testFileID, Name: "diagram.png", Size: 2048, MimeType: "image/png", SHA256: "ab12"},
+		UploadedBy: "u-alice"},
+	testVoiceID: {Attachment: protocol.Attachment{FileID: testVoiceID, Name: "note.ogg", Size: 48000, MimeType: "application/ogg", SHA256: "cd34"},
+		UploadedBy: "u-alice"},
+}
+
+const testServiceToken = "svc-token"
+
+func newTestFileTransfer(t *testing.T, r *MessageRouter) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(serviceTokenHeader) != testServiceToken {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		rec, ok := testFileRecords[req.URL.Query().Get("id")]
+		if req.URL.Path != "/files/meta" || !ok {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(rec)
+	}))
+	t.Cleanup(srv.Close)
+	r.files = newFileTransferClient(srv.URL, testServiceToken)
+}
+
+func TestResolveAttachmentValidatesAgainstFiletransfer(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	newTestFileTransfer(t, r)
+
+	cases := []struct {
+		name string
+		req  protocol.SendMessageRequest
+		want error
+	}{
+		{"plain text", protocol.SendMessageRequest{Type: protocol.MessageTypeText, Content: []byte("hi")}, nil},
+		{"missing descriptor", protocol.SendMessageRequest{Type: protocol.MessageTypeFile, Content: []byte("hi")}, errAttachmentRequired},
+		{"unknown file", protocol.SendMessageRequest{Type: protocol.MessageTypeFile,
+			Attachment: &protocol.Attachment{FileID: "nope"}}, errAttachmentUnknown},
+		{"size mismatch", protocol.SendMessageRequest{Type: protocol.MessageTypeImage,
+			Attachment: &protocol.Attachment{FileID: testFileID, Size: 1}}, errAttachmentMismatch},
+		{"hash mismatch", protocol.SendMessageRequest{Type: protocol.MessageTypeImage,
+			Attachment: &protocol.Attachment{FileID: testFileID, SHA256: "ffff"}}, errAttachmentMismatch},
+		{"valid image", protocol.SendMessageRequest{Type: protocol.MessageTypeImage,
+			Attachment: &protocol.Attachment{FileID: testFileID, Size: 2048, SHA256: "AB12"}}, nil},
+		{"legacy content", protocol.SendMessageRequest{Type: protocol.MessageTypeFile,
+			Content: []byte("FILE:" + testFileID + ":arch.png")}, nil},
+	}
+	for _, c := range cases {
+		req := c.req
+		err := r.resolveAttachment(&req, "u-alice")
+		if !errors.Is(err, c.want) {
+			t.Fatalf("%s: expected %v, got %v", c.name, c.want, err)
+		}
+		if c.want == nil && isAttachmentType(req.Type) {
+			if req.Attachment == nil || req.Attachment.MimeType != "image/png" || req.Attachment.Size != 2048 {
+				t.Fatalf("%s: descriptor not canonicalised: %+v", c.name, req.Attachment)
+			}
+		}
+	}
+
+	legacy := protocol.SendMessageRequest{Type: protocol.MessageTypeFile, Content: []byte("FILE:" + testFileID + ":arch.png")}
+	_ = r.resolveAttachment(&legacy, "u-alice")
+	if legacy.Attachment.Name != "arch.png" {
+		t.Fatalf("expected sender's display name, got %q", legacy.Attachment.Name)
+	}
+}
+
+func TestAttachmentDownloadAuthorizedByChannelMembership(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	newTestFileTransfer(t, r)
+
+	req := protocol.SendMessageRequest{
+		ChannelID:  "priv-1",
+		Type:       protocol.MessageTypeImage,
+		Attachment: &protocol.Attachment{FileID: testFileID},
+	}
+	if err := r.resolveAttachment(&req, "u-alice"); err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	msg, err := r.SaveMessage(req, "u-alice", "priv-1")
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	history, err := r.store.ChannelHistory("priv-1", 10)
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	var stored *protocol.Message
+	for i := range history {
+		if history[i].ID == msg.ID {
+			stored = &history[i]
+		}
+	}
+	if stored == nil || stored.Attachment == nil || stored.Attachment.SHA256 != "ab12" {
+		t.Fatalf("attachment not persisted with message: %+v", stored)
+	}
+
+	check := func(username, fileID string) int {
+		httpReq := httptest.NewRequest(http.MethodGet, "/attachments/authorize?file_id="+fileID, nil)
+		httpReq.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, username))
+		rec := httptest.NewRecorder()
+		r.AttachmentAuthorizeHandler(rec, httpReq)
+		return rec.Code
+	}
+	if code := check("bob", testFileID); code != http.StatusOK {
+		t.Fatalf("expected member to be authorized, got %d", code)
+	}
+	if code := check("charlie", testFileID); code != http.StatusForbidden {
+		t.Fatalf("expected non-member to be forbidden, got %d", code)
+	}
+	if code := check("alice", "never-shared"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unshared file, got %d", code)
+	}
+}
+
+func TestVoiceMessageMetadataValidation(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	newTestFileTransfer(t, r)
+	r.voice = VoiceLimits{MaxDuration: 2 * time.Minute, MaxBytes: 1 << 20}
+
+	voice := func(v *protocol.VoiceInfo) protocol.SendMessageRequest {
+		return protocol.SendMessageRequest{
+			Type:       protocol.MessageTypeVoice,
+			Attachment: &protocol.Attachment{FileID: testVoiceID, Voice: v},
+		}
+	}
+	wave := []int{0, 40, 200, 255, 12}
+	cases := []struct {
+		name string
+		req  protocol.SendMessageRequest
+		want error
+	}{
+		{"missing metadata", voice(nil), errVoiceInvalid},
+		{"no waveform", voice(&protocol.VoiceInfo{DurationMs: 12000, Codec: "opus"}), errVoiceInvalid},
+		{"sample out of range", voice(&protocol.VoiceInfo{DurationMs: 12000, Codec: "opus", Waveform: []int{300}}), errVoiceInvalid},
+		{"waveform too long", voice(&protocol.VoiceInfo{DurationMs: 12000, Codec: "opus", Waveform: make([]int, maxWaveformSamples+1)}), errVoiceInvalid},
+		{"unknown codec", voice(&protocol.VoiceInfo{DurationMs: 12000, Codec: "flac", Waveform: wave}), errVoiceInvalid},
+		{"codec does not match file", voice(&protocol.VoiceInfo{DurationMs: 12000, Codec: "mp3", Waveform: wave}), errAttachmentMismatch},
+		{"too long", voice(&protocol.VoiceInfo{DurationMs: 3 * 60 * 1000, Codec: "opus", Waveform: wave}), errVoiceTooLong},
+		{"implausible bitrate", voice(&protocol.VoiceInfo{DurationMs: 200, Codec: "opus", Waveform: wave}), errVoiceInvalid},
+		{"valid", voice(&protocol.VoiceInfo{DurationMs: 12000, Codec: "OPUS", Waveform: wave}), nil},
+		{"non-audio file", protocol.SendMessageRequest{Type: protocol.MessageTypeVoice, Attachment: &protocol.Attachment{
+			FileID: testFileID, Voice: &protocol.VoiceInfo{DurationMs: 1000, Codec: "opus", Waveform: wave}}}, errAttachmentMismatch},
+	}
+	for _, c := range cases {
+		req := c.req
+		if err := r.resolveAttachment(&req, "u-alice"); !errors.Is(err, c.want) {
+			t.Fatalf("%s: expected %v, got %v", c.name, c.want, err)
+		}
+	}
+
+	r.voice.MaxBytes = 1000
+	tooBig := voice(&protocol.VoiceInfo{DurationMs: 12000, Codec: "opus", Waveform: wave})
+	if err := r.resolveAttachment(&tooBig, "u-alice"); !errors.Is(err, errVoiceTooLarge) {
+		t.Fatalf("expected size limit, got %v", err)
+	}
+}
+
+func TestVoiceMetadataInHistory(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	newTestFileTransfer(t, r)
+
+	req := protocol.SendMessageRequest{
+		Type: protocol.MessageTypeVoice,
+		Attachment: &protocol.Attachment{FileID: testVoiceID, Voice: &protocol.VoiceInfo{
+			DurationMs: 4200, Codec: "opus", Waveform: []int{10, 80, 160, 80, 10},
+		}},
+	}
+	if err := r.resolveAttachment(&req, "u-alice"); err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if _, err := r.SaveMessage(req, "u-alice", "priv-1"); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	httpReq := httptest.NewRequest(http.MethodGet, "/history?channel_id=priv-1", nil)
+	httpReq.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, "bob"))
+	rec := httptest.NewRecorder()
+	r.HistoryHandler(rec, httpReq)
+	var history []protocol.Message
+	if err := json.Unmarshal(rec.Body.Bytes(), &history); err != nil {
+		t.Fatalf("decode history: %v", err)
+	}
+	var got *protocol.Attachment
+	for _, m := range history {
+		if m.Type == protocol.MessageTypeVoice {
+			got = m.Attachment
+		}
+	}
+	if got == nil || got.Voice == nil || got.Voice.DurationMs != 4200 || len(got.Voice.Waveform) != 5 ||
+		got.MimeType != "application/ogg" || got.Size != 48000 {
+		t.Fatalf("voice metadata missing from history: %+v", got)
+	}
+}
+
+func TestAttachmentRequiresUploaderOrAccess(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	newTestFileTransfer(t, r)
+
+	attach := func(senderID, channelID string) error {
+		req := protocol.SendMessageRequest{
+			ChannelID:  channelID,
+			Type:       protocol.MessageTypeImage,
+			Attachment: &protocol.Attachment{FileID: testFileID},
+		}
+		if err := r.resolveAttachment(&req, senderID); err != nil {
+			return err
+		}
+		_, err := r.SaveMessage(req, senderID, channelID)
+		return err
+	}
+
+	// Knowing the ID of alice's unshared upload is not enough.
+	if err := attach("u-charlie", "general"); !errors.Is(err, errAttachmentDenied) {
+		t.Fatalf("expected stranger to be refused, got %v", err)
+	}
+	if err := attach("u-alice", "priv-1"); err != nil {
+		t.Fatalf("uploader attach: %v", err)
+	}
+	// Once shared, members of the channel may pass it on; others still may not.
+	if err := attach("u-bob", "general"); err != nil {
+		t.Fatalf("member re-share: %v", err)
+	}
+	if err := attach("u-charlie", "general"); err != nil {
+		t.Fatalf("re-shared in a public channel, charlie can read it: %v", err)
+	}
+
+	body := `{"channel_id":"general","type":2,"attachment":{"file_id":"` + testVoiceID + `"}}`
+	httpReq := httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(body))
+	httpReq.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, "bob"))
+	rec := httptest.NewRecorder()
+	r.SendHandler(rec, httpReq)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for someone else's file over /send, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAttachmentAuthorizeUploaderAndUpload(t *testing.T) {
+	r := newMessagingTestRouter(t)
+
+	check := func(username, query string) *httptest.ResponseRecorder {
+		httpReq := httptest.NewRequest(http.MethodGet, "/attachments/authorize?"+query, nil)
+		httpReq.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, username))
+		rec := httptest.NewRecorder()
+		r.AttachmentAuthorizeHandler(rec, httpReq)
+		return rec
+	}
+	if rec := check("alice", "file_id=never-shared&uploaded_by=u-alice"); rec.Code != http.StatusOK {
+		t.Fatalf("expected uploader to reach an unshared file, got %d", rec.Code)
+	}
+	if rec := check("bob", "file_id=never-shared&uploaded_by=u-alice"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected others to get 404 for an unshared file, got %d", rec.Code)
+	}
+	rec := check("bob", "action=upload")
+	var out struct {
+		UserID string `json:"user_id"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); rec.Code != http.StatusOK || err != nil || out.UserID != "u-bob" {
+		t.Fatalf("upload check: %d %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// auditEvent matches the body accepted by the audit service's POST /log.
+type auditEvent struct {
+	ActorID        string `json:"actor_id"`
+	Action         string `json:"action"`
+	TargetResource string `json:"target_resource"`
+	Details        string `json:"details"`
+}
+
+// auditClient forwards compliance-relevant events to the audit service.
+// A nil client or empty URL disables forwarding.
+type auditClient struct {
+	url    string
+	client *http.Client
+}
+
+func newAuditClient(url string) *auditClient {
+	return &auditClient{url: url, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func auditClientFromEnv() *auditClient {
+	url := os.Getenv("MESSAGING_AUDIT_URL")
+	if url == "" {
+		url = "http://localhost:8084/log"
+	}
+	return newAuditClient(url)
+}
+
+// LogJSON records an event with details marshalled as JSON. Delivery is
+// synchronous so callers can report failures; errors are also logged.
+func (a *auditClient) LogJSON(actorID, action, target string, details interface{}) error {
+	if a == nil || a.url == "" {
+		return nil
+	}
+	d, _ := json.Marshal(details)
+	body, err := json.Marshal(auditEvent{ActorID: actorID, Action: action, TargetResource: target, Details: string(d)})
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("audit %s on %s not recorded: %v", action, target, err)
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		err := fmt.Errorf("audit service returned %d", resp.StatusCode)
+		log.Printf("audit %s on %s not recorded: %v", action, target, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// authSessionSchema is the auth service's session table. Both services
+// share the database in deployment; creating it here keeps messaging
+// working when it starts first or runs against its own database.
+const authSessionSchema = `
+	CREATE TABLE IF NOT EXISTS auth_sessions (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		expires_at BIGINT NOT NULL,
+		revoked_at BIGINT,
+		revoke_reason TEXT
+	);
+`
+
+// SessionPolicy controls how tokens carrying a session ID are checked.
+type SessionPolicy struct {
+	// TrustUnknown accepts tokens whose session this database does not
+	// know, judging them by signature and expiry alone. Only for a
+	// messaging instance that does not share the auth service's database.
+	TrustUnknown bool
+	// Recheck is how often open /ws connections are matched against
+	// auth_sessions; connections of revoked sessions are closed.
+	Recheck time.Duration
+}
+
+func sessionPolicyFromEnv() SessionPolicy {
+	trust, _ := strconv.ParseBool(os.Getenv("MESSAGING_TRUST_UNKNOWN_SESSIONS"))
+	return SessionPolicy{
+		TrustUnknown: trust,
+		Recheck:      envDuration("MESSAGING_SESSION_RECHECK", 30*time.Second),
+	}
+}
+
+// validateUserToken is validateToken plus the session check: access tokens
+// of a logged out, revoked or unknown session stop working before they
+// expire. Tokens without a session ID are judged by the signature and
+// expiry alone.
+func (r *MessageRouter) validateUserToken(tokenString string) (*Claims, error) {
+	claims, err := validateToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.SessionID == "" {
+		return claims, nil
+	}
+	active, err := r.sessionActive(claims.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if !active {
+		return nil, errUnauthorized
+	}
+	return claims, nil
+}
+
+// sessionActive reports whether sessionID is neither revoked nor expired.
+// Sessions missing from auth_sessions count as active only when the policy
+// trusts unknown sessions.
+func (r *MessageRouter) sessionActive(sessionID string) (bool, error) {
+	var expiresAt int64
+	var revokedAt sql.NullInt64
+	err := r.db.QueryRow(r.bind(`SELECT expires_at, revoked_at FROM auth_sessions WHERE id = ?`), sessionID).
+		Scan(&expiresAt, &revokedAt)
+	switch {
+	case err == sql.ErrNoRows:
+		return r.sessions.TrustUnknown, nil
+	case err != nil:
+		return false, err
+	}
+	return !revokedAt.Valid && expiresAt >= time.Now().Unix(), nil
+}
+
+// checkSessions closes the /ws connections whose session is no longer
+// active. The read loop then unregisters them as on any disconnect.
+func (r *MessageRouter) checkSessions() error {
+	bySession := make(map[string][]*Client)
+	r.mu.RLock()
+	for _, conns := range r.clients {
+		for _, client := range conns {
+			if client.SessionID != "" && client.Conn != nil {
+				bySession[client.SessionID] = append(bySession[client.SessionID], client)
+			}
+		}
+	}
+	r.mu.RUnlock()
+
+	for sessionID, clients := range bySession {
+		active, err := r.sessionActive(sessionID)
+		if err != nil {
+			return err
+		}
+		if active {
+			continue
+		}
+		for _, client := range clients {
+			_ = client.Conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session_revoked"), time.Now().Add(time.Second))
+			client.Conn.Close()
+		}
+	}
+	return nil
+}
+
+// runSessionWatcher checks open connections' sessions every interval.
+func (r *MessageRouter) runSessionWatcher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		if err := r.checkSessions(); err != nil {
+			log.Printf("session scan failed: %v", err)
+		}
+	}
+}
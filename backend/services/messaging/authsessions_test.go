@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"lan-chat/protocol"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+func sessionTokenForTestUser(t *testing.T, username, sessionID string) string {
+	t.Helper()
+	claims := &Claims{
+		Username:  username,
+		Role:      "member",
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(15 * time.Minute)),
+		},
+	}
+	return signTestToken(t, claims)
+}
+
+func TestRevokedSessionsAreRejected(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	now := time.Now()
+	_, err := r.db.Exec(`INSERT INTO auth_sessions (id, user_id, created_at, expires_at, revoked_at, revoke_reason) VALUES
+		('s-live', 'u-alice', ?, ?, NULL, NULL),
+		('s-revoked', 'u-alice', ?, ?, ?, 'logout'),
+		('s-expired', 'u-alice', ?, ?, NULL, NULL)`,
+		now.Unix(), now.Add(time.Hour).Unix(),
+		now.Unix(), now.Add(time.Hour).Unix(), now.Unix(),
+		now.Add(-2*time.Hour).Unix(), now.Add(-time.Hour).Unix())
+	if err != nil {
+		t.Fatalf("insert sessions: %v", err)
+	}
+
+	history := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/history?channel_id=priv-1", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		r.HistoryHandler(rec, req)
+		return rec.Code
+	}
+	for _, tc := range []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"live session", sessionTokenForTestUser(t, "alice", "s-live"), http.StatusOK},
+		{"no session claim", tokenForTestUser(t, "alice"), http.StatusOK},
+		{"unknown session", sessionTokenForTestUser(t, "alice", "s-elsewhere"), http.StatusUnauthorized},
+		{"revoked session", sessionTokenForTestUser(t, "alice", "s-revoked"), http.StatusUnauthorized},
+		{"expired session", sessionTokenForTestUser(t, "alice", "s-expired"), http.StatusUnauthorized},
+	} {
+		if got := history(tc.token); got != tc.want {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.want, got)
+		}
+	}
+
+	r.sessions.TrustUnknown = true
+	if got := history(sessionTokenForTestUser(t, "alice", "s-elsewhere")); got != http.StatusOK {
+		t.Fatalf("unknown session with TrustUnknown: expected 200, got %d", got)
+	}
+	r.sessions.TrustUnknown = false
+
+	// Revoking a session takes effect on the very next request.
+	live := sessionTokenForTestUser(t, "alice", "s-live")
+	if _, err := r.db.Exec(`UPDATE auth_sessions SET revoked_at = ?, revoke_reason = 'admin_revoke_all' WHERE user_id = 'u-alice'`, now.Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if got := history(live); got != http.StatusUnauthorized {
+		t.Fatalf("expected 401 after revoke-all, got %d", got)
+	}
+}
+
+func TestRevokedSessionsLoseTheirSockets(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	now := time.Now()
+	if _, err := r.db.Exec(`INSERT INTO auth_sessions (id, user_id, created_at, expires_at) VALUES
+		('s-kept', 'u-alice', ?, ?), ('s-dropped', 'u-alice', ?, ?)`,
+		now.Unix(), now.Add(time.Hour).Unix(), now.Unix(), now.Add(time.Hour).Unix()); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(r.HandleWS))
+	defer srv.Close()
+	dial := func(sessionID string) *websocket.Conn {
+		header := http.Header{"Authorization": {"Bearer " + sessionTokenForTestUser(t, "alice", sessionID)}}
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+		if err != nil {
+			t.Fatalf("dial %s: %v", sessionID, err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	kept, dropped := dial("s-kept"), dial("s-dropped")
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		r.mu.RLock()
+		n := len(r.clients["u-alice"])
+		r.mu.RUnlock()
+		if n == 2 {
+			break
+		}
+	}
+
+	if _, err := r.db.Exec(`UPDATE auth_sessions SET revoked_at = ?, revoke_reason = 'logout' WHERE id = 's-dropped'`, now.Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.checkSessions(); err != nil {
+		t.Fatal(err)
+	}
+	_ = dropped.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := dropped.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expected the revoked session's socket to be closed, got %v", err)
+	}
+
+	// The other session's socket still receives messages.
+	msg, err := r.SaveMessage(protocol.SendMessageRequest{ChannelID: "general", Type: protocol.MessageTypeText, Content: []byte("hi")}, "u-bob", "general")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Broadcast(msg); err != nil {
+		t.Fatal(err)
+	}
+	if env := readTestFrame(t, kept, protocol.JSONCodec{}); env.Message == nil || env.Message.ID != msg.ID {
+		t.Fatalf("expected the live session to keep receiving, got %+v", env)
+	}
+}
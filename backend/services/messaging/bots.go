@@ -0,0 +1,643 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lan-chat/protocol"
+
+	"github.com/google/uuid"
+)
+
+const (
+	botTokenPrefix         = "bot_"
+	commandSenderPrefix    = "command:"
+	commandCallbackTimeout = 5 * time.Second
+	maxCommandReplyLength  = 8000
+	commandWorkers         = 4
+	commandQueueSize       = 256
+)
+
+var (
+	commandNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+	botUsernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,32}$`)
+	errUnknownCommand  = errors.New("unknown command")
+	errBotNotMember    = errors.New("bot is not a member of the channel")
+)
+
+const botSchema = `
+	CREATE TABLE IF NOT EXISTS bots (
+		id TEXT PRIMARY KEY,
+		user_id TEXT UNIQUE NOT NULL,
+		username TEXT UNIQUE NOT NULL,
+		token_hash TEXT UNIQUE NOT NULL,
+		created_by TEXT,
+		created_at BIGINT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS bot_commands (
+		name TEXT PRIMARY KEY,
+		bot_id TEXT NOT NULL,
+		description TEXT,
+		callback_url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		created_at BIGINT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_bot_commands_bot ON bot_commands(bot_id);
+`
+
+// Bot is a non-human account that authenticates with a long-lived token.
+type Bot struct {
+	ID        string `json:"id"`
+	UserID    string `json:"user_id"`
+	Username  string `json:"username"`
+	CreatedBy string `json:"created_by"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type CreateBotRequest struct {
+	Username string `json:"username"`
+	FullName string `json:"full_name"`
+}
+
+type RegisterCommandRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	CallbackURL string `json:"callback_url"`
+}
+
+// CommandInvocation describes a "/name args" message sent by a user. It is
+// also the JSON body POSTed to HTTP command callbacks.
+type CommandInvocation struct {
+	Name      string `json:"command"`
+	Args      string `json:"args"`
+	ChannelID string `json:"channel_id"`
+	UserID    string `json:"user_id"`
+}
+
+// CommandReply is returned by a command handler. Ephemeral replies are only
+// delivered to the invoker's connections and are never stored.
+type CommandReply struct {
+	Text      string `json:"text"`
+	Ephemeral bool   `json:"ephemeral"`
+}
+
+// CommandHandler runs an in-process slash command.
+type CommandHandler func(ctx context.Context, inv CommandInvocation) (*CommandReply, error)
+
+type registeredCommand struct {
+	Name        string
+	Description string
+	Handler     CommandHandler
+}
+
+// commandRegistry holds in-process command handlers. HTTP callbacks
+// registered by bots live in the bot_commands table instead. Commands sent
+// over /ws wait in queue so a slow callback never stalls a read loop.
+type commandRegistry struct {
+	mu       sync.RWMutex
+	commands map[string]registeredCommand
+	queue    chan CommandInvocation
+}
+
+func newCommandRegistry() *commandRegistry {
+	return &commandRegistry{
+		commands: make(map[string]registeredCommand),
+		queue:    make(chan CommandInvocation, commandQueueSize),
+	}
+}
+
+func (r *MessageRouter) startCommandWorkers() {
+	for i := 0; i < commandWorkers; i++ {
+		go r.commandWorker()
+	}
+}
+
+func (r *MessageRouter) commandWorker() {
+	for inv := range r.commands.queue {
+		_, _, err := r.runCommand(context.Background(), inv)
+		logCommandError(inv, err)
+	}
+}
+
+// enqueueCommand hands inv to a command worker, which delivers the reply
+// to the invoker's connections. When the queue is full the invoker is told
+// to retry instead of the read loop blocking.
+func (r *MessageRouter) enqueueCommand(inv CommandInvocation) bool {
+	select {
+	case r.commands.queue <- inv:
+		return true
+	default:
+		log.Printf("command /%s: queue full, dropped invocation from %s", inv.Name, inv.UserID)
+		r.sendEphemeral(inv.UserID, inv.ChannelID, "Command /"+inv.Name+" is busy, try again")
+		return false
+	}
+}
+
+// RegisterCommand adds an in-process handler for "/name".
+func (r *MessageRouter) RegisterCommand(name, description string, handler CommandHandler) error {
+	if !commandNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid command name %q", name)
+	}
+	r.commands.mu.Lock()
+	defer r.commands.mu.Unlock()
+	r.commands.commands[name] = registeredCommand{Name: name, Description: description, Handler: handler}
+	return nil
+}
+
+func (r *MessageRouter) registerBuiltinCommands() {
+	_ = r.RegisterCommand("help", "List available commands", func(ctx context.Context, inv CommandInvocation) (*CommandReply, error) {
+		lines, err := r.describeCommands()
+		if err != nil {
+			return nil, err
+		}
+		return &CommandReply{Text: strings.Join(lines, "\n"), Ephemeral: true}, nil
+	})
+}
+
+func (r *MessageRouter) describeCommands() ([]string, error) {
+	seen := make(map[string]string)
+	r.commands.mu.RLock()
+	for name, cmd := range r.commands.commands {
+		seen[name] = cmd.Description
+	}
+	r.commands.mu.RUnlock()
+
+	rows, err := r.db.Query(r.bind(`SELECT name, COALESCE(description, '') FROM bot_commands`))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, desc string
+		if err := rows.Scan(&name, &desc); err == nil {
+			if _, ok := seen[name]; !ok {
+				seen[name] = desc
+			}
+		}
+	}
+
+	lines := make([]string, 0, len(seen))
+	for name, desc := range seen {
+		lines = append(lines, "/"+name+" - "+desc)
+	}
+	sort.Strings(lines)
+	return lines, nil
+}
+
+// parseSlashCommand reports whether req is a "/name args" text message.
+func parseSlashCommand(req protocol.SendMessageRequest) (string, string, bool) {
+	if req.Type != protocol.MessageTypeText {
+		return "", "", false
+	}
+	text := strings.TrimSpace(string(req.Content))
+	if !strings.HasPrefix(text, "/") || strings.HasPrefix(text, "//") {
+		return "", "", false
+	}
+	name, args, _ := strings.Cut(text[1:], " ")
+	name = strings.ToLower(name)
+	if !commandNamePattern.MatchString(name) {
+		return "", "", false
+	}
+	return name, strings.TrimSpace(args), true
+}
+
+// hasCommand reports whether "/name" is registered in process or by a bot.
+// Other slash-prefixed text is sent as an ordinary message. When the lookup
+// fails the text is treated as a command, so it fails visibly instead of
+// being posted to the channel.
+func (r *MessageRouter) hasCommand(name string) bool {
+	r.commands.mu.RLock()
+	_, ok := r.commands.commands[name]
+	r.commands.mu.RUnlock()
+	if ok {
+		return true
+	}
+	var exists bool
+	err := r.db.QueryRow(r.bind(`SELECT EXISTS(SELECT 1 FROM bot_commands WHERE name = ?)`), name).Scan(&exists)
+	if err != nil {
+		log.Printf("command /%s lookup failed: %v", name, err)
+		return true
+	}
+	return exists
+}
+
+// runCommand executes the handler for inv and delivers its reply. Public
+// replies are stored and broadcast like any other message and returned;
+// ephemeral replies and errors are pushed only to the invoker and returned
+// as text. A bot may only reply publicly in channels it can post to.
+func (r *MessageRouter) runCommand(ctx context.Context, inv CommandInvocation) (*protocol.Message, string, error) {
+	reply, senderID, err := r.executeCommand(ctx, inv)
+	if err == nil && reply != nil && !reply.Ephemeral && !strings.HasPrefix(senderID, commandSenderPrefix) {
+		if r.authorizeChannelAccess(senderID, inv.ChannelID) != nil {
+			err = errBotNotMember
+		}
+	}
+	if err != nil {
+		text := "Command /" + inv.Name + " failed"
+		switch {
+		case errors.Is(err, errUnknownCommand):
+			text = "Unknown command /" + inv.Name + ". Try /help"
+		case errors.Is(err, errBotNotMember):
+			text = "Command /" + inv.Name + " cannot reply here: its bot is not a member of this channel"
+		}
+		r.sendEphemeral(inv.UserID, inv.ChannelID, text)
+		return nil, text, err
+	}
+	if reply == nil || strings.TrimSpace(reply.Text) == "" {
+		return nil, "", nil
+	}
+	if len(reply.Text) > maxCommandReplyLength {
+		reply.Text = reply.Text[:maxCommandReplyLength]
+	}
+	if reply.Ephemeral {
+		r.sendEphemeral(inv.UserID, inv.ChannelID, reply.Text)
+		return nil, reply.Text, nil
+	}
+
+	msg, err := r.saveServerMessage(protocol.SendMessageRequest{
+		ChannelID: inv.ChannelID,
+		Content:   []byte(reply.Text),
+		Type:      protocol.MessageTypeText,
+	}, senderID, inv.ChannelID)
+	if err != nil {
+		return nil, "", err
+	}
+	return msg, "", r.Broadcast(msg)
+}
+
+func (r *MessageRouter) executeCommand(ctx context.Context, inv CommandInvocation) (*CommandReply, string, error) {
+	r.commands.mu.RLock()
+	cmd, ok := r.commands.commands[inv.Name]
+	r.commands.mu.RUnlock()
+	if ok {
+		reply, err := cmd.Handler(ctx, inv)
+		return reply, commandSenderPrefix + inv.Name, err
+	}
+
+	var botUserID, callbackURL, secret string
+	err := r.db.QueryRow(r.bind(`
+		SELECT b.user_id, c.callback_url, c.secret
+		FROM bot_commands c JOIN bots b ON b.id = c.bot_id
+		WHERE c.name = ?`), inv.Name).Scan(&botUserID, &callbackURL, &secret)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, "", errUnknownCommand
+		}
+		return nil, "", err
+	}
+	reply, err := r.callCommandCallback(ctx, callbackURL, secret, inv)
+	return reply, botUserID, err
+}
+
+// callCommandCallback POSTs inv to a bot's callback URL. The body is signed
+// the same way as outgoing webhooks so bots can reuse their verification.
+func (r *MessageRouter) callCommandCallback(ctx context.Context, callbackURL, secret string, inv CommandInvocation) (*CommandReply, error) {
+	body, err := json.Marshal(inv)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, commandCallbackTimeout)
+	defer cancel()
+
+	ts := time.Now().Unix()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookTimestampHeader, strconv.FormatInt(ts, 10))
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhookPayload(secret, ts, body))
+
+	resp, err := r.webhooks.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("command callback returned %d", resp.StatusCode)
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	var reply CommandReply
+	if err := json.NewDecoder(io.LimitReader(resp.Body, defaultWebhookBodyLimit)).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("invalid command reply: %w", err)
+	}
+	return &reply, nil
+}
+
+// sendEphemeral pushes a transient system message to every connection of
+// userID without persisting it.
+func (r *MessageRouter) sendEphemeral(userID, channelID, text string) {
+	env := &protocol.Envelope{Message: &protocol.Message{
+		ID:        "ephemeral-" + uuid.New().String(),
+		ChannelID: channelID,
+		SenderID:  "system",
+		Timestamp: time.Now().UnixMilli(),
+		Type:      protocol.MessageTypeSystem,
+		Content:   []byte(text),
+		Ephemeral: true,
+	}}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, client := range r.clients[userID] {
+		if client.supports(protocol.CapabilityEphemeral) {
+			client.sendFrame(env)
+		}
+	}
+}
+
+func isBotToken(token string) bool {
+	return strings.HasPrefix(token, botTokenPrefix)
+}
+
+func (r *MessageRouter) authenticateBot(token string) (string, error) {
+	var userID string
+	err := r.db.QueryRow(r.bind(`SELECT user_id FROM bots WHERE token_hash = ?`), hashWebhookToken(token)).Scan(&userID)
+	if err != nil {
+		return "", errUnauthorized
+	}
+	return userID, nil
+}
+
+// authenticateAdmin accepts only user JWTs carrying an admin role.
+func (r *MessageRouter) authenticateAdmin(req *http.Request) (string, error) {
+	token := bearerToken(req)
+	if token == "" || isBotToken(token) {
+		return "", errUnauthorized
+	}
+	claims, err := r.validateUserToken(token)
+	if err != nil {
+		return "", errUnauthorized
+	}
+	if claims.Role != "admin" && claims.Role != "super_admin" {
+		return "", errForbidden
+	}
+	userID, err := r.store.FindUserIDByUsername(claims.Username)
+	if err != nil {
+		return "", errUnauthorized
+	}
+	return userID, nil
+}
+
+func (r *MessageRouter) botByUserID(userID string) (*Bot, error) {
+	var b Bot
+	err := r.db.QueryRow(r.bind(`
+		SELECT id, user_id, username, COALESCE(created_by, ''), created_at
+		FROM bots WHERE user_id = ?`), userID).
+		Scan(&b.ID, &b.UserID, &b.Username, &b.CreatedBy, &b.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// createBot inserts the bot's user row and returns its one-time token.
+func (r *MessageRouter) createBot(req CreateBotRequest, createdBy string) (*Bot, string, error) {
+	secret, err := randomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+	token := botTokenPrefix + secret
+	now := time.Now().Unix()
+	bot := &Bot{
+		ID:        uuid.New().String(),
+		UserID:    uuid.New().String(),
+		Username:  req.Username,
+		CreatedBy: createdBy,
+		CreatedAt: now,
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	// Bots have no usable password; the empty hash never verifies.
+	_, err = tx.Exec(r.bind(`INSERT INTO users (id, username, full_name, password_hash, created_at, updated_at) VALUES (?, ?, ?, '', ?, ?)`),
+		bot.UserID, req.Username, req.FullName, now, now)
+	if err != nil {
+		return nil, "", err
+	}
+	_, err = tx.Exec(r.bind(`INSERT INTO bots (id, user_id, username, token_hash, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?)`),
+		bot.ID, bot.UserID, bot.Username, hashWebhookToken(token), bot.CreatedBy, bot.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+	return bot, token, nil
+}
+
+// BotsHandler lets admins list (GET), create (POST) and delete (DELETE) bots.
+func (r *MessageRouter) BotsHandler(w http.ResponseWriter, req *http.Request) {
+	adminID, err := r.authenticateAdmin(req)
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			http.Error(w, "admin access required", http.StatusForbidden)
+			return
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		rows, err := r.db.Query(r.bind(`SELECT id, user_id, username, COALESCE(created_by, ''), created_at FROM bots ORDER BY username ASC`))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		bots := make([]Bot, 0)
+		for rows.Next() {
+			var b Bot
+			if err := rows.Scan(&b.ID, &b.UserID, &b.Username, &b.CreatedBy, &b.CreatedAt); err == nil {
+				bots = append(bots, b)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"bots": bots})
+
+	case http.MethodPost:
+		var body CreateBotRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		body.Username = strings.TrimSpace(body.Username)
+		body.FullName = strings.TrimSpace(body.FullName)
+		if !botUsernamePattern.MatchString(body.Username) {
+			http.Error(w, "invalid username format", http.StatusBadRequest)
+			return
+		}
+		if len(body.FullName) > 80 {
+			http.Error(w, "full name too long", http.StatusBadRequest)
+			return
+		}
+		bot, token, err := r.createBot(body, adminID)
+		if err != nil {
+			http.Error(w, "bot already exists or db error", http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"bot": bot, "token": token})
+
+	case http.MethodDelete:
+		id := req.URL.Query().Get("id")
+		var userID string
+		if err := r.db.QueryRow(r.bind(`SELECT user_id FROM bots WHERE id = ?`), id).Scan(&userID); err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		tx, err := r.db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		for _, del := range []struct{ query, arg string }{
+			{`DELETE FROM bot_commands WHERE bot_id = ?`, id},
+			{`DELETE FROM bots WHERE id = ?`, id},
+			{`DELETE FROM users WHERE id = ?`, userID},
+		} {
+			if _, err := tx.Exec(r.bind(del.query), del.arg); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// BotCommandsHandler lets a bot (authenticated with its token) register
+// (POST) or remove (DELETE) HTTP callback commands. GET lists every command.
+func (r *MessageRouter) BotCommandsHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := r.authenticate(req)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if req.Method == http.MethodGet {
+		lines, err := r.describeCommands()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"commands": lines})
+		return
+	}
+
+	bot, err := r.botByUserID(userID)
+	if err != nil {
+		http.Error(w, "bot token required", http.StatusForbidden)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPost:
+		var body RegisterCommandRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		body.Name = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(body.Name), "/"))
+		if !commandNamePattern.MatchString(body.Name) {
+			http.Error(w, "invalid command name", http.StatusBadRequest)
+			return
+		}
+		if len(body.Description) > 200 {
+			http.Error(w, "description too long", http.StatusBadRequest)
+			return
+		}
+		target, err := url.Parse(body.CallbackURL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			http.Error(w, "invalid callback_url", http.StatusBadRequest)
+			return
+		}
+		r.commands.mu.RLock()
+		_, builtin := r.commands.commands[body.Name]
+		r.commands.mu.RUnlock()
+		if builtin {
+			http.Error(w, "command name reserved", http.StatusConflict)
+			return
+		}
+		secret, err := randomToken(32)
+		if err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		_, err = r.db.Exec(r.bind(`
+			INSERT INTO bot_commands (name, bot_id, description, callback_url, secret, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT(name) DO UPDATE SET
+				description = excluded.description,
+				callback_url = excluded.callback_url,
+				secret = excluded.secret
+			WHERE bot_commands.bot_id = excluded.bot_id`),
+			body.Name, bot.ID, body.Description, body.CallbackURL, secret, time.Now().Unix())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var owner string
+		if err := r.db.QueryRow(r.bind(`SELECT bot_id FROM bot_commands WHERE name = ?`), body.Name).Scan(&owner); err != nil || owner != bot.ID {
+			http.Error(w, "command registered by another bot", http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]string{"name": body.Name, "secret": secret})
+
+	case http.MethodDelete:
+		name := strings.TrimPrefix(req.URL.Query().Get("name"), "/")
+		res, err := r.db.Exec(r.bind(`DELETE FROM bot_commands WHERE name = ? AND bot_id = ?`), name, bot.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func logCommandError(inv CommandInvocation, err error) {
+	if err != nil && !errors.Is(err, errUnknownCommand) {
+		log.Printf("command /%s failed: %v", inv.Name, err)
+	}
+}
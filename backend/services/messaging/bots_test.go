@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"lan-chat/protocol"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func adminTokenForTestUser(t *testing.T, username string) string {
+	t.Helper()
+	claims := &Claims{
+		Username: username,
+		Role:     "admin",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(1 * time.Hour)),
+		},
+	}
+	return signTestToken(t, claims)
+}
+
+func createTestBot(t *testing.T, r *MessageRouter, username string) (*Bot, string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/bots", strings.NewReader(`{"username":"`+username+`"}`))
+	req.Header.Set("Authorization", "Bearer "+adminTokenForTestUser(t, "alice"))
+	rec := httptest.NewRecorder()
+	r.BotsHandler(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create bot: expected 201, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Bot   Bot    `json:"bot"`
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode bot: %v", err)
+	}
+	return &resp.Bot, resp.Token
+}
+
+func TestBotCreationRequiresAdmin(t *testing.T) {
+	r := newMessagingTestRouter(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/bots", strings.NewReader(`{"username":"deploybot"}`))
+	req.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, "alice"))
+	rec := httptest.NewRecorder()
+	r.BotsHandler(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", rec.Code)
+	}
+}
+
+func TestBotTokenAuthenticates(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	bot, token := createTestBot(t, r, "deploybot")
+
+	req := httptest.NewRequest(http.MethodGet, "/channels", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	userID, err := r.authenticate(req)
+	if err != nil {
+		t.Fatalf("authenticate bot: %v", err)
+	}
+	if userID != bot.UserID {
+		t.Fatalf("expected bot user %s, got %s", bot.UserID, userID)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+botTokenPrefix+"nope")
+	if _, err := r.authenticate(req); err == nil {
+		t.Fatalf("expected unknown bot token to be rejected")
+	}
+}
+
+func TestParseSlashCommand(t *testing.T) {
+	cases := []struct {
+		content string
+		name    string
+		args    string
+		ok      bool
+	}{
+		{"/help", "help", "", true},
+		{"/Deploy  prod now", "deploy", "prod now", true},
+		{"//not a command", "", "", false},
+		{"hello /help", "", "", false},
+	}
+	for _, tc := range cases {
+		name, args, ok := parseSlashCommand(protocol.SendMessageRequest{Type: protocol.MessageTypeText, Content: []byte(tc.content)})
+		if ok != tc.ok || name != tc.name || args != tc.args {
+			t.Fatalf("parse %q: got (%q, %q, %v)", tc.content, name, args, ok)
+		}
+	}
+}
+
+func TestInProcessCommandEphemeralAndPublicReplies(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	_ = r.RegisterCommand("echo", "Echo args", func(ctx context.Context, inv CommandInvocation) (*CommandReply, error) {
+		return &CommandReply{Text: inv.Args, Ephemeral: strings.HasPrefix(inv.Args, "secret")}, nil
+	})
+	alice := r.Register("u-alice", nil)
+	bob := r.Register("u-bob", nil)
+
+	if _, _, err := r.runCommand(context.Background(), CommandInvocation{Name: "echo", Args: "secret hi", ChannelID: "priv-1", UserID: "u-alice"}); err != nil {
+		t.Fatalf("run ephemeral command: %v", err)
+	}
+	select {
+	case data := <-alice.Send:
+		var m protocol.Message
+		_ = json.Unmarshal(data, &m)
+		if !m.Ephemeral || string(m.Content) != "secret hi" {
+			t.Fatalf("unexpected ephemeral frame: %+v", m)
+		}
+	default:
+		t.Fatalf("expected ephemeral reply for invoker")
+	}
+	if len(bob.Send) != 0 {
+		t.Fatalf("ephemeral reply leaked to another member")
+	}
+
+	msg, _, err := r.runCommand(context.Background(), CommandInvocation{Name: "echo", Args: "hello all", ChannelID: "priv-1", UserID: "u-alice"})
+	if err != nil || msg == nil {
+		t.Fatalf("run public command: msg=%v err=%v", msg, err)
+	}
+	if msg.SenderID != commandSenderPrefix+"echo" {
+		t.Fatalf("unexpected sender %q", msg.SenderID)
+	}
+	if len(bob.Send) != 1 {
+		t.Fatalf("expected public reply broadcast to channel members")
+	}
+}
+
+func TestHTTPCallbackCommand(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	bot, token := createTestBot(t, r, "weatherbot")
+
+	var got CommandInvocation
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_ = json.NewDecoder(req.Body).Decode(&got)
+		_ = json.NewEncoder(w).Encode(CommandReply{Text: "sunny in " + got.Args})
+	}))
+	defer srv.Close()
+
+	regReq := httptest.NewRequest(http.MethodPost, "/bots/commands",
+		bytes.NewReader([]byte(`{"name":"/weather","description":"Forecast","callback_url":"`+srv.URL+`"}`)))
+	regReq.Header.Set("Authorization", "Bearer "+token)
+	regRec := httptest.NewRecorder()
+	r.BotCommandsHandler(regRec, regReq)
+	if regRec.Code != http.StatusCreated {
+		t.Fatalf("register command: expected 201, got %d body=%s", regRec.Code, regRec.Body.String())
+	}
+
+	userReq := httptest.NewRequest(http.MethodPost, "/bots/commands",
+		bytes.NewReader([]byte(`{"name":"other","callback_url":"`+srv.URL+`"}`)))
+	userReq.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, "alice"))
+	userRec := httptest.NewRecorder()
+	r.BotCommandsHandler(userRec, userReq)
+	if userRec.Code != http.StatusForbidden {
+		t.Fatalf("expected users to be unable to register commands, got %d", userRec.Code)
+	}
+
+	msg, _, err := r.runCommand(context.Background(), CommandInvocation{Name: "weather", Args: "jakarta", ChannelID: "general", UserID: "u-bob"})
+	if err != nil || msg == nil {
+		t.Fatalf("run callback command: msg=%v err=%v", msg, err)
+	}
+	if got.UserID != "u-bob" || got.ChannelID != "general" {
+		t.Fatalf("unexpected invocation sent to callback: %+v", got)
+	}
+	if msg.SenderID != bot.UserID || string(msg.Content) != "sunny in jakarta" {
+		t.Fatalf("unexpected public reply: %+v", msg)
+	}
+}
+
+func TestUnknownCommandRepliesEphemerally(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	alice := r.Register("u-alice", nil)
+
+	if _, _, err := r.runCommand(context.Background(), CommandInvocation{Name: "nope", ChannelID: "general", UserID: "u-alice"}); err == nil {
+		t.Fatalf("expected unknown command error")
+	}
+	if len(alice.Send) != 1 {
+		t.Fatalf("expected ephemeral error reply")
+	}
+}
+
+func TestBotRepliesOnlyWhereBotCanPost(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	bot, token := createTestBot(t, r, "leakbot")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(w).Encode(CommandReply{Text: "hello from outside"})
+	}))
+	defer srv.Close()
+
+	regReq := httptest.NewRequest(http.MethodPost, "/bots/commands",
+		bytes.NewReader([]byte(`{"name":"leak","callback_url":"`+srv.URL+`"}`)))
+	regReq.Header.Set("Authorization", "Bearer "+token)
+	r.BotCommandsHandler(httptest.NewRecorder(), regReq)
+
+	bob := r.Register("u-bob", nil)
+	msg, text, err := r.runCommand(context.Background(), CommandInvocation{Name: "leak", ChannelID: "priv-1", UserID: "u-alice"})
+	if !errors.Is(err, errBotNotMember) || msg != nil || text == "" {
+		t.Fatalf("expected reply in private channel to be refused, got msg=%v text=%q err=%v", msg, text, err)
+	}
+	if len(bob.Send) != 0 {
+		t.Fatalf("refused bot reply reached the channel")
+	}
+
+	if err := r.store.AddChannelMember("priv-1", bot.UserID); err != nil {
+		t.Fatalf("add bot to channel: %v", err)
+	}
+	if msg, _, err := r.runCommand(context.Background(), CommandInvocation{Name: "leak", ChannelID: "priv-1", UserID: "u-alice"}); err != nil || msg == nil {
+		t.Fatalf("expected member bot to reply: msg=%v err=%v", msg, err)
+	}
+}
+
+func TestSendHandlerCommands(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	_ = r.RegisterCommand("whoami", "Show your ID", func(ctx context.Context, inv CommandInvocation) (*CommandReply, error) {
+		return &CommandReply{Text: "you are " + inv.UserID, Ephemeral: true}, nil
+	})
+
+	send := func(text string) protocol.SendMessageResponse {
+		t.Helper()
+		body, _ := json.Marshal(protocol.SendMessageRequest{ChannelID: "priv-1", Type: protocol.MessageTypeText, Content: []byte(text)})
+		req := httptest.NewRequest(http.MethodPost, "/send", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, "alice"))
+		rec := httptest.NewRecorder()
+		r.SendHandler(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("send %q: expected 200, got %d body=%s", text, rec.Code, rec.Body.String())
+		}
+		var resp protocol.SendMessageResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		return resp
+	}
+
+	resp := send("/whoami")
+	if !resp.Success || resp.MessageID != "" || resp.Ephemeral != "you are u-alice" {
+		t.Fatalf("expected ephemeral reply in the response, got %+v", resp)
+	}
+
+	// Unregistered commands are ordinary text.
+	resp = send("/tmp is full")
+	if !resp.Success || resp.MessageID == "" || resp.Ephemeral != "" {
+		t.Fatalf("expected /tmp text to be stored as a message, got %+v", resp)
+	}
+	var content []byte
+	if err := r.db.QueryRow(`SELECT content FROM messages WHERE id = ?`, resp.MessageID).Scan(&content); err != nil || string(content) != "/tmp is full" {
+		t.Fatalf("stored message = %q err=%v", content, err)
+	}
+}
+
+func TestBotDeleteRemovesBotAndCommands(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	bot, _ := createTestBot(t, r, "gonebot")
+	if _, err := r.db.Exec(`INSERT INTO bot_commands (name, bot_id, callback_url, secret, created_at) VALUES ('gone', ?, 'http://x', 's', 0)`, bot.ID); err != nil {
+		t.Fatalf("insert command: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/bots?id="+bot.ID, nil)
+	req.Header.Set("Authorization", "Bearer "+adminTokenForTestUser(t, "alice"))
+	rec := httptest.NewRecorder()
+	r.BotsHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("delete bot: expected 200, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if r.hasCommand("gone") {
+		t.Fatalf("expected the bot's commands to be removed")
+	}
+	if _, err := r.botByUserID(bot.UserID); err == nil {
+		t.Fatalf("expected the bot to be removed")
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"lan-chat/protocol"
+)
+
+// exportPageSize bounds how many messages an export holds in memory at once.
+const exportPageSize = 500
+
+// ExportedMessage is one line of a JSONL export.
+type ExportedMessage struct {
+	ID            string               `json:"id"`
+	ChannelID     string               `json:"channel_id"`
+	SenderID      string               `json:"sender_id"`
+	SenderName    string               `json:"sender_name"`
+	Timestamp     int64                `json:"timestamp"`
+	Type          protocol.MessageType `json:"type"`
+	Text          string               `json:"text,omitempty"`
+	ContentBase64 string               `json:"content_base64,omitempty"`
+	Attachment    *protocol.Attachment `json:"attachment,omitempty"` // File stays in the filetransfer service
+}
+
+// ExportManifest describes a zip archive.
+type ExportManifest struct {
+	Channel    ChannelView `json:"channel"`
+	ExportedBy string      `json:"exported_by"`
+	ExportedAt int64       `json:"exported_at"`
+	Files      []string    `json:"files"`
+}
+
+func newExportedMessage(rec HistoryRecord) ExportedMessage {
+	out := ExportedMessage{
+		ID:         rec.ID,
+		ChannelID:  rec.ChannelID,
+		SenderID:   rec.SenderID,
+		SenderName: rec.SenderName,
+		Timestamp:  rec.Timestamp,
+		Type:       rec.Type,
+	}
+	if utf8.Valid(rec.Content) {
+		out.Text = string(rec.Content)
+	} else {
+		out.ContentBase64 = base64.StdEncoding.EncodeToString(rec.Content)
+	}
+	out.Attachment = rec.Attachment
+	if out.Attachment == nil {
+		out.Attachment = parseAttachmentRef(out.Text)
+	}
+	return out
+}
+
+// parseAttachmentRef recognises the "FILE:<id>:<name>" content that clients
+// sent before messages carried an attachment descriptor.
+func parseAttachmentRef(text string) *protocol.Attachment {
+	rest, ok := strings.CutPrefix(text, "FILE:")
+	if !ok {
+		return nil
+	}
+	id, name, _ := strings.Cut(rest, ":")
+	if id == "" {
+		return nil
+	}
+	return &protocol.Attachment{FileID: id, Name: name}
+}
+
+// forEachExportedMessage walks a channel's full history page by page.
+func (r *MessageRouter) forEachExportedMessage(channelID string, fn func(ExportedMessage) error) error {
+	var cursor HistoryCursor
+	for {
+		page, err := r.store.HistoryPage(channelID, cursor, exportPageSize)
+		if err != nil {
+			return err
+		}
+		for _, rec := range page {
+			if err := fn(newExportedMessage(rec)); err != nil {
+				return err
+			}
+		}
+		if len(page) < exportPageSize {
+			return nil
+		}
+		last := page[len(page)-1]
+		cursor = HistoryCursor{Timestamp: last.Timestamp, ID: last.ID}
+	}
+}
+
+func (r *MessageRouter) writeJSONLExport(w io.Writer, channelID string) error {
+	enc := json.NewEncoder(w)
+	return r.forEachExportedMessage(channelID, func(m ExportedMessage) error {
+		return enc.Encode(m)
+	})
+}
+
+var exportHTMLHead = template.Must(template.New("head").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>#{{.Channel.Name}} transcript</title>
+<style>
+body{font-family:-apple-system,"Segoe UI",Roboto,sans-serif;margin:2rem auto;max-width:52rem;color:#1d1c1d}
+h1{font-size:1.4rem;margin-bottom:.2rem}
+.meta{color:#616061;font-size:.85rem;margin-bottom:1.5rem}
+.msg{padding:.4rem 0;border-bottom:1px solid #eee}
+.sender{font-weight:600}
+.time{color:#616061;font-size:.75rem;margin-left:.5rem}
+.text{white-space:pre-wrap;margin-top:.15rem}
+.file{margin-top:.15rem;font-size:.9rem}
+.binary{color:#616061;font-style:italic}
+</style>
+</head>
+<body>
+<h1>#{{.Channel.Name}}</h1>
+<div class="meta">Channel {{.Channel.ID}} ({{.Channel.Type}}) &middot; exported by {{.ExportedBy}} at {{.ExportedAt}}</div>
+`))
+
+var exportHTMLMessage = template.Must(template.New("msg").Parse(`<div class="msg" id="{{.ID}}">
+<span class="sender">{{.SenderName}}</span><span class="time">{{.Time}}</span>
+{{- if .Attachment}}
+<div class="file">{{if .Attachment.Voice}}&#127908; voice note {{.Duration}}{{else}}&#128206; {{if .Attachment.Name}}{{.Attachment.Name}}{{else}}file{{end}}{{end}} <code>{{.Attachment.FileID}}</code></div>
+{{- else if .ContentBase64}}
+<div class="text binary">[binary content, {{len .ContentBase64}} base64 bytes]</div>
+{{- else}}
+<div class="text">{{.Text}}</div>
+{{- end}}
+</div>
+`))
+
+const exportHTMLFoot = "</body>\n</html>\n"
+
+type htmlExportMessage struct {
+	ExportedMessage
+	Time     string
+	Duration string
+}
+
+func (r *MessageRouter) writeHTMLExport(w io.Writer, channel ChannelView, exportedBy string, at time.Time) error {
+	head := map[string]interface{}{
+		"Channel":    channel,
+		"ExportedBy": exportedBy,
+		"ExportedAt": at.UTC().Format(time.RFC3339),
+	}
+	if err := exportHTMLHead.Execute(w, head); err != nil {
+		return err
+	}
+	err := r.forEachExportedMessage(channel.ID, func(m ExportedMessage) error {
+		hm := htmlExportMessage{
+			ExportedMessage: m,
+			Time:            time.UnixMilli(m.Timestamp).UTC().Format("2006-01-02 15:04:05 UTC"),
+		}
+		if m.Attachment != nil && m.Attachment.Voice != nil {
+			secs := (m.Attachment.Voice.DurationMs + 500) / 1000
+			hm.Duration = fmt.Sprintf("%d:%02d", secs/60, secs%60)
+		}
+		return exportHTMLMessage.Execute(w, hm)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, exportHTMLFoot)
+	return err
+}
+
+func (r *MessageRouter) writeZipExport(w io.Writer, channel ChannelView, exportedBy string, at time.Time) error {
+	zw := zip.NewWriter(w)
+	manifest := ExportManifest{
+		Channel:    channel,
+		ExportedBy: exportedBy,
+		ExportedAt: at.Unix(),
+		Files:      []string{"messages.jsonl", "transcript.html"},
+	}
+	mf, err := zw.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(mf).Encode(manifest); err != nil {
+		return err
+	}
+	jf, err := zw.Create("messages.jsonl")
+	if err != nil {
+		return err
+	}
+	if err := r.writeJSONLExport(jf, channel.ID); err != nil {
+		return err
+	}
+	hf, err := zw.Create("transcript.html")
+	if err != nil {
+		return err
+	}
+	if err := r.writeHTMLExport(hf, channel, exportedBy, at); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func exportFilename(channel ChannelView, ext string) string {
+	base := channel.Name
+	if channel.Type == "dm" || base == "" {
+		base = channel.ID
+	}
+	base = strings.Trim(unsafeFilenameChars.ReplaceAllString(base, "-"), "-")
+	if base == "" {
+		base = "channel"
+	}
+	return base + "." + ext
+}
+
+// ExportHandler streams a channel's full history as JSONL, a self-contained
+// HTML transcript, or a zip containing both.
+// GET /export?channel_id={id}&format=jsonl|html|zip
+func (r *MessageRouter) ExportHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, err := r.authenticate(req)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	requestedChannelID := req.URL.Query().Get("channel_id")
+	if requestedChannelID == "" {
+		http.Error(w, "missing channel_id", http.StatusBadRequest)
+		return
+	}
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		format = "jsonl"
+	}
+	if format != "jsonl" && format != "html" && format != "zip" {
+		http.Error(w, "format must be jsonl, html or zip", http.StatusBadRequest)
+		return
+	}
+
+	channelID, err := r.resolveRequestedChannel(userID, requestedChannelID)
+	if err != nil {
+		http.Error(w, "channel not found", http.StatusNotFound)
+		return
+	}
+	if err := r.authorizeChannelAccess(userID, channelID); err != nil {
+		if errors.Is(err, errForbidden) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		http.Error(w, "channel not found", http.StatusNotFound)
+		return
+	}
+	channel, err := r.store.GetChannel(channelID)
+	if err != nil {
+		http.Error(w, "channel not found", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	filename := exportFilename(channel, format)
+	switch format {
+	case "jsonl":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	case "zip":
+		w.Header().Set("Content-Type", "application/zip")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+	// Headers are already sent once streaming starts, so failures after this
+	// point can only be logged and the response truncated.
+	switch format {
+	case "jsonl":
+		err = r.writeJSONLExport(w, channelID)
+	case "html":
+		err = r.writeHTMLExport(w, channel, userID, now)
+	case "zip":
+		err = r.writeZipExport(w, channel, userID, now)
+	}
+	if err != nil {
+		log.Printf("export of channel %s as %s failed: %v", channelID, format, err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func exportRequest(t *testing.T, r *MessageRouter, username, query string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/export?"+query, nil)
+	if username != "" {
+		req.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, username))
+	}
+	rec := httptest.NewRecorder()
+	r.ExportHandler(rec, req)
+	return rec
+}
+
+func TestExportRespectsChannelAuthorization(t *testing.T) {
+	r := newMessagingTestRouter(t)
+
+	if rec := exportRequest(t, r, "", "channel_id=priv-1"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+	if rec := exportRequest(t, r, "charlie", "channel_id=priv-1"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", rec.Code)
+	}
+	if rec := exportRequest(t, r, "alice", "channel_id=priv-1&format=pdf"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown format, got %d", rec.Code)
+	}
+	if rec := exportRequest(t, r, "alice", "channel_id=nope"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestExportJSONLStreamsFullHistory(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	if _, err := r.db.Exec(`UPDATE users SET full_name = 'Alice Anderson' WHERE id = 'u-alice'`); err != nil {
+		t.Fatalf("set full name: %v", err)
+	}
+
+	// More than two pages, with timestamp ties across page boundaries.
+	total := 2*exportPageSize + 7
+	tx, err := r.db.Begin()
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	for i := 0; i < total; i++ {
+		_, err := tx.Exec(`INSERT INTO messages (id, channel_id, sender_id, timestamp, type, content, nonce, signature)
+			VALUES (?, 'general', 'u-alice', ?, 1, ?, '', '')`,
+			fmt.Sprintf("g-%05d", i), 1_700_000_000_000+int64(i/3), []byte(fmt.Sprintf("msg %d", i)))
+		if err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO messages (id, channel_id, sender_id, timestamp, type, content, nonce, signature)
+		VALUES ('g-file', 'general', 'u-bob', 1800000000000, 3, 'FILE:f-123:report.pdf', '', '')`)
+	if err != nil {
+		t.Fatalf("insert file message: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	rec := exportRequest(t, r, "charlie", "channel_id=general&format=jsonl")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	if cd := rec.Header().Get("Content-Disposition"); !strings.Contains(cd, `filename="General.jsonl"`) {
+		t.Fatalf("unexpected content disposition %q", cd)
+	}
+
+	var lines []ExportedMessage
+	sc := bufio.NewScanner(rec.Body)
+	for sc.Scan() {
+		var m ExportedMessage
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			t.Fatalf("decode line %d: %v", len(lines), err)
+		}
+		lines = append(lines, m)
+	}
+	if len(lines) != total+1 {
+		t.Fatalf("expected %d messages, got %d", total+1, len(lines))
+	}
+	seen := make(map[string]bool, len(lines))
+	for i, m := range lines {
+		if seen[m.ID] {
+			t.Fatalf("duplicate message %s", m.ID)
+		}
+		seen[m.ID] = true
+		if i > 0 && m.Timestamp < lines[i-1].Timestamp {
+			t.Fatalf("messages out of order at %d", i)
+		}
+	}
+	if lines[0].SenderName != "Alice Anderson" || lines[0].Text != "msg 0" {
+		t.Fatalf("unexpected first message %+v", lines[0])
+	}
+	last := lines[len(lines)-1]
+	if last.SenderName != "bob" || last.Attachment == nil || last.Attachment.FileID != "f-123" || last.Attachment.Name != "report.pdf" {
+		t.Fatalf("unexpected attachment message %+v", last)
+	}
+}
+
+func TestExportHTMLEscapesContent(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	_, err := r.db.Exec(`INSERT INTO messages (id, channel_id, sender_id, timestamp, type, content, nonce, signature)
+		VALUES ('m-xss', 'priv-1', 'u-bob', 1700000000000, 1, '<script>alert(1)</script>', '', '')`)
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	rec := exportRequest(t, r, "bob", "channel_id=priv-1&format=html")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	if strings.Contains(body, "<script>") {
+		t.Fatalf("transcript contains unescaped content")
+	}
+	if !strings.Contains(body, "&lt;script&gt;alert(1)&lt;/script&gt;") || !strings.HasSuffix(body, "</html>\n") {
+		t.Fatalf("unexpected transcript:\n%s", body)
+	}
+}
+
+func TestExportZipContainsAllFormats(t *testing.T) {
+	r := newMessagingTestRouter(t)
+
+	rec := exportRequest(t, r, "alice", "channel_id=priv-1&format=zip")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatalf("open zip: %v", err)
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("open %s: %v", f.Name, err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(data)
+	}
+	var manifest ExportManifest
+	if err := json.Unmarshal([]byte(files["manifest.json"]), &manifest); err != nil || manifest.Channel.ID != "priv-1" {
+		t.Fatalf("unexpected manifest %q (err=%v)", files["manifest.json"], err)
+	}
+	if !strings.Contains(files["messages.jsonl"], `"id":"m-1"`) {
+		t.Fatalf("messages.jsonl missing message: %q", files["messages.jsonl"])
+	}
+	if !strings.Contains(files["transcript.html"], "Private One") {
+		t.Fatalf("transcript.html missing channel name")
+	}
+}
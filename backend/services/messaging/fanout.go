@@ -0,0 +1,387 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"lan-chat/protocol"
+
+	"github.com/google/uuid"
+)
+
+// fanOutSchema stores the per-device copies of fan-out messages and the
+// encrypted transfers a user's devices leave for each other.
+const fanOutSchema = `
+	CREATE TABLE IF NOT EXISTS message_device_payloads (
+		message_id TEXT NOT NULL,
+		channel_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		content TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		PRIMARY KEY (message_id, device_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_message_device_payloads_channel ON message_device_payloads(channel_id, created_at);
+	CREATE TABLE IF NOT EXISTS device_transfers (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		from_device_id TEXT NOT NULL,
+		to_device_id TEXT NOT NULL,
+		content TEXT NOT NULL,
+		size BIGINT NOT NULL,
+		created_at BIGINT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_device_transfers_target ON device_transfers(to_device_id, created_at);
+`
+
+// FanOutLimits bounds fan-out messages and device-to-device transfers.
+type FanOutLimits struct {
+	MaxRecipients    int           // device ciphertexts in one message
+	MaxTransferBytes int           // ciphertext size of one transfer
+	TransferTTL      time.Duration // transfers not collected by then are dropped
+}
+
+func fanOutLimitsFromEnv() FanOutLimits {
+	return FanOutLimits{
+		MaxRecipients:    envInt("MESSAGING_FANOUT_MAX_DEVICES", 200),
+		MaxTransferBytes: envInt("MESSAGING_DEVICE_TRANSFER_MAX_BYTES", 16<<20),
+		TransferTTL:      envDuration("MESSAGING_DEVICE_TRANSFER_TTL", 7*24*time.Hour),
+	}
+}
+
+var (
+	errRecipientsWithContent = errors.New("content must be empty when recipients are set")
+	errRecipientsDevice      = errors.New("device_id must name one of the sender's devices")
+	errRecipientsLimit       = errors.New("too many recipient devices")
+	errRecipientInvalid      = errors.New("each recipient needs a device_id and content")
+	errRecipientDuplicate    = errors.New("duplicate recipient device")
+	errRecipientUnknown      = errors.New("recipient device not found in this channel")
+)
+
+func isRecipientsError(err error) bool {
+	for _, target := range []error{errRecipientsWithContent, errRecipientsDevice, errRecipientsLimit,
+		errRecipientInvalid, errRecipientDuplicate, errRecipientUnknown} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func recipientsErrorDetail(err error, channelID string) protocol.ErrorDetail {
+	return protocol.ErrorDetail{Code: "invalid_recipients", Message: err.Error(), ChannelID: channelID}
+}
+
+// resolveRecipients checks the per-device ciphertexts of a fan-out message
+// and fills in the owner of each device. Every device must belong to a
+// user who may read the channel.
+func (r *MessageRouter) resolveRecipients(req *protocol.SendMessageRequest, senderID, channelID string) error {
+	if len(req.Recipients) == 0 {
+		return nil
+	}
+	if len(req.Content) > 0 {
+		return errRecipientsWithContent
+	}
+	if len(req.Recipients) > r.fanOut.MaxRecipients {
+		return errRecipientsLimit
+	}
+	if owner, err := r.deviceOwner(req.DeviceID); err != nil || owner != senderID {
+		return errRecipientsDevice
+	}
+	seen := make(map[string]bool, len(req.Recipients))
+	allowed := make(map[string]bool)
+	for i := range req.Recipients {
+		c := &req.Recipients[i]
+		if c.DeviceID == "" || len(c.Content) == 0 {
+			return errRecipientInvalid
+		}
+		if seen[c.DeviceID] {
+			return errRecipientDuplicate
+		}
+		seen[c.DeviceID] = true
+		owner, err := r.deviceOwner(c.DeviceID)
+		if err != nil || (c.UserID != "" && c.UserID != owner) {
+			return errRecipientUnknown
+		}
+		if _, checked := allowed[owner]; !checked {
+			allowed[owner] = r.authorizeChannelAccess(owner, channelID) == nil
+		}
+		if !allowed[owner] {
+			return errRecipientUnknown
+		}
+		c.UserID = owner
+	}
+	return nil
+}
+
+func (r *MessageRouter) saveDevicePayloads(msg *protocol.Message, recipients []protocol.DeviceCiphertext) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, c := range recipients {
+		if _, err := tx.Exec(r.bind(`
+			INSERT INTO message_device_payloads (message_id, channel_id, user_id, device_id, content, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)`),
+			msg.ID, msg.ChannelID, c.UserID, c.DeviceID, base64.StdEncoding.EncodeToString(c.Content), msg.Timestamp); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// devicePayloads loads the per-device copies of the fan-out messages of a
+// channel with timestamps in [from, to], keyed by message and device ID.
+func (r *MessageRouter) devicePayloads(channelID string, from, to int64) (map[string]map[string][]byte, error) {
+	rows, err := r.db.Query(r.bind(`
+		SELECT message_id, device_id, content FROM message_device_payloads
+		WHERE channel_id = ? AND created_at >= ? AND created_at <= ?`), channelID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]map[string][]byte)
+	for rows.Next() {
+		var messageID, deviceID, encoded string
+		if err := rows.Scan(&messageID, &deviceID, &encoded); err != nil {
+			return nil, err
+		}
+		content, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		if out[messageID] == nil {
+			out[messageID] = make(map[string][]byte)
+		}
+		out[messageID][deviceID] = content
+	}
+	return out, rows.Err()
+}
+
+// deviceCopy returns msg as deviceID sees it: with its own ciphertext as
+// Content, or with no content if the sender did not encrypt to it.
+func deviceCopy(msg *protocol.Message, deviceID string, payloads map[string][]byte) *protocol.Message {
+	out := *msg
+	out.FanOut = true
+	out.Content = nil
+	if content, ok := payloads[deviceID]; ok && deviceID != "" {
+		out.Content = content
+		out.RecipientDeviceID = deviceID
+	}
+	return &out
+}
+
+// applyDevicePayloads rewrites the fan-out messages of a history page for
+// deviceID (empty for a connection not bound to a device).
+func (r *MessageRouter) applyDevicePayloads(channelID string, history []protocol.Message, deviceID string) error {
+	if len(history) == 0 {
+		return nil
+	}
+	from, to := history[0].Timestamp, history[0].Timestamp
+	for _, m := range history {
+		from, to = min(from, m.Timestamp), max(to, m.Timestamp)
+	}
+	payloads, err := r.devicePayloads(channelID, from, to)
+	if err != nil {
+		return err
+	}
+	for i := range history {
+		if p, ok := payloads[history[i].ID]; ok {
+			history[i] = *deviceCopy(&history[i], deviceID, p)
+		}
+	}
+	return nil
+}
+
+// ownDevice checks that deviceID, if set, belongs to userID.
+func (r *MessageRouter) ownDevice(userID, deviceID string) bool {
+	if deviceID == "" {
+		return true
+	}
+	owner, err := r.deviceOwner(deviceID)
+	return err == nil && owner == userID
+}
+
+// deleteDeviceFanOut drops the message copies and transfers of a removed
+// device; nothing else can decrypt them.
+func (r *MessageRouter) deleteDeviceFanOut(tx *sql.Tx, deviceID string) {
+	if _, err := tx.Exec(r.bind(`DELETE FROM message_device_payloads WHERE device_id = ?`), deviceID); err != nil {
+		log.Printf("failed to delete message copies for device %s: %v", deviceID, err)
+	}
+	if _, err := tx.Exec(r.bind(`DELETE FROM device_transfers WHERE to_device_id = ? OR from_device_id = ?`), deviceID, deviceID); err != nil {
+		log.Printf("failed to delete transfers for device %s: %v", deviceID, err)
+	}
+}
+
+// DeviceTransferRequest carries data, typically history, from one of the
+// caller's devices to another. Content is ciphertext from the pairwise
+// session between the two devices; the server only relays it.
+type DeviceTransferRequest struct {
+	FromDeviceID string `json:"from_device_id"`
+	ToDeviceID   string `json:"to_device_id"`
+	Content      []byte `json:"content"`
+}
+
+// DeviceTransfer is a transfer waiting for its target device.
+type DeviceTransfer struct {
+	ID           string `json:"id"`
+	FromDeviceID string `json:"from_device_id"`
+	ToDeviceID   string `json:"to_device_id"`
+	Content      []byte `json:"content,omitempty"`
+	Size         int64  `json:"size"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+// DeviceTransfersHandler relays encrypted transfers between the caller's
+// devices: POST leaves one, GET ?device_id= lists those waiting for a
+// device and DELETE ?id= acknowledges one after it was stored.
+func (r *MessageRouter) DeviceTransfersHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := r.authenticate(req)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	r.purgeDeviceTransfers(time.Now())
+
+	switch req.Method {
+	case http.MethodPost:
+		// Content is base64 in JSON: allow a third more, plus the fields.
+		limit := int64(r.fanOut.MaxTransferBytes)*4/3 + 4096
+		var body DeviceTransferRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, limit)).Decode(&body); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "transfer too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if body.FromDeviceID == "" || body.ToDeviceID == "" || body.FromDeviceID == body.ToDeviceID || len(body.Content) == 0 {
+			http.Error(w, "from_device_id, to_device_id and content are required", http.StatusBadRequest)
+			return
+		}
+		if len(body.Content) > r.fanOut.MaxTransferBytes {
+			http.Error(w, "transfer too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if !r.ownDevice(userID, body.FromDeviceID) || !r.ownDevice(userID, body.ToDeviceID) {
+			http.Error(w, "device not found", http.StatusNotFound)
+			return
+		}
+		t := DeviceTransfer{
+			ID:           uuid.New().String(),
+			FromDeviceID: body.FromDeviceID,
+			ToDeviceID:   body.ToDeviceID,
+			Size:         int64(len(body.Content)),
+			CreatedAt:    time.Now().Unix(),
+		}
+		_, err := r.db.Exec(r.bind(`
+			INSERT INTO device_transfers (id, user_id, from_device_id, to_device_id, content, size, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`),
+			t.ID, userID, t.FromDeviceID, t.ToDeviceID, base64.StdEncoding.EncodeToString(body.Content), t.Size, t.CreatedAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_ = r.audit.LogJSON(userID, "devices.transfer", "device:"+t.ToDeviceID, map[string]interface{}{
+			"from_device_id": t.FromDeviceID,
+			"size":           t.Size,
+		})
+		r.sendNotice(userID, &protocol.Notice{
+			Kind:     protocol.NoticeDeviceTransfer,
+			UserID:   userID,
+			DeviceID: t.ToDeviceID,
+			Data: map[string]string{
+				"transfer_id":    t.ID,
+				"from_device_id": t.FromDeviceID,
+				"size":           strconv.FormatInt(t.Size, 10),
+			},
+			Timestamp: time.Now().UnixMilli(),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(t)
+
+	case http.MethodGet:
+		deviceID := req.URL.Query().Get("device_id")
+		if deviceID == "" || !r.ownDevice(userID, deviceID) {
+			http.Error(w, "device not found", http.StatusNotFound)
+			return
+		}
+		transfers, err := r.listDeviceTransfers(userID, deviceID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"transfers": transfers})
+
+	case http.MethodDelete:
+		res, err := r.db.Exec(r.bind(`DELETE FROM device_transfers WHERE id = ? AND user_id = ?`), req.URL.Query().Get("id"), userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "transfer not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *MessageRouter) listDeviceTransfers(userID, deviceID string) ([]DeviceTransfer, error) {
+	rows, err := r.db.Query(r.bind(`
+		SELECT id, from_device_id, to_device_id, content, size, created_at FROM device_transfers
+		WHERE user_id = ? AND to_device_id = ?
+		ORDER BY created_at ASC, id ASC`), userID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	transfers := make([]DeviceTransfer, 0)
+	for rows.Next() {
+		var t DeviceTransfer
+		var encoded string
+		if err := rows.Scan(&t.ID, &t.FromDeviceID, &t.ToDeviceID, &encoded, &t.Size, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		if t.Content, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, fmt.Errorf("transfer %s: %w", t.ID, err)
+		}
+		transfers = append(transfers, t)
+	}
+	return transfers, rows.Err()
+}
+
+// purgeDeviceTransfers drops transfers older than the configured TTL.
+func (r *MessageRouter) purgeDeviceTransfers(now time.Time) {
+	cutoff := now.Add(-r.fanOut.TransferTTL).Unix()
+	if _, err := r.db.Exec(r.bind(`DELETE FROM device_transfers WHERE created_at < ?`), cutoff); err != nil {
+		log.Printf("failed to purge device transfers: %v", err)
+	}
+}
+
+// announceNewDevice tells the user's other devices that deviceID published
+// its first identity key, so one of them can send it the history.
+func (r *MessageRouter) announceNewDevice(userID, deviceID string) {
+	r.sendNotice(userID, &protocol.Notice{
+		Kind:      protocol.NoticeDeviceAdded,
+		UserID:    userID,
+		DeviceID:  deviceID,
+		Timestamp: time.Now().UnixMilli(),
+	})
+}
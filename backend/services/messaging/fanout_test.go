@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"lan-chat/protocol"
+)
+
+func nextMessage(t *testing.T, c *Client) *protocol.Message {
+	t.Helper()
+	select {
+	case data := <-c.Send:
+		env, err := c.Codec.DecodeFrame(data)
+		if err != nil || env.Message == nil {
+			t.Fatalf("expected message frame, got %s (%v)", data, err)
+		}
+		return env.Message
+	default:
+		t.Fatalf("expected a message for %s/%s", c.UserID, c.DeviceID)
+	}
+	return nil
+}
+
+func TestFanOutDeliversEachDeviceItsOwnCiphertext(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	aliceDesk, _ := registerTestDeviceKey(t, r, "alice")
+	aliceLaptop, _ := registerTestDeviceKey(t, r, "alice")
+	bobDesk, _ := registerTestDeviceKey(t, r, "bob")
+	bobLaptop, _ := registerTestDeviceKey(t, r, "bob")
+
+	bobDeskConn := r.RegisterDevice("u-bob", bobDesk, nil)
+	bobLaptopConn := r.RegisterDevice("u-bob", bobLaptop, nil)
+	bobUnbound := r.Register("u-bob", nil)
+	aliceLaptopConn := r.RegisterDevice("u-alice", aliceLaptop, nil)
+
+	msg, err := r.SaveMessage(protocol.SendMessageRequest{
+		ChannelID: "priv-1",
+		Type:      protocol.MessageTypeText,
+		DeviceID:  aliceDesk,
+		Recipients: []protocol.DeviceCiphertext{
+			{DeviceID: bobDesk, Content: []byte("ct for bob desk")},
+			{UserID: "u-bob", DeviceID: bobLaptop, Content: []byte("ct for bob laptop")},
+			{DeviceID: aliceLaptop, Content: []byte("ct for alice laptop")},
+		},
+	}, "u-alice", "priv-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Broadcast(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	for conn, want := range map[*Client]string{
+		bobDeskConn:     "ct for bob desk",
+		bobLaptopConn:   "ct for bob laptop",
+		aliceLaptopConn: "ct for alice laptop",
+		bobUnbound:      "",
+	} {
+		got := nextMessage(t, conn)
+		if !got.FanOut || string(got.Content) != want || got.DeviceID != aliceDesk {
+			t.Fatalf("%s/%s got %+v, want content %q", conn.UserID, conn.DeviceID, got, want)
+		}
+		if want != "" && got.RecipientDeviceID != conn.DeviceID {
+			t.Fatalf("expected recipient device %s, got %q", conn.DeviceID, got.RecipientDeviceID)
+		}
+	}
+
+	// History gives each device its own copy; no device means no content.
+	history := func(username, deviceID string) (*httptest.ResponseRecorder, []protocol.Message) {
+		req := httptest.NewRequest(http.MethodGet, "/history?channel_id=priv-1&device_id="+deviceID, nil)
+		req.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, username))
+		rec := httptest.NewRecorder()
+		r.HistoryHandler(rec, req)
+		var msgs []protocol.Message
+		_ = json.Unmarshal(rec.Body.Bytes(), &msgs)
+		return rec, msgs
+	}
+	find := func(msgs []protocol.Message) *protocol.Message {
+		for i := range msgs {
+			if msgs[i].ID == msg.ID {
+				return &msgs[i]
+			}
+		}
+		t.Fatalf("message %s missing from history", msg.ID)
+		return nil
+	}
+	_, msgs := history("bob", bobLaptop)
+	if got := find(msgs); string(got.Content) != "ct for bob laptop" || got.RecipientDeviceID != bobLaptop {
+		t.Fatalf("unexpected history copy %+v", got)
+	}
+	_, msgs = history("bob", "")
+	if got := find(msgs); !got.FanOut || len(got.Content) != 0 {
+		t.Fatalf("expected no content without a device, got %+v", got)
+	}
+	if rec, _ := history("bob", aliceLaptop); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected another user's device to be refused, got %d", rec.Code)
+	}
+}
+
+func TestFanOutRejectsInvalidRecipients(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	r.fanOut.MaxRecipients = 2
+	aliceDesk, _ := registerTestDeviceKey(t, r, "alice")
+	bobDesk, _ := registerTestDeviceKey(t, r, "bob")
+	charlieDesk, _ := registerTestDeviceKey(t, r, "charlie")
+	to := func(deviceID string) protocol.DeviceCiphertext {
+		return protocol.DeviceCiphertext{DeviceID: deviceID, Content: []byte("ct")}
+	}
+
+	cases := []struct {
+		name string
+		req  protocol.SendMessageRequest
+		want error
+	}{
+		{"content and recipients", protocol.SendMessageRequest{Content: []byte("hi"), DeviceID: aliceDesk, Recipients: []protocol.DeviceCiphertext{to(bobDesk)}}, errRecipientsWithContent},
+		{"no sending device", protocol.SendMessageRequest{Recipients: []protocol.DeviceCiphertext{to(bobDesk)}}, errRecipientsDevice},
+		{"someone else's device", protocol.SendMessageRequest{DeviceID: bobDesk, Recipients: []protocol.DeviceCiphertext{to(bobDesk)}}, errRecipientsDevice},
+		{"too many", protocol.SendMessageRequest{DeviceID: aliceDesk, Recipients: []protocol.DeviceCiphertext{to(bobDesk), to(aliceDesk), to("d-x")}}, errRecipientsLimit},
+		{"empty ciphertext", protocol.SendMessageRequest{DeviceID: aliceDesk, Recipients: []protocol.DeviceCiphertext{{DeviceID: bobDesk}}}, errRecipientInvalid},
+		{"duplicate", protocol.SendMessageRequest{DeviceID: aliceDesk, Recipients: []protocol.DeviceCiphertext{to(bobDesk), to(bobDesk)}}, errRecipientDuplicate},
+		{"unknown device", protocol.SendMessageRequest{DeviceID: aliceDesk, Recipients: []protocol.DeviceCiphertext{to("d-missing")}}, errRecipientUnknown},
+		{"not a member", protocol.SendMessageRequest{DeviceID: aliceDesk, Recipients: []protocol.DeviceCiphertext{to(charlieDesk)}}, errRecipientUnknown},
+		{"wrong owner", protocol.SendMessageRequest{DeviceID: aliceDesk, Recipients: []protocol.DeviceCiphertext{{UserID: "u-alice", DeviceID: bobDesk, Content: []byte("ct")}}}, errRecipientUnknown},
+	}
+	for _, tc := range cases {
+		tc.req.ChannelID = "priv-1"
+		if _, err := r.SaveMessage(tc.req, "u-alice", "priv-1"); !errors.Is(err, tc.want) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.want, err)
+		}
+		if !isRecipientsError(tc.want) {
+			t.Fatalf("%s: %v is not reported as invalid_recipients", tc.name, tc.want)
+		}
+	}
+}
+
+func postTransfer(t *testing.T, r *MessageRouter, username string, body DeviceTransferRequest) *httptest.ResponseRecorder {
+	t.Helper()
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, "/devices/transfers", bytes.NewReader(data))
+	req.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, username))
+	rec := httptest.NewRecorder()
+	r.DeviceTransfersHandler(rec, req)
+	return rec
+}
+
+func listTransfers(t *testing.T, r *MessageRouter, username, deviceID string) (int, []DeviceTransfer) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/devices/transfers?device_id="+deviceID, nil)
+	req.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, username))
+	rec := httptest.NewRecorder()
+	r.DeviceTransfersHandler(rec, req)
+	var out struct {
+		Transfers []DeviceTransfer `json:"transfers"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &out)
+	return rec.Code, out.Transfers
+}
+
+func TestDeviceTransferRelaysHistoryToNewDevice(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	r.fanOut.MaxTransferBytes = 64
+	oldDevice, _ := registerTestDeviceKey(t, r, "alice")
+	newDevice, _ := registerTestDeviceKey(t, r, "alice")
+	bobDevice, _ := registerTestDeviceKey(t, r, "bob")
+	newConn := r.RegisterDevice("u-alice", newDevice, nil)
+
+	// Publishing the first identity key tells the user's other devices.
+	d := newTestPreKeyDevice(t, r, "alice", 1)
+	if rec := postPreKeys(t, r, tokenForTestUser(t, "alice"), d.upload()); rec.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", rec.Code, rec.Body.String())
+	}
+	if n := nextNotice(t, newConn); n.Kind != protocol.NoticeDeviceAdded || n.DeviceID != d.id {
+		t.Fatalf("unexpected notice %+v", n)
+	}
+
+	history := []byte("ratchet-encrypted history")
+	rec := postTransfer(t, r, "alice", DeviceTransferRequest{FromDeviceID: oldDevice, ToDeviceID: newDevice, Content: history})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("transfer: %d %s", rec.Code, rec.Body.String())
+	}
+	var created DeviceTransfer
+	_ = json.Unmarshal(rec.Body.Bytes(), &created)
+	if n := nextNotice(t, newConn); n.Kind != protocol.NoticeDeviceTransfer || n.DeviceID != newDevice || n.Data["transfer_id"] != created.ID || n.Data["from_device_id"] != oldDevice {
+		t.Fatalf("unexpected notice %+v", n)
+	}
+
+	for _, bad := range []struct {
+		username string
+		body     DeviceTransferRequest
+		want     int
+	}{
+		{"bob", DeviceTransferRequest{FromDeviceID: bobDevice, ToDeviceID: newDevice, Content: history}, http.StatusNotFound},
+		{"alice", DeviceTransferRequest{FromDeviceID: oldDevice, ToDeviceID: oldDevice, Content: history}, http.StatusBadRequest},
+		{"alice", DeviceTransferRequest{FromDeviceID: oldDevice, ToDeviceID: newDevice, Content: bytes.Repeat([]byte("x"), 65)}, http.StatusRequestEntityTooLarge},
+	} {
+		if rec := postTransfer(t, r, bad.username, bad.body); rec.Code != bad.want {
+			t.Fatalf("expected %d for %+v, got %d", bad.want, bad.body, rec.Code)
+		}
+	}
+
+	if code, _ := listTransfers(t, r, "bob", newDevice); code != http.StatusNotFound {
+		t.Fatalf("expected another user's device to be refused, got %d", code)
+	}
+	code, transfers := listTransfers(t, r, "alice", newDevice)
+	if code != http.StatusOK || len(transfers) != 1 || !bytes.Equal(transfers[0].Content, history) || transfers[0].FromDeviceID != oldDevice {
+		t.Fatalf("unexpected transfers %d %+v", code, transfers)
+	}
+
+	del := httptest.NewRequest(http.MethodDelete, "/devices/transfers?id="+created.ID, nil)
+	del.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, "bob"))
+	rec = httptest.NewRecorder()
+	r.DeviceTransfersHandler(rec, del)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected bob not to acknowledge alice's transfer, got %d", rec.Code)
+	}
+	del.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, "alice"))
+	rec = httptest.NewRecorder()
+	r.DeviceTransfersHandler(rec, del)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("acknowledge: %d %s", rec.Code, rec.Body.String())
+	}
+	if _, transfers := listTransfers(t, r, "alice", newDevice); len(transfers) != 0 {
+		t.Fatalf("expected acknowledged transfer to be gone, got %+v", transfers)
+	}
+
+	// Removing a device drops what was waiting for it.
+	postTransfer(t, r, "alice", DeviceTransferRequest{FromDeviceID: oldDevice, ToDeviceID: newDevice, Content: history})
+	remove := httptest.NewRequest(http.MethodDelete, "/devices/keys?device_id="+newDevice, nil)
+	remove.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, "alice"))
+	r.DeviceKeysHandler(httptest.NewRecorder(), remove)
+	var left int
+	_ = r.db.QueryRow(`SELECT COUNT(*) FROM device_transfers`).Scan(&left)
+	if left != 0 {
+		t.Fatalf("expected transfers of a removed device to be deleted, %d left", left)
+	}
+}
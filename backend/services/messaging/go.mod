@@ -6,8 +6,14 @@ require (
 	github.com/golang-jwt/jwt/v5 v5.2.0
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.3
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.22
+	lan-chat/jwks v0.0.0
 	lan-chat/protocol v0.0.0
 )
 
+require google.golang.org/protobuf v1.34.2 // indirect
+
 replace lan-chat/protocol => ../../pkg/protocol
+
+replace lan-chat/jwks => ../../pkg/jwks
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"lan-chat/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// HandshakeConfig controls the Hello/Welcome exchange on /ws.
+type HandshakeConfig struct {
+	// MinVersion is the oldest client protocol version accepted. The default
+	// 0 keeps clients that never send a Hello working; raise it to 1 once the
+	// whole fleet has upgraded.
+	MinVersion   int32
+	HelloTimeout time.Duration // how long to wait for Hello when it is required
+}
+
+func handshakeConfigFromEnv() HandshakeConfig {
+	return HandshakeConfig{
+		MinVersion:   int32(envInt("MESSAGING_WS_MIN_VERSION", 0)),
+		HelloTimeout: envDuration("MESSAGING_WS_HELLO_TIMEOUT", 10*time.Second),
+	}
+}
+
+// capabilities lists the features this server advertises in Welcome.
+func (r *MessageRouter) capabilities() []string {
+	caps := []string{
+		protocol.CapabilityAttachments,
+		protocol.CapabilityBinary,
+		protocol.CapabilityCommands,
+		protocol.CapabilityEphemeral,
+		protocol.CapabilityNotices,
+		protocol.CapabilityVoice,
+	}
+	if r.signatures.Mode != signaturePolicyOff {
+		caps = append(caps, protocol.CapabilitySignatures)
+	}
+	return caps
+}
+
+func (r *MessageRouter) negotiate(h *protocol.Hello) (*protocol.Welcome, error) {
+	return protocol.Negotiate(h, r.handshake.MinVersion, protocol.ProtocolVersion, r.capabilities())
+}
+
+// awaitHello reads the first frame of a connection that must introduce
+// itself and negotiates it.
+func (r *MessageRouter) awaitHello(conn *websocket.Conn, codec protocol.Codec) (*protocol.Welcome, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(r.handshake.HelloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return nil, helloRequiredError()
+	}
+	env, err := codec.DecodeFrame(data)
+	if err != nil || env.Hello == nil {
+		return nil, helloRequiredError()
+	}
+	return r.negotiate(env.Hello)
+}
+
+func helloRequiredError() error {
+	return &protocol.HandshakeError{Detail: protocol.ErrorDetail{
+		Code:    protocol.ErrorCodeHelloRequired,
+		Message: "first frame must be a hello",
+	}}
+}
+
+func handshakeErrorDetail(err error) protocol.ErrorDetail {
+	var hs *protocol.HandshakeError
+	if errors.As(err, &hs) {
+		return hs.Detail
+	}
+	return protocol.ErrorDetail{Code: protocol.ErrorCodeIncompatibleVersion, Message: err.Error()}
+}
+
+// rejectWS answers a failed handshake on a connection that was never
+// registered, then closes it.
+func rejectWS(conn *websocket.Conn, codec protocol.Codec, err error) {
+	detail := handshakeErrorDetail(err)
+	if data, encErr := codec.EncodeFrame(&protocol.Envelope{Error: &detail}); encErr == nil {
+		frameType := websocket.TextMessage
+		if codec.Binary() {
+			frameType = websocket.BinaryMessage
+		}
+		_ = conn.WriteMessage(frameType, data)
+	}
+	_ = conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, detail.Code), time.Now().Add(time.Second))
+	conn.Close()
+}
+
+// enable records the negotiated capabilities and sends the Welcome.
+func (c *Client) enable(w *protocol.Welcome) {
+	caps := make(map[string]bool, len(w.Enabled))
+	for _, capability := range w.Enabled {
+		caps[capability] = true
+	}
+	c.capsMu.Lock()
+	c.caps = caps
+	c.capsMu.Unlock()
+	c.sendFrame(&protocol.Envelope{Welcome: w})
+}
+
+// supports reports whether the connection may receive frames that rely on
+// capability. Clients that never sent a Hello get everything, as before.
+func (c *Client) supports(capability string) bool {
+	c.capsMu.RLock()
+	defer c.capsMu.RUnlock()
+	return c.caps == nil || c.caps[capability]
+}
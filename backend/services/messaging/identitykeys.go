@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"lan-chat/protocol"
+
+	"github.com/google/uuid"
+)
+
+// identityHistorySchema keeps every identity key a device has published, so
+// clients can tell a key they verified earlier from one that replaced it.
+const identityHistorySchema = `
+	CREATE TABLE IF NOT EXISTS identity_key_history (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		identity_key TEXT NOT NULL,
+		fingerprint TEXT NOT NULL,
+		event TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		seq BIGINT NOT NULL -- nanoseconds, orders events within the same second
+	);
+	CREATE INDEX IF NOT EXISTS idx_identity_key_history_user ON identity_key_history(user_id, seq);
+`
+
+// Identity key history events.
+const (
+	identityEventAdded   = "added"   // first key of a device
+	identityEventChanged = "changed" // device replaced its key
+	identityEventRemoved = "removed" // device deleted
+
+	// identitySenderID is the sender of identity change warnings in DMs.
+	identitySenderID = "system:identity"
+)
+
+// IdentityKeyEvent is one entry of a user's identity key history.
+type IdentityKeyEvent struct {
+	ID          string `json:"id"`
+	UserID      string `json:"user_id"`
+	DeviceID    string `json:"device_id"`
+	IdentityKey string `json:"identity_key"` // base64 protocol.IdentityKey.Bytes()
+	Fingerprint string `json:"fingerprint"`  // hex SHA-256 of the key
+	Event       string `json:"event"`
+	CreatedAt   int64  `json:"created_at"`
+}
+
+func (r *MessageRouter) recordIdentityEvent(tx *sql.Tx, userID, deviceID string, identity []byte, event string, at time.Time) error {
+	sum := sha256.Sum256(identity)
+	_, err := tx.Exec(r.bind(`
+		INSERT INTO identity_key_history (id, user_id, device_id, identity_key, fingerprint, event, created_at, seq)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		uuid.New().String(), userID, deviceID, base64.StdEncoding.EncodeToString(identity), hex.EncodeToString(sum[:]), event, at.Unix(), time.Now().UnixNano())
+	return err
+}
+
+// IdentityKeyHistoryHandler lists the identity key history of ?user_id=
+// (default the caller), optionally for one ?device_id=, oldest first.
+func (r *MessageRouter) IdentityKeyHistoryHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := r.authenticate(req)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	target := req.URL.Query().Get("user_id")
+	if target == "" {
+		target = userID
+	}
+	query := `
+		SELECT id, user_id, device_id, identity_key, fingerprint, event, created_at
+		FROM identity_key_history WHERE user_id = ?`
+	args := []interface{}{target}
+	if deviceID := req.URL.Query().Get("device_id"); deviceID != "" {
+		query += ` AND device_id = ?`
+		args = append(args, deviceID)
+	}
+	rows, err := r.db.Query(r.bind(query+` ORDER BY seq ASC`), args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	history := make([]IdentityKeyEvent, 0)
+	for rows.Next() {
+		var e IdentityKeyEvent
+		if err := rows.Scan(&e.ID, &e.UserID, &e.DeviceID, &e.IdentityKey, &e.Fingerprint, &e.Event, &e.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		history = append(history, e)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"user_id": target, "history": history})
+}
+
+// announceIdentityChange posts a system message into every DM of userID
+// when one of their devices replaced its identity key or a device was
+// added next to ones that already had keys: the safety number their
+// contacts verified no longer matches.
+func (r *MessageRouter) announceIdentityChange(userID, deviceID, event string) {
+	if event == identityEventAdded {
+		var others int
+		err := r.db.QueryRow(r.bind(`
+			SELECT COUNT(*) FROM device_identity_keys i
+			JOIN devices d ON d.id = i.device_id
+			WHERE d.user_id = ? AND d.id <> ?`), userID, deviceID).Scan(&others)
+		if err != nil || others == 0 {
+			return
+		}
+	}
+
+	var username, deviceName string
+	_ = r.db.QueryRow(r.bind(`SELECT username FROM users WHERE id = ?`), userID).Scan(&username)
+	if username == "" {
+		username = userID
+	}
+	_ = r.db.QueryRow(r.bind(`SELECT device_name FROM devices WHERE id = ?`), deviceID).Scan(&deviceName)
+	text := fmt.Sprintf("%s's identity key changed on device %q. Compare safety numbers again before trusting new messages.", username, deviceName)
+	if event == identityEventAdded {
+		text = fmt.Sprintf("%s added a new device %q. Compare safety numbers again to verify it.", username, deviceName)
+	}
+
+	rows, err := r.db.Query(r.bind(`
+		SELECT m.channel_id FROM channel_members m
+		JOIN channels c ON c.id = m.channel_id
+		WHERE m.user_id = ? AND c.type = 'dm'`), userID)
+	if err != nil {
+		log.Printf("failed to list DMs for identity change of %s: %v", userID, err)
+		return
+	}
+	var channels []string
+	for rows.Next() {
+		var channelID string
+		if err := rows.Scan(&channelID); err == nil {
+			channels = append(channels, channelID)
+		}
+	}
+	rows.Close()
+
+	for _, channelID := range channels {
+		msg, err := r.saveServerMessage(protocol.SendMessageRequest{
+			ChannelID: channelID,
+			Content:   []byte(text),
+			Type:      protocol.MessageTypeSystem,
+		}, identitySenderID, channelID)
+		if err != nil {
+			log.Printf("failed to post identity change to %s: %v", channelID, err)
+			continue
+		}
+		if err := r.Broadcast(msg); err != nil {
+			log.Printf("failed to broadcast identity change to %s: %v", channelID, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"lan-chat/protocol"
+)
+
+func identityHistory(t *testing.T, r *MessageRouter, token, query string) []IdentityKeyEvent {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/prekeys/history"+query, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	r.IdentityKeyHistoryHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("history: %d %s", rec.Code, rec.Body.String())
+	}
+	var out struct {
+		History []IdentityKeyEvent `json:"history"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	return out.History
+}
+
+func dmSystemMessages(t *testing.T, r *MessageRouter, channelID string) []string {
+	t.Helper()
+	msgs, err := r.store.ChannelHistory(channelID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, m := range msgs {
+		if m.Type == protocol.MessageTypeSystem && m.SenderID == identitySenderID {
+			out = append(out, string(m.Content))
+		}
+	}
+	return out
+}
+
+func TestIdentityKeyReplacementIsRecordedAndAnnounced(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	dm, err := r.store.FindOrCreateDMChannel("u-alice", "u-bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceConn := r.Register("u-alice", nil)
+	bobToken := tokenForTestUser(t, "bob")
+
+	bob := newTestPreKeyDevice(t, r, "bob", 3)
+	if rec := postPreKeys(t, r, bobToken, bob.upload()); rec.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", rec.Code, rec.Body.String())
+	}
+	if got := dmSystemMessages(t, r, dm); len(got) != 0 {
+		t.Fatalf("a user's first key needs no warning, got %q", got)
+	}
+
+	// Reinstalling: a new identity for the same device.
+	reinstalled := newTestPreKeyDevice(t, r, "bob", 2)
+	reinstalled.id = bob.id
+	replace := reinstalled.upload()
+	replace.ReplaceIdentity = true
+	noSPK := replace
+	noSPK.SignedPreKey = nil
+	if rec := postPreKeys(t, r, bobToken, noSPK); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected replacement without signed prekey to fail, got %d", rec.Code)
+	}
+	rec := postPreKeys(t, r, bobToken, replace)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("replace identity: %d %s", rec.Code, rec.Body.String())
+	}
+	// One-time prekeys of the old identity are gone; only the new ones remain.
+	var out struct {
+		Status PreKeyStatus `json:"status"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &out)
+	if out.Status.OneTimePreKeys != 2 {
+		t.Fatalf("expected only the new one-time prekeys, got %+v", out.Status)
+	}
+	bundle := fetchBundles(t, r, tokenForTestUser(t, "alice"), "u-bob")[0]
+	if ik, err := bundle.Verify(); err != nil || !ik.Equal(reinstalled.identity.Public()) {
+		t.Fatalf("expected bundle with the new identity: %v", err)
+	}
+
+	warnings := dmSystemMessages(t, r, dm)
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "bob's identity key changed") {
+		t.Fatalf("expected identity change warning in the DM, got %q", warnings)
+	}
+	select {
+	case data := <-aliceConn.Send:
+		var m protocol.Message
+		_ = json.Unmarshal(data, &m)
+		if m.ChannelID != dm || m.SenderID != identitySenderID {
+			t.Fatalf("unexpected frame %s", data)
+		}
+	default:
+		t.Fatalf("expected the warning to be delivered to the contact")
+	}
+
+	// A second device with its own key changes bob's safety number too.
+	laptop := newTestPreKeyDevice(t, r, "bob", 1)
+	if rec := postPreKeys(t, r, bobToken, laptop.upload()); rec.Code != http.StatusOK {
+		t.Fatalf("upload second device: %d %s", rec.Code, rec.Body.String())
+	}
+	if warnings := dmSystemMessages(t, r, dm); len(warnings) != 2 || !strings.Contains(warnings[1], "added a new device") {
+		t.Fatalf("expected new device warning, got %q", warnings)
+	}
+
+	del := httptest.NewRequest(http.MethodDelete, "/devices/keys?device_id="+laptop.id, nil)
+	del.Header.Set("Authorization", "Bearer "+bobToken)
+	r.DeviceKeysHandler(httptest.NewRecorder(), del)
+
+	history := identityHistory(t, r, tokenForTestUser(t, "alice"), "?user_id=u-bob")
+	var events []string
+	for _, e := range history {
+		events = append(events, e.Event)
+	}
+	if strings.Join(events, ",") != "added,changed,added,removed" {
+		t.Fatalf("unexpected history %v", events)
+	}
+	if history[0].IdentityKey == history[1].IdentityKey || history[0].Fingerprint == history[1].Fingerprint {
+		t.Fatalf("expected the replaced key to differ: %+v", history[:2])
+	}
+	if only := identityHistory(t, r, bobToken, "?device_id="+bob.id); len(only) != 2 {
+		t.Fatalf("expected device filter, got %+v", only)
+	}
+
+	// Safety numbers computed from the history change with the key.
+	alice, _ := protocol.GenerateIdentityKeyPair(rand.Reader)
+	before := protocol.SafetyNumber("u-alice", []protocol.IdentityKey{alice.Public()}, "u-bob", []protocol.IdentityKey{bob.identity.Public()})
+	after := protocol.SafetyNumber("u-alice", []protocol.IdentityKey{alice.Public()}, "u-bob", []protocol.IdentityKey{reinstalled.identity.Public()})
+	if before == after {
+		t.Fatalf("safety number did not change with the identity key")
+	}
+}
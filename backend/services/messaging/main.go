@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"database/sql"
 	"encoding/hex"
@@ -9,24 +10,29 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"lan-chat/jwks"
 	"lan-chat/protocol"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	CheckOrigin:  func(r *http.Request) bool { return true },
+	Subprotocols: protocol.Subprotocols,
 }
 
+const maxWSFrameBytes = 1 << 20 // 1 MiB
+
 const requestIDHeader = "X-Request-ID"
 
 type statusRecorder struct {
@@ -78,16 +84,47 @@ func withRequestTrace(name string, next http.HandlerFunc) http.HandlerFunc {
 
 // Client represents a connected user over WebSocket
 type Client struct {
-	UserID string
-	Conn   *websocket.Conn
-	Send   chan []byte
+	UserID    string
+	DeviceID  string // bound with /ws?device_id=; selects fan-out ciphertexts
+	SessionID string // auth session of the token that opened the connection
+	Conn      *websocket.Conn
+	Send      chan []byte    // frames already encoded with Codec
+	Codec     protocol.Codec // negotiated via the WebSocket subprotocol
+
+	capsMu sync.RWMutex
+	caps   map[string]bool // from Welcome; nil if the client sent no Hello
+}
+
+// sendFrame encodes env for this connection and queues it, dropping the
+// frame if the connection is not keeping up.
+func (c *Client) sendFrame(env *protocol.Envelope) {
+	data, err := c.Codec.EncodeFrame(env)
+	if err != nil {
+		return
+	}
+	select {
+	case c.Send <- data:
+	default:
+	}
 }
 
 // MessageRouter handles message routing, storage, and real-time delivery.
 type MessageRouter struct {
-	db      *sql.DB
-	clients map[string][]*Client // UserID -> Multiple connections
-	mu      sync.RWMutex
+	store      MessageStore
+	db         *sql.DB              // shared with store; used by webhook and bot tables
+	clients    map[string][]*Client // UserID -> Multiple connections
+	mu         sync.RWMutex
+	webhooks   *webhookDispatcher
+	commands   *commandRegistry
+	flood      *floodGuard
+	audit      *auditClient
+	files      *fileTransferClient
+	voice      VoiceLimits
+	signatures SignaturePolicy
+	handshake  HandshakeConfig
+	prekeys    PreKeyLimits
+	fanOut     FanOutLimits
+	sessions   SessionPolicy
 }
 
 var (
@@ -97,8 +134,9 @@ var (
 )
 
 type Claims struct {
-	Username string `json:"username"`
-	Role     string `json:"role"`
+	Username  string `json:"username"`
+	Role      string `json:"role"`
+	SessionID string `json:"sid,omitempty"` // auth_sessions row the token belongs to
 	jwt.RegisteredClaims
 }
 
@@ -118,19 +156,30 @@ type CreateDMRequest struct {
 	TargetUserID string `json:"target_user_id"`
 }
 
-func jwtSecret() []byte {
-	secret := os.Getenv("MESSAGING_JWT_SECRET")
-	if secret == "" {
-		secret = "my_secret_key"
+// tokenIssuer is the "iss" of access tokens minted by the auth service.
+const tokenIssuer = "lan-chat-auth"
+
+// tokenKeys verifies access tokens against the keys the auth service
+// publishes; messaging holds nothing that can sign a token.
+var tokenKeys = jwks.NewCache(
+	jwks.HTTPSource(envString("MESSAGING_JWKS_URL", "http://localhost:8086/.well-known/jwks.json"), nil),
+	envDuration("MESSAGING_JWKS_REFRESH", 5*time.Minute),
+	envDuration("MESSAGING_JWKS_GRACE", 24*time.Hour),
+)
+
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
 	}
-	return []byte(secret)
+	return def
 }
 
 func validateToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret(), nil
-	})
+		kid, _ := token.Header["kid"].(string)
+		return tokenKeys.Key(context.Background(), kid)
+	}, jwt.WithValidMethods([]string{jwks.Algorithm}), jwt.WithIssuer(tokenIssuer))
 	if err != nil {
 		return nil, err
 	}
@@ -152,58 +201,76 @@ func bearerToken(req *http.Request) string {
 }
 
 func NewMessageRouter(dbPath string) (*MessageRouter, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	store, err := NewSQLiteStore(dbPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
-	}
-
-	if err := initDB(db); err != nil {
-		return nil, fmt.Errorf("failed to initialize database: %w", err)
-	}
-
-	return &MessageRouter{
-		db:      db,
-		clients: make(map[string][]*Client),
-	}, nil
-}
-
-func initDB(db *sql.DB) error {
-	query := `
-	CREATE TABLE IF NOT EXISTS channels (
-		id TEXT PRIMARY KEY,
-		name TEXT,
-		type TEXT DEFAULT 'public'
-	);
-	CREATE TABLE IF NOT EXISTS channel_members (
-		channel_id TEXT,
-		user_id TEXT,
-		PRIMARY KEY (channel_id, user_id)
-	);
-	CREATE TABLE IF NOT EXISTS messages (
-		id TEXT PRIMARY KEY,
-		channel_id TEXT,
-		sender_id TEXT,
-		timestamp INTEGER,
-		type INTEGER,
-		content BLOB,
-		nonce BLOB,
-		signature BLOB
-	);
-	CREATE INDEX IF NOT EXISTS idx_channel_timestamp ON messages(channel_id, timestamp);
-	`
-	_, err := db.Exec(query)
-	return err
+		return nil, err
+	}
+	return NewMessageRouterWithStore(store)
+}
+
+// NewMessageRouterWithStore builds a router on top of any MessageStore.
+func NewMessageRouterWithStore(store MessageStore) (*MessageRouter, error) {
+	db := store.DB()
+	for _, schema := range []string{webhookSchema, botSchema, retentionSchema, attachmentSchema, signatureSchema, prekeySchema, identityHistorySchema, fanOutSchema, authSessionSchema, membershipSchema} {
+		if _, err := db.Exec(schema); err != nil {
+			return nil, fmt.Errorf("failed to initialize database: %w", err)
+		}
+	}
+
+	router := &MessageRouter{
+		store:      store,
+		db:         db,
+		clients:    make(map[string][]*Client),
+		webhooks:   newWebhookDispatcher(store),
+		commands:   newCommandRegistry(),
+		flood:      newFloodGuard(floodConfigFromEnv()),
+		audit:      auditClientFromEnv(),
+		files:      fileTransferClientFromEnv(),
+		voice:      voiceLimitsFromEnv(),
+		signatures: signaturePolicyFromEnv(),
+		handshake:  handshakeConfigFromEnv(),
+		prekeys:    preKeyLimitsFromEnv(),
+		fanOut:     fanOutLimitsFromEnv(),
+		sessions:   sessionPolicyFromEnv(),
+	}
+	router.registerBuiltinCommands()
+	router.startCommandWorkers()
+	return router, nil
+}
+
+// bind adapts a "?"-placeholder query to the store's SQL dialect.
+func (r *MessageRouter) bind(query string) string {
+	return r.store.Rebind(query)
 }
 
 // Register adds a new client connection
 func (r *MessageRouter) Register(userID string, conn *websocket.Conn) *Client {
+	return r.RegisterDevice(userID, "", conn)
+}
+
+// RegisterDevice adds a client connection bound to one of the user's
+// devices, which then receives its own copy of fan-out messages.
+func (r *MessageRouter) RegisterDevice(userID, deviceID string, conn *websocket.Conn) *Client {
+	return r.registerSession(userID, deviceID, "", conn)
+}
+
+// registerSession is RegisterDevice for a connection opened with a token
+// of sessionID, which is closed once the session is revoked.
+func (r *MessageRouter) registerSession(userID, deviceID, sessionID string, conn *websocket.Conn) *Client {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	subprotocol := ""
+	if conn != nil {
+		subprotocol = conn.Subprotocol()
+	}
 	client := &Client{
-		UserID: userID,
-		Conn:   conn,
-		Send:   make(chan []byte, 256),
+		UserID:    userID,
+		DeviceID:  deviceID,
+		SessionID: sessionID,
+		Conn:      conn,
+		Send:      make(chan []byte, 256),
+		Codec:     protocol.CodecFor(subprotocol),
 	}
 	r.clients[userID] = append(r.clients[userID], client)
 
@@ -243,59 +310,15 @@ func (r *MessageRouter) getChannelMembers(channelID string) ([]string, string, e
 		return nil, "public", nil
 	}
 
-	rows, err := r.db.Query("SELECT user_id FROM channel_members WHERE channel_id = ?", channelID)
+	members, err := r.store.ChannelMemberIDs(channelID)
 	if err != nil {
 		return nil, chType, err
 	}
-	defer rows.Close()
-
-	var members []string
-	for rows.Next() {
-		var uid string
-		if err := rows.Scan(&uid); err == nil {
-			members = append(members, uid)
-		}
-	}
 	return members, chType, nil
 }
 
 func (r *MessageRouter) getChannelType(channelID string) (string, error) {
-	var chType string
-	err := r.db.QueryRow("SELECT type FROM channels WHERE id = ?", channelID).Scan(&chType)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return "", errChannelMissing
-		}
-		return "", err
-	}
-	return chType, nil
-}
-
-func (r *MessageRouter) userExists(userID string) (bool, error) {
-	var exists bool
-	err := r.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", userID).Scan(&exists)
-	if err != nil {
-		return false, err
-	}
-	return exists, nil
-}
-
-func (r *MessageRouter) findUserIDByUsername(username string) (string, error) {
-	var userID string
-	err := r.db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
-	if err != nil {
-		return "", err
-	}
-	return userID, nil
-}
-
-func (r *MessageRouter) isChannelMember(channelID, userID string) (bool, error) {
-	var exists bool
-	err := r.db.QueryRow(
-		"SELECT EXISTS(SELECT 1 FROM channel_members WHERE channel_id = ? AND user_id = ?)",
-		channelID, userID,
-	).Scan(&exists)
-	return exists, err
+	return r.store.ChannelType(channelID)
 }
 
 func (r *MessageRouter) authorizeChannelAccess(userID, channelID string) error {
@@ -306,7 +329,7 @@ func (r *MessageRouter) authorizeChannelAccess(userID, channelID string) error {
 	if chType == "public" {
 		return nil
 	}
-	member, err := r.isChannelMember(channelID, userID)
+	member, err := r.store.IsChannelMember(channelID, userID)
 	if err != nil {
 		return err
 	}
@@ -316,50 +339,6 @@ func (r *MessageRouter) authorizeChannelAccess(userID, channelID string) error {
 	return nil
 }
 
-func (r *MessageRouter) listAccessibleChannels(userID string) ([]ChannelView, error) {
-	rows, err := r.db.Query(`
-		SELECT DISTINCT c.id, c.name, c.type
-		FROM channels c
-		LEFT JOIN channel_members m ON c.id = m.channel_id
-		WHERE c.type = 'public' OR m.user_id = ?
-		ORDER BY c.name ASC`, userID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	out := make([]ChannelView, 0)
-	for rows.Next() {
-		var ch ChannelView
-		if err := rows.Scan(&ch.ID, &ch.Name, &ch.Type); err == nil {
-			out = append(out, ch)
-		}
-	}
-	return out, nil
-}
-
-func (r *MessageRouter) listChannelMembers(channelID string) ([]ChannelMemberView, error) {
-	rows, err := r.db.Query(`
-		SELECT u.id, u.username, COALESCE(u.full_name, '')
-		FROM channel_members m
-		JOIN users u ON u.id = m.user_id
-		WHERE m.channel_id = ?
-		ORDER BY u.username ASC`, channelID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	out := make([]ChannelMemberView, 0)
-	for rows.Next() {
-		var m ChannelMemberView
-		if err := rows.Scan(&m.ID, &m.Username, &m.FullName); err == nil {
-			out = append(out, m)
-		}
-	}
-	return out, nil
-}
-
 func (r *MessageRouter) resolveRequestedChannel(senderID, requestedChannelID string) (string, error) {
 	if requestedChannelID == "" {
 		return "", errChannelMissing
@@ -371,7 +350,7 @@ func (r *MessageRouter) resolveRequestedChannel(senderID, requestedChannelID str
 		return "", err
 	}
 
-	exists, err := r.userExists(requestedChannelID)
+	exists, err := r.store.UserExists(requestedChannelID)
 	if err != nil {
 		return "", err
 	}
@@ -381,23 +360,34 @@ func (r *MessageRouter) resolveRequestedChannel(senderID, requestedChannelID str
 	if requestedChannelID == senderID {
 		return "", errForbidden
 	}
-	return r.findOrCreateDMChannel(senderID, requestedChannelID)
+	return r.store.FindOrCreateDMChannel(senderID, requestedChannelID)
 }
 
 func (r *MessageRouter) authenticate(req *http.Request) (string, error) {
+	userID, _, err := r.authenticateSession(req)
+	return userID, err
+}
+
+// authenticateSession is authenticate that also returns the auth session
+// the token belongs to; bot tokens and tokens without one return "".
+func (r *MessageRouter) authenticateSession(req *http.Request) (string, string, error) {
 	token := bearerToken(req)
 	if token == "" {
-		return "", errUnauthorized
+		return "", "", errUnauthorized
 	}
-	claims, err := validateToken(token)
+	if isBotToken(token) {
+		userID, err := r.authenticateBot(token)
+		return userID, "", err
+	}
+	claims, err := r.validateUserToken(token)
 	if err != nil {
-		return "", errUnauthorized
+		return "", "", errUnauthorized
 	}
-	userID, err := r.findUserIDByUsername(claims.Username)
+	userID, err := r.store.FindUserIDByUsername(claims.Username)
 	if err != nil {
-		return "", errUnauthorized
+		return "", "", errUnauthorized
 	}
-	return userID, nil
+	return userID, claims.SessionID, nil
 }
 
 // Broadcast sends a message to specific users (who should receive this message)
@@ -406,20 +396,48 @@ func (r *MessageRouter) Broadcast(msg *protocol.Message) error {
 	if err != nil {
 		return err
 	}
+	var payloads map[string][]byte
+	if msg.FanOut {
+		all, err := r.devicePayloads(msg.ChannelID, msg.Timestamp, msg.Timestamp)
+		if err != nil {
+			return err
+		}
+		payloads = all[msg.ID]
+	}
+	r.dispatchOutgoingWebhooks(msg)
 
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	data, _ := json.Marshal(msg)
+	// Encode once per negotiated codec rather than once per connection.
+	env := &protocol.Envelope{Message: msg}
+	encoded := make(map[string][]byte)
+	deliver := func(client *Client) {
+		if msg.FanOut {
+			// Each device gets only its own ciphertext.
+			client.sendFrame(&protocol.Envelope{Message: deviceCopy(msg, client.DeviceID, payloads)})
+			return
+		}
+		name := client.Codec.Subprotocol()
+		data, ok := encoded[name]
+		if !ok {
+			var err error
+			if data, err = client.Codec.EncodeFrame(env); err != nil {
+				return
+			}
+			encoded[name] = data
+		}
+		select {
+		case client.Send <- data:
+		default:
+		}
+	}
 
 	if chType == "public" {
 		// Broadcast to everyone online
 		for _, conns := range r.clients {
 			for _, client := range conns {
-				select {
-				case client.Send <- data:
-				default:
-				}
+				deliver(client)
 			}
 		}
 	} else {
@@ -427,10 +445,7 @@ func (r *MessageRouter) Broadcast(msg *protocol.Message) error {
 		for _, userID := range members {
 			if conns, ok := r.clients[userID]; ok {
 				for _, client := range conns {
-					select {
-					case client.Send <- data:
-					default:
-					}
+					deliver(client)
 				}
 			}
 		}
@@ -438,54 +453,18 @@ func (r *MessageRouter) Broadcast(msg *protocol.Message) error {
 	return nil
 }
 
-// findOrCreateDMChannel ensures a DM channel exists between two users.
-func (r *MessageRouter) findOrCreateDMChannel(u1, u2 string) (string, error) {
-	// Standardized name for DM: "dm:<uid1>:<uid2>" where uid1 < uid2
-	p1, p2 := u1, u2
-	if p1 > p2 {
-		p1, p2 = u2, u1
-	}
-	dmID := fmt.Sprintf("dm:%s:%s", p1, p2)
-
-	var exists bool
-	err := r.db.QueryRow("SELECT EXISTS(SELECT 1 FROM channels WHERE id = ?)", dmID).Scan(&exists)
-	if err != nil {
-		return "", err
-	}
-
-	if !exists {
-		tx, err := r.db.Begin()
-		if err != nil {
-			return "", err
-		}
-		defer tx.Rollback()
-
-		_, err = tx.Exec("INSERT INTO channels (id, name, type) VALUES (?, ?, ?)", dmID, "Direct Message", "dm")
-		if err != nil {
-			return "", err
-		}
-		_, err = tx.Exec("INSERT INTO channel_members (channel_id, user_id) VALUES (?, ?)", dmID, u1)
-		if err != nil {
-			return "", err
-		}
-		_, err = tx.Exec("INSERT INTO channel_members (channel_id, user_id) VALUES (?, ?)", dmID, u2)
-		if err != nil {
-			return "", err
-		}
-		if err := tx.Commit(); err != nil {
-			return "", err
-		}
-	}
-	return dmID, nil
-}
-
 // HandleWS handles WebSocket upgrade and loop
 func (r *MessageRouter) HandleWS(w http.ResponseWriter, req *http.Request) {
-	userID, err := r.authenticate(req)
+	userID, sessionID, err := r.authenticateSession(req)
 	if err != nil {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
+	deviceID := req.URL.Query().Get("device_id")
+	if !r.ownDevice(userID, deviceID) {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
 
 	conn, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
@@ -493,23 +472,62 @@ func (r *MessageRouter) HandleWS(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	client := r.Register(userID, conn)
+	conn.SetReadLimit(maxWSFrameBytes)
+
+	// When old clients are no longer accepted, nothing is delivered before
+	// the Hello has been negotiated.
+	var welcome *protocol.Welcome
+	if r.handshake.MinVersion > 0 {
+		codec := protocol.CodecFor(conn.Subprotocol())
+		if welcome, err = r.awaitHello(conn, codec); err != nil {
+			rejectWS(conn, codec, err)
+			return
+		}
+	}
+	client := r.registerSession(userID, deviceID, sessionID, conn)
+	if welcome != nil {
+		client.enable(welcome)
+	}
 
 	// Read loop (client sending messages via WS)
 	go func() {
-		defer func() {
-			r.Unregister(client)
-			conn.Close()
-		}()
+		// Unregistering closes Send; the write loop drains it and closes conn.
+		defer r.Unregister(client)
 
+		greeted := welcome != nil
 		for {
 			_, message, err := conn.ReadMessage()
 			if err != nil {
 				break
 			}
 
-			var sendReq protocol.SendMessageRequest
-			if err := json.Unmarshal(message, &sendReq); err == nil {
+			env, err := client.Codec.DecodeFrame(message)
+			if err != nil {
+				continue
+			}
+			if env.Hello != nil {
+				if greeted {
+					client.sendErrorFrame(protocol.ErrorDetail{Code: "unexpected_hello", Message: "hello must be the first frame"})
+					continue
+				}
+				greeted = true
+				w, err := r.negotiate(env.Hello)
+				if err != nil {
+					client.sendErrorFrame(handshakeErrorDetail(err))
+					return
+				}
+				client.enable(w)
+				continue
+			}
+			// A first frame that is not a Hello comes from a pre-handshake client.
+			greeted = true
+
+			if env.Send != nil {
+				sendReq := *env.Send
+				if retry, err := r.flood.CheckUser(userID); err != nil {
+					client.sendErrorFrame(floodErrorDetail(err, sendReq.ChannelID, retry))
+					continue
+				}
 				finalChannelID, err := r.resolveRequestedChannel(userID, sendReq.ChannelID)
 				if err != nil {
 					continue
@@ -517,8 +535,28 @@ func (r *MessageRouter) HandleWS(w http.ResponseWriter, req *http.Request) {
 				if err := r.authorizeChannelAccess(userID, finalChannelID); err != nil {
 					continue
 				}
+				if retry, err := r.flood.CheckChannel(userID, finalChannelID); err != nil {
+					client.sendErrorFrame(floodErrorDetail(err, finalChannelID, retry))
+					continue
+				}
+				if name, args, ok := parseSlashCommand(sendReq); ok && r.hasCommand(name) {
+					r.enqueueCommand(CommandInvocation{Name: name, Args: args, ChannelID: finalChannelID, UserID: userID})
+					continue
+				}
+				if err := r.resolveAttachment(&sendReq, userID); err != nil {
+					client.sendErrorFrame(attachmentErrorDetail(err, finalChannelID))
+					continue
+				}
 
 				msg, err := r.SaveMessage(sendReq, userID, finalChannelID)
+				if isSignatureError(err) {
+					client.sendErrorFrame(signatureErrorDetail(err, finalChannelID))
+					continue
+				}
+				if isRecipientsError(err) {
+					client.sendErrorFrame(recipientsErrorDetail(err, finalChannelID))
+					continue
+				}
 				if err == nil {
 					_ = r.Broadcast(msg)
 				}
@@ -527,38 +565,212 @@ func (r *MessageRouter) HandleWS(w http.ResponseWriter, req *http.Request) {
 	}()
 
 	// Write loop (sending messages to client)
+	frameType := websocket.TextMessage
+	if client.Codec.Binary() {
+		frameType = websocket.BinaryMessage
+	}
 	for data := range client.Send {
-		err := conn.WriteMessage(websocket.TextMessage, data)
+		err := conn.WriteMessage(frameType, data)
 		if err != nil {
 			break
 		}
 	}
+	_ = conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	conn.Close()
 }
 
+// SaveMessage persists a user-sent message after applying the signature
+// policy. Signed messages keep the client's timestamp and device ID so
+// recipients can verify them against the sender's device key. Fan-out
+// messages keep the sending device so recipients can pick the session.
 func (r *MessageRouter) SaveMessage(req protocol.SendMessageRequest, senderID string, channelID string) (*protocol.Message, error) {
-	msg := &protocol.Message{
-		ID:        uuid.New().String(),
-		ChannelID: channelID,
-		SenderID:  senderID,
-		Timestamp: time.Now().UnixMilli(),
-		Type:      req.Type,
-		Content:   req.Content,
-		Nonce:     req.Nonce,
-		Signature: req.Signature,
-	}
-
-	_, err := r.db.Exec(`
-		INSERT INTO messages (id, channel_id, sender_id, timestamp, type, content, nonce, signature)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		msg.ID, msg.ChannelID, msg.SenderID, msg.Timestamp, msg.Type, msg.Content, msg.Nonce, msg.Signature,
-	)
+	now := time.Now()
+	timestamp, deviceID, err := r.verifySignature(req, senderID, channelID, now)
 	if err != nil {
-		return nil, fmt.Errorf("failed to persist message: %w", err)
+		return nil, err
+	}
+	if err := r.resolveRecipients(&req, senderID, channelID); err != nil {
+		return nil, err
+	}
+	if deviceID == "" {
+		req.Signature = nil
+	}
+	msg := r.newMessage(req, senderID, channelID, timestamp)
+	msg.DeviceID = deviceID
+	if len(req.Recipients) > 0 {
+		msg.DeviceID = req.DeviceID
+		msg.FanOut = true
+	}
+	if err := r.persistMessage(msg); err != nil {
+		return nil, err
+	}
+	if msg.FanOut {
+		if err := r.saveDevicePayloads(msg, req.Recipients); err != nil {
+			return nil, fmt.Errorf("failed to persist device payloads: %w", err)
+		}
+		deviceID = req.DeviceID
 	}
+	r.touchDevice(deviceID, now)
+	return msg, nil
+}
 
+// saveServerMessage persists a message produced by the server itself (bot
+// replies, incoming webhooks), which is never signed.
+func (r *MessageRouter) saveServerMessage(req protocol.SendMessageRequest, senderID string, channelID string) (*protocol.Message, error) {
+	req.Signature = nil
+	msg := r.newMessage(req, senderID, channelID, time.Now().UnixMilli())
+	if err := r.persistMessage(msg); err != nil {
+		return nil, err
+	}
 	return msg, nil
 }
 
+func (r *MessageRouter) newMessage(req protocol.SendMessageRequest, senderID, channelID string, timestamp int64) *protocol.Message {
+	return &protocol.Message{
+		ID:         uuid.New().String(),
+		ChannelID:  channelID,
+		SenderID:   senderID,
+		Timestamp:  timestamp,
+		Type:       req.Type,
+		Content:    req.Content,
+		Nonce:      req.Nonce,
+		Signature:  req.Signature,
+		Attachment: req.Attachment,
+	}
+}
+
+func (r *MessageRouter) persistMessage(msg *protocol.Message) error {
+	if err := r.store.SaveMessage(msg); err != nil {
+		return fmt.Errorf("failed to persist message: %w", err)
+	}
+	if err := r.recordAttachment(msg); err != nil {
+		return fmt.Errorf("failed to record attachment: %w", err)
+	}
+	return nil
+}
+
+// SendHandler posts a message over HTTP. Slash commands answer in the
+// response: a public reply's ID, or the text of an ephemeral one.
+func (r *MessageRouter) SendHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var msgReq protocol.SendMessageRequest
+	if err := json.NewDecoder(req.Body).Decode(&msgReq); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	senderID := req.Header.Get("X-User-ID")
+	authUserID, err := r.authenticate(req)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	senderID = authUserID
+
+	if retry, err := r.flood.CheckUser(senderID); err != nil {
+		writeFloodError(w, err, msgReq.ChannelID, retry)
+		return
+	}
+	channelID, err := r.resolveRequestedChannel(senderID, msgReq.ChannelID)
+	if err != nil {
+		http.Error(w, "channel not found", http.StatusNotFound)
+		return
+	}
+	if err := r.authorizeChannelAccess(senderID, channelID); err != nil {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if retry, err := r.flood.CheckChannel(senderID, channelID); err != nil {
+		writeFloodError(w, err, channelID, retry)
+		return
+	}
+	if name, args, ok := parseSlashCommand(msgReq); ok && r.hasCommand(name) {
+		inv := CommandInvocation{Name: name, Args: args, ChannelID: channelID, UserID: senderID}
+		reply, ephemeral, err := r.runCommand(req.Context(), inv)
+		logCommandError(inv, err)
+		resp := protocol.SendMessageResponse{Success: err == nil, Ephemeral: ephemeral}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		if reply != nil {
+			resp.MessageID = reply.ID
+		}
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	if err := r.resolveAttachment(&msgReq, senderID); err != nil {
+		status := http.StatusBadGateway
+		switch {
+		case errors.Is(err, errAttachmentDenied):
+			status = http.StatusForbidden
+		case errors.Is(err, errVoiceTooLarge):
+			status = http.StatusRequestEntityTooLarge
+		case errors.Is(err, errAttachmentRequired), errors.Is(err, errAttachmentUnknown),
+			errors.Is(err, errAttachmentMismatch), errors.Is(err, errVoiceInvalid), errors.Is(err, errVoiceTooLong):
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	msg, err := r.SaveMessage(msgReq, senderID, channelID)
+	if isSignatureError(err) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if isRecipientsError(err) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := r.Broadcast(msg); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(protocol.SendMessageResponse{MessageID: msg.ID, Success: true})
+}
+
+// historyPageSize is the default and largest number of messages /history
+// returns at once.
+const historyPageSize = 100
+
+// historyParams reads the /history cursor: since (Unix ms) returns messages
+// at or after that time, and after_id additionally skips messages at since
+// up to and including that ID, so the last message of a page continues the
+// walk without repeats. Without either, history starts at the oldest
+// message.
+func historyParams(q url.Values) (HistoryCursor, int, error) {
+	var cursor HistoryCursor
+	if v := q.Get("since"); v != "" {
+		ts, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return cursor, 0, errors.New("invalid since")
+		}
+		cursor.Timestamp = ts
+	}
+	cursor.ID = q.Get("after_id")
+	limit := historyPageSize
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return cursor, 0, errors.New("invalid limit")
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+	return cursor, limit, nil
+}
+
+// HistoryHandler returns up to historyPageSize messages of a channel, oldest
+// first, starting at the cursor described by historyParams.
 func (r *MessageRouter) HistoryHandler(w http.ResponseWriter, req *http.Request) {
 	userID, err := r.authenticate(req)
 	if err != nil {
@@ -582,22 +794,29 @@ func (r *MessageRouter) HistoryHandler(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	rows, err := r.db.Query(`
-		SELECT id, channel_id, sender_id, timestamp, type, content, nonce, signature 
-		FROM messages WHERE channel_id = ? ORDER BY timestamp ASC LIMIT 100`, channelID)
+	deviceID := req.URL.Query().Get("device_id")
+	if !r.ownDevice(userID, deviceID) {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+
+	cursor, limit, err := historyParams(req.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := r.store.HistoryPage(channelID, cursor, limit)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	var history []protocol.Message
-	for rows.Next() {
-		var m protocol.Message
-		err := rows.Scan(&m.ID, &m.ChannelID, &m.SenderID, &m.Timestamp, &m.Type, &m.Content, &m.Nonce, &m.Signature)
-		if err == nil {
-			history = append(history, m)
-		}
+	history := make([]protocol.Message, 0, len(page))
+	for _, rec := range page {
+		history = append(history, rec.Message)
+	}
+	if err := r.applyDevicePayloads(channelID, history, deviceID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -615,7 +834,7 @@ func (r *MessageRouter) ChannelsHandler(w http.ResponseWriter, req *http.Request
 		return
 	}
 
-	channels, err := r.listAccessibleChannels(userID)
+	channels, err := r.store.ListAccessibleChannels(userID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -644,7 +863,7 @@ func (r *MessageRouter) ChannelMembersHandler(w http.ResponseWriter, req *http.R
 		return
 	}
 
-	members, err := r.listChannelMembers(channelID)
+	members, err := r.store.ListChannelMembers(channelID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -676,7 +895,7 @@ func (r *MessageRouter) CreateDMHandler(w http.ResponseWriter, req *http.Request
 		http.Error(w, "invalid target", http.StatusBadRequest)
 		return
 	}
-	exists, err := r.userExists(body.TargetUserID)
+	exists, err := r.store.UserExists(body.TargetUserID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -686,7 +905,7 @@ func (r *MessageRouter) CreateDMHandler(w http.ResponseWriter, req *http.Request
 		return
 	}
 
-	channelID, err := r.findOrCreateDMChannel(userID, body.TargetUserID)
+	channelID, err := r.store.FindOrCreateDMChannel(userID, body.TargetUserID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -696,69 +915,66 @@ func (r *MessageRouter) CreateDMHandler(w http.ResponseWriter, req *http.Request
 }
 
 func main() {
-	dbPath := os.Getenv("MESSAGING_DB_PATH")
-	if dbPath == "" {
-		dbPath = "data/chat.db"
+	var store MessageStore
+	var err error
+	if os.Getenv("MESSAGING_DB_DRIVER") == "postgres" {
+		store, err = NewPostgresStore(os.Getenv("MESSAGING_DB_DSN"))
+	} else {
+		dbPath := os.Getenv("MESSAGING_DB_PATH")
+		if dbPath == "" {
+			dbPath = "data/chat.db"
+		}
+		if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+			log.Fatalf("Failed to create data directory: %v", err)
+		}
+		store, err = NewSQLiteStore(dbPath)
 	}
-
-	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
-		log.Fatalf("Failed to create data directory: %v", err)
+	if err != nil {
+		log.Fatalf("Failed to open message store: %v", err)
 	}
 
-	router, err := NewMessageRouter(dbPath)
+	router, err := NewMessageRouterWithStore(store)
 	if err != nil {
 		log.Fatalf("Failed to initialize router: %v", err)
 	}
+	if router.files.token == "" {
+		log.Println("WARNING: MESSAGING_FILETRANSFER_TOKEN is empty; filetransfer will refuse file lookups and attachments will be rejected")
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ws", withRequestTrace("ws", router.HandleWS))
 	mux.HandleFunc("/history", withRequestTrace("history", router.HistoryHandler))
+	mux.HandleFunc("/export", withRequestTrace("export", router.ExportHandler))
+	mux.HandleFunc("/devices/keys", withRequestTrace("devices-keys", router.DeviceKeysHandler))
+	mux.HandleFunc("/devices/transfers", withRequestTrace("devices-transfers", router.DeviceTransfersHandler))
+	mux.HandleFunc("/prekeys", withRequestTrace("prekeys", router.PreKeysHandler))
+	mux.HandleFunc("/prekeys/bundle", withRequestTrace("prekeys-bundle", router.PreKeyBundleHandler))
+	mux.HandleFunc("/prekeys/status", withRequestTrace("prekeys-status", router.PreKeyStatusHandler))
+	mux.HandleFunc("/prekeys/history", withRequestTrace("prekeys-history", router.IdentityKeyHistoryHandler))
+	mux.HandleFunc("/attachments/authorize", withRequestTrace("attachments-authorize", router.AttachmentAuthorizeHandler))
 	mux.HandleFunc("/channels", withRequestTrace("channels", router.ChannelsHandler))
 	mux.HandleFunc("/channel-members", withRequestTrace("channel-members", router.ChannelMembersHandler))
+	mux.HandleFunc("/channel-members/changes", withRequestTrace("channel-member-changes", router.MembershipChangesHandler))
 	mux.HandleFunc("/dm", withRequestTrace("dm", router.CreateDMHandler))
+	mux.HandleFunc("/webhooks/incoming", withRequestTrace("webhooks-incoming", router.IncomingWebhooksHandler))
+	mux.HandleFunc("/webhooks/outgoing", withRequestTrace("webhooks-outgoing", router.OutgoingWebhooksHandler))
+	mux.HandleFunc("/webhooks/deliveries", withRequestTrace("webhooks-deliveries", router.WebhookDeliveriesHandler))
+	mux.HandleFunc("/bots", withRequestTrace("bots", router.BotsHandler))
+	mux.HandleFunc("/bots/commands", withRequestTrace("bots-commands", router.BotCommandsHandler))
+	mux.HandleFunc("/moderation/mutes", withRequestTrace("moderation-mutes", router.MutesHandler))
+	mux.HandleFunc("/retention/policies", withRequestTrace("retention-policies", router.RetentionPoliciesHandler))
+	mux.HandleFunc("/retention/holds", withRequestTrace("retention-holds", router.LegalHoldsHandler))
+	mux.HandleFunc("/retention/purge", withRequestTrace("retention-purge", router.RetentionPurgeHandler))
+	mux.HandleFunc("/hooks/incoming", withRequestTrace("hooks-incoming", router.IncomingWebhookHandler))
 	mux.HandleFunc("/health", withRequestTrace("health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintln(w, "Messaging Service is running")
 	}))
-	mux.HandleFunc("/send", withRequestTrace("send", func(w http.ResponseWriter, req *http.Request) {
-		if req.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		var msgReq protocol.SendMessageRequest
-		if err := json.NewDecoder(req.Body).Decode(&msgReq); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		senderID := req.Header.Get("X-User-ID")
-		authUserID, err := router.authenticate(req)
-		if err != nil {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
-			return
-		}
-		senderID = authUserID
-
-		channelID, err := router.resolveRequestedChannel(senderID, msgReq.ChannelID)
-		if err != nil {
-			http.Error(w, "channel not found", http.StatusNotFound)
-			return
-		}
-		if err := router.authorizeChannelAccess(senderID, channelID); err != nil {
-			http.Error(w, "forbidden", http.StatusForbidden)
-			return
-		}
+	mux.HandleFunc("/send", withRequestTrace("send", router.SendHandler))
 
-		msg, err := router.SaveMessage(msgReq, senderID, channelID)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if err := router.Broadcast(msg); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		json.NewEncoder(w).Encode(protocol.SendMessageResponse{MessageID: msg.ID, Success: true})
-	}))
+	go router.runRetentionPurger(envDuration("MESSAGING_RETENTION_INTERVAL", time.Hour))
+	go router.runMembershipWatcher(envDuration("MESSAGING_MEMBERSHIP_INTERVAL", 2*time.Second))
+	go router.runSessionWatcher(router.sessions.Recheck)
 
 	port := os.Getenv("PORT")
 	if port == "" {
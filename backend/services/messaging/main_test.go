@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
@@ -10,6 +12,9 @@ import (
 	"testing"
 	"time"
 
+	"lan-chat/jwks"
+	"lan-chat/protocol"
+
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -19,7 +24,11 @@ func seedMessagingTestData(t *testing.T, r *MessageRouter) {
 	_, err := r.db.Exec(`
 		CREATE TABLE IF NOT EXISTS users (
 			id TEXT PRIMARY KEY,
-			username TEXT UNIQUE NOT NULL
+			username TEXT UNIQUE NOT NULL,
+			full_name TEXT,
+			password_hash TEXT,
+			created_at INTEGER,
+			updated_at INTEGER
 		);`)
 	if err != nil {
 		t.Fatalf("create users table: %v", err)
@@ -79,8 +88,28 @@ func tokenForTestUser(t *testing.T, username string) string {
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(1 * time.Hour)),
 		},
 	}
-	tok := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	out, err := tok.SignedString(jwtSecret())
+	return signTestToken(t, claims)
+}
+
+// testSigningKey stands in for the auth service's signing key; tokenKeys
+// is pointed at its public half for the whole test binary.
+var testSigningKey = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{0x42}, ed25519.SeedSize))
+
+const testSigningKeyID = "test-key"
+
+func init() {
+	pub := testSigningKey.Public().(ed25519.PublicKey)
+	tokenKeys = jwks.NewCache(jwks.StaticSource(jwks.Set{Keys: []jwks.JWK{jwks.PublicJWK(testSigningKeyID, pub)}}), time.Hour, time.Hour)
+}
+
+func signTestToken(t *testing.T, claims *Claims) string {
+	t.Helper()
+	if claims.Issuer == "" {
+		claims.Issuer = tokenIssuer
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	tok.Header["kid"] = testSigningKeyID
+	out, err := tok.SignedString(testSigningKey)
 	if err != nil {
 		t.Fatalf("sign token: %v", err)
 	}
@@ -166,7 +195,7 @@ func TestChannelsAndDMFlow(t *testing.T) {
 		t.Fatalf("expected dm channel id, got %q", dmID)
 	}
 
-	member, err := r.isChannelMember(dmID, "u-bob")
+	member, err := r.store.IsChannelMember(dmID, "u-bob")
 	if err != nil || !member {
 		t.Fatalf("expected bob as member in dm channel, err=%v member=%v", err, member)
 	}
@@ -200,3 +229,119 @@ func TestWithRequestTracePropagatesIncomingRequestID(t *testing.T) {
 		t.Fatalf("expected propagated request id rid-123, got %q", got)
 	}
 }
+
+func TestValidateTokenRequiresPublishedKey(t *testing.T) {
+	if _, err := validateToken(tokenForTestUser(t, "alice")); err != nil {
+		t.Fatalf("expected token from the published key to verify: %v", err)
+	}
+
+	claims := func() *Claims {
+		return &Claims{
+			Username: "alice",
+			Role:     "admin",
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    tokenIssuer,
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			},
+		}
+	}
+	// The old shared secret no longer mints anything.
+	hs, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims()).SignedString([]byte("my_secret_key"))
+	// Nor does a key the auth service never published.
+	_, rogue, _ := ed25519.GenerateKey(nil)
+	unpublished := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims())
+	unpublished.Header["kid"] = "rogue"
+	rogueToken, _ := unpublished.SignedString(rogue)
+	wrongKey := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims())
+	wrongKey.Header["kid"] = testSigningKeyID
+	wrongKeyToken, _ := wrongKey.SignedString(rogue)
+	foreign := claims()
+	foreign.Issuer = "someone-else"
+
+	for name, token := range map[string]string{
+		"hs256":          hs,
+		"unknown kid":    rogueToken,
+		"wrong key":      wrongKeyToken,
+		"foreign issuer": signTestToken(t, foreign),
+	} {
+		if _, err := validateToken(token); err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+}
+
+func TestHistoryCursorWalksWholeChannel(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	if _, err := r.db.Exec(`DELETE FROM messages`); err != nil {
+		t.Fatalf("clear messages: %v", err)
+	}
+	// 250 messages, five per millisecond, so pages end mid-timestamp.
+	base := time.Now().Add(-time.Hour).UnixMilli()
+	for i := 0; i < 250; i++ {
+		msg := &protocol.Message{
+			ID:        fmt.Sprintf("h-%03d", i),
+			ChannelID: "priv-1",
+			SenderID:  "u-alice",
+			Timestamp: base + int64(i/5),
+			Type:      protocol.MessageTypeText,
+			Content:   []byte("x"),
+		}
+		if err := r.store.SaveMessage(msg); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+	token := tokenForTestUser(t, "bob")
+	get := func(query string) (int, []protocol.Message) {
+		req := httptest.NewRequest(http.MethodGet, "/history?channel_id=priv-1"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		r.HistoryHandler(rec, req)
+		var msgs []protocol.Message
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &msgs); err != nil {
+				t.Fatalf("decode history: %v", err)
+			}
+		}
+		return rec.Code, msgs
+	}
+
+	code, first := get("")
+	if code != http.StatusOK || len(first) != historyPageSize || first[0].ID != "h-000" {
+		t.Fatalf("expected the oldest %d messages, got %d (%d)", historyPageSize, len(first), code)
+	}
+
+	var seen []string
+	query := ""
+	for {
+		_, page := get(query + "&limit=40")
+		for _, m := range page {
+			seen = append(seen, m.ID)
+		}
+		if len(page) < 40 {
+			break
+		}
+		last := page[len(page)-1]
+		query = fmt.Sprintf("&since=%d&after_id=%s", last.Timestamp, last.ID)
+	}
+	if len(seen) != 250 {
+		t.Fatalf("cursor walk returned %d messages, want 250", len(seen))
+	}
+	for i, id := range seen {
+		if id != fmt.Sprintf("h-%03d", i) {
+			t.Fatalf("message %d is %s, out of order or repeated", i, id)
+		}
+	}
+
+	// since alone is inclusive, so a client resuming from the newest
+	// timestamp it saw also gets messages that shared that millisecond.
+	_, tail := get(fmt.Sprintf("&since=%d", base+49))
+	if len(tail) != 5 || tail[0].ID != "h-245" {
+		t.Fatalf("expected the last millisecond's 5 messages, got %d", len(tail))
+	}
+
+	for _, bad := range []string{"&since=yesterday", "&limit=0", "&limit=x"} {
+		if code, _ := get(bad); code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", bad, code)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"lan-chat/protocol"
+)
+
+// membershipSchema keeps the members of private channels as of the last
+// scan and a numbered log of what each scan changed. Members are added and
+// removed by admin-api as well as by this service, so changes are found by
+// comparing channel_members with the stored snapshot rather than at the
+// call sites; because the snapshot is stored, changes made while messaging
+// was down are found on the next start.
+const membershipSchema = `
+	CREATE TABLE IF NOT EXISTS channel_member_snapshot (
+		channel_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		PRIMARY KEY (channel_id, user_id)
+	);
+	CREATE TABLE IF NOT EXISTS channel_member_changes (
+		channel_id TEXT NOT NULL,
+		version BIGINT NOT NULL,
+		added TEXT NOT NULL,
+		removed TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		PRIMARY KEY (channel_id, version)
+	);
+`
+
+// membershipChangesPageSize bounds the changes returned per request.
+const membershipChangesPageSize = 500
+
+// MembershipChange is one recorded change to a private channel's members.
+// Versions count each channel's changes from 1.
+type MembershipChange struct {
+	ChannelID string   `json:"channel_id"`
+	Version   int64    `json:"version"`
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	Timestamp int64    `json:"timestamp"`
+}
+
+// scanMembership compares the members of private channels with the stored
+// snapshot, records each changed channel's difference under its next version
+// and moves the snapshot forward, all in one transaction.
+func (r *MessageRouter) scanMembership() ([]MembershipChange, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	byChannel := make(map[string]*MembershipChange)
+	collect := func(query string, added bool) error {
+		rows, err := tx.Query(query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var channelID, userID string
+			if err := rows.Scan(&channelID, &userID); err != nil {
+				return err
+			}
+			c := byChannel[channelID]
+			if c == nil {
+				c = &MembershipChange{ChannelID: channelID, Added: []string{}, Removed: []string{}}
+				byChannel[channelID] = c
+			}
+			if added {
+				c.Added = append(c.Added, userID)
+			} else {
+				c.Removed = append(c.Removed, userID)
+			}
+		}
+		return rows.Err()
+	}
+	if err := collect(`
+		SELECT cm.channel_id, cm.user_id
+		FROM channel_members cm
+		JOIN channels c ON c.id = cm.channel_id AND c.type = 'private'
+		WHERE NOT EXISTS (
+			SELECT 1 FROM channel_member_snapshot s
+			WHERE s.channel_id = cm.channel_id AND s.user_id = cm.user_id)`, true); err != nil {
+		return nil, err
+	}
+	if err := collect(`
+		SELECT s.channel_id, s.user_id
+		FROM channel_member_snapshot s
+		WHERE NOT EXISTS (
+			SELECT 1 FROM channel_members cm
+			JOIN channels c ON c.id = cm.channel_id AND c.type = 'private'
+			WHERE cm.channel_id = s.channel_id AND cm.user_id = s.user_id)`, false); err != nil {
+		return nil, err
+	}
+	if len(byChannel) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now().UnixMilli()
+	changes := make([]MembershipChange, 0, len(byChannel))
+	for _, c := range byChannel {
+		sort.Strings(c.Added)
+		sort.Strings(c.Removed)
+		var last int64
+		if err := tx.QueryRow(r.bind(`SELECT COALESCE(MAX(version), 0) FROM channel_member_changes WHERE channel_id = ?`), c.ChannelID).Scan(&last); err != nil {
+			return nil, err
+		}
+		c.Version, c.Timestamp = last+1, now
+		if _, err := tx.Exec(r.bind(`
+			INSERT INTO channel_member_changes (channel_id, version, added, removed, created_at)
+			VALUES (?, ?, ?, ?, ?)`),
+			c.ChannelID, c.Version, strings.Join(c.Added, ","), strings.Join(c.Removed, ","), now); err != nil {
+			return nil, err
+		}
+		for _, userID := range c.Added {
+			if _, err := tx.Exec(r.bind(`INSERT INTO channel_member_snapshot (channel_id, user_id) VALUES (?, ?)`), c.ChannelID, userID); err != nil {
+				return nil, err
+			}
+		}
+		for _, userID := range c.Removed {
+			if _, err := tx.Exec(r.bind(`DELETE FROM channel_member_snapshot WHERE channel_id = ? AND user_id = ?`), c.ChannelID, userID); err != nil {
+				return nil, err
+			}
+		}
+		changes = append(changes, *c)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].ChannelID < changes[j].ChannelID })
+	return changes, nil
+}
+
+// checkMembership scans for membership changes and notifies everyone
+// affected: current members must replace their sender keys, and removed
+// members learn they should drop the channel's keys. Clients that were
+// offline catch up through MembershipChangesHandler.
+func (r *MessageRouter) checkMembership() error {
+	changes, err := r.scanMembership()
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		notice := &protocol.Notice{
+			Kind:      protocol.NoticeChannelMembersChanged,
+			ChannelID: c.ChannelID,
+			Data: map[string]string{
+				"version": strconv.FormatInt(c.Version, 10),
+				"added":   strings.Join(c.Added, ","),
+				"removed": strings.Join(c.Removed, ","),
+			},
+			Timestamp: c.Timestamp,
+		}
+		members, err := r.store.ChannelMemberIDs(c.ChannelID)
+		if err != nil {
+			log.Printf("membership notice for %s: %v", c.ChannelID, err)
+		}
+		for _, userID := range append(members, c.Removed...) {
+			r.sendNotice(userID, notice)
+		}
+	}
+	return nil
+}
+
+// runMembershipWatcher checks for membership changes every interval.
+func (r *MessageRouter) runMembershipWatcher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := r.checkMembership(); err != nil {
+			log.Printf("membership scan failed: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// MembershipChangesHandler lets members of a private channel catch up on
+// membership changes after ?since=<version>, oldest first. Version is the
+// channel's latest; a page shorter than the whole gap continues from the
+// last returned change. Users who are no longer members get 403 and should
+// drop the channel's keys.
+func (r *MessageRouter) MembershipChangesHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, err := r.authenticate(req)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	channelID := req.URL.Query().Get("channel_id")
+	if channelID == "" {
+		http.Error(w, "missing channel_id", http.StatusBadRequest)
+		return
+	}
+	var since int64
+	if v := req.URL.Query().Get("since"); v != "" {
+		if since, err = strconv.ParseInt(v, 10, 64); err != nil || since < 0 {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := r.authorizeChannelAccess(userID, channelID); err != nil {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	changes, version, err := r.membershipChanges(channelID, since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"channel_id": channelID,
+		"version":    version,
+		"changes":    changes,
+	})
+}
+
+// membershipChanges returns up to membershipChangesPageSize changes of a
+// channel after since, and the channel's latest version.
+func (r *MessageRouter) membershipChanges(channelID string, since int64) ([]MembershipChange, int64, error) {
+	var version int64
+	if err := r.db.QueryRow(r.bind(`SELECT COALESCE(MAX(version), 0) FROM channel_member_changes WHERE channel_id = ?`), channelID).Scan(&version); err != nil {
+		return nil, 0, err
+	}
+	rows, err := r.db.Query(r.bind(`
+		SELECT version, added, removed, created_at
+		FROM channel_member_changes
+		WHERE channel_id = ? AND version > ?
+		ORDER BY version ASC
+		LIMIT ?`), channelID, since, membershipChangesPageSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	changes := []MembershipChange{}
+	for rows.Next() {
+		c := MembershipChange{ChannelID: channelID}
+		var added, removed string
+		if err := rows.Scan(&c.Version, &added, &removed, &c.Timestamp); err != nil {
+			return nil, 0, err
+		}
+		c.Added, c.Removed = splitIDs(added), splitIDs(removed)
+		changes = append(changes, c)
+	}
+	return changes, version, rows.Err()
+}
+
+func splitIDs(joined string) []string {
+	if joined == "" {
+		return []string{}
+	}
+	return strings.Split(joined, ",")
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"lan-chat/protocol"
+)
+
+func nextNotice(t *testing.T, c *Client) *protocol.Notice {
+	t.Helper()
+	select {
+	case data := <-c.Send:
+		env, err := c.Codec.DecodeFrame(data)
+		if err != nil || env.Notice == nil {
+			t.Fatalf("expected notice frame, got %s (%v)", data, err)
+		}
+		return env.Notice
+	default:
+		t.Fatalf("expected a notice for %s", c.UserID)
+	}
+	return nil
+}
+
+func TestMembershipChangesNotifyMembers(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	alice := r.Register("u-alice", nil)
+	bob := r.Register("u-bob", nil)
+	charlie := r.Register("u-charlie", nil)
+
+	// The first scan records the existing members of private channels as
+	// version 1; public channels are not tracked.
+	if err := r.checkMembership(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*Client{alice, bob} {
+		n := nextNotice(t, c)
+		if n.ChannelID != "priv-1" || n.Data["version"] != "1" || n.Data["added"] != "u-alice,u-bob" {
+			t.Fatalf("unexpected first notice for %s: %+v", c.UserID, n)
+		}
+	}
+	if len(charlie.Send) != 0 {
+		t.Fatalf("non-member notified of the first scan")
+	}
+
+	if err := r.store.AddChannelMember("priv-1", "u-charlie"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.store.AddChannelMember("general", "u-charlie"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.checkMembership(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*Client{alice, bob, charlie} {
+		n := nextNotice(t, c)
+		if n.Kind != protocol.NoticeChannelMembersChanged || n.ChannelID != "priv-1" || n.Data["version"] != "2" ||
+			n.Data["added"] != "u-charlie" || n.Data["removed"] != "" {
+			t.Fatalf("unexpected notice for %s: %+v", c.UserID, n)
+		}
+		if len(c.Send) != 0 {
+			t.Fatalf("public channel change notified to %s", c.UserID)
+		}
+	}
+
+	if err := r.checkMembership(); err != nil {
+		t.Fatal(err)
+	}
+	if len(alice.Send) != 0 {
+		t.Fatalf("no notice expected without changes")
+	}
+
+	// Admin-api removes members directly from the shared table; the removed
+	// member is told as well.
+	if _, err := r.db.Exec(`DELETE FROM channel_members WHERE channel_id = 'priv-1' AND user_id = 'u-bob'`); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.checkMembership(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*Client{alice, bob, charlie} {
+		if n := nextNotice(t, c); n.Data["removed"] != "u-bob" || n.Data["added"] != "" || n.Data["version"] != "3" {
+			t.Fatalf("unexpected notice for %s: %+v", c.UserID, n)
+		}
+	}
+
+	// Clients that did not negotiate notices are skipped.
+	alice.enable(&protocol.Welcome{})
+	<-alice.Send
+	_ = r.store.RemoveChannelMember("priv-1", "u-charlie")
+	if err := r.checkMembership(); err != nil {
+		t.Fatal(err)
+	}
+	if len(alice.Send) != 0 {
+		t.Fatalf("notice sent to a client without the notices capability")
+	}
+	if n := nextNotice(t, charlie); n.Data["removed"] != "u-charlie" {
+		t.Fatalf("unexpected notice %+v", n)
+	}
+}
+
+func TestMembershipChangesSurviveRestart(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	if err := r.checkMembership(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A change made while messaging is down is still found, and numbered
+	// after the changes recorded before the restart.
+	if err := r.store.AddChannelMember("priv-1", "u-charlie"); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := NewMessageRouterWithStore(r.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := restarted.Register("u-alice", nil)
+	if err := restarted.checkMembership(); err != nil {
+		t.Fatal(err)
+	}
+	if n := nextNotice(t, alice); n.Data["added"] != "u-charlie" || n.Data["version"] != "2" {
+		t.Fatalf("change made while down was lost: %+v", n)
+	}
+
+	get := func(user, query string) (int, struct {
+		Version int64              `json:"version"`
+		Changes []MembershipChange `json:"changes"`
+	}) {
+		req := httptest.NewRequest(http.MethodGet, "/channel-members/changes?channel_id=priv-1"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, user))
+		rec := httptest.NewRecorder()
+		restarted.MembershipChangesHandler(rec, req)
+		var out struct {
+			Version int64              `json:"version"`
+			Changes []MembershipChange `json:"changes"`
+		}
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+				t.Fatalf("decode changes: %v", err)
+			}
+		}
+		return rec.Code, out
+	}
+
+	// A reconnecting client asks for what it missed after the last version
+	// it applied.
+	code, out := get("bob", "&since=1")
+	if code != http.StatusOK || out.Version != 2 || len(out.Changes) != 1 ||
+		out.Changes[0].Version != 2 || len(out.Changes[0].Added) != 1 || out.Changes[0].Added[0] != "u-charlie" {
+		t.Fatalf("unexpected changes %d %+v", code, out)
+	}
+	if code, out := get("bob", ""); code != http.StatusOK || len(out.Changes) != 2 {
+		t.Fatalf("expected the whole log without since, got %d %+v", code, out)
+	}
+
+	_ = restarted.store.RemoveChannelMember("priv-1", "u-bob")
+	if code, _ := get("bob", "&since=2"); code != http.StatusForbidden {
+		t.Fatalf("removed member: expected 403, got %d", code)
+	}
+	if code, _ := get("alice", "&since=x"); code != http.StatusBadRequest {
+		t.Fatalf("bad since: expected 400, got %d", code)
+	}
+}
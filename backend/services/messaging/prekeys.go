@@ -0,0 +1,534 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"lan-chat/protocol"
+)
+
+// prekeySchema stores the public half of each device's X3DH keys. The
+// identity key is fixed for the life of a device; signed prekeys are
+// replaced on upload and one-time prekeys are deleted as bundles hand them
+// out.
+const prekeySchema = `
+	CREATE TABLE IF NOT EXISTS device_identity_keys (
+		device_id TEXT PRIMARY KEY,
+		identity_key TEXT NOT NULL,
+		created_at BIGINT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS signed_prekeys (
+		device_id TEXT PRIMARY KEY,
+		key_id BIGINT NOT NULL,
+		public_key TEXT NOT NULL,
+		signature TEXT NOT NULL,
+		created_at BIGINT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS one_time_prekeys (
+		device_id TEXT NOT NULL,
+		key_id BIGINT NOT NULL,
+		public_key TEXT NOT NULL,
+		created_at BIGINT NOT NULL,
+		PRIMARY KEY (device_id, key_id)
+	);
+`
+
+// PreKeyLimits bounds one-time prekey uploads and sets when owners are told
+// to upload more.
+type PreKeyLimits struct {
+	MaxPerUpload int // one-time prekeys in a single request
+	MaxPerDevice int // one-time prekeys stored per device
+	LowWatermark int // notify the owner when fewer remain
+}
+
+func preKeyLimitsFromEnv() PreKeyLimits {
+	return PreKeyLimits{
+		MaxPerUpload: envInt("MESSAGING_PREKEY_MAX_UPLOAD", 100),
+		MaxPerDevice: envInt("MESSAGING_PREKEY_MAX_PER_DEVICE", 200),
+		LowWatermark: envInt("MESSAGING_PREKEY_LOW_WATERMARK", 10),
+	}
+}
+
+var (
+	errIdentityKeyMismatch  = errors.New("identity key differs from the one registered for this device")
+	errSignedPreKeyRequired = errors.New("signed_prekey is required on the first upload")
+	errPreKeyLimit          = errors.New("device would exceed its one-time prekey limit")
+)
+
+// UploadPreKeysRequest publishes a device's keys. All keys are base64. The
+// identity key is protocol.IdentityKey.Bytes() and must be sent with every
+// upload; the signed prekey is required on the first upload and replaces
+// the previous one when given. A different identity key is only accepted
+// with ReplaceIdentity (e.g. after reinstalling), which also needs a new
+// signed prekey and discards the device's remaining one-time prekeys.
+type UploadPreKeysRequest struct {
+	DeviceID        string                `json:"device_id"`
+	IdentityKey     string                `json:"identity_key"`
+	ReplaceIdentity bool                  `json:"replace_identity,omitempty"`
+	SignedPreKey    *SignedPreKeyUpload   `json:"signed_prekey,omitempty"`
+	OneTimePreKeys  []OneTimePreKeyUpload `json:"one_time_prekeys,omitempty"`
+}
+
+type SignedPreKeyUpload struct {
+	KeyID     uint32 `json:"key_id"`
+	PublicKey string `json:"public_key"`
+	Signature string `json:"signature"`
+}
+
+type OneTimePreKeyUpload struct {
+	KeyID     uint32 `json:"key_id"`
+	PublicKey string `json:"public_key"`
+}
+
+// DevicePreKeyBundle is a protocol.PreKeyBundle for one device.
+type DevicePreKeyBundle struct {
+	DeviceID string `json:"device_id"`
+	protocol.PreKeyBundle
+}
+
+// PreKeyStatus summarises the published keys of one device.
+type PreKeyStatus struct {
+	DeviceID              string `json:"device_id"`
+	UserID                string `json:"user_id"`
+	DeviceName            string `json:"device_name"`
+	IdentityFingerprint   string `json:"identity_fingerprint,omitempty"` // hex SHA-256 of the identity key
+	SignedPreKeyID        uint32 `json:"signed_prekey_id,omitempty"`
+	SignedPreKeyCreatedAt int64  `json:"signed_prekey_created_at,omitempty"`
+	OneTimePreKeys        int    `json:"one_time_prekeys"`
+	Low                   bool   `json:"low"`
+	LastSeen              int64  `json:"last_seen,omitempty"`
+}
+
+func decodeKey(s string, size int) ([]byte, bool) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	return b, err == nil && len(b) == size
+}
+
+// deviceOwner returns the user a device is registered to.
+func (r *MessageRouter) deviceOwner(deviceID string) (string, error) {
+	var userID string
+	err := r.db.QueryRow(r.bind(`SELECT user_id FROM devices WHERE id = ?`), deviceID).Scan(&userID)
+	return userID, err
+}
+
+// PreKeysHandler accepts prekey uploads (POST) for the caller's devices.
+func (r *MessageRouter) PreKeysHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := r.authenticate(req)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body UploadPreKeysRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if owner, err := r.deviceOwner(body.DeviceID); err != nil || owner != userID {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+	identity, ok := decodeKey(body.IdentityKey, protocol.IdentityKeySize)
+	if !ok {
+		http.Error(w, "identity_key must be a base64 identity key", http.StatusBadRequest)
+		return
+	}
+	if spk := body.SignedPreKey; spk != nil {
+		pub, ok := decodeKey(spk.PublicKey, protocol.KeySize)
+		if !ok {
+			http.Error(w, "signed_prekey.public_key must be a base64 X25519 key", http.StatusBadRequest)
+			return
+		}
+		sig, _ := base64.StdEncoding.DecodeString(spk.Signature)
+		bundle := protocol.PreKeyBundle{IdentityKey: identity, SignedPreKey: pub, SignedPreKeySignature: sig}
+		if _, err := bundle.Verify(); err != nil {
+			http.Error(w, "signed prekey signature is invalid", http.StatusBadRequest)
+			return
+		}
+	}
+	if len(body.OneTimePreKeys) > r.prekeys.MaxPerUpload {
+		http.Error(w, "too many one-time prekeys in one upload", http.StatusBadRequest)
+		return
+	}
+	seen := make(map[uint32]bool, len(body.OneTimePreKeys))
+	for _, k := range body.OneTimePreKeys {
+		if _, ok := decodeKey(k.PublicKey, protocol.KeySize); !ok || k.KeyID == 0 || seen[k.KeyID] {
+			http.Error(w, "one-time prekeys need unique non-zero key_id and a base64 X25519 public_key", http.StatusBadRequest)
+			return
+		}
+		seen[k.KeyID] = true
+	}
+
+	event, err := r.storePreKeys(body, userID, identity, time.Now())
+	if err != nil {
+		switch {
+		case errors.Is(err, errIdentityKeyMismatch):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, errSignedPreKeyRequired), errors.Is(err, errPreKeyLimit):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, "one-time prekey already uploaded or db error", http.StatusConflict)
+		}
+		return
+	}
+	status, err := r.preKeyStatus("d.id = ?", body.DeviceID)
+	if err != nil || len(status) == 0 {
+		http.Error(w, "failed to load prekey status", http.StatusInternalServerError)
+		return
+	}
+	_ = r.audit.LogJSON(userID, "prekeys.upload", "device:"+body.DeviceID, map[string]interface{}{
+		"signed_prekey":    body.SignedPreKey != nil,
+		"one_time_prekeys": len(body.OneTimePreKeys),
+		"identity":         event,
+	})
+	if event != "" {
+		r.announceIdentityChange(userID, body.DeviceID, event)
+	}
+	if event == identityEventAdded {
+		r.announceNewDevice(userID, body.DeviceID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": status[0]})
+}
+
+// storePreKeys saves an upload and returns the identity key event it
+// caused ("added", "changed" or "" when the key is unchanged).
+func (r *MessageRouter) storePreKeys(body UploadPreKeysRequest, userID string, identity []byte, now time.Time) (string, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	encodedIdentity := base64.StdEncoding.EncodeToString(identity)
+	var existing, event string
+	err = tx.QueryRow(r.bind(`SELECT identity_key FROM device_identity_keys WHERE device_id = ?`), body.DeviceID).Scan(&existing)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		if body.SignedPreKey == nil {
+			return "", errSignedPreKeyRequired
+		}
+		if _, err := tx.Exec(r.bind(`INSERT INTO device_identity_keys (device_id, identity_key, created_at) VALUES (?, ?, ?)`),
+			body.DeviceID, encodedIdentity, now.Unix()); err != nil {
+			return "", err
+		}
+		event = identityEventAdded
+	case err != nil:
+		return "", err
+	case existing != encodedIdentity:
+		if !body.ReplaceIdentity {
+			return "", errIdentityKeyMismatch
+		}
+		if body.SignedPreKey == nil {
+			return "", errSignedPreKeyRequired
+		}
+		if _, err := tx.Exec(r.bind(`UPDATE device_identity_keys SET identity_key = ?, created_at = ? WHERE device_id = ?`),
+			encodedIdentity, now.Unix(), body.DeviceID); err != nil {
+			return "", err
+		}
+		if _, err := tx.Exec(r.bind(`DELETE FROM one_time_prekeys WHERE device_id = ?`), body.DeviceID); err != nil {
+			return "", err
+		}
+		event = identityEventChanged
+	}
+	if event != "" {
+		if err := r.recordIdentityEvent(tx, userID, body.DeviceID, identity, event, now); err != nil {
+			return "", err
+		}
+	}
+
+	if spk := body.SignedPreKey; spk != nil {
+		if _, err := tx.Exec(r.bind(`DELETE FROM signed_prekeys WHERE device_id = ?`), body.DeviceID); err != nil {
+			return "", err
+		}
+		if _, err := tx.Exec(r.bind(`
+			INSERT INTO signed_prekeys (device_id, key_id, public_key, signature, created_at)
+			VALUES (?, ?, ?, ?, ?)`), body.DeviceID, spk.KeyID, spk.PublicKey, spk.Signature, now.Unix()); err != nil {
+			return "", err
+		}
+	}
+
+	if len(body.OneTimePreKeys) > 0 {
+		var count int
+		if err := tx.QueryRow(r.bind(`SELECT COUNT(*) FROM one_time_prekeys WHERE device_id = ?`), body.DeviceID).Scan(&count); err != nil {
+			return "", err
+		}
+		if count+len(body.OneTimePreKeys) > r.prekeys.MaxPerDevice {
+			return "", errPreKeyLimit
+		}
+		for _, k := range body.OneTimePreKeys {
+			if _, err := tx.Exec(r.bind(`
+				INSERT INTO one_time_prekeys (device_id, key_id, public_key, created_at)
+				VALUES (?, ?, ?, ?)`), body.DeviceID, k.KeyID, k.PublicKey, now.Unix()); err != nil {
+				return "", err
+			}
+		}
+	}
+	return event, tx.Commit()
+}
+
+// PreKeyBundleHandler returns one bundle per device of ?user_id= (or only
+// ?device_id=), handing out one one-time prekey from each. Devices without
+// an identity key or signed prekey are skipped. A bundle without a
+// one-time prekey still works, with weaker forward secrecy for the first
+// message.
+func (r *MessageRouter) PreKeyBundleHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := r.authenticate(req)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	targetID := req.URL.Query().Get("user_id")
+	deviceID := req.URL.Query().Get("device_id")
+	if targetID == "" {
+		http.Error(w, "user_id is required", http.StatusBadRequest)
+		return
+	}
+	if retry, err := r.flood.CheckBundle(userID, targetID); err != nil {
+		secs := int64(math.Ceil(retry.Seconds()))
+		if secs < 1 {
+			secs = 1
+		}
+		w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+		http.Error(w, "too many bundle requests, slow down", http.StatusTooManyRequests)
+		return
+	}
+
+	query := `
+		SELECT d.id, i.identity_key, s.key_id, s.public_key, s.signature
+		FROM devices d
+		JOIN device_identity_keys i ON i.device_id = d.id
+		JOIN signed_prekeys s ON s.device_id = d.id
+		WHERE d.user_id = ?`
+	args := []interface{}{targetID}
+	if deviceID != "" {
+		query += ` AND d.id = ?`
+		args = append(args, deviceID)
+	}
+	rows, err := r.db.Query(r.bind(query+` ORDER BY d.created_at ASC`), args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	bundles := make([]DevicePreKeyBundle, 0)
+	for rows.Next() {
+		var b DevicePreKeyBundle
+		var identity, spk, sig string
+		if err := rows.Scan(&b.DeviceID, &identity, &b.SignedPreKeyID, &spk, &sig); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b.IdentityKey, _ = base64.StdEncoding.DecodeString(identity)
+		b.SignedPreKey, _ = base64.StdEncoding.DecodeString(spk)
+		b.SignedPreKeySignature, _ = base64.StdEncoding.DecodeString(sig)
+		bundles = append(bundles, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for i := range bundles {
+		keyID, pub, remaining, err := r.consumeOneTimePreKey(bundles[i].DeviceID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		bundles[i].OneTimePreKeyID, bundles[i].OneTimePreKey = keyID, pub
+		if remaining < r.prekeys.LowWatermark {
+			r.notifyPreKeysLow(targetID, bundles[i].DeviceID, remaining)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"user_id": targetID, "bundles": bundles})
+}
+
+// consumeOneTimePreKey deletes and returns the device's oldest one-time
+// prekey, or a zero ID when none are left, along with how many remain.
+// Concurrent callers never receive the same key: a key only counts as
+// handed out once this call's DELETE removed it.
+func (r *MessageRouter) consumeOneTimePreKey(deviceID string) (uint32, []byte, int, error) {
+	for attempt := 0; attempt < 5; attempt++ {
+		tx, err := r.db.Begin()
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		var keyID uint32
+		var encoded string
+		err = tx.QueryRow(r.bind(`
+			SELECT key_id, public_key FROM one_time_prekeys
+			WHERE device_id = ? ORDER BY key_id ASC LIMIT 1`), deviceID).Scan(&keyID, &encoded)
+		if errors.Is(err, sql.ErrNoRows) {
+			tx.Rollback()
+			return 0, nil, 0, nil
+		}
+		if err != nil {
+			tx.Rollback()
+			return 0, nil, 0, err
+		}
+		res, err := tx.Exec(r.bind(`DELETE FROM one_time_prekeys WHERE device_id = ? AND key_id = ?`), deviceID, keyID)
+		if err != nil {
+			tx.Rollback()
+			return 0, nil, 0, err
+		}
+		if n, _ := res.RowsAffected(); n != 1 {
+			tx.Rollback()
+			continue
+		}
+		var remaining int
+		if err := tx.QueryRow(r.bind(`SELECT COUNT(*) FROM one_time_prekeys WHERE device_id = ?`), deviceID).Scan(&remaining); err != nil {
+			tx.Rollback()
+			return 0, nil, 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, nil, 0, err
+		}
+		pub, _ := base64.StdEncoding.DecodeString(encoded)
+		return keyID, pub, remaining, nil
+	}
+	return 0, nil, 0, errors.New("one-time prekey contention, try again")
+}
+
+// notifyPreKeysLow tells the owner's connected clients that deviceID
+// should upload more one-time prekeys.
+func (r *MessageRouter) notifyPreKeysLow(userID, deviceID string, remaining int) {
+	r.sendNotice(userID, &protocol.Notice{
+		Kind:     protocol.NoticePreKeysLow,
+		UserID:   userID,
+		DeviceID: deviceID,
+		Data: map[string]string{
+			"remaining": strconv.Itoa(remaining),
+			"threshold": strconv.Itoa(r.prekeys.LowWatermark),
+		},
+		Timestamp: time.Now().UnixMilli(),
+	})
+}
+
+// sendNotice pushes a notice to every connection of userID that negotiated
+// the notices capability.
+func (r *MessageRouter) sendNotice(userID string, notice *protocol.Notice) {
+	env := &protocol.Envelope{Notice: notice}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, client := range r.clients[userID] {
+		if client.supports(protocol.CapabilityNotices) {
+			client.sendFrame(env)
+		}
+	}
+}
+
+// preKeyStatus lists devices matching where (a condition on d, the devices
+// table) with their published key state.
+func (r *MessageRouter) preKeyStatus(where string, args ...interface{}) ([]PreKeyStatus, error) {
+	rows, err := r.db.Query(r.bind(`
+		SELECT d.id, d.user_id, d.device_name, COALESCE(d.last_seen, 0),
+			COALESCE(i.identity_key, ''), COALESCE(s.key_id, 0), COALESCE(s.created_at, 0),
+			(SELECT COUNT(*) FROM one_time_prekeys o WHERE o.device_id = d.id)
+		FROM devices d
+		LEFT JOIN device_identity_keys i ON i.device_id = d.id
+		LEFT JOIN signed_prekeys s ON s.device_id = d.id
+		WHERE `+where+`
+		ORDER BY d.user_id ASC, d.created_at ASC`), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]PreKeyStatus, 0)
+	for rows.Next() {
+		var s PreKeyStatus
+		var identity string
+		if err := rows.Scan(&s.DeviceID, &s.UserID, &s.DeviceName, &s.LastSeen,
+			&identity, &s.SignedPreKeyID, &s.SignedPreKeyCreatedAt, &s.OneTimePreKeys); err != nil {
+			return nil, err
+		}
+		if identity != "" {
+			raw, _ := base64.StdEncoding.DecodeString(identity)
+			sum := sha256.Sum256(raw)
+			s.IdentityFingerprint = hex.EncodeToString(sum[:])
+		}
+		s.Low = s.OneTimePreKeys < r.prekeys.LowWatermark
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// PreKeyStatusHandler reports key status per device: the caller's own
+// devices, or for admins every device (optionally ?user_id=).
+func (r *MessageRouter) PreKeyStatusHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := r.authenticate(req)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	target := req.URL.Query().Get("user_id")
+	if _, err := r.authenticateAdmin(req); err != nil {
+		if target != "" && target != userID {
+			http.Error(w, "admin access required", http.StatusForbidden)
+			return
+		}
+		target = userID
+	}
+
+	var devices []PreKeyStatus
+	if target == "" {
+		devices, err = r.preKeyStatus("1 = 1")
+	} else {
+		devices, err = r.preKeyStatus("d.user_id = ?", target)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"devices":       devices,
+		"low_watermark": r.prekeys.LowWatermark,
+	})
+}
+
+// deletePreKeys removes every key published for a device and records the
+// identity key's removal. An error leaves tx to be rolled back: keys that
+// outlive their device could still be handed out in bundles.
+func (r *MessageRouter) deletePreKeys(tx *sql.Tx, userID, deviceID string) error {
+	var identity string
+	err := tx.QueryRow(r.bind(`SELECT identity_key FROM device_identity_keys WHERE device_id = ?`), deviceID).Scan(&identity)
+	switch {
+	case err == nil:
+		raw, _ := base64.StdEncoding.DecodeString(identity)
+		if err := r.recordIdentityEvent(tx, userID, deviceID, raw, identityEventRemoved, time.Now()); err != nil {
+			return fmt.Errorf("record identity key removal: %w", err)
+		}
+	case !errors.Is(err, sql.ErrNoRows):
+		return err
+	}
+	for _, table := range []string{"device_identity_keys", "signed_prekeys", "one_time_prekeys"} {
+		if _, err := tx.Exec(r.bind(`DELETE FROM `+table+` WHERE device_id = ?`), deviceID); err != nil {
+			return fmt.Errorf("delete %s: %w", table, err)
+		}
+	}
+	return nil
+}
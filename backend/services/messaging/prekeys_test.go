@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"lan-chat/protocol"
+)
+
+type testPreKeyDevice struct {
+	id       string
+	identity *protocol.IdentityKeyPair
+	spk      *protocol.SignedPreKey
+	opks     []*protocol.OneTimePreKey
+}
+
+func newTestPreKeyDevice(t *testing.T, r *MessageRouter, username string, opks int) *testPreKeyDevice {
+	t.Helper()
+	deviceID, _ := registerTestDeviceKey(t, r, username)
+	identity, err := protocol.GenerateIdentityKeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spk, err := protocol.GenerateSignedPreKey(rand.Reader, identity, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := protocol.GenerateOneTimePreKeys(rand.Reader, 1, opks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testPreKeyDevice{id: deviceID, identity: identity, spk: spk, opks: keys}
+}
+
+func (d *testPreKeyDevice) upload() UploadPreKeysRequest {
+	b64 := base64.StdEncoding.EncodeToString
+	body := UploadPreKeysRequest{
+		DeviceID:    d.id,
+		IdentityKey: b64(d.identity.Public().Bytes()),
+		SignedPreKey: &SignedPreKeyUpload{
+			KeyID:     d.spk.ID,
+			PublicKey: b64(d.spk.KeyPair.Public),
+			Signature: b64(d.spk.Signature),
+		},
+	}
+	for _, k := range d.opks {
+		body.OneTimePreKeys = append(body.OneTimePreKeys, OneTimePreKeyUpload{KeyID: k.ID, PublicKey: b64(k.KeyPair.Public)})
+	}
+	return body
+}
+
+func postPreKeys(t *testing.T, r *MessageRouter, token string, body UploadPreKeysRequest) *httptest.ResponseRecorder {
+	t.Helper()
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, "/prekeys", bytes.NewReader(data))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	r.PreKeysHandler(rec, req)
+	return rec
+}
+
+func fetchBundles(t *testing.T, r *MessageRouter, token, userID string) []DevicePreKeyBundle {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/prekeys/bundle?user_id="+userID, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	r.PreKeyBundleHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("fetch bundle: %d %s", rec.Code, rec.Body.String())
+	}
+	var out struct {
+		Bundles []DevicePreKeyBundle `json:"bundles"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatalf("decode bundles: %v", err)
+	}
+	return out.Bundles
+}
+
+func TestPreKeyUploadValidation(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	bob := newTestPreKeyDevice(t, r, "bob", 3)
+	token := tokenForTestUser(t, "bob")
+
+	if rec := postPreKeys(t, r, tokenForTestUser(t, "alice"), bob.upload()); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected another user's device to be rejected, got %d", rec.Code)
+	}
+
+	forged := bob.upload()
+	other, _ := protocol.GenerateIdentityKeyPair(rand.Reader)
+	forged.IdentityKey = base64.StdEncoding.EncodeToString(other.Public().Bytes())
+	if rec := postPreKeys(t, r, token, forged); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected signature from another identity to be rejected, got %d", rec.Code)
+	}
+
+	noSPK := bob.upload()
+	noSPK.SignedPreKey = nil
+	if rec := postPreKeys(t, r, token, noSPK); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected first upload without signed prekey to be rejected, got %d", rec.Code)
+	}
+
+	rec := postPreKeys(t, r, token, bob.upload())
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", rec.Code, rec.Body.String())
+	}
+	var out struct {
+		Status PreKeyStatus `json:"status"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &out)
+	if out.Status.OneTimePreKeys != 3 || out.Status.SignedPreKeyID != 1 || out.Status.IdentityFingerprint == "" {
+		t.Fatalf("unexpected status %+v", out.Status)
+	}
+
+	if rec := postPreKeys(t, r, token, bob.upload()); rec.Code != http.StatusConflict {
+		t.Fatalf("expected re-uploaded one-time prekey IDs to conflict, got %d", rec.Code)
+	}
+
+	// The identity key of a device is fixed; a new identity needs a new device.
+	changed := newTestPreKeyDevice(t, r, "bob", 0)
+	changed.id = bob.id
+	if rec := postPreKeys(t, r, token, changed.upload()); rec.Code != http.StatusConflict {
+		t.Fatalf("expected identity change to conflict, got %d", rec.Code)
+	}
+
+	// Top-ups need only the identity key and the new one-time prekeys.
+	more, _ := protocol.GenerateOneTimePreKeys(rand.Reader, 4, 2)
+	topUp := UploadPreKeysRequest{DeviceID: bob.id, IdentityKey: bob.upload().IdentityKey}
+	for _, k := range more {
+		topUp.OneTimePreKeys = append(topUp.OneTimePreKeys, OneTimePreKeyUpload{KeyID: k.ID, PublicKey: base64.StdEncoding.EncodeToString(k.KeyPair.Public)})
+	}
+	if rec := postPreKeys(t, r, token, topUp); rec.Code != http.StatusOK || !bytes.Contains(rec.Body.Bytes(), []byte(`"one_time_prekeys":5`)) {
+		t.Fatalf("top-up: %d %s", rec.Code, rec.Body.String())
+	}
+
+	r.prekeys.MaxPerDevice = 5
+	extra, _ := protocol.GenerateOneTimePreKeys(rand.Reader, 10, 1)
+	topUp.OneTimePreKeys = []OneTimePreKeyUpload{{KeyID: extra[0].ID, PublicKey: base64.StdEncoding.EncodeToString(extra[0].KeyPair.Public)}}
+	if rec := postPreKeys(t, r, token, topUp); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected per-device limit to be enforced, got %d", rec.Code)
+	}
+}
+
+func TestPreKeyBundleConsumesOneTimePreKeys(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	bob := newTestPreKeyDevice(t, r, "bob", 2)
+	if rec := postPreKeys(t, r, tokenForTestUser(t, "bob"), bob.upload()); rec.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", rec.Code, rec.Body.String())
+	}
+	aliceToken := tokenForTestUser(t, "alice")
+
+	seen := map[uint32]bool{}
+	for i := 0; i < 2; i++ {
+		bundles := fetchBundles(t, r, aliceToken, "u-bob")
+		if len(bundles) != 1 || bundles[0].DeviceID != bob.id {
+			t.Fatalf("unexpected bundles %+v", bundles)
+		}
+		id := bundles[0].OneTimePreKeyID
+		if id == 0 || seen[id] {
+			t.Fatalf("fetch %d: expected a fresh one-time prekey, got %d", i, id)
+		}
+		seen[id] = true
+	}
+	bundles := fetchBundles(t, r, aliceToken, "u-bob")
+	if len(bundles) != 1 || bundles[0].OneTimePreKeyID != 0 || bundles[0].OneTimePreKey != nil {
+		t.Fatalf("expected bundle without one-time prekey once exhausted, got %+v", bundles)
+	}
+	if _, err := bundles[0].Verify(); err != nil {
+		t.Fatalf("exhausted bundle should still verify: %v", err)
+	}
+	if got := fetchBundles(t, r, aliceToken, "u-charlie"); len(got) != 0 {
+		t.Fatalf("expected no bundles for a user without keys, got %+v", got)
+	}
+}
+
+func TestPreKeyBundleEstablishesSession(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	bob := newTestPreKeyDevice(t, r, "bob", 5)
+	if rec := postPreKeys(t, r, tokenForTestUser(t, "bob"), bob.upload()); rec.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", rec.Code, rec.Body.String())
+	}
+	bundle := fetchBundles(t, r, tokenForTestUser(t, "alice"), "u-bob")[0]
+
+	aliceIdentity, _ := protocol.GenerateIdentityKeyPair(rand.Reader)
+	alice := protocol.NewDoubleRatchetHandler(aliceIdentity, nil)
+	session, err := alice.InitiateSession(bundle.DeviceID, &bundle.PreKeyBundle)
+	if err != nil {
+		t.Fatalf("initiate: %v", err)
+	}
+	ct, err := alice.EncryptMessage(session, []byte("hi bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := protocol.NewMemoryPreKeyStore([]*protocol.SignedPreKey{bob.spk}, bob.opks)
+	bobHandler := protocol.NewDoubleRatchetHandler(bob.identity, store)
+	var bobSession protocol.RatchetSession
+	pt, err := bobHandler.DecryptMessage(&bobSession, ct)
+	if err != nil || string(pt) != "hi bob" {
+		t.Fatalf("decrypt: %q %v", pt, err)
+	}
+	if _, err := store.OneTimePreKey(bundle.OneTimePreKeyID); err == nil {
+		t.Fatalf("expected the used one-time prekey to be removed on the device")
+	}
+}
+
+func TestPreKeysLowNotifiesOwner(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	r.prekeys.LowWatermark = 2
+	bob := newTestPreKeyDevice(t, r, "bob", 3)
+	if rec := postPreKeys(t, r, tokenForTestUser(t, "bob"), bob.upload()); rec.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", rec.Code, rec.Body.String())
+	}
+	bobConn := r.Register("u-bob", nil)
+	aliceConn := r.Register("u-alice", nil)
+	aliceToken := tokenForTestUser(t, "alice")
+
+	fetchBundles(t, r, aliceToken, "u-bob")
+	if len(bobConn.Send) != 0 {
+		t.Fatalf("no notice expected while above the watermark")
+	}
+	fetchBundles(t, r, aliceToken, "u-bob")
+	select {
+	case data := <-bobConn.Send:
+		env, err := bobConn.Codec.DecodeFrame(data)
+		if err != nil || env.Notice == nil {
+			t.Fatalf("expected notice frame, got %s (%v)", data, err)
+		}
+		n := env.Notice
+		if n.Kind != protocol.NoticePreKeysLow || n.DeviceID != bob.id || n.Data["remaining"] != "1" || n.Data["threshold"] != "2" {
+			t.Fatalf("unexpected notice %+v", n)
+		}
+	default:
+		t.Fatalf("expected prekeys_low notice for the owner")
+	}
+	if len(aliceConn.Send) != 0 {
+		t.Fatalf("notice leaked to the requester")
+	}
+
+	// Clients that did not negotiate notices are not sent them.
+	bobConn.enable(&protocol.Welcome{Enabled: []string{protocol.CapabilityEphemeral}})
+	<-bobConn.Send // the Welcome
+	fetchBundles(t, r, aliceToken, "u-bob")
+	if len(bobConn.Send) != 0 {
+		t.Fatalf("notice sent to a client without the notices capability")
+	}
+}
+
+func TestPreKeyStatusVisibility(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	bob := newTestPreKeyDevice(t, r, "bob", 1)
+	if rec := postPreKeys(t, r, tokenForTestUser(t, "bob"), bob.upload()); rec.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", rec.Code, rec.Body.String())
+	}
+	registerTestDeviceKey(t, r, "alice")
+
+	status := func(token, query string) (int, []PreKeyStatus) {
+		req := httptest.NewRequest(http.MethodGet, "/prekeys/status"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		r.PreKeyStatusHandler(rec, req)
+		var out struct {
+			Devices []PreKeyStatus `json:"devices"`
+		}
+		_ = json.Unmarshal(rec.Body.Bytes(), &out)
+		return rec.Code, out.Devices
+	}
+
+	code, own := status(tokenForTestUser(t, "bob"), "")
+	if code != http.StatusOK || len(own) != 1 || own[0].DeviceID != bob.id || own[0].OneTimePreKeys != 1 || !own[0].Low {
+		t.Fatalf("unexpected own status %d %+v", code, own)
+	}
+	if code, _ := status(tokenForTestUser(t, "bob"), "?user_id=u-alice"); code != http.StatusForbidden {
+		t.Fatalf("expected members not to see other users' devices, got %d", code)
+	}
+
+	code, all := status(adminTokenForTestUser(t, "alice"), "")
+	if code != http.StatusOK || len(all) != 2 {
+		t.Fatalf("expected admin to see every device, got %d %+v", code, all)
+	}
+	for _, d := range all {
+		if d.UserID == "u-alice" && (d.IdentityFingerprint != "" || d.OneTimePreKeys != 0) {
+			t.Fatalf("device without prekeys reported keys: %+v", d)
+		}
+	}
+	if code, only := status(adminTokenForTestUser(t, "alice"), "?user_id=u-bob"); code != http.StatusOK || len(only) != 1 {
+		t.Fatalf("expected admin filter by user, got %d %+v", code, only)
+	}
+
+	del := httptest.NewRequest(http.MethodDelete, "/devices/keys?device_id="+bob.id, nil)
+	del.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, "bob"))
+	r.DeviceKeysHandler(httptest.NewRecorder(), del)
+	if got := fetchBundles(t, r, tokenForTestUser(t, "alice"), "u-bob"); len(got) != 0 {
+		t.Fatalf("expected removed device to publish no bundle, got %+v", got)
+	}
+	var n int
+	_ = r.db.QueryRow(`SELECT COUNT(*) FROM device_identity_keys WHERE device_id = ?`, bob.id).Scan(&n)
+	if n != 0 {
+		t.Fatalf("expected removed device's prekeys to be deleted")
+	}
+}
+
+func TestDrainedPreKeyPoolFallsBackToSignedPreKey(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	bob := newTestPreKeyDevice(t, r, "bob", 1)
+	if rec := postPreKeys(t, r, tokenForTestUser(t, "bob"), bob.upload()); rec.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", rec.Code, rec.Body.String())
+	}
+	aliceToken := tokenForTestUser(t, "alice")
+	if first := fetchBundles(t, r, aliceToken, "u-bob"); first[0].OneTimePreKeyID == 0 {
+		t.Fatalf("first fetch should hand out the only one-time prekey")
+	}
+	bundle := fetchBundles(t, r, aliceToken, "u-bob")[0]
+	if bundle.OneTimePreKeyID != 0 {
+		t.Fatalf("drained pool handed out one-time prekey %d", bundle.OneTimePreKeyID)
+	}
+
+	// A session from the signed prekey alone still works end to end and
+	// leaves the device's own one-time prekeys alone.
+	aliceIdentity, _ := protocol.GenerateIdentityKeyPair(rand.Reader)
+	alice := protocol.NewDoubleRatchetHandler(aliceIdentity, nil)
+	session, err := alice.InitiateSession(bundle.DeviceID, &bundle.PreKeyBundle)
+	if err != nil {
+		t.Fatalf("initiate from a drained bundle: %v", err)
+	}
+	ct, err := alice.EncryptMessage(session, []byte("no one-time key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := protocol.NewMemoryPreKeyStore([]*protocol.SignedPreKey{bob.spk}, bob.opks)
+	var bobSession protocol.RatchetSession
+	if pt, err := protocol.NewDoubleRatchetHandler(bob.identity, store).DecryptMessage(&bobSession, ct); err != nil || string(pt) != "no one-time key" {
+		t.Fatalf("decrypt: %q %v", pt, err)
+	}
+	if _, err := store.OneTimePreKey(bob.opks[0].ID); err != nil {
+		t.Fatalf("a session without a one-time prekey removed one: %v", err)
+	}
+}
+
+func TestPreKeyBundleFetchesAreRateLimited(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	now := time.Unix(1_700_000_000, 0)
+	r.flood = newTestFloodGuard(&now)
+	r.flood.bundles = newBucketLimiter(1, 2)
+	bob := newTestPreKeyDevice(t, r, "bob", 10)
+	if rec := postPreKeys(t, r, tokenForTestUser(t, "bob"), bob.upload()); rec.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", rec.Code, rec.Body.String())
+	}
+	fetch := func(username, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/prekeys/bundle?user_id="+target, nil)
+		req.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, username))
+		rec := httptest.NewRecorder()
+		r.PreKeyBundleHandler(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := fetch("alice", "u-bob"); rec.Code != http.StatusOK {
+			t.Fatalf("fetch %d: %d", i+1, rec.Code)
+		}
+	}
+	rec := fetch("alice", "u-bob")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("fetch past the burst: %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	// The limit is per requester and target.
+	if rec := fetch("charlie", "u-bob"); rec.Code != http.StatusOK {
+		t.Fatalf("another requester: %d", rec.Code)
+	}
+	if rec := fetch("alice", "u-charlie"); rec.Code != http.StatusOK {
+		t.Fatalf("another target: %d", rec.Code)
+	}
+	now = now.Add(time.Second)
+	if rec := fetch("alice", "u-bob"); rec.Code != http.StatusOK {
+		t.Fatalf("fetch after the refill: %d", rec.Code)
+	}
+}
+
+func TestDeviceRemovalRollsBackWhenKeysCannotBeDeleted(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	bob := newTestPreKeyDevice(t, r, "bob", 2)
+	if rec := postPreKeys(t, r, tokenForTestUser(t, "bob"), bob.upload()); rec.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", rec.Code, rec.Body.String())
+	}
+	if _, err := r.db.Exec(`DROP TABLE one_time_prekeys`); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/devices/keys?device_id="+bob.id, nil)
+	req.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, "bob"))
+	rec := httptest.NewRecorder()
+	r.DeviceKeysHandler(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500 when the prekeys cannot be deleted, got %d", rec.Code)
+	}
+	var devices, identities int
+	_ = r.db.QueryRow(`SELECT COUNT(*) FROM devices WHERE id = ?`, bob.id).Scan(&devices)
+	_ = r.db.QueryRow(`SELECT COUNT(*) FROM device_identity_keys WHERE device_id = ?`, bob.id).Scan(&identities)
+	if devices != 1 || identities != 1 {
+		t.Fatalf("half-removed device: devices=%d identity keys=%d", devices, identities)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"lan-chat/protocol"
+)
+
+var (
+	errRateLimited = errors.New("rate limited")
+	errMuted       = errors.New("muted")
+)
+
+// FloodConfig controls per-user and per-channel token buckets and the
+// automatic mute applied to senders that keep hitting them.
+type FloodConfig struct {
+	UserRate     float64       // messages per second per user
+	UserBurst    float64       // bucket size per user
+	ChannelRate  float64       // messages per second per channel
+	ChannelBurst float64       // bucket size per channel
+	MuteStrikes  int           // rejections within StrikeWindow before muting
+	StrikeWindow time.Duration // window for counting rejections
+	MuteDuration time.Duration // how long an automatic mute lasts
+	BundleRate   float64       // prekey bundle fetches per second per requester and target
+	BundleBurst  float64       // bucket size per requester and target
+}
+
+func envFloat(key string, def float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(key)); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+func floodConfigFromEnv() FloodConfig {
+	return FloodConfig{
+		UserRate:     envFloat("MESSAGING_USER_RATE", 5),
+		UserBurst:    envFloat("MESSAGING_USER_BURST", 20),
+		ChannelRate:  envFloat("MESSAGING_CHANNEL_RATE", 50),
+		ChannelBurst: envFloat("MESSAGING_CHANNEL_BURST", 200),
+		MuteStrikes:  envInt("MESSAGING_MUTE_STRIKES", 20),
+		StrikeWindow: envDuration("MESSAGING_STRIKE_WINDOW", time.Minute),
+		MuteDuration: envDuration("MESSAGING_MUTE_DURATION", 5*time.Minute),
+		BundleRate:   envFloat("MESSAGING_PREKEY_BUNDLE_RATE", 0.2),
+		BundleBurst:  envFloat("MESSAGING_PREKEY_BUNDLE_BURST", 10),
+	}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// bucketLimiter is a keyed token-bucket limiter.
+type bucketLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+func newBucketLimiter(rate, burst float64) *bucketLimiter {
+	return &bucketLimiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow takes one token for key. When the bucket is empty it returns false
+// and the time until the next token is available.
+func (l *bucketLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Refund returns a token taken by Allow for a send that was rejected
+// elsewhere.
+func (l *bucketLimiter) Refund(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[key]; ok {
+		b.tokens = math.Min(l.burst, b.tokens+1)
+	}
+}
+
+// prune drops buckets that have been idle long enough to be full again.
+func (l *bucketLimiter) prune(now time.Time) {
+	idle := time.Duration(l.burst / l.rate * float64(time.Second))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > idle {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// MuteView is an active automatic mute as shown to admins.
+type MuteView struct {
+	UserID  string `json:"user_id"`
+	Until   int64  `json:"until"`
+	Strikes int    `json:"strikes"`
+}
+
+// floodGuard enforces FloodConfig for message sends.
+type floodGuard struct {
+	cfg       FloodConfig
+	users     *bucketLimiter
+	channels  *bucketLimiter
+	bundles   *bucketLimiter // nil when bundle fetches are unlimited
+	mu        sync.Mutex
+	strikes   map[string][]time.Time
+	mutes     map[string]time.Time
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+func newFloodGuard(cfg FloodConfig) *floodGuard {
+	g := &floodGuard{
+		cfg:      cfg,
+		users:    newBucketLimiter(cfg.UserRate, cfg.UserBurst),
+		channels: newBucketLimiter(cfg.ChannelRate, cfg.ChannelBurst),
+		strikes:  make(map[string][]time.Time),
+		mutes:    make(map[string]time.Time),
+		now:      time.Now,
+	}
+	if cfg.BundleRate > 0 && cfg.BundleBurst > 0 {
+		g.bundles = newBucketLimiter(cfg.BundleRate, cfg.BundleBurst)
+	}
+	return g
+}
+
+// Check reports whether userID may send one message to channelID now. On
+// rejection it returns errMuted or errRateLimited and a retry hint. Only the
+// user's own bucket counts towards a mute: a busy channel slows everyone in
+// it down without punishing them, and costs them no user tokens.
+func (g *floodGuard) Check(userID, channelID string) (time.Duration, error) {
+	if wait, err := g.CheckUser(userID); err != nil {
+		return wait, err
+	}
+	return g.CheckChannel(userID, channelID)
+}
+
+// CheckUser takes a token from userID's own bucket. Send paths call it
+// before resolving or authorizing the channel, so sends to channels that
+// do not exist or are forbidden still cost the sender and cannot hammer
+// the database for free.
+func (g *floodGuard) CheckUser(userID string) (time.Duration, error) {
+	now := g.now()
+	g.maybePrune(now)
+
+	g.mu.Lock()
+	if until, ok := g.mutes[userID]; ok {
+		if now.Before(until) {
+			g.mu.Unlock()
+			return until.Sub(now), errMuted
+		}
+		delete(g.mutes, userID)
+	}
+	g.mu.Unlock()
+
+	ok, wait := g.users.Allow(userID, now)
+	if !ok {
+		if g.strike(userID, now) {
+			return g.cfg.MuteDuration, errMuted
+		}
+		return wait, errRateLimited
+	}
+	return 0, nil
+}
+
+// CheckChannel takes a token from channelID's bucket once CheckUser has
+// passed, giving userID's token back when the channel is busy.
+func (g *floodGuard) CheckChannel(userID, channelID string) (time.Duration, error) {
+	if ok, wait := g.channels.Allow(channelID, g.now()); !ok {
+		g.users.Refund(userID)
+		return wait, errRateLimited
+	}
+	return 0, nil
+}
+
+// CheckBundle reports whether userID may fetch targetID's prekey bundles
+// now. Every fetch hands out one-time prekeys, so without a limit one
+// member could drain another's pool and push every new session onto the
+// signed prekey alone.
+func (g *floodGuard) CheckBundle(userID, targetID string) (time.Duration, error) {
+	if g.bundles == nil {
+		return 0, nil
+	}
+	now := g.now()
+	g.maybePrune(now)
+	if ok, wait := g.bundles.Allow(userID+"\x00"+targetID, now); !ok {
+		return wait, errRateLimited
+	}
+	return 0, nil
+}
+
+// strike records a rejection and mutes the user once MuteStrikes is reached.
+func (g *floodGuard) strike(userID string, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	cutoff := now.Add(-g.cfg.StrikeWindow)
+	list := g.strikes[userID]
+	i := 0
+	for i < len(list) && list[i].Before(cutoff) {
+		i++
+	}
+	list = append(list[i:], now)
+	if len(list) < g.cfg.MuteStrikes {
+		g.strikes[userID] = list
+		return false
+	}
+	delete(g.strikes, userID)
+	g.mutes[userID] = now.Add(g.cfg.MuteDuration)
+	log.Printf("User %s muted for %s after %d rate limit violations", userID, g.cfg.MuteDuration, len(list))
+	return true
+}
+
+func (g *floodGuard) maybePrune(now time.Time) {
+	g.mu.Lock()
+	due := now.Sub(g.lastPrune) > time.Minute
+	if due {
+		g.lastPrune = now
+	}
+	g.mu.Unlock()
+	if due {
+		g.users.prune(now)
+		g.channels.prune(now)
+		if g.bundles != nil {
+			g.bundles.prune(now)
+		}
+	}
+}
+
+// Mutes returns the active automatic mutes ordered by expiry.
+func (g *floodGuard) Mutes() []MuteView {
+	now := g.now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	out := make([]MuteView, 0, len(g.mutes))
+	for userID, until := range g.mutes {
+		if now.Before(until) {
+			out = append(out, MuteView{UserID: userID, Until: until.Unix(), Strikes: g.cfg.MuteStrikes})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Until < out[j].Until })
+	return out
+}
+
+// Unmute lifts an automatic mute early.
+func (g *floodGuard) Unmute(userID string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.mutes[userID]
+	delete(g.mutes, userID)
+	delete(g.strikes, userID)
+	return ok
+}
+
+// ErrorFrame is the JSON body of a rejected HTTP request; over /ws the same
+// detail is sent in a protocol.Envelope.
+type ErrorFrame struct {
+	Error protocol.ErrorDetail `json:"error"`
+}
+
+func floodErrorDetail(err error, channelID string, retry time.Duration) protocol.ErrorDetail {
+	d := protocol.ErrorDetail{
+		Code:         "rate_limited",
+		Message:      "too many messages, slow down",
+		ChannelID:    channelID,
+		RetryAfterMs: retry.Milliseconds(),
+	}
+	if errors.Is(err, errMuted) {
+		d.Code = "muted"
+		d.Message = "temporarily muted for flooding"
+	}
+	return d
+}
+
+// sendErrorFrame queues an error frame on a single connection.
+func (c *Client) sendErrorFrame(detail protocol.ErrorDetail) {
+	c.sendFrame(&protocol.Envelope{Error: &detail})
+}
+
+// writeFloodError answers an HTTP send rejected by the flood guard.
+func writeFloodError(w http.ResponseWriter, err error, channelID string, retry time.Duration) {
+	secs := int64(math.Ceil(retry.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	_ = json.NewEncoder(w).Encode(ErrorFrame{Error: floodErrorDetail(err, channelID, retry)})
+}
+
+// MutesHandler lets admins list (GET) and lift (DELETE ?user_id=) automatic mutes.
+func (r *MessageRouter) MutesHandler(w http.ResponseWriter, req *http.Request) {
+	if _, err := r.authenticateAdmin(req); err != nil {
+		if errors.Is(err, errForbidden) {
+			http.Error(w, "admin access required", http.StatusForbidden)
+			return
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"mutes": r.flood.Mutes()})
+	case http.MethodDelete:
+		userID := req.URL.Query().Get("user_id")
+		if userID == "" {
+			http.Error(w, "missing user_id", http.StatusBadRequest)
+			return
+		}
+		if !r.flood.Unmute(userID) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
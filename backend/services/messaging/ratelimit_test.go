@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"lan-chat/protocol"
+)
+
+func newTestFloodGuard(clock *time.Time) *floodGuard {
+	g := newFloodGuard(FloodConfig{
+		UserRate:     1,
+		UserBurst:    2,
+		ChannelRate:  10,
+		ChannelBurst: 3,
+		MuteStrikes:  3,
+		StrikeWindow: time.Minute,
+		MuteDuration: 5 * time.Minute,
+	})
+	g.now = func() time.Time { return *clock }
+	return g
+}
+
+func TestFloodGuardPerUserBucket(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	g := newTestFloodGuard(&now)
+
+	for i := 0; i < 2; i++ {
+		if _, err := g.Check("u-1", "c-1"); err != nil {
+			t.Fatalf("send %d within burst rejected: %v", i, err)
+		}
+	}
+	retry, err := g.Check("u-1", "c-2")
+	if !errors.Is(err, errRateLimited) {
+		t.Fatalf("expected rate limit after burst, got %v", err)
+	}
+	if retry <= 0 || retry > time.Second {
+		t.Fatalf("unexpected retry hint %s", retry)
+	}
+
+	now = now.Add(time.Second)
+	if _, err := g.Check("u-1", "c-2"); err != nil {
+		t.Fatalf("expected token refill after 1s, got %v", err)
+	}
+}
+
+func TestFloodGuardPerChannelBucket(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	g := newTestFloodGuard(&now)
+
+	for _, u := range []string{"u-1", "u-2", "u-3"} {
+		if _, err := g.Check(u, "busy"); err != nil {
+			t.Fatalf("send by %s rejected: %v", u, err)
+		}
+	}
+	if _, err := g.Check("u-4", "busy"); !errors.Is(err, errRateLimited) {
+		t.Fatalf("expected channel limit, got %v", err)
+	}
+	if _, err := g.Check("u-4", "quiet"); err != nil {
+		t.Fatalf("other channel should be unaffected, got %v", err)
+	}
+}
+
+func TestFloodGuardBusyChannelDoesNotPunishBystanders(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	g := newTestFloodGuard(&now)
+	g.cfg.MuteStrikes = 2
+	g.channels = newBucketLimiter(10, 2)
+
+	// The spammer drains the shared channel bucket and keeps going.
+	var spam error
+	for i := 0; i < 10; i++ {
+		_, spam = g.Check("spammer", "shared")
+	}
+	if !errors.Is(spam, errMuted) {
+		t.Fatalf("expected spammer to be muted, got %v", spam)
+	}
+
+	// The innocent user is held back by the full channel but never struck.
+	for i := 0; i < 10; i++ {
+		if _, err := g.Check("innocent", "shared"); !errors.Is(err, errRateLimited) {
+			t.Fatalf("attempt %d: expected channel rate limit, got %v", i, err)
+		}
+	}
+	for _, m := range g.Mutes() {
+		if m.UserID == "innocent" {
+			t.Fatalf("innocent user muted by channel limit: %+v", g.Mutes())
+		}
+	}
+
+	// Rejected attempts cost no user tokens: the full burst is still there
+	// in a channel with room.
+	for i := 0; i < 2; i++ {
+		if _, err := g.Check("innocent", "other"); err != nil {
+			t.Fatalf("send %d after channel rejections: %v", i, err)
+		}
+	}
+}
+
+func TestFloodGuardMutesRepeatOffenders(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	g := newTestFloodGuard(&now)
+
+	var err error
+	for i := 0; i < 5; i++ {
+		_, err = g.Check("spammer", "c-1")
+	}
+	if !errors.Is(err, errMuted) {
+		t.Fatalf("expected mute after repeated violations, got %v", err)
+	}
+	mutes := g.Mutes()
+	if len(mutes) != 1 || mutes[0].UserID != "spammer" {
+		t.Fatalf("expected spammer in mute list, got %+v", mutes)
+	}
+
+	now = now.Add(time.Minute)
+	if _, err := g.Check("spammer", "c-1"); !errors.Is(err, errMuted) {
+		t.Fatalf("expected mute to persist, got %v", err)
+	}
+	now = now.Add(5 * time.Minute)
+	if _, err := g.Check("spammer", "c-1"); err != nil {
+		t.Fatalf("expected mute to expire, got %v", err)
+	}
+}
+
+func TestMutesHandlerAdminOnly(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	r.flood.mutes["u-bob"] = time.Now().Add(time.Minute)
+
+	memberReq := httptest.NewRequest(http.MethodGet, "/moderation/mutes", nil)
+	memberReq.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, "alice"))
+	memberRec := httptest.NewRecorder()
+	r.MutesHandler(memberRec, memberReq)
+	if memberRec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for member, got %d", memberRec.Code)
+	}
+
+	listReq := httptest.NewRequest(http.MethodGet, "/moderation/mutes", nil)
+	listReq.Header.Set("Authorization", "Bearer "+adminTokenForTestUser(t, "alice"))
+	listRec := httptest.NewRecorder()
+	r.MutesHandler(listRec, listReq)
+	var payload struct {
+		Mutes []MuteView `json:"mutes"`
+	}
+	if err := json.Unmarshal(listRec.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("decode mutes: %v", err)
+	}
+	if len(payload.Mutes) != 1 || payload.Mutes[0].UserID != "u-bob" {
+		t.Fatalf("unexpected mutes %+v", payload.Mutes)
+	}
+
+	delReq := httptest.NewRequest(http.MethodDelete, "/moderation/mutes?user_id=u-bob", nil)
+	delReq.Header.Set("Authorization", "Bearer "+adminTokenForTestUser(t, "alice"))
+	delRec := httptest.NewRecorder()
+	r.MutesHandler(delRec, delReq)
+	if delRec.Code != http.StatusOK {
+		t.Fatalf("expected 200 on unmute, got %d", delRec.Code)
+	}
+	if _, err := r.flood.Check("u-bob", "general"); err != nil {
+		t.Fatalf("expected unmuted user to send, got %v", err)
+	}
+}
+
+func TestWriteFloodErrorSetsRetryAfter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeFloodError(rec, errRateLimited, "general", 1500*time.Millisecond)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Fatalf("expected Retry-After 2, got %q", got)
+	}
+	var frame ErrorFrame
+	if err := json.Unmarshal(rec.Body.Bytes(), &frame); err != nil || frame.Error.Code != "rate_limited" {
+		t.Fatalf("unexpected error frame %s (err=%v)", rec.Body.String(), err)
+	}
+}
+
+func TestSendToForbiddenChannelsIsRateLimited(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	now := time.Unix(1_700_000_000, 0)
+	r.flood = newTestFloodGuard(&now)
+
+	send := func(channelID string) int {
+		t.Helper()
+		body, _ := json.Marshal(protocol.SendMessageRequest{ChannelID: channelID, Type: protocol.MessageTypeText, Content: []byte("hi")})
+		req := httptest.NewRequest(http.MethodPost, "/send", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, "charlie"))
+		rec := httptest.NewRecorder()
+		r.SendHandler(rec, req)
+		return rec.Code
+	}
+	// Lookups of channels that do not exist or are off limits spend the
+	// sender's tokens like real sends.
+	if code := send("no-such-channel"); code != http.StatusNotFound {
+		t.Fatalf("unknown channel: expected 404, got %d", code)
+	}
+	if code := send("priv-1"); code != http.StatusForbidden {
+		t.Fatalf("foreign private channel: expected 403, got %d", code)
+	}
+	if code := send("no-such-channel"); code != http.StatusTooManyRequests {
+		t.Fatalf("after the burst: expected 429, got %d", code)
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const retentionSchema = `
+	CREATE TABLE IF NOT EXISTS retention_policies (
+		scope TEXT NOT NULL,
+		scope_id TEXT NOT NULL DEFAULT '',
+		retention_days INTEGER NOT NULL,
+		updated_by TEXT,
+		updated_at BIGINT,
+		PRIMARY KEY (scope, scope_id)
+	);
+	CREATE TABLE IF NOT EXISTS legal_holds (
+		channel_id TEXT PRIMARY KEY,
+		reason TEXT,
+		placed_by TEXT,
+		placed_at BIGINT
+	);
+`
+
+const (
+	retentionScopeGlobal     = "global"
+	retentionScopeDepartment = "department"
+	retentionScopeChannel    = "channel"
+
+	// retentionAuditActor is the audit actor for scheduled purge runs.
+	retentionAuditActor = "system:retention"
+)
+
+// RetentionPolicy keeps messages for RetentionDays. The most specific
+// policy wins (channel, then department, then global); 0 keeps forever.
+type RetentionPolicy struct {
+	Scope         string `json:"scope"`
+	ScopeID       string `json:"scope_id,omitempty"`
+	RetentionDays int    `json:"retention_days"`
+	UpdatedBy     string `json:"updated_by,omitempty"`
+	UpdatedAt     int64  `json:"updated_at"`
+}
+
+// LegalHold exempts a channel from purging regardless of policy.
+type LegalHold struct {
+	ChannelID string `json:"channel_id"`
+	Reason    string `json:"reason"`
+	PlacedBy  string `json:"placed_by,omitempty"`
+	PlacedAt  int64  `json:"placed_at"`
+}
+
+type PlaceLegalHoldRequest struct {
+	ChannelID string `json:"channel_id"`
+	Reason    string `json:"reason"`
+}
+
+// PurgeReport summarises one purge run.
+type PurgeReport struct {
+	StartedAt      int64            `json:"started_at"`
+	ChannelsPurged int              `json:"channels_purged"`
+	Deleted        int64            `json:"deleted"`
+	PerChannel     map[string]int64 `json:"per_channel,omitempty"`
+	Held           []string         `json:"held,omitempty"`
+	// Failed maps channels whose purge failed, and were left as they were,
+	// to the error.
+	Failed map[string]string `json:"failed,omitempty"`
+	// AuditError is set when the purge ran but could not be audited.
+	AuditError string `json:"audit_error,omitempty"`
+}
+
+type retentionKey struct{ scope, id string }
+
+// effectiveRetentionDays resolves the policy for a channel. ok is false when
+// no policy applies.
+func effectiveRetentionDays(policies map[retentionKey]int, channelID, departmentID string) (days int, ok bool) {
+	if d, ok := policies[retentionKey{retentionScopeChannel, channelID}]; ok {
+		return d, true
+	}
+	if departmentID != "" {
+		if d, ok := policies[retentionKey{retentionScopeDepartment, departmentID}]; ok {
+			return d, true
+		}
+	}
+	d, ok := policies[retentionKey{retentionScopeGlobal, ""}]
+	return d, ok
+}
+
+func (r *MessageRouter) listRetentionPolicies() ([]RetentionPolicy, error) {
+	rows, err := r.db.Query(r.bind(`
+		SELECT scope, scope_id, retention_days, COALESCE(updated_by, ''), COALESCE(updated_at, 0)
+		FROM retention_policies ORDER BY scope ASC, scope_id ASC`))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]RetentionPolicy, 0)
+	for rows.Next() {
+		var p RetentionPolicy
+		if err := rows.Scan(&p.Scope, &p.ScopeID, &p.RetentionDays, &p.UpdatedBy, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+func (r *MessageRouter) listLegalHolds() ([]LegalHold, error) {
+	rows, err := r.db.Query(r.bind(`
+		SELECT channel_id, COALESCE(reason, ''), COALESCE(placed_by, ''), COALESCE(placed_at, 0)
+		FROM legal_holds ORDER BY placed_at ASC`))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]LegalHold, 0)
+	for rows.Next() {
+		var h LegalHold
+		if err := rows.Scan(&h.ChannelID, &h.Reason, &h.PlacedBy, &h.PlacedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
+
+// PurgeExpiredMessages deletes messages older than each channel's effective
+// retention, skipping channels under legal hold, and audits the run as actorID.
+// A channel that fails to purge is listed in the report's Failed; an error
+// is only returned when the run could not start.
+func (r *MessageRouter) PurgeExpiredMessages(actorID string, now time.Time) (*PurgeReport, error) {
+	report := &PurgeReport{StartedAt: now.Unix(), PerChannel: make(map[string]int64)}
+
+	list, err := r.listRetentionPolicies()
+	if err != nil {
+		return nil, err
+	}
+	policies := make(map[retentionKey]int, len(list))
+	for _, p := range list {
+		policies[retentionKey{p.Scope, p.ScopeID}] = p.RetentionDays
+	}
+
+	holdList, err := r.listLegalHolds()
+	if err != nil {
+		return nil, err
+	}
+	holds := make(map[string]bool, len(holdList))
+	for _, h := range holdList {
+		holds[h.ChannelID] = true
+	}
+
+	type channelRef struct{ id, department string }
+	rows, err := r.db.Query(r.bind(`SELECT id, COALESCE(department_id, '') FROM channels`))
+	if err != nil {
+		return nil, err
+	}
+	var channels []channelRef
+	for rows.Next() {
+		var c channelRef
+		if err := rows.Scan(&c.id, &c.department); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		channels = append(channels, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, c := range channels {
+		days, ok := effectiveRetentionDays(policies, c.id, c.department)
+		if !ok || days <= 0 {
+			continue
+		}
+		if holds[c.id] {
+			report.Held = append(report.Held, c.id)
+			continue
+		}
+		cutoff := now.Add(-time.Duration(days) * 24 * time.Hour).UnixMilli()
+		n, err := r.purgeChannel(c.id, cutoff)
+		if err != nil {
+			// One broken channel must not keep the others, or the audit
+			// record of the run, from happening.
+			if report.Failed == nil {
+				report.Failed = make(map[string]string)
+			}
+			report.Failed[c.id] = err.Error()
+			continue
+		}
+		if n > 0 {
+			report.PerChannel[c.id] = n
+			report.Deleted += n
+			report.ChannelsPurged++
+		}
+	}
+
+	if err := r.audit.LogJSON(actorID, "retention.purge", "messages", report); err != nil {
+		report.AuditError = err.Error()
+	}
+	return report, nil
+}
+
+// purgeChannel deletes the messages of channelID older than cutoff (Unix
+// ms) together with their attachment records and per-device payloads, and
+// returns how many messages went.
+func (r *MessageRouter) purgeChannel(channelID string, cutoff int64) (int64, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(r.bind(`DELETE FROM messages WHERE channel_id = ? AND timestamp < ?`), channelID, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(r.bind(`DELETE FROM message_attachments WHERE channel_id = ? AND created_at < ?`), channelID, cutoff); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(r.bind(`DELETE FROM message_device_payloads WHERE channel_id = ? AND created_at < ?`), channelID, cutoff); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// auditChange audits an admin change that is already stored. The change
+// stands either way; when the audit fails, resp carries audit_error so the
+// admin knows to record it by hand.
+func (r *MessageRouter) auditChange(resp map[string]interface{}, adminID, action, target string, details interface{}) {
+	if err := r.audit.LogJSON(adminID, action, target, details); err != nil {
+		log.Printf("%s by %s not audited: %v", action, adminID, err)
+		resp["audit_error"] = err.Error()
+	}
+}
+
+// runRetentionPurger purges expired messages now and then every interval.
+func (r *MessageRouter) runRetentionPurger(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		report, err := r.PurgeExpiredMessages(retentionAuditActor, time.Now())
+		if err != nil {
+			log.Printf("retention purge failed: %v", err)
+		} else {
+			if report.Deleted > 0 {
+				log.Printf("retention purge deleted %d messages in %d channels", report.Deleted, report.ChannelsPurged)
+			}
+			for channelID, msg := range report.Failed {
+				log.Printf("retention purge of channel %s failed: %s", channelID, msg)
+			}
+			if report.AuditError != "" {
+				log.Printf("retention purge not audited: %s", report.AuditError)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+func validateRetentionPolicy(p *RetentionPolicy) error {
+	p.Scope = strings.TrimSpace(p.Scope)
+	p.ScopeID = strings.TrimSpace(p.ScopeID)
+	switch p.Scope {
+	case retentionScopeGlobal:
+		if p.ScopeID != "" {
+			return errors.New("global policy takes no scope_id")
+		}
+	case retentionScopeDepartment, retentionScopeChannel:
+		if p.ScopeID == "" {
+			return errors.New("missing scope_id")
+		}
+	default:
+		return errors.New("scope must be global, department or channel")
+	}
+	if p.RetentionDays < 0 || p.RetentionDays > 36500 {
+		return errors.New("retention_days must be between 0 and 36500")
+	}
+	return nil
+}
+
+// RetentionPoliciesHandler lets admins list (GET), set (PUT) and remove
+// (DELETE ?scope=&scope_id=) retention policies.
+func (r *MessageRouter) RetentionPoliciesHandler(w http.ResponseWriter, req *http.Request) {
+	adminID, err := r.authenticateAdmin(req)
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			http.Error(w, "admin access required", http.StatusForbidden)
+			return
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		policies, err := r.listRetentionPolicies()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"policies": policies})
+
+	case http.MethodPut:
+		var p RetentionPolicy
+		if err := json.NewDecoder(req.Body).Decode(&p); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := validateRetentionPolicy(&p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if p.Scope == retentionScopeChannel {
+			if _, err := r.getChannelType(p.ScopeID); err != nil {
+				http.Error(w, "channel not found", http.StatusNotFound)
+				return
+			}
+		}
+		p.UpdatedBy = adminID
+		p.UpdatedAt = time.Now().Unix()
+		_, err := r.db.Exec(r.bind(`
+			INSERT INTO retention_policies (scope, scope_id, retention_days, updated_by, updated_at)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (scope, scope_id) DO UPDATE SET
+				retention_days = excluded.retention_days,
+				updated_by = excluded.updated_by,
+				updated_at = excluded.updated_at`),
+			p.Scope, p.ScopeID, p.RetentionDays, p.UpdatedBy, p.UpdatedAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp := map[string]interface{}{"policy": p}
+		r.auditChange(resp, adminID, "retention.policy.set", "retention_policies", p)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+
+	case http.MethodDelete:
+		scope := req.URL.Query().Get("scope")
+		scopeID := req.URL.Query().Get("scope_id")
+		res, err := r.db.Exec(r.bind(`DELETE FROM retention_policies WHERE scope = ? AND scope_id = ?`), scope, scopeID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		resp := map[string]interface{}{"ok": true}
+		r.auditChange(resp, adminID, "retention.policy.delete", "retention_policies",
+			map[string]string{"scope": scope, "scope_id": scopeID})
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// LegalHoldsHandler lets admins list (GET), place (POST) and release
+// (DELETE ?channel_id=) legal holds.
+func (r *MessageRouter) LegalHoldsHandler(w http.ResponseWriter, req *http.Request) {
+	adminID, err := r.authenticateAdmin(req)
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			http.Error(w, "admin access required", http.StatusForbidden)
+			return
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		holds, err := r.listLegalHolds()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"holds": holds})
+
+	case http.MethodPost:
+		var body PlaceLegalHoldRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		body.Reason = strings.TrimSpace(body.Reason)
+		if body.Reason == "" || len(body.Reason) > 500 {
+			http.Error(w, "reason is required (max 500 chars)", http.StatusBadRequest)
+			return
+		}
+		if _, err := r.getChannelType(body.ChannelID); err != nil {
+			http.Error(w, "channel not found", http.StatusNotFound)
+			return
+		}
+		hold := LegalHold{ChannelID: body.ChannelID, Reason: body.Reason, PlacedBy: adminID, PlacedAt: time.Now().Unix()}
+		_, err := r.db.Exec(r.bind(`
+			INSERT INTO legal_holds (channel_id, reason, placed_by, placed_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT (channel_id) DO UPDATE SET reason = excluded.reason`),
+			hold.ChannelID, hold.Reason, hold.PlacedBy, hold.PlacedAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp := map[string]interface{}{"hold": hold}
+		r.auditChange(resp, adminID, "legal_hold.place", "channel:"+hold.ChannelID, hold)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(resp)
+
+	case http.MethodDelete:
+		channelID := req.URL.Query().Get("channel_id")
+		res, err := r.db.Exec(r.bind(`DELETE FROM legal_holds WHERE channel_id = ?`), channelID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		resp := map[string]interface{}{"ok": true}
+		r.auditChange(resp, adminID, "legal_hold.release", "channel:"+channelID, map[string]string{"channel_id": channelID})
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// RetentionPurgeHandler lets admins trigger a purge run immediately.
+func (r *MessageRouter) RetentionPurgeHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	adminID, err := r.authenticateAdmin(req)
+	if err != nil {
+		if errors.Is(err, errForbidden) {
+			http.Error(w, "admin access required", http.StatusForbidden)
+			return
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	report, err := r.PurgeExpiredMessages(adminID, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(report)
+}
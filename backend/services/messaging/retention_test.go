@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// auditRecorder stands in for the audit service's POST /log.
+type auditRecorder struct {
+	mu     sync.Mutex
+	events []auditEvent
+}
+
+func newAuditRecorder(t *testing.T, r *MessageRouter) *auditRecorder {
+	t.Helper()
+	rec := &auditRecorder{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var ev auditEvent
+		_ = json.NewDecoder(req.Body).Decode(&ev)
+		rec.mu.Lock()
+		rec.events = append(rec.events, ev)
+		rec.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(srv.Close)
+	r.audit = newAuditClient(srv.URL)
+	return rec
+}
+
+func (a *auditRecorder) actions() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make([]string, 0, len(a.events))
+	for _, ev := range a.events {
+		out = append(out, ev.Action)
+	}
+	return out
+}
+
+func adminRetentionRequest(t *testing.T, h http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+adminTokenForTestUser(t, "alice"))
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
+
+func insertAgedMessage(t *testing.T, r *MessageRouter, id, channelID string, age time.Duration, now time.Time) {
+	t.Helper()
+	_, err := r.db.Exec(`INSERT INTO messages (id, channel_id, sender_id, timestamp, type, content, nonce, signature)
+		VALUES (?, ?, 'u-alice', ?, 1, 'x', '', '')`, id, channelID, now.Add(-age).UnixMilli())
+	if err != nil {
+		t.Fatalf("insert message: %v", err)
+	}
+}
+
+func messageIDs(t *testing.T, r *MessageRouter) map[string]bool {
+	t.Helper()
+	rows, err := r.db.Query(`SELECT id FROM messages`)
+	if err != nil {
+		t.Fatalf("query messages: %v", err)
+	}
+	defer rows.Close()
+	ids := map[string]bool{}
+	for rows.Next() {
+		var id string
+		_ = rows.Scan(&id)
+		ids[id] = true
+	}
+	return ids
+}
+
+func TestEffectiveRetentionDaysPrecedence(t *testing.T) {
+	policies := map[retentionKey]int{
+		{retentionScopeGlobal, ""}:           90,
+		{retentionScopeDepartment, "eng"}:    30,
+		{retentionScopeChannel, "incidents"}: 0,
+	}
+	cases := []struct {
+		channel, dept string
+		want          int
+	}{
+		{"random", "", 90},
+		{"random", "sales", 90},
+		{"builds", "eng", 30},
+		{"incidents", "eng", 0},
+	}
+	for _, c := range cases {
+		if got, ok := effectiveRetentionDays(policies, c.channel, c.dept); !ok || got != c.want {
+			t.Fatalf("%s/%s: expected %d, got %d (ok=%v)", c.channel, c.dept, c.want, got, ok)
+		}
+	}
+	if _, ok := effectiveRetentionDays(map[retentionKey]int{}, "random", ""); ok {
+		t.Fatalf("expected no policy without any configured")
+	}
+}
+
+func TestPurgeHonoursPoliciesAndLegalHold(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	audit := newAuditRecorder(t, r)
+	now := time.Now()
+
+	if _, err := r.db.Exec(`INSERT INTO channels (id, name, type, department_id) VALUES
+		('eng-builds', 'Builds', 'public', 'eng'),
+		('eng-incident', 'Incident', 'private', 'eng')`); err != nil {
+		t.Fatalf("insert channels: %v", err)
+	}
+	_, _ = r.db.Exec(`DELETE FROM messages`)
+	insertAgedMessage(t, r, "general-old", "general", 100*24*time.Hour, now)
+	insertAgedMessage(t, r, "general-new", "general", 10*24*time.Hour, now)
+	insertAgedMessage(t, r, "builds-old", "eng-builds", 40*24*time.Hour, now)
+	insertAgedMessage(t, r, "builds-new", "eng-builds", 20*24*time.Hour, now)
+	insertAgedMessage(t, r, "incident-old", "eng-incident", 400*24*time.Hour, now)
+
+	for _, body := range []string{
+		`{"scope":"global","retention_days":90}`,
+		`{"scope":"department","scope_id":"eng","retention_days":30}`,
+	} {
+		if rec := adminRetentionRequest(t, r.RetentionPoliciesHandler, http.MethodPut, "/retention/policies", body); rec.Code != http.StatusOK {
+			t.Fatalf("set policy: %d %s", rec.Code, rec.Body.String())
+		}
+	}
+	hold := `{"channel_id":"eng-incident","reason":"investigation 2026-17"}`
+	if rec := adminRetentionRequest(t, r.LegalHoldsHandler, http.MethodPost, "/retention/holds", hold); rec.Code != http.StatusCreated {
+		t.Fatalf("place hold: %d %s", rec.Code, rec.Body.String())
+	}
+
+	report, err := r.PurgeExpiredMessages(retentionAuditActor, now)
+	if err != nil {
+		t.Fatalf("purge: %v", err)
+	}
+	if report.Deleted != 2 || report.PerChannel["general"] != 1 || report.PerChannel["eng-builds"] != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if len(report.Held) != 1 || report.Held[0] != "eng-incident" {
+		t.Fatalf("expected held channel in report, got %+v", report.Held)
+	}
+	ids := messageIDs(t, r)
+	for _, id := range []string{"general-new", "builds-new", "incident-old"} {
+		if !ids[id] {
+			t.Fatalf("%s should have been kept", id)
+		}
+	}
+	for _, id := range []string{"general-old", "builds-old"} {
+		if ids[id] {
+			t.Fatalf("%s should have been purged", id)
+		}
+	}
+
+	if rec := adminRetentionRequest(t, r.LegalHoldsHandler, http.MethodDelete, "/retention/holds?channel_id=eng-incident", ""); rec.Code != http.StatusOK {
+		t.Fatalf("release hold: %d", rec.Code)
+	}
+	if _, err := r.PurgeExpiredMessages(retentionAuditActor, now); err != nil {
+		t.Fatalf("purge: %v", err)
+	}
+	if messageIDs(t, r)["incident-old"] {
+		t.Fatalf("released channel should be purged")
+	}
+
+	want := []string{"retention.policy.set", "retention.policy.set", "legal_hold.place", "retention.purge", "legal_hold.release", "retention.purge"}
+	if got := audit.actions(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("unexpected audit trail %v", got)
+	}
+}
+
+func TestPurgeReportsStorageAndAuditFailures(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	audit := newAuditRecorder(t, r)
+	now := time.Now()
+	_, _ = r.db.Exec(`DELETE FROM messages`)
+	insertAgedMessage(t, r, "general-old", "general", 100*24*time.Hour, now)
+	insertAgedMessage(t, r, "priv-old", "priv-1", 100*24*time.Hour, now)
+	if _, err := r.db.Exec(`INSERT INTO retention_policies (scope, scope_id, retention_days, updated_by, updated_at) VALUES ('global', '', 30, 'u-alice', 0)`); err != nil {
+		t.Fatalf("insert policy: %v", err)
+	}
+
+	// A channel whose delete fails is left untouched and reported; the
+	// other channels are still purged and the run is still audited.
+	if _, err := r.db.Exec(`CREATE TRIGGER keep_general BEFORE DELETE ON messages
+		WHEN old.channel_id = 'general' BEGIN SELECT RAISE(ABORT, 'general is stuck'); END`); err != nil {
+		t.Fatalf("create trigger: %v", err)
+	}
+	report, err := r.PurgeExpiredMessages(retentionAuditActor, now)
+	if err != nil {
+		t.Fatalf("purge: %v", err)
+	}
+	ids := messageIDs(t, r)
+	if !ids["general-old"] || ids["priv-old"] {
+		t.Fatalf("expected only the failing channel to keep its messages, got %v", ids)
+	}
+	if report.Deleted != 1 || !strings.Contains(report.Failed["general"], "general is stuck") {
+		t.Fatalf("expected the failed channel in the report, got %+v", report)
+	}
+	if got := audit.actions(); len(got) != 1 || got[0] != "retention.purge" {
+		t.Fatalf("expected the partial run to be audited, got %v", got)
+	}
+	if _, err := r.db.Exec(`DROP TRIGGER keep_general`); err != nil {
+		t.Fatalf("drop trigger: %v", err)
+	}
+
+	// A purge that cannot be audited still runs and says so.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	r.audit = newAuditClient(srv.URL)
+	report, err = r.PurgeExpiredMessages(retentionAuditActor, now)
+	if err != nil {
+		t.Fatalf("purge: %v", err)
+	}
+	if report.Deleted != 1 || report.AuditError == "" {
+		t.Fatalf("expected purge with audit error, got %+v", report)
+	}
+
+	// So do policy and legal hold changes.
+	rec := adminRetentionRequest(t, r.RetentionPoliciesHandler, http.MethodPut, "/retention/policies", `{"scope":"global","retention_days":60}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"audit_error"`) {
+		t.Fatalf("unaudited policy change: %d %s", rec.Code, rec.Body.String())
+	}
+	rec = adminRetentionRequest(t, r.LegalHoldsHandler, http.MethodPost, "/retention/holds", `{"channel_id":"general","reason":"case 12"}`)
+	if rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), `"audit_error"`) {
+		t.Fatalf("unaudited legal hold: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRetentionPoliciesValidationAndAccess(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	newAuditRecorder(t, r)
+
+	memberReq := httptest.NewRequest(http.MethodGet, "/retention/policies", nil)
+	memberReq.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, "alice"))
+	memberRec := httptest.NewRecorder()
+	r.RetentionPoliciesHandler(memberRec, memberReq)
+	if memberRec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for member, got %d", memberRec.Code)
+	}
+
+	for _, body := range []string{
+		`{"scope":"team","retention_days":5}`,
+		`{"scope":"global","scope_id":"x","retention_days":5}`,
+		`{"scope":"channel","retention_days":5}`,
+		`{"scope":"global","retention_days":-1}`,
+	} {
+		if rec := adminRetentionRequest(t, r.RetentionPoliciesHandler, http.MethodPut, "/retention/policies", body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %d", body, rec.Code)
+		}
+	}
+	if rec := adminRetentionRequest(t, r.RetentionPoliciesHandler, http.MethodPut, "/retention/policies",
+		`{"scope":"channel","scope_id":"missing","retention_days":5}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown channel, got %d", rec.Code)
+	}
+	if rec := adminRetentionRequest(t, r.LegalHoldsHandler, http.MethodPost, "/retention/holds",
+		`{"channel_id":"general"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for hold without reason, got %d", rec.Code)
+	}
+}
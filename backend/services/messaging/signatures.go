@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"lan-chat/protocol"
+
+	"github.com/google/uuid"
+)
+
+// devices mirrors the admin-api table so device keys can be registered when
+// messaging runs on its own database; in the shared platform.db the admin
+// schema already exists and admins deleting a device revokes its key.
+const signatureSchema = `
+	CREATE TABLE IF NOT EXISTS devices (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		device_name TEXT NOT NULL,
+		fingerprint TEXT UNIQUE NOT NULL,
+		last_seen BIGINT,
+		created_at BIGINT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS device_signing_keys (
+		device_id TEXT PRIMARY KEY,
+		algorithm TEXT NOT NULL,
+		public_key TEXT NOT NULL,
+		created_at BIGINT NOT NULL
+	);
+`
+
+var (
+	errSignatureRequired = errors.New("message must be signed by a registered device")
+	errSignatureInvalid  = errors.New("message signature is invalid")
+	errDeviceLimit       = errors.New("device limit reached, remove a device first")
+)
+
+// Signature policies for user-sent messages.
+const (
+	signaturePolicyOff      = "off"      // never verify
+	signaturePolicyOptional = "optional" // verify signed messages, accept unsigned
+	signaturePolicyRequired = "required" // reject unsigned messages
+)
+
+// SignaturePolicy controls how SaveMessage treats Signature.
+type SignaturePolicy struct {
+	Mode    string
+	MaxSkew time.Duration // allowed distance between signed and server time
+	// MaxDevices caps the devices, and so signing keys, one user may
+	// register; 0 means no cap.
+	MaxDevices int
+}
+
+func signaturePolicyFromEnv() SignaturePolicy {
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv("MESSAGING_SIGNATURE_POLICY")))
+	switch mode {
+	case signaturePolicyOff, signaturePolicyRequired:
+	default:
+		mode = signaturePolicyOptional
+	}
+	return SignaturePolicy{
+		Mode:       mode,
+		MaxSkew:    envDuration("MESSAGING_SIGNATURE_MAX_SKEW", 5*time.Minute),
+		MaxDevices: envInt("MESSAGING_MAX_DEVICES_PER_USER", 20),
+	}
+}
+
+// DeviceKey is a registered device signing key.
+type DeviceKey struct {
+	DeviceID    string `json:"device_id"`
+	UserID      string `json:"user_id"`
+	DeviceName  string `json:"device_name"`
+	Fingerprint string `json:"fingerprint"`
+	Algorithm   string `json:"algorithm"`
+	PublicKey   string `json:"public_key"` // base64
+	CreatedAt   int64  `json:"created_at"`
+}
+
+type RegisterDeviceKeyRequest struct {
+	DeviceName string `json:"device_name"`
+	PublicKey  string `json:"public_key"` // base64 Ed25519 public key
+}
+
+// deviceSigningKey returns the key of deviceID if it belongs to userID and
+// the device has not been removed.
+func (r *MessageRouter) deviceSigningKey(deviceID, userID string) (ed25519.PublicKey, error) {
+	var encoded string
+	err := r.db.QueryRow(r.bind(`
+		SELECT k.public_key
+		FROM device_signing_keys k
+		JOIN devices d ON d.id = k.device_id
+		WHERE k.device_id = ? AND d.user_id = ? AND k.algorithm = 'ed25519'`), deviceID, userID).Scan(&encoded)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errSignatureInvalid
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// verifySignature applies the signature policy to a user-sent message. It
+// returns the timestamp to store: the signed one for verified messages so
+// recipients can re-verify, otherwise the server clock.
+func (r *MessageRouter) verifySignature(req protocol.SendMessageRequest, senderID, channelID string, now time.Time) (int64, string, error) {
+	if r.signatures.Mode == signaturePolicyOff {
+		return now.UnixMilli(), "", nil
+	}
+	if len(req.Signature) == 0 {
+		if r.signatures.Mode == signaturePolicyRequired {
+			// Bots authenticate with server-issued tokens and have no devices.
+			if _, err := r.botByUserID(senderID); err != nil {
+				return 0, "", errSignatureRequired
+			}
+		}
+		return now.UnixMilli(), "", nil
+	}
+	if req.DeviceID == "" || req.Timestamp == 0 {
+		return 0, "", errSignatureInvalid
+	}
+	skew := now.Sub(time.UnixMilli(req.Timestamp))
+	if skew > r.signatures.MaxSkew || -skew > r.signatures.MaxSkew {
+		return 0, "", errSignatureInvalid
+	}
+	key, err := r.deviceSigningKey(req.DeviceID, senderID)
+	if err != nil {
+		return 0, "", errSignatureInvalid
+	}
+	// The signature must cover the channel the message is stored in, so that
+	// recipients can verify it; a DM addressed by user ID must be opened
+	// (POST /dm) and signed with its dm_ channel ID.
+	if !protocol.VerifyMessageSignature(key, channelID, req.Content, req.Nonce, req.Timestamp, req.Signature) {
+		return 0, "", errSignatureInvalid
+	}
+	return req.Timestamp, req.DeviceID, nil
+}
+
+func signatureErrorDetail(err error, channelID string) protocol.ErrorDetail {
+	return protocol.ErrorDetail{Code: "invalid_signature", Message: err.Error(), ChannelID: channelID}
+}
+
+func isSignatureError(err error) bool {
+	return errors.Is(err, errSignatureRequired) || errors.Is(err, errSignatureInvalid)
+}
+
+func (r *MessageRouter) listDeviceKeys(userID string) ([]DeviceKey, error) {
+	rows, err := r.db.Query(r.bind(`
+		SELECT d.id, d.user_id, d.device_name, d.fingerprint, k.algorithm, k.public_key, k.created_at
+		FROM device_signing_keys k
+		JOIN devices d ON d.id = k.device_id
+		WHERE d.user_id = ?
+		ORDER BY k.created_at ASC`), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]DeviceKey, 0)
+	for rows.Next() {
+		var k DeviceKey
+		if err := rows.Scan(&k.DeviceID, &k.UserID, &k.DeviceName, &k.Fingerprint, &k.Algorithm, &k.PublicKey, &k.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, k)
+	}
+	return out, rows.Err()
+}
+
+// DeviceKeysHandler lets users register (POST) and remove (DELETE
+// ?device_id=) their device signing keys, and look up any user's keys
+// (GET ?user_id=) to verify messages client-side.
+func (r *MessageRouter) DeviceKeysHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := r.authenticate(req)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		target := req.URL.Query().Get("user_id")
+		if target == "" {
+			target = userID
+		}
+		keys, err := r.listDeviceKeys(target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"devices": keys})
+
+	case http.MethodPost:
+		var body RegisterDeviceKeyRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		body.DeviceName = strings.TrimSpace(body.DeviceName)
+		if body.DeviceName == "" || len(body.DeviceName) > 80 {
+			http.Error(w, "invalid device_name", http.StatusBadRequest)
+			return
+		}
+		pub, err := base64.StdEncoding.DecodeString(body.PublicKey)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			http.Error(w, "public_key must be a base64 Ed25519 key", http.StatusBadRequest)
+			return
+		}
+		sum := sha256.Sum256(pub)
+		key := DeviceKey{
+			DeviceID:    uuid.New().String(),
+			UserID:      userID,
+			DeviceName:  body.DeviceName,
+			Fingerprint: hex.EncodeToString(sum[:]),
+			Algorithm:   "ed25519",
+			PublicKey:   base64.StdEncoding.EncodeToString(pub),
+			CreatedAt:   time.Now().Unix(),
+		}
+		if err := r.registerDeviceKey(key); errors.Is(err, errDeviceLimit) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, "device key already registered or db error", http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"device": key})
+
+	case http.MethodDelete:
+		deviceID := req.URL.Query().Get("device_id")
+		tx, err := r.db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		res, err := tx.Exec(r.bind(`DELETE FROM devices WHERE id = ? AND user_id = ?`), deviceID, userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if _, err := tx.Exec(r.bind(`DELETE FROM device_signing_keys WHERE device_id = ?`), deviceID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := r.deletePreKeys(tx, userID, deviceID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		r.deleteDeviceFanOut(tx, deviceID)
+		if err := tx.Commit(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// registerDeviceKey adds a device with its signing key, or fails with
+// errDeviceLimit when the user already has MaxDevices.
+func (r *MessageRouter) registerDeviceKey(k DeviceKey) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(r.bind(`
+		INSERT INTO devices (id, user_id, device_name, fingerprint, last_seen, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`), k.DeviceID, k.UserID, k.DeviceName, k.Fingerprint, k.CreatedAt, k.CreatedAt)
+	if err != nil {
+		return err
+	}
+	// Counted after the insert, so the new device's own write is what
+	// concurrent registrations wait on.
+	var devices int
+	if err := tx.QueryRow(r.bind(`SELECT COUNT(*) FROM devices WHERE user_id = ?`), k.UserID).Scan(&devices); err != nil {
+		return err
+	}
+	if r.signatures.MaxDevices > 0 && devices > r.signatures.MaxDevices {
+		return errDeviceLimit
+	}
+	_, err = tx.Exec(r.bind(`
+		INSERT INTO device_signing_keys (device_id, algorithm, public_key, created_at)
+		VALUES (?, ?, ?, ?)`), k.DeviceID, k.Algorithm, k.PublicKey, k.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// touchDevice records activity for a device after a verified message.
+func (r *MessageRouter) touchDevice(deviceID string, at time.Time) {
+	if deviceID == "" {
+		return
+	}
+	if _, err := r.db.Exec(r.bind(`UPDATE devices SET last_seen = ? WHERE id = ?`), at.Unix(), deviceID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("failed to update last_seen for device %s: %v", deviceID, err)
+	}
+}
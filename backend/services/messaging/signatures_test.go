@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"lan-chat/protocol"
+)
+
+func registerTestDeviceKey(t *testing.T, r *MessageRouter, username string) (string, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	body, _ := json.Marshal(RegisterDeviceKeyRequest{DeviceName: "laptop", PublicKey: base64.StdEncoding.EncodeToString(pub)})
+	req := httptest.NewRequest(http.MethodPost, "/devices/keys", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, username))
+	rec := httptest.NewRecorder()
+	r.DeviceKeysHandler(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("register device key: %d %s", rec.Code, rec.Body.String())
+	}
+	var out struct {
+		Device DeviceKey `json:"device"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatalf("decode device: %v", err)
+	}
+	return out.Device.DeviceID, priv
+}
+
+func signedTestRequest(deviceID string, key ed25519.PrivateKey, channelID, text string, at time.Time) protocol.SendMessageRequest {
+	req := protocol.SendMessageRequest{
+		ChannelID: channelID,
+		Type:      protocol.MessageTypeText,
+		Content:   []byte(text),
+		Nonce:     []byte("nonce-1"),
+		Timestamp: at.UnixMilli(),
+	}
+	protocol.SignMessage(&req, deviceID, key)
+	return req
+}
+
+func TestSaveMessageVerifiesDeviceSignature(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	r.signatures = SignaturePolicy{Mode: signaturePolicyOptional, MaxSkew: time.Minute}
+	deviceID, key := registerTestDeviceKey(t, r, "alice")
+	now := time.Now()
+
+	valid := signedTestRequest(deviceID, key, "priv-1", "hello", now)
+	msg, err := r.SaveMessage(valid, "u-alice", "priv-1")
+	if err != nil {
+		t.Fatalf("valid signature rejected: %v", err)
+	}
+	if msg.DeviceID != deviceID || msg.Timestamp != valid.Timestamp {
+		t.Fatalf("expected signed device and timestamp to be stored, got %+v", msg)
+	}
+	history, err := r.store.ChannelHistory("priv-1", 10)
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	var stored *protocol.Message
+	for i := range history {
+		if history[i].ID == msg.ID {
+			stored = &history[i]
+		}
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	if stored == nil || !protocol.VerifyMessageSignature(pub, stored.ChannelID, stored.Content, stored.Nonce, stored.Timestamp, stored.Signature) {
+		t.Fatalf("stored message is not verifiable by recipients: %+v", stored)
+	}
+
+	tampered := signedTestRequest(deviceID, key, "priv-1", "hello", now)
+	tampered.Content = []byte("hell0")
+	otherChannel := signedTestRequest(deviceID, key, "general", "hello", now)
+	otherChannel.ChannelID = "priv-1"
+	// A DM addressed by user ID resolves to its dm_ channel, which is what
+	// the signature must cover.
+	dmTarget := signedTestRequest(deviceID, key, "u-bob", "hello", now)
+	stale := signedTestRequest(deviceID, key, "priv-1", "hello", now.Add(-2*time.Minute))
+	unknownDevice := signedTestRequest("no-such-device", key, "priv-1", "hello", now)
+	cases := []struct {
+		name   string
+		req    protocol.SendMessageRequest
+		sender string
+	}{
+		{"tampered content", tampered, "u-alice"},
+		{"replayed to another channel", otherChannel, "u-alice"},
+		{"signed over DM target instead of channel", dmTarget, "u-alice"},
+		{"outside skew", stale, "u-alice"},
+		{"unknown device", unknownDevice, "u-alice"},
+		{"someone else's device", valid, "u-bob"},
+	}
+	for _, c := range cases {
+		if _, err := r.SaveMessage(c.req, c.sender, "priv-1"); !errors.Is(err, errSignatureInvalid) {
+			t.Fatalf("%s: expected errSignatureInvalid, got %v", c.name, err)
+		}
+	}
+
+	unsigned := protocol.SendMessageRequest{Type: protocol.MessageTypeText, Content: []byte("plain")}
+	if _, err := r.SaveMessage(unsigned, "u-alice", "priv-1"); err != nil {
+		t.Fatalf("optional policy should accept unsigned messages: %v", err)
+	}
+	r.signatures.Mode = signaturePolicyRequired
+	if _, err := r.SaveMessage(unsigned, "u-alice", "priv-1"); !errors.Is(err, errSignatureRequired) {
+		t.Fatalf("required policy should reject unsigned messages, got %v", err)
+	}
+	if _, err := r.SaveMessage(signedTestRequest(deviceID, key, "priv-1", "again", time.Now()), "u-alice", "priv-1"); err != nil {
+		t.Fatalf("required policy should accept signed messages: %v", err)
+	}
+}
+
+func TestDeletedDeviceRevokesSigningKey(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	deviceID, key := registerTestDeviceKey(t, r, "alice")
+
+	list := httptest.NewRequest(http.MethodGet, "/devices/keys?user_id=u-alice", nil)
+	list.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, "bob"))
+	listRec := httptest.NewRecorder()
+	r.DeviceKeysHandler(listRec, list)
+	if listRec.Code != http.StatusOK || !strings.Contains(listRec.Body.String(), deviceID) {
+		t.Fatalf("expected alice's key to be listed, got %d %s", listRec.Code, listRec.Body.String())
+	}
+
+	del := httptest.NewRequest(http.MethodDelete, "/devices/keys?device_id="+deviceID, nil)
+	del.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, "bob"))
+	delRec := httptest.NewRecorder()
+	r.DeviceKeysHandler(delRec, del)
+	if delRec.Code != http.StatusNotFound {
+		t.Fatalf("expected other users not to remove the device, got %d", delRec.Code)
+	}
+
+	// Admin-api removes devices directly from the shared table.
+	if _, err := r.db.Exec(`DELETE FROM devices WHERE id = ?`, deviceID); err != nil {
+		t.Fatalf("delete device: %v", err)
+	}
+	if _, err := r.SaveMessage(signedTestRequest(deviceID, key, "priv-1", "hi", time.Now()), "u-alice", "priv-1"); !errors.Is(err, errSignatureInvalid) {
+		t.Fatalf("expected removed device's key to be rejected, got %v", err)
+	}
+}
+
+func TestDeviceKeysAreCappedPerUser(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	r.signatures.MaxDevices = 2
+	first, _ := registerTestDeviceKey(t, r, "alice")
+	registerTestDeviceKey(t, r, "alice")
+
+	register := func(username string) *httptest.ResponseRecorder {
+		pub, _, _ := ed25519.GenerateKey(rand.Reader)
+		body, _ := json.Marshal(RegisterDeviceKeyRequest{DeviceName: "phone", PublicKey: base64.StdEncoding.EncodeToString(pub)})
+		req := httptest.NewRequest(http.MethodPost, "/devices/keys", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, username))
+		rec := httptest.NewRecorder()
+		r.DeviceKeysHandler(rec, req)
+		return rec
+	}
+	if rec := register("alice"); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "device limit") {
+		t.Fatalf("third device: %d %s", rec.Code, rec.Body.String())
+	}
+	var devices int
+	if err := r.db.QueryRow(`SELECT COUNT(*) FROM devices WHERE user_id = 'u-alice'`).Scan(&devices); err != nil || devices != 2 {
+		t.Fatalf("refused device was stored: %d %v", devices, err)
+	}
+	// The cap is per user, and removing a device frees a slot.
+	if rec := register("bob"); rec.Code != http.StatusCreated {
+		t.Fatalf("another user's device: %d", rec.Code)
+	}
+	del := httptest.NewRequest(http.MethodDelete, "/devices/keys?device_id="+first, nil)
+	del.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, "alice"))
+	delRec := httptest.NewRecorder()
+	r.DeviceKeysHandler(delRec, del)
+	if delRec.Code != http.StatusOK {
+		t.Fatalf("remove device: %d", delRec.Code)
+	}
+	if rec := register("alice"); rec.Code != http.StatusCreated {
+		t.Fatalf("device after removing one: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestDeviceRemovalRollsBackWhenSigningKeyCannotBeDeleted(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	deviceID, _ := registerTestDeviceKey(t, r, "alice")
+	if _, err := r.db.Exec(`CREATE TRIGGER keep_signing_keys BEFORE DELETE ON device_signing_keys
+		BEGIN SELECT RAISE(ABORT, 'signing keys are stuck'); END`); err != nil {
+		t.Fatal(err)
+	}
+	del := httptest.NewRequest(http.MethodDelete, "/devices/keys?device_id="+deviceID, nil)
+	del.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, "alice"))
+	rec := httptest.NewRecorder()
+	r.DeviceKeysHandler(rec, del)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", rec.Code)
+	}
+	var devices int
+	if err := r.db.QueryRow(`SELECT COUNT(*) FROM devices WHERE id = ?`, deviceID).Scan(&devices); err != nil || devices != 1 {
+		t.Fatalf("device removed without its signing key: %d %v", devices, err)
+	}
+}
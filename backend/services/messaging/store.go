@@ -0,0 +1,518 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"lan-chat/protocol"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// MessageStore persists channels, channel membership, DM channels and
+// messages. The users table is owned by the auth/admin services and is only
+// read through it. It is not a storage-agnostic abstraction: the router
+// keeps most feature tables on DB() with hand-written SQL, so every
+// implementation is a database/sql store for a SQL dialect that Rebind
+// can express, currently SQLite and Postgres.
+type MessageStore interface {
+	ChannelType(channelID string) (string, error)
+	GetChannel(channelID string) (ChannelView, error)
+	// CreateChannel creates a channel; a non-empty ownerID joins it as
+	// its owner.
+	CreateChannel(id, name, chType, ownerID string) error
+	AddChannelMember(channelID, userID string) error
+	RemoveChannelMember(channelID, userID string) error
+	ChannelMemberIDs(channelID string) ([]string, error)
+	IsChannelMember(channelID, userID string) (bool, error)
+	ChannelMemberRole(channelID, userID string) (string, error)
+	ListAccessibleChannels(userID string) ([]ChannelView, error)
+	ListChannelMembers(channelID string) ([]ChannelMemberView, error)
+	UserExists(userID string) (bool, error)
+	FindUserIDByUsername(username string) (string, error)
+	FindOrCreateDMChannel(u1, u2 string) (string, error)
+	SaveMessage(msg *protocol.Message) error
+	ChannelHistory(channelID string, limit int) ([]protocol.Message, error)
+	HistoryPage(channelID string, after HistoryCursor, limit int) ([]HistoryRecord, error)
+
+	// DB and Rebind give the router's features (webhooks, bots, retention,
+	// keys, ...) the connection for their own tables and queries, written
+	// with "?" placeholders.
+	DB() *sql.DB
+	Rebind(query string) string
+	Close() error
+}
+
+// sqlStore implements MessageStore on database/sql. Queries are written with
+// "?" placeholders and rewritten by rebind for drivers that need it.
+type sqlStore struct {
+	db     *sql.DB
+	rebind func(string) string
+}
+
+// SQLiteStore is the default single-node MessageStore.
+type SQLiteStore struct {
+	sqlStore
+}
+
+// PostgresStore is a MessageStore for deployments that outgrow one disk.
+type PostgresStore struct {
+	sqlStore
+}
+
+const sqliteSchema = `
+	CREATE TABLE IF NOT EXISTS channels (
+		id TEXT PRIMARY KEY,
+		name TEXT,
+		type TEXT DEFAULT 'public',
+		department_id TEXT
+	);
+	CREATE TABLE IF NOT EXISTS channel_members (
+		channel_id TEXT,
+		user_id TEXT,
+		role TEXT DEFAULT 'member',
+		PRIMARY KEY (channel_id, user_id)
+	);
+	CREATE TABLE IF NOT EXISTS messages (
+		id TEXT PRIMARY KEY,
+		channel_id TEXT,
+		sender_id TEXT,
+		timestamp INTEGER,
+		type INTEGER,
+		content BLOB,
+		nonce BLOB,
+		signature BLOB,
+		attachment TEXT,
+		device_id TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_channel_timestamp ON messages(channel_id, timestamp);
+`
+
+const postgresSchema = `
+	CREATE TABLE IF NOT EXISTS channels (
+		id TEXT PRIMARY KEY,
+		name TEXT,
+		type TEXT DEFAULT 'public',
+		department_id TEXT
+	);
+	CREATE TABLE IF NOT EXISTS channel_members (
+		channel_id TEXT,
+		user_id TEXT,
+		role TEXT DEFAULT 'member',
+		PRIMARY KEY (channel_id, user_id)
+	);
+	CREATE TABLE IF NOT EXISTS messages (
+		id TEXT PRIMARY KEY,
+		channel_id TEXT,
+		sender_id TEXT,
+		timestamp BIGINT,
+		type INTEGER,
+		content BYTEA,
+		nonce BYTEA,
+		signature BYTEA,
+		attachment TEXT,
+		device_id TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_channel_timestamp ON messages(channel_id, timestamp);
+`
+
+// NewSQLiteStore opens (and migrates) a SQLite database file.
+func NewSQLiteStore(dbPath string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize database: %w", err)
+	}
+	for _, c := range [][3]string{{"channels", "department_id", "TEXT"}, {"messages", "attachment", "TEXT"}, {"messages", "device_id", "TEXT"}, {"channel_members", "role", "TEXT DEFAULT 'member'"}} {
+		if err := sqliteAddColumn(db, c[0], c[1], c[2]); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to migrate database: %w", err)
+		}
+	}
+	return &SQLiteStore{sqlStore{db: db, rebind: func(q string) string { return q }}}, nil
+}
+
+// NewPostgresStore connects to Postgres using a lib/pq DSN and migrates it.
+func NewPostgresStore(dsn string) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	if _, err := db.Exec(postgresSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize database: %w", err)
+	}
+	_, err = db.Exec(`
+		ALTER TABLE channels ADD COLUMN IF NOT EXISTS department_id TEXT;
+		ALTER TABLE messages ADD COLUMN IF NOT EXISTS attachment TEXT;
+		ALTER TABLE messages ADD COLUMN IF NOT EXISTS device_id TEXT;
+		ALTER TABLE channel_members ADD COLUMN IF NOT EXISTS role TEXT DEFAULT 'member';`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+	return &PostgresStore{sqlStore{db: db, rebind: dollarPlaceholders}}, nil
+}
+
+// sqliteAddColumn adds a column to databases created before it existed.
+func sqliteAddColumn(db *sql.DB, table, column, decl string) error {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid       int
+			name, typ string
+			notNull   int
+			dflt      sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + decl)
+	return err
+}
+
+// dollarPlaceholders rewrites "?" placeholders to Postgres "$n" form,
+// leaving question marks in string literals and quoted identifiers alone.
+func dollarPlaceholders(query string) string {
+	var b strings.Builder
+	n := 0
+	var quote rune
+	for _, c := range query {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) DB() *sql.DB                { return s.db }
+func (s *sqlStore) Rebind(query string) string { return s.rebind(query) }
+func (s *sqlStore) Close() error               { return s.db.Close() }
+
+func (s *sqlStore) ChannelType(channelID string) (string, error) {
+	var chType string
+	err := s.db.QueryRow(s.rebind("SELECT type FROM channels WHERE id = ?"), channelID).Scan(&chType)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", errChannelMissing
+		}
+		return "", err
+	}
+	return chType, nil
+}
+
+func (s *sqlStore) GetChannel(channelID string) (ChannelView, error) {
+	var ch ChannelView
+	err := s.db.QueryRow(s.rebind("SELECT id, COALESCE(name, ''), type FROM channels WHERE id = ?"), channelID).
+		Scan(&ch.ID, &ch.Name, &ch.Type)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ch, errChannelMissing
+	}
+	return ch, err
+}
+
+func (s *sqlStore) CreateChannel(id, name, chType, ownerID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(s.rebind("INSERT INTO channels (id, name, type) VALUES (?, ?, ?)"), id, name, chType); err != nil {
+		return err
+	}
+	if ownerID != "" {
+		if _, err := tx.Exec(s.rebind("INSERT INTO channel_members (channel_id, user_id, role) VALUES (?, ?, 'owner')"), id, ownerID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) AddChannelMember(channelID, userID string) error {
+	_, err := s.db.Exec(s.rebind(`
+		INSERT INTO channel_members (channel_id, user_id) VALUES (?, ?)
+		ON CONFLICT (channel_id, user_id) DO NOTHING`), channelID, userID)
+	return err
+}
+
+func (s *sqlStore) RemoveChannelMember(channelID, userID string) error {
+	_, err := s.db.Exec(s.rebind("DELETE FROM channel_members WHERE channel_id = ? AND user_id = ?"), channelID, userID)
+	return err
+}
+
+func (s *sqlStore) ChannelMemberIDs(channelID string) ([]string, error) {
+	rows, err := s.db.Query(s.rebind("SELECT user_id FROM channel_members WHERE channel_id = ?"), channelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []string
+	for rows.Next() {
+		var uid string
+		if err := rows.Scan(&uid); err == nil {
+			members = append(members, uid)
+		}
+	}
+	return members, rows.Err()
+}
+
+func (s *sqlStore) IsChannelMember(channelID, userID string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(s.rebind(
+		"SELECT EXISTS(SELECT 1 FROM channel_members WHERE channel_id = ? AND user_id = ?)"),
+		channelID, userID,
+	).Scan(&exists)
+	return exists, err
+}
+
+// ChannelMemberRole returns userID's role in channelID ("owner", "admin" or
+// "member"), or "" when the user is not a member.
+func (s *sqlStore) ChannelMemberRole(channelID, userID string) (string, error) {
+	var role string
+	err := s.db.QueryRow(s.rebind(
+		"SELECT COALESCE(role, 'member') FROM channel_members WHERE channel_id = ? AND user_id = ?"),
+		channelID, userID,
+	).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return role, err
+}
+
+func (s *sqlStore) ListAccessibleChannels(userID string) ([]ChannelView, error) {
+	rows, err := s.db.Query(s.rebind(`
+		SELECT DISTINCT c.id, c.name, c.type
+		FROM channels c
+		LEFT JOIN channel_members m ON c.id = m.channel_id
+		WHERE c.type = 'public' OR m.user_id = ?
+		ORDER BY c.name ASC`), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]ChannelView, 0)
+	for rows.Next() {
+		var ch ChannelView
+		if err := rows.Scan(&ch.ID, &ch.Name, &ch.Type); err == nil {
+			out = append(out, ch)
+		}
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) ListChannelMembers(channelID string) ([]ChannelMemberView, error) {
+	rows, err := s.db.Query(s.rebind(`
+		SELECT u.id, u.username, COALESCE(u.full_name, '')
+		FROM channel_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.channel_id = ?
+		ORDER BY u.username ASC`), channelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]ChannelMemberView, 0)
+	for rows.Next() {
+		var m ChannelMemberView
+		if err := rows.Scan(&m.ID, &m.Username, &m.FullName); err == nil {
+			out = append(out, m)
+		}
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlStore) UserExists(userID string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow(s.rebind("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)"), userID).Scan(&exists)
+	return exists, err
+}
+
+func (s *sqlStore) FindUserIDByUsername(username string) (string, error) {
+	var userID string
+	err := s.db.QueryRow(s.rebind("SELECT id FROM users WHERE username = ?"), username).Scan(&userID)
+	if err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+// FindOrCreateDMChannel ensures a DM channel exists between two users.
+func (s *sqlStore) FindOrCreateDMChannel(u1, u2 string) (string, error) {
+	// Standardized name for DM: "dm:<uid1>:<uid2>" where uid1 < uid2
+	p1, p2 := u1, u2
+	if p1 > p2 {
+		p1, p2 = u2, u1
+	}
+	dmID := fmt.Sprintf("dm:%s:%s", p1, p2)
+
+	var exists bool
+	err := s.db.QueryRow(s.rebind("SELECT EXISTS(SELECT 1 FROM channels WHERE id = ?)"), dmID).Scan(&exists)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return dmID, nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(s.rebind(`
+		INSERT INTO channels (id, name, type) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO NOTHING`), dmID, "Direct Message", "dm")
+	if err != nil {
+		return "", err
+	}
+	for _, uid := range []string{u1, u2} {
+		_, err = tx.Exec(s.rebind(`
+			INSERT INTO channel_members (channel_id, user_id) VALUES (?, ?)
+			ON CONFLICT (channel_id, user_id) DO NOTHING`), dmID, uid)
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return dmID, nil
+}
+
+func (s *sqlStore) SaveMessage(msg *protocol.Message) error {
+	var attachment sql.NullString
+	if msg.Attachment != nil {
+		b, err := json.Marshal(msg.Attachment)
+		if err != nil {
+			return err
+		}
+		attachment = sql.NullString{String: string(b), Valid: true}
+	}
+	_, err := s.db.Exec(s.rebind(`
+		INSERT INTO messages (id, channel_id, sender_id, timestamp, type, content, nonce, signature, attachment, device_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		msg.ID, msg.ChannelID, msg.SenderID, msg.Timestamp, msg.Type, msg.Content, msg.Nonce, msg.Signature, attachment, msg.DeviceID,
+	)
+	return err
+}
+
+// decodeAttachment restores Message.Attachment from its stored JSON form.
+func decodeAttachment(m *protocol.Message, raw sql.NullString) {
+	if !raw.Valid || raw.String == "" {
+		return
+	}
+	var a protocol.Attachment
+	if json.Unmarshal([]byte(raw.String), &a) == nil {
+		m.Attachment = &a
+	}
+}
+
+// ChannelHistory returns up to limit messages of a channel, oldest first.
+func (s *sqlStore) ChannelHistory(channelID string, limit int) ([]protocol.Message, error) {
+	rows, err := s.db.Query(s.rebind(`
+		SELECT id, channel_id, sender_id, timestamp, type, content, nonce, signature, attachment, COALESCE(device_id, '')
+		FROM messages WHERE channel_id = ? ORDER BY timestamp ASC LIMIT ?`), channelID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []protocol.Message
+	for rows.Next() {
+		var m protocol.Message
+		var attachment sql.NullString
+		err := rows.Scan(&m.ID, &m.ChannelID, &m.SenderID, &m.Timestamp, &m.Type, &m.Content, &m.Nonce, &m.Signature, &attachment, &m.DeviceID)
+		if err == nil {
+			decodeAttachment(&m, attachment)
+			history = append(history, m)
+		}
+	}
+	return history, rows.Err()
+}
+
+// HistoryCursor is a keyset position in a channel's history. The zero value
+// starts before the first message.
+type HistoryCursor struct {
+	Timestamp int64
+	ID        string
+}
+
+// HistoryRecord is a stored message with its sender's display name.
+type HistoryRecord struct {
+	protocol.Message
+	SenderName string
+}
+
+// HistoryPage returns up to limit messages after the cursor, oldest first,
+// so callers can walk arbitrarily long histories in bounded memory.
+func (s *sqlStore) HistoryPage(channelID string, after HistoryCursor, limit int) ([]HistoryRecord, error) {
+	ts := after.Timestamp
+	if ts == 0 && after.ID == "" {
+		ts = math.MinInt64
+	}
+	rows, err := s.db.Query(s.rebind(`
+		SELECT m.id, m.channel_id, m.sender_id, m.timestamp, m.type, m.content, m.nonce, m.signature, m.attachment, COALESCE(m.device_id, ''),
+			COALESCE(NULLIF(u.full_name, ''), u.username, m.sender_id)
+		FROM messages m
+		LEFT JOIN users u ON u.id = m.sender_id
+		WHERE m.channel_id = ? AND (m.timestamp > ? OR (m.timestamp = ? AND m.id > ?))
+		ORDER BY m.timestamp ASC, m.id ASC
+		LIMIT ?`), channelID, ts, ts, after.ID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := make([]HistoryRecord, 0, limit)
+	for rows.Next() {
+		var rec HistoryRecord
+		m := &rec.Message
+		var attachment sql.NullString
+		if err := rows.Scan(&m.ID, &m.ChannelID, &m.SenderID, &m.Timestamp, &m.Type, &m.Content, &m.Nonce, &m.Signature, &attachment, &m.DeviceID, &rec.SenderName); err != nil {
+			return nil, err
+		}
+		decodeAttachment(m, attachment)
+		page = append(page, rec)
+	}
+	return page, rows.Err()
+}
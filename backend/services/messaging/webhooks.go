@@ -0,0 +1,676 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"lan-chat/protocol"
+
+	"github.com/google/uuid"
+)
+
+const (
+	webhookSenderPrefix     = "webhook:"
+	webhookSignatureHeader  = "X-Webhook-Signature"
+	webhookTimestampHeader  = "X-Webhook-Timestamp"
+	webhookIDHeader         = "X-Webhook-ID"
+	defaultWebhookBodyLimit = 64 << 10 // 64 KiB
+	maxWebhookTextLength    = 8000
+	webhookWorkers          = 4
+	webhookQueueSize        = 256
+)
+
+var errWebhookMissing = errors.New("webhook not found")
+
+const webhookSchema = `
+	CREATE TABLE IF NOT EXISTS incoming_webhooks (
+		id TEXT PRIMARY KEY,
+		channel_id TEXT NOT NULL,
+		name TEXT,
+		token_hash TEXT NOT NULL,
+		created_by TEXT,
+		created_at BIGINT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_incoming_webhooks_channel ON incoming_webhooks(channel_id);
+	CREATE TABLE IF NOT EXISTS outgoing_webhooks (
+		id TEXT PRIMARY KEY,
+		channel_id TEXT NOT NULL,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		trigger_prefix TEXT DEFAULT '',
+		created_by TEXT,
+		created_at BIGINT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_outgoing_webhooks_channel ON outgoing_webhooks(channel_id);
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id TEXT PRIMARY KEY,
+		webhook_id TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		attempt INTEGER NOT NULL,
+		status_code INTEGER,
+		error TEXT,
+		delivered_at BIGINT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_hook ON webhook_deliveries(webhook_id, delivered_at);
+`
+
+// IncomingWebhook posts external events into a channel as system messages.
+type IncomingWebhook struct {
+	ID        string `json:"id"`
+	ChannelID string `json:"channel_id"`
+	Name      string `json:"name"`
+	CreatedBy string `json:"created_by"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// OutgoingWebhook pushes matching channel messages to an external URL.
+type OutgoingWebhook struct {
+	ID            string `json:"id"`
+	ChannelID     string `json:"channel_id"`
+	URL           string `json:"url"`
+	TriggerPrefix string `json:"trigger_prefix"`
+	CreatedBy     string `json:"created_by"`
+	CreatedAt     int64  `json:"created_at"`
+	secret        string
+}
+
+// WebhookDelivery is one attempt to deliver a message to an outgoing webhook.
+type WebhookDelivery struct {
+	ID          string `json:"id"`
+	WebhookID   string `json:"webhook_id"`
+	MessageID   string `json:"message_id"`
+	Attempt     int    `json:"attempt"`
+	StatusCode  int    `json:"status_code"`
+	Error       string `json:"error,omitempty"`
+	DeliveredAt int64  `json:"delivered_at"`
+}
+
+type CreateIncomingWebhookRequest struct {
+	ChannelID string `json:"channel_id"`
+	Name      string `json:"name"`
+}
+
+type CreateOutgoingWebhookRequest struct {
+	ChannelID     string `json:"channel_id"`
+	URL           string `json:"url"`
+	TriggerPrefix string `json:"trigger_prefix"`
+}
+
+// IncomingWebhookPayload is the body accepted by /hooks/incoming.
+type IncomingWebhookPayload struct {
+	Text     string `json:"text"`
+	Username string `json:"username"`
+}
+
+// OutgoingWebhookPayload is the body POSTed to outgoing webhook URLs.
+type OutgoingWebhookPayload struct {
+	WebhookID string           `json:"webhook_id"`
+	Message   protocol.Message `json:"message"`
+}
+
+// webhookDispatcher delivers messages to outgoing webhooks with retries. A
+// fixed set of workers drains a bounded queue, so a slow endpoint delays
+// deliveries instead of piling up goroutines.
+type webhookDispatcher struct {
+	store       MessageStore
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+	queue       chan webhookJob
+}
+
+type webhookJob struct {
+	hook OutgoingWebhook
+	msg  protocol.Message
+}
+
+func newWebhookDispatcher(store MessageStore) *webhookDispatcher {
+	d := &webhookDispatcher{
+		store:       store,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		maxAttempts: 3,
+		backoff:     2 * time.Second,
+		queue:       make(chan webhookJob, webhookQueueSize),
+	}
+	for i := 0; i < webhookWorkers; i++ {
+		go d.work()
+	}
+	return d
+}
+
+func (d *webhookDispatcher) work() {
+	for job := range d.queue {
+		d.deliver(job.hook, job.msg)
+	}
+}
+
+// enqueue hands msg to the workers, dropping it when the queue is full.
+func (d *webhookDispatcher) enqueue(hook OutgoingWebhook, msg protocol.Message) bool {
+	select {
+	case d.queue <- webhookJob{hook: hook, msg: msg}:
+		return true
+	default:
+		log.Printf("outgoing webhook %s: queue full, dropped message %s", hook.ID, msg.ID)
+		return false
+	}
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashWebhookToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// signWebhookPayload returns the hex HMAC-SHA256 of "<timestamp>.<body>".
+func signWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func isWebhookSender(senderID string) bool {
+	return strings.HasPrefix(senderID, webhookSenderPrefix)
+}
+
+func (r *MessageRouter) createIncomingWebhook(channelID, name, createdBy string) (*IncomingWebhook, string, error) {
+	token, err := randomToken(24)
+	if err != nil {
+		return nil, "", err
+	}
+	hook := &IncomingWebhook{
+		ID:        uuid.New().String(),
+		ChannelID: channelID,
+		Name:      name,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now().Unix(),
+	}
+	_, err = r.db.Exec(r.bind(`
+		INSERT INTO incoming_webhooks (id, channel_id, name, token_hash, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`),
+		hook.ID, hook.ChannelID, hook.Name, hashWebhookToken(token), hook.CreatedBy, hook.CreatedAt,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	return hook, token, nil
+}
+
+func (r *MessageRouter) verifyIncomingWebhook(id, token string) (*IncomingWebhook, error) {
+	var hook IncomingWebhook
+	var tokenHash string
+	err := r.db.QueryRow(r.bind(`
+		SELECT id, channel_id, COALESCE(name, ''), token_hash, COALESCE(created_by, ''), created_at
+		FROM incoming_webhooks WHERE id = ?`), id).
+		Scan(&hook.ID, &hook.ChannelID, &hook.Name, &tokenHash, &hook.CreatedBy, &hook.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errUnauthorized
+		}
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(tokenHash), []byte(hashWebhookToken(token))) != 1 {
+		return nil, errUnauthorized
+	}
+	return &hook, nil
+}
+
+func (r *MessageRouter) listIncomingWebhooks(channelID string) ([]IncomingWebhook, error) {
+	rows, err := r.db.Query(r.bind(`
+		SELECT id, channel_id, COALESCE(name, ''), COALESCE(created_by, ''), created_at
+		FROM incoming_webhooks WHERE channel_id = ? ORDER BY created_at ASC`), channelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]IncomingWebhook, 0)
+	for rows.Next() {
+		var h IncomingWebhook
+		if err := rows.Scan(&h.ID, &h.ChannelID, &h.Name, &h.CreatedBy, &h.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
+
+func (r *MessageRouter) createOutgoingWebhook(req CreateOutgoingWebhookRequest, createdBy string) (*OutgoingWebhook, string, error) {
+	secret, err := randomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+	hook := &OutgoingWebhook{
+		ID:            uuid.New().String(),
+		ChannelID:     req.ChannelID,
+		URL:           req.URL,
+		TriggerPrefix: req.TriggerPrefix,
+		CreatedBy:     createdBy,
+		CreatedAt:     time.Now().Unix(),
+		secret:        secret,
+	}
+	_, err = r.db.Exec(r.bind(`
+		INSERT INTO outgoing_webhooks (id, channel_id, url, secret, trigger_prefix, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		hook.ID, hook.ChannelID, hook.URL, secret, hook.TriggerPrefix, hook.CreatedBy, hook.CreatedAt,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	return hook, secret, nil
+}
+
+func (r *MessageRouter) listOutgoingWebhooks(channelID string) ([]OutgoingWebhook, error) {
+	rows, err := r.db.Query(r.bind(`
+		SELECT id, channel_id, url, secret, COALESCE(trigger_prefix, ''), COALESCE(created_by, ''), created_at
+		FROM outgoing_webhooks WHERE channel_id = ? ORDER BY created_at ASC`), channelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]OutgoingWebhook, 0)
+	for rows.Next() {
+		var h OutgoingWebhook
+		if err := rows.Scan(&h.ID, &h.ChannelID, &h.URL, &h.secret, &h.TriggerPrefix, &h.CreatedBy, &h.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
+
+// authorizeChannelManager allows platform admins and the owners and admins
+// of channelID.
+func (r *MessageRouter) authorizeChannelManager(req *http.Request, userID, channelID string) error {
+	if _, err := r.getChannelType(channelID); err != nil {
+		return err
+	}
+	if _, err := r.authenticateAdmin(req); err == nil {
+		return nil
+	}
+	role, err := r.store.ChannelMemberRole(channelID, userID)
+	if err != nil {
+		return err
+	}
+	if role != "owner" && role != "admin" {
+		return errForbidden
+	}
+	return nil
+}
+
+// webhookChannel returns the channel an incoming or outgoing webhook belongs to.
+func (r *MessageRouter) webhookChannel(table, id string) (string, error) {
+	var channelID string
+	err := r.db.QueryRow(r.bind("SELECT channel_id FROM "+table+" WHERE id = ?"), id).Scan(&channelID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", errWebhookMissing
+		}
+		return "", err
+	}
+	return channelID, nil
+}
+
+func (r *MessageRouter) listWebhookDeliveries(webhookID string, limit int) ([]WebhookDelivery, error) {
+	rows, err := r.db.Query(r.bind(`
+		SELECT id, webhook_id, message_id, attempt, COALESCE(status_code, 0), COALESCE(error, ''), delivered_at
+		FROM webhook_deliveries WHERE webhook_id = ? ORDER BY delivered_at DESC, attempt DESC LIMIT ?`),
+		webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make([]WebhookDelivery, 0)
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.MessageID, &d.Attempt, &d.StatusCode, &d.Error, &d.DeliveredAt); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// dispatchOutgoingWebhooks queues delivery of msg to every matching outgoing
+// webhook of its channel. Messages posted by webhooks are never forwarded to
+// avoid delivery loops between two integrations, and fan-out messages are
+// skipped because their content is only a placeholder for per-device
+// ciphertexts.
+func (r *MessageRouter) dispatchOutgoingWebhooks(msg *protocol.Message) {
+	if r.webhooks == nil || msg.FanOut || isWebhookSender(msg.SenderID) {
+		return
+	}
+	hooks, err := r.listOutgoingWebhooks(msg.ChannelID)
+	if err != nil {
+		log.Printf("outgoing webhooks lookup failed: %v", err)
+		return
+	}
+	for _, hook := range hooks {
+		if !strings.HasPrefix(string(msg.Content), hook.TriggerPrefix) {
+			continue
+		}
+		r.webhooks.enqueue(hook, *msg)
+	}
+}
+
+// deliver POSTs msg to hook, retrying with linear backoff on transport
+// errors and non-2xx responses. Every attempt is written to webhook_deliveries.
+func (d *webhookDispatcher) deliver(hook OutgoingWebhook, msg protocol.Message) bool {
+	body, err := json.Marshal(OutgoingWebhookPayload{WebhookID: hook.ID, Message: msg})
+	if err != nil {
+		return false
+	}
+
+	for attempt := 1; attempt <= d.maxAttempts; attempt++ {
+		status, err := d.post(hook, body)
+		d.record(hook.ID, msg.ID, attempt, status, err)
+		if err == nil {
+			return true
+		}
+		if attempt < d.maxAttempts {
+			time.Sleep(d.backoff * time.Duration(attempt))
+		}
+	}
+	log.Printf("outgoing webhook %s gave up on message %s after %d attempts", hook.ID, msg.ID, d.maxAttempts)
+	return false
+}
+
+func (d *webhookDispatcher) post(hook OutgoingWebhook, body []byte) (int, error) {
+	ts := time.Now().Unix()
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookIDHeader, hook.ID)
+	req.Header.Set(webhookTimestampHeader, strconv.FormatInt(ts, 10))
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhookPayload(hook.secret, ts, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func (d *webhookDispatcher) record(webhookID, messageID string, attempt, status int, deliveryErr error) {
+	errText := ""
+	if deliveryErr != nil {
+		errText = deliveryErr.Error()
+	}
+	_, err := d.store.DB().Exec(d.store.Rebind(`
+		INSERT INTO webhook_deliveries (id, webhook_id, message_id, attempt, status_code, error, delivered_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		uuid.New().String(), webhookID, messageID, attempt, status, errText, time.Now().UnixMilli(),
+	)
+	if err != nil {
+		log.Printf("record webhook delivery failed: %v", err)
+	}
+}
+
+// IncomingWebhookHandler accepts external posts at /hooks/incoming?id=&token=
+// and turns them into system messages in the webhook's channel.
+func (r *MessageRouter) IncomingWebhookHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := req.Header.Get("X-Webhook-Token")
+	if token == "" {
+		token = req.URL.Query().Get("token")
+	}
+	hook, err := r.verifyIncomingWebhook(req.URL.Query().Get("id"), token)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var payload IncomingWebhookPayload
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, defaultWebhookBodyLimit)).Decode(&payload); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	payload.Text = strings.TrimSpace(payload.Text)
+	if payload.Text == "" || len(payload.Text) > maxWebhookTextLength {
+		http.Error(w, "invalid text", http.StatusBadRequest)
+		return
+	}
+	if payload.Username != "" {
+		payload.Text = payload.Username + ": " + payload.Text
+	}
+
+	msg, err := r.saveServerMessage(protocol.SendMessageRequest{
+		ChannelID: hook.ChannelID,
+		Content:   []byte(payload.Text),
+		Type:      protocol.MessageTypeSystem,
+	}, webhookSenderPrefix+hook.ID, hook.ChannelID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := r.Broadcast(msg); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(protocol.SendMessageResponse{MessageID: msg.ID, Success: true})
+}
+
+// IncomingWebhooksHandler lists (GET), creates (POST) and deletes (DELETE)
+// incoming webhooks. A webhook posts into its channel under a name of its
+// choosing, so managing them is left to admins and channel owners.
+func (r *MessageRouter) IncomingWebhooksHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := r.authenticate(req)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		channelID := req.URL.Query().Get("channel_id")
+		if channelID == "" {
+			http.Error(w, "missing channel_id", http.StatusBadRequest)
+			return
+		}
+		if err := r.authorizeChannelManager(req, userID, channelID); err != nil {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		hooks, err := r.listIncomingWebhooks(channelID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"webhooks": hooks})
+
+	case http.MethodPost:
+		var body CreateIncomingWebhookRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		body.Name = strings.TrimSpace(body.Name)
+		if body.ChannelID == "" {
+			http.Error(w, "missing channel_id", http.StatusBadRequest)
+			return
+		}
+		if len(body.Name) > 80 {
+			http.Error(w, "name too long", http.StatusBadRequest)
+			return
+		}
+		if err := r.authorizeChannelManager(req, userID, body.ChannelID); err != nil {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		hook, token, err := r.createIncomingWebhook(body.ChannelID, body.Name, userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"webhook": hook,
+			"token":   token,
+			"url":     "/hooks/incoming?id=" + url.QueryEscape(hook.ID) + "&token=" + url.QueryEscape(token),
+		})
+
+	case http.MethodDelete:
+		r.deleteWebhook(w, req, userID, "incoming_webhooks", r.authorizeChannelManager)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// OutgoingWebhooksHandler lists (GET) outgoing webhooks for channels the
+// caller can access. Creating (POST) and deleting (DELETE) them sends channel
+// traffic to arbitrary URLs, so it is left to admins and channel owners.
+func (r *MessageRouter) OutgoingWebhooksHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := r.authenticate(req)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		channelID := req.URL.Query().Get("channel_id")
+		if channelID == "" {
+			http.Error(w, "missing channel_id", http.StatusBadRequest)
+			return
+		}
+		if err := r.authorizeChannelAccess(userID, channelID); err != nil {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		hooks, err := r.listOutgoingWebhooks(channelID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"webhooks": hooks})
+
+	case http.MethodPost:
+		var body CreateOutgoingWebhookRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if body.ChannelID == "" {
+			http.Error(w, "missing channel_id", http.StatusBadRequest)
+			return
+		}
+		target, err := url.Parse(body.URL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			http.Error(w, "invalid url", http.StatusBadRequest)
+			return
+		}
+		if len(body.TriggerPrefix) > 64 {
+			http.Error(w, "trigger_prefix too long", http.StatusBadRequest)
+			return
+		}
+		if err := r.authorizeChannelManager(req, userID, body.ChannelID); err != nil {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		hook, secret, err := r.createOutgoingWebhook(body, userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"webhook": hook, "secret": secret})
+
+	case http.MethodDelete:
+		r.deleteWebhook(w, req, userID, "outgoing_webhooks", r.authorizeChannelManager)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *MessageRouter) deleteWebhook(w http.ResponseWriter, req *http.Request, userID, table string, authorize func(*http.Request, string, string) error) {
+	id := req.URL.Query().Get("id")
+	channelID, err := r.webhookChannel(table, id)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err := authorize(req, userID, channelID); err != nil {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if _, err := r.db.Exec(r.bind("DELETE FROM "+table+" WHERE id = ?"), id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+}
+
+// WebhookDeliveriesHandler returns the delivery log of an outgoing webhook.
+func (r *MessageRouter) WebhookDeliveriesHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, err := r.authenticate(req)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	webhookID := req.URL.Query().Get("webhook_id")
+	channelID, err := r.webhookChannel("outgoing_webhooks", webhookID)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err := r.authorizeChannelAccess(userID, channelID); err != nil {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	deliveries, err := r.listWebhookDeliveries(webhookID, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"deliveries": deliveries})
+}
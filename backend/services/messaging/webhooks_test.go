@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"lan-chat/protocol"
+)
+
+func TestIncomingWebhookPostsSystemMessage(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	if _, err := r.db.Exec(`UPDATE channel_members SET role = 'owner' WHERE channel_id = 'priv-1' AND user_id = 'u-alice'`); err != nil {
+		t.Fatalf("make alice owner: %v", err)
+	}
+
+	createReq := httptest.NewRequest(http.MethodPost, "/webhooks/incoming",
+		bytes.NewReader([]byte(`{"channel_id":"priv-1","name":"ci"}`)))
+	createReq.Header.Set("Authorization", "Bearer "+tokenForTestUser(t, "alice"))
+	createRec := httptest.NewRecorder()
+	r.IncomingWebhooksHandler(createRec, createReq)
+	if createRec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d body=%s", createRec.Code, createRec.Body.String())
+	}
+	var created struct {
+		Webhook IncomingWebhook `json:"webhook"`
+		Token   string          `json:"token"`
+		URL     string          `json:"url"`
+	}
+	if err := json.Unmarshal(createRec.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode create response: %v", err)
+	}
+
+	badReq := httptest.NewRequest(http.MethodPost, "/hooks/incoming?id="+created.Webhook.ID+"&token=wrong",
+		bytes.NewReader([]byte(`{"text":"build failed"}`)))
+	badRec := httptest.NewRecorder()
+	r.IncomingWebhookHandler(badRec, badReq)
+	if badRec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for bad token, got %d", badRec.Code)
+	}
+
+	hookReq := httptest.NewRequest(http.MethodPost, created.URL,
+		bytes.NewReader([]byte(`{"text":"build failed","username":"ci"}`)))
+	hookRec := httptest.NewRecorder()
+	r.IncomingWebhookHandler(hookRec, hookReq)
+	if hookRec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d body=%s", hookRec.Code, hookRec.Body.String())
+	}
+
+	var msgType int
+	var content []byte
+	var senderID string
+	err := r.db.QueryRow(`SELECT type, content, sender_id FROM messages WHERE sender_id LIKE 'webhook:%'`).
+		Scan(&msgType, &content, &senderID)
+	if err != nil {
+		t.Fatalf("load webhook message: %v", err)
+	}
+	if msgType != int(protocol.MessageTypeSystem) {
+		t.Fatalf("expected system message, got type %d", msgType)
+	}
+	if string(content) != "ci: build failed" {
+		t.Fatalf("unexpected content %q", content)
+	}
+}
+
+func TestIncomingWebhookRequiresChannelOwner(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	if _, err := r.db.Exec(`UPDATE channel_members SET role = 'owner' WHERE channel_id = 'priv-1' AND user_id = 'u-alice'`); err != nil {
+		t.Fatalf("make alice owner: %v", err)
+	}
+
+	do := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, bytes.NewReader([]byte(body)))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		r.IncomingWebhooksHandler(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPost, "/webhooks/incoming", tokenForTestUser(t, "charlie"), `{"channel_id":"priv-1"}`); rec.Code != http.StatusForbidden {
+		t.Fatalf("non-member: expected 403, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/webhooks/incoming", tokenForTestUser(t, "bob"), `{"channel_id":"priv-1"}`); rec.Code != http.StatusForbidden {
+		t.Fatalf("plain member: expected 403, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/webhooks/incoming", tokenForTestUser(t, "charlie"), `{"channel_id":"general"}`); rec.Code != http.StatusForbidden {
+		t.Fatalf("public channel reader: expected 403, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/webhooks/incoming", adminTokenForTestUser(t, "charlie"), `{"channel_id":"general"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("admin: expected 201, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	rec := do(http.MethodPost, "/webhooks/incoming", tokenForTestUser(t, "alice"), `{"channel_id":"priv-1","name":"ci"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("owner: expected 201, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var created struct {
+		Webhook IncomingWebhook `json:"webhook"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode create response: %v", err)
+	}
+
+	if rec := do(http.MethodGet, "/webhooks/incoming?channel_id=priv-1", tokenForTestUser(t, "bob"), ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("plain member list: expected 403, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/webhooks/incoming?channel_id=priv-1", tokenForTestUser(t, "alice"), ""); rec.Code != http.StatusOK {
+		t.Fatalf("owner list: expected 200, got %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/webhooks/incoming?id="+created.Webhook.ID, tokenForTestUser(t, "bob"), ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("plain member delete: expected 403, got %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/webhooks/incoming?id="+created.Webhook.ID, tokenForTestUser(t, "alice"), ""); rec.Code != http.StatusOK {
+		t.Fatalf("owner delete: expected 200, got %d", rec.Code)
+	}
+}
+
+func TestOutgoingWebhookSignsAndRetries(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	r.webhooks.backoff = time.Millisecond
+
+	var calls int32
+	var gotBody []byte
+	var gotSig, gotTS string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		gotBody, _ = io.ReadAll(req.Body)
+		gotSig = req.Header.Get(webhookSignatureHeader)
+		gotTS = req.Header.Get(webhookTimestampHeader)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	hook, secret, err := r.createOutgoingWebhook(CreateOutgoingWebhookRequest{
+		ChannelID:     "priv-1",
+		URL:           srv.URL,
+		TriggerPrefix: "!deploy",
+	}, "u-alice")
+	if err != nil {
+		t.Fatalf("create outgoing webhook: %v", err)
+	}
+
+	msg := protocol.Message{ID: "m-hook", ChannelID: "priv-1", SenderID: "u-alice", Content: []byte("!deploy prod")}
+	if ok := r.webhooks.deliver(*hook, msg); !ok {
+		t.Fatalf("expected delivery to succeed after retry")
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 attempts, got %d", calls)
+	}
+
+	ts, _ := strconv.ParseInt(gotTS, 10, 64)
+	if want := "sha256=" + signWebhookPayload(secret, ts, gotBody); gotSig != want {
+		t.Fatalf("signature mismatch: got %q want %q", gotSig, want)
+	}
+
+	deliveries, err := r.listWebhookDeliveries(hook.ID, 10)
+	if err != nil {
+		t.Fatalf("list deliveries: %v", err)
+	}
+	if len(deliveries) != 2 {
+		t.Fatalf("expected 2 delivery log entries, got %d", len(deliveries))
+	}
+	if deliveries[0].StatusCode != http.StatusNoContent || deliveries[1].StatusCode != http.StatusBadGateway {
+		t.Fatalf("unexpected delivery log: %+v", deliveries)
+	}
+}
+
+func TestOutgoingWebhookSkipsWebhookSenders(t *testing.T) {
+	r := newMessagingTestRouter(t)
+
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer srv.Close()
+
+	if _, _, err := r.createOutgoingWebhook(CreateOutgoingWebhookRequest{ChannelID: "priv-1", URL: srv.URL}, "u-alice"); err != nil {
+		t.Fatalf("create outgoing webhook: %v", err)
+	}
+	r.dispatchOutgoingWebhooks(&protocol.Message{ID: "m-loop", ChannelID: "priv-1", SenderID: webhookSenderPrefix + "x"})
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&calls) != 0 {
+		t.Fatalf("expected webhook-originated message not to be forwarded")
+	}
+}
+
+func TestOutgoingWebhookCreateRequiresChannelOwner(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	if _, err := r.db.Exec(`UPDATE channel_members SET role = 'owner' WHERE channel_id = 'priv-1' AND user_id = 'u-alice'`); err != nil {
+		t.Fatalf("make alice owner: %v", err)
+	}
+
+	create := func(token, channelID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/webhooks/outgoing",
+			bytes.NewReader([]byte(`{"channel_id":"`+channelID+`","url":"http://hooks.example/x"}`)))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		r.OutgoingWebhooksHandler(rec, req)
+		return rec
+	}
+
+	if rec := create(tokenForTestUser(t, "bob"), "priv-1"); rec.Code != http.StatusForbidden {
+		t.Fatalf("plain member: expected 403, got %d", rec.Code)
+	}
+	if rec := create(tokenForTestUser(t, "charlie"), "general"); rec.Code != http.StatusForbidden {
+		t.Fatalf("public channel reader: expected 403, got %d", rec.Code)
+	}
+	if rec := create(adminTokenForTestUser(t, "charlie"), "general"); rec.Code != http.StatusCreated {
+		t.Fatalf("admin: expected 201, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	rec := create(tokenForTestUser(t, "alice"), "priv-1")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("owner: expected 201, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var created struct {
+		Webhook OutgoingWebhook `json:"webhook"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode create response: %v", err)
+	}
+
+	del := func(token string) int {
+		req := httptest.NewRequest(http.MethodDelete, "/webhooks/outgoing?id="+created.Webhook.ID, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		r.OutgoingWebhooksHandler(rec, req)
+		return rec.Code
+	}
+	if code := del(tokenForTestUser(t, "bob")); code != http.StatusForbidden {
+		t.Fatalf("plain member delete: expected 403, got %d", code)
+	}
+	if code := del(tokenForTestUser(t, "alice")); code != http.StatusOK {
+		t.Fatalf("owner delete: expected 200, got %d", code)
+	}
+}
+
+func TestOutgoingWebhookSkipsFanOutMessages(t *testing.T) {
+	r := newMessagingTestRouter(t)
+
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer srv.Close()
+
+	if _, _, err := r.createOutgoingWebhook(CreateOutgoingWebhookRequest{ChannelID: "priv-1", URL: srv.URL}, "u-alice"); err != nil {
+		t.Fatalf("create outgoing webhook: %v", err)
+	}
+	r.dispatchOutgoingWebhooks(&protocol.Message{ID: "m-fan", ChannelID: "priv-1", SenderID: "u-alice", FanOut: true})
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&calls) != 0 {
+		t.Fatalf("expected fan-out message not to be forwarded")
+	}
+}
+
+func TestOutgoingWebhookQueueIsBounded(t *testing.T) {
+	d := &webhookDispatcher{queue: make(chan webhookJob, 1)}
+	hook := OutgoingWebhook{ID: "h-1"}
+	if !d.enqueue(hook, protocol.Message{ID: "m-1"}) {
+		t.Fatalf("expected first message to be queued")
+	}
+	if d.enqueue(hook, protocol.Message{ID: "m-2"}) {
+		t.Fatalf("expected a full queue to drop the message")
+	}
+}
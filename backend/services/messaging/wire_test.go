@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"lan-chat/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+func dialTestWS(t *testing.T, srv *httptest.Server, username string, subprotocols ...string) *websocket.Conn {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: subprotocols}
+	header := http.Header{"Authorization": {"Bearer " + tokenForTestUser(t, username)}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// waitForClients blocks until every user has a registered connection;
+// registration happens after the upgrade response is written.
+func waitForClients(r *MessageRouter, userIDs ...string) {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		r.mu.RLock()
+		n := 0
+		for _, id := range userIDs {
+			if len(r.clients[id]) > 0 {
+				n++
+			}
+		}
+		r.mu.RUnlock()
+		if n == len(userIDs) {
+			return
+		}
+	}
+}
+
+func readTestFrame(t *testing.T, conn *websocket.Conn, codec protocol.Codec) *protocol.Envelope {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	env, err := codec.DecodeFrame(data)
+	if err != nil {
+		t.Fatalf("decode frame: %v", err)
+	}
+	return env
+}
+
+func writeTestFrame(t *testing.T, conn *websocket.Conn, codec protocol.Codec, env *protocol.Envelope) {
+	t.Helper()
+	data, err := codec.EncodeFrame(env)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	frameType := websocket.TextMessage
+	if codec.Binary() {
+		frameType = websocket.BinaryMessage
+	}
+	if err := conn.WriteMessage(frameType, data); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+func TestWSNegotiatesEncodingPerConnection(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	srv := httptest.NewServer(http.HandlerFunc(r.HandleWS))
+	defer srv.Close()
+
+	binary := dialTestWS(t, srv, "alice", protocol.SubprotocolProtobuf, protocol.SubprotocolJSON)
+	legacy := dialTestWS(t, srv, "bob")
+	if binary.Subprotocol() != protocol.SubprotocolProtobuf || legacy.Subprotocol() != "" {
+		t.Fatalf("unexpected subprotocols %q / %q", binary.Subprotocol(), legacy.Subprotocol())
+	}
+
+	waitForClients(r, "u-alice", "u-bob")
+
+	payload := []byte{0x00, 0xff, 0x10, 0x80}
+	frame, err := protocol.ProtobufCodec{}.EncodeFrame(&protocol.Envelope{Send: &protocol.SendMessageRequest{
+		ChannelID: "priv-1", Type: protocol.MessageTypeText, Content: payload,
+	}})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if err := binary.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	read := func(conn *websocket.Conn, codec protocol.Codec, wantType int) *protocol.Message {
+		t.Helper()
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		typ, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if typ != wantType {
+			t.Fatalf("expected frame type %d, got %d", wantType, typ)
+		}
+		env, err := codec.DecodeFrame(data)
+		if err != nil || env.Message == nil {
+			t.Fatalf("decode frame: %+v %v", env, err)
+		}
+		return env.Message
+	}
+	fromBinary := read(binary, protocol.ProtobufCodec{}, websocket.BinaryMessage)
+	fromLegacy := read(legacy, protocol.JSONCodec{}, websocket.TextMessage)
+	if string(fromBinary.Content) != string(payload) || string(fromLegacy.Content) != string(payload) ||
+		fromBinary.ID != fromLegacy.ID || fromBinary.SenderID != "u-alice" {
+		t.Fatalf("clients disagree: %+v vs %+v", fromBinary, fromLegacy)
+	}
+}
+
+func TestWSHandshake(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	srv := httptest.NewServer(http.HandlerFunc(r.HandleWS))
+	defer srv.Close()
+	codec := protocol.JSONCodec{}
+
+	conn := dialTestWS(t, srv, "alice")
+	writeTestFrame(t, conn, codec, &protocol.Envelope{Hello: &protocol.Hello{
+		Version: protocol.ProtocolVersion, Capabilities: []string{protocol.CapabilityVoice, "threads"},
+	}})
+	env := readTestFrame(t, conn, codec)
+	if env.Welcome == nil || env.Welcome.Version != protocol.ProtocolVersion ||
+		len(env.Welcome.Enabled) != 1 || env.Welcome.Enabled[0] != protocol.CapabilityVoice {
+		t.Fatalf("expected welcome enabling voice only, got %+v", env)
+	}
+	// The connection opted out of ephemeral replies.
+	r.sendEphemeral("u-alice", "general", "only for alice")
+	writeTestFrame(t, conn, codec, &protocol.Envelope{Send: &protocol.SendMessageRequest{
+		ChannelID: "priv-1", Type: protocol.MessageTypeText, Content: []byte("after hello"),
+	}})
+	if env := readTestFrame(t, conn, codec); env.Message == nil || string(env.Message.Content) != "after hello" {
+		t.Fatalf("expected own message after welcome, got %+v", env)
+	}
+
+	missing := dialTestWS(t, srv, "bob")
+	writeTestFrame(t, missing, codec, &protocol.Envelope{Hello: &protocol.Hello{Version: 1, Required: []string{"receipts"}}})
+	if env := readTestFrame(t, missing, codec); env.Error == nil || env.Error.Code != protocol.ErrorCodeMissingCapability {
+		t.Fatalf("expected missing_capability, got %+v", env)
+	}
+	if _, _, err := missing.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("expected connection to be closed, got %v", err)
+	}
+
+	// Once the minimum version is raised, clients that skip the Hello are
+	// turned away before anything is delivered to them.
+	r.handshake.MinVersion = 1
+	legacy := dialTestWS(t, srv, "charlie")
+	writeTestFrame(t, legacy, codec, &protocol.Envelope{Send: &protocol.SendMessageRequest{ChannelID: "general", Content: []byte("hi")}})
+	if env := readTestFrame(t, legacy, codec); env.Error == nil || env.Error.Code != protocol.ErrorCodeHelloRequired {
+		t.Fatalf("expected hello_required, got %+v", env)
+	}
+	if _, _, err := legacy.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expected policy violation close, got %v", err)
+	}
+
+	old := dialTestWS(t, srv, "charlie")
+	writeTestFrame(t, old, codec, &protocol.Envelope{Hello: &protocol.Hello{Version: 0}})
+	if env := readTestFrame(t, old, codec); env.Error == nil || env.Error.Code != protocol.ErrorCodeIncompatibleVersion {
+		t.Fatalf("expected incompatible_version, got %+v", env)
+	}
+}
+
+func TestWSCommandDoesNotBlockReadLoop(t *testing.T) {
+	r := newMessagingTestRouter(t)
+	release := make(chan struct{})
+	if err := r.RegisterCommand("slow", "Blocks until released", func(ctx context.Context, inv CommandInvocation) (*CommandReply, error) {
+		<-release
+		return &CommandReply{Text: "done"}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(r.HandleWS))
+	defer srv.Close()
+
+	conn := dialTestWS(t, srv, "alice")
+	waitForClients(r, "u-alice")
+	codec := protocol.JSONCodec{}
+	writeTestFrame(t, conn, codec, &protocol.Envelope{Send: &protocol.SendMessageRequest{
+		ChannelID: "general", Type: protocol.MessageTypeText, Content: []byte("/slow"),
+	}})
+	writeTestFrame(t, conn, codec, &protocol.Envelope{Send: &protocol.SendMessageRequest{
+		ChannelID: "general", Type: protocol.MessageTypeText, Content: []byte("still here"),
+	}})
+
+	if env := readTestFrame(t, conn, codec); env.Message == nil || string(env.Message.Content) != "still here" {
+		t.Fatalf("expected the next message while the command runs, got %+v", env)
+	}
+	close(release)
+	if env := readTestFrame(t, conn, codec); env.Message == nil || string(env.Message.Content) != "done" ||
+		env.Message.SenderID != commandSenderPrefix+"slow" {
+		t.Fatalf("expected the command reply afterwards, got %+v", env)
+	}
+}
@@ -6,11 +6,34 @@ import '../models/user.dart';
 class AuthService {
   final String baseUrl;
   User? _currentUser;
+  String? _refreshToken;
+  DateTime? _expiresAt;
+  Future<String>? _refreshing;
+
+  // Set when the password was right but a second factor is needed.
+  String? _mfaChallenge;
+  String? _mfaPurpose;
+  String? _mfaUsername;
+
+  // Set when the password was right but has to be replaced before login.
+  String? _passwordChallenge;
+  String? _passwordReason;
+
+  /// Access tokens are renewed this long before they expire.
+  static const refreshMargin = Duration(seconds: 30);
 
   AuthService({required this.baseUrl});
 
   User? get currentUser => _currentUser;
 
+  /// 'verify' when login needs a two-factor code, 'enroll' when policy
+  /// requires setting up two-factor authentication first, otherwise null.
+  String? get pendingSecondFactor => _mfaPurpose;
+
+  /// 'reset' after an administrator issued a one-time password, 'expired'
+  /// when the password is older than the policy allows, otherwise null.
+  String? get pendingPasswordChange => _passwordReason;
+
   /// Register a new user. Call this before login if the account doesn't exist.
   Future<String?> register(String username, String password, {String role = 'member', String? fullName}) async {
     try {
@@ -50,20 +73,13 @@ class AuthService {
           return false;
         }
         final data = jsonDecode(body) as Map<String, dynamic>;
-        final token = data['token'] as String?;
-        final userId = data['user_id'] as String? ?? '';
-        final role = data['role'] as String? ?? 'user';
-
-        _currentUser = User(
-          id: userId,
-          username: username,
-          role: role,
-          token: token ?? '',
-        );
-
-        final prefs = await SharedPreferences.getInstance();
-        await prefs.setString('jwt_token', token ?? '');
-        return true;
+        if (data['password_change_required'] == true) {
+          _passwordChallenge = data['challenge'] as String?;
+          _passwordReason = data['reason'] as String?;
+          _mfaUsername = username;
+          return false;
+        }
+        return _afterPassword(username, data);
       }
       // Log for debugging (e.g. 401 = wrong password, 404 = wrong URL)
       print('Login failed: status=${response.statusCode} body=${response.body}');
@@ -74,14 +90,212 @@ class AuthService {
     }
   }
 
+  Future<bool> _afterPassword(String username, Map<String, dynamic> data) async {
+    if (data['mfa_required'] == true) {
+      _mfaChallenge = data['challenge'] as String?;
+      _mfaPurpose = data['purpose'] as String?;
+      _mfaUsername = username;
+      return false;
+    }
+    await _completeLogin(username, data);
+    return true;
+  }
+
+  /// Replaces the password login asked to change. Returns null when it was
+  /// accepted (check [currentUser] or [pendingSecondFactor] next), otherwise
+  /// the reason it was rejected.
+  Future<String?> changePasswordAtLogin(String newPassword) async {
+    try {
+      final response = await http.post(
+        Uri.parse('$baseUrl/login/password'),
+        body: jsonEncode({'challenge': _passwordChallenge, 'new_password': newPassword}),
+        headers: {'Content-Type': 'application/json'},
+      );
+      if (response.statusCode == 200) {
+        _passwordChallenge = null;
+        _passwordReason = null;
+        await _afterPassword(_mfaUsername ?? '', jsonDecode(response.body) as Map<String, dynamic>);
+        return null;
+      }
+      print('Password change failed: status=${response.statusCode} body=${response.body}');
+      return response.body.trim();
+    } catch (e) {
+      print('Password change error: $e');
+      return '$e';
+    }
+  }
+
+  /// Changes the signed-in user's password. Other sessions are signed out.
+  /// Returns null on success, otherwise the reason it was rejected.
+  Future<String?> changePassword(String currentPassword, String newPassword) async {
+    try {
+      final response = await http.post(
+        Uri.parse('$baseUrl/password'),
+        body: jsonEncode({'current_password': currentPassword, 'new_password': newPassword}),
+        headers: {
+          'Content-Type': 'application/json',
+          'Authorization': 'Bearer ${await accessToken()}',
+        },
+      );
+      if (response.statusCode == 200) {
+        return null;
+      }
+      print('Password change failed: status=${response.statusCode} body=${response.body}');
+      return response.body.trim();
+    } catch (e) {
+      print('Password change error: $e');
+      return '$e';
+    }
+  }
+
+  Future<void> _completeLogin(String username, Map<String, dynamic> data) async {
+    final userId = data['user_id'] as String? ?? '';
+    final role = data['role'] as String? ?? 'user';
+    _currentUser = User(id: userId, username: username, role: role);
+    _mfaChallenge = null;
+    _mfaPurpose = null;
+    _mfaUsername = null;
+    _passwordChallenge = null;
+    _passwordReason = null;
+    await _storeTokens(data);
+  }
+
+  Future<http.Response> _postChallenge(String path, Map<String, dynamic> body) {
+    return http.post(
+      Uri.parse('$baseUrl$path'),
+      body: jsonEncode({'challenge': _mfaChallenge, ...body}),
+      headers: {'Content-Type': 'application/json'},
+    );
+  }
+
+  /// Finishes a login that needs a second factor. Six digits are an
+  /// authenticator code; anything else is tried as a recovery code.
+  Future<bool> verifySecondFactor(String code) async {
+    code = code.trim();
+    final isTotp = RegExp(r'^\d{6}$').hasMatch(code);
+    try {
+      final response = await _postChallenge('/login/2fa', {isTotp ? 'code' : 'recovery_code': code});
+      if (response.statusCode == 200) {
+        await _completeLogin(_mfaUsername ?? '', jsonDecode(response.body) as Map<String, dynamic>);
+        return true;
+      }
+      print('2FA failed: status=${response.statusCode} body=${response.body}');
+    } catch (e) {
+      print('2FA error: $e');
+    }
+    return false;
+  }
+
+  /// Starts the enrollment policy requires during login. Returns the
+  /// 'secret' and 'otpauth_uri' to add to an authenticator app.
+  Future<Map<String, String>?> startEnrollment() async {
+    try {
+      final response = await _postChallenge('/login/2fa/enroll', {});
+      if (response.statusCode == 200) {
+        final data = jsonDecode(response.body) as Map<String, dynamic>;
+        return {'secret': data['secret'] as String, 'otpauth_uri': data['otpauth_uri'] as String};
+      }
+      print('2FA enroll failed: status=${response.statusCode} body=${response.body}');
+    } catch (e) {
+      print('2FA enroll error: $e');
+    }
+    return null;
+  }
+
+  /// Confirms the enrollment with the first code and signs in. Returns the
+  /// recovery codes to show the user once, or null on failure.
+  Future<List<String>?> confirmEnrollment(String code) async {
+    try {
+      final response = await _postChallenge('/login/2fa/confirm', {'code': code.trim()});
+      if (response.statusCode == 200) {
+        final data = jsonDecode(response.body) as Map<String, dynamic>;
+        await _completeLogin(_mfaUsername ?? '', data);
+        return (data['recovery_codes'] as List<dynamic>? ?? []).cast<String>();
+      }
+      print('2FA confirm failed: status=${response.statusCode} body=${response.body}');
+    } catch (e) {
+      print('2FA confirm error: $e');
+    }
+    return null;
+  }
+
+  /// Revokes the session at the auth service and forgets it locally.
   Future<void> logout() async {
+    final token = _currentUser?.token;
+    final refreshToken = _refreshToken;
+    try {
+      if (token != null && token.isNotEmpty) {
+        await http.post(
+          Uri.parse('$baseUrl/logout'),
+          body: jsonEncode({'refresh_token': refreshToken ?? ''}),
+          headers: {
+            'Content-Type': 'application/json',
+            'Authorization': 'Bearer $token',
+          },
+        );
+      }
+    } catch (e) {
+      print('Logout error: $e');
+    }
     _currentUser = null;
+    _refreshToken = null;
+    _expiresAt = null;
     final prefs = await SharedPreferences.getInstance();
     await prefs.remove('jwt_token');
+    await prefs.remove('refresh_token');
   }
 
-  Future<String?> getToken() async {
+  /// Returns a usable access token, renewing it through /refresh when it is
+  /// about to expire. Pass this to services instead of a fixed token.
+  Future<String> accessToken() async {
+    final token = _currentUser?.token ?? '';
+    final expiresAt = _expiresAt;
+    if (token.isEmpty || _refreshToken == null || expiresAt == null) {
+      return token;
+    }
+    if (expiresAt.difference(DateTime.now()) > refreshMargin) {
+      return token;
+    }
+    // A refresh token works once; concurrent callers share one refresh.
+    return _refreshing ??= _refresh().whenComplete(() => _refreshing = null);
+  }
+
+  Future<String> _refresh() async {
+    try {
+      final response = await http.post(
+        Uri.parse('$baseUrl/refresh'),
+        body: jsonEncode({'refresh_token': _refreshToken}),
+        headers: {'Content-Type': 'application/json'},
+      );
+      if (response.statusCode == 200) {
+        await _storeTokens(jsonDecode(response.body) as Map<String, dynamic>);
+      } else {
+        print('Refresh failed: status=${response.statusCode} body=${response.body}');
+      }
+    } catch (e) {
+      print('Refresh error: $e');
+    }
+    return _currentUser?.token ?? '';
+  }
+
+  Future<void> _storeTokens(Map<String, dynamic> data) async {
+    final token = data['token'] as String? ?? '';
+    final user = _currentUser;
+    if (user != null) {
+      _currentUser = User(id: user.id, username: user.username, role: data['role'] as String? ?? user.role, token: token);
+    }
+    _refreshToken = data['refresh_token'] as String?;
+    final expiresIn = data['expires_in'] as int?;
+    _expiresAt = expiresIn == null ? null : DateTime.now().add(Duration(seconds: expiresIn));
+
     final prefs = await SharedPreferences.getInstance();
-    return prefs.getString('jwt_token');
+    await prefs.setString('jwt_token', token);
+    if (_refreshToken != null) {
+      await prefs.setString('refresh_token', _refreshToken!);
+    }
+  }
+
+  Future<String?> getToken() async {
+    return accessToken();
   }
 }
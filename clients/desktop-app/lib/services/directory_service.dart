@@ -5,12 +5,13 @@ import '../models/user.dart';
 class DirectoryService {
   final String adminBaseUrl;
   final String messagingBaseUrl;
-  final String token;
+  /// Supplies the current access token, e.g. AuthService.accessToken.
+  final Future<String> Function() accessToken;
 
   DirectoryService({
     required this.adminBaseUrl,
     required this.messagingBaseUrl,
-    required this.token,
+    required this.accessToken,
   });
 
   Future<List<User>> getUsers() async {
@@ -41,6 +42,7 @@ class DirectoryService {
 
   Future<List<Map<String, dynamic>>> getChannels() async {
     try {
+      final token = await accessToken();
       final response = await http.get(
         Uri.parse('$messagingBaseUrl/channels'),
         headers: {
@@ -61,6 +63,7 @@ class DirectoryService {
 
   Future<List<Map<String, dynamic>>> getChannelMembers(String channelId) async {
     try {
+      final token = await accessToken();
       final response = await http.get(
         Uri.parse('$messagingBaseUrl/channel-members?channel_id=$channelId'),
         headers: {
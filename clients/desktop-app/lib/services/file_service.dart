@@ -8,9 +8,10 @@ class FileService {
 
   FileService({required this.baseUrl});
 
-  Future<Map<String, dynamic>?> uploadFile(File file) async {
+  Future<Map<String, dynamic>?> uploadFile(File file, {String? token}) async {
     try {
       final request = http.MultipartRequest('POST', Uri.parse('$baseUrl/upload'));
+      if (token != null) request.headers['Authorization'] = 'Bearer $token';
       request.files.add(await http.MultipartFile.fromPath('file', file.path));
 
       final streamedResponse = await request.send();
@@ -27,7 +28,9 @@ class FileService {
     }
   }
 
-  String getDownloadUrl(String fileId) {
-    return '$baseUrl/download?id=$fileId';
+  String getDownloadUrl(String fileId, {String? token}) {
+    return Uri.parse('$baseUrl/download').replace(
+      queryParameters: {'id': fileId, if (token != null) 'token': token},
+    ).toString();
   }
 }
@@ -7,7 +7,8 @@ import '../models/message.dart';
 class MessagingService {
   final String httpBaseUrl;
   final String wsBaseUrl;
-  final String token;
+  /// Supplies the current access token, e.g. AuthService.accessToken.
+  final Future<String> Function() accessToken;
 
   WebSocketChannel? _channel;
   final StreamController<Message> _messageController = StreamController<Message>.broadcast();
@@ -15,12 +16,13 @@ class MessagingService {
   MessagingService({
     required this.httpBaseUrl,
     required this.wsBaseUrl,
-    required this.token,
+    required this.accessToken,
   });
 
   Stream<Message> get messageStream => _messageController.stream;
 
-  void connect() {
+  Future<void> connect() async {
+    final token = await accessToken();
     if (token.isEmpty) {
       print('WS connect skipped: missing token');
       return;
@@ -46,6 +48,7 @@ class MessagingService {
 
   Future<List<Map<String, dynamic>>> getMyChannels() async {
     try {
+      final token = await accessToken();
       final response = await http.get(
         Uri.parse('$httpBaseUrl/channels'),
         headers: {
@@ -65,6 +68,7 @@ class MessagingService {
 
   Future<String?> createDMChannel(String targetUserId) async {
     try {
+      final token = await accessToken();
       final response = await http.post(
         Uri.parse('$httpBaseUrl/dm'),
         headers: {
@@ -86,6 +90,7 @@ class MessagingService {
 
   Future<List<Map<String, dynamic>>> getChannelMembers(String channelId) async {
     try {
+      final token = await accessToken();
       final response = await http.get(
         Uri.parse('$httpBaseUrl/channel-members?channel_id=$channelId'),
         headers: {
@@ -105,6 +110,7 @@ class MessagingService {
 
   Future<List<Message>> getHistory(String channelId) async {
     try {
+      final token = await accessToken();
       final response = await http.get(
         Uri.parse('$httpBaseUrl/history?channel_id=$channelId'),
         headers: {
@@ -125,6 +131,7 @@ class MessagingService {
 
   Future<bool> sendMessage(String channelId, String content, MessageType type) async {
     try {
+      final token = await accessToken();
       final payload = {
         'channel_id': channelId,
         'content': base64Encode(utf8.encode(content)),
@@ -48,7 +48,10 @@ class _ChatScreenState extends State<ChatScreen> {
     final result = await FilePicker.platform.pickFiles();
     if (result != null && result.files.single.path != null) {
       final file = File(result.files.single.path!);
-      final res = await _fileService.uploadFile(file);
+      final res = await _fileService.uploadFile(
+        file,
+        token: context.read<AuthService>().currentUser?.token,
+      );
       if (res != null) {
         final fileId = res['file_id'];
         final provider = context.read<ChatProvider>();
@@ -442,7 +445,11 @@ class _ChatScreenState extends State<ChatScreen> {
           IconButton(
             icon: const Icon(Icons.download, color: Colors.black54),
             onPressed: () async {
-              final url = Uri.parse('${AppConfig.fileTransferBaseUrl}/download?id=$fileId');
+              // Downloads are authorized by channel membership; a browser
+              // cannot send our Authorization header, so pass the token.
+              final url = Uri.parse('${AppConfig.fileTransferBaseUrl}/download').replace(
+                queryParameters: {'id': fileId, if (token != null) 'token': token},
+              );
               if (await canLaunchUrl(url)) {
                 await launchUrl(url, mode: LaunchMode.externalApplication);
               } else {
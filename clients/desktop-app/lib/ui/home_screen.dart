@@ -74,7 +74,7 @@ class HomeScreen extends StatelessWidget {
                   messagingService: MessagingService(
                     httpBaseUrl: AppConfig.messagingBaseUrl,
                     wsBaseUrl: AppConfig.wsMessagingBaseUrl,
-                    token: authService.currentUser!.token ?? '',
+                    accessToken: authService.accessToken,
                   ),
                 ),
               ),
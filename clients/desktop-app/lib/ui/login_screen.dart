@@ -42,23 +42,33 @@ class _LoginScreenState extends State<LoginScreen> {
     } else {
       success = await widget.authService.login(username, password);
     }
+    if (success != true && mounted && widget.authService.pendingPasswordChange != null) {
+      success = await _changePassword();
+    }
+    if (success != true && mounted) {
+      switch (widget.authService.pendingSecondFactor) {
+        case 'verify':
+          success = await _askSecondFactor();
+        case 'enroll':
+          success = await _enrollSecondFactor();
+      }
+    }
 
     setState(() => _isLoading = false);
 
     if (success == true && mounted) {
-      final user = widget.authService.currentUser!;
-      
-      // Initialize services with the authenticated user data
+      // Initialize services with the authenticated session; they ask
+      // AuthService for a fresh access token on every request.
       final msgService = MessagingService(
         httpBaseUrl: AppConfig.messagingBaseUrl,
         wsBaseUrl: AppConfig.wsMessagingBaseUrl,
-        token: user.token ?? '',
+        accessToken: widget.authService.accessToken,
       );
       
       final dirService = DirectoryService(
         adminBaseUrl: AppConfig.adminApiBaseUrl,
         messagingBaseUrl: AppConfig.messagingBaseUrl,
-        token: user.token ?? '',
+        accessToken: widget.authService.accessToken,
       );
 
       Navigator.pushReplacement(
@@ -78,6 +88,102 @@ class _LoginScreenState extends State<LoginScreen> {
     }
   }
 
+  Future<String?> _promptCode(String title, Widget? content,
+      {String hint = 'Code from your authenticator app', bool obscure = false}) {
+    final controller = TextEditingController();
+    return showDialog<String>(
+      context: context,
+      barrierDismissible: false,
+      builder: (context) => AlertDialog(
+        title: Text(title),
+        content: Column(
+          mainAxisSize: MainAxisSize.min,
+          crossAxisAlignment: CrossAxisAlignment.start,
+          children: [
+            if (content != null) content,
+            TextField(
+              controller: controller,
+              autofocus: true,
+              obscureText: obscure,
+              decoration: InputDecoration(hintText: hint),
+              onSubmitted: (v) => Navigator.pop(context, v),
+            ),
+          ],
+        ),
+        actions: [
+          TextButton(onPressed: () => Navigator.pop(context), child: const Text('Cancel')),
+          TextButton(onPressed: () => Navigator.pop(context, controller.text), child: const Text('Continue')),
+        ],
+      ),
+    );
+  }
+
+  /// Asks for a new password until the auth service accepts it. Returns
+  /// true when that also completed the login.
+  Future<bool> _changePassword() async {
+    var message = widget.authService.pendingPasswordChange == 'expired'
+        ? 'Your password has expired. Choose a new one.'
+        : 'Your password was reset. Choose a new one to continue.';
+    while (mounted) {
+      final newPassword = await _promptCode(
+        'Change password',
+        Padding(padding: const EdgeInsets.only(bottom: 12), child: Text(message)),
+        hint: 'New password',
+        obscure: true,
+      );
+      if (newPassword == null || newPassword.isEmpty) return false;
+      final problem = await widget.authService.changePasswordAtLogin(newPassword);
+      if (problem == null) {
+        _passwordController.text = newPassword;
+        return widget.authService.currentUser != null;
+      }
+      message = problem;
+    }
+    return false;
+  }
+
+  Future<bool> _askSecondFactor() async {
+    final code = await _promptCode(
+      'Two-factor authentication',
+      const Text('Enter the 6-digit code, or one of your recovery codes.'),
+    );
+    if (code == null || code.trim().isEmpty) return false;
+    return widget.authService.verifySecondFactor(code);
+  }
+
+  Future<bool> _enrollSecondFactor() async {
+    final enrollment = await widget.authService.startEnrollment();
+    if (enrollment == null || !mounted) return false;
+    final code = await _promptCode(
+      'Set up two-factor authentication',
+      Padding(
+        padding: const EdgeInsets.only(bottom: 12),
+        child: SelectableText(
+          'Your account requires two-factor authentication. Add this key to your authenticator app:\n\n'
+          '${enrollment['secret']}\n\n${enrollment['otpauth_uri']}',
+        ),
+      ),
+    );
+    if (code == null || code.trim().isEmpty) return false;
+    final recoveryCodes = await widget.authService.confirmEnrollment(code);
+    if (recoveryCodes == null || !mounted) return false;
+    await showDialog<void>(
+      context: context,
+      barrierDismissible: false,
+      builder: (context) => AlertDialog(
+        title: const Text('Save your recovery codes'),
+        content: SelectableText(
+          'Each code signs you in once if you lose your authenticator. They are not shown again.\n\n'
+          '${recoveryCodes.join('\n')}',
+        ),
+        actions: [
+          TextButton(onPressed: () => Navigator.pop(context), child: const Text('I have saved them')),
+        ],
+      ),
+    );
+    return true;
+  }
+
   void _showError(String msg) {
     ScaffoldMessenger.of(context).showSnackBar(SnackBar(
       content: Text(msg),
@@ -50,13 +50,19 @@ export default function UsersPage() {
   const save = async (e: React.FormEvent) => {
     e.preventDefault();
     if (modal === 'create') {
-      await usersApi.create({ 
-        username: form.username, 
-        full_name: form.full_name,
-        password: '123456789', // Default
-        role_id: form.role_id || undefined,
-        department_id: form.department_id || undefined
-      });
+      try {
+        // Without a password the server issues a one-time one.
+        const { data } = await usersApi.create({
+          username: form.username,
+          full_name: form.full_name,
+          role_id: form.role_id || undefined,
+          department_id: form.department_id || undefined
+        });
+        showTemporaryPassword(data.temporary_password);
+      } catch (err: any) {
+        alert(err.response?.data?.error || 'Failed to create user');
+        return;
+      }
     } else if (modal === 'edit' && selectedUser) {
       await usersApi.update(selectedUser.id, {
         username: form.username,
@@ -71,16 +77,40 @@ export default function UsersPage() {
     load();
   };
 
+  const showTemporaryPassword = (password?: string) => {
+    if (!password) return;
+    window.prompt('One-time password, shown only now. Give it to the user; they must change it at their next login.', password);
+  };
+
   const resetPassword = async (id: string) => {
-    if (!confirm('Reset password to 123456789?')) return;
+    if (!confirm('Replace this user\'s password with a one-time password? They must change it at their next login.')) return;
     try {
-      await usersApi.resetPassword(id);
-      alert('Password has been reset to 123456789');
+      const { data } = await usersApi.resetPassword(id);
+      showTemporaryPassword(data.temporary_password);
     } catch (err: any) {
       alert(err.response?.data?.error || 'Failed to reset password');
     }
   };
 
+  const resetTwoFactor = async (id: string) => {
+    if (!confirm('Remove this user\'s two-factor authentication? They must enroll again if policy requires it.')) return;
+    try {
+      const { data } = await usersApi.resetTwoFactor(id);
+      alert(data.had_2fa ? 'Two-factor authentication has been reset' : 'This user had no two-factor authentication');
+    } catch (err: any) {
+      alert(err.response?.data?.error || 'Failed to reset two-factor authentication');
+    }
+  };
+
+  const unlock = async (id: string) => {
+    try {
+      const { data } = await usersApi.unlock(id);
+      alert(data.had_failures ? 'Account unlocked' : 'This account had no failed logins');
+    } catch (err: any) {
+      alert(err.response?.data?.error || 'Failed to unlock account');
+    }
+  };
+
   const del = async (id: string) => {
     if (!confirm('Delete this user?')) return;
     await usersApi.delete(id);
@@ -124,6 +154,8 @@ export default function UsersPage() {
                   <td className="p-4 text-right space-x-3">
                     <button onClick={() => openEdit(u)} className="text-slate-600 hover:text-slate-900 font-semibold underline decoration-slate-300">Edit</button>
                     <button onClick={() => resetPassword(u.id)} className="text-orange-600 hover:text-orange-800 font-semibold underline decoration-orange-200">Reset Pwd</button>
+                    <button onClick={() => resetTwoFactor(u.id)} className="text-orange-600 hover:text-orange-800 font-semibold underline decoration-orange-200">Reset 2FA</button>
+                    <button onClick={() => unlock(u.id)} className="text-orange-600 hover:text-orange-800 font-semibold underline decoration-orange-200">Unlock</button>
                     <button onClick={() => del(u.id)} className="text-red-600 hover:text-red-800 font-semibold">Delete</button>
                   </td>
                 </tr>
@@ -143,7 +175,7 @@ export default function UsersPage() {
           <div className="bg-white rounded-xl shadow-2xl w-full max-w-md overflow-hidden animate-in fade-in zoom-in duration-200">
             <div className="p-6 border-b border-slate-100">
               <h2 className="text-xl font-bold text-slate-800">{modal === 'create' ? 'Create New User' : 'Edit User'}</h2>
-              {modal === 'create' && <p className="text-xs text-slate-400 mt-1 uppercase tracking-tighter">Password will be <span className="font-mono bg-slate-100 px-1 rounded">123456789</span></p>}
+              {modal === 'create' && <p className="text-xs text-slate-400 mt-1 uppercase tracking-tighter">A one-time password is generated and shown once</p>}
             </div>
             
             <form onSubmit={save} className="p-6 space-y-4">
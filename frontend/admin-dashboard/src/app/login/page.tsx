@@ -2,65 +2,157 @@
 
 import { useState } from 'react';
 import { useRouter } from 'next/navigation';
-import { authApi } from '@/services/api';
+import { authApi, AdminLogin, MFAChallenge } from '@/services/api';
 import { useAuthStore } from '@/store/authStore';
 
+type Step =
+  | { kind: 'password' }
+  | { kind: 'verify'; challenge: string }
+  | { kind: 'enroll'; challenge: string; secret?: string; uri?: string }
+  | { kind: 'recovery'; codes: string[]; login: AdminLogin };
+
+const errorMessage = (err: unknown, fallback: string) =>
+  (err as { response?: { data?: { error?: string } } })?.response?.data?.error ?? fallback;
+
 export default function LoginPage() {
   const router = useRouter();
   const setAuth = useAuthStore((s) => s.setAuth);
   const [username, setUsername] = useState('');
   const [password, setPassword] = useState('');
+  const [code, setCode] = useState('');
+  const [step, setStep] = useState<Step>({ kind: 'password' });
   const [error, setError] = useState('');
   const [loading, setLoading] = useState(false);
 
-  const submit = async (e: React.FormEvent) => {
-    e.preventDefault();
+  const finish = (data: AdminLogin) => {
+    setAuth(data.token, { id: data.user.id, username: data.user.username, role: data.user.role });
+    router.push('/dashboard');
+    router.refresh();
+  };
+
+  const run = async (fallback: string, action: () => Promise<void>) => {
     setError('');
     setLoading(true);
     try {
-      const { data } = await authApi.login(username, password);
-      setAuth(data.token, { id: data.user.id, username: data.user.username, role: data.user.role });
-      router.push('/dashboard');
-      router.refresh();
+      await action();
     } catch (err: unknown) {
-      setError((err as { response?: { data?: { error?: string } } })?.response?.data?.error ?? 'Login failed');
+      setError(errorMessage(err, fallback));
     } finally {
       setLoading(false);
     }
   };
 
+  const submit = (e: React.FormEvent) => {
+    e.preventDefault();
+    if (step.kind === 'password') {
+      run('Login failed', async () => {
+        const { data } = await authApi.login(username, password);
+        if ('mfa_required' in data) {
+          const challenge = (data as MFAChallenge).challenge;
+          setStep(data.purpose === 'enroll' ? { kind: 'enroll', challenge } : { kind: 'verify', challenge });
+          return;
+        }
+        finish(data);
+      });
+    } else if (step.kind === 'verify') {
+      // Authenticator codes are six digits; anything else is a recovery code.
+      const body = /^\d{6}$/.test(code.trim()) ? { code: code.trim() } : { recovery_code: code };
+      run('Invalid code', async () => {
+        const { data } = await authApi.loginMFA(step.challenge, body);
+        finish(data);
+      });
+    } else if (step.kind === 'enroll' && !step.secret) {
+      run('Could not start two-factor setup', async () => {
+        const { data } = await authApi.loginEnroll(step.challenge);
+        setStep({ ...step, secret: data.secret, uri: data.otpauth_uri });
+      });
+    } else if (step.kind === 'enroll') {
+      run('Invalid code', async () => {
+        const { data } = await authApi.loginConfirm(step.challenge, code.trim());
+        setStep({ kind: 'recovery', codes: data.recovery_codes ?? [], login: data });
+      });
+    } else if (step.kind === 'recovery') {
+      finish(step.login);
+    }
+  };
+
+  const submitLabel = {
+    password: 'Sign in',
+    verify: 'Verify',
+    enroll: step.kind === 'enroll' && step.secret ? 'Enable two-factor authentication' : 'Set up two-factor authentication',
+    recovery: 'I have saved these codes',
+  }[step.kind];
+
   return (
     <div className="min-h-screen flex items-center justify-center bg-slate-100">
       <div className="w-full max-w-sm rounded-lg border border-slate-200 bg-white p-8 shadow">
         <h1 className="text-xl font-semibold text-slate-800 mb-6">Admin Control Panel</h1>
         <form onSubmit={submit} className="space-y-4">
-          <div>
-            <label className="block text-sm font-medium text-slate-700 mb-1">Username</label>
-            <input
-              type="text"
-              value={username}
-              onChange={(e) => setUsername(e.target.value)}
-              className="w-full rounded border border-slate-300 px-3 py-2 text-slate-900"
-              required
-            />
-          </div>
-          <div>
-            <label className="block text-sm font-medium text-slate-700 mb-1">Password</label>
-            <input
-              type="password"
-              value={password}
-              onChange={(e) => setPassword(e.target.value)}
-              className="w-full rounded border border-slate-300 px-3 py-2 text-slate-900"
-              required
-            />
-          </div>
+          {step.kind === 'password' && (
+            <>
+              <div>
+                <label className="block text-sm font-medium text-slate-700 mb-1">Username</label>
+                <input
+                  type="text"
+                  value={username}
+                  onChange={(e) => setUsername(e.target.value)}
+                  className="w-full rounded border border-slate-300 px-3 py-2 text-slate-900"
+                  required
+                />
+              </div>
+              <div>
+                <label className="block text-sm font-medium text-slate-700 mb-1">Password</label>
+                <input
+                  type="password"
+                  value={password}
+                  onChange={(e) => setPassword(e.target.value)}
+                  className="w-full rounded border border-slate-300 px-3 py-2 text-slate-900"
+                  required
+                />
+              </div>
+            </>
+          )}
+          {step.kind === 'enroll' && !step.secret && (
+            <p className="text-sm text-slate-600">Your role requires two-factor authentication. Set it up to continue.</p>
+          )}
+          {step.kind === 'enroll' && step.secret && (
+            <div className="space-y-2 text-sm text-slate-600">
+              <p>Add this account to your authenticator app, using the setup key or the otpauth link, then enter the code it shows.</p>
+              <p className="font-mono break-all rounded bg-slate-100 p-2 text-slate-900">{step.secret}</p>
+              <a href={step.uri} className="block break-all text-slate-500 underline">{step.uri}</a>
+            </div>
+          )}
+          {(step.kind === 'verify' || (step.kind === 'enroll' && step.secret)) && (
+            <div>
+              <label className="block text-sm font-medium text-slate-700 mb-1">
+                {step.kind === 'verify' ? 'Authentication code or recovery code' : 'Authentication code'}
+              </label>
+              <input
+                type="text"
+                inputMode="numeric"
+                autoComplete="one-time-code"
+                value={code}
+                onChange={(e) => setCode(e.target.value)}
+                className="w-full rounded border border-slate-300 px-3 py-2 text-slate-900"
+                required
+              />
+            </div>
+          )}
+          {step.kind === 'recovery' && (
+            <div className="space-y-2 text-sm text-slate-600">
+              <p>Save these recovery codes somewhere safe. Each one signs you in once if you lose your authenticator; they are not shown again.</p>
+              <ul className="grid grid-cols-2 gap-1 font-mono text-slate-900">
+                {step.codes.map((c) => <li key={c}>{c}</li>)}
+              </ul>
+            </div>
+          )}
           {error && <p className="text-sm text-red-600">{error}</p>}
           <button
             type="submit"
             disabled={loading}
             className="w-full rounded bg-slate-800 py-2 text-white font-medium hover:bg-slate-700 disabled:opacity-50"
           >
-            {loading ? 'Signing in...' : 'Sign in'}
+            {loading ? 'Please wait...' : submitLabel}
           </button>
         </form>
       </div>
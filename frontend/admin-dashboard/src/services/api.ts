@@ -40,9 +40,18 @@ api.interceptors.response.use(
   }
 );
 
+export type AdminLogin = { token: string; user: { id: string; username: string; role: string }; expires_at: number; recovery_codes?: string[] };
+export type MFAChallenge = { mfa_required: true; challenge: string; purpose: 'verify' | 'enroll'; methods: string[]; expires_in: number };
+
 export const authApi = {
   login: (username: string, password: string) =>
-    api.post<{ token: string; user: { id: string; username: string; role: string }; expires_at: number }>('/admin/login', { username, password }),
+    api.post<AdminLogin | MFAChallenge>('/admin/login', { username, password }),
+  loginMFA: (challenge: string, code: { code?: string; recovery_code?: string }) =>
+    api.post<AdminLogin>('/admin/login/2fa', { challenge, ...code }),
+  loginEnroll: (challenge: string) =>
+    api.post<{ secret: string; otpauth_uri: string }>('/admin/login/2fa/enroll', { challenge }),
+  loginConfirm: (challenge: string, code: string) =>
+    api.post<AdminLogin>('/admin/login/2fa/confirm', { challenge, code }),
   me: () => api.get('/admin/me'),
   createAdmin: (data: { username: string; password: string; role?: string }) =>
     api.post<{ id: string; username: string; role: string }>('/admin/admins', data),
@@ -50,10 +59,19 @@ export const authApi = {
 
 export const usersApi = {
   list: () => api.get<{ users: Array<{ id: string; username: string; full_name: string; role_id: string; department_id: string; created_at: number; updated_at: number }> }>('/admin/users'),
-  create: (data: { username: string; full_name?: string; password: string; role_id?: string; department_id?: string }) => api.post('/admin/users', data),
+  create: (data: { username: string; full_name?: string; password?: string; role_id?: string; department_id?: string; must_change_password?: boolean }) =>
+    api.post<{ id: string; username: string; must_change: boolean; temporary_password?: string }>('/admin/users', data),
   update: (id: string, data: { username?: string; full_name?: string; role_id?: string; department_id?: string }) => api.put(`/admin/users/${id}`, data),
   delete: (id: string) => api.delete(`/admin/users/${id}`),
-  resetPassword: (id: string) => api.post(`/admin/users/${id}/reset-password`),
+  resetPassword: (id: string) => api.post<{ ok: boolean; temporary_password: string; must_change: boolean }>(`/admin/users/${id}/reset-password`),
+  resetTwoFactor: (id: string) => api.delete<{ ok: boolean; had_2fa: boolean }>(`/admin/users/${id}/2fa`),
+  unlock: (id: string) => api.delete<{ ok: boolean; had_failures: boolean }>(`/admin/users/${id}/lockout`),
+};
+
+export const twoFactorApi = {
+  requirements: () => api.get<{ role: string[]; department: string[]; admin_role: string[] }>('/admin/2fa/requirements'),
+  setRequirements: (data: { role: string[]; department: string[]; admin_role: string[] }) => api.put('/admin/2fa/requirements', data),
+  resetAdmin: (id: string) => api.delete(`/admin/admins/${id}/2fa`),
 };
 
 export const departmentsApi = {